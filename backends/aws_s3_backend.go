@@ -27,6 +27,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
@@ -49,6 +50,9 @@ import (
 // AWSS3BackendPrefix is the URI prefix used for the AWSS3Backend.
 const AWSS3BackendPrefix = "s3"
 
+// s3MaxCopyObjectSize is the largest object S3 will copy with a single CopyObject request.
+const s3MaxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
 // AWSS3Backend integrates with Amazon Web Services' S3.
 type AWSS3Backend struct {
 	conf       *BackendConfig
@@ -229,13 +233,19 @@ func (a *AWSS3Backend) Upload(ctx context.Context, vol *files.VolumeInfo) error
 		r = &reader{vol} // Remove the Seek interface since we are using a Pipe
 	}
 
-	// Do a MultiPart Upload - force the s3manager to compute each chunks md5 hash
-	_, err := a.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+	input := &s3manager.UploadInput{
 		Bucket:       aws.String(a.bucketName),
 		Key:          aws.String(key),
 		Body:         r,
 		StorageClass: getS3EnvironmentOverride("AWS_S3_STORAGE_CLASS"),
-	}, s3manager.WithUploaderRequestOptions(options...))
+	}
+	if files.IsVolumeObject(vol.ObjectName) {
+		// Lifecycle transitions are scoped to volumes with this tag, keeping manifests readable
+		input.Tagging = aws.String(url.Values{volumeTagKey: {volumeTagValue}}.Encode())
+	}
+
+	// Do a MultiPart Upload - force the s3manager to compute each chunks md5 hash
+	_, err := a.uploader.UploadWithContext(ctx, input, s3manager.WithUploaderRequestOptions(options...))
 
 	if err != nil {
 		log.AppLogger.Debugf("s3 backend: Error while uploading volume %s - %v", vol.ObjectName, err)
@@ -389,3 +399,192 @@ func getS3EnvironmentOverride(envVar string) *string {
 	}
 	return nil
 }
+
+// SetLifecyclePolicy will install lifecycle rules scoped to the configured prefix of the bucket, preserving
+// any other rules already configured on the bucket. Transitions only apply to the volumes, which are tagged when
+// uploaded, so manifests are never moved to a storage class they cannot be read from without a restore.
+func (a *AWSS3Backend) SetLifecyclePolicy(ctx context.Context, policy *LifecyclePolicy) error {
+	ruleID := lifecycleRuleID(a.prefix)
+	volumesRuleID := ruleID + ":volumes"
+	rules := make([]*s3.LifecycleRule, 0, 2)
+
+	resp, err := a.client.GetBucketLifecycleConfigurationWithContext(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(a.bucketName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NoSuchLifecycleConfiguration" {
+			return err
+		}
+	} else {
+		for _, rule := range resp.Rules {
+			if rule.ID != nil && (*rule.ID == ruleID || *rule.ID == volumesRuleID) {
+				continue
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	if policy.TransitionAfterDays > 0 {
+		storageClass := policy.TransitionStorageClass
+		if storageClass == "" {
+			storageClass = s3.TransitionStorageClassGlacier
+		}
+		rules = append(rules, &s3.LifecycleRule{
+			ID:     aws.String(volumesRuleID),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{And: &s3.LifecycleRuleAndOperator{
+				Prefix: aws.String(a.prefix),
+				Tags:   []*s3.Tag{{Key: aws.String(volumeTagKey), Value: aws.String(volumeTagValue)}},
+			}},
+			Transitions: []*s3.Transition{{
+				Days:         aws.Int64(int64(policy.TransitionAfterDays)),
+				StorageClass: aws.String(storageClass),
+			}},
+		})
+	}
+
+	// Aborting incomplete uploads cannot be scoped by tags, the uploads are not tagged until completed
+	if policy.AbortIncompleteUploadsAfterDays > 0 {
+		rules = append(rules, &s3.LifecycleRule{
+			ID:     aws.String(ruleID),
+			Status: aws.String(s3.ExpirationStatusEnabled),
+			Filter: &s3.LifecycleRuleFilter{Prefix: aws.String(a.prefix)},
+			AbortIncompleteMultipartUpload: &s3.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int64(int64(policy.AbortIncompleteUploadsAfterDays)),
+			},
+		})
+	}
+
+	if len(rules) == 0 {
+		_, err = a.client.DeleteBucketLifecycleWithContext(ctx, &s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(a.bucketName),
+		})
+		return err
+	}
+
+	_, err = a.client.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(a.bucketName),
+		LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err != nil {
+		log.AppLogger.Debugf("s3 backend: Error while setting lifecycle configuration on bucket %s - %v", a.bucketName, err)
+	}
+	return err
+}
+
+// CopyFrom will copy the named object from the provided source backend into this AWSS3Backend's configured
+// bucket+prefix using a server-side copy. ErrUnsupported is returned if the source is not an S3 backend or if
+// the object is too large to be copied in a single request.
+func (a *AWSS3Backend) CopyFrom(ctx context.Context, source Backend, name string) error {
+	src, ok := source.(*AWSS3Backend)
+	if !ok {
+		return ErrUnsupported
+	}
+
+	srcKey := src.prefix + name
+	resp, err := src.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(src.bucketName),
+		Key:    aws.String(srcKey),
+	})
+	if err != nil {
+		return err
+	}
+	if resp.ContentLength != nil && *resp.ContentLength > s3MaxCopyObjectSize {
+		return ErrUnsupported
+	}
+
+	_, err = a.client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:       aws.String(a.bucketName),
+		Key:          aws.String(a.prefix + name),
+		CopySource:   aws.String(url.PathEscape(src.bucketName + "/" + srcKey)),
+		StorageClass: getS3EnvironmentOverride("AWS_S3_STORAGE_CLASS"),
+	}, withRequestLimiter(a.conf.MaxParallelUploadBuffer))
+	if err != nil {
+		log.AppLogger.Debugf("s3 backend: Error while copying object %s - %v", name, err)
+	}
+	return err
+}
+
+// PresignURL will generate a pre-signed URL that can be used to download the named object until it expires.
+func (a *AWSS3Backend) PresignURL(ctx context.Context, name string, expires time.Duration) (string, error) {
+	req, _ := a.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(a.prefix + name),
+	})
+	req.SetContext(ctx)
+	return req.Presign(expires)
+}
+
+// ListVersions will iterate through all object versions in the configured AWS S3 bucket and return
+// them, filtering by the provided prefix. Delete markers are not included.
+func (a *AWSS3Backend) ListVersions(ctx context.Context, prefix string) ([]ObjectVersion, error) {
+	l := make([]ObjectVersion, 0, 1000)
+	input := &s3.ListObjectVersionsInput{
+		Bucket:  aws.String(a.bucketName),
+		MaxKeys: aws.Int64(1000),
+		Prefix:  aws.String(a.prefix + prefix),
+	}
+	for {
+		resp, err := a.client.ListObjectVersionsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range resp.Versions {
+			l = append(l, ObjectVersion{
+				Name:         strings.TrimPrefix(aws.StringValue(v.Key), a.prefix),
+				VersionID:    aws.StringValue(v.VersionId),
+				LastModified: aws.TimeValue(v.LastModified),
+				IsLatest:     aws.BoolValue(v.IsLatest),
+			})
+		}
+
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		input.KeyMarker = resp.NextKeyMarker
+		input.VersionIdMarker = resp.NextVersionIdMarker
+	}
+
+	return l, nil
+}
+
+// DownloadVersion will download the requested version of an object which can be read from the returned io.ReadCloser
+func (a *AWSS3Backend) DownloadVersion(ctx context.Context, key, versionID string) (io.ReadCloser, error) {
+	resp, err := a.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:    aws.String(a.bucketName),
+		Key:       aws.String(a.prefix + key),
+		VersionId: aws.String(versionID),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat will return the metadata S3 holds for the given key. The MD5 sum is only reported
+// for objects that were not uploaded in multiple parts.
+func (a *AWSS3Backend) Stat(ctx context.Context, key string) (*ObjectInfo, error) {
+	resp, err := a.client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(a.bucketName),
+		Key:    aws.String(a.prefix + key),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	info := &ObjectInfo{
+		Name:         key,
+		Size:         aws.Int64Value(resp.ContentLength),
+		StorageClass: aws.StringValue(resp.StorageClass),
+	}
+	if info.StorageClass == "" {
+		info.StorageClass = s3.ObjectStorageClassStandard
+	}
+	// The ETag is only the MD5 of the content for objects uploaded in a single part, and encrypted with SSE-S3 if at all
+	encrypted := strings.HasPrefix(aws.StringValue(resp.ServerSideEncryption), "aws:kms") || resp.SSECustomerAlgorithm != nil
+	if etag := strings.Trim(aws.StringValue(resp.ETag), "\""); !strings.Contains(etag, "-") && !encrypted {
+		info.MD5Sum = etag
+	}
+	return info, nil
+}
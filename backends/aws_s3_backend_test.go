@@ -27,10 +27,13 @@ import (
 	"context"
 	"os"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -45,10 +48,14 @@ type mockS3Client struct {
 	s3iface.S3API
 
 	headcallcount int
+	lifecycle     *s3.BucketLifecycleConfiguration
+	copySource    string
 }
 
 type mockS3Uploader struct {
 	s3manageriface.UploaderAPI
+
+	tagging map[string]*string
 }
 
 var (
@@ -147,6 +154,29 @@ func (m *mockS3Client) HeadObjectWithContext(ctx aws.Context, in *s3.HeadObjectI
 			ContentLength: aws.Int64(50),
 			Restore:       aws.String("ongoing-request=\"false\", expiry-date=\"Wed, 07 Nov 2012 00:00:00 GMT\""),
 		}, nil
+	case "sses3":
+		return &s3.HeadObjectOutput{
+			ContentLength:        aws.Int64(5),
+			ETag:                 aws.String("\"5d41402abc4b2a76b9719d911017c592\""),
+			ServerSideEncryption: aws.String(s3.ServerSideEncryptionAes256),
+		}, nil
+	case "multipart":
+		return &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(5),
+			ETag:          aws.String("\"d41d8cd98f00b204e9800998ecf8427e-2\""),
+		}, nil
+	case "ssekms":
+		return &s3.HeadObjectOutput{
+			ContentLength:        aws.Int64(5),
+			ETag:                 aws.String("\"6b2c2f2e8ee4b34a8bcb6b0c7d3a7f21\""),
+			ServerSideEncryption: aws.String(s3.ServerSideEncryptionAwsKms),
+		}, nil
+	case "ssec":
+		return &s3.HeadObjectOutput{
+			ContentLength:        aws.Int64(5),
+			ETag:                 aws.String("\"0b7e3d3bfc8f5d1c5e6b2a1a4b6f0e9c\""),
+			SSECustomerAlgorithm: aws.String("AES256"),
+		}, nil
 	default:
 		return &s3.HeadObjectOutput{
 			StorageClass:  aws.String(s3.ObjectStorageClassStandard),
@@ -169,6 +199,64 @@ func (m *mockS3Client) RestoreObjectWithContext(
 	return nil, nil
 }
 
+func (m *mockS3Client) GetBucketLifecycleConfigurationWithContext(
+	ctx aws.Context,
+	in *s3.GetBucketLifecycleConfigurationInput,
+	_ ...request.Option,
+) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if m.lifecycle == nil {
+		return nil, awserr.New("NoSuchLifecycleConfiguration", "", errTest)
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: m.lifecycle.Rules}, nil
+}
+
+func (m *mockS3Client) PutBucketLifecycleConfigurationWithContext(
+	ctx aws.Context,
+	in *s3.PutBucketLifecycleConfigurationInput,
+	_ ...request.Option,
+) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	if *in.Bucket == s3BadBucket {
+		return nil, errTest
+	}
+	m.lifecycle = in.LifecycleConfiguration
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+func (m *mockS3Client) CopyObjectWithContext(ctx aws.Context, in *s3.CopyObjectInput, _ ...request.Option) (*s3.CopyObjectOutput, error) {
+	if *in.Key == s3BadKey {
+		return nil, errTest
+	}
+	m.copySource = *in.CopySource
+	return &s3.CopyObjectOutput{}, nil
+}
+
+func (m *mockS3Client) ListObjectVersionsWithContext(
+	ctx aws.Context,
+	in *s3.ListObjectVersionsInput,
+	_ ...request.Option,
+) (*s3.ListObjectVersionsOutput, error) {
+	if *in.Bucket == s3BadBucket {
+		return nil, errTest
+	}
+
+	if in.KeyMarker == nil {
+		return &s3.ListObjectVersionsOutput{
+			IsTruncated:         aws.Bool(true),
+			NextKeyMarker:       aws.String("manifest"),
+			NextVersionIdMarker: aws.String("v2"),
+			Versions: []*s3.ObjectVersion{
+				{Key: aws.String(*in.Prefix + "manifest"), VersionId: aws.String("v2"), IsLatest: aws.Bool(true)},
+			},
+		}, nil
+	}
+	return &s3.ListObjectVersionsOutput{
+		IsTruncated: aws.Bool(false),
+		Versions: []*s3.ObjectVersion{
+			{Key: aws.String(*in.Prefix + "manifest"), VersionId: aws.String("v1"), IsLatest: aws.Bool(false)},
+		},
+	}, nil
+}
+
 func (m *mockS3Uploader) UploadWithContext(
 	ctx aws.Context,
 	in *s3manager.UploadInput,
@@ -177,6 +265,9 @@ func (m *mockS3Uploader) UploadWithContext(
 	if *in.Key == s3BadKey {
 		return nil, errTest
 	}
+	if m.tagging != nil {
+		m.tagging[*in.Key] = in.Tagging
+	}
 	return nil, nil
 }
 
@@ -400,6 +491,40 @@ func TestS3Upload(t *testing.T) {
 	}
 }
 
+func TestS3UploadTagsVolumes(t *testing.T) {
+	_, vol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volume for testing - %v", err)
+	}
+
+	uploader := &mockS3Uploader{tagging: make(map[string]*string)}
+	b := &AWSS3Backend{}
+	conf := &BackendConfig{TargetURI: AWSS3BackendPrefix + "://goodbucket/prefix/"}
+	if err = b.Init(context.Background(), conf, WithS3Client(&mockS3Client{}), WithS3Uploader(uploader)); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+
+	for name, tagged := range map[string]bool{
+		"tank/data|snap.zstream.gz.vol1":                 true,
+		"host/objects/ab/abcdef.zstream.zst.age":         true,
+		"tank/data|snap.manifest.zstream.gz.vol2":        true,
+		"manifests|tank/data|snap.manifest.gz":           false,
+		"manifests|tank/data|snap.zstream.manifest.gz":   false,
+		"manifests|tank/data|snap.manifest.gz.sig":       false,
+		"index|tank/data.index.gz":                       false,
+		"locks|tank/data.lock":                           false,
+		"generations|manifests|tank/data|snap.gz|000001": false,
+	} {
+		vol.ObjectName = name
+		if err = b.Upload(context.Background(), vol); err != nil {
+			t.Fatalf("Did not get expected nil error uploading %s, got %v instead", name, err)
+		}
+		if tagging := uploader.tagging["prefix/"+name]; (tagging != nil && *tagging == "zfsbackup-object=volume") != tagged {
+			t.Errorf("Expected %s to be tagged as a volume %v, got tagging %v", name, tagged, aws.StringValue(tagging))
+		}
+	}
+}
+
 func TestS3List(t *testing.T) {
 	testCases := []struct {
 		conf    *BackendConfig
@@ -478,6 +603,173 @@ func TestS3PreDownload(t *testing.T) {
 	}
 }
 
+func TestS3SetLifecyclePolicy(t *testing.T) {
+	client := &mockS3Client{
+		lifecycle: &s3.BucketLifecycleConfiguration{
+			Rules: []*s3.LifecycleRule{
+				{ID: aws.String("unrelated")},
+				{ID: aws.String(lifecycleRuleID("prefix/"))},
+			},
+		},
+	}
+
+	b := &AWSS3Backend{}
+	conf := &BackendConfig{TargetURI: AWSS3BackendPrefix + "://goodbucket/prefix/"}
+	if err := b.Init(context.Background(), conf, WithS3Client(client), WithS3Uploader(&mockS3Uploader{})); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+
+	policy := &LifecyclePolicy{TransitionAfterDays: 30, AbortIncompleteUploadsAfterDays: 7}
+	if err := b.SetLifecyclePolicy(context.Background(), policy); err != nil {
+		t.Fatalf("Did not get expected nil error, got %v instead", err)
+	}
+
+	if len(client.lifecycle.Rules) != 3 {
+		t.Fatalf("Expected 3 lifecycle rules, got %d instead", len(client.lifecycle.Rules))
+	}
+
+	transition, abort := client.lifecycle.Rules[1], client.lifecycle.Rules[2]
+	if *client.lifecycle.Rules[0].ID != "unrelated" || *transition.ID != lifecycleRuleID("prefix/")+":volumes" || *abort.ID != lifecycleRuleID("prefix/") {
+		t.Errorf("Existing lifecycle rules were not preserved/replaced as expected")
+	}
+	filter := transition.Filter.And
+	if filter == nil || *filter.Prefix != "prefix/" || len(filter.Tags) != 1 ||
+		*filter.Tags[0].Key != volumeTagKey || *filter.Tags[0].Value != volumeTagValue {
+		t.Errorf("Expected the transition to be scoped to the volumes under 'prefix/', got %v", transition.Filter)
+	}
+	if len(transition.Transitions) != 1 || *transition.Transitions[0].Days != 30 || *transition.Transitions[0].StorageClass != s3.TransitionStorageClassGlacier {
+		t.Errorf("Expected a single transition to GLACIER after 30 days, got %v", transition.Transitions)
+	}
+	for _, rule := range client.lifecycle.Rules[1:] {
+		if rule.Expiration != nil {
+			t.Errorf("Expected no expiration to be set, got %v", rule.Expiration)
+		}
+	}
+	if *abort.Filter.Prefix != "prefix/" || *abort.AbortIncompleteMultipartUpload.DaysAfterInitiation != 7 || abort.Transitions != nil {
+		t.Errorf("Expected incomplete uploads under 'prefix/' to be aborted after 7 days, got %v", abort)
+	}
+
+	// Installing the policy again replaces both rules, and without a transition, leaves only the abort rule
+	policy.TransitionAfterDays = 0
+	if err := b.SetLifecyclePolicy(context.Background(), policy); err != nil {
+		t.Fatalf("Did not get expected nil error, got %v instead", err)
+	}
+	if len(client.lifecycle.Rules) != 2 || *client.lifecycle.Rules[1].ID != lifecycleRuleID("prefix/") {
+		t.Errorf("Expected the transition rule to be removed, got %v", client.lifecycle.Rules)
+	}
+}
+
+func TestS3CopyFrom(t *testing.T) {
+	client := &mockS3Client{}
+	opts := []Option{WithS3Client(client), WithS3Uploader(&mockS3Uploader{})}
+
+	src := &AWSS3Backend{}
+	if err := src.Init(context.Background(), &BackendConfig{TargetURI: AWSS3BackendPrefix + "://srcbucket/src|"}, opts...); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+
+	dst := &AWSS3Backend{}
+	conf := &BackendConfig{
+		TargetURI:               AWSS3BackendPrefix + "://dstbucket",
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := dst.Init(context.Background(), conf, opts...); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+
+	if err := dst.CopyFrom(context.Background(), src, "good"); err != nil {
+		t.Errorf("Did not get expected nil error, got %v instead", err)
+	}
+	if client.copySource != "srcbucket%2Fsrc%7Cgood" {
+		t.Errorf("Expected escaped copy source 'srcbucket%%2Fsrc%%7Cgood', got '%s' instead", client.copySource)
+	}
+
+	if err := dst.CopyFrom(context.Background(), src, s3BadKey); err != errTest {
+		t.Errorf("Expected error %v, got %v instead", errTest, err)
+	}
+
+	if err := dst.CopyFrom(context.Background(), &FileBackend{}, "good"); err != ErrUnsupported {
+		t.Errorf("Expected error %v, got %v instead", ErrUnsupported, err)
+	}
+}
+
+func TestS3Stat(t *testing.T) {
+	b := &AWSS3Backend{}
+	opts := []Option{WithS3Client(&mockS3Client{}), WithS3Uploader(&mockS3Uploader{})}
+	if err := b.Init(context.Background(), &BackendConfig{TargetURI: AWSS3BackendPrefix + "://bucket"}, opts...); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+
+	testCases := []struct {
+		key    string
+		md5Sum string
+	}{
+		{key: "sses3", md5Sum: "5d41402abc4b2a76b9719d911017c592"},
+		{key: "multipart"},
+		{key: "ssekms"},
+		{key: "ssec"},
+	}
+	for _, testCase := range testCases {
+		info, err := b.Stat(context.Background(), testCase.key)
+		if err != nil {
+			t.Errorf("%s: Did not get expected nil error, got %v instead", testCase.key, err)
+			continue
+		}
+		if info.Size != 5 || info.MD5Sum != testCase.md5Sum || info.StorageClass != s3.ObjectStorageClassStandard {
+			t.Errorf("%s: Expected a 5 byte standard object with the MD5 sum %q, got %+v", testCase.key, testCase.md5Sum, info)
+		}
+	}
+
+	if _, err := b.Stat(context.Background(), s3BadKey); err != errTest {
+		t.Errorf("Expected error %v, got %v instead", errTest, err)
+	}
+}
+
+func TestS3PresignURL(t *testing.T) {
+	sess, err := session.NewSession(aws.NewConfig().
+		WithRegion("us-east-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")))
+	if err != nil {
+		t.Fatalf("Error while creating session: %v", err)
+	}
+
+	b := &AWSS3Backend{client: s3.New(sess), bucketName: "goodbucket", prefix: "prefix/"}
+	u, err := b.PresignURL(context.Background(), "object", time.Hour)
+	if err != nil {
+		t.Fatalf("Did not get expected nil error, got %v instead", err)
+	}
+
+	if !strings.Contains(u, "goodbucket") || !strings.Contains(u, "prefix/object") {
+		t.Errorf("Expected URL to reference the bucket and prefixed key, got %s instead", u)
+	}
+	if !strings.Contains(u, "X-Amz-Expires=3600") || !strings.Contains(u, "X-Amz-Signature=") {
+		t.Errorf("Expected a signed URL valid for an hour, got %s instead", u)
+	}
+}
+
+func TestS3ListVersions(t *testing.T) {
+	b := &AWSS3Backend{}
+	conf := &BackendConfig{TargetURI: AWSS3BackendPrefix + "://goodbucket/prefix/"}
+	if err := b.Init(context.Background(), conf, getOptions()...); err != nil {
+		t.Fatalf("Did not get expected nil error on Init, got %v instead", err)
+	}
+
+	versions, err := b.ListVersions(context.Background(), "")
+	if err != nil {
+		t.Fatalf("Did not get expected nil error, got %v instead", err)
+	}
+
+	if len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, got %d instead", len(versions))
+	}
+	if versions[0].Name != "manifest" || versions[0].VersionID != "v2" || !versions[0].IsLatest {
+		t.Errorf("Unexpected first version %+v", versions[0])
+	}
+	if versions[1].Name != "manifest" || versions[1].VersionID != "v1" || versions[1].IsLatest {
+		t.Errorf("Unexpected second version %+v", versions[1])
+	}
+}
+
 func TestS3Backend(t *testing.T) {
 	t.Parallel()
 
@@ -33,6 +33,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/pkg/errors"
@@ -46,6 +47,8 @@ import (
 const (
 	AzureBackendPrefix = "azure"
 	blobAPIURL         = "blob.core.windows.net"
+
+	azureCopyPollInterval = 5 * time.Second
 )
 
 var errContainerMismatch = errors.New("container name in SAS URI is different than destination container provided")
@@ -279,3 +282,145 @@ func (a *AzureBackend) List(ctx context.Context, prefix string) ([]string, error
 
 	return l, nil
 }
+
+// CopyFrom will copy the named object from the provided source backend into this AzureBackend's configured
+// container+prefix using a server-side copy. ErrUnsupported is returned if the source is not an Azure backend
+// that this backend's credentials can read from.
+func (a *AzureBackend) CopyFrom(ctx context.Context, source Backend, name string) error {
+	src, ok := source.(*AzureBackend)
+	if !ok || (src.containersas == "" && src.accountName != a.accountName) {
+		return ErrUnsupported
+	}
+
+	srcURL := src.containerSvc.NewBlobURL(src.prefix + name).URL()
+	blobURL := a.containerSvc.NewBlobURL(a.prefix + name)
+	resp, err := blobURL.StartCopyFromURL(
+		ctx,
+		srcURL,
+		azblob.Metadata{},
+		azblob.ModifiedAccessConditions{},
+		azblob.BlobAccessConditions{},
+		azblob.DefaultAccessTier,
+		azblob.BlobTagsMap{},
+	)
+	if err != nil {
+		log.AppLogger.Debugf("azure backend: Error while starting copy of object %s - %v", name, err)
+		return err
+	}
+
+	status := resp.CopyStatus()
+	for status == azblob.CopyStatusPending {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(azureCopyPollInterval):
+		}
+
+		props, perr := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if perr != nil {
+			return perr
+		}
+		status = props.CopyStatus()
+		if status != azblob.CopyStatusPending && status != azblob.CopyStatusSuccess {
+			return fmt.Errorf("azure backend: copy of object %s finished with status %s - %s", name, status, props.CopyStatusDescription())
+		}
+	}
+
+	if status != azblob.CopyStatusSuccess {
+		return fmt.Errorf("azure backend: copy of object %s finished with status %s", name, status)
+	}
+	return nil
+}
+
+// PresignURL will generate a URL with a blob scoped, read-only SAS token that can be used to download the named
+// object until it expires. ErrUnsupported is returned when authenticating with a SAS URI as no account key is
+// available to sign with.
+func (a *AzureBackend) PresignURL(ctx context.Context, name string, expires time.Duration) (string, error) {
+	if a.containersas != "" {
+		return "", ErrUnsupported
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(a.accountName, a.accountKey)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to initilze Azure credential")
+	}
+
+	protocol := azblob.SASProtocolHTTPSandHTTP
+	if strings.HasPrefix(a.azureURL, "https://") {
+		protocol = azblob.SASProtocolHTTPS
+	}
+
+	sas, err := azblob.BlobSASSignatureValues{
+		Protocol:      protocol,
+		ExpiryTime:    time.Now().UTC().Add(expires),
+		ContainerName: a.containerName,
+		BlobName:      a.prefix + name,
+		Permissions:   azblob.BlobSASPermissions{Read: true}.String(),
+	}.NewSASQueryParameters(credential)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to sign SAS token")
+	}
+
+	blobURL := a.containerSvc.NewBlobURL(a.prefix + name).URL()
+	blobURL.RawQuery = sas.Encode()
+	return blobURL.String(), nil
+}
+
+// ListVersions will iterate through all blob versions in the configured Azure Storage Container and return
+// them, filtering by the provided prefix.
+func (a *AzureBackend) ListVersions(ctx context.Context, prefix string) ([]ObjectVersion, error) {
+	l := make([]ObjectVersion, 0, 5000)
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := a.containerSvc.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Details:    azblob.BlobListingDetails{Versions: true},
+			Prefix:     a.prefix + prefix,
+			MaxResults: 5000,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "error while listing blob versions from container")
+		}
+
+		for _, item := range resp.Segment.BlobItems {
+			v := ObjectVersion{
+				Name:         strings.TrimPrefix(item.Name, a.prefix),
+				LastModified: item.Properties.LastModified,
+				IsLatest:     item.IsCurrentVersion == nil || *item.IsCurrentVersion,
+			}
+			if item.VersionID != nil {
+				v.VersionID = *item.VersionID
+			}
+			l = append(l, v)
+		}
+
+		marker = resp.NextMarker
+	}
+
+	return l, nil
+}
+
+// DownloadVersion will download the requested version of a blob which can be read from the returned io.ReadCloser
+func (a *AzureBackend) DownloadVersion(ctx context.Context, name, versionID string) (io.ReadCloser, error) {
+	blobURL := a.containerSvc.NewBlobURL(a.prefix + name).WithVersionID(versionID)
+	resp, err := blobURL.Download(ctx, int64(0), int64(0), azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// Stat will return the metadata Azure holds for the given blob.
+func (a *AzureBackend) Stat(ctx context.Context, name string) (*ObjectInfo, error) {
+	blobURL := a.containerSvc.NewBlobURL(a.prefix + name)
+	props, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Name:         name,
+		Size:         props.ContentLength(),
+		MD5Sum:       hex.EncodeToString(props.ContentMD5()),
+		StorageClass: props.AccessTier(),
+	}, nil
+}
@@ -23,10 +23,14 @@ package backends
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/files"
 )
 
@@ -57,13 +61,135 @@ type BackendConfig struct {
 	UploadChunkSize         int
 }
 
+// LifecyclePolicy describes the lifecycle rules a target should apply to the objects stored under its prefix.
+// Only volumes are transitioned to a colder storage class, manifests must stay readable. Nothing is ever expired,
+// as incremental backups may depend on volumes of any age, prune removes the backup sets no longer needed instead.
+// A zero value for any of the day counts disables that part of the policy.
+type LifecyclePolicy struct {
+	TransitionAfterDays             int
+	TransitionStorageClass          string
+	AbortIncompleteUploadsAfterDays int
+}
+
+// The tag volumes are uploaded to S3 with, which its lifecycle rules use to only transition volumes.
+const (
+	volumeTagKey   = "zfsbackup-object"
+	volumeTagValue = "volume"
+)
+
+// LifecycleManager is implemented by backends that can install lifecycle rules on their target.
+type LifecycleManager interface {
+	SetLifecyclePolicy(ctx context.Context, policy *LifecyclePolicy) error // Install (or replace) the lifecycle rule for the configured prefix
+}
+
+// ServerSideCopier is implemented by backends that can copy objects directly from another backend of the same provider.
+// nolint:lll // It's neater this way
+type ServerSideCopier interface {
+	CopyFrom(ctx context.Context, source Backend, name string) error // Copy the named object from the source backend without routing it through this machine
+}
+
+// Presigner is implemented by backends that can generate time-limited URLs granting read access to an object.
+// nolint:lll // It's neater this way
+type Presigner interface {
+	PresignURL(ctx context.Context, name string, expires time.Duration) (string, error) // Generate a URL that can be used to download the named object until it expires
+}
+
+// ObjectVersion describes a single version of an object stored in a target with versioning enabled.
+type ObjectVersion struct {
+	Name         string
+	VersionID    string
+	LastModified time.Time
+	IsLatest     bool
+}
+
+// VersionedBackend is implemented by backends that can access previous versions of objects when the target keeps them.
+// nolint:lll // It's neater this way
+type VersionedBackend interface {
+	ListVersions(ctx context.Context, prefix string) ([]ObjectVersion, error)               // Lists all versions of the objects in the backend, filtering by the provided prefix.
+	DownloadVersion(ctx context.Context, filename, versionID string) (io.ReadCloser, error) // Download the requested version of a file that can be read from the returned io.ReaderCloser
+}
+
+// ObjectInfo describes an object stored in a target. Fields that a target cannot report are left empty.
+type ObjectInfo struct {
+	Name         string
+	Size         int64
+	MD5Sum       string // hex encoded
+	StorageClass string
+}
+
+// Stater is implemented by backends that can report metadata about a stored object without downloading it.
+type Stater interface {
+	Stat(ctx context.Context, name string) (*ObjectInfo, error) // Return the metadata of the named object
+}
+
 var (
 	// ErrInvalidURI is returned when a backend determines that the provided URI is malformed/invalid.
 	ErrInvalidURI = errors.New("backends: invalid URI provided to backend")
 	// ErrInvalidPrefix is returned when a backend destination is provided with a URI prefix that isn't registered.
 	ErrInvalidPrefix = errors.New("backends: the provided prefix does not exist")
+	// ErrUnsupported is returned when a backend is asked to do something its target cannot support.
+	ErrUnsupported = errors.New("backends: operation not supported by this backend")
 )
 
+// TargetOptions holds per-target overrides provided as query parameters on a target URI,
+// e.g. s3://bucket/prefix?maxParallel=8&priority=10
+type TargetOptions struct {
+	MaxParallelUploads int // Overrides the global maximum number of parallel uploads when greater than 0
+	Priority           int // Targets with a higher priority are uploaded to first
+}
+
+// ParseTargetURI will split any per-target options off of the provided URI, returning the URI
+// the backend should be initialized with along with the options found. As in any URL, the options
+// are the query starting at the first '?', so a '?' cannot appear in the path or prefix of a target.
+func ParseTargetURI(uri string) (string, *TargetOptions, error) {
+	opts := &TargetOptions{}
+	if !strings.Contains(uri, "?") {
+		return uri, opts, nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", nil, ErrInvalidURI
+	}
+	if u.RawQuery == "" {
+		return strings.TrimSuffix(uri, "?"), opts, nil
+	}
+	idx := strings.Index(uri, "?"+u.RawQuery)
+
+	values, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return "", nil, ErrInvalidURI
+	}
+
+	for key := range values {
+		value, perr := strconv.Atoi(values.Get(key))
+		if perr != nil {
+			return "", nil, fmt.Errorf("backends: invalid value for target option %s - %v", key, perr)
+		}
+		switch key {
+		case "maxParallel":
+			if value < 1 {
+				return "", nil, fmt.Errorf("backends: target option maxParallel must be greater than 0, was given %d", value)
+			}
+			opts.MaxParallelUploads = value
+		case "priority":
+			opts.Priority = value
+		default:
+			return "", nil, fmt.Errorf("backends: unknown target option %s, a '?' starts the target options and cannot appear in a path", key)
+		}
+	}
+
+	return uri[:idx], opts, nil
+}
+
+// lifecycleRuleID returns the identifier used for lifecycle rules installed by this application.
+func lifecycleRuleID(prefix string) string {
+	if prefix == "" {
+		return config.ProgramName
+	}
+	return config.ProgramName + ":" + prefix
+}
+
 // GetBackendForURI will try and parse the URI for a matching backend to use.
 func GetBackendForURI(uri string) (Backend, error) {
 	prefix := strings.Split(uri, "://")
@@ -84,6 +210,8 @@ func GetBackendForURI(uri string) (Backend, error) {
 		return &AzureBackend{}, nil
 	case B2BackendPrefix:
 		return &B2Backend{}, nil
+	case StripedBackendPrefix:
+		return &StripedBackend{}, nil
 	default:
 		return nil, ErrInvalidPrefix
 	}
@@ -243,3 +243,50 @@ func BackendTest(ctx context.Context, prefix, uri string, skipPrefix bool, b Bac
 		})
 	}
 }
+
+func TestParseTargetURI(t *testing.T) {
+	testCases := []struct {
+		uri      string
+		expected string
+		opts     TargetOptions
+		valid    bool
+	}{
+		{uri: "s3://bucket/prefix", expected: "s3://bucket/prefix", valid: true},
+		{uri: "s3://bucket?maxParallel=8", expected: "s3://bucket", opts: TargetOptions{MaxParallelUploads: 8}, valid: true},
+		{uri: "azure://ct?maxParallel=2&priority=-1", expected: "azure://ct", opts: TargetOptions{MaxParallelUploads: 2, Priority: -1}, valid: true},
+		{uri: "s3://bucket?maxParallel=0"},
+		{uri: "s3://bucket?maxParallel=fast"},
+		{uri: "s3://bucket?unknown=1"},
+		{uri: "s3://bucket?", expected: "s3://bucket", valid: true},
+		{uri: "file:///backups/what?/day?maxParallel=8"},
+		{
+			uri:      "s3://bucket/what?maxParallel=8&priority=2",
+			expected: "s3://bucket/what",
+			opts:     TargetOptions{MaxParallelUploads: 8, Priority: 2},
+			valid:    true,
+		},
+		{
+			uri:      "stripe://1/s3://bucket/prefix|gs://bucket|file:///backups?maxParallel=2",
+			expected: "stripe://1/s3://bucket/prefix|gs://bucket|file:///backups",
+			opts:     TargetOptions{MaxParallelUploads: 2},
+			valid:    true,
+		},
+	}
+
+	for idx, testCase := range testCases {
+		uri, opts, err := ParseTargetURI(testCase.uri)
+		if !testCase.valid {
+			if err == nil {
+				t.Errorf("%d: Expected error parsing %s, got nil", idx, testCase.uri)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: Expected nil error parsing %s, got %v", idx, testCase.uri, err)
+			continue
+		}
+		if uri != testCase.expected || *opts != testCase.opts {
+			t.Errorf("%d: Expected %s %+v, got %s %+v", idx, testCase.expected, testCase.opts, uri, *opts)
+		}
+	}
+}
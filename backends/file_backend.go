@@ -22,6 +22,8 @@ package backends
 
 import (
 	"context"
+	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"encoding/hex"
 	"io"
 	"os"
 	"path/filepath"
@@ -143,3 +145,25 @@ func (f *FileBackend) List(ctx context.Context, prefix string) ([]string, error)
 
 	return l, err
 }
+
+// Stat will return the size of the file along with its MD5 sum, which is computed by reading the file.
+func (f *FileBackend) Stat(ctx context.Context, filename string) (*ObjectInfo, error) {
+	r, err := os.Open(filepath.Join(f.localPath, filename))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	// nolint:gosec // MD5 not used for cryptographic purposes here
+	md5Raw := md5.New()
+	size, err := io.Copy(md5Raw, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Name:   filename,
+		Size:   size,
+		MD5Sum: hex.EncodeToString(md5Raw.Sum(nil)),
+	}, nil
+}
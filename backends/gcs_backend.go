@@ -22,9 +22,13 @@ package backends
 
 import (
 	"context"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"google.golang.org/api/iterator"
@@ -113,6 +117,10 @@ func (g *GoogleCloudStorageBackend) Upload(ctx context.Context, vol *files.Volum
 	w.CRC32C = vol.CRC32CSum32
 	w.SendCRC32C = true
 	w.ChunkSize = g.conf.UploadChunkSize
+	if files.IsVolumeObject(vol.ObjectName) {
+		// Lifecycle transitions are conditioned on the custom time, which only volumes have, keeping manifests readable
+		w.CustomTime = time.Now()
+	}
 
 	if _, err := io.Copy(w, vol); err != nil {
 		log.AppLogger.Debugf("gs backend: Error while uploading volume %s - %v", vol.ObjectName, err)
@@ -163,3 +171,150 @@ func (g *GoogleCloudStorageBackend) List(ctx context.Context, prefix string) ([]
 	}
 	return l, nil
 }
+
+// SetLifecyclePolicy will install lifecycle rules matching the configured prefix of the bucket, preserving
+// any other rules already configured on the bucket. Transitions are conditioned on the custom time volumes are
+// uploaded with, so manifests are never moved to a storage class.
+func (g *GoogleCloudStorageBackend) SetLifecyclePolicy(ctx context.Context, policy *LifecyclePolicy) error {
+	bucket := g.client.Bucket(g.bucketName)
+	attrs, err := bucket.Attrs(ctx)
+	if err != nil {
+		return err
+	}
+
+	var matchesPrefix []string
+	if g.prefix != "" {
+		matchesPrefix = []string{g.prefix}
+	}
+
+	var managed []storage.LifecycleRule
+	if policy.TransitionAfterDays > 0 {
+		storageClass := policy.TransitionStorageClass
+		if storageClass == "" {
+			storageClass = "COLDLINE"
+		}
+		managed = append(managed, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: storageClass},
+			Condition: storage.LifecycleCondition{DaysSinceCustomTime: int64(policy.TransitionAfterDays), MatchesPrefix: matchesPrefix},
+		})
+	}
+
+	if policy.AbortIncompleteUploadsAfterDays > 0 {
+		managed = append(managed, storage.LifecycleRule{
+			Action:    storage.LifecycleAction{Type: storage.AbortIncompleteMPUAction},
+			Condition: storage.LifecycleCondition{AgeInDays: int64(policy.AbortIncompleteUploadsAfterDays), MatchesPrefix: matchesPrefix},
+		})
+	}
+
+	rules := make([]storage.LifecycleRule, 0, len(attrs.Lifecycle.Rules)+len(managed))
+	for _, rule := range attrs.Lifecycle.Rules {
+		if isManagedLifecycleRule(&rule, matchesPrefix, managed) {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	rules = append(rules, managed...)
+
+	_, err = bucket.Update(ctx, storage.BucketAttrsToUpdate{Lifecycle: &storage.Lifecycle{Rules: rules}})
+	if err != nil {
+		log.AppLogger.Debugf("gs backend: Error while setting lifecycle configuration on bucket %s - %v", g.bucketName, err)
+	}
+	return err
+}
+
+// isManagedLifecycleRule reports whether the rule is one SetLifecyclePolicy installs, or installed in the past, for
+// the prefix provided, i.e. a storage class transition, an expiration, or an abort of incomplete uploads, conditioned
+// only on the age or custom time of the objects matching that prefix, so it is replaced rather than kept alongside
+// the new rules. Rules without a prefix apply to the whole bucket and cannot be told apart from rules configured by
+// others, so for a bucket without a prefix only the rules identical to the managed rules being installed are replaced.
+func isManagedLifecycleRule(rule *storage.LifecycleRule, matchesPrefix []string, managed []storage.LifecycleRule) bool {
+	condition := rule.Condition
+	if len(condition.MatchesPrefix) == 0 {
+		condition.MatchesPrefix = nil
+	}
+
+	if matchesPrefix == nil {
+		for _, managedRule := range managed {
+			if reflect.DeepEqual(rule.Action, managedRule.Action) && reflect.DeepEqual(condition, managedRule.Condition) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch rule.Action.Type {
+	case storage.SetStorageClassAction:
+	case storage.DeleteAction, storage.AbortIncompleteMPUAction:
+		if rule.Action.StorageClass != "" {
+			return false
+		}
+	default:
+		return false
+	}
+
+	if (condition.AgeInDays > 0) == (condition.DaysSinceCustomTime > 0) {
+		return false
+	}
+	condition.AgeInDays = 0
+	condition.DaysSinceCustomTime = 0
+	return reflect.DeepEqual(condition, storage.LifecycleCondition{MatchesPrefix: matchesPrefix})
+}
+
+// PresignURL will generate a signed URL that can be used to download the named object until it expires.
+// The credentials in use must be able to sign blobs, see:
+// https://pkg.go.dev/cloud.google.com/go/storage#hdr-Credential_requirements_for_signing
+func (g *GoogleCloudStorageBackend) PresignURL(ctx context.Context, name string, expires time.Duration) (string, error) {
+	return g.client.Bucket(g.bucketName).SignedURL(g.prefix+name, &storage.SignedURLOptions{
+		Method:  "GET",
+		Expires: time.Now().Add(expires),
+		Scheme:  storage.SigningSchemeV4,
+	})
+}
+
+// ListVersions will iterate through all object generations in the configured GCS bucket and return
+// them, filtering by the provided prefix. Generations are used as the version identifier.
+func (g *GoogleCloudStorageBackend) ListVersions(ctx context.Context, prefix string) ([]ObjectVersion, error) {
+	l := make([]ObjectVersion, 0, 1000)
+	it := g.client.Bucket(g.bucketName).Objects(ctx, &storage.Query{Prefix: g.prefix + prefix, Versions: true})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, ObjectVersion{
+			Name:         strings.TrimPrefix(attrs.Name, g.prefix),
+			VersionID:    strconv.FormatInt(attrs.Generation, 10),
+			LastModified: attrs.Created,
+			IsLatest:     attrs.Deleted.IsZero(),
+		})
+	}
+
+	return l, nil
+}
+
+// DownloadVersion will download the requested generation of an object which can be read from the returned io.ReadCloser
+func (g *GoogleCloudStorageBackend) DownloadVersion(ctx context.Context, filename, versionID string) (io.ReadCloser, error) {
+	generation, err := strconv.ParseInt(versionID, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("gs backend: invalid generation %s - %v", versionID, err)
+	}
+	return g.client.Bucket(g.bucketName).Object(g.prefix + filename).Generation(generation).NewReader(ctx)
+}
+
+// Stat will return the metadata GCS holds for the given object.
+func (g *GoogleCloudStorageBackend) Stat(ctx context.Context, filename string) (*ObjectInfo, error) {
+	attrs, err := g.client.Bucket(g.bucketName).Object(g.prefix + filename).Attrs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ObjectInfo{
+		Name:         filename,
+		Size:         attrs.Size,
+		MD5Sum:       hex.EncodeToString(attrs.MD5),
+		StorageClass: attrs.StorageClass,
+	}, nil
+}
@@ -85,3 +85,110 @@ func TestGCSBackend(t *testing.T) {
 
 	BackendTest(ctx, GoogleCloudStorageBackendPrefix, gcsTestBucketName, false, b, WithGoogleCloudStorageClient(client))(t)
 }
+
+func TestGCSManagedLifecycleRules(t *testing.T) {
+	t.Parallel()
+
+	prefix := []string{"host/"}
+	testCases := []struct {
+		name    string
+		rule    storage.LifecycleRule
+		managed bool
+	}{
+		{
+			name: "transition",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "ARCHIVE"},
+				Condition: storage.LifecycleCondition{AgeInDays: 30, MatchesPrefix: prefix},
+			},
+			managed: true,
+		},
+		{
+			name: "volume transition",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "COLDLINE"},
+				Condition: storage.LifecycleCondition{DaysSinceCustomTime: 30, MatchesPrefix: prefix},
+			},
+			managed: true,
+		},
+		{
+			name: "age and custom time",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "COLDLINE"},
+				Condition: storage.LifecycleCondition{AgeInDays: 7, DaysSinceCustomTime: 30, MatchesPrefix: prefix},
+			},
+		},
+		{
+			name: "expiration",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: 365, MatchesPrefix: prefix},
+			},
+			managed: true,
+		},
+		{
+			name: "other prefix",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: 365, MatchesPrefix: []string{"other/"}},
+			},
+		},
+		{
+			name: "noncurrent versions",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: 7, Liveness: storage.Archived, MatchesPrefix: prefix},
+			},
+		},
+		{
+			name: "storage class condition",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{AgeInDays: 7, MatchesStorageClasses: []string{"STANDARD"}, MatchesPrefix: prefix},
+			},
+		},
+		{
+			name: "no age",
+			rule: storage.LifecycleRule{
+				Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+				Condition: storage.LifecycleCondition{NumNewerVersions: 3, MatchesPrefix: prefix},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		if managed := isManagedLifecycleRule(&tc.rule, prefix, nil); managed != tc.managed {
+			t.Errorf("%s: expected the rule to be managed %v, got %v", tc.name, tc.managed, managed)
+		}
+	}
+
+	managed := []storage.LifecycleRule{{
+		Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "COLDLINE"},
+		Condition: storage.LifecycleCondition{DaysSinceCustomTime: 30},
+	}}
+	foreign := []storage.LifecycleRule{
+		{
+			Action:    storage.LifecycleAction{Type: storage.DeleteAction},
+			Condition: storage.LifecycleCondition{AgeInDays: 30, MatchesPrefix: []string{}},
+		},
+		{
+			Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "ARCHIVE"},
+			Condition: storage.LifecycleCondition{DaysSinceCustomTime: 30},
+		},
+		{
+			Action:    storage.LifecycleAction{Type: storage.AbortIncompleteMPUAction},
+			Condition: storage.LifecycleCondition{AgeInDays: 7},
+		},
+	}
+	for _, rule := range foreign {
+		if isManagedLifecycleRule(&rule, nil, managed) {
+			t.Errorf("expected the bucket-wide rule %+v to be kept for a bucket without a prefix", rule)
+		}
+	}
+	rule := storage.LifecycleRule{
+		Action:    storage.LifecycleAction{Type: storage.SetStorageClassAction, StorageClass: "COLDLINE"},
+		Condition: storage.LifecycleCondition{DaysSinceCustomTime: 30, MatchesPrefix: []string{}},
+	}
+	if !isManagedLifecycleRule(&rule, nil, managed) {
+		t.Errorf("expected a bucket-wide rule identical to a managed rule to be replaced")
+	}
+}
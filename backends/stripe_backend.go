@@ -0,0 +1,525 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// StripedBackendPrefix is the URI prefix used for the StripedBackend.
+const StripedBackendPrefix = "stripe"
+
+// Every shard starts with a header holding the size of the original object so it can be rejoined. When the top bit
+// of the size is set, the shard ends with the SHA-256 digest of the data between its header and the digest, so a
+// corrupted shard is rebuilt from the others instead of being rejoined. Shards stored before digests were added
+// have neither.
+const (
+	stripeHeaderSize = 8
+	stripeDigestFlag = uint64(1) << 63
+)
+
+var (
+	errStripedPipe   = errors.New("striped backend: cannot stripe a piped volume, a MaxFileBuffer greater than 0 is required")
+	errShardMismatch = errors.New("striped backend: shard does not match its digest")
+)
+
+// StripedBackend splits every object it is given across a set of data targets plus a set of parity targets
+// using Reed-Solomon erasure coding. No single target holds the full object, and any object can be recovered
+// so long as no more targets than there are parity shards are lost.
+//
+// The TargetURI is expected in the form stripe://<parity>/<uri1>|<uri2>|..., for example
+// stripe://1/s3://bucket-a|gs://bucket-b|azure://container would store two data shards and one parity shard.
+type StripedBackend struct {
+	conf         *BackendConfig
+	targets      []string
+	backends     []Backend
+	dataShards   int
+	parityShards int
+	enc          reedsolomon.StreamEncoder
+}
+
+type stripeShard struct {
+	file *os.File
+	size int64
+	data *io.SectionReader
+}
+
+// Init will initialize the StripedBackend along with each of the targets it stripes across.
+func (s *StripedBackend) Init(ctx context.Context, conf *BackendConfig, opts ...Option) error {
+	s.conf = conf
+
+	cleanPrefix := strings.TrimPrefix(s.conf.TargetURI, StripedBackendPrefix+"://")
+	if cleanPrefix == s.conf.TargetURI {
+		return ErrInvalidURI
+	}
+
+	parts := strings.SplitN(cleanPrefix, "/", 2)
+	if len(parts) != 2 {
+		return ErrInvalidURI
+	}
+
+	parity, err := strconv.Atoi(parts[0])
+	if err != nil || parity < 1 {
+		log.AppLogger.Errorf("striped backend: The number of parity targets must be a number greater than 0, was given %s", parts[0])
+		return ErrInvalidURI
+	}
+
+	s.targets = strings.Split(parts[1], "|")
+	if len(s.targets) <= parity {
+		log.AppLogger.Errorf("striped backend: At least one data target is required in addition to the %d parity targets.", parity)
+		return ErrInvalidURI
+	}
+	s.parityShards = parity
+	s.dataShards = len(s.targets) - parity
+
+	s.enc, err = reedsolomon.NewStream(s.dataShards, s.parityShards)
+	if err != nil {
+		return err
+	}
+
+	s.backends = make([]Backend, len(s.targets))
+	for idx, target := range s.targets {
+		if strings.HasPrefix(target, StripedBackendPrefix+"://") {
+			log.AppLogger.Errorf("striped backend: Cannot stripe across another striped target.")
+			return ErrInvalidURI
+		}
+
+		b, berr := GetBackendForURI(target)
+		if berr != nil {
+			return berr
+		}
+
+		// Each target gets its own upload buffer as every shard of a volume is uploaded at the same time
+		targetConf := *conf
+		targetConf.TargetURI = target
+		if conf.MaxParallelUploadBuffer != nil {
+			targetConf.MaxParallelUploadBuffer = make(chan bool, cap(conf.MaxParallelUploadBuffer))
+		}
+
+		if berr = b.Init(ctx, &targetConf, opts...); berr != nil {
+			log.AppLogger.Errorf("striped backend: Could not initialize target %s - %v", target, berr)
+			return berr
+		}
+		s.backends[idx] = b
+	}
+
+	return nil
+}
+
+// Upload will split the provided volume into its data and parity shards and upload each to its own target.
+// nolint:funlen,gocyclo // Difficult to break this up
+func (s *StripedBackend) Upload(ctx context.Context, vol *files.VolumeInfo) error {
+	if vol.IsUsingPipe() {
+		return errStripedPipe
+	}
+
+	shards := make([]*files.VolumeInfo, len(s.backends))
+	defer func() {
+		for _, shard := range shards {
+			if shard == nil {
+				continue
+			}
+			_ = shard.Close()
+			if err := shard.DeleteVolume(); err != nil {
+				log.AppLogger.Warningf("striped backend: Could not delete temporary shard for %s - %v", vol.ObjectName, err)
+			}
+		}
+	}()
+
+	header := make([]byte, stripeHeaderSize)
+	binary.BigEndian.PutUint64(header, vol.Size|stripeDigestFlag)
+
+	writers := make([]io.Writer, len(shards))
+	digests := make([]hash.Hash, len(shards))
+	for idx := range shards {
+		shard, err := files.CreateSimpleVolume(ctx, false)
+		if err != nil {
+			return err
+		}
+		shard.ObjectName = vol.ObjectName
+		shards[idx] = shard
+		digests[idx] = sha256.New()
+		writers[idx] = io.MultiWriter(shard, digests[idx])
+
+		if _, err = shard.Write(header); err != nil {
+			return err
+		}
+	}
+
+	// Empty objects are stored as shards holding only their header and digest
+	if vol.Size > 0 {
+		if err := s.encodeShards(vol, shards, writers, digests); err != nil {
+			return err
+		}
+	} else if _, err := io.Copy(io.Discard, vol); err != nil {
+		return err
+	}
+
+	// The digests of the data shards were already written by encodeShards
+	for idx, shard := range shards {
+		if vol.Size == 0 || idx >= s.dataShards {
+			if _, err := shard.Write(digests[idx].Sum(nil)); err != nil {
+				return err
+			}
+		}
+		if err := shard.Close(); err != nil {
+			return err
+		}
+	}
+
+	group, gctx := errgroup.WithContext(ctx)
+	for idx := range s.backends {
+		b, shard, target := s.backends[idx], shards[idx], s.targets[idx]
+		group.Go(func() error {
+			if err := shard.OpenVolume(); err != nil {
+				return err
+			}
+			defer shard.Close()
+
+			if err := b.Upload(gctx, shard); err != nil {
+				log.AppLogger.Debugf("striped backend: Error uploading shard of %s to %s - %v", shard.ObjectName, target, err)
+				return err
+			}
+			return nil
+		})
+	}
+
+	return group.Wait()
+}
+
+// encodeShards will split the volume into the data shards, ending each with its digest, and compute the parity
+// shards from them.
+func (s *StripedBackend) encodeShards(vol *files.VolumeInfo, shards []*files.VolumeInfo, writers []io.Writer, digests []hash.Hash) error {
+	if err := s.enc.Split(vol, writers[:s.dataShards], int64(vol.Size)); err != nil {
+		return fmt.Errorf("striped backend: could not split %s into shards - %v", vol.ObjectName, err)
+	}
+
+	// Re-read the data shards, up to their digest, to compute the parity shards
+	perShard := (int64(vol.Size) + int64(s.dataShards) - 1) / int64(s.dataShards)
+	inputs := make([]io.Reader, s.dataShards)
+	for idx, shard := range shards[:s.dataShards] {
+		if _, err := shard.Write(digests[idx].Sum(nil)); err != nil {
+			return err
+		}
+		if err := shard.Close(); err != nil {
+			return err
+		}
+		if err := shard.OpenVolume(); err != nil {
+			return err
+		}
+		inputs[idx] = io.NewSectionReader(shard, stripeHeaderSize, perShard)
+	}
+
+	if err := s.enc.Encode(inputs, writers[s.dataShards:]); err != nil {
+		return fmt.Errorf("striped backend: could not compute parity shards for %s - %v", vol.ObjectName, err)
+	}
+
+	return nil
+}
+
+// List will return the objects matching the prefix that have enough shards available to be recovered.
+func (s *StripedBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		mutex    sync.Mutex
+		counts   = make(map[string]int)
+		failures []error
+	)
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.backends))
+	for idx := range s.backends {
+		b, target := s.backends[idx], s.targets[idx]
+		go func() {
+			defer wg.Done()
+			names, err := b.List(ctx, prefix)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				log.AppLogger.Warningf("striped backend: Could not list objects in %s - %v", target, err)
+				failures = append(failures, err)
+				return
+			}
+			for _, name := range names {
+				counts[name]++
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(failures) > s.parityShards {
+		return nil, failures[0]
+	}
+
+	l := make([]string, 0, len(counts))
+	for name, count := range counts {
+		if count >= s.dataShards {
+			l = append(l, name)
+		} else {
+			log.AppLogger.Warningf("striped backend: Only %d of the %d shards required to recover %s were found.", count, s.dataShards, name)
+		}
+	}
+	sort.Strings(l)
+
+	return l, nil
+}
+
+// PreDownload will prepare the shards of the objects provided for download in every target.
+func (s *StripedBackend) PreDownload(ctx context.Context, objects []string) error {
+	var failures []error
+	for idx, b := range s.backends {
+		if err := b.PreDownload(ctx, objects); err != nil {
+			log.AppLogger.Warningf("striped backend: Could not pre download objects in %s - %v", s.targets[idx], err)
+			failures = append(failures, err)
+		}
+	}
+
+	if len(failures) > s.parityShards {
+		return failures[0]
+	}
+	return nil
+}
+
+// Download will fetch the shards for the requested object, reconstructing any missing data shards from the
+// parity shards as needed, and return the rejoined object.
+// nolint:funlen,gocyclo // Difficult to break this up
+func (s *StripedBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	shards := make([]*stripeShard, len(s.backends))
+	errs := make([]error, len(s.backends))
+
+	var wg sync.WaitGroup
+	wg.Add(len(s.backends))
+	for idx := range s.backends {
+		idx := idx
+		go func() {
+			defer wg.Done()
+			shards[idx], errs[idx] = downloadShard(ctx, s.backends[idx], filename)
+			if errs[idx] != nil {
+				log.AppLogger.Warningf("striped backend: Could not download shard of %s from %s - %v", filename, s.targets[idx], errs[idx])
+			}
+		}()
+	}
+	wg.Wait()
+
+	cleanup := func() {
+		for _, shard := range shards {
+			if shard != nil {
+				_ = shard.file.Close()
+				_ = os.Remove(shard.file.Name())
+			}
+		}
+	}
+
+	var (
+		size      int64 = -1
+		available int
+		firstErr  error
+	)
+	for idx, shard := range shards {
+		if shard == nil {
+			if firstErr == nil {
+				firstErr = errs[idx]
+			}
+			continue
+		}
+		if size == -1 {
+			size = shard.size
+		} else if shard.size != size {
+			log.AppLogger.Warningf("striped backend: Shard of %s in %s does not match the other shards, ignoring it.", filename, s.targets[idx])
+			_ = shard.file.Close()
+			_ = os.Remove(shard.file.Name())
+			shards[idx] = nil
+			continue
+		}
+		available++
+	}
+
+	if available < s.dataShards {
+		cleanup()
+		if firstErr == nil {
+			firstErr = fmt.Errorf("striped backend: only %d of the %d shards required to recover %s are intact", available, s.dataShards, filename)
+		}
+		return nil, firstErr
+	}
+
+	if size == 0 {
+		cleanup()
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+
+	// Rebuild any missing data shards
+	valid := make([]io.Reader, len(shards))
+	fill := make([]io.Writer, len(shards))
+	missing := false
+	for idx, shard := range shards {
+		if shard != nil {
+			valid[idx] = shard.data
+			continue
+		}
+		if idx >= s.dataShards {
+			continue
+		}
+
+		f, err := os.CreateTemp(config.BackupTempdir, config.ProgramName)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		shards[idx] = &stripeShard{file: f, size: size}
+		fill[idx] = f
+		missing = true
+	}
+
+	if missing {
+		log.AppLogger.Infof("striped backend: Reconstructing missing shards of %s.", filename)
+		if err := s.enc.Reconstruct(valid, fill); err != nil {
+			cleanup()
+			return nil, fmt.Errorf("striped backend: could not reconstruct %s - %v", filename, err)
+		}
+	}
+
+	dataShards := make([]io.Reader, s.dataShards)
+	for idx, shard := range shards[:s.dataShards] {
+		if fill[idx] != nil {
+			if _, err := shard.file.Seek(0, io.SeekStart); err != nil {
+				cleanup()
+				return nil, err
+			}
+			dataShards[idx] = shard.file
+			continue
+		}
+		if _, err := shard.data.Seek(0, io.SeekStart); err != nil {
+			cleanup()
+			return nil, err
+		}
+		dataShards[idx] = shard.data
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer cleanup()
+		pw.CloseWithError(s.enc.Join(pw, dataShards, size))
+	}()
+
+	return pr, nil
+}
+
+// downloadShard will download a shard to a temporary file and return it, failing with errShardMismatch when its data
+// does not match the digest it ends with.
+func downloadShard(ctx context.Context, b Backend, filename string) (*stripeShard, error) {
+	r, err := b.Download(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	f, err := os.CreateTemp(config.BackupTempdir, config.ProgramName)
+	if err != nil {
+		return nil, err
+	}
+
+	shard, err := readShard(r, f)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return nil, err
+	}
+	return shard, nil
+}
+
+// readShard will copy the shard read from r to the file provided and check its digest, if it has one.
+func readShard(r io.Reader, f *os.File) (*stripeShard, error) {
+	length, err := io.Copy(f, r)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, stripeHeaderSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint64(header)
+	if size&stripeDigestFlag == 0 {
+		return &stripeShard{file: f, size: int64(size), data: io.NewSectionReader(f, stripeHeaderSize, length-stripeHeaderSize)}, nil
+	}
+
+	dataLength := length - stripeHeaderSize - sha256.Size
+	if dataLength < 0 {
+		return nil, errShardMismatch
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err = f.ReadAt(expected, stripeHeaderSize+dataLength); err != nil {
+		return nil, err
+	}
+	digest := sha256.New()
+	if _, err = io.Copy(digest, io.NewSectionReader(f, stripeHeaderSize, dataLength)); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(digest.Sum(nil), expected) {
+		return nil, errShardMismatch
+	}
+
+	return &stripeShard{file: f, size: int64(size &^ stripeDigestFlag), data: io.NewSectionReader(f, stripeHeaderSize, dataLength)}, nil
+}
+
+// Delete will delete the shards of the given object from every target.
+func (s *StripedBackend) Delete(ctx context.Context, filename string) error {
+	var firstErr error
+	for idx, b := range s.backends {
+		if err := b.Delete(ctx, filename); err != nil {
+			log.AppLogger.Warningf("striped backend: Could not delete shard of %s from %s - %v", filename, s.targets[idx], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Close will release the resources used by every target.
+func (s *StripedBackend) Close() error {
+	var firstErr error
+	for _, b := range s.backends {
+		if err := b.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,269 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backends
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func stripedTestURI(t *testing.T, parity int, count int) (string, []string) {
+	dirs := make([]string, count)
+	targets := make([]string, count)
+	for idx := range dirs {
+		dirs[idx] = t.TempDir()
+		targets[idx] = FileBackendPrefix + "://" + dirs[idx]
+	}
+	return strings.Repeat("1", parity) + "/" + strings.Join(targets, "|"), dirs
+}
+
+func TestStripedInit(t *testing.T) {
+	uri, _ := stripedTestURI(t, 1, 3)
+	testCases := []struct {
+		uri     string
+		errTest errTestFunc
+	}{
+		{
+			uri:     StripedBackendPrefix + "://" + uri,
+			errTest: nilErrTest,
+		},
+		{
+			uri:     "notvalid://" + uri,
+			errTest: errInvalidURIErrTest,
+		},
+		{
+			uri:     StripedBackendPrefix + "://0/file:///|file:///",
+			errTest: errInvalidURIErrTest,
+		},
+		{
+			uri:     StripedBackendPrefix + "://1/file:///",
+			errTest: errInvalidURIErrTest,
+		},
+		{
+			uri:     StripedBackendPrefix + "://1/file:///|stripe://1/file:///|file:///",
+			errTest: errInvalidURIErrTest,
+		},
+	}
+	for idx, testCase := range testCases {
+		b := &StripedBackend{}
+		conf := &BackendConfig{TargetURI: testCase.uri}
+		if err := b.Init(context.Background(), conf); !testCase.errTest(err) {
+			t.Errorf("%d: Unexpected error, got %v", idx, err)
+		}
+	}
+}
+
+func TestStripedBackend(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	uri, _ := stripedTestURI(t, 1, 3)
+	b, err := GetBackendForURI(StripedBackendPrefix + "://" + uri)
+	if err != nil {
+		t.Fatalf("Error while trying to get backend: %v", err)
+	}
+
+	BackendTest(ctx, StripedBackendPrefix, uri, true, b)(t)
+}
+
+func TestStripedBackendReconstruct(t *testing.T) {
+	ctx := context.Background()
+	payload, goodVol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("Error while creating test volumes: %v", err)
+	}
+	defer goodVol.DeleteVolume()
+
+	uri, dirs := stripedTestURI(t, 1, 3)
+	b := &StripedBackend{}
+	conf := &BackendConfig{TargetURI: StripedBackendPrefix + "://" + uri, MaxParallelUploadBuffer: make(chan bool, 1)}
+	if err = b.Init(ctx, conf); err != nil {
+		t.Fatalf("Issue initializing backend: %v", err)
+	}
+
+	if err = goodVol.OpenVolume(); err != nil {
+		t.Fatalf("could not open good volume due to error %v", err)
+	}
+	err = b.Upload(ctx, goodVol)
+	goodVol.Close()
+	if err != nil {
+		t.Fatalf("Issue uploading goodvol: %v", err)
+	}
+
+	// No single target should hold the full object
+	for _, dir := range dirs {
+		shard, rerr := os.ReadFile(filepath.Join(dir, goodVol.ObjectName))
+		if rerr != nil {
+			t.Fatalf("could not read shard: %v", rerr)
+		}
+		if len(shard) >= len(payload) {
+			t.Errorf("Expected shard to be smaller than the payload, got %d bytes", len(shard))
+		}
+	}
+
+	// Losing any one target must not lose the object
+	for idx, dir := range dirs {
+		shardPath := filepath.Join(dir, goodVol.ObjectName)
+		shard, rerr := os.ReadFile(shardPath)
+		if rerr != nil {
+			t.Fatalf("could not read shard: %v", rerr)
+		}
+		if err = os.Remove(shardPath); err != nil {
+			t.Fatalf("could not remove shard: %v", err)
+		}
+
+		names, lerr := b.List(ctx, "")
+		if lerr != nil || len(names) != 1 {
+			t.Errorf("%d: Expected the object to be listed, got %v, %v", idx, names, lerr)
+		}
+
+		r, derr := b.Download(ctx, goodVol.ObjectName)
+		if derr != nil {
+			t.Fatalf("%d: Issue calling Download: %v", idx, derr)
+		}
+		downloaded, rerr := io.ReadAll(r)
+		r.Close()
+		if rerr != nil {
+			t.Fatalf("%d: error reading: %v", idx, rerr)
+		}
+		if !bytes.Equal(downloaded, payload) {
+			t.Errorf("%d: downloaded object does not equal expected payload", idx)
+		}
+
+		if err = os.WriteFile(shardPath, shard, 0600); err != nil {
+			t.Fatalf("could not restore shard: %v", err)
+		}
+	}
+
+	// Losing more targets than there are parity shards is fatal
+	for _, dir := range dirs[:2] {
+		if err = os.Remove(filepath.Join(dir, goodVol.ObjectName)); err != nil {
+			t.Fatalf("could not remove shard: %v", err)
+		}
+	}
+	if _, err = b.Download(ctx, goodVol.ObjectName); err == nil {
+		t.Errorf("Expected an error downloading an unrecoverable object, got nil")
+	}
+}
+
+func TestStripedBackendCorruptShard(t *testing.T) {
+	ctx := context.Background()
+	payload, goodVol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("Error while creating test volumes: %v", err)
+	}
+	defer goodVol.DeleteVolume()
+
+	uri, dirs := stripedTestURI(t, 1, 3)
+	b := &StripedBackend{}
+	conf := &BackendConfig{TargetURI: StripedBackendPrefix + "://" + uri, MaxParallelUploadBuffer: make(chan bool, 1)}
+	if err = b.Init(ctx, conf); err != nil {
+		t.Fatalf("Issue initializing backend: %v", err)
+	}
+
+	if err = goodVol.OpenVolume(); err != nil {
+		t.Fatalf("could not open good volume due to error %v", err)
+	}
+	err = b.Upload(ctx, goodVol)
+	goodVol.Close()
+	if err != nil {
+		t.Fatalf("Issue uploading goodvol: %v", err)
+	}
+
+	corrupt := func(shardPath string) []byte {
+		shard, rerr := os.ReadFile(shardPath)
+		if rerr != nil {
+			t.Fatalf("could not read shard: %v", rerr)
+		}
+		corrupted := append([]byte(nil), shard...)
+		corrupted[stripeHeaderSize+len(corrupted)/3]++
+		if err = os.WriteFile(shardPath, corrupted, 0600); err != nil {
+			t.Fatalf("could not corrupt shard: %v", err)
+		}
+		return shard
+	}
+
+	// A corrupted shard of the same size is rebuilt from the others instead of being rejoined
+	for idx, dir := range dirs {
+		shardPath := filepath.Join(dir, goodVol.ObjectName)
+		shard := corrupt(shardPath)
+
+		r, derr := b.Download(ctx, goodVol.ObjectName)
+		if derr != nil {
+			t.Fatalf("%d: Issue calling Download: %v", idx, derr)
+		}
+		downloaded, rerr := io.ReadAll(r)
+		r.Close()
+		if rerr != nil {
+			t.Fatalf("%d: error reading: %v", idx, rerr)
+		}
+		if !bytes.Equal(downloaded, payload) {
+			t.Errorf("%d: downloaded object does not equal expected payload", idx)
+		}
+
+		if err = os.WriteFile(shardPath, shard, 0600); err != nil {
+			t.Fatalf("could not restore shard: %v", err)
+		}
+	}
+
+	for _, dir := range dirs[:2] {
+		corrupt(filepath.Join(dir, goodVol.ObjectName))
+	}
+	if _, err = b.Download(ctx, goodVol.ObjectName); err == nil {
+		t.Errorf("Expected an error downloading an object with more corrupted shards than parity shards, got nil")
+	}
+}
+
+func TestReadShard(t *testing.T) {
+	legacy := append([]byte{0, 0, 0, 0, 0, 0, 0, 3}, []byte("abc")...)
+	f, err := os.CreateTemp(t.TempDir(), "shard")
+	if err != nil {
+		t.Fatalf("could not create shard file: %v", err)
+	}
+	defer f.Close()
+
+	shard, err := readShard(bytes.NewReader(legacy), f)
+	if err != nil {
+		t.Fatalf("Expected a shard without a digest to be read, got %v", err)
+	}
+	data, err := io.ReadAll(shard.data)
+	if err != nil || shard.size != 3 || string(data) != "abc" {
+		t.Errorf("Expected a shard of size 3 holding abc, got %d, %q, %v", shard.size, data, err)
+	}
+
+	truncated := []byte{0x80, 0, 0, 0, 0, 0, 0, 3, 'a'}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		t.Fatalf("could not rewind shard file: %v", err)
+	}
+	if err = f.Truncate(0); err != nil {
+		t.Fatalf("could not truncate shard file: %v", err)
+	}
+	if _, err = readShard(bytes.NewReader(truncated), f); err != errShardMismatch {
+		t.Errorf("Expected a shard too short to hold its digest to fail with %v, got %v", errShardMismatch, err)
+	}
+}
@@ -24,22 +24,25 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5" //nolint:gosec // Not used for cryptography
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"github.com/dustin/go-humanize"
 	"github.com/miolini/datacounter"
-	"github.com/nightlyone/lockfile"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/jdfalk/zfsbackup-go/backends"
@@ -54,6 +57,9 @@ var (
 	manifestmutex sync.Mutex
 )
 
+// deleteBackendURI is appended to the destinations to clean up local volumes once every target has processed them.
+const deleteBackendURI = backends.DeleteBackendPrefix + "://"
+
 type snapshotFilter struct {
 	prefix      string
 	regexpMatch *regexp.Regexp
@@ -98,6 +104,7 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *files.JobInfo) error {
 	}
 	lastComparableSnapshots := make([]*files.SnapshotInfo, len(jobInfo.Destinations))
 	lastBackup := make([]*files.SnapshotInfo, len(jobInfo.Destinations))
+	var lastJob *files.JobInfo
 	for idx := range jobInfo.Destinations {
 		destBackups, derr := getBackupsForTarget(ctx, jobInfo.VolumeName, jobInfo.Destinations[idx], jobInfo)
 		if derr != nil {
@@ -107,10 +114,13 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *files.JobInfo) error {
 			continue
 		}
 		lastBackup[idx] = &destBackups[0].BaseSnapshot
+		if idx == 0 {
+			lastJob = destBackups[0]
+		}
 		if jobInfo.Incremental {
 			lastComparableSnapshots[idx] = &destBackups[0].BaseSnapshot
 		}
-		if jobInfo.FullIfOlderThan != -1*time.Minute {
+		if jobInfo.FullIfOlderThan != -1*time.Minute || jobInfo.Differential {
 			for _, bkp := range destBackups {
 				if bkp.IncrementalSnapshot.Name == "" {
 					lastComparableSnapshots[idx] = &bkp.BaseSnapshot
@@ -132,6 +142,18 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *files.JobInfo) error {
 		}
 	}
 
+	// A dataset destroyed and created again under the same name shares no snapshots with the backups taken before, so
+	// an incremental backup from them could never be received
+	if lastJob != nil && lastJob.DatasetGUID != "" {
+		guid, gerr := zfs.GetZFSProperty(ctx, "guid", zfs.GetLocalVolumeName(jobInfo))
+		if gerr != nil {
+			log.AppLogger.Warningf("Could not determine the guid of %s - %v", zfs.GetLocalVolumeName(jobInfo), gerr)
+		} else if reason := datasetReplaced(lastJob, guid); reason != "" {
+			log.AppLogger.Infof("%s, performing full backup.", reason)
+			return nil
+		}
+	}
+
 	// Now select the proper job options and continue
 	if jobInfo.Incremental {
 		if lastComparableSnapshots[0] == nil {
@@ -140,6 +162,30 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *files.JobInfo) error {
 		if lastComparableSnapshots[0].Equal(&snapshots[0]) {
 			return ErrNoOp
 		}
+		if reason := chainLimitReached(jobInfo, lastJob); reason != "" {
+			log.AppLogger.Infof("%s, performing full backup.", reason)
+			return nil
+		}
+		jobInfo.IncrementalSnapshot = *lastComparableSnapshots[0]
+	}
+
+	if jobInfo.Differential {
+		if lastComparableSnapshots[0] == nil {
+			return fmt.Errorf("no full backup to take a differential backup from - try doing a full backup instead")
+		}
+		if lastBackup[0].Equal(&snapshots[0]) {
+			return ErrNoOp
+		}
+		if ok, verr := validateSnapShotExists(ctx, lastComparableSnapshots[0], jobInfo.VolumeName, true); verr != nil {
+			return verr
+		} else if !ok {
+			log.AppLogger.Infof(
+				"Last Full backup was done on %v but is no longer found in the local target, performing full backup.",
+				lastComparableSnapshots[0].CreationTime,
+			)
+			return nil
+		}
+		// Always increment from the last full backup so a restore needs at most two backup sets
 		jobInfo.IncrementalSnapshot = *lastComparableSnapshots[0]
 	}
 
@@ -176,16 +222,125 @@ func ProcessSmartOptions(ctx context.Context, jobInfo *files.JobInfo) error {
 			return nil
 		}
 		jobInfo.IncrementalSnapshot = *lastBackup[0]
+		jobInfo.ChainFullSnapshot = *lastComparableSnapshots[0]
 	}
 	jobInfo.IntermediaryIncremental = jobInfo.SmartIntermediaryIncremental
 	return nil
 }
 
+// chainLimitReached returns why the next incremental backup after the last backup provided would
+// exceed the maxChainLength or maxChainAge options, or an empty string if it would not.
+func chainLimitReached(jobInfo *files.JobInfo, last *files.JobInfo) string {
+	if last == nil {
+		return ""
+	}
+	length, full := backupChain(last)
+	if jobInfo.MaxChainLength > 0 && length >= jobInfo.MaxChainLength {
+		return fmt.Sprintf("The incremental chain already has %d incremental backups (max %d)", length, jobInfo.MaxChainLength)
+	}
+	if jobInfo.MaxChainAge > 0 && full != nil && jobInfo.BaseSnapshot.CreationTime.Sub(full.BaseSnapshot.CreationTime) > jobInfo.MaxChainAge {
+		return fmt.Sprintf(
+			"The incremental chain started with the full backup of %v, more than %v before the snapshot to backup",
+			full.BaseSnapshot.CreationTime, jobInfo.MaxChainAge,
+		)
+	}
+	return ""
+}
+
+// datasetReplaced returns why the dataset with the guid provided is not the dataset the last backup was taken of, or an
+// empty string if it is or the last backup did not record the guid of its dataset.
+func datasetReplaced(last *files.JobInfo, guid string) string {
+	if last == nil || last.DatasetGUID == "" || guid == "" || last.DatasetGUID == guid {
+		return ""
+	}
+	return fmt.Sprintf(
+		"%s was destroyed and created again since the backup of %s (guid %s, was %s)",
+		last.VolumeName, last.BaseSnapshot.Name, guid, last.DatasetGUID,
+	)
+}
+
+// backupChain walks back from the backup provided to the full backup it depends on, returning the
+// number of incremental backups found along the way and the full backup, if it was found.
+func backupChain(backup *files.JobInfo) (length int, full *files.JobInfo) {
+	for backup != nil && backup.IncrementalSnapshot.Name != "" {
+		length++
+		backup = backup.ParentSnap
+	}
+	return length, backup
+}
+
 func includeSnapshot(snapshot *files.SnapshotInfo, filter *snapshotFilter) bool {
 	return (filter.prefix == "" || strings.HasPrefix(snapshot.Name, filter.prefix)) &&
 		(filter.regexpMatch == nil || filter.regexpMatch.MatchString(snapshot.Name))
 }
 
+// snapshotTemplateReplacer returns a replacer for the strftime style directives supported in
+// snapshot name templates.
+func snapshotTemplateReplacer(t time.Time) *strings.Replacer {
+	return strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%y", t.Format("06"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%j", t.Format("002"),
+		"%H", t.Format("15"),
+		"%M", t.Format("04"),
+		"%S", t.Format("05"),
+		"%F", t.Format("2006-01-02"),
+		"%T", t.Format("15:04:05"),
+		"%s", strconv.FormatInt(t.Unix(), 10),
+		"%%", "%",
+	)
+}
+
+// snapshotTemplateData is made available to snapshot name templates using the Go template syntax.
+type snapshotTemplateData struct {
+	Time    time.Time
+	Dataset string // The last component of the dataset name, e.g. data for tank/data
+}
+
+var validSnapshotName = regexp.MustCompile(`^[\w\-:\.]+$`)
+
+// snapshotName renders a snapshot name template for the dataset at the time provided. The template may use Go
+// template syntax, e.g. zfsbackup-{{.Time.UTC.Format "20060102T150405"}}, along with the strftime style directives
+// supported by snapshotTemplateReplacer.
+func snapshotName(nameTemplate, dataset string, t time.Time) (string, error) {
+	name := nameTemplate
+	if strings.Contains(nameTemplate, "{{") {
+		tmpl, err := template.New("snapshot").Option("missingkey=error").Parse(nameTemplate)
+		if err != nil {
+			return "", fmt.Errorf("could not parse the snapshot name template %s - %v", nameTemplate, err)
+		}
+		var buf strings.Builder
+		if err = tmpl.Execute(&buf, snapshotTemplateData{Time: t, Dataset: path.Base(dataset)}); err != nil {
+			return "", fmt.Errorf("could not render the snapshot name template %s - %v", nameTemplate, err)
+		}
+		name = buf.String()
+	}
+
+	name = snapshotTemplateReplacer(t).Replace(name)
+	if !validSnapshotName.MatchString(name) {
+		return "", fmt.Errorf("the snapshot name template %s produced an invalid snapshot name %q", nameTemplate, name)
+	}
+	return name, nil
+}
+
+// SnapshotBefore will take a new snapshot of the volume, named using the SnapshotBefore template
+// and the job's start time, so a smart option can back it up right after.
+func SnapshotBefore(ctx context.Context, jobInfo *files.JobInfo) error {
+	volume := zfs.GetLocalVolumeName(jobInfo)
+	name, err := snapshotName(jobInfo.SnapshotBefore, volume, jobInfo.StartTime)
+	if err != nil {
+		return err
+	}
+	if !includeSnapshot(&files.SnapshotInfo{Name: name}, newSnapshotFilter(jobInfo.SnapshotPrefix, jobInfo.SnapshotRegexp)) {
+		return fmt.Errorf("the snapshot name %s does not match the snapshot prefix or regex provided and would not be backed up", name)
+	}
+
+	log.AppLogger.Infof("Taking snapshot %s@%s before the backup.", volume, name)
+	return zfs.CreateSnapshot(ctx, volume, name, jobInfo.Recursive || jobInfo.Replication)
+}
+
 // Will list all backups found in the target destination
 func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *files.JobInfo) ([]*files.JobInfo, error) {
 	// Prepare the backend client
@@ -196,7 +351,7 @@ func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *fi
 	}
 
 	// Get the local cache dir
-	localCachePath, cerr := getCacheDir(target)
+	localCachePath, cerr := getCacheDir(jobInfo, target)
 	if cerr != nil {
 		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
 		return nil, cerr
@@ -210,18 +365,20 @@ func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *fi
 	}
 
 	// Read in Manifests and display
-	decodedManifests := make([]*files.JobInfo, 0, len(safeManifests))
-	for _, manifest := range safeManifests {
-		manifestPath := filepath.Join(localCachePath, manifest)
-		decodedManifest, oerr := readManifest(ctx, manifestPath, jobInfo)
-		if oerr != nil {
-			return nil, oerr
-		}
+	manifests, err := readManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if err != nil {
+		return nil, err
+	}
+	decodedManifests := make([]*files.JobInfo, 0, len(manifests))
+	for _, decodedManifest := range manifests {
 		if strings.Compare(decodedManifest.VolumeName, volume) == 0 {
 			decodedManifests = append(decodedManifests, decodedManifest)
 		}
 	}
 
+	// Link incremental backups to their parents so their chains can be followed
+	linkManifests(decodedManifests)
+
 	sort.SliceStable(decodedManifests, func(i, j int) bool {
 		return decodedManifests[i].BaseSnapshot.CreationTime.After(decodedManifests[j].BaseSnapshot.CreationTime)
 	})
@@ -229,8 +386,14 @@ func getBackupsForTarget(ctx context.Context, volume, target string, jobInfo *fi
 }
 
 // Backup will initiate a backup with the provided configuration.
-// nolint:funlen,gocyclo // Difficult to break this up
 func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
+	return runBackup(pctx, jobInfo, nil)
+}
+
+// runBackup will backup the job, limiting the parallel uploads with the provided upload buffer
+// so it can be shared between concurrent backups. A new buffer is used when nil is given.
+// nolint:funlen,gocyclo // Difficult to break this up
+func runBackup(pctx context.Context, jobInfo *files.JobInfo, uploadBuffer chan bool) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
 
@@ -240,28 +403,16 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 		}
 	}
 
-	// Make sure nobody else is working on the same volume/dataset we are!
-	// nolint:gosec // MD5 not used for cryptographic purposes
-	lockFilePath := filepath.Join(os.TempDir(), fmt.Sprintf("zfsbackup.%x.lck", md5.Sum([]byte(jobInfo.VolumeName))))
-	lock, lferr := lockfile.New(lockFilePath)
-	if lferr != nil {
-		log.AppLogger.Errorf("Cannot init lock. reason: %v", lferr)
-		return lferr
+	if err := prepareDataKey(ctx, jobInfo); err != nil {
+		return err
 	}
-	lferr = lock.TryLock()
 
-	if lferr != nil {
-		log.AppLogger.Errorf(
-			"Cannot lock %q, reason: %v. If no other execution of %s is working on %s, you may forcefully remove the lock file located %s.",
-			lock, lferr, config.ProgramName, jobInfo.VolumeName, lockFilePath,
-		)
-		return lferr
+	// Make sure nobody else is working on the same volume/dataset we are!
+	lock, lerr := lockDataset(ctx, jobInfo)
+	if lerr != nil {
+		return lerr
 	}
-	defer func() {
-		if err := lock.Unlock(); err != nil {
-			log.AppLogger.Warningf("Could not release lock %s: %v", lockFilePath, err)
-		}
-	}()
+	defer lock.release()
 
 	fileBufferSize := jobInfo.MaxFileBuffer
 	if fileBufferSize == 0 {
@@ -269,7 +420,9 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 	}
 
 	// Validate the snapshots we want to use exist
-	if ok, verr := validateSnapShotExists(ctx, &jobInfo.BaseSnapshot, zfs.GetLocalVolumeName(jobInfo), false); verr != nil {
+	if jobInfo.Stdin {
+		log.AppLogger.Debugf("Not validating the snapshots of %s, the stream will be read from stdin.", jobInfo.VolumeName)
+	} else if ok, verr := validateSnapShotExists(ctx, &jobInfo.BaseSnapshot, zfs.GetLocalVolumeName(jobInfo), false); verr != nil {
 		log.AppLogger.Errorf("Cannot validate if selected base snapshot exists due to error - %v", verr)
 		return verr
 	} else if !ok {
@@ -277,7 +430,7 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 		return fmt.Errorf("selected base snapshot does not exist")
 	}
 
-	if jobInfo.IncrementalSnapshot.Name != "" {
+	if jobInfo.IncrementalSnapshot.Name != "" && !jobInfo.Stdin {
 		if ok, verr := validateSnapShotExists(ctx, &jobInfo.IncrementalSnapshot, zfs.GetLocalVolumeName(jobInfo), true); verr != nil {
 			log.AppLogger.Errorf("Cannot validate if selected incremental snapshot exists due to error - %v", verr)
 			return verr
@@ -287,20 +440,95 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 		}
 	}
 
+	// Record the compression used by the volume so the receiving pool can be checked for support
+	if jobInfo.CompressedStream() && jobInfo.StreamCompression == "" && !jobInfo.Stdin {
+		compression, perr := zfs.GetZFSProperty(ctx, "compression", zfs.GetLocalVolumeName(jobInfo))
+		if perr != nil {
+			log.AppLogger.Warningf(
+				"Could not determine the compression property of %s, the pool restored to will not be checked for the compression "+
+					"features the stream requires - %v", zfs.GetLocalVolumeName(jobInfo), perr,
+			)
+		}
+		jobInfo.StreamCompression = compression
+	}
+
+	// Record what a zvol contains so it is known before restoring it
+	if !jobInfo.Stdin && jobInfo.Zvol == nil {
+		if zerr := recordZvolInfo(ctx, jobInfo); zerr != nil {
+			log.AppLogger.Warningf("Could not record the zvol details of %s - %v", zfs.GetLocalVolumeName(jobInfo), zerr)
+		}
+	}
+
+	// Record the guid of the snapshot so a restore can be checked against it
+	if !jobInfo.Stdin && jobInfo.SnapshotGUID == "" {
+		snapshot := fmt.Sprintf("%s@%s", zfs.GetLocalVolumeName(jobInfo), jobInfo.BaseSnapshot.Name)
+		guid, gerr := zfs.GetZFSProperty(ctx, "guid", snapshot)
+		if gerr != nil {
+			log.AppLogger.Warningf("Could not determine the guid of %s - %v", snapshot, gerr)
+		}
+		jobInfo.SnapshotGUID = guid
+	}
+
+	// Record the guid of the dataset so backups can tell it apart from a dataset created again under the same name
+	if !jobInfo.Stdin && jobInfo.DatasetGUID == "" {
+		guid, gerr := zfs.GetZFSProperty(ctx, "guid", zfs.GetLocalVolumeName(jobInfo))
+		if gerr != nil {
+			log.AppLogger.Warningf("Could not determine the guid of %s - %v", zfs.GetLocalVolumeName(jobInfo), gerr)
+		}
+		jobInfo.DatasetGUID = guid
+	}
+
+	// Record where the backup is taken so backups of many machines sharing a target can be told apart
+	if jobInfo.Hostname == "" {
+		hostname, herr := os.Hostname()
+		if herr != nil {
+			log.AppLogger.Warningf("Could not determine the hostname - %v", herr)
+		}
+		jobInfo.Hostname = hostname
+	}
+	if !jobInfo.Stdin && jobInfo.PoolName == "" {
+		jobInfo.PoolName = zfs.PoolName(zfs.GetLocalVolumeName(jobInfo))
+		guid, gerr := zfs.GetPoolProperty(ctx, "guid", jobInfo.PoolName)
+		if gerr != nil {
+			log.AppLogger.Warningf("Could not determine the guid of the pool %s - %v", jobInfo.PoolName, gerr)
+		}
+		jobInfo.PoolGUID = guid
+	}
+
+	// Record the properties set on the volume so a restore can set them again
+	if !jobInfo.Stdin && jobInfo.LocalProperties == nil {
+		properties, perr := zfs.GetLocalProperties(ctx, zfs.GetLocalVolumeName(jobInfo))
+		if perr != nil {
+			log.AppLogger.Warningf("Could not get the properties of %s - %v", zfs.GetLocalVolumeName(jobInfo), perr)
+		}
+		jobInfo.LocalProperties = properties
+	}
+
+	// Fail now rather than running out of space in the working directory part way through
+	if err := checkScratchSpace(ctx, jobInfo, 1); err != nil {
+		return err
+	}
+
 	startCh := make(chan *files.VolumeInfo, fileBufferSize) // Sent to ZFS command and meant to be closed when done
 	stepCh := make(chan *files.VolumeInfo, fileBufferSize)  // Used as input to first backend, closed when final manifest is sent through
 
 	var maniwg sync.WaitGroup
 	maniwg.Add(1)
 
-	uploadBuffer := make(chan bool, jobInfo.MaxParallelUploads)
-	defer close(uploadBuffer)
+	if uploadBuffer == nil {
+		uploadBuffer = make(chan bool, jobInfo.MaxParallelUploads)
+		defer close(uploadBuffer)
+	}
 
 	fileBuffer := make(chan bool, fileBufferSize)
 	for i := 0; i < fileBufferSize; i++ {
 		fileBuffer <- true
 	}
 
+	prog := newProgress("Sent", "upload")
+	stopProgress := prog.run(ctx)
+	defer stopProgress()
+
 	var group *errgroup.Group
 	group, ctx = errgroup.WithContext(ctx)
 
@@ -330,28 +558,56 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 
 	// Start the ZFS send stream
 	group.Go(func() error {
-		return sendStream(ctx, jobInfo, startCh, fileBuffer)
+		if jobInfo.Stdin {
+			return readStdinStream(ctx, jobInfo, startCh, fileBuffer, prog)
+		}
+		return sendStream(ctx, jobInfo, startCh, fileBuffer, prog)
 	})
 
 	var usedBackends []backends.Backend
 	var channels []<-chan *files.VolumeInfo
 	channels = append(channels, stepCh)
 
+	// Upload to the targets with the highest priority first
+	sort.SliceStable(jobInfo.Destinations, func(i, j int) bool {
+		return targetOptions(jobInfo.Destinations[i]).Priority > targetOptions(jobInfo.Destinations[j]).Priority
+	})
+
+	totalTargets := len(jobInfo.Destinations)
 	if jobInfo.MaxFileBuffer != 0 {
-		jobInfo.Destinations = append(jobInfo.Destinations, backends.DeleteBackendPrefix+"://")
+		jobInfo.Destinations = append(jobInfo.Destinations, deleteBackendURI)
 	}
 
 	// Prepare backends and setup plumbing
 	for _, destination := range jobInfo.Destinations {
-		backend, berr := prepareBackend(ctx, jobInfo, destination, uploadBuffer)
+		// Targets with their own concurrency limit should not be throttled by (or throttle) the other targets
+		targetBuffer := uploadBuffer
+		if opts := targetOptions(destination); opts.MaxParallelUploads > 0 {
+			targetBuffer = make(chan bool, opts.MaxParallelUploads)
+		}
+		backend, berr := prepareBackend(ctx, jobInfo, destination, targetBuffer)
 		if berr != nil {
 			log.AppLogger.Errorf("Could not initialize backend due to error - %v.", berr)
 			return berr
 		}
-		_, cerr := getCacheDir(destination)
-		if cerr != nil {
-			log.AppLogger.Errorf("Could not create cache for destination %s due to error - %v.", destination, cerr)
-			return cerr
+		if !jobInfo.NoCache {
+			if _, cerr := getCacheDir(jobInfo, destination); cerr != nil {
+				log.AppLogger.Errorf("Could not create cache for destination %s due to error - %v.", destination, cerr)
+				return cerr
+			}
+		}
+		// A manifest of the same backup set already in the target is kept rather than overwritten
+		if destination != deleteBackendURI {
+			generation, gerr := supersedeManifest(ctx, backend, jobInfo)
+			if gerr != nil {
+				log.AppLogger.Errorf("Could not keep the manifest already in %s due to error - %v.", destination, gerr)
+				return gerr
+			}
+			manifestmutex.Lock()
+			if generation > jobInfo.ManifestGeneration {
+				jobInfo.ManifestGeneration = generation
+			}
+			manifestmutex.Unlock()
 		}
 		out, waitgroup := retryUploadChainer(ctx, channels[len(channels)-1], backend, jobInfo, destination)
 		channels = append(channels, out)
@@ -369,19 +625,26 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 				if !ok {
 					return nil
 				}
+				if err := checkTargetPolicy(jobInfo, vol, totalTargets); err != nil {
+					return err
+				}
 				if !vol.IsManifest {
 					log.AppLogger.Debugf("Volume %s has finished the entire pipeline.", vol.ObjectName)
+					prog.addWritten(vol.Size)
+					prog.addTransferred(vol.Size * uint64(len(vol.Targets)))
 					log.AppLogger.Debugf("Adding %s to the manifest volume list.", vol.ObjectName)
 					manifestmutex.Lock()
 					jobInfo.Volumes = append(jobInfo.Volumes, vol)
 					manifestmutex.Unlock()
 					// Write a manifest file and save it locally in order to resume later
-					manifestVol, err := saveManifest(ctx, jobInfo, false)
-					if err != nil {
-						return err
-					}
-					if err = manifestVol.DeleteVolume(); err != nil {
-						log.AppLogger.Warningf("Error deleting temporary manifest file  - %v", err)
+					if !jobInfo.NoCache {
+						manifestVol, err := saveManifest(ctx, jobInfo, false)
+						if err != nil {
+							return err
+						}
+						if err = manifestVol.DeleteVolume(); err != nil {
+							log.AppLogger.Warningf("Error deleting temporary manifest file  - %v", err)
+						}
 					}
 					maniwg.Done()
 				} else {
@@ -408,6 +671,7 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 		log.AppLogger.Infof("All volumes dispatched in pipeline, finalizing manifest file.")
 		manifestmutex.Lock()
 		jobInfo.EndTime = time.Now()
+		jobInfo.Compression = jobInfo.CompressionSummary()
 		manifestmutex.Unlock()
 		manifestVol, err := saveManifest(ctx, jobInfo, true)
 		if err != nil {
@@ -419,6 +683,7 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 	})
 
 	err := group.Wait() // Wait for ZFS Send to finish, Backends to finish, and Manifest files to be copied/uploaded
+	stopProgress()
 	if err != nil {
 		return err
 	}
@@ -449,6 +714,31 @@ func Backup(pctx context.Context, jobInfo *files.JobInfo) error {
 		)
 	}
 
+	if len(jobInfo.PendingTargets) > 0 {
+		log.AppLogger.Noticef(
+			"The backup still needs to be replicated to: %s. Run the replicate command with the --pending option to do so.",
+			strings.Join(jobInfo.PendingTargets, ", "),
+		)
+	}
+
+	// The index is rebuilt from the cached manifests, so it cannot be kept without a cache
+	if !jobInfo.NoCache {
+		for idx, destination := range jobInfo.Destinations {
+			if destination == deleteBackendURI {
+				continue
+			}
+			if ierr := updateDatasetIndex(ctx, jobInfo, destination, usedBackends[idx]); ierr != nil {
+				log.AppLogger.Warningf("Could not update the index of %s in %s - %v", jobInfo.VolumeName, destination, ierr)
+			}
+		}
+	}
+
+	if jobInfo.HoldTag != "" {
+		if herr := updateChainHolds(ctx, jobInfo); herr != nil {
+			log.AppLogger.Warningf("Could not update the holds on the snapshots of %s - %v", zfs.GetLocalVolumeName(jobInfo), herr)
+		}
+	}
+
 	log.AppLogger.Debugf("Cleaning up resources...")
 
 	for _, backend := range usedBackends {
@@ -474,115 +764,59 @@ func saveManifest(ctx context.Context, j *files.JobInfo, final bool) (*files.Vol
 	// nolint:gosec // MD5 not used for cryptographic purposes here
 	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifest.ObjectName)))
 	manifest.IsFinalManifest = final
-	jsonEnc := json.NewEncoder(manifest)
-	err = jsonEnc.Encode(j)
+	err = files.EncodeManifest(manifest, j)
 	if err != nil {
-		log.AppLogger.Errorf("Could not JSON Encode job information due to error - %v", err)
+		log.AppLogger.Errorf("Could not encode job information due to error - %v", err)
 		return nil, err
 	}
 	if err = manifest.Close(); err != nil {
 		log.AppLogger.Errorf("Could not close manifest volume due to error - %v", err)
 		return nil, err
 	}
+	if final {
+		if err = manifest.SignDetached(ctx, j); err != nil {
+			log.AppLogger.Errorf("Could not sign manifest volume due to error - %v", err)
+			return nil, err
+		}
+	}
 	for _, destination := range j.Destinations {
-		if destination == backends.DeleteBackendPrefix+"://" {
+		if destination == deleteBackendURI || j.NoCache {
 			continue
 		}
-		// nolint:gosec // MD5 not used for cryptographic purposes here
-		safeFolder := fmt.Sprintf("%x", md5.Sum([]byte(destination)))
-		dest := filepath.Join(config.WorkingDir, "cache", safeFolder, safeManifestFile)
+		dest := filepath.Join(cacheDirPath(j, destination), safeManifestFile)
 		if err = manifest.CopyTo(dest); err != nil {
 			log.AppLogger.Warningf("Could not write manifest volume due to error - %v", err)
 			return nil, err
 		}
+		if err = cacheSignature(manifest, dest); err != nil {
+			log.AppLogger.Warningf("Could not write manifest signature due to error - %v", err)
+			return nil, err
+		}
 		log.AppLogger.Debugf("Copied manifest to local cache for destination %s.", destination)
 	}
 	return manifest, nil
 }
 
 // nolint:funlen,gocyclo // Difficult to break this apart
-func sendStream(ctx context.Context, j *files.JobInfo, c chan<- *files.VolumeInfo, buffer <-chan bool) error {
+func sendStream(ctx context.Context, j *files.JobInfo, c chan<- *files.VolumeInfo, buffer <-chan bool, p *progress) error {
 	var group *errgroup.Group
 	group, ctx = errgroup.WithContext(ctx)
 
 	buf := bytes.NewBuffer(nil)
 	cmd := zfs.GetZFSSendCommand(ctx, j)
+	commandLine := strings.Join(cmd.Args, " ")
 	cin, cout := io.Pipe()
 	cmd.Stdout = cout
 	cmd.Stderr = buf
-	counter := datacounter.NewReaderCounter(cin)
-	usingPipe := false
-	if j.MaxFileBuffer == 0 {
-		usingPipe = true
+	if p != nil {
+		// Have zfs report the estimated stream size and its progress in a parsable format
+		cmd.Args = append([]string{cmd.Args[0], cmd.Args[1], "-v", "-P"}, cmd.Args[2:]...)
+		cmd.Stderr = &zfsProgressWriter{p: p, out: buf}
 	}
+	counter := datacounter.NewReaderCounter(cin)
 
 	group.Go(func() error {
-		var lastTotalBytes uint64
-		defer close(c)
-		var err error
-		var volume *files.VolumeInfo
-		skipBytes, volNum := j.TotalBytesStreamedAndVols()
-		lastTotalBytes = skipBytes
-		for {
-			// Skip bytes if we are resuming
-			if skipBytes > 0 {
-				log.AppLogger.Debugf("Want to skip %d bytes.", skipBytes)
-				written, serr := io.CopyN(io.Discard, counter, int64(skipBytes))
-				if serr != nil && serr != io.EOF {
-					log.AppLogger.Errorf("Error while trying to read from the zfs stream to skip %d bytes - %v", skipBytes, serr)
-					return serr
-				}
-				skipBytes -= uint64(written)
-				log.AppLogger.Debugf("Skipped %d bytes of the ZFS send stream.", written)
-				continue
-			}
-
-			// Setup next Volume
-			if volume == nil || volume.Counter() >= (j.VolumeSize*humanize.MiByte)-50*humanize.KiByte {
-				if volume != nil {
-					log.AppLogger.Debugf("Finished creating volume %s", volume.ObjectName)
-					volume.ZFSStreamBytes = counter.Count() - lastTotalBytes
-					lastTotalBytes = counter.Count()
-					if err = volume.Close(); err != nil {
-						log.AppLogger.Errorf("Error while trying to close volume %s - %v", volume.ObjectName, err)
-						return err
-					}
-					if !usingPipe {
-						c <- volume
-					}
-				}
-				<-buffer
-				volume, err = files.CreateBackupVolume(ctx, j, volNum)
-				if err != nil {
-					log.AppLogger.Errorf("Error while creating volume %d - %v", volNum, err)
-					return err
-				}
-				log.AppLogger.Debugf("Starting volume %s", volume.ObjectName)
-				volNum++
-				if usingPipe {
-					c <- volume
-				}
-			}
-
-			// Write a little at a time and break the output between volumes as needed
-			_, ierr := io.CopyN(volume, counter, files.BufferSize*2)
-			if ierr == io.EOF {
-				// We are done!
-				log.AppLogger.Debugf("Finished creating volume %s", volume.ObjectName)
-				volume.ZFSStreamBytes = counter.Count() - lastTotalBytes
-				if err = volume.Close(); err != nil {
-					log.AppLogger.Errorf("Error while trying to close volume %s - %v", volume.ObjectName, err)
-					return err
-				}
-				if !usingPipe {
-					c <- volume
-				}
-				return nil
-			} else if ierr != nil {
-				log.AppLogger.Errorf("Error while trying to read from the zfs stream for volume %s - %v", volume.ObjectName, ierr)
-				return ierr
-			}
-		}
+		return splitStream(ctx, j, counter, c, buffer)
 	})
 
 	// Start the zfs send command
@@ -614,7 +848,7 @@ func sendStream(ctx context.Context, j *files.JobInfo, c chan<- *files.VolumeInf
 	}()
 
 	manifestmutex.Lock()
-	j.ZFSCommandLine = strings.Join(cmd.Args, " ")
+	j.ZFSCommandLine = commandLine
 	manifestmutex.Unlock()
 	// Wait for the command to finish
 
@@ -630,6 +864,127 @@ func sendStream(ctx context.Context, j *files.JobInfo, c chan<- *files.VolumeInf
 	return nil
 }
 
+// splitStream will read the stream provided, splitting it into volumes that are sent to the channel provided.
+// nolint:funlen,gocyclo // Difficult to break this apart
+func splitStream(
+	ctx context.Context,
+	j *files.JobInfo,
+	counter *datacounter.ReaderCounter,
+	c chan<- *files.VolumeInfo,
+	buffer <-chan bool,
+) error {
+	usingPipe := false
+	if j.MaxFileBuffer == 0 {
+		usingPipe = true
+	}
+
+	// Hash the zfs stream bytes of each volume so restores can be verified and volumes named after their content
+	streamHash := sha256.New()
+	stream := io.TeeReader(counter, streamHash)
+
+	var lastTotalBytes uint64
+	defer close(c)
+	var err error
+	var volume *files.VolumeInfo
+	var volumeJobInfo *files.JobInfo
+	sampler := newCompressionSampler(j)
+	skipBytes, volNum := j.TotalBytesStreamedAndVols()
+	lastTotalBytes = skipBytes
+	for {
+		// Skip bytes if we are resuming
+		if skipBytes > 0 {
+			log.AppLogger.Debugf("Want to skip %d bytes.", skipBytes)
+			written, serr := io.CopyN(io.Discard, counter, int64(skipBytes))
+			if serr != nil && serr != io.EOF {
+				log.AppLogger.Errorf("Error while trying to read from the zfs stream to skip %d bytes - %v", skipBytes, serr)
+				return serr
+			}
+			skipBytes -= uint64(written)
+			log.AppLogger.Debugf("Skipped %d bytes of the ZFS send stream.", written)
+			continue
+		}
+
+		// Setup next Volume
+		if volume == nil || volume.Counter() >= (j.VolumeSize*humanize.MiByte)-50*humanize.KiByte {
+			if volume != nil {
+				log.AppLogger.Debugf("Finished creating volume %s", volume.ObjectName)
+				volume.ZFSStreamBytes = counter.Count() - lastTotalBytes
+				lastTotalBytes = counter.Count()
+				if err = volume.Close(); err != nil {
+					log.AppLogger.Errorf("Error while trying to close volume %s - %v", volume.ObjectName, err)
+					return err
+				}
+				volume.ZFSStreamSHA256 = fmt.Sprintf("%x", streamHash.Sum(nil))
+				contentAddress(volumeJobInfo, volume)
+				sampler.observe(volume)
+				if !usingPipe {
+					c <- volume
+				}
+			}
+			<-buffer
+			storeOnly := sampler.nextStoreOnly()
+			volumeJobInfo = volumeJob(j, storeOnly)
+			volume, err = files.CreateBackupVolume(ctx, volumeJobInfo, volNum)
+			if err != nil {
+				log.AppLogger.Errorf("Error while creating volume %d - %v", volNum, err)
+				return err
+			}
+			volume.StoreOnly = storeOnly
+			log.AppLogger.Debugf("Starting volume %s", volume.ObjectName)
+			streamHash.Reset()
+			volNum++
+			if usingPipe {
+				c <- volume
+			}
+		}
+
+		// Write a little at a time and break the output between volumes as needed
+		_, ierr := io.CopyN(volume, stream, files.BufferSize*2)
+		if ierr == io.EOF {
+			// We are done!
+			log.AppLogger.Debugf("Finished creating volume %s", volume.ObjectName)
+			volume.ZFSStreamBytes = counter.Count() - lastTotalBytes
+			if err = volume.Close(); err != nil {
+				log.AppLogger.Errorf("Error while trying to close volume %s - %v", volume.ObjectName, err)
+				return err
+			}
+			volume.ZFSStreamSHA256 = fmt.Sprintf("%x", streamHash.Sum(nil))
+			contentAddress(volumeJobInfo, volume)
+			if !usingPipe {
+				c <- volume
+			}
+			return nil
+		} else if ierr != nil {
+			log.AppLogger.Errorf("Error while trying to read from the zfs stream for volume %s - %v", volume.ObjectName, ierr)
+			return ierr
+		}
+	}
+}
+
+// readStdinStream will split the externally produced stream read from stdin into volumes that are sent to the channel provided.
+func readStdinStream(ctx context.Context, j *files.JobInfo, c chan<- *files.VolumeInfo, buffer <-chan bool, p *progress) error {
+	log.AppLogger.Infof("Reading the stream for %s@%s from stdin", j.VolumeName, j.BaseSnapshot.Name)
+	counter := datacounter.NewReaderCounter(io.TeeReader(config.Stdin, p))
+	if err := splitStream(ctx, j, counter, c, buffer); err != nil {
+		log.AppLogger.Errorf("Error while reading the stream from stdin - %v", err)
+		return err
+	}
+	log.AppLogger.Infof("Finished reading the stream from stdin")
+	manifestmutex.Lock()
+	j.ZFSStreamBytes = counter.Count()
+	manifestmutex.Unlock()
+	return nil
+}
+
+// contentAddress renames a finished volume after the hash of the zfs stream bytes it holds when content addressing is enabled.
+func contentAddress(j *files.JobInfo, volume *files.VolumeInfo) {
+	if !j.ContentAddressed {
+		return
+	}
+	volume.ObjectName = j.ContentVolumeObjectName(volume.ZFSStreamSHA256)
+	log.AppLogger.Debugf("Volume %d will be stored as %s", volume.VolumeNumber, volume.ObjectName)
+}
+
 func tryResume(ctx context.Context, j *files.JobInfo) error {
 	// Temproary Final Manifest File
 	manifest, merr := files.CreateManifestVolume(ctx, j)
@@ -649,9 +1004,7 @@ func tryResume(ctx context.Context, j *files.JobInfo) error {
 	// nolint:gosec // MD5 not used for cryptographic purposes here
 	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifest.ObjectName)))
 
-	destination := j.Destinations[0]
-	safeFolder := fmt.Sprintf("%x", md5.Sum([]byte(destination))) // nolint:gosec // MD5 not used for cryptographic purposes here
-	origManiPath := filepath.Join(config.WorkingDir, "cache", safeFolder, safeManifestFile)
+	origManiPath := filepath.Join(cacheDirPath(j, j.Destinations[0]), safeManifestFile)
 
 	switch originalManifest, oerr := readManifest(ctx, origManiPath, j); {
 	case os.IsNotExist(oerr):
@@ -668,6 +1021,19 @@ func tryResume(ctx context.Context, j *files.JobInfo) error {
 			return fmt.Errorf("option mismatch")
 		}
 
+		if originalManifest.Decompressor != j.Decompressor {
+			log.AppLogger.Errorf(
+				"Cannot resume backup, original decompressor %s != decompressor specified %s",
+				originalManifest.Decompressor, j.Decompressor,
+			)
+			return fmt.Errorf("option mismatch")
+		}
+
+		if originalManifest.ZstdWindowLog != j.ZstdWindowLog || !bytes.Equal(originalManifest.ZstdDictionary, j.ZstdDictionary) {
+			log.AppLogger.Errorf("Cannot resume backup, different zstd window or dictionary specified")
+			return fmt.Errorf("option mismatch")
+		}
+
 		if originalManifest.EncryptTo != j.EncryptTo {
 			log.AppLogger.Errorf(
 				"Cannot resume backup, different encryptTo flags specified (original %v != current %v)",
@@ -684,6 +1050,26 @@ func tryResume(ctx context.Context, j *files.JobInfo) error {
 			return fmt.Errorf("option mismatch")
 		}
 
+		if strings.Join(originalManifest.AgeRecipients, ",") != strings.Join(j.AgeRecipients, ",") {
+			log.AppLogger.Errorf(
+				"Cannot resume backup, different ageRecipient flags specified (original %v != current %v)",
+				originalManifest.AgeRecipients, j.AgeRecipients,
+			)
+			return fmt.Errorf("option mismatch")
+		}
+
+		kmsKeys := make([]string, 0, len(originalManifest.WrappedKeys))
+		for _, wrapped := range originalManifest.WrappedKeys {
+			kmsKeys = append(kmsKeys, wrapped.KeyURI)
+		}
+		if strings.Join(kmsKeys, ",") != strings.Join(j.KMSKeys, ",") {
+			log.AppLogger.Errorf(
+				"Cannot resume backup, different kmsKey flags specified (original %v != current %v)",
+				kmsKeys, j.KMSKeys,
+			)
+			return fmt.Errorf("option mismatch")
+		}
+
 		currentCMD := zfs.GetZFSSendCommand(ctx, j)
 		oldCMD := zfs.GetZFSSendCommand(ctx, originalManifest)
 		oldCMDLine := strings.Join(currentCMD.Args, " ")
@@ -699,6 +1085,7 @@ func tryResume(ctx context.Context, j *files.JobInfo) error {
 		manifestmutex.Lock()
 		j.Volumes = originalManifest.Volumes
 		j.StartTime = originalManifest.StartTime
+		j.WrappedKeys = originalManifest.WrappedKeys
 		manifestmutex.Unlock()
 		log.AppLogger.Infof("Will be resuming previous backup attempt.")
 	}
@@ -715,16 +1102,29 @@ func retryUploadChainer(
 	out := make(chan *files.VolumeInfo)
 	parts := strings.Split(dest, "://")
 	prefix := parts[0]
+	target, opts, _ := backends.ParseTargetURI(dest)
+	parallel := j.MaxParallelUploads
+	if opts != nil && opts.MaxParallelUploads > 0 {
+		parallel = opts.MaxParallelUploads
+	}
+	// Uploads to the delete backend only remove the local copy of a volume and are never paused
+	var window *uploadWindow
+	if dest != deleteBackendURI {
+		var err error
+		if window, err = newUploadWindow(j.UploadWindow); err != nil {
+			log.AppLogger.Warningf("%s backend: Ignoring invalid upload window - %v", prefix, err)
+		}
+	}
 	var gwg *errgroup.Group
-	if j.MaxParallelUploads > 1 {
+	if parallel > 1 {
 		gwg, ctx = errgroup.WithContext(ctx)
 	} else {
 		gwg = new(errgroup.Group)
 	}
 
 	var wg sync.WaitGroup
-	wg.Add(j.MaxParallelUploads)
-	for i := 0; i < j.MaxParallelUploads; i++ {
+	wg.Add(parallel)
+	for i := 0; i < parallel; i++ {
 		gwg.Go(func() error {
 			defer wg.Done()
 			for vol := range in {
@@ -733,6 +1133,10 @@ func retryUploadChainer(
 					return ctx.Err()
 				default:
 					log.AppLogger.Debugf("%s backend: Processing volume %s", prefix, vol.ObjectName)
+					// Volumes keep buffering in the working directory, up to the max file buffer, while the window is closed
+					if err := window.wait(ctx, prefix); err != nil {
+						return err
+					}
 					// Prepare the backoff retryer (forces the user configured retry options across all backends)
 					be := backoff.NewExponentialBackOff()
 					be.MaxInterval = j.MaxBackoffTime
@@ -740,11 +1144,25 @@ func retryUploadChainer(
 					retryconf := backoff.WithContext(be, ctx)
 
 					operation := volUploadWrapper(ctx, b, vol, prefix)
+					if j.ContentAddressed && dest != deleteBackendURI {
+						operation = skipExistingWrapper(ctx, b, vol, prefix, operation)
+					}
 					if err := backoff.Retry(operation, retryconf); err != nil {
-						log.AppLogger.Errorf("%s backend: Failed to upload volume %s due to error: %v", prefix, vol.ObjectName, err)
-						return err
+						if !failoverAllowed(j, dest) || ctx.Err() != nil {
+							log.AppLogger.Errorf("%s backend: Failed to upload volume %s due to error: %v", prefix, vol.ObjectName, err)
+							return err
+						}
+						// Let the volume continue down the pipeline, the target policy is enforced once it reaches the end
+						log.AppLogger.Warningf(
+							"%s backend: Failed to upload volume %s due to error: %v, continuing with the remaining targets",
+							prefix, vol.ObjectName, err,
+						)
+					} else {
+						if dest != deleteBackendURI {
+							vol.Targets = append(vol.Targets, target)
+						}
+						log.AppLogger.Debugf("%s backend: Processed volume %s", prefix, vol.ObjectName)
 					}
-					log.AppLogger.Debugf("%s backend: Processed volume %s", prefix, vol.ObjectName)
 					out <- vol
 				}
 			}
@@ -762,6 +1180,33 @@ func retryUploadChainer(
 	return out, gwg
 }
 
+// failoverAllowed reports whether a failed upload to the destination can be tolerated under the target policy.
+func failoverAllowed(j *files.JobInfo, dest string) bool {
+	return dest != deleteBackendURI && j.TargetPolicy != "" && j.TargetPolicy != files.TargetPolicyAll
+}
+
+// checkTargetPolicy verifies the volume made it to enough targets to satisfy the target policy.
+func checkTargetPolicy(j *files.JobInfo, vol *files.VolumeInfo, totalTargets int) error {
+	if required := j.RequiredTargets(totalTargets); len(vol.Targets) < required {
+		log.AppLogger.Errorf(
+			"Volume %s was only uploaded to %d of %d targets, %d required by the %s target policy.",
+			vol.ObjectName, len(vol.Targets), totalTargets, required, j.TargetPolicy,
+		)
+		return fmt.Errorf("volume %s did not reach enough targets", vol.ObjectName)
+	}
+	return nil
+}
+
+func containsTarget(targets []string, target string) bool {
+	target, _, _ = backends.ParseTargetURI(target)
+	for _, t := range targets {
+		if strings.TrimRight(t, "/") == strings.TrimRight(target, "/") {
+			return true
+		}
+	}
+	return false
+}
+
 func volUploadWrapper(ctx context.Context, b backends.Backend, vol *files.VolumeInfo, prefix string) func() error {
 	return func() error {
 		if err := vol.OpenVolume(); err != nil {
@@ -771,9 +1216,48 @@ func volUploadWrapper(ctx context.Context, b backends.Backend, vol *files.Volume
 		defer vol.Close()
 
 		err := b.Upload(ctx, vol)
+		if err == nil {
+			err = uploadSignature(ctx, b, vol)
+		}
 		if err != nil {
 			log.AppLogger.Debugf("%s: Error while uploading volume %s - %v", prefix, vol.ObjectName, err)
 		}
 		return err
 	}
 }
+
+// skipExistingWrapper will only run the upload operation provided if the content addressed volume is not already
+// stored in the backend, e.g. by a retried backup or another dataset with identical data.
+func skipExistingWrapper(
+	ctx context.Context,
+	b backends.Backend,
+	vol *files.VolumeInfo,
+	prefix string,
+	upload func() error,
+) func() error {
+	return func() error {
+		exists, err := objectExists(ctx, b, vol.ObjectName)
+		if err != nil {
+			log.AppLogger.Debugf("%s: Error while checking if volume %s already exists - %v", prefix, vol.ObjectName, err)
+			return err
+		}
+		if exists {
+			log.AppLogger.Infof("%s: Volume %s is already stored, skipping upload.", prefix, vol.ObjectName)
+			return nil
+		}
+		return upload()
+	}
+}
+
+func objectExists(ctx context.Context, b backends.Backend, name string) (bool, error) {
+	objects, err := b.List(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	for _, object := range objects {
+		if object == name {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -21,16 +21,44 @@
 package backup
 
 import (
+	"archive/tar"
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"filippo.io/age"
+	humanize "github.com/dustin/go-humanize"
+	"github.com/juju/ratelimit"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/sync/errgroup"
+
 	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/kms"
+	"github.com/jdfalk/zfsbackup-go/pgp"
+	"github.com/jdfalk/zfsbackup-go/zfs"
 )
 
 // Truly a useless backend
@@ -77,6 +105,46 @@ func TestIncludeSnapshot(t *testing.T) {
 	}
 }
 
+func TestSnapshotTemplateReplacer(t *testing.T) {
+	start := time.Date(2017, time.February, 3, 4, 5, 6, 0, time.UTC)
+	if name := snapshotTemplateReplacer(start).Replace("zfsbackup-%Y%m%d%H%M%S"); name != "zfsbackup-20170203040506" {
+		t.Errorf("Expected zfsbackup-20170203040506, got %s", name)
+	}
+	if name := snapshotTemplateReplacer(start).Replace("auto-%s-100%%"); name != "auto-1486094706-100%" {
+		t.Errorf("Expected auto-1486094706-100%%, got %s", name)
+	}
+}
+
+func TestSnapshotName(t *testing.T) {
+	start := time.Date(2017, time.February, 3, 4, 5, 6, 0, time.UTC)
+	testCases := []struct {
+		template string
+		expected string
+		valid    bool
+	}{
+		{"zfsbackup-%Y%m%dT%H%M%S", "zfsbackup-20170203T040506", true},
+		{"autosnap_%F_%T_daily", "autosnap_2017-02-03_04:05:06_daily", true},
+		{"zfsbackup-{{.Time.Format \"20060102T150405\"}}", "zfsbackup-20170203T040506", true},
+		{"{{.Dataset}}-%y%j", "data-17034", true},
+		{"zfsbackup %Y", "", false},
+		{"{{.Missing}}", "", false},
+		{"{{.Time", "", false},
+		{"", "", false},
+	}
+
+	for idx, c := range testCases {
+		name, err := snapshotName(c.template, "tank/data", start)
+		if c.valid && err != nil {
+			t.Errorf("%d: Expected nil error for template %s, got %v", idx, c.template, err)
+		} else if !c.valid && err == nil {
+			t.Errorf("%d: Expected an error for template %s, got name %s", idx, c.template, name)
+		}
+		if name != c.expected {
+			t.Errorf("%d: Expected %s, got %s", idx, c.expected, name)
+		}
+	}
+}
+
 func TestRetryUploadChainer(t *testing.T) {
 	_, goodVol, badVol, err := prepareTestVols()
 	if err != nil {
@@ -125,35 +193,4555 @@ func TestRetryUploadChainer(t *testing.T) {
 	}
 }
 
-func prepareTestVols() (payload []byte, goodVol, badVol *files.VolumeInfo, err error) {
-	payload = make([]byte, 10*1024*1024)
-	if _, err = rand.Read(payload); err != nil {
-		return
+func TestRetryUploadChainerFailover(t *testing.T) {
+	_, goodVol, badVol, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
 	}
-	reader := bytes.NewReader(payload)
-	goodVol, err = files.CreateSimpleVolume(context.Background(), false)
+	defer goodVol.DeleteVolume()
+
+	j := &files.JobInfo{
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     5 * time.Millisecond,
+		MaxRetryTime:       10 * time.Millisecond,
+		TargetPolicy:       files.TargetPolicyQuorum,
+	}
+
+	in := make(chan *files.VolumeInfo, 2)
+	out, wg := retryUploadChainer(context.Background(), in, &mockBackend{}, j, "mock://")
+	in <- goodVol
+	in <- badVol
+	close(in)
+
+	var vols []*files.VolumeInfo
+	for vol := range out {
+		vols = append(vols, vol)
+	}
+	if errResult := wg.Wait(); errResult != nil {
+		t.Fatalf("Expected nil error with quorum policy, got %v", errResult)
+	}
+
+	if len(vols) != 2 {
+		t.Fatalf("Expected both volumes to be passed along, got %d", len(vols))
+	}
+	if len(goodVol.Targets) != 1 || goodVol.Targets[0] != "mock://" {
+		t.Errorf("Expected good volume to be recorded in the mock target, got %v", goodVol.Targets)
+	}
+	if len(badVol.Targets) != 0 {
+		t.Errorf("Expected bad volume to not be recorded in any target, got %v", badVol.Targets)
+	}
+
+	if err = checkTargetPolicy(j, goodVol, 2); err == nil {
+		t.Errorf("Expected volume stored in 1 of 2 targets to fail the quorum policy")
+	}
+	if err = checkTargetPolicy(j, goodVol, 1); err != nil {
+		t.Errorf("Expected volume stored in 1 of 1 targets to pass the quorum policy, got %v", err)
+	}
+	j.TargetPolicy = files.TargetPolicyAny
+	if err = checkTargetPolicy(j, goodVol, 3); err != nil {
+		t.Errorf("Expected volume stored in 1 of 3 targets to pass the any policy, got %v", err)
+	}
+}
+
+func TestCopyObject(t *testing.T) {
+	payload, goodVol, _, err := prepareTestVols()
 	if err != nil {
-		return
+		t.Fatalf("error preparing volumes for testing - %v", err)
 	}
-	_, err = io.Copy(goodVol, reader)
+	defer goodVol.DeleteVolume()
+	goodVol.ObjectName = "copytest.zstream.vol1"
+
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	src, dst := &backends.FileBackend{}, &backends.FileBackend{}
+	for dir, b := range map[string]*backends.FileBackend{srcDir: src, dstDir: dst} {
+		conf := &backends.BackendConfig{
+			TargetURI:               backends.FileBackendPrefix + "://" + dir,
+			MaxParallelUploadBuffer: make(chan bool, 1),
+		}
+		if err = b.Init(context.Background(), conf); err != nil {
+			t.Fatalf("error initializing file backend - %v", err)
+		}
+	}
+
+	if err = goodVol.OpenVolume(); err != nil {
+		t.Fatalf("could not open volume - %v", err)
+	}
+	err = src.Upload(context.Background(), goodVol)
+	goodVol.Close()
 	if err != nil {
-		return
+		t.Fatalf("could not upload volume - %v", err)
 	}
-	err = goodVol.Close()
+
+	if err = copyObject(context.Background(), src, dst, goodVol.ObjectName); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+
+	copied, err := os.ReadFile(filepath.Join(dstDir, goodVol.ObjectName))
 	if err != nil {
-		return
+		t.Fatalf("could not read copied object - %v", err)
+	}
+	if !bytes.Equal(copied, payload) {
+		t.Errorf("copied object does not match source object")
 	}
 
-	badVol, err = files.CreateSimpleVolume(context.Background(), false)
+	if err = copyObject(context.Background(), src, dst, "missing"); !os.IsNotExist(err) {
+		t.Errorf("Expected not exist error, got %v", err)
+	}
+}
+
+func TestCompareTargetStates(t *testing.T) {
+	ctx := context.Background()
+	dirA, dirB := t.TempDir(), t.TempDir()
+	states := make([]*targetState, 0, 2)
+	for _, dir := range []string{dirA, dirB} {
+		b := &backends.FileBackend{}
+		conf := &backends.BackendConfig{TargetURI: backends.FileBackendPrefix + "://" + dir}
+		if err := b.Init(ctx, conf); err != nil {
+			t.Fatalf("error initializing file backend - %v", err)
+		}
+		states = append(states, &targetState{
+			uri:       conf.TargetURI,
+			backend:   b,
+			manifests: make(map[string]*files.JobInfo),
+			objects:   make(map[string]bool),
+		})
+	}
+
+	// sha256("hello")
+	hello := "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	manifest := &files.JobInfo{Volumes: []*files.VolumeInfo{
+		{ObjectName: "vol1", Size: 5, MD5Sum: "5d41402abc4b2a76b9719d911017c592", SHA256Sum: hello}, // md5("hello")
+		{ObjectName: "vol2", Size: 5, MD5Sum: "5d41402abc4b2a76b9719d911017c592", SHA256Sum: hello},
+		{ObjectName: "vol3", Size: 5, SHA256Sum: hello},
+	}}
+	states[0].manifests["manifest"] = manifest
+
+	write := func(state *targetState, dir, name, content string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("could not write test object - %v", err)
+		}
+		state.objects[name] = true
+	}
+	write(states[0], dirA, "vol1", "hello")
+	write(states[0], dirA, "vol2", "hello")
+	write(states[1], dirB, "vol1", "jello")
+	// No MD5 is recorded for vol3, as for a multipart upload, so only its size can be checked without --deep
+	write(states[0], dirA, "vol3", "hello")
+	write(states[1], dirB, "vol3", "jello")
+
+	expected := []Divergence{
+		{Target: states[1].uri, ObjectName: "manifest", IsManifest: true, Reason: DivergenceMissing},
+		{Target: states[1].uri, ObjectName: "vol1", Reason: DivergenceChecksumMismatch},
+		{Target: states[1].uri, ObjectName: "vol2", Reason: DivergenceMissing},
+	}
+	for _, deep := range []bool{false, true} {
+		result, err := compareTargetStates(ctx, deep, states...)
+		if err != nil {
+			t.Fatalf("Expected nil error, got %v", err)
+		}
+
+		expectedDivergences := expected
+		expectedUnchecked := []UncheckedVolume{{Target: states[0].uri, ObjectName: "vol3"}, {Target: states[1].uri, ObjectName: "vol3"}}
+		if deep {
+			expectedDivergences = append(expectedDivergences, Divergence{Target: states[1].uri, ObjectName: "vol3", Reason: DivergenceChecksumMismatch})
+			expectedUnchecked = nil
+		}
+		if len(result.Divergences) != len(expectedDivergences) {
+			t.Fatalf("deep %v: Expected %d divergences, got %d: %+v", deep, len(expectedDivergences), len(result.Divergences), result.Divergences)
+		}
+		for idx := range expectedDivergences {
+			got := result.Divergences[idx]
+			if got.Target != expectedDivergences[idx].Target || got.ObjectName != expectedDivergences[idx].ObjectName ||
+				got.IsManifest != expectedDivergences[idx].IsManifest || got.Reason != expectedDivergences[idx].Reason {
+				t.Errorf("deep %v, %d: Expected divergence %+v, got %+v", deep, idx, expectedDivergences[idx], got)
+			}
+		}
+		if !reflect.DeepEqual(result.Unchecked, expectedUnchecked) {
+			t.Errorf("deep %v: Expected the volumes not checked to be %+v, got %+v", deep, expectedUnchecked, result.Unchecked)
+		}
+	}
+}
+
+func TestOrderTargetsForVolume(t *testing.T) {
+	targets := []restoreTarget{{uri: "s3://a"}, {uri: "gs://b"}, {uri: "azure://c"}}
+
+	ordered := orderTargetsForVolume(targets, &files.VolumeInfo{})
+	if len(ordered) != 3 || ordered[0].uri != "s3://a" || ordered[2].uri != "azure://c" {
+		t.Errorf("Expected targets to keep their order when the volume records no targets, got %v", ordered)
+	}
+
+	ordered = orderTargetsForVolume(targets, &files.VolumeInfo{Targets: []string{"azure://c/"}})
+	if len(ordered) != 3 || ordered[0].uri != "azure://c" || ordered[1].uri != "s3://a" || ordered[2].uri != "gs://b" {
+		t.Errorf("Expected the target holding the volume to be tried first, got %v", ordered)
+	}
+}
+
+func TestCatalogChain(t *testing.T) {
+	full := &files.JobInfo{VolumeName: "pool", BaseSnapshot: files.SnapshotInfo{Name: "a"}, Separator: "|"}
+	incr := &files.JobInfo{
+		VolumeName:          "pool",
+		BaseSnapshot:        files.SnapshotInfo{Name: "b"},
+		IncrementalSnapshot: files.SnapshotInfo{Name: "a"},
+		Separator:           "|",
+		ParentSnap:          full,
+	}
+	orphan := &files.JobInfo{
+		VolumeName:          "pool",
+		BaseSnapshot:        files.SnapshotInfo{Name: "d"},
+		IncrementalSnapshot: files.SnapshotInfo{Name: "c"},
+		Separator:           "|",
+	}
+	entries := map[string]*CatalogEntry{
+		full.ManifestObjectName():   {Targets: []string{"s3://a", "gs://b"}},
+		incr.ManifestObjectName():   {Targets: []string{"gs://b", "azure://c"}},
+		orphan.ManifestObjectName(): {Targets: []string{"s3://a"}},
+	}
+
+	chain, complete, restorableFrom := catalogChain(incr, entries)
+	if len(chain) != 2 || chain[0] != "a" || chain[1] != "b" {
+		t.Errorf("Expected chain [a b], got %v", chain)
+	}
+	if !complete || len(restorableFrom) != 1 || restorableFrom[0] != "gs://b" {
+		t.Errorf("Expected a complete chain restorable from gs://b, got %v %v", complete, restorableFrom)
+	}
+
+	if _, complete, restorableFrom = catalogChain(orphan, entries); complete || len(restorableFrom) != 0 {
+		t.Errorf("Expected an incomplete chain with no targets, got %v %v", complete, restorableFrom)
+	}
+}
+
+func TestRecursiveVolumes(t *testing.T) {
+	manifestTree := map[string][]*files.JobInfo{"pool/data/b": nil, "pool/data": nil, "pool/database": nil, "pool/data/a/c": nil}
+
+	volumes := recursiveVolumes(manifestTree, "pool/data", true)
+	if len(volumes) != 3 || volumes[0] != "pool/data" || volumes[1] != "pool/data/a/c" || volumes[2] != "pool/data/b" {
+		t.Errorf("Expected [pool/data pool/data/a/c pool/data/b], got %v", volumes)
+	}
+
+	volumes = recursiveVolumes(manifestTree, "pool/data/*", false)
+	if len(volumes) != 1 || volumes[0] != "pool/data/b" {
+		t.Errorf("Expected [pool/data/b], got %v", volumes)
+	}
+	volumes = recursiveVolumes(manifestTree, "pool/data/*", true)
+	if len(volumes) != 2 || volumes[0] != "pool/data/a/c" || volumes[1] != "pool/data/b" {
+		t.Errorf("Expected [pool/data/a/c pool/data/b], got %v", volumes)
+	}
+	j := &files.JobInfo{VolumeName: "pool/data/*", LocalVolume: "backup/restored"}
+	if local := recursiveLocalVolume(j, "pool/data/a/c"); local != "backup/restored/a/c" {
+		t.Errorf("Expected local volume backup/restored/a/c, got %s", local)
+	}
+
+	testCases := []struct {
+		fullPath, lastPath bool
+		expected           string
+	}{
+		{expected: "tank/restore/a/c"},
+		{fullPath: true, expected: "tank/restore"},
+		{lastPath: true, expected: "tank/restore/data/a"},
+	}
+	for idx, testCase := range testCases {
+		j := &files.JobInfo{VolumeName: "pool/data", LocalVolume: "tank/restore", FullPath: testCase.fullPath, LastPath: testCase.lastPath}
+		if local := recursiveLocalVolume(j, "pool/data/a/c"); local != testCase.expected {
+			t.Errorf("%d: Expected local volume %s, got %s", idx, testCase.expected, local)
+		}
+	}
+}
+
+func TestDatasetFilter(t *testing.T) {
+	datasets := []string{"pool/data", "pool/data/tmp", "pool/data/tmp/a", "pool/data/vm", "pool/data/vm/cache", "pool/data/vm/disk0"}
+
+	filter, err := newDatasetFilter(nil, []string{"*/tmp", "regexp:/cache$"})
 	if err != nil {
-		return
+		t.Fatalf("Expected nil error compiling patterns, got %v", err)
 	}
-	err = badVol.Close()
+	selected := filter.apply("pool/data", datasets)
+	if strings.Join(selected, ",") != "pool/data,pool/data/vm,pool/data/vm/disk0" {
+		t.Errorf("Expected excluded datasets and their descendants to be skipped, got %v", selected)
+	}
+
+	filter, err = newDatasetFilter([]string{"pool/data/vm*"}, []string{"*/cache"})
 	if err != nil {
-		return
+		t.Fatalf("Expected nil error compiling patterns, got %v", err)
+	}
+	selected = filter.apply("pool/data", datasets)
+	if strings.Join(selected, ",") != "pool/data,pool/data/vm,pool/data/vm/disk0" {
+		t.Errorf("Expected only included datasets to be selected, got %v", selected)
 	}
 
-	err = badVol.DeleteVolume()
+	if _, err = newDatasetFilter([]string{"regexp:("}, nil); err == nil {
+		t.Errorf("Expected an error compiling an invalid regular expression, got nil")
+	}
+}
 
-	return payload, goodVol, badVol, err
+func TestGlobRoot(t *testing.T) {
+	testCases := map[string]string{
+		"pool/vm/*":        "pool/vm",
+		"pool/*/disk?":     "pool",
+		"*/data":           "",
+		"pool/[ab]/c":      "pool",
+		"pool/data/nested": "pool/data/nested",
+	}
+	for pattern, expected := range testCases {
+		if root := globRoot(pattern); root != expected {
+			t.Errorf("Expected root %q for %s, got %q", expected, pattern, root)
+		}
+	}
+}
+
+func TestEstimateVolumes(t *testing.T) {
+	testCases := []struct {
+		size, volumeSize, expected uint64
+	}{
+		{size: 0, volumeSize: 200, expected: 1},
+		{size: 200 * 1024 * 1024, volumeSize: 200, expected: 1},
+		{size: 200*1024*1024 + 1, volumeSize: 200, expected: 2},
+		{size: 1024 * 1024 * 1024, volumeSize: 100, expected: 11},
+	}
+	for idx, testCase := range testCases {
+		if volumes := estimateVolumes(testCase.size, testCase.volumeSize); volumes != testCase.expected {
+			t.Errorf("%d: Expected %d volumes, got %d", idx, testCase.expected, volumes)
+		}
+	}
+}
+
+func TestZFSProgressWriter(t *testing.T) {
+	p := &progress{action: "Sent", transfer: "upload", start: time.Now()}
+	out := bytes.NewBuffer(nil)
+	w := &zfsProgressWriter{p: p, out: out}
+
+	output := "full\tpool/data@snap\t1048576\nsize\t1048576\n12:00:01\t524288\tpool/data@snap\nwarning: some"
+	if _, err := w.Write([]byte(output)); err != nil {
+		t.Fatalf("Expected nil error writing progress, got %v", err)
+	}
+	if _, err := w.Write([]byte("thing\n")); err != nil {
+		t.Fatalf("Expected nil error writing progress, got %v", err)
+	}
+
+	if p.total != 1048576 || p.streamed != 524288 {
+		t.Errorf("Expected a total of 1048576 and 524288 streamed, got %d and %d", p.total, p.streamed)
+	}
+	if out.String() != "warning: something\n" {
+		t.Errorf("Expected other output to be passed through, got %q", out.String())
+	}
+	if line := p.String(); !strings.HasPrefix(line, "Sent 512 KiB of 1.0 MiB (50.0%)") {
+		t.Errorf("Unexpected progress line %q", line)
+	}
+}
+
+func TestProgressVolumes(t *testing.T) {
+	p := &progress{action: "Received", transfer: "download", start: time.Now(), total: 4096}
+	vol1 := &files.VolumeInfo{ObjectName: "vol1", VolumeNumber: 1, Size: 1024}
+	vol2 := &files.VolumeInfo{ObjectName: "vol2", VolumeNumber: 2, Size: 1024}
+
+	p.setVolumeStage(vol1, volumeDownloading)
+	p.setVolumeStage(vol2, volumeDownloading)
+	p.setVolumeStage(vol1, volumeReceiving)
+	// The download of a streamed volume completes after its receive started
+	p.volumeDownloaded(vol1)
+	p.volumeDownloaded(vol2)
+	p.addStreamed(1024)
+
+	report := p.report()
+	if len(report.Volumes) != 2 || report.Volumes[0].Stage != volumeReceiving || report.Volumes[1].Stage != volumeDownloaded {
+		t.Errorf("Unexpected volume stages %+v", report.Volumes)
+	}
+	if line := p.String(); !strings.HasSuffix(line, "receiving vol 1, downloaded vol 2") {
+		t.Errorf("Unexpected progress line %q", line)
+	}
+
+	p.volumeDone(vol1)
+	p.volumeDone(vol2)
+	p.volumeDownloaded(vol2)
+	if report = p.report(); len(report.Volumes) != 0 {
+		t.Errorf("Expected no volumes once received, got %+v", report.Volumes)
+	}
+	if report.StreamedBytes != 1024 || report.TotalBytes != 4096 || report.ETASeconds < 0 {
+		t.Errorf("Unexpected progress report %+v", report)
+	}
+}
+
+func TestVerifyStreamDigest(t *testing.T) {
+	stream := []byte("zfs stream")
+	sum := sha256.Sum256(stream)
+	vol := &files.VolumeInfo{ObjectName: "vol1", ZFSStreamSHA256: fmt.Sprintf("%x", sum)}
+	j := &files.JobInfo{Verify: true}
+
+	streamHash := sha256.New()
+	streamHash.Write(stream)
+	if err := verifyStreamDigest(j, vol, streamHash); err != nil {
+		t.Errorf("Expected the stream to match, got %v", err)
+	}
+
+	streamHash.Write([]byte("corrupted"))
+	if err := verifyStreamDigest(j, vol, streamHash); err == nil {
+		t.Errorf("Expected an error for a stream that does not match")
+	}
+
+	// Volumes without a recorded digest, or restores without the Verify option, are not checked
+	if err := verifyStreamDigest(j, &files.VolumeInfo{ObjectName: "vol2"}, streamHash); err != nil {
+		t.Errorf("Expected nil error for a volume without a digest, got %v", err)
+	}
+	if err := verifyStreamDigest(&files.JobInfo{}, vol, streamHash); err != nil {
+		t.Errorf("Expected nil error without the Verify option, got %v", err)
+	}
+}
+
+func TestWriteTarArchive(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "dir"), 0o755); err != nil {
+		t.Fatalf("Expected nil error creating a directory, got %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "dir", "file"), []byte("contents"), 0o644); err != nil {
+		t.Fatalf("Expected nil error creating a file, got %v", err)
+	}
+	if err := os.Symlink("dir/file", filepath.Join(root, "link")); err != nil {
+		t.Fatalf("Expected nil error creating a symlink, got %v", err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := writeTarArchive(context.Background(), root, buf); err != nil {
+		t.Fatalf("Expected nil error writing the tar archive, got %v", err)
+	}
+
+	entries := make(map[string]string)
+	tr := tar.NewReader(buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Expected nil error reading the tar archive, got %v", err)
+		}
+		data, _ := io.ReadAll(tr)
+		entries[header.Name] = string(data) + header.Linkname
+	}
+	expected := map[string]string{"dir/": "", "dir/file": "contents", "link": "dir/file"}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected tar entries %v, got %v", expected, entries)
+	}
+}
+
+func TestLatestFullBackup(t *testing.T) {
+	full1 := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "a"}}
+	incr1 := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "b"}, IncrementalSnapshot: full1.BaseSnapshot}
+	full2 := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "c"}}
+	incr2 := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "d"}, IncrementalSnapshot: full2.BaseSnapshot}
+	volumeSnaps := []*files.JobInfo{full1, incr1, full2, incr2}
+
+	testCases := []struct {
+		snapshot string
+		expected *files.JobInfo
+	}{
+		{snapshot: "", expected: full2},
+		{snapshot: "d", expected: full2},
+		{snapshot: "b", expected: full1},
+		{snapshot: "missing", expected: nil},
+	}
+	for idx, testCase := range testCases {
+		if full := latestFullBackup(volumeSnaps, testCase.snapshot); full != testCase.expected {
+			t.Errorf("%d: Expected %v, got %v", idx, testCase.expected, full)
+		}
+	}
+	if full := latestFullBackup(volumeSnaps[1:2], ""); full != nil {
+		t.Errorf("Expected no full backup, got %v", full)
+	}
+}
+
+func TestCheckForcedRollback(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name    string
+		script  string
+		wantErr bool
+	}{
+		{name: "missing volume", script: "echo \"cannot open 'pool/fs': dataset does not exist\" >&2; exit 1\n"},
+		{name: "listing fails", script: "echo 'permission denied' >&2; exit 1\n", wantErr: true},
+		{name: "nothing to discard", script: "case $1 in list) echo 'pool/fs@a 1 snapshot';; get) echo 0;; esac\n"},
+		{name: "confirmed", script: "case $1 in list) echo 'pool/fs@b 2 snapshot';; get) echo 0;; esac\n"},
+	}
+	for _, tc := range testCases {
+		fakeZFS(t, tc.script)
+		err := checkForcedRollback(ctx, &files.JobInfo{Force: true, AssumeYes: true}, "pool/fs", "a")
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected an error %v, got %v", tc.name, tc.wantErr, err)
+		}
+	}
+}
+
+func TestForcedRollbackLosses(t *testing.T) {
+	snapshots := []files.SnapshotInfo{{Name: "d"}, {Name: "c", Bookmark: true}, {Name: "b"}, {Name: "a"}}
+
+	if losses := forcedRollbackLosses(snapshots, "a"); len(losses) != 1 || !strings.HasSuffix(losses[0], ": d, b") {
+		t.Errorf("Expected the snapshots d and b to be lost, got %v", losses)
+	}
+	if losses := forcedRollbackLosses(snapshots, "d"); len(losses) != 0 {
+		t.Errorf("Expected nothing to be lost, got %v", losses)
+	}
+	if losses := forcedRollbackLosses(snapshots, ""); len(losses) != 1 || !strings.HasSuffix(losses[0], "snapshots d, b, a") {
+		t.Errorf("Expected the volume and every snapshot to be lost, got %v", losses)
+	}
+	if losses := forcedRollbackLosses(nil, ""); len(losses) != 1 {
+		t.Errorf("Expected the volume to be lost, got %v", losses)
+	}
+}
+
+func TestChainLimitReached(t *testing.T) {
+	start := time.Now()
+	full := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "a", CreationTime: start}}
+	incr1 := &files.JobInfo{
+		BaseSnapshot:        files.SnapshotInfo{Name: "b", CreationTime: start.Add(24 * time.Hour)},
+		IncrementalSnapshot: full.BaseSnapshot,
+		ParentSnap:          full,
+	}
+	incr2 := &files.JobInfo{
+		BaseSnapshot:        files.SnapshotInfo{Name: "c", CreationTime: start.Add(48 * time.Hour)},
+		IncrementalSnapshot: incr1.BaseSnapshot,
+		ParentSnap:          incr1,
+	}
+	next := files.SnapshotInfo{Name: "d", CreationTime: start.Add(72 * time.Hour)}
+
+	if length, root := backupChain(incr2); length != 2 || root != full {
+		t.Errorf("Expected a chain of 2 incremental backups from the full backup, got %d %v", length, root)
+	}
+
+	testCases := []struct {
+		maxLength int
+		maxAge    time.Duration
+		reached   bool
+	}{
+		{},
+		{maxLength: 3},
+		{maxLength: 2, reached: true},
+		{maxAge: 96 * time.Hour},
+		{maxAge: 48 * time.Hour, reached: true},
+	}
+	for idx, testCase := range testCases {
+		j := &files.JobInfo{BaseSnapshot: next, MaxChainLength: testCase.maxLength, MaxChainAge: testCase.maxAge}
+		if reason := chainLimitReached(j, incr2); (reason != "") != testCase.reached {
+			t.Errorf("%d: Expected limit reached to be %v, got %q", idx, testCase.reached, reason)
+		}
+	}
+}
+
+func TestBackupSetChain(t *testing.T) {
+	full := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "a"}}
+	incr1 := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "b"}, IncrementalSnapshot: full.BaseSnapshot, ParentSnap: full}
+	incr2 := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "c"}, IncrementalSnapshot: incr1.BaseSnapshot, ParentSnap: incr1}
+
+	if chain, err := backupSetChain(incr2); err != nil || len(chain) != 3 || chain[0] != full || chain[1] != incr1 || chain[2] != incr2 {
+		t.Errorf("Expected the chain from the full backup to the incremental backup, got %v %v", chain, err)
+	}
+	if chain, err := backupSetChain(full); err != nil || len(chain) != 1 || chain[0] != full {
+		t.Errorf("Expected only the full backup, got %v %v", chain, err)
+	}
+
+	orphan := &files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "d"}, IncrementalSnapshot: files.SnapshotInfo{Name: "missing"}}
+	if _, err := backupSetChain(orphan); err == nil {
+		t.Errorf("Expected an error for an incremental backup whose parent is missing")
+	}
+}
+
+func TestPrunableChain(t *testing.T) {
+	start := time.Now()
+	vols := func(names ...string) []*files.VolumeInfo {
+		volumes := make([]*files.VolumeInfo, 0, len(names))
+		for _, name := range names {
+			volumes = append(volumes, &files.VolumeInfo{ObjectName: name})
+		}
+		return volumes
+	}
+	snap := func(name string, day int) files.SnapshotInfo {
+		return files.SnapshotInfo{Name: name, CreationTime: start.Add(time.Duration(day) * 24 * time.Hour)}
+	}
+	full := &files.JobInfo{VolumeName: "tank/data", BaseSnapshot: snap("a", 0), Volumes: vols("a1", "shared")}
+	incr1 := &files.JobInfo{VolumeName: "tank/data", BaseSnapshot: snap("b", 1), IncrementalSnapshot: snap("a", 0), Volumes: vols("b1")}
+	incr2 := &files.JobInfo{VolumeName: "tank/data", BaseSnapshot: snap("c", 2), IncrementalSnapshot: snap("b", 1), Volumes: vols("c1")}
+	consolidated := &files.JobInfo{VolumeName: "tank/data", BaseSnapshot: snap("c", 2), Volumes: vols("c2", "shared")}
+	manifests := []*files.JobInfo{full, incr1, incr2, consolidated}
+	linkManifests(manifests)
+
+	if head := consolidateHead(manifests, ""); head != consolidated {
+		t.Errorf("Expected the full backup of the latest snapshot to be preferred, got %v", head)
+	}
+	if head := consolidateHead(manifests, "b"); head != incr1 {
+		t.Errorf("Expected the backup of snapshot b, got %v", head)
+	}
+
+	prunable, volumes := prunableChain(incr2, manifests)
+	if len(prunable) != 3 {
+		t.Errorf("Expected the entire old chain to be prunable, got %d backup sets", len(prunable))
+	}
+	if expected := []string{"c1", "b1", "a1"}; !reflect.DeepEqual(volumes, expected) {
+		t.Errorf("Expected volumes %v to be pruned, got %v", expected, volumes)
+	}
+
+	// A branch from the middle of the chain keeps the backup sets it depends on
+	branch := &files.JobInfo{VolumeName: "tank/data", BaseSnapshot: snap("d", 3), IncrementalSnapshot: snap("b", 1), Volumes: vols("d1")}
+	manifests = append(manifests, branch)
+	linkManifests(manifests)
+	prunable, volumes = prunableChain(incr2, manifests)
+	if len(prunable) != 1 || prunable[0] != incr2 {
+		t.Errorf("Expected only the head of the old chain to be prunable, got %v", prunable)
+	}
+	if expected := []string{"c1"}; !reflect.DeepEqual(volumes, expected) {
+		t.Errorf("Expected volumes %v to be pruned, got %v", expected, volumes)
+	}
+}
+
+func TestDetectZvolSignatures(t *testing.T) {
+	image := func(offset int, magic ...byte) []byte {
+		data := make([]byte, zvolSignatureBytes)
+		copy(data[offset:], magic)
+		return data
+	}
+	ext4 := image(1080, 0x53, 0xEF)
+	ext4[1116], ext4[1120] = 0x4, 0x40
+	gpt := image(512, []byte("EFI PART")...)
+	ntfs := image(3, []byte("NTFS    ")...)
+	for _, data := range [][]byte{gpt, ntfs} {
+		data[510], data[511] = 0x55, 0xAA
+	}
+
+	testCases := []struct {
+		data           []byte
+		partitionTable string
+		filesystem     string
+	}{
+		{image(0), "", ""},
+		{image(510, 0x55, 0xAA), "dos", ""},
+		{gpt, "gpt", ""},
+		{image(0, []byte("XFSB")...), "", "xfs"},
+		{image(0x10040, []byte("_BHRfS_M")...), "", "btrfs"},
+		{image(1080, 0x53, 0xEF), "", "ext2"},
+		{ext4, "", "ext4"},
+		{ntfs, "", "ntfs"},
+		{[]byte("LUKS\xba\xbe"), "", "crypto_LUKS"},
+	}
+
+	for idx, c := range testCases {
+		partitionTable, filesystem := detectZvolSignatures(c.data)
+		if partitionTable != c.partitionTable || filesystem != c.filesystem {
+			t.Errorf("%d: Expected %q/%q, got %q/%q", idx, c.partitionTable, c.filesystem, partitionTable, filesystem)
+		}
+	}
+}
+
+func TestSkipExistingWrapper(t *testing.T) {
+	_, goodVol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+	defer goodVol.DeleteVolume()
+
+	j := &files.JobInfo{ObjectPrefix: "prefix", Compressor: files.InternalCompressor, ContentAddressed: true}
+	sum := strings.Repeat("ab", 32)
+	goodVol.ObjectName = j.ContentVolumeObjectName(sum)
+	if expected := "prefix/objects/ab/" + sum + ".zstream.gz"; goodVol.ObjectName != expected {
+		t.Fatalf("Expected object name %s, got %s", expected, goodVol.ObjectName)
+	}
+	j.EncryptTo = "user@domain.com"
+	if encrypted := j.ContentVolumeObjectName(sum); encrypted == goodVol.ObjectName {
+		t.Errorf("Expected encrypted volumes to be stored under a different name than unencrypted ones")
+	}
+
+	dir := t.TempDir()
+	b := &backends.FileBackend{}
+	conf := &backends.BackendConfig{
+		TargetURI:               backends.FileBackendPrefix + "://" + dir,
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err = b.Init(context.Background(), conf); err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+
+	uploads := 0
+	operation := skipExistingWrapper(context.Background(), b, goodVol, "file", func() error {
+		uploads++
+		return volUploadWrapper(context.Background(), b, goodVol, "file")()
+	})
+
+	for i := 0; i < 2; i++ {
+		if err = operation(); err != nil {
+			t.Fatalf("Expected nil error, got %v", err)
+		}
+	}
+	if uploads != 1 {
+		t.Errorf("Expected the volume to be uploaded once, was uploaded %d times", uploads)
+	}
+}
+
+func TestUploadWindow(t *testing.T) {
+	day := func(hour, min int) time.Time { return time.Date(2020, 1, 1, hour, min, 0, 0, time.UTC) }
+	testCases := []struct {
+		window   string
+		now      time.Time
+		expected time.Time
+	}{
+		{"22:00-06:00", day(23, 0), day(23, 0)},
+		{"22:00-06:00", day(3, 30), day(3, 30)},
+		{"22:00-06:00", day(6, 0), day(22, 0)},
+		{"22:00-06:00", day(12, 0), day(22, 0)},
+		{"09:00-17:00", day(8, 59), day(9, 0)},
+		{"09:00-17:00", day(12, 0), day(12, 0)},
+		{"09:00-17:00", day(18, 0), time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC)},
+	}
+
+	for idx, c := range testCases {
+		w, err := newUploadWindow(c.window)
+		if err != nil {
+			t.Fatalf("%d: unexpected error parsing window %s - %v", idx, c.window, err)
+		}
+		if open := w.nextOpen(c.now); !open.Equal(c.expected) {
+			t.Errorf("%d: Expected window %s to open at %v at %v, got %v", idx, c.window, c.expected, c.now, open)
+		}
+	}
+
+	for _, window := range []string{"22:00", "25:00-06:00", "10:00-10:00"} {
+		if _, err := newUploadWindow(window); err == nil {
+			t.Errorf("Expected an error parsing window %s", window)
+		}
+	}
+
+	var noWindow *uploadWindow
+	if now := day(12, 0); !noWindow.nextOpen(now).Equal(now) {
+		t.Errorf("Expected uploads to always be allowed without a window")
+	}
+}
+
+func TestReadStdinStream(t *testing.T) {
+	payload := bytes.Repeat([]byte("zfsbackup"), 200*1024)
+	oldStdin := config.Stdin
+	config.Stdin = bytes.NewReader(payload)
+	defer func() { config.Stdin = oldStdin }()
+
+	j := &files.JobInfo{
+		VolumeName:    "tank/data",
+		BaseSnapshot:  files.SnapshotInfo{Name: "a"},
+		Stdin:         true,
+		VolumeSize:    1,
+		MaxFileBuffer: 5,
+		Separator:     "|",
+	}
+
+	c := make(chan *files.VolumeInfo, 5)
+	buffer := make(chan bool, 5)
+	for i := 0; i < 5; i++ {
+		buffer <- true
+	}
+	if err := readStdinStream(context.Background(), j, c, buffer, nil); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+
+	var streamed []byte
+	for vol := range c {
+		if err := vol.OpenVolume(); err != nil {
+			t.Fatalf("could not open volume - %v", err)
+		}
+		data, err := io.ReadAll(vol)
+		vol.Close()
+		vol.DeleteVolume()
+		if err != nil {
+			t.Fatalf("could not read volume - %v", err)
+		}
+		streamed = append(streamed, data...)
+	}
+
+	if !bytes.Equal(streamed, payload) {
+		t.Errorf("Expected the volumes to hold the stream read from stdin")
+	}
+	if j.ZFSStreamBytes != uint64(len(payload)) {
+		t.Errorf("Expected %d stream bytes to be recorded, got %d", len(payload), j.ZFSStreamBytes)
+	}
+}
+
+func TestRequiredScratchSpace(t *testing.T) {
+	j := &files.JobInfo{VolumeSize: 200, MaxFileBuffer: 5}
+
+	if got, want := requiredScratchSpace(j, 1, 0), uint64(5*201*humanize.MiByte); got != want {
+		t.Errorf("expected %d bytes for the file buffer, got %d", want, got)
+	}
+	if got, want := requiredScratchSpace(j, 3, 0), uint64(3*5*201*humanize.MiByte); got != want {
+		t.Errorf("expected %d bytes for parallel backups, got %d", want, got)
+	}
+	if got, want := requiredScratchSpace(j, 1, 10*humanize.MiByte), uint64(11*humanize.MiByte); got != want {
+		t.Errorf("expected %d bytes for a small stream, got %d", want, got)
+	}
+	if got, want := requiredScratchSpace(j, 1, 10*humanize.GiByte), uint64(5*201*humanize.MiByte); got != want {
+		t.Errorf("expected %d bytes for a large stream, got %d", want, got)
+	}
+
+	j.MaxFileBuffer = 0
+	if got := requiredScratchSpace(j, 1, 0); got != 0 {
+		t.Errorf("expected no space to be required when piping volumes, got %d", got)
+	}
+}
+
+func TestNoCacheManifest(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	j := &files.JobInfo{VolumeName: "pool/fs", Compressor: files.InternalCompressor, ManifestPrefix: "manifests", NoCache: true}
+	manifest, err := saveManifest(context.Background(), j, true)
+	if err != nil {
+		t.Fatalf("expected no error saving the manifest, got %v", err)
+	}
+
+	if entries, rerr := os.ReadDir(tempdir); rerr != nil || len(entries) != 0 {
+		t.Errorf("expected nothing to be written to the working directory, got %d entries (%v)", len(entries), rerr)
+	}
+
+	if err = manifest.OpenVolume(); err != nil {
+		t.Fatalf("expected no error opening the manifest, got %v", err)
+	}
+	data, err := io.ReadAll(manifest)
+	if err != nil {
+		t.Fatalf("expected no error reading the manifest, got %v", err)
+	}
+	if uint64(len(data)) != manifest.Size || manifest.Size == 0 {
+		t.Errorf("expected to read back the %d bytes written to the manifest, got %d", manifest.Size, len(data))
+	}
+	if err = manifest.Close(); err != nil {
+		t.Errorf("expected no error closing the manifest, got %v", err)
+	}
+	if err = manifest.DeleteVolume(); err != nil {
+		t.Errorf("expected no error deleting the manifest, got %v", err)
+	}
+}
+
+func TestAgeManifest(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate an age identity - %v", err)
+	}
+	j := &files.JobInfo{
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix:   "manifests",
+		Separator:        "|",
+		AgeRecipients:    []string{identity.Recipient().String()},
+		AgeRecipientKeys: []age.Recipient{identity.Recipient()},
+	}
+	manifest, err := files.CreateManifestVolume(context.Background(), j)
+	if err != nil {
+		t.Fatalf("expected no error creating the manifest, got %v", err)
+	}
+	if !strings.HasSuffix(manifest.ObjectName, ".gz.age") {
+		t.Errorf("expected the manifest to be named as an age encrypted file, got %s", manifest.ObjectName)
+	}
+	if err = json.NewEncoder(manifest).Encode(j); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+	if err = manifest.Close(); err != nil {
+		t.Fatalf("expected no error closing the manifest, got %v", err)
+	}
+	path := filepath.Join(tempdir, "manifest")
+	if err = manifest.CopyTo(path); err != nil {
+		t.Fatalf("expected no error copying the manifest, got %v", err)
+	}
+
+	if _, err = readManifest(context.Background(), path, &files.JobInfo{}); err == nil {
+		t.Errorf("expected an error reading the manifest without the age identity")
+	}
+
+	keys := &files.JobInfo{AgeIdentities: []age.Identity{identity}}
+	decoded, err := readManifest(context.Background(), path, keys)
+	if err != nil {
+		t.Fatalf("expected no error reading the manifest with the age identity, got %v", err)
+	}
+	if len(decoded.AgeRecipients) != 1 || decoded.AgeRecipients[0] != j.AgeRecipients[0] {
+		t.Errorf("expected the manifest to record the age recipient, got %v", decoded.AgeRecipients)
+	}
+	decoded.CopyKeys(keys)
+	if len(decoded.AgeIdentities) != 1 || decoded.EncryptKey != nil {
+		t.Errorf("expected the age identity to be used to read the volumes of the backup")
+	}
+}
+
+// fakeKeyService wraps keys by reversing them, and fails to unwrap when it has no access
+type fakeKeyService struct {
+	uri    string
+	denied bool
+	calls  *[]string
+}
+
+func (f *fakeKeyService) Wrap(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return reverseBytes(plaintext), nil
+}
+
+func (f *fakeKeyService) Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	*f.calls = append(*f.calls, f.uri)
+	if f.denied {
+		return nil, fmt.Errorf("access denied")
+	}
+	return reverseBytes(ciphertext), nil
+}
+
+func reverseBytes(in []byte) []byte {
+	out := make([]byte, len(in))
+	for idx, b := range in {
+		out[len(in)-1-idx] = b
+	}
+	return out
+}
+
+func TestDataKey(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	var calls []string
+	oldGetKeyService := getKeyService
+	getKeyService = func(ctx context.Context, uri string) (kms.KeyService, error) {
+		return &fakeKeyService{uri: uri, denied: strings.HasPrefix(uri, kms.AWSKMSPrefix), calls: &calls}, nil
+	}
+	defer func() { getKeyService = oldGetKeyService }()
+
+	awsKey, gcpKey := "awskms://alias/backups", "gcpkms://projects/p/locations/global/keyRings/r/cryptoKeys/k"
+	j := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		KMSKeys:        []string{awsKey, gcpKey},
+	}
+	if err := prepareDataKey(context.Background(), j); err != nil {
+		t.Fatalf("expected no error preparing the data key, got %v", err)
+	}
+	if len(j.WrappedKeys) != 2 || len(j.AgeRecipientKeys) != 1 {
+		t.Fatalf("expected the data key to be wrapped by both keys, got %d wrapped keys", len(j.WrappedKeys))
+	}
+	recipient := j.AgeRecipientKeys[0].(*age.X25519Recipient).String()
+
+	// The manifest is encrypted with the data key, which it leads with wrapped
+	manifest, err := files.CreateManifestVolume(context.Background(), j)
+	if err != nil {
+		t.Fatalf("expected no error creating the manifest, got %v", err)
+	}
+	if strings.HasSuffix(manifest.ObjectName, ".age") {
+		t.Errorf("expected the manifest to keep its name, got %s", manifest.ObjectName)
+	}
+	if err = json.NewEncoder(manifest).Encode(j); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+	if err = manifest.Close(); err != nil {
+		t.Fatalf("expected no error closing the manifest, got %v", err)
+	}
+	path := filepath.Join(tempdir, "manifest")
+	if err = manifest.CopyTo(path); err != nil {
+		t.Fatalf("expected no error copying the manifest, got %v", err)
+	}
+	if raw, rerr := os.ReadFile(path); rerr != nil || bytes.Contains(raw, []byte("pool/fs")) {
+		t.Errorf("expected the manifest to be encrypted, got %v", rerr)
+	}
+	if _, err = files.ExtractLocal(context.Background(), &files.JobInfo{}, path, true); !errors.As(err, new(*files.EncryptedManifestError)) {
+		t.Errorf("expected the manifest to require its data key, got %v", err)
+	}
+	decoded, err := readManifest(context.Background(), path, &files.JobInfo{})
+	if err != nil {
+		t.Fatalf("expected no error reading the manifest without any keys, got %v", err)
+	}
+	if decoded.VolumeName != "pool/fs" || len(decoded.AgeRecipientKeys) != 1 ||
+		decoded.AgeRecipientKeys[0].(*age.X25519Recipient).String() != recipient {
+		t.Errorf("expected the manifest to be decrypted with the unwrapped data key and keep it to be written again")
+	}
+
+	// The key of the target's provider is tried first, falling back to the others
+	calls = nil
+	identity, err := unwrapDataKey(context.Background(), decoded.WrappedKeys, "s3://bucket")
+	if err != nil {
+		t.Fatalf("expected no error unwrapping the data key, got %v", err)
+	}
+	if got := identity.Recipient().String(); got != recipient {
+		t.Errorf("expected the data key unwrapped to match the one generated")
+	}
+	if !reflect.DeepEqual(calls, []string{awsKey, gcpKey}) {
+		t.Errorf("expected the AWS key to be tried first for an S3 target, got %v", calls)
+	}
+	calls = nil
+	if _, err = unwrapDataKey(context.Background(), decoded.WrappedKeys, "gs://bucket"); err != nil || len(calls) != 1 || calls[0] != gcpKey {
+		t.Errorf("expected only the GCP key to be tried for a GCS target, got %v (%v)", calls, err)
+	}
+
+	// A resumed backup keeps the data key of the volumes already uploaded
+	resumed := &files.JobInfo{KMSKeys: j.KMSKeys, WrappedKeys: decoded.WrappedKeys}
+	if err = prepareDataKey(context.Background(), resumed); err != nil {
+		t.Fatalf("expected no error preparing the data key of a resumed backup, got %v", err)
+	}
+	if got := resumed.AgeRecipientKeys[0].(*age.X25519Recipient).String(); got != recipient {
+		t.Errorf("expected the resumed backup to keep the data key")
+	}
+}
+
+func TestCheckAgentSignature(t *testing.T) {
+	status := []byte("[GNUPG:] NEWSIG\n" +
+		"[GNUPG:] GOODSIG 858BDB1D16AD4C27 Test <test@example.com>\n" +
+		"[GNUPG:] VALIDSIG 9A4A8E9E8849BE0804948369858BDB1D16AD4C27 2026-10-17 1792218791 0 4 0 22 8 00\n")
+
+	if err := pgp.CheckAgentSignature(status, "test@example.com"); err != nil {
+		t.Errorf("expected a good signature from the signer, got %v", err)
+	}
+	if err := pgp.CheckAgentSignature(status, "other@example.com"); err == nil {
+		t.Errorf("expected an error when signed by someone else")
+	}
+	if err := pgp.CheckAgentSignature([]byte("[GNUPG:] BADSIG 858BDB1D16AD4C27 Test <test@example.com>\n"), "test@example.com"); err == nil {
+		t.Errorf("expected an error for a bad signature")
+	}
+	if err := pgp.CheckAgentSignature(nil, ""); err != nil {
+		t.Errorf("expected no error when no signature is required, got %v", err)
+	}
+}
+
+func TestReceiveToFile(t *testing.T) {
+	payload, goodVol, _, err := prepareTestVols()
+	if err != nil {
+		t.Fatalf("error preparing volumes for testing - %v", err)
+	}
+
+	dir := t.TempDir()
+	j := &files.JobInfo{
+		VolumeName:          "pool/fs",
+		BaseSnapshot:        files.SnapshotInfo{Name: "snap2"},
+		IncrementalSnapshot: files.SnapshotInfo{Name: "snap1"},
+		ToFile:              dir,
+	}
+	path := streamFilePath(j)
+	if want := filepath.Join(dir, "pool_fs@snap1..snap2.zstream"); path != want {
+		t.Errorf("expected the stream to be written to %s, got %s", want, path)
+	}
+
+	c := make(chan *files.VolumeInfo, 1)
+	c <- goodVol
+	close(c)
+	buffer := make(chan interface{}, 1)
+	buffer <- nil
+	set := &restoreSet{job: *j, manifest: j}
+	if err = receiveToFile(context.Background(), path, set, c, buffer, nil, nil); err != nil {
+		t.Fatalf("expected no error writing the stream, got %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("could not read the stream written - %v", err)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("expected the stream written to match the volume payload")
+	}
+	if _, err = os.Stat(path + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("expected the partial stream file to be renamed, got %v", err)
+	}
+
+	empty := make(chan *files.VolumeInfo)
+	close(empty)
+	if err = receiveToFile(context.Background(), path, set, empty, buffer, nil, nil); err == nil {
+		t.Errorf("expected an error when the stream file already exists")
+	}
+}
+
+func TestRestoreCheckpoint(t *testing.T) {
+	oldWorkingDir := config.WorkingDir
+	config.WorkingDir = t.TempDir()
+	defer func() { config.WorkingDir = oldWorkingDir }()
+
+	dir := t.TempDir()
+	full := &files.JobInfo{VolumeName: "pool/fs", BaseSnapshot: files.SnapshotInfo{Name: "snap1"}, ToFile: dir}
+	incremental := &files.JobInfo{
+		VolumeName:          "pool/fs",
+		BaseSnapshot:        files.SnapshotInfo{Name: "snap2"},
+		IncrementalSnapshot: files.SnapshotInfo{Name: "snap1"},
+		ToFile:              dir,
+		Volumes:             []*files.VolumeInfo{{ObjectName: "vol1"}, {ObjectName: "vol2"}},
+	}
+	sets := []*restoreSet{{job: *full, manifest: full}, {job: *incremental, manifest: incremental}}
+
+	if checkpoint := loadRestoreCheckpoint(&files.JobInfo{}, sets); checkpoint != nil {
+		t.Errorf("expected no checkpoint when not restoring to stream files")
+	}
+
+	// Interrupt the restore after the full backup and the first volume of the incremental backup
+	checkpoint := loadRestoreCheckpoint(full, sets)
+	if got := checkpoint.resume(sets); len(got) != 2 {
+		t.Fatalf("expected a new restore to restore every backup set, got %d", len(got))
+	}
+	fullPath, incrementalPath := streamFilePath(full), streamFilePath(incremental)
+	if err := os.WriteFile(fullPath, []byte("full"), 0o600); err != nil {
+		t.Fatalf("could not write the stream file - %v", err)
+	}
+	if err := checkpoint.written(fullPath); err != nil {
+		t.Fatalf("expected no error recording the stream file, got %v", err)
+	}
+	if err := checkpoint.start(incrementalPath, false); err != nil {
+		t.Fatalf("expected no error starting the stream file, got %v", err)
+	}
+	if err := checkpoint.volumeWritten(incremental.Volumes[0], 4); err != nil {
+		t.Fatalf("expected no error recording the volume, got %v", err)
+	}
+	if err := os.WriteFile(incrementalPath+".partial", []byte("vol1garbage"), 0o600); err != nil {
+		t.Fatalf("could not write the partial stream file - %v", err)
+	}
+
+	sets = []*restoreSet{{job: *full, manifest: full}, {job: *incremental, manifest: incremental}}
+	got := loadRestoreCheckpoint(full, sets).resume(sets)
+	if len(got) != 1 || got[0].manifest != incremental {
+		t.Fatalf("expected only the incremental backup to be left to restore, got %d backup sets", len(got))
+	}
+	if got[0].skip != 1 || got[0].offset != 4 {
+		t.Errorf("expected to resume after the first volume at offset 4, got volume %d at offset %d", got[0].skip, got[0].offset)
+	}
+
+	// Resuming drops whatever was written after the last volume recorded
+	empty := make(chan *files.VolumeInfo)
+	close(empty)
+	if err := receiveToFile(context.Background(), incrementalPath, got[0], empty, nil, nil, checkpoint); err != nil {
+		t.Fatalf("expected no error resuming the stream file, got %v", err)
+	}
+	if data, err := os.ReadFile(incrementalPath); err != nil || string(data) != "vol1" {
+		t.Errorf("expected the resumed stream file to hold the volume written before, got %q (%v)", data, err)
+	}
+
+	checkpoint.remove()
+	if _, err := os.Stat(checkpoint.path); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint to be removed, got %v", err)
+	}
+}
+
+// objectBackend serves the objects it holds for download
+type objectBackend struct {
+	mockBackend
+	objects map[string][]byte
+}
+
+func (o *objectBackend) Download(ctx context.Context, filename string) (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(o.objects[filename])), nil
+}
+
+func (o *objectBackend) List(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	for name := range o.objects {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func TestDownloadPool(t *testing.T) {
+	backend := &objectBackend{objects: make(map[string][]byte)}
+	var sets [][]*files.VolumeInfo
+	for set := 0; set < 2; set++ {
+		var volumes []*files.VolumeInfo
+		for vol := 0; vol < 3; vol++ {
+			name := fmt.Sprintf("set%d.vol%d", set, vol)
+			backend.objects[name] = []byte(name)
+			volumes = append(volumes, &files.VolumeInfo{ObjectName: name, SHA256Sum: fmt.Sprintf("%x", sha256.Sum256([]byte(name)))})
+		}
+		sets = append(sets, volumes)
+	}
+
+	j := &files.JobInfo{MaxFileBuffer: 2, MaxRetryTime: time.Second, MaxBackoffTime: time.Second}
+	group, ctx := errgroup.WithContext(context.Background())
+	pool := newDownloadPool(ctx, group, j, nil)
+	targets := []restoreTarget{{uri: "mock://", backend: backend}}
+	var channels [][]chan *files.VolumeInfo
+	for _, volumes := range sets {
+		channels = append(channels, pool.queue(volumes, targets))
+	}
+	pool.close()
+
+	// Receive the volumes in order, handing back a slot after each one like the receive does
+	for set := range channels {
+		for idx, c := range channels[set] {
+			vol, ok := <-c
+			if !ok {
+				t.Fatalf("expected volume %d of set %d to be downloaded", idx, set)
+			}
+			if err := vol.OpenVolume(); err != nil {
+				t.Fatalf("could not open volume %s - %v", vol.ObjectName, err)
+			}
+			data, err := io.ReadAll(vol)
+			if err != nil || string(data) != vol.ObjectName {
+				t.Errorf("expected volume %s to hold its name, got %q (%v)", vol.ObjectName, data, err)
+			}
+			vol.Close()
+			if err = vol.DeleteVolume(); err != nil {
+				t.Errorf("could not delete volume %s - %v", vol.ObjectName, err)
+			}
+			<-pool.buffer
+		}
+	}
+
+	if err := group.Wait(); err != nil {
+		t.Errorf("expected no error from the download pool, got %v", err)
+	}
+}
+
+func TestVolumeAvailable(t *testing.T) {
+	first := &objectBackend{objects: map[string][]byte{"vol1": nil}}
+	second := &objectBackend{objects: map[string][]byte{"vol1": nil, "vol2": nil}}
+	targets := []restoreTarget{{uri: "mock://first", backend: first}, {uri: "mock://second", backend: second}}
+
+	if !volumeAvailable(context.Background(), targets, &files.VolumeInfo{ObjectName: "vol1"}) {
+		t.Errorf("expected vol1 to be found in the first target")
+	}
+	if !volumeAvailable(context.Background(), targets, &files.VolumeInfo{ObjectName: "vol2"}) {
+		t.Errorf("expected vol2 to be found in the second target")
+	}
+	if volumeAvailable(context.Background(), targets, &files.VolumeInfo{ObjectName: "vol"}) {
+		t.Errorf("expected a volume matching only by prefix to be missing")
+	}
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestLimitDownload(t *testing.T) {
+	r := &closeRecorder{Reader: strings.NewReader("payload")}
+	if limitDownload(r) != io.ReadCloser(r) {
+		t.Errorf("expected downloads not to be wrapped without a download limit")
+	}
+
+	config.BackupDownloadBucket = ratelimit.NewBucketWithRate(1024*1024, 1024*1024)
+	defer func() { config.BackupDownloadBucket = nil }()
+
+	limited := limitDownload(r)
+	data, err := io.ReadAll(limited)
+	if err != nil || string(data) != "payload" {
+		t.Errorf("expected to read the payload through the limiter, got %q (%v)", data, err)
+	}
+	if err = limited.Close(); err != nil || !r.closed {
+		t.Errorf("expected the download to be closed through the limiter (%v)", err)
+	}
+}
+
+func prepareTestVols() (payload []byte, goodVol, badVol *files.VolumeInfo, err error) {
+	payload = make([]byte, 10*1024*1024)
+	if _, err = rand.Read(payload); err != nil {
+		return
+	}
+	reader := bytes.NewReader(payload)
+	goodVol, err = files.CreateSimpleVolume(context.Background(), false)
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(goodVol, reader)
+	if err != nil {
+		return
+	}
+	err = goodVol.Close()
+	if err != nil {
+		return
+	}
+
+	badVol, err = files.CreateSimpleVolume(context.Background(), false)
+	if err != nil {
+		return
+	}
+	err = badVol.Close()
+	if err != nil {
+		return
+	}
+
+	err = badVol.DeleteVolume()
+
+	return payload, goodVol, badVol, err
+}
+
+func TestRekeyVolume(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	backend := &backends.FileBackend{}
+	conf := &backends.BackendConfig{
+		TargetURI:               backends.FileBackendPrefix + "://" + t.TempDir(),
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := backend.Init(ctx, conf); err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+
+	oldIdentity, _ := age.GenerateX25519Identity()
+	newIdentity, _ := age.GenerateX25519Identity()
+	manifest := &files.JobInfo{
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix:   "manifests",
+		Separator:        "|",
+		Compressor:       files.InternalCompressor,
+		CompressionLevel: 6,
+		MaxFileBuffer:    1,
+		AgeRecipients:    []string{oldIdentity.Recipient().String()},
+		AgeRecipientKeys: []age.Recipient{oldIdentity.Recipient()},
+		AgeIdentities:    []age.Identity{oldIdentity},
+	}
+	payload := bytes.Repeat([]byte("zfs stream "), 1000)
+	vol, err := files.CreateBackupVolume(ctx, manifest, 1)
+	if err != nil {
+		t.Fatalf("expected no error creating the volume, got %v", err)
+	}
+	defer vol.DeleteVolume()
+	if _, err = vol.Write(payload); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("expected no error closing the volume, got %v", err)
+	}
+	if err = vol.OpenVolume(); err != nil {
+		t.Fatalf("could not open volume - %v", err)
+	}
+	err = backend.Upload(ctx, vol)
+	vol.Close()
+	if err != nil {
+		t.Fatalf("could not upload volume - %v", err)
+	}
+
+	keys := &files.JobInfo{
+		AgeRecipients:    []string{newIdentity.Recipient().String()},
+		AgeRecipientKeys: []age.Recipient{newIdentity.Recipient()},
+		AgeIdentities:    []age.Identity{newIdentity},
+	}
+	rekeyed := withKeys(manifest, keys)
+	rekeyed.KeyGeneration = 1
+	newVol, err := rekeyVolume(ctx, manifest, rekeyed, backend, vol)
+	if err != nil {
+		t.Fatalf("expected no error rekeying the volume, got %v", err)
+	}
+	if newVol.ObjectName == vol.ObjectName || !strings.Contains(newVol.ObjectName, ".key1.") {
+		t.Errorf("expected the rekeyed volume to be named after the key generation, got %s", newVol.ObjectName)
+	}
+
+	// Only the new identity can read the volume, which is still compressed
+	for _, tc := range []struct {
+		identity *age.X25519Identity
+		valid    bool
+	}{{oldIdentity, false}, {newIdentity, true}} {
+		r, derr := backend.Download(ctx, newVol.ObjectName)
+		if derr != nil {
+			t.Fatalf("could not download the rekeyed volume - %v", derr)
+		}
+		downloaded, _ := files.CreateSimpleVolume(ctx, false)
+		_, _ = io.Copy(downloaded, r)
+		r.Close()
+		downloaded.Close()
+
+		reader := cloneJobInfo(rekeyed)
+		reader.AgeIdentities = []age.Identity{tc.identity}
+		err = downloaded.Extract(ctx, reader, false)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("expected an error reading the rekeyed volume with the old identity")
+			}
+			downloaded.DeleteVolume()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected no error reading the rekeyed volume, got %v", err)
+		}
+		data, rerr := io.ReadAll(downloaded)
+		downloaded.Close()
+		downloaded.DeleteVolume()
+		if rerr != nil || !bytes.Equal(data, payload) {
+			t.Errorf("expected the rekeyed volume to hold the same stream, got %d bytes (%v)", len(data), rerr)
+		}
+	}
+}
+
+func TestDatasetKeys(t *testing.T) {
+	jobInfo := &files.JobInfo{
+		VolumeName: "tank",
+		EncryptTo:  "admin@example.com",
+		DatasetKeys: []*files.DatasetKeys{
+			{Dataset: "tank/tenants/a*", EncryptTo: "a@example.com", SignFrom: "a@example.com"},
+			{Dataset: "tank/tenants/b", EncryptTo: "b@example.com"},
+			{Dataset: "tank/tenants/ab", EncryptTo: "unused@example.com"},
+		},
+	}
+
+	testCases := []struct {
+		dataset   string
+		encryptTo string
+		signFrom  string
+	}{
+		{"tank/home", "admin@example.com", ""},
+		{"tank/tenants/ab", "a@example.com", "a@example.com"},
+		{"tank/tenants/b", "b@example.com", ""},
+		{"tank/tenants/b/db", "b@example.com", ""},
+		{"tank/tenants/bc", "admin@example.com", ""},
+	}
+	for _, tc := range testCases {
+		child := recursiveJobInfo(jobInfo, "tank", tc.dataset)
+		if child.EncryptTo != tc.encryptTo || child.SignFrom != tc.signFrom {
+			t.Errorf("%s: expected keys %q/%q, got %q/%q", tc.dataset, tc.encryptTo, tc.signFrom, child.EncryptTo, child.SignFrom)
+		}
+	}
+}
+
+func TestDatasetCompression(t *testing.T) {
+	jobInfo := &files.JobInfo{
+		VolumeName:       "tank",
+		Compressor:       files.InternalCompressor,
+		CompressionLevel: 6,
+		DatasetCompression: []*files.DatasetCompression{
+			{Dataset: "tank/video", Compressor: files.NoCompressor},
+			{Dataset: "tank/docs", Compressor: "xz", CompressionLevel: 9, Decompressor: "xz -d -c"},
+			{Dataset: "tank/logs*", CompressionLevel: 1},
+		},
+	}
+
+	testCases := []struct {
+		dataset      string
+		compressor   string
+		level        int
+		decompressor string
+	}{
+		{"tank/home", files.InternalCompressor, 6, ""},
+		{"tank/video", "", 6, ""},
+		{"tank/video/raw", "", 6, ""},
+		{"tank/docs", "xz", 9, "xz -d -c"},
+		{"tank/logs2", files.InternalCompressor, 1, ""},
+	}
+	for _, tc := range testCases {
+		child := recursiveJobInfo(jobInfo, "tank", tc.dataset)
+		if child.Compressor != tc.compressor || child.CompressionLevel != tc.level || child.Decompressor != tc.decompressor {
+			t.Errorf(
+				"%s: expected compression %q/%d/%q, got %q/%d/%q", tc.dataset, tc.compressor, tc.level, tc.decompressor,
+				child.Compressor, child.CompressionLevel, child.Decompressor,
+			)
+		}
+	}
+}
+
+func TestHideNames(t *testing.T) {
+	j := &files.JobInfo{
+		VolumeName:          "pool/tenant",
+		BaseSnapshot:        files.SnapshotInfo{Name: "snap2"},
+		IncrementalSnapshot: files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix:      "manifests",
+		Separator:           "|",
+		Compressor:          files.InternalCompressor,
+		EncryptTo:           "a@example.com",
+		HideNames:           true,
+		NamesKey:            []byte("0123456789abcdef0123456789abcdef"),
+	}
+	for _, name := range []string{j.ManifestObjectName(), j.BackupVolumeObjectName(1)} {
+		if strings.Contains(name, "tenant") || strings.Contains(name, "snap") {
+			t.Errorf("expected the object name to hide the volume and snapshot names, got %s", name)
+		}
+	}
+
+	other := *j
+	other.NamesKey = []byte("fedcba9876543210fedcba9876543210")
+	if other.ManifestObjectName() == j.ManifestObjectName() {
+		t.Errorf("expected backups named with different keys to be named differently")
+	}
+	other = *j
+	other.BaseSnapshot.Name = "snap3"
+	if other.BackupVolumeObjectName(1) == j.BackupVolumeObjectName(1) {
+		t.Errorf("expected backups of different snapshots to be named differently")
+	}
+}
+
+func TestManifestSignature(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	signer, err := openpgp.NewEntity("Test", "", "test@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate a signing key - %v", err)
+	}
+	other, err := openpgp.NewEntity("Other", "", "other@example.com", nil)
+	if err != nil {
+		t.Fatalf("could not generate a signing key - %v", err)
+	}
+	identity, _ := age.GenerateX25519Identity()
+
+	// age encrypted manifests carry no embedded signature, so only the detached one is checked
+	j := &files.JobInfo{
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix:   "manifests",
+		Separator:        "|",
+		AgeRecipients:    []string{identity.Recipient().String()},
+		AgeRecipientKeys: []age.Recipient{identity.Recipient()},
+		SignKey:          signer,
+	}
+	manifest, err := files.CreateManifestVolume(context.Background(), j)
+	if err != nil {
+		t.Fatalf("expected no error creating the manifest, got %v", err)
+	}
+	defer manifest.DeleteVolume()
+	if err = json.NewEncoder(manifest).Encode(j); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+	if err = manifest.Close(); err != nil {
+		t.Fatalf("expected no error closing the manifest, got %v", err)
+	}
+	if err = manifest.SignDetached(context.Background(), j); err != nil || len(manifest.Signature) == 0 {
+		t.Fatalf("expected the manifest to be signed, got %v", err)
+	}
+	path := filepath.Join(tempdir, "manifest")
+	if err = manifest.CopyTo(path); err != nil {
+		t.Fatalf("expected no error copying the manifest, got %v", err)
+	}
+	if err = cacheSignature(manifest, path); err != nil {
+		t.Fatalf("expected no error caching the signature, got %v", err)
+	}
+
+	keys := &files.JobInfo{AgeIdentities: []age.Identity{identity}, SignKey: signer}
+	if _, err = readManifest(context.Background(), path, keys); err != nil {
+		t.Errorf("expected no error reading the signed manifest, got %v", err)
+	}
+	if _, err = readManifest(context.Background(), path, &files.JobInfo{AgeIdentities: keys.AgeIdentities, SignKey: other}); err == nil {
+		t.Errorf("expected an error verifying the manifest with another key")
+	}
+
+	original, _ := os.ReadFile(path)
+	tampered := append(append([]byte(nil), original...), '\n')
+	if err = os.WriteFile(path, tampered, 0o600); err != nil {
+		t.Fatalf("could not tamper with the manifest - %v", err)
+	}
+	if _, err = readManifest(context.Background(), path, keys); err == nil {
+		t.Errorf("expected an error reading a tampered manifest")
+	}
+
+	// Manifests uploaded before detached signatures were written are still read
+	_ = os.WriteFile(path, original, 0o600)
+	_ = cacheSignature(&files.VolumeInfo{}, path)
+	if _, err = readManifest(context.Background(), path, keys); err != nil {
+		t.Errorf("expected no error reading a manifest without a detached signature, got %v", err)
+	}
+}
+
+func TestVerifyVolumeCrypto(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	backend := &backends.FileBackend{}
+	conf := &backends.BackendConfig{
+		TargetURI:               backends.FileBackendPrefix + "://" + t.TempDir(),
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := backend.Init(ctx, conf); err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+
+	identity, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+	manifest := &files.JobInfo{
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix:   "manifests",
+		Separator:        "|",
+		MaxFileBuffer:    1,
+		AgeRecipients:    []string{identity.Recipient().String()},
+		AgeRecipientKeys: []age.Recipient{identity.Recipient()},
+	}
+	// Larger than what is downloaded so only the start of the volume is checked
+	payload := make([]byte, 4*cryptoSampleSize)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not generate the payload - %v", err)
+	}
+	vol, err := files.CreateBackupVolume(ctx, manifest, 1)
+	if err != nil {
+		t.Fatalf("expected no error creating the volume, got %v", err)
+	}
+	defer vol.DeleteVolume()
+	if _, err = vol.Write(payload); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("expected no error closing the volume, got %v", err)
+	}
+	if err = vol.OpenVolume(); err != nil {
+		t.Fatalf("could not open volume - %v", err)
+	}
+	err = backend.Upload(ctx, vol)
+	vol.Close()
+	if err != nil {
+		t.Fatalf("could not upload volume - %v", err)
+	}
+
+	manifest.AgeIdentities = []age.Identity{identity}
+	if err = verifyVolumeCrypto(ctx, manifest, backend, vol); err != nil {
+		t.Errorf("expected the volume to verify, got %v", err)
+	}
+
+	manifest.AgeIdentities = []age.Identity{other}
+	if err = verifyVolumeCrypto(ctx, manifest, backend, vol); err == nil {
+		t.Errorf("expected an error verifying the volume with another identity")
+	}
+
+	if err = verifyVolumeCrypto(ctx, &files.JobInfo{}, backend, vol); !errors.Is(err, files.ErrNotEncrypted) {
+		t.Errorf("expected ErrNotEncrypted without any keys, got %v", err)
+	}
+}
+
+func TestVerifyVolumeDigest(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	backend := &backends.FileBackend{}
+	conf := &backends.BackendConfig{
+		TargetURI:               backends.FileBackendPrefix + "://" + t.TempDir(),
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := backend.Init(ctx, conf); err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+
+	manifest := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		MaxFileBuffer:  1,
+	}
+	vol, err := files.CreateBackupVolume(ctx, manifest, 1)
+	if err != nil {
+		t.Fatalf("expected no error creating the volume, got %v", err)
+	}
+	defer vol.DeleteVolume()
+	if _, err = vol.Write(bytes.Repeat([]byte("zfs stream "), 10000)); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("expected no error closing the volume, got %v", err)
+	}
+	if err = vol.OpenVolume(); err != nil {
+		t.Fatalf("could not open volume - %v", err)
+	}
+	err = backend.Upload(ctx, vol)
+	vol.Close()
+	if err != nil {
+		t.Fatalf("could not upload volume - %v", err)
+	}
+
+	if err = verifyVolumeDigest(ctx, manifest, backend, vol); err != nil {
+		t.Errorf("expected the volume to verify, got %v", err)
+	}
+
+	corrupt := &files.VolumeInfo{ObjectName: vol.ObjectName, Size: vol.Size, SHA256Sum: strings.Repeat("0", 64)}
+	if err = verifyVolumeDigest(ctx, manifest, backend, corrupt); err == nil {
+		t.Errorf("expected an error verifying a volume whose digest does not match")
+	}
+
+	corrupt = &files.VolumeInfo{ObjectName: vol.ObjectName, Size: vol.Size + 1, SHA256Sum: vol.SHA256Sum}
+	if err = verifyVolumeDigest(ctx, manifest, backend, corrupt); err == nil {
+		t.Errorf("expected an error verifying a volume whose size does not match")
+	}
+}
+
+func TestDigestAlgorithm(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	backend := &backends.FileBackend{}
+	conf := &backends.BackendConfig{
+		TargetURI:               backends.FileBackendPrefix + "://" + t.TempDir(),
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := backend.Init(ctx, conf); err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+
+	for _, algorithm := range []string{files.DigestSHA256, files.DigestSHA512, files.DigestBLAKE3} {
+		manifest := &files.JobInfo{
+			VolumeName:      "pool/fs",
+			BaseSnapshot:    files.SnapshotInfo{Name: "snap1"},
+			ManifestPrefix:  "manifests",
+			Separator:       "|",
+			MaxFileBuffer:   1,
+			DigestAlgorithm: algorithm,
+		}
+		vol, err := files.CreateBackupVolume(ctx, manifest, 1)
+		if err != nil {
+			t.Fatalf("expected no error creating the volume, got %v", err)
+		}
+		if _, err = vol.Write(bytes.Repeat([]byte("zfs stream "), 10000)); err != nil {
+			t.Fatalf("expected no error writing the volume, got %v", err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("expected no error closing the volume, got %v", err)
+		}
+
+		expected, _ := files.NewDigest(algorithm)
+		if err = vol.OpenVolume(); err != nil {
+			t.Fatalf("could not open volume - %v", err)
+		}
+		if _, err = io.Copy(expected, vol); err != nil {
+			t.Fatalf("could not read volume - %v", err)
+		}
+		vol.Close()
+		if sum := fmt.Sprintf("%x", expected.Sum(nil)); vol.Checksum() != sum || vol.ChecksumAlgorithm() != algorithm {
+			t.Errorf("expected the %s digest of the volume to be %s, got %s (%s)", algorithm, sum, vol.Checksum(), vol.ChecksumAlgorithm())
+		}
+		if algorithm != files.DigestSHA256 && (vol.SHA256Sum != "" || vol.DigestAlgorithm != algorithm) {
+			t.Errorf("expected only the %s digest of the volume to be computed, got %s", algorithm, vol.SHA256Sum)
+		}
+
+		if err = vol.OpenVolume(); err != nil {
+			t.Fatalf("could not open volume - %v", err)
+		}
+		err = backend.Upload(ctx, vol)
+		vol.Close()
+		if err != nil {
+			t.Fatalf("could not upload volume - %v", err)
+		}
+		if err = verifyVolumeDigest(ctx, manifest, backend, vol); err != nil {
+			t.Errorf("expected the volume digested with %s to verify, got %v", algorithm, err)
+		}
+		vol.DeleteVolume()
+	}
+
+	if _, err := files.NewDigest("md5"); err == nil {
+		t.Errorf("expected an unknown digest algorithm to be refused")
+	}
+}
+
+func TestInternalCompressors(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	payload := bytes.Repeat([]byte("zfs stream "), 100000)
+	testCases := []struct {
+		compressor string
+		level      int
+		windowLog  int
+		extension  string
+	}{
+		{files.InternalLZ4Compressor, 1, 0, ".lz4"},
+		{files.InternalLZ4Compressor, 9, 0, ".lz4"},
+		{files.InternalZstdCompressor, 1, 0, ".zst"},
+		{files.InternalZstdCompressor, 9, 27, ".zst"},
+	}
+	for _, tc := range testCases {
+		level := tc.level
+		j := &files.JobInfo{
+			VolumeName:       "pool/fs",
+			BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+			Separator:        "|",
+			Compressor:       tc.compressor,
+			CompressionLevel: level,
+			ZstdWindowLog:    tc.windowLog,
+			MaxFileBuffer:    1,
+		}
+		vol, err := files.CreateBackupVolume(ctx, j, 1)
+		if err != nil {
+			t.Fatalf("expected no error creating the volume, got %v", err)
+		}
+		if !strings.Contains(vol.ObjectName, tc.extension) {
+			t.Errorf("expected the volume to be named with the %s extension, got %s", tc.extension, vol.ObjectName)
+		}
+		if _, err = vol.Write(payload); err != nil {
+			t.Fatalf("expected no error writing the volume, got %v", err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("expected no error closing the volume, got %v", err)
+		}
+		if vol.Size >= uint64(len(payload)) {
+			t.Errorf("expected the volume to be compressed at level %d, got %d bytes", level, vol.Size)
+		}
+
+		if err = vol.Extract(ctx, j, false); err != nil {
+			t.Fatalf("expected no error extracting the volume, got %v", err)
+		}
+		data, rerr := io.ReadAll(vol)
+		vol.Close()
+		vol.DeleteVolume()
+		if rerr != nil || !bytes.Equal(data, payload) {
+			t.Errorf("expected the %s volume to hold the same stream at level %d, got %d bytes (%v)", tc.compressor, level, len(data), rerr)
+		}
+	}
+}
+
+func TestAdaptiveCompression(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	// Random data does not compress, so only the first volume should be compressed
+	payload := make([]byte, 4*1024*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("could not generate the payload - %v", err)
+	}
+	oldStdin := config.Stdin
+	config.Stdin = bytes.NewReader(payload)
+	defer func() { config.Stdin = oldStdin }()
+
+	j := &files.JobInfo{
+		VolumeName:          "tank/data",
+		BaseSnapshot:        files.SnapshotInfo{Name: "a"},
+		Stdin:               true,
+		VolumeSize:          1,
+		MaxFileBuffer:       5,
+		Separator:           "|",
+		Compressor:          files.InternalCompressor,
+		CompressionLevel:    6,
+		AdaptiveCompression: true,
+	}
+
+	c := make(chan *files.VolumeInfo, 10)
+	buffer := make(chan bool, 10)
+	for i := 0; i < 10; i++ {
+		buffer <- true
+	}
+	if err := readStdinStream(context.Background(), j, c, buffer, nil); err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+
+	var streamed []byte
+	stored := 0
+	for vol := range c {
+		if vol.VolumeNumber == 1 && vol.StoreOnly {
+			t.Errorf("expected the first volume to be compressed")
+		}
+		if vol.StoreOnly {
+			stored++
+			if strings.Contains(vol.ObjectName, ".gz") {
+				t.Errorf("expected the store-only volume to be named without the compressor extension, got %s", vol.ObjectName)
+			}
+		}
+		if err := vol.Extract(context.Background(), j, false); err != nil {
+			t.Fatalf("could not extract volume - %v", err)
+		}
+		data, err := io.ReadAll(vol)
+		vol.Close()
+		vol.DeleteVolume()
+		if err != nil {
+			t.Fatalf("could not read volume - %v", err)
+		}
+		streamed = append(streamed, data...)
+	}
+
+	if stored == 0 {
+		t.Errorf("expected the incompressible volumes to be stored without compression")
+	}
+	if !bytes.Equal(streamed, payload) {
+		t.Errorf("Expected the volumes to hold the stream read from stdin")
+	}
+}
+
+func TestCompressionSampler(t *testing.T) {
+	sampler := newCompressionSampler(&files.JobInfo{Compressor: files.InternalCompressor, AdaptiveCompression: true})
+	sampler.observe(&files.VolumeInfo{Size: 990 * 1024, ZFSStreamBytes: 1000 * 1024})
+	for i := 0; i < resampleInterval; i++ {
+		if !sampler.nextStoreOnly() {
+			t.Fatalf("expected volume %d to be stored without compression", i)
+		}
+	}
+	if sampler.nextStoreOnly() {
+		t.Errorf("expected a volume to be compressed again to resample the data")
+	}
+	sampler.observe(&files.VolumeInfo{Size: 300 * 1024, ZFSStreamBytes: 1000 * 1024})
+	if sampler.nextStoreOnly() {
+		t.Errorf("expected compressible data to be compressed")
+	}
+
+	disabled := newCompressionSampler(&files.JobInfo{Compressor: files.ZfsCompressor, AdaptiveCompression: true})
+	disabled.observe(&files.VolumeInfo{Size: 990 * 1024, ZFSStreamBytes: 1000 * 1024})
+	if disabled.nextStoreOnly() {
+		t.Errorf("expected zfs compressed streams to be left alone")
+	}
+}
+
+func TestBenchCompressor(t *testing.T) {
+	sample := bytes.Repeat([]byte("zfs stream "), 100000)
+	for _, compressor := range []string{files.InternalCompressor, files.InternalLZ4Compressor} {
+		j := &files.JobInfo{Compressor: compressor, CompressionLevel: 6}
+		result := benchCompressor(context.Background(), j, sample)
+		if result.Error != "" {
+			t.Fatalf("expected no error benchmarking %s, got %s", compressor, result.Error)
+		}
+		if result.SampleBytes != uint64(len(sample)) || result.CompressedBytes == 0 || result.Ratio <= 1 {
+			t.Errorf("expected %s to compress the sample, got %+v", compressor, result)
+		}
+	}
+
+	result := benchCompressor(context.Background(), &files.JobInfo{Compressor: "not-a-compressor", CompressionLevel: 6}, sample)
+	if result.Error == "" {
+		t.Errorf("expected an error benchmarking a missing compressor")
+	}
+}
+
+func TestCustomCompressor(t *testing.T) {
+	if _, err := exec.LookPath("gzip"); err != nil {
+		t.Skip("gzip is not installed")
+	}
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	payload := bytes.Repeat([]byte("zfs stream "), 100000)
+	j := &files.JobInfo{
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+		Separator:        "|",
+		Compressor:       "gzip --fast -c",
+		Decompressor:     "gzip -d -c",
+		CompressionLevel: 6,
+		MaxFileBuffer:    1,
+	}
+	vol, err := files.CreateBackupVolume(ctx, j, 1)
+	if err != nil {
+		t.Fatalf("expected no error creating the volume, got %v", err)
+	}
+	if !strings.Contains(vol.ObjectName, ".gzip.") {
+		t.Errorf("expected the volume to be named after the compressor binary, got %s", vol.ObjectName)
+	}
+	if _, err = vol.Write(payload); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("expected no error closing the volume, got %v", err)
+	}
+
+	if err = vol.Extract(ctx, j, false); err != nil {
+		t.Fatalf("expected no error extracting the volume, got %v", err)
+	}
+	data, rerr := io.ReadAll(vol)
+	if err = vol.Close(); err != nil {
+		t.Errorf("expected no error closing the extracted volume, got %v", err)
+	}
+	vol.DeleteVolume()
+	if rerr != nil || !bytes.Equal(data, payload) {
+		t.Errorf("expected the volume to hold the same stream, got %d bytes (%v)", len(data), rerr)
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	tempdir := t.TempDir()
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = tempdir
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	identity, _ := age.GenerateX25519Identity()
+	j := &files.JobInfo{
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+		Separator:        "|",
+		Compressor:       files.InternalCompressor,
+		CompressionLevel: 6,
+		MaxFileBuffer:    1,
+		AgeRecipients:    []string{identity.Recipient().String()},
+		AgeRecipientKeys: []age.Recipient{identity.Recipient()},
+	}
+	payload := bytes.Repeat([]byte("zfs stream "), 100000)
+	for volNum := int64(1); volNum <= 2; volNum++ {
+		vol, err := files.CreateBackupVolume(ctx, j, volNum)
+		if err != nil {
+			t.Fatalf("expected no error creating the volume, got %v", err)
+		}
+		if _, err = vol.Write(payload); err != nil {
+			t.Fatalf("expected no error writing the volume, got %v", err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("expected no error closing the volume, got %v", err)
+		}
+		vol.DeleteVolume()
+		vol.ZFSStreamBytes = uint64(len(payload))
+		if vol.CompressedBytes == 0 || vol.CompressedBytes >= vol.Size {
+			t.Errorf("expected the compressed size to be recorded before encryption, got %d of %d bytes", vol.CompressedBytes, vol.Size)
+		}
+		j.Volumes = append(j.Volumes, vol)
+	}
+
+	stats := j.CompressionSummary()
+	if stats == nil {
+		t.Fatalf("expected the compression to be summarized")
+	}
+	if stats.RawBytes != uint64(2*len(payload)) || stats.CompressedBytes != j.Volumes[0].CompressedBytes+j.Volumes[1].CompressedBytes {
+		t.Errorf("expected the sizes of the volumes to be summed, got %+v", stats)
+	}
+	if stats.Ratio <= 1 {
+		t.Errorf("expected a compression ratio above 1, got %f", stats.Ratio)
+	}
+	j.Compression = stats
+	if long := j.LongString(); !strings.Contains(long, "Compression: ") || !strings.Contains(long, "Volume 2: ") {
+		t.Errorf("expected the long description to include the compression and volumes, got %s", long)
+	}
+
+	j.Volumes = append(j.Volumes, &files.VolumeInfo{VolumeNumber: 3, ZFSStreamBytes: 10})
+	if j.CompressionSummary() != nil {
+		t.Errorf("expected no summary when a volume did not record its compressed size")
+	}
+}
+
+func TestZstdOptions(t *testing.T) {
+	j := &files.JobInfo{
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     time.Minute,
+		CompressionLevel:   6,
+		Compressor:         files.InternalZstdCompressor,
+		Separator:          "|",
+		UploadChunkSize:    10,
+		TargetPolicy:       files.TargetPolicyAll,
+	}
+	for _, windowLog := range []int{0, 10, 27, 29} {
+		j.ZstdWindowLog = windowLog
+		if err := j.ValidateSendFlags(); err != nil {
+			t.Errorf("expected window log %d to be valid, got %v", windowLog, err)
+		}
+	}
+	for _, windowLog := range []int{9, 30} {
+		j.ZstdWindowLog = windowLog
+		if err := j.ValidateSendFlags(); err == nil {
+			t.Errorf("expected window log %d to be rejected", windowLog)
+		}
+	}
+
+	j.ZstdWindowLog = 0
+	j.ZstdDictionary = []byte("not a dictionary")
+	if err := j.ValidateSendFlags(); err == nil {
+		t.Errorf("expected an invalid dictionary to be rejected")
+	}
+}
+
+func TestManifestDB(t *testing.T) {
+	oldWorkingDir, oldManifestDB := config.WorkingDir, config.ManifestDB
+	config.WorkingDir, config.ManifestDB = t.TempDir(), true
+	defer func() { config.WorkingDir, config.ManifestDB = oldWorkingDir, oldManifestDB }()
+
+	ctx := context.Background()
+	localCachePath := t.TempDir()
+	writeManifest := func(name, volume, snapshot string) {
+		j := &files.JobInfo{
+			VolumeName:     volume,
+			BaseSnapshot:   files.SnapshotInfo{Name: snapshot},
+			ManifestPrefix: "manifests",
+			Separator:      "|",
+		}
+		manifest, err := files.CreateManifestVolume(ctx, j)
+		if err != nil {
+			t.Fatalf("expected no error creating the manifest, got %v", err)
+		}
+		if err = json.NewEncoder(manifest).Encode(j); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+		if err = manifest.Close(); err != nil {
+			t.Fatalf("expected no error closing the manifest, got %v", err)
+		}
+		if err = manifest.CopyTo(filepath.Join(localCachePath, name)); err != nil {
+			t.Fatalf("expected no error copying the manifest, got %v", err)
+		}
+	}
+	writeManifest("a", "pool/a", "snap1")
+	writeManifest("b", "pool/b", "snap1")
+
+	decoded, err := readManifests(ctx, localCachePath, []string{"a", "b"}, &files.JobInfo{})
+	if err != nil {
+		t.Fatalf("expected no error reading the manifests, got %v", err)
+	}
+	if len(decoded) != 2 || decoded[0].VolumeName != "pool/a" || decoded[1].VolumeName != "pool/b" {
+		t.Fatalf("expected both manifests to be decoded in order, got %v", decoded)
+	}
+
+	// A changed manifest is decoded again and one no longer listed is dropped from the database
+	writeManifest("a", "pool/a", "snap2")
+	decoded, err = readManifests(ctx, localCachePath, []string{"a"}, &files.JobInfo{})
+	if err != nil {
+		t.Fatalf("expected no error reading the manifests, got %v", err)
+	}
+	if len(decoded) != 1 || decoded[0].BaseSnapshot.Name != "snap2" {
+		t.Fatalf("expected the changed manifest to be decoded again, got %v", decoded)
+	}
+
+	db, err := bolt.Open(filepath.Join(config.WorkingDir, manifestDBName), 0600, nil)
+	if err != nil {
+		t.Fatalf("expected no error opening the manifest database, got %v", err)
+	}
+	defer db.Close()
+	cached, err := loadCachedManifests(db, []byte(filepath.Base(localCachePath)))
+	if err != nil {
+		t.Fatalf("expected no error loading the cached manifests, got %v", err)
+	}
+	if len(cached) != 1 || cached["a"] == nil || cached["a"].Manifest.BaseSnapshot.Name != "snap2" {
+		t.Errorf("expected only the updated manifest to remain in the database, got %v", cached)
+	}
+}
+
+func TestManifestSchemaVersion(t *testing.T) {
+	j := &files.JobInfo{
+		VolumeName: "pool/fs",
+		Volumes: []*files.VolumeInfo{
+			{ZFSStreamBytes: 300, CompressedBytes: 100},
+		},
+	}
+	changed, err := j.MigrateSchema()
+	if err != nil || !changed {
+		t.Fatalf("expected a manifest without a schema version to be migrated, got %v, %v", changed, err)
+	}
+	if j.SchemaVersion != files.ManifestSchemaVersion || j.Compression == nil || j.Compression.Ratio != 3 {
+		t.Errorf("expected the manifest to be upgraded with its compression statistics, got %d, %v", j.SchemaVersion, j.Compression)
+	}
+	if changed, err = j.MigrateSchema(); err != nil || changed {
+		t.Errorf("expected a current manifest to be left alone, got %v, %v", changed, err)
+	}
+
+	// Manifests from newer releases are refused when read
+	ctx := context.Background()
+	newer := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		SchemaVersion:  files.ManifestSchemaVersion + 1,
+	}
+	manifest, err := files.CreateManifestVolume(ctx, newer)
+	if err != nil {
+		t.Fatalf("expected no error creating the manifest, got %v", err)
+	}
+	if err = json.NewEncoder(manifest).Encode(newer); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+	if err = manifest.Close(); err != nil {
+		t.Fatalf("expected no error closing the manifest, got %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "manifest")
+	if err = manifest.CopyTo(path); err != nil {
+		t.Fatalf("expected no error copying the manifest, got %v", err)
+	}
+	if _, err = readManifest(ctx, path, &files.JobInfo{}); err == nil {
+		t.Errorf("expected a manifest with a newer schema version to be refused")
+	}
+	if _, err = newer.MigrateSchema(); err == nil {
+		t.Errorf("expected a manifest with a newer schema version not to be migrated")
+	}
+}
+
+func TestManifestTags(t *testing.T) {
+	manifest := &files.JobInfo{
+		VolumeName: "pool/fs",
+		Tags:       map[string]string{"reason": "pre-migration", "ticket": "42"},
+	}
+
+	cases := []struct {
+		tags     map[string]string
+		expected bool
+	}{
+		{nil, true},
+		{map[string]string{"reason": "pre-migration"}, true},
+		{map[string]string{"reason": "pre-migration", "ticket": "42"}, true},
+		{map[string]string{"reason": "nightly"}, false},
+		{map[string]string{"reason": "pre-migration", "host": "a"}, false},
+	}
+	for _, c := range cases {
+		if got := manifestMatchesTags(manifest, c.tags); got != c.expected {
+			t.Errorf("expected filtering by %v to return %v, got %v", c.tags, c.expected, got)
+		}
+	}
+	if manifestMatchesTags(&files.JobInfo{}, map[string]string{"reason": ""}) {
+		t.Errorf("expected an untagged manifest not to match a tag with an empty value")
+	}
+
+	if got := manifest.TagsString(); got != "reason=pre-migration,ticket=42" {
+		t.Errorf("expected the tags to be sorted, got %s", got)
+	}
+	if !strings.Contains(manifest.String(), "Tags: reason=pre-migration,ticket=42") {
+		t.Errorf("expected the tags to be listed, got %s", manifest.String())
+	}
+}
+
+func TestRestorableProperties(t *testing.T) {
+	properties := map[string]string{
+		"compression":         "lz4",
+		"mountpoint":          "/srv/data",
+		"encryption":          "aes-256-gcm",
+		"keylocation":         "prompt",
+		"volsize":             "1073741824",
+		"com.example:backup":  "nightly",
+		"recordsize":          "1048576",
+		"org.example:comment": "keep",
+	}
+
+	got := restorableProperties(properties, []string{"mountpoint", "org.example:comment"})
+	expected := []string{"com.example:backup", "compression", "recordsize"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the properties to restore to be %v, got %v", expected, got)
+	}
+
+	manifest := &files.JobInfo{VolumeName: "pool/fs", LocalProperties: map[string]string{"compression": "lz4", "atime": "off"}}
+	if !strings.Contains(manifest.LongString(), "Properties: atime=off,compression=lz4") {
+		t.Errorf("expected the properties to be listed, got %s", manifest.LongString())
+	}
+	if strings.Contains(manifest.String(), "Properties:") {
+		t.Errorf("expected the properties to only be listed in the long listing, got %s", manifest.String())
+	}
+}
+
+func TestDatasetGUID(t *testing.T) {
+	last := &files.JobInfo{VolumeName: "pool/fs", BaseSnapshot: files.SnapshotInfo{Name: "snap2"}, DatasetGUID: "111"}
+	if reason := datasetReplaced(last, "111"); reason != "" {
+		t.Errorf("expected the same dataset not to be reported as replaced, got %s", reason)
+	}
+	if reason := datasetReplaced(&files.JobInfo{VolumeName: "pool/fs"}, "111"); reason != "" {
+		t.Errorf("expected a backup without a dataset guid not to be reported as replaced, got %s", reason)
+	}
+	if reason := datasetReplaced(last, "222"); !strings.Contains(reason, "pool/fs was destroyed and created again") {
+		t.Errorf("expected the dataset to be reported as replaced, got %s", reason)
+	}
+
+	now := time.Now()
+	manifests := []*files.JobInfo{
+		{VolumeName: "pool/new", BaseSnapshot: files.SnapshotInfo{Name: "snap3", CreationTime: now}, DatasetGUID: "111"},
+		{VolumeName: "pool/old", BaseSnapshot: files.SnapshotInfo{Name: "snap1", CreationTime: now.Add(-2 * time.Hour)}, DatasetGUID: "111"},
+		{VolumeName: "pool/old", BaseSnapshot: files.SnapshotInfo{Name: "snap2", CreationTime: now.Add(-time.Hour)}, DatasetGUID: "111"},
+		{VolumeName: "pool/other", BaseSnapshot: files.SnapshotInfo{Name: "snap1", CreationTime: now}, DatasetGUID: "222"},
+		{VolumeName: "pool/legacy", BaseSnapshot: files.SnapshotInfo{Name: "snap1", CreationTime: now}},
+	}
+	renames := datasetRenames(manifests)
+	if len(renames) != 1 || !strings.HasPrefix(renames[0], "Volume pool/old was renamed to pool/new before snapshot snap3") {
+		t.Errorf("expected a single rename from pool/old to pool/new, got %v", renames)
+	}
+}
+
+func TestManifestHost(t *testing.T) {
+	manifest := &files.JobInfo{
+		VolumeName: "tank/fs",
+		Hostname:   "web1.example.com",
+		PoolName:   "tank",
+		PoolGUID:   "1234",
+		Version:    config.VersionNumber,
+	}
+
+	cases := []struct {
+		host     string
+		expected bool
+	}{
+		{"", true},
+		{"web1.example.com", true},
+		{"web1*", true},
+		{"*", true},
+		{"web1", false},
+		{"web2*", false},
+	}
+	for _, c := range cases {
+		if got := manifestMatchesHost(manifest, c.host); got != c.expected {
+			t.Errorf("expected filtering by host %s to return %v, got %v", c.host, c.expected, got)
+		}
+	}
+
+	expected := fmt.Sprintf("Host: web1.example.com (pool tank, guid 1234), zfsbackup v%s", config.Version())
+	if !strings.Contains(manifest.LongString(), expected) {
+		t.Errorf("expected the long listing to contain %s, got %s", expected, manifest.LongString())
+	}
+}
+
+func TestManifestGenerations(t *testing.T) {
+	oldWorkingDir, oldTempdir, oldStdout, oldGenerations := config.WorkingDir, config.BackupTempdir, config.Stdout, config.ManifestGenerations
+	config.WorkingDir, config.BackupTempdir, config.ManifestGenerations = t.TempDir(), t.TempDir(), 2
+	defer func() {
+		config.WorkingDir, config.BackupTempdir, config.Stdout, config.ManifestGenerations = oldWorkingDir, oldTempdir, oldStdout, oldGenerations
+	}()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	manifest := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+	}
+	for i := 0; i < 4; i++ {
+		manifest.Tags = map[string]string{"write": strconv.Itoa(i)}
+		if err = writeManifest(ctx, manifest, backend, target); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+	}
+	name := manifest.ManifestObjectName()
+	generations, err := listManifestGenerations(ctx, manifest, backend, name)
+	if err != nil {
+		t.Fatalf("expected no error listing the generations, got %v", err)
+	}
+	if !reflect.DeepEqual(generations, []int{1, 2}) || manifest.ManifestGeneration != 3 {
+		t.Errorf("expected the last 2 generations to be kept and the manifest to be generation 3, got %v and %d",
+			generations, manifest.ManifestGeneration)
+	}
+
+	j := &files.JobInfo{ManifestPrefix: "manifests", Separator: "|", Destinations: []string{target}}
+	output := new(bytes.Buffer)
+	config.Stdout = output
+	if err = List(ctx, j, "", time.Time{}, time.Time{}, false, true, false, nil, ""); err != nil {
+		t.Fatalf("expected no error listing the manifests, got %v", err)
+	}
+	if !strings.Contains(output.String(), "Found 2 superseded manifests") || !strings.Contains(output.String(), "Generation: 2 of "+name) {
+		t.Errorf("expected the superseded generations to be listed, got %s", output.String())
+	}
+
+	// Corrupt the manifest, it is recovered from the latest generation
+	corrupt, err := files.CreateSimpleVolume(ctx, false)
+	if err != nil {
+		t.Fatalf("expected no error creating a volume, got %v", err)
+	}
+	corrupt.ObjectName = name
+	if _, err = corrupt.Write([]byte("not a manifest")); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	if err = corrupt.Close(); err != nil {
+		t.Fatalf("expected no error closing the volume, got %v", err)
+	}
+	if err = corrupt.OpenVolume(); err != nil {
+		t.Fatalf("expected no error opening the volume, got %v", err)
+	}
+	if err = backend.Upload(ctx, corrupt); err != nil {
+		t.Fatalf("expected no error uploading the volume, got %v", err)
+	}
+	_ = corrupt.Close()
+	_ = corrupt.DeleteVolume()
+	localCachePath, err := getCacheDir(j, target)
+	if err != nil {
+		t.Fatalf("expected no error getting the cache dir, got %v", err)
+	}
+	if err = os.RemoveAll(localCachePath); err != nil {
+		t.Fatalf("expected no error clearing the cache dir, got %v", err)
+	}
+
+	if err = RecoverManifests(ctx, j, target, false); err != nil {
+		t.Fatalf("expected no error recovering the manifests, got %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "manifest")
+	if err = downloadTo(ctx, backend, name, path); err != nil {
+		t.Fatalf("expected no error downloading the manifest, got %v", err)
+	}
+	recovered, err := readManifest(ctx, path, j)
+	if err != nil {
+		t.Fatalf("expected the recovered manifest to be readable, got %v", err)
+	}
+	if recovered.ManifestGeneration != 2 || recovered.Tags["write"] != "2" {
+		t.Errorf("expected generation 2 to be recovered, got generation %d written %s", recovered.ManifestGeneration, recovered.Tags["write"])
+	}
+}
+
+func TestManifestEncoding(t *testing.T) {
+	ctx := context.Background()
+	j := &files.JobInfo{
+		StartTime:        time.Now().Round(time.Second),
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1", CreationTime: time.Now().Round(time.Second)},
+		ManifestPrefix:   "manifests",
+		Separator:        "|",
+		SchemaVersion:    files.ManifestSchemaVersion,
+		ManifestEncoding: files.ManifestEncodingCBOR,
+		ZstdDictionary:   []byte("dictionary"),
+		Tags:             map[string]string{"reason": "nightly"},
+	}
+	for i := int64(1); i <= 1000; i++ {
+		j.Volumes = append(j.Volumes, &files.VolumeInfo{
+			ObjectName:   fmt.Sprintf("pool/fs|snap1.zstream.gz.vol%d", i),
+			VolumeNumber: i,
+			SHA256Sum:    strings.Repeat("a", 64),
+			MD5Sum:       strings.Repeat("b", 32),
+			Size:         200 * 1024 * 1024,
+		})
+	}
+
+	encoded := new(bytes.Buffer)
+	if err := files.EncodeManifest(encoded, j); err != nil {
+		t.Fatalf("expected no error encoding the manifest, got %v", err)
+	}
+	plain := *j
+	plain.ManifestEncoding = ""
+	encodedJSON := new(bytes.Buffer)
+	if err := files.EncodeManifest(encodedJSON, &plain); err != nil {
+		t.Fatalf("expected no error encoding the manifest, got %v", err)
+	}
+	if encoded.Len() >= encodedJSON.Len() {
+		t.Errorf("expected the CBOR manifest (%d bytes) to be smaller than the JSON one (%d bytes)", encoded.Len(), encodedJSON.Len())
+	}
+
+	// Written and read back through a manifest volume like any other manifest
+	manifest, err := files.CreateManifestVolume(ctx, j)
+	if err != nil {
+		t.Fatalf("expected no error creating the manifest, got %v", err)
+	}
+	if _, err = manifest.Write(encoded.Bytes()); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+	if err = manifest.Close(); err != nil {
+		t.Fatalf("expected no error closing the manifest, got %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "manifest")
+	if err = manifest.CopyTo(path); err != nil {
+		t.Fatalf("expected no error copying the manifest, got %v", err)
+	}
+	decoded, err := readManifest(ctx, path, &files.JobInfo{})
+	if err != nil {
+		t.Fatalf("expected no error reading the manifest, got %v", err)
+	}
+	if len(decoded.Volumes) != len(j.Volumes) || decoded.Volumes[999].ObjectName != j.Volumes[999].ObjectName ||
+		!decoded.BaseSnapshot.CreationTime.Equal(j.BaseSnapshot.CreationTime) ||
+		!bytes.Equal(decoded.ZstdDictionary, j.ZstdDictionary) || decoded.Tags["reason"] != "nightly" ||
+		decoded.ManifestEncoding != files.ManifestEncodingCBOR {
+		t.Errorf("expected the manifest to be decoded as it was encoded")
+	}
+
+	// Releases only reading JSON see the header as a manifest of a newer schema version
+	header := new(files.JobInfo)
+	if err = json.NewDecoder(bytes.NewReader(encoded.Bytes())).Decode(header); err != nil {
+		t.Fatalf("expected the header to be valid JSON, got %v", err)
+	}
+	if header.SchemaVersion != files.ManifestSchemaVersion || header.VolumeName != "" {
+		t.Errorf("expected only the schema version and encoding in the header, got %+v", header)
+	}
+
+	j.SchemaVersion = files.ManifestSchemaVersion + 1
+	encoded.Reset()
+	if err = files.EncodeManifest(encoded, j); err != nil {
+		t.Fatalf("expected no error encoding the manifest, got %v", err)
+	}
+	if _, err = files.DecodeManifest(encoded); err == nil {
+		t.Errorf("expected a CBOR manifest of a newer schema version to be refused")
+	}
+}
+
+func TestDatasetIndex(t *testing.T) {
+	oldWorkingDir, oldTempdir, oldStdout := config.WorkingDir, config.BackupTempdir, config.Stdout
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() { config.WorkingDir, config.BackupTempdir, config.Stdout = oldWorkingDir, oldTempdir, oldStdout }()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	now := time.Now()
+	sets := []*files.JobInfo{
+		{VolumeName: "pool/fs", BaseSnapshot: files.SnapshotInfo{Name: "snap2", CreationTime: now}, IncrementalSnapshot: files.SnapshotInfo{Name: "snap1"}},
+		{VolumeName: "pool/fs", BaseSnapshot: files.SnapshotInfo{Name: "snap1", CreationTime: now.Add(-time.Hour)}},
+		{VolumeName: "pool/other", BaseSnapshot: files.SnapshotInfo{Name: "snap1", CreationTime: now}},
+	}
+	for _, set := range sets {
+		set.ManifestPrefix, set.Separator = "manifests", "|"
+		set.Volumes = []*files.VolumeInfo{{ObjectName: "vol1", Size: 100}}
+		if err = writeManifest(ctx, set, backend, target); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+	}
+
+	j := &files.JobInfo{VolumeName: "pool/fs", ManifestPrefix: "manifests", Separator: "|", Destinations: []string{target}}
+	if err = updateDatasetIndex(ctx, j, target, backend); err != nil {
+		t.Fatalf("expected no error updating the index, got %v", err)
+	}
+	index, err := readDatasetIndex(ctx, j, backend, j.IndexObjectName())
+	if err != nil {
+		t.Fatalf("expected no error reading the index, got %v", err)
+	}
+	if len(index.BackupSets) != 2 || index.BackupSets[0].BaseSnapshot.Name != "snap1" ||
+		index.BackupSets[1].IncrementalSnapshot.Name != "snap1" || index.BackupSets[1].Size != 100 {
+		t.Errorf("expected the index to summarize both backup sets of the volume in order, got %+v", index.BackupSets)
+	}
+
+	output := new(bytes.Buffer)
+	config.Stdout = output
+	if err = ListIndex(ctx, j, "pool/fs", time.Time{}, time.Time{}, nil, ""); err != nil {
+		t.Fatalf("expected no error listing the index, got %v", err)
+	}
+	if !strings.Contains(output.String(), "Found 2 backup sets") {
+		t.Errorf("expected both backup sets to be listed, got %s", output.String())
+	}
+
+	// Indexes are left alone by clean, but deleted along with the backup sets it removes
+	if !strings.HasPrefix(j.IndexObjectName(), j.IndexListPrefix()) || strings.HasPrefix(j.IndexObjectName(), j.ManifestListPrefix()) {
+		t.Errorf("expected the index %s not to be listed as a manifest", j.IndexObjectName())
+	}
+	if err = deleteDatasetIndex(ctx, j, backend); err != nil {
+		t.Fatalf("expected no error deleting the index, got %v", err)
+	}
+	output.Reset()
+	if err = ListIndex(ctx, j, "pool/*", time.Time{}, time.Time{}, nil, ""); err != nil {
+		t.Fatalf("expected no error listing the indexes, got %v", err)
+	}
+	if !strings.Contains(output.String(), "Found 0 backup sets") {
+		t.Errorf("expected no backup sets to be listed without an index, got %s", output.String())
+	}
+}
+
+func TestAggregateStats(t *testing.T) {
+	start := time.Now()
+	set := func(volume, name, from string, day int, size uint64, took time.Duration) *files.JobInfo {
+		j := &files.JobInfo{
+			VolumeName:     volume,
+			BaseSnapshot:   files.SnapshotInfo{Name: name, CreationTime: start.Add(time.Duration(day) * 24 * time.Hour)},
+			Volumes:        []*files.VolumeInfo{{Size: size}},
+			ZFSStreamBytes: 2 * size,
+			StartTime:      start,
+			EndTime:        start.Add(took),
+		}
+		if from != "" {
+			j.IncrementalSnapshot = files.SnapshotInfo{Name: from, CreationTime: start.Add(time.Duration(day-7) * 24 * time.Hour)}
+		}
+		return j
+	}
+	manifests := []*files.JobInfo{
+		set("tank/data", "c", "b", 14, 100, 3*time.Minute),
+		set("tank/data", "a", "", 0, 1000, 5*time.Minute),
+		set("tank/data", "b", "a", 7, 300, time.Minute),
+		set("tank/logs", "a", "", 0, 50, time.Minute),
+	}
+
+	stats := aggregateStats(manifests)
+	if len(stats) != 2 || stats[0].VolumeName != "tank/data" || stats[1].VolumeName != "tank/logs" {
+		t.Fatalf("expected totals for tank/data and tank/logs, got %v", stats)
+	}
+
+	data := stats[0]
+	if data.BackupSets != 3 || data.FullBackups != 1 {
+		t.Errorf("expected 3 backup sets with 1 full backup, got %d and %d", data.BackupSets, data.FullBackups)
+	}
+	if data.StoredBytes != 1400 || data.LogicalBytes != 2800 {
+		t.Errorf("expected 1400 bytes stored of 2800 bytes, got %d of %d", data.StoredBytes, data.LogicalBytes)
+	}
+	if data.GrowthPerWeek != 200 {
+		t.Errorf("expected a growth of 200 bytes per week, got %d", data.GrowthPerWeek)
+	}
+	if data.AverageDuration != 3*time.Minute {
+		t.Errorf("expected an average duration of 3m, got %v", data.AverageDuration)
+	}
+	if data.CurrentChain != 3 || data.LongestChain != 3 {
+		t.Errorf("expected a current and longest chain of 3, got %d and %d", data.CurrentChain, data.LongestChain)
+	}
+
+	if logs := stats[1]; logs.GrowthPerWeek != 0 || logs.CurrentChain != 1 {
+		t.Errorf("expected a single full backup not to grow, got %d per week and a chain of %d", logs.GrowthPerWeek, logs.CurrentChain)
+	}
+}
+
+func TestManifestBundle(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir
+	}()
+
+	ctx := context.Background()
+	source := backends.FileBackendPrefix + "://" + t.TempDir()
+	destination := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, source, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	var names []string
+	for _, volume := range []string{"pool/fs", "pool/other"} {
+		manifest := &files.JobInfo{
+			VolumeName:     volume,
+			BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+			ManifestPrefix: "manifests",
+			Separator:      "|",
+		}
+		if err = writeManifest(ctx, manifest, backend, source); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+		names = append(names, manifest.ManifestObjectName())
+	}
+
+	j := &files.JobInfo{ManifestPrefix: "manifests", Separator: "|"}
+	bundlePath := filepath.Join(t.TempDir(), "manifests.tar")
+	if err = ExportManifests(ctx, j, source, "pool/fs", bundlePath); err != nil {
+		t.Fatalf("expected no error exporting the manifests, got %v", err)
+	}
+	if err = ExportManifests(ctx, j, source, "pool/fs", bundlePath); err == nil {
+		t.Errorf("expected an existing bundle not to be overwritten")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err = ImportManifests(ctx, j, destination, bundlePath); err != nil {
+			t.Fatalf("expected no error importing the manifests, got %v", err)
+		}
+	}
+	imported, err := readTargetManifests(ctx, j, destination)
+	if err != nil {
+		t.Fatalf("expected no error reading the imported manifests, got %v", err)
+	}
+	if len(imported) != 1 || imported[0].ManifestObjectName() != names[0] {
+		t.Errorf("expected only the manifest of pool/fs to be imported, got %v", imported)
+	}
+}
+
+func TestCleanOrphans(t *testing.T) {
+	oldWorkingDir, oldTempdir, oldStdout := config.WorkingDir, config.BackupTempdir, config.Stdout
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.WorkingDir, config.BackupTempdir, config.Stdout = oldWorkingDir, oldTempdir, oldStdout
+	}()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	source := filepath.Join(t.TempDir(), "volume")
+	if err = os.WriteFile(source, []byte("volume"), 0o600); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	objects := []string{
+		"pool|fs|snap1.zstream.gz.vol1",
+		"pool|fs|snap1.zstream.gz.vol2",
+		"pool|fs|snap0.zstream.gz.vol1",
+		"objects/ab/abcd.zstream.gz",
+	}
+	for _, name := range objects {
+		if err = uploadFile(ctx, backend, source, name); err != nil {
+			t.Fatalf("expected no error uploading %s, got %v", name, err)
+		}
+	}
+	manifest := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		Volumes:        []*files.VolumeInfo{{ObjectName: objects[0]}},
+	}
+	if err = writeManifest(ctx, manifest, backend, target); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+
+	j := &files.JobInfo{ManifestPrefix: "manifests", Separator: "|", Destinations: []string{target}}
+	output := new(bytes.Buffer)
+	config.Stdout = output
+	if err = Clean(ctx, j, false, true); err != nil {
+		t.Fatalf("expected no error reporting the orphans, got %v", err)
+	}
+	for _, expected := range []string{
+		"Found 3 orphaned objects",
+		objects[1] + " - extra volume of the backup set pool/fs@snap1",
+		objects[2] + " - not referenced by any manifest",
+		objects[3] + " - content addressed volume",
+	} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("expected the report to contain %q, got %s", expected, output.String())
+		}
+	}
+	remaining, err := backend.List(ctx, "")
+	if err != nil {
+		t.Fatalf("expected no error listing the objects, got %v", err)
+	}
+	if len(remaining) != len(objects)+1 {
+		t.Errorf("expected nothing to be deleted without --force, found %v", remaining)
+	}
+
+	j.Force = true
+	if err = Clean(ctx, j, false, true); err != nil {
+		t.Fatalf("expected no error deleting the orphans, got %v", err)
+	}
+	if remaining, err = backend.List(ctx, "pool"); err != nil || !reflect.DeepEqual(remaining, objects[:1]) {
+		t.Errorf("expected only the referenced volume to be kept, got %v (%v)", remaining, err)
+	}
+}
+
+func TestVerifyVolumeFull(t *testing.T) {
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = t.TempDir()
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	backend := &backends.FileBackend{}
+	conf := &backends.BackendConfig{
+		TargetURI:               backends.FileBackendPrefix + "://" + t.TempDir(),
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := backend.Init(ctx, conf); err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+
+	identity, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+	manifest := &files.JobInfo{
+		VolumeName:       "pool/fs",
+		BaseSnapshot:     files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix:   "manifests",
+		Separator:        "|",
+		MaxFileBuffer:    1,
+		Compressor:       files.InternalCompressor,
+		AgeRecipients:    []string{identity.Recipient().String()},
+		AgeRecipientKeys: []age.Recipient{identity.Recipient()},
+	}
+	payload := bytes.Repeat([]byte("zfs stream "), 10000)
+	vol, err := files.CreateBackupVolume(ctx, manifest, 1)
+	if err != nil {
+		t.Fatalf("expected no error creating the volume, got %v", err)
+	}
+	defer vol.DeleteVolume()
+	if _, err = vol.Write(payload); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	if err = vol.Close(); err != nil {
+		t.Fatalf("expected no error closing the volume, got %v", err)
+	}
+	if err = vol.OpenVolume(); err != nil {
+		t.Fatalf("could not open volume - %v", err)
+	}
+	err = backend.Upload(ctx, vol)
+	vol.Close()
+	if err != nil {
+		t.Fatalf("could not upload volume - %v", err)
+	}
+	vol.ZFSStreamBytes = uint64(len(payload))
+	vol.ZFSStreamSHA256 = fmt.Sprintf("%x", sha256.Sum256(payload))
+
+	manifest.AgeIdentities = []age.Identity{identity}
+	if err = verifyVolumeFull(ctx, manifest, backend, vol); err != nil {
+		t.Errorf("expected the volume to verify, got %v", err)
+	}
+
+	manifest.AgeIdentities = []age.Identity{other}
+	if err = verifyVolumeFull(ctx, manifest, backend, vol); err == nil {
+		t.Errorf("expected an error verifying the volume with another identity")
+	}
+
+	manifest.AgeIdentities = []age.Identity{identity}
+	corrupt := &files.VolumeInfo{
+		ObjectName:      vol.ObjectName,
+		Size:            vol.Size,
+		SHA256Sum:       vol.SHA256Sum,
+		ZFSStreamBytes:  vol.ZFSStreamBytes,
+		ZFSStreamSHA256: strings.Repeat("0", 64),
+	}
+	if err = verifyVolumeFull(ctx, manifest, backend, corrupt); err == nil || !strings.Contains(err.Error(), "zfs stream hash mismatch") {
+		t.Errorf("expected an error verifying a volume whose zfs stream does not match, got %v", err)
+	}
+
+	volumes := make([]*files.VolumeInfo, 10)
+	for idx := range volumes {
+		volumes[idx] = &files.VolumeInfo{VolumeNumber: int64(idx)}
+	}
+	sampled := sampleVolumes(volumes, 3)
+	if len(sampled) != 3 || !sort.SliceIsSorted(sampled, func(i, j int) bool { return sampled[i].VolumeNumber < sampled[j].VolumeNumber }) {
+		t.Errorf("expected 3 volumes to be sampled in order, got %v", sampled)
+	}
+	if sampled = sampleVolumes(volumes, 0); len(sampled) != len(volumes) {
+		t.Errorf("expected every volume to be checked without a sample, got %d", len(sampled))
+	}
+}
+
+func TestTransitionAfterDays(t *testing.T) {
+	testCases := []struct {
+		retention RetentionPolicy
+		days      int
+	}{
+		{},
+		{retention: RetentionPolicy{KeepDaily: 7}},
+		{retention: RetentionPolicy{KeepWeekly: 4, KeepMonthly: 12}},
+		{retention: RetentionPolicy{KeepDaily: 7, KeepWeekly: 4}, days: 7},
+		{retention: RetentionPolicy{KeepDaily: 14, KeepMonthly: 12}, days: 14},
+	}
+	for idx, testCase := range testCases {
+		if days := transitionAfterDays(testCase.retention); days != testCase.days {
+			t.Errorf("%d: Expected volumes to be transitioned after %d days, got %d", idx, testCase.days, days)
+		}
+	}
+}
+
+func TestPruneBackupSets(t *testing.T) {
+	vols := func(names ...string) []*files.VolumeInfo {
+		volumes := make([]*files.VolumeInfo, 0, len(names))
+		for _, name := range names {
+			volumes = append(volumes, &files.VolumeInfo{ObjectName: name})
+		}
+		return volumes
+	}
+	snap := func(name string, month time.Month, day int) files.SnapshotInfo {
+		return files.SnapshotInfo{Name: name, CreationTime: time.Date(2024, month, day, 12, 0, 0, 0, time.Local)}
+	}
+	manifests := func() []*files.JobInfo {
+		return []*files.JobInfo{
+			{VolumeName: "tank/data", BaseSnapshot: snap("f1", time.January, 1), Volumes: vols("f1", "shared")},
+			{VolumeName: "tank/data", BaseSnapshot: snap("i1", time.January, 15), IncrementalSnapshot: snap("f1", time.January, 1), Volumes: vols("i1")},
+			{VolumeName: "tank/data", BaseSnapshot: snap("f2", time.February, 1), Volumes: vols("f2", "shared")},
+			{VolumeName: "tank/data", BaseSnapshot: snap("i2", time.February, 2), IncrementalSnapshot: snap("f2", time.February, 1), Volumes: vols("i2")},
+			{VolumeName: "tank/data", BaseSnapshot: snap("i3", time.February, 3), IncrementalSnapshot: snap("i2", time.February, 2), Volumes: vols("i3")},
+			{VolumeName: "tank/other", BaseSnapshot: snap("o1", time.January, 1), Volumes: vols("o1")},
+		}
+	}
+
+	decisions, prunable, volumes := pruneBackupSets(manifests(), "tank/data", RetentionPolicy{KeepDaily: 1})
+	if len(decisions) != 5 {
+		t.Fatalf("expected a decision for each backup set of tank/data, got %d", len(decisions))
+	}
+	if len(prunable) != 2 || prunable[0].BaseSnapshot.Name != "f1" || prunable[1].BaseSnapshot.Name != "i1" {
+		t.Errorf("expected the January chain to be pruned, got %v", prunable)
+	}
+	if expected := []string{"f1", "i1"}; !reflect.DeepEqual(volumes, expected) {
+		t.Errorf("expected volumes %v to be pruned, got %v", expected, volumes)
+	}
+	if reasons := decisions[2].Reasons; !decisions[2].Keep || !reflect.DeepEqual(reasons, []string{"needed by tank/data@i3"}) {
+		t.Errorf("expected the full backup of the kept chain to be kept, got %v", decisions[2])
+	}
+	if reasons := decisions[4].Reasons; !reflect.DeepEqual(reasons, []string{"latest", "daily"}) {
+		t.Errorf("expected the latest backup set to be kept as the latest and daily, got %v", reasons)
+	}
+
+	if _, prunable, _ = pruneBackupSets(manifests(), "tank/data", RetentionPolicy{KeepDaily: 1, KeepMonthly: 2}); len(prunable) != 0 {
+		t.Errorf("expected the January backup set to be kept as monthly along with its chain, got %v", prunable)
+	}
+	if _, prunable, _ = pruneBackupSets(manifests(), "", RetentionPolicy{KeepWeekly: 1}); len(prunable) != 2 {
+		t.Errorf("expected only the January chain to be pruned, got %v", prunable)
+	}
+}
+
+func TestPruneHiddenNames(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() { config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir }()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	source := filepath.Join(t.TempDir(), "volume")
+	if err = os.WriteFile(source, []byte("volume"), 0o600); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	identity, _ := age.GenerateX25519Identity()
+	manifestNames := make([]string, 0, 2)
+	volumeNames := make([]string, 0, 2)
+	for idx, snapshot := range []string{"snap1", "snap2"} {
+		manifest := &files.JobInfo{
+			VolumeName:       "pool/fs",
+			BaseSnapshot:     files.SnapshotInfo{Name: snapshot, CreationTime: time.Date(2024, time.January, idx+1, 0, 0, 0, 0, time.UTC)},
+			ManifestPrefix:   "manifests",
+			Separator:        "|",
+			AgeRecipients:    []string{identity.Recipient().String()},
+			AgeRecipientKeys: []age.Recipient{identity.Recipient()},
+			HideNames:        true,
+			NamesKey:         []byte("0123456789abcdef0123456789abcdef"),
+		}
+		volumeNames = append(volumeNames, manifest.BackupVolumeObjectName(1))
+		manifest.Volumes = []*files.VolumeInfo{{ObjectName: volumeNames[idx]}}
+		if err = uploadFile(ctx, backend, source, volumeNames[idx]); err != nil {
+			t.Fatalf("expected no error uploading the volume, got %v", err)
+		}
+		if err = writeManifest(ctx, manifest, backend, target); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+		manifestNames = append(manifestNames, manifest.ManifestObjectName())
+	}
+
+	// Without the names key, the manifests are found by the hidden names recorded in them
+	j := &files.JobInfo{
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		Destinations:   []string{target},
+		AgeIdentities:  []age.Identity{identity},
+	}
+	if err = Prune(ctx, j, target, "pool/fs", RetentionPolicy{KeepLast: 1}, false); err != nil {
+		t.Fatalf("expected no error pruning, got %v", err)
+	}
+	for idx, name := range []string{manifestNames[0], volumeNames[0], manifestNames[1], volumeNames[1]} {
+		exists, eerr := objectExists(ctx, backend, name)
+		if eerr != nil {
+			t.Fatalf("expected no error looking up %s, got %v", name, eerr)
+		}
+		if kept := idx >= 2; exists != kept {
+			t.Errorf("expected %s to exist: %v, got %v", name, kept, exists)
+		}
+	}
+}
+
+func TestRetainedByPolicy(t *testing.T) {
+	start := time.Date(2024, time.March, 10, 18, 0, 0, 0, time.UTC)
+	// Hourly snapshots over two days, newest first
+	times := make([]time.Time, 48)
+	for idx := range times {
+		times[idx] = start.Add(-time.Duration(idx) * time.Hour)
+	}
+
+	retained := retainedByPolicy(times, RetentionPolicy{KeepLast: 3}, time.UTC)
+	if !reflect.DeepEqual(retained[0], []string{"latest", "last"}) || len(retained[2]) != 1 || retained[3] != nil {
+		t.Errorf("expected the 3 latest snapshots to be kept, got %v", retained[:4])
+	}
+
+	retained = retainedByPolicy(times, RetentionPolicy{KeepDaily: 2}, time.UTC)
+	kept := 0
+	for idx, periods := range retained {
+		if len(periods) > 0 {
+			kept++
+			if idx != 0 && idx != 19 {
+				t.Errorf("expected the latest snapshot of March 10th and 9th to be kept, got %v", times[idx])
+			}
+		}
+	}
+	if kept != 2 {
+		t.Errorf("expected 2 snapshots to be kept, got %d", kept)
+	}
+
+	if retained = retainedByPolicy(nil, RetentionPolicy{KeepLast: 3}, time.UTC); len(retained) != 0 {
+		t.Errorf("expected nothing to be kept without snapshots, got %v", retained)
+	}
+}
+
+func TestBackupStatus(t *testing.T) {
+	start := time.Now()
+	snap := func(name string, day int, bookmark bool) files.SnapshotInfo {
+		return files.SnapshotInfo{Name: name, CreationTime: start.Add(time.Duration(day) * 24 * time.Hour), Bookmark: bookmark}
+	}
+	full := &files.JobInfo{VolumeName: "tank/data", BaseSnapshot: snap("auto-1", 1, false)}
+	last := &files.JobInfo{
+		VolumeName:          "tank/data",
+		BaseSnapshot:        snap("auto-2", 2, false),
+		IncrementalSnapshot: full.BaseSnapshot,
+		ParentSnap:          full,
+		EndTime:             start.Add(49 * time.Hour),
+	}
+	// Newest first, as listed by zfs
+	snapshots := []files.SnapshotInfo{
+		snap("auto-4", 4, false),
+		snap("manual", 3, false),
+		snap("auto-3", 3, false),
+		snap("auto-2", 2, true),
+		snap("auto-1", 1, false),
+	}
+
+	status := backupStatus(snapshots, []*files.JobInfo{last, full}, newSnapshotFilter("auto-", ""))
+	if status.LastBackup == nil || status.LastBackup.Name != "auto-2" || !status.LastBackupTime.Equal(last.EndTime) {
+		t.Fatalf("expected the last backup to be auto-2 completed at %v, got %v at %v", last.EndTime, status.LastBackup, status.LastBackupTime)
+	}
+	if status.LastBackupLocal != "bookmark" {
+		t.Errorf("expected the last backup to only be found as a bookmark, got %s", status.LastBackupLocal)
+	}
+	if status.ChainLength != 2 {
+		t.Errorf("expected a chain length of 2, got %d", status.ChainLength)
+	}
+	if !reflect.DeepEqual(status.PendingSnapshots, []string{"auto-4", "auto-3"}) {
+		t.Errorf("expected auto-4 and auto-3 to be pending, got %v", status.PendingSnapshots)
+	}
+
+	status = backupStatus(snapshots, nil, newSnapshotFilter("", ""))
+	if status.LastBackup != nil || status.ChainLength != 0 || len(status.PendingSnapshots) != 4 {
+		t.Errorf("expected every snapshot to be pending without backups, got %+v", status)
+	}
+}
+
+func TestBuildMountTree(t *testing.T) {
+	full := &files.JobInfo{VolumeName: "tank/data", BaseSnapshot: files.SnapshotInfo{Name: "a"}}
+	incremental := &files.JobInfo{
+		VolumeName:          "tank/data",
+		BaseSnapshot:        files.SnapshotInfo{Name: "b"},
+		IncrementalSnapshot: files.SnapshotInfo{Name: "a"},
+	}
+	parent := &files.JobInfo{VolumeName: "tank", BaseSnapshot: files.SnapshotInfo{Name: "a"}}
+
+	root := buildMountTree([]*files.JobInfo{full, incremental, parent})
+	tank, ok := root.children["tank"]
+	if !ok || len(root.children) != 1 || len(root.sets) != 0 {
+		t.Fatalf("expected a single tank directory at the root, got %+v", root)
+	}
+	if tank.sets["@a"] != parent || len(tank.sets) != 1 {
+		t.Errorf("expected the backup set of tank in its directory, got %v", tank.sets)
+	}
+	data := tank.children["data"]
+	if data == nil || data.sets["@a"] != full || data.sets["@a..@b"] != incremental {
+		t.Errorf("expected the backup sets of tank/data nested under tank, got %+v", data)
+	}
+}
+
+func TestStreamReader(t *testing.T) {
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = t.TempDir()
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	ctx := context.Background()
+	backend := &backends.FileBackend{}
+	conf := &backends.BackendConfig{
+		TargetURI:               backends.FileBackendPrefix + "://" + t.TempDir(),
+		MaxParallelUploadBuffer: make(chan bool, 1),
+	}
+	if err := backend.Init(ctx, conf); err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+
+	manifest := &files.JobInfo{
+		VolumeName:    "pool/fs",
+		BaseSnapshot:  files.SnapshotInfo{Name: "snap1"},
+		Separator:     "|",
+		MaxFileBuffer: 1,
+		Compressor:    files.InternalCompressor,
+	}
+	var stream []byte
+	for i := 1; i <= 3; i++ {
+		payload := bytes.Repeat([]byte(fmt.Sprintf("volume %d ", i)), 1000*i)
+		vol, err := files.CreateBackupVolume(ctx, manifest, int64(i))
+		if err != nil {
+			t.Fatalf("expected no error creating the volume, got %v", err)
+		}
+		defer vol.DeleteVolume()
+		if _, err = vol.Write(payload); err != nil {
+			t.Fatalf("expected no error writing the volume, got %v", err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("expected no error closing the volume, got %v", err)
+		}
+		if err = vol.OpenVolume(); err != nil {
+			t.Fatalf("could not open volume - %v", err)
+		}
+		err = backend.Upload(ctx, vol)
+		vol.Close()
+		if err != nil {
+			t.Fatalf("could not upload volume - %v", err)
+		}
+		vol.ZFSStreamBytes = uint64(len(payload))
+		manifest.Volumes = append(manifest.Volumes, vol)
+		stream = append(stream, payload...)
+	}
+	manifest.ZFSStreamBytes = uint64(len(stream))
+
+	check := func(r *streamReader, off, length int) {
+		t.Helper()
+		buf := make([]byte, length)
+		n, err := r.ReadAt(buf, int64(off))
+		end := off + length
+		if end > len(stream) {
+			end = len(stream)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatalf("expected no error reading %d bytes at offset %d, got %v", length, off, err)
+		}
+		if !bytes.Equal(buf[:n], stream[off:end]) {
+			t.Errorf("expected %d bytes of the stream at offset %d, got %d bytes that do not match", end-off, off, n)
+		}
+	}
+
+	r := newStreamReader(ctx, manifest, backend, "")
+	if r.offsets == nil || r.size != uint64(len(stream)) {
+		t.Fatalf("expected the offsets of every volume and a size of %d, got %v and %d", len(stream), r.offsets, r.size)
+	}
+	check(r, 0, 100)
+	check(r, 100, 20000)
+	check(r, 50000, 5000)
+	check(r, 10, 10)
+	check(r, len(stream)-10, 100)
+	if n, err := r.ReadAt(make([]byte, 10), int64(len(stream))); n != 0 || !errors.Is(err, io.EOF) {
+		t.Errorf("expected EOF reading past the end of the stream, got %d bytes and %v", n, err)
+	}
+	r.Close()
+
+	// Without the size of each volume the stream is read from its start
+	for _, vol := range manifest.Volumes {
+		vol.ZFSStreamBytes = 0
+	}
+	r = newStreamReader(ctx, manifest, backend, "")
+	if r.offsets != nil || r.size != uint64(len(stream)) {
+		t.Fatalf("expected no offsets and the size of the manifest, got %v and %d", r.offsets, r.size)
+	}
+	check(r, 30000, 100)
+	check(r, 5, 50000)
+	r.Close()
+}
+
+func TestCat(t *testing.T) {
+	oldWorkingDir, oldTempdir, oldStdout := config.WorkingDir, config.BackupTempdir, config.Stdout
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.WorkingDir, config.BackupTempdir, config.Stdout = oldWorkingDir, oldTempdir, oldStdout
+	}()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	manifest := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		MaxFileBuffer:  1,
+		Compressor:     files.InternalCompressor,
+	}
+	var stream []byte
+	for i := 1; i <= 2; i++ {
+		payload := bytes.Repeat([]byte(fmt.Sprintf("volume %d ", i)), 5000)
+		vol, verr := files.CreateBackupVolume(ctx, manifest, int64(i))
+		if verr != nil {
+			t.Fatalf("expected no error creating the volume, got %v", verr)
+		}
+		defer vol.DeleteVolume()
+		if _, err = vol.Write(payload); err != nil {
+			t.Fatalf("expected no error writing the volume, got %v", err)
+		}
+		if err = vol.Close(); err != nil {
+			t.Fatalf("expected no error closing the volume, got %v", err)
+		}
+		if err = vol.OpenVolume(); err != nil {
+			t.Fatalf("could not open volume - %v", err)
+		}
+		err = backend.Upload(ctx, vol)
+		vol.Close()
+		if err != nil {
+			t.Fatalf("could not upload volume - %v", err)
+		}
+		manifest.Volumes = append(manifest.Volumes, vol)
+		stream = append(stream, payload...)
+	}
+	manifest.ZFSStreamBytes = uint64(len(stream))
+	if err = writeManifest(ctx, manifest, backend, target); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+
+	out := new(bytes.Buffer)
+	config.Stdout = out
+	j := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1"},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		Destinations:   []string{target},
+	}
+	if err = Cat(ctx, j); err != nil {
+		t.Fatalf("expected no error writing the stream, got %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), stream) {
+		t.Errorf("expected the %d bytes of the stream to be written, got %d bytes that do not match", len(stream), out.Len())
+	}
+
+	j.IncrementalSnapshot = files.SnapshotInfo{Name: "snap0"}
+	if err = Cat(ctx, j); err == nil {
+		t.Errorf("expected an error writing the stream of a backup set that does not exist")
+	}
+}
+
+func TestCompareTrees(t *testing.T) {
+	fromRoot, toRoot := t.TempDir(), t.TempDir()
+	modTime := time.Now().Add(-time.Hour)
+	write := func(root, name, content string) {
+		t.Helper()
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("could not create the directory of %s - %v", path, err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("could not write %s - %v", path, err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("could not set the times of %s - %v", path, err)
+		}
+	}
+	for _, root := range []string{fromRoot, toRoot} {
+		write(root, "same", "unchanged")
+		write(root, "dir/changed", "before")
+	}
+	write(toRoot, "dir/changed", "after")
+	write(fromRoot, "removed", "gone")
+	write(toRoot, "dir/added", "new")
+	for _, root := range []string{fromRoot, toRoot} {
+		if err := os.Chtimes(filepath.Join(root, "dir"), modTime, modTime); err != nil {
+			t.Fatalf("could not set the times of the directory - %v", err)
+		}
+	}
+
+	entries, err := compareTrees(fromRoot, toRoot)
+	if err != nil {
+		t.Fatalf("expected no error comparing the trees, got %v", err)
+	}
+	expected := []DiffEntry{
+		{Change: DiffAdded, Path: "/dir/added"},
+		{Change: DiffModified, Path: "/dir/changed"},
+		{Change: DiffRemoved, Path: "/removed"},
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+}
+
+func TestParseZFSDiff(t *testing.T) {
+	lines := []string{
+		"M\t/tmp/zfsbackup-diff-1/",
+		"+\t/tmp/zfsbackup-diff-1/new",
+		"R\t/tmp/zfsbackup-diff-1/old\t/tmp/zfsbackup-diff-1/dir/renamed",
+	}
+	expected := []DiffEntry{
+		{Change: DiffModified, Path: "/"},
+		{Change: DiffAdded, Path: "/new"},
+		{Change: DiffRenamed, Path: "/old", NewPath: "/dir/renamed"},
+	}
+	if entries := parseZFSDiff(lines, "/tmp/zfsbackup-diff-1"); !reflect.DeepEqual(entries, expected) {
+		t.Errorf("expected %v, got %v", expected, entries)
+	}
+}
+
+func TestDashboard(t *testing.T) {
+	oldWorkingDir, oldTempdir, oldStdout := config.WorkingDir, config.BackupTempdir, config.Stdout
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() { config.WorkingDir, config.BackupTempdir, config.Stdout = oldWorkingDir, oldTempdir, oldStdout }()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	start := time.Now().Add(-48 * time.Hour)
+	full := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: start},
+		EndTime:        start,
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+	}
+	incremental := &files.JobInfo{
+		VolumeName:          "pool/fs",
+		BaseSnapshot:        files.SnapshotInfo{Name: "snap2", CreationTime: start.Add(24 * time.Hour)},
+		IncrementalSnapshot: full.BaseSnapshot,
+		EndTime:             start.Add(24 * time.Hour),
+		ManifestPrefix:      "manifests",
+		Separator:           "|",
+	}
+	for _, manifest := range []*files.JobInfo{full, incremental} {
+		if err = writeManifest(ctx, manifest, backend, target); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+	}
+
+	datasets := buildDashboardDatasets([]*files.JobInfo{incremental, full})
+	if len(datasets) != 1 || len(datasets[0].Chain) != 2 || datasets[0].Chain[0].Name != "snap1" || datasets[0].Chain[1].Name != "snap2" {
+		t.Fatalf("expected a single dataset with a chain from snap1 to snap2, got %+v", datasets)
+	}
+	if !datasets[0].LastBackup.Equal(incremental.EndTime) {
+		t.Errorf("expected the last backup to be at %v, got %v", incremental.EndTime, datasets[0].LastBackup)
+	}
+
+	j := &files.JobInfo{ManifestPrefix: "manifests", Separator: "|"}
+	d := &dashboard{ctx: ctx, jobInfo: j, targets: []string{target}, token: "secret"}
+	handler := d.handler()
+	request := func(method, path string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Host = "127.0.0.1:8080"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusMisdirectedRequest {
+		t.Errorf("expected the dashboard to refuse a request for a host name, got %d", rec.Code)
+	}
+
+	rec = request(http.MethodGet, "/", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected the dashboard to be served, got %d - %s", rec.Code, rec.Body.String())
+	}
+	for _, expected := range []string{"pool/fs", "snap1", "snap2", "2 backup sets of 1 datasets", `name="token" value="secret"`} {
+		if !strings.Contains(rec.Body.String(), expected) {
+			t.Errorf("expected the dashboard to show %q, got %s", expected, rec.Body.String())
+		}
+	}
+
+	rec = request(http.MethodGet, "/actions", nil)
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected actions to only be triggered with a POST request, got %d", rec.Code)
+	}
+
+	form := url.Values{"kind": {ActionVerify}, "target": {"file:///elsewhere"}, "volume": {"pool/fs"}}
+	if rec = request(http.MethodPost, "/actions", form); rec.Code != http.StatusForbidden {
+		t.Errorf("expected an action without the token to be refused, got %d", rec.Code)
+	}
+
+	form.Set("token", "secret")
+	if rec = request(http.MethodPost, "/actions", form); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an action on an unknown target to be refused, got %d", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/actions", strings.NewReader(form.Encode()))
+	req.Host = "127.0.0.1:8080"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected an action sent from another origin to be refused, got %d", rec.Code)
+	}
+
+	// Actions write to themselves, not to the shared stdout, even when several are triggered at once
+	stdout := new(bytes.Buffer)
+	config.Stdout = stdout
+	form.Set("target", target)
+	for i := 0; i < 2; i++ {
+		if rec = request(http.MethodPost, "/actions", form); rec.Code != http.StatusSeeOther {
+			t.Fatalf("expected the action to be started, got %d - %s", rec.Code, rec.Body.String())
+		}
+	}
+	var actions []serverAction
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if actions = d.listActions(); !actions[0].Finished.IsZero() && !actions[1].Finished.IsZero() {
+			break
+		}
+	}
+	for _, action := range actions {
+		if action.Finished.IsZero() || !strings.Contains(action.Output, "Verified 2 backup sets") {
+			t.Errorf("expected action %d to finish with its own output, got %+v", action.ID, action)
+		}
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("expected the actions not to write to stdout, got %q", stdout.String())
+	}
+
+	for host, allowed := range map[string]bool{
+		"127.0.0.1:8080": true, "[::1]:8080": true, "localhost:8080": true, "LOCALHOST": true, "192.168.1.2": true,
+		"rebind.example.com:8080": false, "localhost.example.com": false,
+	} {
+		if allowedDashboardHost(host) != allowed {
+			t.Errorf("expected the host %s to be allowed %v", host, allowed)
+		}
+	}
+}
+
+func TestTUIModel(t *testing.T) {
+	start := time.Now()
+	full := &files.JobInfo{VolumeName: "pool/b", BaseSnapshot: files.SnapshotInfo{Name: "snap1", CreationTime: start}}
+	incremental := &files.JobInfo{
+		VolumeName:          "pool/b",
+		BaseSnapshot:        files.SnapshotInfo{Name: "snap2", CreationTime: start.Add(time.Hour)},
+		IncrementalSnapshot: full.BaseSnapshot,
+	}
+	other := &files.JobInfo{VolumeName: "pool/a", BaseSnapshot: files.SnapshotInfo{Name: "snap1", CreationTime: start}}
+
+	m := newTUIModel("file:///backups", []*files.JobInfo{full, incremental, other})
+	lines := m.render(80, 10)
+	if len(lines) != 10 || !strings.Contains(lines[2], "pool/a") || !strings.Contains(lines[3], "pool/b") {
+		t.Fatalf("expected the datasets listed in order on 10 lines, got %q", lines)
+	}
+
+	if action := m.handleKey(keyDown); action.Kind != "" || m.volume != 1 {
+		t.Fatalf("expected down to select pool/b, got %d", m.volume)
+	}
+	m.handleKey(keyDown)
+	if m.volume != 1 {
+		t.Errorf("expected the selection to stop at the last dataset, got %d", m.volume)
+	}
+	if action := m.handleKey("v"); action.Kind != ActionVerify || action.Volume != "pool/b" || action.Manifest != nil {
+		t.Errorf("expected v to verify every backup set of pool/b, got %+v", action)
+	}
+	if action := m.handleKey("r"); action.Kind != tuiRestore || action.Manifest != incremental {
+		t.Errorf("expected r to restore the latest backup set of pool/b, got %+v", action)
+	}
+
+	m.handleKey(keyEnter)
+	lines = m.render(80, 10)
+	if m.screen != tuiBackupSets || !strings.Contains(lines[2], "snap2") || !strings.Contains(lines[3], "snap1") {
+		t.Fatalf("expected the backup sets of pool/b newest first, got %q", lines)
+	}
+	m.handleKey(keyEnd)
+	if action := m.handleKey("d"); action.Kind != ActionRestoreDryRun || action.Manifest != full {
+		t.Errorf("expected d to make a restore dry run of the full backup set, got %+v", action)
+	}
+
+	m.handleKey(keyEnter)
+	lines = m.render(80, 10)
+	if m.screen != tuiManifest || !strings.Contains(lines[0], "pool/b@snap1") || lines[2] != "{" {
+		t.Errorf("expected the manifest of the full backup set, got %q", lines)
+	}
+	m.handleKey(keyPageDown)
+	if lines = m.render(80, 10); m.scroll != 6 || lines[2] != m.manifest[6] {
+		t.Errorf("expected page down to scroll the manifest by a page, got %d", m.scroll)
+	}
+	m.handleKey(keyEscape)
+	m.handleKey(keyEscape)
+	if m.screen != tuiDatasets {
+		t.Errorf("expected escape to go back to the datasets, got screen %d", m.screen)
+	}
+	if action := m.handleKey("q"); action.Kind != tuiQuit {
+		t.Errorf("expected q to quit, got %+v", action)
+	}
+}
+
+func TestReadKey(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("j\x1b[A\x1b[6~\r\x7fé\x03"))
+	expected := []string{"j", keyUp, keyPageDown, keyEnter, keyBackspace, "é", keyInterrupt}
+	for _, want := range expected {
+		key, err := readKey(r)
+		if err != nil || key != want {
+			t.Fatalf("expected %q, got %q - %v", want, key, err)
+		}
+	}
+	if _, err := readKey(r); err != io.EOF {
+		t.Errorf("expected EOF once the input is read, got %v", err)
+	}
+}
+
+func TestDelegatedPermissions(t *testing.T) {
+	allowed := `---- Permissions on pool/fs -----------------------------------------
+Permission sets:
+	@backup receive
+Local permissions:
+	user alice hold
+Local+Descendent permissions:
+	group staff snapshot,release
+	user bob send
+---- Permissions on pool --------------------------------------------
+Local permissions:
+	user alice receive
+Descendent permissions:
+	user alice send
+Local+Descendent permissions:
+	everyone mount
+Create time permissions:
+	destroy
+`
+	granted := delegatedPermissions(allowed, "pool/fs", "alice", []string{"staff"})
+	expected := map[string]bool{"hold": true, "snapshot": true, "release": true, "send": true, "mount": true}
+	if !reflect.DeepEqual(granted, expected) {
+		t.Errorf("expected %v to be granted, got %v", expected, granted)
+	}
+	if missing := missingPermissions(granted, receivePermissions); !reflect.DeepEqual(missing, []string{"receive", "create"}) {
+		t.Errorf("expected receive and create to be missing, got %v", missing)
+	}
+	if missing := missingPermissions(granted, sendPermissions); len(missing) != 0 {
+		t.Errorf("expected no send permission to be missing, got %v", missing)
+	}
+}
+
+func TestDoctorChecks(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() { config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir }()
+
+	ctx := context.Background()
+	j := &files.JobInfo{ManifestPrefix: "manifests", Compressor: files.InternalZstdCompressor, VolumeSize: 1, MaxFileBuffer: 1}
+
+	if check := checkWorkingDirectory(j); check.Result != DoctorOK {
+		t.Errorf("expected the working directory to pass, got %+v", check)
+	}
+	if check := checkCompressor(j); check.Result != DoctorOK {
+		t.Errorf("expected the internal compressor to pass, got %+v", check)
+	}
+	j.Compressor = "zfsbackup-missing-compressor -9"
+	if check := checkCompressor(j); check.Result != DoctorFailed || check.Fix == "" {
+		t.Errorf("expected a missing external compressor to fail with a fix, got %+v", check)
+	}
+	if check := checkKeys(j, nil); check.Result != DoctorWarning {
+		t.Errorf("expected a warning without encryption, got %+v", check)
+	}
+	if check := checkKeys(j, errors.New("bad keyring")); check.Result != DoctorFailed {
+		t.Errorf("expected keys that could not be loaded to fail, got %+v", check)
+	}
+
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	if check := checkTarget(ctx, j, target); check.Result != DoctorOK {
+		t.Errorf("expected the target to pass, got %+v", check)
+	}
+	if check := checkTarget(ctx, j, backends.FileBackendPrefix+"://"+filepath.Join(t.TempDir(), "missing")); check.Result != DoctorFailed {
+		t.Errorf("expected a missing target to fail, got %+v", check)
+	}
+}
+
+func TestBenchTarget(t *testing.T) {
+	oldWorkingDir, oldTempdir, oldStdout, oldJSON := config.WorkingDir, config.BackupTempdir, config.Stdout, config.JSONOutput
+	config.WorkingDir, config.BackupTempdir, config.JSONOutput = t.TempDir(), t.TempDir(), true
+	defer func() {
+		config.WorkingDir, config.BackupTempdir, config.Stdout, config.JSONOutput = oldWorkingDir, oldTempdir, oldStdout, oldJSON
+	}()
+	output := new(bytes.Buffer)
+	config.Stdout = output
+
+	dir := t.TempDir()
+	target := backends.FileBackendPrefix + "://" + dir
+	if err := BenchTarget(context.Background(), &files.JobInfo{}, []string{target}, 5*humanize.KiByte, 2*humanize.KiByte, []int{1, 2}); err != nil {
+		t.Fatalf("expected no error benchmarking the target, got %v", err)
+	}
+
+	var results []TargetBenchResult
+	if err := json.Unmarshal(output.Bytes(), &results); err != nil {
+		t.Fatalf("could not decode the results - %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected a result per level of parallelism, got %+v", results)
+	}
+	for _, result := range results {
+		if result.Error != "" || result.Objects != 3 || result.ObjectBytes != 5*humanize.KiByte ||
+			result.UploadThroughput <= 0 || result.DownloadThroughput <= 0 {
+			t.Errorf("expected 3 objects holding 5KiB to be transferred, got %+v", result)
+		}
+	}
+
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the benchmark objects to be deleted from the target, got %v - %v", entries, err)
+	}
+	if entries, err := os.ReadDir(config.BackupTempdir); err != nil || len(entries) != 0 {
+		t.Errorf("expected the benchmark objects to be deleted from the working directory, got %v - %v", entries, err)
+	}
+}
+
+func TestMedianDuration(t *testing.T) {
+	if median := medianDuration([]time.Duration{3, 1, 2}); median != 2 {
+		t.Errorf("expected a median of 2, got %v", median)
+	}
+	if median := medianDuration(nil); median != 0 {
+		t.Errorf("expected a median of 0 without durations, got %v", median)
+	}
+}
+
+func TestEstimateRestore(t *testing.T) {
+	volumes := []*files.VolumeInfo{
+		{ObjectName: "a", Size: 2 * humanize.GiByte},
+		{ObjectName: "b", Size: 2 * humanize.GiByte},
+		{ObjectName: "c", Size: humanize.GiByte},
+		{ObjectName: "d", Size: humanize.GiByte},
+	}
+	classes := []string{"GLACIER", "GLACIER", "STANDARD_IA", "WEIRD"}
+
+	estimate := estimateRestore(volumes, classes, TierStandard, 0.09)
+	if estimate.Volumes != 4 || estimate.Bytes != 6*humanize.GiByte || len(estimate.StorageClasses) != 3 {
+		t.Fatalf("expected 4 volumes of 6GiB in 3 storage classes, got %+v", estimate)
+	}
+	glacier := estimate.StorageClasses[0]
+	if glacier.StorageClass != "GLACIER" || glacier.Volumes != 2 || glacier.RehydrationMax != 5*time.Hour {
+		t.Errorf("expected 2 volumes in GLACIER readable within 5 hours, got %+v", glacier)
+	}
+	if weird := estimate.StorageClasses[2]; weird.Priced || weird.RetrievalCost != 0 {
+		t.Errorf("expected an unknown storage class not to be priced, got %+v", weird)
+	}
+	// 4GiB at $0.01 from GLACIER, 1GiB at $0.01 from STANDARD_IA
+	if diff := estimate.RetrievalCost - 0.05; diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("expected a retrieval cost of $0.05, got %v", estimate.RetrievalCost)
+	}
+	if diff := estimate.TotalCost - (0.05 + 6*0.09); diff > 1e-9 || diff < -1e-9 {
+		t.Errorf("expected the egress of 6GiB to be added to the total, got %v", estimate.TotalCost)
+	}
+	if estimate.RehydrationMax != 5*time.Hour {
+		t.Errorf("expected the restore to wait for up to 5 hours, got %v", estimate.RehydrationMax)
+	}
+
+	oldStdout := config.Stdout
+	defer func() { config.Stdout = oldStdout }()
+	output := new(bytes.Buffer)
+	config.Stdout = output
+	if err := printRestoreEstimate(estimate); err != nil {
+		t.Fatalf("expected no error printing the estimate, got %v", err)
+	}
+	for _, expected := range []string{"GLACIER: 2 volumes, 4.0 GiB, $0.04 to retrieve with the standard tier, readable after 3h0m0s to 5h0m0s", "= $0.59."} {
+		if !strings.Contains(output.String(), expected) {
+			t.Errorf("expected the estimate to show %q, got %s", expected, output.String())
+		}
+	}
+
+	if estimate = estimateRestore(volumes[:2], classes[:2], TierBulk, 0); estimate.TotalCost != 0 || estimate.RehydrationMax != 12*time.Hour {
+		t.Errorf("expected a free bulk retrieval readable within 12 hours, got %+v", estimate)
+	}
+
+	t.Setenv("AWS_S3_GLACIER_RESTORE_TIER", "Expedited")
+	if tier := defaultRetrievalTier(); tier != TierExpedited {
+		t.Errorf("expected the tier of the S3 backend to be used by default, got %s", tier)
+	}
+	t.Setenv("AWS_S3_GLACIER_RESTORE_TIER", "")
+	if tier := defaultRetrievalTier(); tier != TierBulk {
+		t.Errorf("expected the bulk tier by default, got %s", tier)
+	}
+}
+
+func TestBackedUpVolumes(t *testing.T) {
+	oldWorkingDir := config.WorkingDir
+	config.WorkingDir = t.TempDir()
+	defer func() { config.WorkingDir = oldWorkingDir }()
+
+	ctx := context.Background()
+	targetA, targetB := "file:///backups/a", "file:///backups/b"
+	jobInfo := &files.JobInfo{ManifestPrefix: "manifests"}
+	otherNamespace := &files.JobInfo{ManifestPrefix: "manifests", ObjectPrefix: "other"}
+	writeCachedManifest := func(jobInfo *files.JobInfo, target, name, volume, snapshot string) {
+		j := &files.JobInfo{VolumeName: volume, BaseSnapshot: files.SnapshotInfo{Name: snapshot}}
+		manifest, err := files.CreateManifestVolume(ctx, j)
+		if err != nil {
+			t.Fatalf("expected no error creating the manifest, got %v", err)
+		}
+		if err = json.NewEncoder(manifest).Encode(j); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+		if err = manifest.Close(); err != nil {
+			t.Fatalf("expected no error closing the manifest, got %v", err)
+		}
+		if err = os.MkdirAll(cacheDirPath(jobInfo, target), 0755); err != nil {
+			t.Fatalf("expected no error creating the cache dir, got %v", err)
+		}
+		if err = manifest.CopyTo(filepath.Join(cacheDirPath(jobInfo, target), name)); err != nil {
+			t.Fatalf("expected no error copying the manifest, got %v", err)
+		}
+	}
+	writeCachedManifest(jobInfo, targetA, "a1", "pool/a", "snap1")
+	writeCachedManifest(jobInfo, targetA, "a2", "pool/a", "snap2")
+	writeCachedManifest(jobInfo, targetB, "b1", "pool/b", "snap1")
+	writeCachedManifest(otherNamespace, targetB, "b1", "pool/d", "snap1")
+
+	// Namespaces sharing a target are cached apart
+	if cacheDirPath(jobInfo, targetB) == cacheDirPath(otherNamespace, targetB) {
+		t.Errorf("expected the namespaces of a target to be cached in different directories")
+	}
+	if volumes := BackedUpVolumes(ctx, otherNamespace, []string{targetB}); !reflect.DeepEqual(volumes, []string{"pool/d", "pool/d@snap1"}) {
+		t.Errorf("expected only the manifests of the namespace to be read, got %v", volumes)
+	}
+
+	// An encrypted manifest can only be completed once it is found in the manifest database
+	encrypted := filepath.Join(cacheDirPath(jobInfo, targetB), "b2")
+	if err := os.WriteFile(encrypted, []byte("encrypted"), 0600); err != nil {
+		t.Fatalf("expected no error writing the encrypted manifest, got %v", err)
+	}
+	if err := os.WriteFile(encrypted+files.SignatureSuffix, []byte("signature"), 0600); err != nil {
+		t.Fatalf("expected no error writing the signature, got %v", err)
+	}
+	if volumes := BackedUpVolumes(ctx, jobInfo, []string{targetB}); !reflect.DeepEqual(volumes, []string{"pool/b", "pool/b@snap1"}) {
+		t.Errorf("expected only the unencrypted manifest of the target to be read, got %v", volumes)
+	}
+
+	db, err := bolt.Open(filepath.Join(config.WorkingDir, manifestDBName), 0600, nil)
+	if err != nil {
+		t.Fatalf("expected no error opening the manifest database, got %v", err)
+	}
+	updated := map[string]*cachedManifest{
+		"b2": {Manifest: &files.JobInfo{VolumeName: "pool/c", BaseSnapshot: files.SnapshotInfo{Name: "snap3"}}},
+	}
+	if err = storeCachedManifests(db, []byte(filepath.Base(cacheDirPath(jobInfo, targetB))), updated, nil); err != nil {
+		t.Fatalf("expected no error storing the manifest, got %v", err)
+	}
+	db.Close()
+
+	expected := []string{
+		"pool/a", "pool/a@snap1", "pool/a@snap2", "pool/b", "pool/b@snap1", "pool/c", "pool/c@snap3", "pool/d", "pool/d@snap1",
+	}
+	if volumes := BackedUpVolumes(ctx, jobInfo, nil); !reflect.DeepEqual(volumes, expected) {
+		t.Errorf("expected the volumes of every cached target %v, got %v", expected, volumes)
+	}
+}
+
+func TestDatasetLock(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() { config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir }()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	j := &files.JobInfo{
+		VolumeName:   fmt.Sprintf("pool/locked-%d", time.Now().UnixNano()),
+		Destinations: []string{target},
+		Separator:    "|",
+		TargetLock:   true,
+		LockTimeout:  time.Hour,
+	}
+
+	lock, err := lockDataset(ctx, j)
+	if err != nil {
+		t.Fatalf("expected no error locking the volume, got %v", err)
+	}
+	if _, err = lockDataset(ctx, j); !errors.Is(err, errDatasetLocked) {
+		t.Errorf("expected the local lock to refuse a second run, got %v", err)
+	}
+	if _, err = lockVolumes(ctx, j, target, []*files.JobInfo{j}); !errors.Is(err, errDatasetLocked) {
+		t.Errorf("expected the local lock to refuse a command deleting backup sets, got %v", err)
+	}
+	if pid, rerr := os.ReadFile(pidPath(lock.path)); rerr != nil || strings.TrimSpace(string(pid)) != strconv.Itoa(os.Getpid()) {
+		t.Errorf("expected the process holding the lock to be recorded, got %q (%v)", pid, rerr)
+	}
+	backend, err := prepareBackend(ctx, j, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("expected no error preparing the backend, got %v", err)
+	}
+	defer backend.Close()
+	if marker, rerr := readLockMarker(ctx, backend, j.LockObjectName()); rerr != nil || marker == nil || marker.PID != os.Getpid() {
+		t.Fatalf("expected the lock object to be held by this process, got %v and %v", marker, rerr)
+	}
+	if _, err = lockHost(ctx, j, backend, target); !errors.Is(err, errDatasetLocked) {
+		t.Errorf("expected clean to be refused while a volume is locked, got %v", err)
+	}
+	lock.release()
+	if marker, rerr := readLockMarker(ctx, backend, j.LockObjectName()); rerr != nil || marker != nil {
+		t.Fatalf("expected the lock object to be deleted once released, got %v and %v", marker, rerr)
+	}
+
+	// Clean holds the lock of the host exclusively, refusing every run meanwhile
+	hostLock, err := lockHost(ctx, j, backend, target)
+	if err != nil {
+		t.Fatalf("expected no error locking the host, got %v", err)
+	}
+	if _, err = lockDataset(ctx, j); !errors.Is(err, errDatasetLocked) {
+		t.Errorf("expected a run to be refused while clean holds the lock of the host, got %v", err)
+	}
+	hostLock.release()
+
+	// A lock object held by another host is only replaced once stale, or when breaking it
+	other := &lockMarker{Host: "other-host", PID: 1, Started: time.Now(), Refreshed: time.Now()}
+	if err = writeLockMarker(ctx, backend, j.LockObjectName(), other); err != nil {
+		t.Fatalf("expected no error writing the lock object, got %v", err)
+	}
+	if _, err = lockDataset(ctx, j); !errors.Is(err, errDatasetLocked) {
+		t.Errorf("expected the lock object of another host to refuse the run, got %v", err)
+	}
+	if _, err = lockVolumes(ctx, j, target, []*files.JobInfo{j}); !errors.Is(err, errDatasetLocked) {
+		t.Errorf("expected the lock object of another host to refuse a command deleting backup sets, got %v", err)
+	}
+	if _, err = lockHost(ctx, j, backend, target); !errors.Is(err, errDatasetLocked) {
+		t.Errorf("expected the lock object of another host to refuse clean, got %v", err)
+	}
+	other.Refreshed = time.Now().Add(-2 * time.Hour)
+	if err = writeLockMarker(ctx, backend, j.LockObjectName(), other); err != nil {
+		t.Fatalf("expected no error writing the lock object, got %v", err)
+	}
+	if lock, err = lockDataset(ctx, j); err != nil {
+		t.Fatalf("expected a stale lock object to be replaced, got %v", err)
+	}
+	lock.release()
+
+	other.Refreshed = time.Now()
+	if err = writeLockMarker(ctx, backend, j.LockObjectName(), other); err != nil {
+		t.Fatalf("expected no error writing the lock object, got %v", err)
+	}
+	j.BreakLock = true
+	if lock, err = lockDataset(ctx, j); err != nil {
+		t.Fatalf("expected the lock object to be broken, got %v", err)
+	}
+	lock.release()
+
+	host, _ := os.Hostname()
+	if !(&lockMarker{Host: host, Refreshed: time.Now()}).stale(host, time.Hour, time.Now()) {
+		t.Errorf("expected a lock object left by this host to be stale once the local lock is taken")
+	}
+
+	// A symlink put in place of a lock file is not followed
+	dir, err := lockDir()
+	if err != nil {
+		t.Fatalf("expected no error preparing the lock directory, got %v", err)
+	}
+	victim := filepath.Join(t.TempDir(), "victim")
+	if err = os.WriteFile(victim, []byte("keep"), 0o600); err != nil {
+		t.Fatalf("expected no error writing the file, got %v", err)
+	}
+	j.VolumeName += "-symlink"
+	if err = os.Symlink(victim, localLockPath(dir, j.VolumeName)); err != nil {
+		t.Fatalf("expected no error creating the symlink, got %v", err)
+	}
+	if _, err = lockDataset(ctx, j); err == nil {
+		t.Errorf("expected the lock file to be refused when it is a symlink")
+	}
+	if content, _ := os.ReadFile(victim); string(content) != "keep" {
+		t.Errorf("expected the file the symlink points to be left untouched, got %q", content)
+	}
+	if err = os.Chmod(dir, 0o777); err != nil {
+		t.Fatalf("expected no error changing the mode of the lock directory, got %v", err)
+	}
+	if _, err = lockDir(); err == nil {
+		t.Errorf("expected a lock directory writable by others to be refused")
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2020, 1, 3, 12, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		last     time.Time
+		expected FreshnessState
+		status   string
+	}{
+		{last: now.Add(-3 * time.Hour), expected: FreshnessOK, status: "OK - last backup of pool/fs completed 3h0m0s ago"},
+		{last: now.Add(-30 * time.Hour), expected: FreshnessWarning, status: "WARNING - last backup of pool/fs completed 30h0m0s ago"},
+		{last: now.Add(-50 * time.Hour), expected: FreshnessCritical, status: "| age=180000s;93600;180000;0"},
+		{expected: FreshnessCritical, status: "CRITICAL - no backup of pool/fs found"},
+	}
+	for _, tc := range testCases {
+		state, status := freshness("pool/fs", tc.last, now, 26*time.Hour, 50*time.Hour)
+		if state != tc.expected || !strings.Contains(status, tc.status) {
+			t.Errorf("expected %s with %q for a backup at %v, got %s with %q", tc.expected, tc.status, tc.last, state, status)
+		}
+	}
+}
+
+func TestObjectNamespace(t *testing.T) {
+	testCases := []struct {
+		prefix    string
+		namespace string
+	}{
+		{prefix: "", namespace: ""},
+		{prefix: "host", namespace: "host/"},
+		{prefix: "/site/host/", namespace: "site/host/"},
+	}
+	for _, tc := range testCases {
+		j := &files.JobInfo{ObjectPrefix: tc.prefix, ManifestPrefix: "manifests", Separator: "|"}
+		if namespace := j.ObjectNamespace(); namespace != tc.namespace {
+			t.Errorf("expected the prefix %q to give the namespace %q, got %q", tc.prefix, tc.namespace, namespace)
+		}
+		if prefix := j.ManifestListPrefix(); prefix != tc.namespace+"manifests" {
+			t.Errorf("expected the manifests of %q to be listed under %q, got %q", tc.prefix, tc.namespace+"manifests", prefix)
+		}
+		if prefix := j.IndexListPrefix(); prefix != tc.namespace+"index|" {
+			t.Errorf("expected the indexes of %q to be listed under %q, got %q", tc.prefix, tc.namespace+"index|", prefix)
+		}
+	}
+
+	j := &files.JobInfo{ManifestPrefix: "manifests", Separator: "|"}
+	objects := []string{
+		"manifests|pool/fs|snap1.manifest.gz",
+		"manifests|pool/manifests|snap1.manifest.gz",
+		"pool/fs|snap1.zstream.gz.vol1",
+		"hostA/manifests|pool/fs|snap1.manifest.gz",
+		"hostA/pool/fs|snap1.zstream.gz.vol1",
+		"site/hostB/generations|manifests|pool/fs|snap1.manifest.gz|000001",
+		"hostC/index|pool/fs.index.gz",
+	}
+	expected := []string{"hostA/", "hostC/", "site/hostB/"}
+	if namespaces := otherNamespaces(j, objects); !reflect.DeepEqual(namespaces, expected) {
+		t.Errorf("expected the namespaces %v to be found, got %v", expected, namespaces)
+	}
+	j.ObjectPrefix = "site"
+	if namespaces := otherNamespaces(j, objects[5:6]); !reflect.DeepEqual(namespaces, []string{"site/hostB/"}) {
+		t.Errorf("expected the namespace nested in the job's to be found, got %v", namespaces)
+	}
+}
+
+func TestCleanOtherNamespaces(t *testing.T) {
+	oldWorkingDir, oldTempdir, oldStdout := config.WorkingDir, config.BackupTempdir, config.Stdout
+	config.WorkingDir, config.BackupTempdir, config.Stdout = t.TempDir(), t.TempDir(), new(bytes.Buffer)
+	defer func() {
+		config.WorkingDir, config.BackupTempdir, config.Stdout = oldWorkingDir, oldTempdir, oldStdout
+	}()
+
+	ctx := context.Background()
+	target := backends.FileBackendPrefix + "://" + t.TempDir()
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	source := filepath.Join(t.TempDir(), "volume")
+	if err = os.WriteFile(source, []byte("volume"), 0o600); err != nil {
+		t.Fatalf("expected no error writing the volume, got %v", err)
+	}
+	objects := []string{"pool/fs|snap1.zstream.gz.vol1", "pool/fs|snap0.zstream.gz.vol1", "otherhost/pool/fs|snap1.zstream.gz.vol1"}
+	for _, name := range objects {
+		if err = uploadFile(ctx, backend, source, name); err != nil {
+			t.Fatalf("expected no error uploading %s, got %v", name, err)
+		}
+	}
+	for _, prefix := range []string{"", "otherhost"} {
+		manifest := &files.JobInfo{
+			VolumeName:     "pool/fs",
+			BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+			ManifestPrefix: "manifests",
+			ObjectPrefix:   prefix,
+			Separator:      "|",
+			Volumes:        []*files.VolumeInfo{{ObjectName: objects[0]}},
+		}
+		if prefix != "" {
+			manifest.Volumes[0].ObjectName = objects[2]
+		}
+		if err = writeManifest(ctx, manifest, backend, target); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+	}
+
+	// Without a prefix the whole target is listed, only the unreferenced volume without a prefix is an orphan
+	j := &files.JobInfo{ManifestPrefix: "manifests", Separator: "|", Destinations: []string{target}, Force: true}
+	if err = Clean(ctx, j, false, true); err != nil {
+		t.Fatalf("expected no error deleting the orphans, got %v", err)
+	}
+	remaining, err := backend.List(ctx, "otherhost/")
+	if err != nil || len(remaining) != 2 {
+		t.Errorf("expected the manifest and volume of the other host to be kept, got %v (%v)", remaining, err)
+	}
+	if remaining, err = backend.List(ctx, "pool"); err != nil || !reflect.DeepEqual(remaining, objects[:1]) {
+		t.Errorf("expected only the referenced volume without a prefix to be kept, got %v (%v)", remaining, err)
+	}
+}
+
+// fakeZFS will point the zfs package at a shell script standing in for the zfs executable until the test ends.
+func fakeZFS(t *testing.T, script string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "zfs")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatalf("could not write the fake zfs executable: %v", err)
+	}
+	oldPath := zfs.ZFSPath
+	zfs.ZFSPath = path
+	t.Cleanup(func() { zfs.ZFSPath = oldPath })
+}
+
+func TestCheckPartialReceive(t *testing.T) {
+	ctx := context.Background()
+	aborted := filepath.Join(t.TempDir(), "aborted")
+
+	testCases := []struct {
+		name         string
+		script       string
+		abortPartial bool
+		wantErr      bool
+		wantAborted  bool
+	}{
+		{name: "missing volume", script: "echo 'dataset does not exist' >&2; exit 1\n"},
+		{name: "no partial state", script: "echo -\n"},
+		{name: "partial state", script: "echo 1-abc-def\n", wantErr: true},
+		{
+			name:         "partial state aborted",
+			script:       "case $1 in get) echo 1-abc-def;; receive) echo \"$@\" > " + aborted + ";; esac\n",
+			abortPartial: true,
+			wantAborted:  true,
+		},
+		{
+			name:         "abort fails",
+			script:       "case $1 in get) echo 1-abc-def;; receive) exit 1;; esac\n",
+			abortPartial: true,
+			wantErr:      true,
+		},
+	}
+	for _, tc := range testCases {
+		os.Remove(aborted)
+		fakeZFS(t, tc.script)
+		err := checkPartialReceive(ctx, &files.JobInfo{AbortPartial: tc.abortPartial}, "pool/fs")
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: expected an error %v, got %v", tc.name, tc.wantErr, err)
+		}
+		args, rerr := os.ReadFile(aborted)
+		if (rerr == nil) != tc.wantAborted {
+			t.Errorf("%s: expected the partial state to be aborted %v, got %v", tc.name, tc.wantAborted, rerr == nil)
+		} else if tc.wantAborted && strings.TrimSpace(string(args)) != "receive -A pool/fs" {
+			t.Errorf("%s: expected zfs receive -A pool/fs to be run, got zfs %s", tc.name, args)
+		}
+	}
+}
+
+// fakeZFSHolds will point the zfs package at a fake zfs executable listing the snapshots s1 to s4 of pool/fs and
+// keeping the holds placed on them in a file, returning a function reading the snapshots holding the tag provided.
+func fakeZFSHolds(t *testing.T, held ...string) func(tag string) []string {
+	t.Helper()
+	state := filepath.Join(t.TempDir(), "holds")
+	var lines string
+	for _, snapshot := range held {
+		lines += "pool/fs@" + snapshot + "\tzfsbackup\n"
+	}
+	if err := os.WriteFile(state, []byte(lines), 0o600); err != nil {
+		t.Fatalf("could not write the holds of the fake zfs executable: %v", err)
+	}
+	fakeZFS(t, `state=`+state+`
+case $1 in
+list) for s in 4 3 2 1; do printf 'pool/fs@s%d\t%d\tsnapshot\n' $s $s; done;;
+holds) shift 2; for s in "$@"; do grep "^$s	" $state; done; true;;
+hold) printf '%s\t%s\n' "$3" "$2" >> $state;;
+release) grep -v "^$3	$2\$" $state > $state.new; mv $state.new $state;;
+esac
+`)
+	return func(tag string) []string {
+		data, err := os.ReadFile(state)
+		if err != nil {
+			t.Fatalf("could not read the holds of the fake zfs executable: %v", err)
+		}
+		var snapshots []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if fields := strings.Split(line, "\t"); len(fields) == 2 && fields[1] == tag {
+				snapshots = append(snapshots, strings.TrimPrefix(fields[0], "pool/fs@"))
+			}
+		}
+		sort.Strings(snapshots)
+		return snapshots
+	}
+}
+
+func TestUpdateChainHolds(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		name     string
+		held     []string
+		job      files.JobInfo
+		expected []string
+	}{
+		{
+			name:     "full backup",
+			held:     []string{"s1", "s2"},
+			job:      files.JobInfo{BaseSnapshot: files.SnapshotInfo{Name: "s3"}, FullIfOlderThan: time.Hour},
+			expected: []string{"s3"},
+		},
+		{
+			name: "incremental backup",
+			held: []string{"s2"},
+			job: files.JobInfo{
+				BaseSnapshot: files.SnapshotInfo{Name: "s3"}, IncrementalSnapshot: files.SnapshotInfo{Name: "s2"},
+				FullIfOlderThan: -1 * time.Minute,
+			},
+			expected: []string{"s3"},
+		},
+		{
+			// s1 holds the tag as well, but is older than the snapshot of the chain's full backup
+			name: "chain continued from its full backup",
+			held: []string{"s1", "s2", "s3"},
+			job: files.JobInfo{
+				BaseSnapshot: files.SnapshotInfo{Name: "s4"}, IncrementalSnapshot: files.SnapshotInfo{Name: "s3"},
+				ChainFullSnapshot: files.SnapshotInfo{Name: "s2"}, FullIfOlderThan: time.Hour,
+			},
+			expected: []string{"s2", "s4"},
+		},
+		{
+			name: "differential backup",
+			held: []string{"s1", "s3"},
+			job: files.JobInfo{
+				BaseSnapshot: files.SnapshotInfo{Name: "s4"}, IncrementalSnapshot: files.SnapshotInfo{Name: "s1"},
+				Differential: true, FullIfOlderThan: -1 * time.Minute,
+			},
+			expected: []string{"s1"},
+		},
+	}
+	for _, tc := range testCases {
+		held := fakeZFSHolds(t, tc.held...)
+		job := tc.job
+		job.VolumeName = "pool/fs"
+		job.HoldTag = "zfsbackup"
+		if err := updateChainHolds(ctx, &job); err != nil {
+			t.Errorf("%s: could not update the holds: %v", tc.name, err)
+			continue
+		}
+		if snapshots := held("zfsbackup"); !reflect.DeepEqual(snapshots, tc.expected) {
+			t.Errorf("%s: expected the snapshots %v to be held, got %v", tc.name, tc.expected, snapshots)
+		}
+	}
+}
+
+func TestReleasePrunedHolds(t *testing.T) {
+	held := fakeZFSHolds(t, "s1", "s2", "s3", "s4")
+
+	backupSet := func(base, incremental string) *files.JobInfo {
+		return &files.JobInfo{
+			VolumeName:          "pool/fs",
+			BaseSnapshot:        files.SnapshotInfo{Name: base},
+			IncrementalSnapshot: files.SnapshotInfo{Name: incremental},
+		}
+	}
+	// The old chain s1 <- s2 <- s3 is pruned once consolidate uploaded a full backup of s3, which s4 increments from
+	full1, incr2, incr3 := backupSet("s1", ""), backupSet("s2", "s1"), backupSet("s3", "s2")
+	full3, incr4 := backupSet("s3", ""), backupSet("s4", "s3")
+	manifests := []*files.JobInfo{full1, incr2, incr3, full3, incr4}
+
+	releasePrunedHolds(context.Background(), "zfsbackup", []*files.JobInfo{incr3, incr2, full1}, manifests)
+	if snapshots := held("zfsbackup"); !reflect.DeepEqual(snapshots, []string{"s3", "s4"}) {
+		t.Errorf("expected the holds on s1 and s2 to be released, got the snapshots %v held", snapshots)
+	}
+}
+
+func TestPromoteSandbox(t *testing.T) {
+	ctx := context.Background()
+	calls := filepath.Join(t.TempDir(), "calls")
+	run := func(failRename, targetExists bool) []string {
+		t.Helper()
+		os.Remove(calls)
+		script := `echo "$@" >> ` + calls + `
+case $1 in
+get) case $6 in mounted) echo yes;; type) echo filesystem;; esac;;
+`
+		if failRename {
+			script += "rename) if [ \"$2\" = pool/fs_zfsbackup_sandbox ]; then exit 1; fi;;\n"
+		}
+		fakeZFS(t, script+"esac\n")
+
+		err := promoteSandbox(ctx, &files.JobInfo{}, "pool/fs_zfsbackup_sandbox", "pool/fs", targetExists)
+		if (err != nil) != failRename {
+			t.Errorf("expected an error %v promoting the sandbox, got %v", failRename, err)
+		}
+		data, rerr := os.ReadFile(calls)
+		if rerr != nil {
+			t.Fatalf("could not read the calls of the fake zfs executable: %v", rerr)
+		}
+		var commands []string
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			if !strings.HasPrefix(line, "get ") {
+				commands = append(commands, regexp.MustCompile(`_replaced_\d+`).ReplaceAllString(line, "_replaced"))
+			}
+		}
+		return commands
+	}
+
+	expected := []string{"unmount pool/fs", "rename pool/fs pool/fs_replaced", "rename pool/fs_zfsbackup_sandbox pool/fs", "mount pool/fs"}
+	if commands := run(false, true); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected the sandbox to replace the local volume with %v, got %v", expected, commands)
+	}
+
+	expected = []string{"rename pool/fs_zfsbackup_sandbox pool/fs", "mount pool/fs"}
+	if commands := run(false, false); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected the sandbox to be renamed to the local volume with %v, got %v", expected, commands)
+	}
+
+	expected = []string{
+		"unmount pool/fs", "rename pool/fs pool/fs_replaced", "rename pool/fs_zfsbackup_sandbox pool/fs",
+		"rename pool/fs_replaced pool/fs", "mount pool/fs",
+	}
+	if commands := run(true, true); !reflect.DeepEqual(commands, expected) {
+		t.Errorf("expected the local volume to be renamed back with %v, got %v", expected, commands)
+	}
+}
+
+func TestRunSandboxHook(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env")
+	hook := `echo "$ZFSBACKUP_SANDBOX $ZFSBACKUP_TARGET" > ` + out
+	if err := runSandboxHook(context.Background(), hook, "pool/fs_zfsbackup_sandbox", "pool/fs"); err != nil {
+		t.Fatalf("expected the hook to succeed, got %v", err)
+	}
+	if data, err := os.ReadFile(out); err != nil || strings.TrimSpace(string(data)) != "pool/fs_zfsbackup_sandbox pool/fs" {
+		t.Errorf("expected the hook to get the sandbox and target names, got %q, %v", data, err)
+	}
+	if err := runSandboxHook(context.Background(), "exit 3", "pool/fs_zfsbackup_sandbox", "pool/fs"); err == nil {
+		t.Errorf("expected a failing hook to fail the sandboxed restore")
+	}
+}
+
+func TestUploadSignature(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	target := backends.FileBackendPrefix + "://" + dir
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("expected no error preparing the backend, got %v", err)
+	}
+	defer backend.Close()
+
+	oldTempdir := config.BackupTempdir
+	config.BackupTempdir = t.TempDir()
+	defer func() { config.BackupTempdir = oldTempdir }()
+
+	vol := &files.VolumeInfo{ObjectName: "manifests|pool/fs|snap1.manifest", Signature: []byte("signature")}
+	if err = uploadSignature(ctx, backend, vol); err != nil {
+		t.Fatalf("expected no error uploading the signature, got %v", err)
+	}
+	if data, rerr := os.ReadFile(filepath.Join(dir, vol.ObjectName+files.SignatureSuffix)); rerr != nil || string(data) != "signature" {
+		t.Errorf("expected the signature to be uploaded next to the manifest, got %q, %v", data, rerr)
+	}
+	if entries, _ := os.ReadDir(config.BackupTempdir); len(entries) != 0 {
+		t.Errorf("expected the signature not to be written to the temporary directory, found %d files", len(entries))
+	}
+}
+
+func TestHiddenObjectNames(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	hmacOf := func(names string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(names))
+		return fmt.Sprintf("%x", mac.Sum(nil))
+	}
+
+	j := &files.JobInfo{VolumeName: "pool/fs", HideNames: true, NamesKey: key, ManifestPrefix: "manifests", Separator: "|"}
+	hidden := hmacOf("pool/fs")
+	lockName := j.LockObjectName()
+	if lockName != "locks|"+hidden+".lock" {
+		t.Errorf("expected the lock object to be named after the hidden volume name %s, got %s", hidden, lockName)
+	}
+	if name := j.IndexObjectName(); !strings.HasPrefix(name, "index|"+hidden+".") {
+		t.Errorf("expected the index to be named after the hidden volume name %s, got %s", hidden, name)
+	}
+
+	j.BaseSnapshot = files.SnapshotInfo{Name: "snap2"}
+	j.IncrementalSnapshot = files.SnapshotInfo{Name: "snap1"}
+	hidden = hmacOf("pool/fs\x00snap1\x00to\x00snap2")
+	if name := j.BackupVolumeObjectName(1); !strings.HasPrefix(name, hidden+".zstream") {
+		t.Errorf("expected the volume to be named after the hidden volume and snapshot names %s, got %s", hidden, name)
+	}
+	if name := j.ManifestObjectName(); !strings.Contains(name, hidden) || strings.Contains(name, "pool/fs") {
+		t.Errorf("expected the manifest to be named after the hidden volume and snapshot names %s, got %s", hidden, name)
+	}
+
+	// Without the key a guessed name cannot be confirmed
+	if unkeyed := fmt.Sprintf("%x", sha256.Sum256([]byte("pool/fs"))); strings.Contains(lockName, unkeyed) {
+		t.Errorf("expected the hidden name to be keyed, got %s", lockName)
+	}
+}
+
+func TestSync(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir
+	}()
+
+	ctx := context.Background()
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	source, destination := backends.FileBackendPrefix+"://"+srcDir, backends.FileBackendPrefix+"://"+dstDir
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, source, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	write := func(dir, name, content string) {
+		if werr := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); werr != nil {
+			t.Fatalf("could not write test object - %v", werr)
+		}
+	}
+	write(srcDir, "pool|fs|snap1.zstream.vol1", "hello")
+	write(srcDir, "pool|fs|snap1.zstream.vol2", "hello")
+	write(srcDir, "pool|fs|snap1.zstream.vol3", "jello")
+	write(dstDir, "pool|fs|snap1.zstream.vol1", "jello")
+
+	manifest := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+	}
+	for idx := 1; idx <= 3; idx++ {
+		manifest.Volumes = append(manifest.Volumes, &files.VolumeInfo{
+			ObjectName: fmt.Sprintf("pool|fs|snap1.zstream.vol%d", idx),
+			Size:       5,
+			MD5Sum:     "5d41402abc4b2a76b9719d911017c592", // md5("hello")
+		})
+	}
+	if err = writeManifest(ctx, manifest, backend, source); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+
+	j := &files.JobInfo{
+		ManifestPrefix:     "manifests",
+		Separator:          "|",
+		MaxParallelUploads: 2,
+		MaxRetryTime:       time.Second,
+		MaxBackoffTime:     time.Millisecond,
+	}
+	if err = Sync(ctx, j, source, destination); err != nil {
+		t.Fatalf("expected no error syncing the targets, got %v", err)
+	}
+
+	for _, name := range []string{"pool|fs|snap1.zstream.vol1", "pool|fs|snap1.zstream.vol2"} {
+		if content, rerr := os.ReadFile(filepath.Join(dstDir, name)); rerr != nil || string(content) != "hello" {
+			t.Errorf("expected %s to be repaired in the destination, got %q (%v)", name, content, rerr)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dstDir, "pool|fs|snap1.zstream.vol3")); !os.IsNotExist(err) {
+		t.Errorf("expected the volume corrupt in the source not to be copied, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(dstDir, manifest.ManifestObjectName())); err != nil {
+		t.Errorf("expected the manifest to be copied to the destination, got %v", err)
+	}
+
+	// A volume corrupt in the source must never replace the intact copy in the destination
+	write(srcDir, "pool|fs|snap1.zstream.vol2", "jello")
+	if err = Sync(ctx, j, source, destination); err != nil {
+		t.Fatalf("expected no error syncing the targets again, got %v", err)
+	}
+	if content, rerr := os.ReadFile(filepath.Join(dstDir, "pool|fs|snap1.zstream.vol2")); rerr != nil || string(content) != "hello" {
+		t.Errorf("expected the intact destination volume not to be overwritten, got %q (%v)", content, rerr)
+	}
+}
+
+func TestReplicate(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir
+	}()
+
+	ctx := context.Background()
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	source, destination := backends.FileBackendPrefix+"://"+srcDir, backends.FileBackendPrefix+"://"+dstDir
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, source, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	manifests := make(map[string]*files.JobInfo)
+	for _, volumeName := range []string{"pool/data", "pool/other"} {
+		objectName := strings.ReplaceAll(volumeName, "/", "|") + "|snap1.zstream.vol1"
+		if err = os.WriteFile(filepath.Join(srcDir, objectName), []byte("hello"), 0o600); err != nil {
+			t.Fatalf("could not write test object - %v", err)
+		}
+		manifests[volumeName] = &files.JobInfo{
+			VolumeName:     volumeName,
+			BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+			ManifestPrefix: "manifests",
+			Separator:      "|",
+			Volumes:        []*files.VolumeInfo{{ObjectName: objectName, Size: 5, MD5Sum: "5d41402abc4b2a76b9719d911017c592"}},
+		}
+		if err = writeManifest(ctx, manifests[volumeName], backend, source); err != nil {
+			t.Fatalf("expected no error writing the manifest, got %v", err)
+		}
+	}
+
+	j := &files.JobInfo{
+		ManifestPrefix:     "manifests",
+		Separator:          "|",
+		MaxParallelUploads: 2,
+		MaxRetryTime:       time.Second,
+		MaxBackoffTime:     time.Millisecond,
+	}
+	replicated := func() []string {
+		var names []string
+		if werr := filepath.Walk(dstDir, func(p string, fi os.FileInfo, werr error) error {
+			if werr == nil && !fi.IsDir() {
+				names = append(names, strings.TrimPrefix(p, dstDir+string(filepath.Separator)))
+			}
+			return werr
+		}); werr != nil {
+			t.Fatalf("expected no error listing the destination, got %v", werr)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	if err = Replicate(ctx, j, source, destination, "", true); err != nil {
+		t.Fatalf("expected no error for a dry run, got %v", err)
+	}
+	if names := replicated(); len(names) != 0 {
+		t.Errorf("expected a dry run not to copy anything, found %v", names)
+	}
+
+	if err = Replicate(ctx, j, source, destination, "pool/d*", false); err != nil {
+		t.Fatalf("expected no error replicating the matching volumes, got %v", err)
+	}
+	expected := []string{manifests["pool/data"].ManifestObjectName(), manifests["pool/data"].Volumes[0].ObjectName}
+	sort.Strings(expected)
+	if names := replicated(); !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected only the backup set of pool/data to be replicated, expected %v, got %v", expected, names)
+	}
+
+	if err = Replicate(ctx, j, source, destination, "", false); err != nil {
+		t.Fatalf("expected no error replicating the remaining volumes, got %v", err)
+	}
+	if names := replicated(); len(names) != 4 {
+		t.Errorf("expected both backup sets to be replicated, got %v", names)
+	}
+}
+
+func TestReplicatePending(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir
+	}()
+
+	ctx := context.Background()
+	srcDir, dstDir := t.TempDir(), t.TempDir()
+	missingDir := filepath.Join(t.TempDir(), "missing")
+	source := backends.FileBackendPrefix + "://" + srcDir
+	destination, unavailable := backends.FileBackendPrefix+"://"+dstDir, backends.FileBackendPrefix+"://"+missingDir
+	backend, err := prepareBackend(ctx, &files.JobInfo{}, source, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer backend.Close()
+
+	objectName := "pool|fs|snap1.zstream.vol1"
+	if err = os.WriteFile(filepath.Join(srcDir, objectName), []byte("hello"), 0o600); err != nil {
+		t.Fatalf("could not write test object - %v", err)
+	}
+	manifest := &files.JobInfo{
+		VolumeName:     "pool/fs",
+		BaseSnapshot:   files.SnapshotInfo{Name: "snap1", CreationTime: time.Now()},
+		ManifestPrefix: "manifests",
+		Separator:      "|",
+		PendingTargets: []string{destination, unavailable},
+		Volumes:        []*files.VolumeInfo{{ObjectName: objectName, Size: 5, MD5Sum: "5d41402abc4b2a76b9719d911017c592"}},
+	}
+	if err = writeManifest(ctx, manifest, backend, source); err != nil {
+		t.Fatalf("expected no error writing the manifest, got %v", err)
+	}
+
+	j := &files.JobInfo{
+		ManifestPrefix:     "manifests",
+		Separator:          "|",
+		MaxParallelUploads: 2,
+		MaxRetryTime:       time.Second,
+		MaxBackoffTime:     time.Millisecond,
+	}
+	pendingTargets := func(target string) []string {
+		state, serr := loadTargetState(ctx, j, target, backend)
+		if serr != nil {
+			t.Fatalf("expected no error reading the manifests of %s, got %v", target, serr)
+		}
+		stored, ok := state.manifests[manifest.ManifestObjectName()]
+		if !ok {
+			t.Fatalf("expected the manifest to exist in %s", target)
+		}
+		return stored.PendingTargets
+	}
+
+	if err = ReplicatePending(ctx, j, source, "", false); err != errReplicationIncomplete {
+		t.Fatalf("expected %v with a target unavailable, got %v", errReplicationIncomplete, err)
+	}
+	if content, rerr := os.ReadFile(filepath.Join(dstDir, objectName)); rerr != nil || string(content) != "hello" {
+		t.Errorf("expected the volume to be replicated to the available target, got %q (%v)", content, rerr)
+	}
+	if _, err = os.Stat(filepath.Join(dstDir, manifest.ManifestObjectName())); err != nil {
+		t.Errorf("expected the manifest to be replicated to the available target, got %v", err)
+	}
+	if pending := pendingTargets(source); !reflect.DeepEqual(pending, []string{unavailable}) {
+		t.Errorf("expected the source manifest to only list the unavailable target as pending, got %v", pending)
+	}
+
+	if err = os.Mkdir(missingDir, 0o700); err != nil {
+		t.Fatalf("could not create the missing target - %v", err)
+	}
+	if err = ReplicatePending(ctx, j, source, "", false); err != nil {
+		t.Fatalf("expected no error replicating to the remaining target, got %v", err)
+	}
+	if _, err = os.Stat(filepath.Join(missingDir, objectName)); err != nil {
+		t.Errorf("expected the volume to be replicated to the remaining target, got %v", err)
+	}
+	if pending := pendingTargets(source); len(pending) != 0 {
+		t.Errorf("expected no pending targets left in the source manifest, got %v", pending)
+	}
+
+	dstBackend, err := prepareBackend(ctx, &files.JobInfo{}, destination, make(chan bool, 1))
+	if err != nil {
+		t.Fatalf("error initializing file backend - %v", err)
+	}
+	defer dstBackend.Close()
+	state, err := loadTargetState(ctx, j, destination, dstBackend)
+	if err != nil {
+		t.Fatalf("expected no error reading the manifests of the destination, got %v", err)
+	}
+	if stored := state.manifests[manifest.ManifestObjectName()]; stored == nil || len(stored.PendingTargets) != 0 {
+		t.Errorf("expected the replicated manifest not to carry pending targets, got %+v", stored)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	oldStdin := config.Stdin
+	defer func() { config.Stdin = oldStdin }()
+
+	for answer, expected := range map[string]bool{
+		"y\n":    true,
+		"YES\n":  true,
+		" Y \n":  true,
+		"n\n":    false,
+		"\n":     false,
+		"":       false,
+		"sure\n": false,
+	} {
+		config.Stdin = strings.NewReader(answer)
+		if got := Confirm("Continue?"); got != expected {
+			t.Errorf("Expected the answer %q to confirm %v, got %v", answer, expected, got)
+		}
+	}
+}
+
+func TestDifferentialSmartOptions(t *testing.T) {
+	oldWorkingDir, oldTempdir := config.WorkingDir, config.BackupTempdir
+	config.WorkingDir, config.BackupTempdir = t.TempDir(), t.TempDir()
+	defer func() {
+		config.WorkingDir, config.BackupTempdir = oldWorkingDir, oldTempdir
+	}()
+	fakeZFS(t, `for s in 4 3 2 1; do printf 'pool/fs@s%d\t%d\tsnapshot\n' $s $s; done`)
+
+	ctx := context.Background()
+	snap := func(n int) files.SnapshotInfo {
+		return files.SnapshotInfo{Name: fmt.Sprintf("s%d", n), CreationTime: time.Unix(int64(n), 0)}
+	}
+	backupSet := func(base, incremental int) *files.JobInfo {
+		manifest := &files.JobInfo{VolumeName: "pool/fs", BaseSnapshot: snap(base), ManifestPrefix: "manifests", Separator: "|"}
+		if incremental >= 0 {
+			manifest.IncrementalSnapshot = snap(incremental)
+		}
+		return manifest
+	}
+
+	testCases := []struct {
+		name        string
+		manifests   []*files.JobInfo
+		incremental string
+		err         error
+	}{
+		{name: "no backups", err: errors.New("no full backup to take a differential backup from - try doing a full backup instead")},
+		{
+			name:      "only incremental backups",
+			manifests: []*files.JobInfo{backupSet(3, 2), backupSet(2, 1)},
+			err:       errors.New("no full backup to take a differential backup from - try doing a full backup instead"),
+		},
+		{name: "full backup missing locally", manifests: []*files.JobInfo{backupSet(0, -1)}},
+		{name: "last full backup", manifests: []*files.JobInfo{backupSet(1, -1)}, incremental: "s1"},
+		{
+			name:        "last full backup rather than the last incremental",
+			manifests:   []*files.JobInfo{backupSet(1, -1), backupSet(2, 1), backupSet(3, 2)},
+			incremental: "s1",
+		},
+		{
+			name:        "latest full backup",
+			manifests:   []*files.JobInfo{backupSet(1, -1), backupSet(2, 1), backupSet(3, -1)},
+			incremental: "s3",
+		},
+		{name: "up to date", manifests: []*files.JobInfo{backupSet(1, -1), backupSet(4, 1)}, err: ErrNoOp},
+	}
+
+	for _, testCase := range testCases {
+		target := backends.FileBackendPrefix + "://" + t.TempDir()
+		backend, err := prepareBackend(ctx, &files.JobInfo{}, target, make(chan bool, 1))
+		if err != nil {
+			t.Fatalf("error initializing file backend - %v", err)
+		}
+		for _, manifest := range testCase.manifests {
+			if err = writeManifest(ctx, manifest, backend, target); err != nil {
+				t.Fatalf("%s: expected no error writing the manifest, got %v", testCase.name, err)
+			}
+		}
+		backend.Close()
+
+		j := &files.JobInfo{
+			VolumeName:      "pool/fs",
+			Destinations:    []string{target},
+			ManifestPrefix:  "manifests",
+			Separator:       "|",
+			Differential:    true,
+			FullIfOlderThan: -1 * time.Minute,
+		}
+		err = ProcessSmartOptions(ctx, j)
+		if testCase.err != nil {
+			if err == nil || err.Error() != testCase.err.Error() {
+				t.Errorf("%s: expected error %v, got %v", testCase.name, testCase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: expected no error, got %v", testCase.name, err)
+			continue
+		}
+		if j.BaseSnapshot.Name != "s4" || j.IncrementalSnapshot.Name != testCase.incremental {
+			t.Errorf("%s: expected a backup of s4 incremental from %q, got %s incremental from %q",
+				testCase.name, testCase.incremental, j.BaseSnapshot.Name, j.IncrementalSnapshot.Name)
+		}
+	}
 }
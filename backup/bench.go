@@ -0,0 +1,188 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/miolini/datacounter"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// BenchResult holds how a compressor at a compression level performed on the sample of a send stream.
+type BenchResult struct {
+	Compressor      string
+	Level           int
+	SampleBytes     uint64
+	CompressedBytes uint64
+	// Ratio is the size of the sample divided by its compressed size
+	Ratio float64
+	// Throughput is the number of sample bytes compressed per second
+	Throughput float64
+	Duration   time.Duration
+	Error      string `json:",omitempty"`
+}
+
+// BenchCompress will read up to sampleSize bytes of the zfs send stream of the job's snapshot and compress them with
+// each of the compressors at each of the levels provided, reporting the throughput and ratio of each.
+func BenchCompress(pctx context.Context, jobInfo *files.JobInfo, compressors []string, levels []int, sampleSize uint64) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	sample, err := readSendSample(ctx, jobInfo, sampleSize)
+	if err != nil {
+		return err
+	}
+	if len(sample) == 0 {
+		log.AppLogger.Errorf("The zfs send stream of %s@%s is empty, nothing to benchmark.", jobInfo.VolumeName, jobInfo.BaseSnapshot.Name)
+		return fmt.Errorf("empty send stream")
+	}
+	log.AppLogger.Infof("Benchmarking compressors with a %s sample of the send stream.", humanize.IBytes(uint64(len(sample))))
+
+	results := make([]BenchResult, 0, len(compressors)*len(levels))
+	for _, compressor := range compressors {
+		compressorLevels := levels
+		if len(strings.Fields(compressor)) > 1 {
+			// Compressors given with their own arguments ignore the compression level
+			compressorLevels = []int{0}
+		}
+		for _, level := range compressorLevels {
+			j := cloneJobInfo(jobInfo)
+			j.Compressor = compressor
+			j.CompressionLevel = level
+			log.AppLogger.Debugf("Benchmarking %s at compression level %d.", compressor, level)
+			results = append(results, benchCompressor(ctx, j, sample))
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+
+	if config.JSONOutput {
+		j, jerr := json.Marshal(results)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf(
+		"Compressed a %s sample of %s@%s:", humanize.IBytes(uint64(len(sample))), jobInfo.VolumeName, jobInfo.BaseSnapshot.Name,
+	)}
+	for _, result := range results {
+		if result.Error != "" {
+			output = append(output, fmt.Sprintf("\t%s: failed - %s", benchName(result), result.Error))
+			continue
+		}
+		output = append(output, fmt.Sprintf(
+			"\t%s: %.2fx ratio (%s), %s/s",
+			benchName(result), result.Ratio, humanize.IBytes(result.CompressedBytes), humanize.IBytes(uint64(result.Throughput)),
+		))
+	}
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	return nil
+}
+
+// benchName describes the compressor and level of the result.
+func benchName(result BenchResult) string {
+	if result.Level == 0 {
+		return result.Compressor
+	}
+	return fmt.Sprintf("%s level %d", result.Compressor, result.Level)
+}
+
+// readSendSample will read up to sampleSize bytes of the zfs send stream for the job, stopping the send afterwards.
+func readSendSample(pctx context.Context, j *files.JobInfo, sampleSize uint64) ([]byte, error) {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	stderr := bytes.NewBuffer(nil)
+	cmd := zfs.GetZFSSendCommand(ctx, j)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	log.AppLogger.Infof("Starting zfs send command: %s", strings.Join(cmd.Args, " "))
+	if err = cmd.Start(); err != nil {
+		log.AppLogger.Errorf("Error starting zfs command - %v", err)
+		return nil, err
+	}
+
+	sample, rerr := io.ReadAll(io.LimitReader(stdout, int64(sampleSize)))
+	if uint64(len(sample)) == sampleSize {
+		// We have all we need, stop the send instead of waiting for the whole stream
+		cancel()
+		_ = cmd.Wait()
+		return sample, nil
+	}
+	if err = cmd.Wait(); err != nil || rerr != nil {
+		if err == nil {
+			err = rerr
+		}
+		log.AppLogger.Errorf("Error while reading the zfs send stream - %v: %s", err, strings.TrimSpace(stderr.String()))
+		return nil, err
+	}
+	return sample, nil
+}
+
+// benchCompressor will time compressing the sample with the job's compressor and compression level.
+func benchCompressor(ctx context.Context, j *files.JobInfo, sample []byte) BenchResult {
+	result := BenchResult{Compressor: j.Compressor, Level: j.CompressionLevel, SampleBytes: uint64(len(sample))}
+
+	counter := datacounter.NewWriterCounter(io.Discard)
+	start := time.Now()
+	w, err := files.NewCompressor(ctx, j, counter)
+	if err == nil {
+		if _, err = w.Write(sample); err != nil {
+			_ = w.Close()
+		} else {
+			err = w.Close()
+		}
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	result.Duration = time.Since(start)
+	result.CompressedBytes = counter.Count()
+	if result.CompressedBytes > 0 {
+		result.Ratio = float64(result.SampleBytes) / float64(result.CompressedBytes)
+	}
+	if result.Duration > 0 {
+		result.Throughput = float64(result.SampleBytes) / result.Duration.Seconds()
+	}
+	return result
+}
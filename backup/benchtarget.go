@@ -0,0 +1,314 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// benchTargetPrefix is the prefix of the objects uploaded to benchmark a target, followed by the time the benchmark
+// started and the number of transfers running in parallel.
+const benchTargetPrefix = "zfsbackup-bench-"
+
+// TargetBenchResult holds how a target performed uploading, then downloading, the benchmark objects with a number of
+// transfers running in parallel.
+type TargetBenchResult struct {
+	Target      string
+	Parallel    int
+	Objects     int
+	ObjectBytes uint64
+	// UploadThroughput and DownloadThroughput are the number of bytes transferred per second, across all transfers
+	UploadThroughput   float64
+	DownloadThroughput float64
+	// UploadLatency is the median time an object took to upload, DownloadLatency the median time to its first byte
+	UploadLatency   time.Duration
+	DownloadLatency time.Duration
+	Error           string `json:",omitempty"`
+}
+
+// BenchTarget will upload, download, then delete size bytes of random data split in objects of objectSize bytes to
+// and from each target, with each of the numbers of transfers running in parallel provided, reporting the throughput
+// and latency of each. The objects are written to the working directory once, before any is uploaded.
+func BenchTarget(pctx context.Context, jobInfo *files.JobInfo, targets []string, size, objectSize uint64, parallels []int) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	if available, err := freeSpace(config.BackupTempdir); err == nil && available < size {
+		log.AppLogger.Errorf("Not enough free space in %s for the benchmark objects: %s available but %s needed.",
+			config.BackupTempdir, humanize.IBytes(available), humanize.IBytes(size))
+		return fmt.Errorf("not enough free space in %s", config.BackupTempdir)
+	}
+	objects, err := createBenchObjects(ctx, size, objectSize)
+	defer func() {
+		for _, object := range objects {
+			if derr := object.DeleteVolume(); derr != nil {
+				log.AppLogger.Warningf("Could not delete the temporary benchmark file - %v", derr)
+			}
+		}
+	}()
+	if err != nil {
+		log.AppLogger.Errorf("Could not write the benchmark objects - %v", err)
+		return err
+	}
+	for _, parallel := range parallels {
+		if parallel > len(objects) {
+			log.AppLogger.Warningf("Only %d objects will be transferred, %d transfers cannot all run in parallel.", len(objects), parallel)
+		}
+	}
+
+	prefix := benchTargetPrefix + strconv.FormatInt(time.Now().Unix(), 10)
+	results := make([]TargetBenchResult, 0, len(targets)*len(parallels))
+	for _, target := range targets {
+		for _, parallel := range parallels {
+			log.AppLogger.Infof("Benchmarking %s with %d transfers in parallel.", target, parallel)
+			results = append(results, benchTarget(ctx, jobInfo, target, fmt.Sprintf("%s-%d", prefix, parallel), objects, parallel))
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+	}
+
+	return printTargetBenchResults(results, size, objectSize)
+}
+
+// createBenchObjects will write volumes of objectSize bytes of random data, the last one holding what remains, until
+// size bytes were written.
+func createBenchObjects(ctx context.Context, size, objectSize uint64) ([]*files.VolumeInfo, error) {
+	block := make([]byte, humanize.MiByte)
+	if _, err := rand.Read(block); err != nil {
+		return nil, err
+	}
+
+	var objects []*files.VolumeInfo
+	for written := uint64(0); written < size; {
+		object, err := files.CreateSimpleVolume(ctx, false)
+		if err != nil {
+			return objects, err
+		}
+		objects = append(objects, object)
+
+		remaining := objectSize
+		if size-written < remaining {
+			remaining = size - written
+		}
+		for remaining > 0 {
+			chunk := block
+			if remaining < uint64(len(chunk)) {
+				chunk = chunk[:remaining]
+			}
+			if _, err = object.Write(chunk); err != nil {
+				_ = object.Close()
+				return objects, err
+			}
+			remaining -= uint64(len(chunk))
+			written += uint64(len(chunk))
+		}
+		if err = object.Close(); err != nil {
+			return objects, err
+		}
+	}
+	return objects, nil
+}
+
+// benchTarget will time uploading the objects to the target, named after the prefix, then downloading them back, with
+// parallel transfers at a time, deleting them afterwards.
+func benchTarget(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	target, prefix string,
+	objects []*files.VolumeInfo,
+	parallel int,
+) TargetBenchResult {
+	result := TargetBenchResult{Target: target, Parallel: parallel, Objects: len(objects)}
+	for _, object := range objects {
+		result.ObjectBytes += object.Size
+	}
+
+	j := cloneJobInfo(jobInfo)
+	j.MaxParallelUploads = parallel
+	backend, err := prepareBackend(ctx, j, target, make(chan bool, parallel))
+	if err != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, err)
+		result.Error = err.Error()
+		return result
+	}
+	defer backend.Close()
+
+	names := make([]string, len(objects))
+	for i := range objects {
+		names[i] = fmt.Sprintf("%s-%d", prefix, i)
+	}
+	uploaded := make([]bool, len(objects))
+	defer func() {
+		for i, name := range names {
+			if !uploaded[i] {
+				continue
+			}
+			if derr := backend.Delete(ctx, name); derr != nil {
+				log.AppLogger.Warningf("Could not delete the benchmark object %s from %s - %v", name, target, derr)
+			}
+		}
+	}()
+
+	start := time.Now()
+	latencies, err := runBenchTransfers(ctx, len(objects), parallel, func(i int) (time.Duration, error) {
+		object := objects[i]
+		object.ObjectName = names[i]
+		if oerr := object.OpenVolume(); oerr != nil {
+			return 0, oerr
+		}
+		defer object.Close()
+		transferStart := time.Now()
+		if uerr := backend.Upload(ctx, object); uerr != nil {
+			return 0, uerr
+		}
+		uploaded[i] = true
+		return time.Since(transferStart), nil
+	})
+	if err != nil {
+		log.AppLogger.Errorf("Could not upload the benchmark objects to %s - %v", target, err)
+		result.Error = fmt.Sprintf("upload failed - %v", err)
+		return result
+	}
+	result.UploadThroughput = float64(result.ObjectBytes) / time.Since(start).Seconds()
+	result.UploadLatency = medianDuration(latencies)
+
+	start = time.Now()
+	latencies, err = runBenchTransfers(ctx, len(objects), parallel, func(i int) (time.Duration, error) {
+		transferStart := time.Now()
+		r, derr := backend.Download(ctx, names[i])
+		if derr != nil {
+			return 0, derr
+		}
+		defer r.Close()
+		first := make([]byte, 1)
+		if _, derr = io.ReadFull(r, first); derr != nil {
+			return 0, derr
+		}
+		firstByte := time.Since(transferStart)
+		n, derr := io.Copy(io.Discard, r)
+		if derr != nil {
+			return 0, derr
+		}
+		if uint64(n)+1 != objects[i].Size {
+			return 0, fmt.Errorf("downloaded %d bytes of %s, expected %d", n+1, names[i], objects[i].Size)
+		}
+		return firstByte, nil
+	})
+	if err != nil {
+		log.AppLogger.Errorf("Could not download the benchmark objects from %s - %v", target, err)
+		result.Error = fmt.Sprintf("download failed - %v", err)
+		return result
+	}
+	result.DownloadThroughput = float64(result.ObjectBytes) / time.Since(start).Seconds()
+	result.DownloadLatency = medianDuration(latencies)
+	return result
+}
+
+// runBenchTransfers will run the transfer of each of the count objects, parallel at a time, returning the latency
+// each transfer reported.
+func runBenchTransfers(ctx context.Context, count, parallel int, transfer func(int) (time.Duration, error)) ([]time.Duration, error) {
+	latencies := make([]time.Duration, count)
+	var mutex sync.Mutex
+	group, gctx := errgroup.WithContext(ctx)
+	buffer := make(chan bool, parallel)
+	for i := 0; i < count; i++ {
+		i := i
+		select {
+		case <-gctx.Done():
+			return nil, group.Wait()
+		case buffer <- true:
+		}
+		group.Go(func() error {
+			defer func() { <-buffer }()
+			latency, err := transfer(i)
+			if err != nil {
+				return err
+			}
+			mutex.Lock()
+			latencies[i] = latency
+			mutex.Unlock()
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return latencies, nil
+}
+
+// medianDuration returns the median of the durations provided.
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[len(sorted)/2]
+}
+
+func printTargetBenchResults(results []TargetBenchResult, size, objectSize uint64) error {
+	if config.JSONOutput {
+		j, err := json.Marshal(results)
+		if err != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", err)
+			return err
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	var output []string
+	for i, result := range results {
+		if i == 0 || results[i-1].Target != result.Target {
+			output = append(output, fmt.Sprintf("Transferred %s in objects of up to %s to and from %s:",
+				humanize.IBytes(size), humanize.IBytes(objectSize), result.Target))
+		}
+		if result.Error != "" {
+			output = append(output, fmt.Sprintf("\t%d in parallel: failed - %s", result.Parallel, result.Error))
+			continue
+		}
+		output = append(output, fmt.Sprintf(
+			"\t%d in parallel: upload %s/s (%v per object), download %s/s (%v to first byte)",
+			result.Parallel,
+			humanize.IBytes(uint64(result.UploadThroughput)), result.UploadLatency.Round(time.Microsecond),
+			humanize.IBytes(uint64(result.DownloadThroughput)), result.DownloadLatency.Round(time.Microsecond),
+		))
+	}
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	return nil
+}
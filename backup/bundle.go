@@ -0,0 +1,302 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// ExportManifests will write the manifests found in the target for the volumes matching volumeName, using the same
+// rules as the list command, to a tar archive at bundlePath. The manifests and their detached signatures are
+// written as they are stored in the target, still encrypted and signed, named after their object names.
+func ExportManifests(pctx context.Context, jobInfo *files.JobInfo, target, volumeName, bundlePath string) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	if _, err := os.Stat(bundlePath); err == nil {
+		log.AppLogger.Errorf("The bundle %s already exists, refusing to overwrite it.", bundlePath)
+		return fmt.Errorf("%s already exists", bundlePath)
+	}
+
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+	localCachePath, err := getCacheDir(jobInfo, target)
+	if err != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, err)
+		return err
+	}
+
+	// Write to a temporary file so an incomplete bundle is never left under the name requested
+	partial := bundlePath + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.AppLogger.Errorf("Could not create %s - %v", partial, err)
+		return err
+	}
+	defer os.Remove(partial)
+
+	tw := tar.NewWriter(f)
+	exported := 0
+	for _, manifest := range manifests {
+		if !manifestMatchesFilter(manifest, volumeName, time.Time{}, time.Time{}) {
+			continue
+		}
+
+		name := manifest.ManifestObjectName()
+		// nolint:gosec // MD5 not used for cryptographic purposes here
+		manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(name))))
+		if err = addBundleFile(tw, name, manifestPath); err != nil {
+			f.Close()
+			return err
+		}
+		if _, serr := os.Stat(signaturePath(manifestPath)); serr == nil {
+			if err = addBundleFile(tw, name+files.SignatureSuffix, signaturePath(manifestPath)); err != nil {
+				f.Close()
+				return err
+			}
+		}
+		log.AppLogger.Debugf("Exported the manifest %s.", name)
+		exported++
+	}
+
+	if err = tw.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(partial, bundlePath); err != nil {
+		return err
+	}
+
+	log.AppLogger.Noticef("Exported %d of %d manifests found in %s to %s.", exported, len(manifests), target, bundlePath)
+	return nil
+}
+
+// addBundleFile will write the file at filePath to the bundle as name.
+func addBundleFile(tw *tar.Writer, name, filePath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("could not open %s to add it to the bundle - %v", filePath, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     0o600,
+		ModTime:  info.ModTime(),
+	}); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// ImportManifests will upload the manifests of the bundle written by ExportManifests to the target, under the same
+// object names. Every manifest is read, and its signature checked, before any is uploaded. Manifests the target
+// already holds are left alone, and the index of every volume imported is deleted so it is rebuilt by the next send.
+// nolint:funlen // Difficult to break this up
+func ImportManifests(pctx context.Context, jobInfo *files.JobInfo, target, bundlePath string) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	tempdir, err := os.MkdirTemp(config.BackupTempdir, "bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempdir)
+
+	names, err := extractBundle(bundlePath, tempdir)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the bundle %s - %v", bundlePath, err)
+		return err
+	}
+
+	manifests := make(map[string]*files.JobInfo, len(names))
+	for _, name := range names {
+		manifest, merr := readManifest(ctx, bundleFilePath(tempdir, name), jobInfo)
+		if merr != nil {
+			log.AppLogger.Errorf("Could not read the manifest %s from the bundle %s - %v", name, bundlePath, merr)
+			return merr
+		}
+		manifests[name] = manifest
+	}
+
+	// Manifests are uploaded one at a time
+	uploadBuffer := make(chan bool, 1)
+	defer close(uploadBuffer)
+	backend, err := prepareBackend(ctx, jobInfo, target, uploadBuffer)
+	if err != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, err)
+		return err
+	}
+	defer backend.Close()
+
+	imported := 0
+	volumes := make(map[string]bool)
+	for _, name := range names {
+		exists, eerr := objectExists(ctx, backend, name)
+		if eerr != nil {
+			return eerr
+		}
+		if exists {
+			log.AppLogger.Infof("The manifest %s is already in %s, skipping it.", name, target)
+			continue
+		}
+
+		manifestPath := bundleFilePath(tempdir, name)
+		if _, serr := os.Stat(signaturePath(manifestPath)); serr == nil {
+			// Upload the signature first so the manifest is never found without it
+			if err = uploadFile(ctx, backend, signaturePath(manifestPath), name+files.SignatureSuffix); err != nil {
+				return err
+			}
+		}
+		if err = uploadFile(ctx, backend, manifestPath, name); err != nil {
+			log.AppLogger.Errorf("Could not upload the manifest %s to %s due to error - %v", name, target, err)
+			return err
+		}
+		log.AppLogger.Debugf("Imported the manifest %s.", name)
+		volumes[manifests[name].VolumeName] = true
+		imported++
+	}
+
+	for volume := range volumes {
+		j := *jobInfo
+		j.VolumeName = volume
+		if err = deleteDatasetIndex(ctx, &j, backend); err != nil {
+			log.AppLogger.Warningf("Could not delete the index of %s in %s - %v", volume, target, err)
+		}
+	}
+
+	log.AppLogger.Noticef("Imported %d of %d manifests from %s to %s.", imported, len(names), bundlePath, target)
+	return nil
+}
+
+// bundleFilePath returns where the manifest named name is extracted to beneath dir.
+func bundleFilePath(dir, name string) string {
+	// nolint:gosec // MD5 not used for cryptographic purposes here
+	return filepath.Join(dir, fmt.Sprintf("%x", md5.Sum([]byte(name))))
+}
+
+// extractBundle will extract the manifests of the bundle at bundlePath to dir, laid out like the local cache, and
+// return their object names.
+func extractBundle(bundlePath, dir string) ([]string, error) {
+	f, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	tr := tar.NewReader(f)
+	for {
+		header, herr := tr.Next()
+		if herr == io.EOF {
+			break
+		} else if herr != nil {
+			return nil, herr
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		filePath := bundleFilePath(dir, header.Name)
+		if strings.HasSuffix(header.Name, files.SignatureSuffix) {
+			filePath = signaturePath(bundleFilePath(dir, strings.TrimSuffix(header.Name, files.SignatureSuffix)))
+			if err = os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+				return nil, err
+			}
+		} else {
+			names = append(names, header.Name)
+		}
+
+		out, oerr := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+		if oerr != nil {
+			return nil, oerr
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// uploadFile will upload the file at filePath to the backend as objectName.
+func uploadFile(ctx context.Context, backend backends.Backend, filePath, objectName string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	vol, err := files.CreateSimpleVolume(ctx, false)
+	if err != nil {
+		return fmt.Errorf("could not create temporary file to upload %s due to error - %v", objectName, err)
+	}
+	defer func() {
+		// The delete backend has already removed it
+		if derr := vol.DeleteVolume(); derr != nil && !os.IsNotExist(derr) {
+			log.AppLogger.Warningf("Could not delete temporary file for %s due to error - %v", objectName, derr)
+		}
+	}()
+
+	vol.ObjectName = objectName
+	if _, err = io.Copy(vol, f); err != nil {
+		_ = vol.Close()
+		return err
+	}
+	if err = vol.Close(); err != nil {
+		return err
+	}
+
+	if err = vol.OpenVolume(); err != nil {
+		return err
+	}
+	defer vol.Close()
+
+	return backend.Upload(ctx, vol)
+}
@@ -0,0 +1,87 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// Cat will write the zfs send stream of the backup set described by the jobInfo to stdout, reassembled from its
+// volumes, decrypted and decompressed, so it can be piped to zfs receive or any other tool reading zfs streams.
+func Cat(pctx context.Context, jobInfo *files.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	targets, err := prepareRestoreTargets(ctx, jobInfo)
+	if err != nil {
+		return err
+	}
+	defer closeRestoreTargets(targets)
+
+	var (
+		manifest *files.JobInfo
+		source   restoreTarget
+	)
+	for _, t := range targets {
+		if manifest, err = fetchManifest(ctx, jobInfo, t); err == nil {
+			source = t
+			break
+		}
+		log.AppLogger.Warningf("Could not retrieve the manifest from target %s - %v", t.uri, err)
+	}
+	if err != nil {
+		log.AppLogger.Errorf("Error trying to retrieve manifest volume - %v", err)
+		return err
+	}
+	manifest.ManifestPrefix = jobInfo.ManifestPrefix
+	manifest.ObjectPrefix = jobInfo.ObjectPrefix
+	manifest.CopyKeys(jobInfo)
+
+	toDownload := make([]string, len(manifest.Volumes))
+	for idx := range manifest.Volumes {
+		toDownload[idx] = manifest.Volumes[idx].ObjectName
+	}
+	if err = source.backend.PreDownload(ctx, toDownload); err != nil {
+		log.AppLogger.Errorf("Error trying to pre download backup set volumes from target %s - %v", source.uri, err)
+		return err
+	}
+
+	log.AppLogger.Infof("Writing the zfs stream of %s to stdout.", backupSetName(manifest))
+	reader := newStreamReader(ctx, manifest, source.backend, source.uri)
+	defer reader.Close()
+	written, err := io.Copy(config.Stdout, io.NewSectionReader(reader, 0, math.MaxInt64))
+	if err != nil {
+		log.AppLogger.Errorf("Could not write the zfs stream of %s - %v", backupSetName(manifest), err)
+		return err
+	}
+	if manifest.ZFSStreamBytes != 0 && uint64(written) != manifest.ZFSStreamBytes {
+		log.AppLogger.Errorf("Wrote %d bytes of the zfs stream of %s, expected %d.", written, backupSetName(manifest), manifest.ZFSStreamBytes)
+		return fmt.Errorf("zfs stream size mismatch, expected %d bytes but wrote %d", manifest.ZFSStreamBytes, written)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// CatalogEntry describes a backup set found in one or more targets.
+type CatalogEntry struct {
+	VolumeName          string
+	BaseSnapshot        files.SnapshotInfo
+	IncrementalSnapshot files.SnapshotInfo
+	ManifestObjectName  string
+	Volumes             int
+	TotalBytes          uint64
+	Targets             []string // The targets holding this backup set
+	Chain               []string // The snapshots to restore, in order, to arrive at this backup set
+	ChainComplete       bool     // False when a parent backup set of this one could not be found in any target
+	RestorableFrom      []string // The targets holding every backup set in the chain
+}
+
+// Catalog will fetch the manifests from every target provided and output a merged, deduplicated view of
+// the backup sets found, grouped by volume, along with which targets hold each backup set and its chain.
+// Only the volumes matching startswith, using the same rules as the list command, are included.
+// nolint:funlen // Difficult to break this up
+func Catalog(pctx context.Context, jobInfo *files.JobInfo, targets []string, startswith string) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	var (
+		manifests []*files.JobInfo
+		entries   = make(map[string]*CatalogEntry)
+	)
+	for _, target := range targets {
+		found, err := readTargetManifests(ctx, jobInfo, target)
+		if err != nil {
+			return err
+		}
+
+		for _, manifest := range found {
+			if !manifestMatchesFilter(manifest, startswith, time.Time{}, time.Time{}) {
+				continue
+			}
+
+			name := manifest.ManifestObjectName()
+			entry, ok := entries[name]
+			if !ok {
+				entry = &CatalogEntry{
+					VolumeName:          manifest.VolumeName,
+					BaseSnapshot:        manifest.BaseSnapshot,
+					IncrementalSnapshot: manifest.IncrementalSnapshot,
+					ManifestObjectName:  name,
+					Volumes:             len(manifest.Volumes),
+					TotalBytes:          manifest.TotalBytesWritten(),
+				}
+				entries[name] = entry
+				manifests = append(manifests, manifest)
+			}
+			entry.Targets = append(entry.Targets, target)
+		}
+	}
+
+	manifestTree := linkManifests(manifests)
+	catalog := make(map[string][]*CatalogEntry, len(manifestTree))
+	for volume, snapList := range manifestTree {
+		sort.SliceStable(snapList, func(i, j int) bool {
+			return snapList[i].BaseSnapshot.CreationTime.Before(snapList[j].BaseSnapshot.CreationTime)
+		})
+		for _, manifest := range snapList {
+			entry := entries[manifest.ManifestObjectName()]
+			entry.Chain, entry.ChainComplete, entry.RestorableFrom = catalogChain(manifest, entries)
+			catalog[volume] = append(catalog[volume], entry)
+		}
+	}
+
+	if config.JSONOutput {
+		j, jerr := json.Marshal(catalog)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	volumes := make([]string, 0, len(catalog))
+	for volume := range catalog {
+		volumes = append(volumes, volume)
+	}
+	sort.Strings(volumes)
+
+	output := []string{fmt.Sprintf("Found %d backup sets for %d volumes across %d targets:", len(entries), len(volumes), len(targets))}
+	for _, volume := range volumes {
+		output = append(output, fmt.Sprintf("\n%s:", volume))
+		for _, entry := range catalog[volume] {
+			kind := "full"
+			if entry.IncrementalSnapshot.Name != "" {
+				kind = fmt.Sprintf("incremental from %s", entry.IncrementalSnapshot.Name)
+			}
+			restorable := strings.Join(entry.RestorableFrom, ", ")
+			if !entry.ChainComplete {
+				restorable = "none, the chain is incomplete"
+			} else if restorable == "" {
+				restorable = "none, no single target holds the entire chain"
+			}
+			output = append(output, fmt.Sprintf(
+				"\t%s (%s) - %d volumes, %s\n\t\tFound in: %s\n\t\tRestorable from: %s",
+				entry.BaseSnapshot.Name, kind, entry.Volumes, humanize.IBytes(entry.TotalBytes),
+				strings.Join(entry.Targets, ", "), restorable,
+			))
+		}
+	}
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+
+	return nil
+}
+
+// readTargetManifests will sync the local cache for the target and return the manifests found in it.
+func readTargetManifests(ctx context.Context, jobInfo *files.JobInfo, target string) ([]*files.JobInfo, error) {
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return nil, berr
+	}
+	defer backend.Close()
+
+	localCachePath, cerr := getCacheDir(jobInfo, target)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return nil, cerr
+	}
+
+	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	if serr != nil {
+		log.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return nil, serr
+	}
+
+	manifests, err := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range manifests {
+		manifest.ManifestPrefix = jobInfo.ManifestPrefix
+		manifest.ObjectPrefix = jobInfo.ObjectPrefix
+		manifest.CopyKeys(jobInfo)
+	}
+
+	return manifests, nil
+}
+
+// catalogChain walks the parents of the manifest to compute the snapshots to restore, in order, along with
+// whether every parent was found and the targets holding every backup set in the chain.
+func catalogChain(manifest *files.JobInfo, entries map[string]*CatalogEntry) (chain []string, complete bool, restorableFrom []string) {
+	var candidates []string
+	for current := manifest; current != nil; current = current.ParentSnap {
+		chain = append([]string{current.BaseSnapshot.Name}, chain...)
+
+		entry := entries[current.ManifestObjectName()]
+		if current == manifest {
+			candidates = append(candidates, entry.Targets...)
+		} else {
+			remaining := candidates[:0]
+			for _, target := range candidates {
+				if containsTarget(entry.Targets, target) {
+					remaining = append(remaining, target)
+				}
+			}
+			candidates = remaining
+		}
+
+		if current.ParentSnap == nil {
+			complete = current.IncrementalSnapshot.Name == ""
+		}
+	}
+
+	if !complete {
+		return chain, false, nil
+	}
+	return chain, true, candidates
+}
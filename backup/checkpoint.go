@@ -0,0 +1,176 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// restoreCheckpoint records how far a restore to stream files got in the working directory, so an interrupted
+// restore run again resumes after the last volume written instead of downloading the whole chain again. Restores
+// received by zfs resume from the last snapshot received instead, as zfs cannot resume a stream read from a backup.
+// All methods are safe to call on a nil checkpoint so callers do not need to check if checkpointing is enabled.
+type restoreCheckpoint struct {
+	// Stream files written completely
+	Received []string
+	// The stream file being written, along with the volumes written to it so far and their size
+	Partial     string
+	Volumes     []string
+	StreamBytes uint64
+
+	path string
+}
+
+// loadRestoreCheckpoint returns the checkpoint of the restore of the backup sets to stream files, read from the
+// working directory when a previous run of the same restore was interrupted. It returns nil when the restore is not
+// to stream files, or there is no working directory to keep it in.
+func loadRestoreCheckpoint(jobInfo *files.JobInfo, sets []*restoreSet) *restoreCheckpoint {
+	if jobInfo.ToFile == "" || config.WorkingDir == "" || len(sets) == 0 {
+		return nil
+	}
+
+	last := sets[len(sets)-1].job
+	key := sha256.Sum256([]byte(strings.Join([]string{last.VolumeName, last.ToFile, last.BaseSnapshot.Name}, "\x00")))
+	c := &restoreCheckpoint{path: filepath.Join(config.WorkingDir, "restores", fmt.Sprintf("%x.json", key))}
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.AppLogger.Warningf("Could not read the restore checkpoint %s, starting over - %v", c.path, err)
+		}
+		return c
+	}
+	if err = json.Unmarshal(data, c); err != nil {
+		log.AppLogger.Warningf("Could not parse the restore checkpoint %s, starting over - %v", c.path, err)
+		return &restoreCheckpoint{path: c.path}
+	}
+	return c
+}
+
+// resume will drop the backup sets the checkpoint records as written, and skip the volumes already written to the
+// stream file of the backup set that was interrupted, returning the backup sets left to restore.
+func (c *restoreCheckpoint) resume(sets []*restoreSet) []*restoreSet {
+	if c == nil {
+		return sets
+	}
+
+	remaining := make([]*restoreSet, 0, len(sets))
+	for _, set := range sets {
+		path := streamFilePath(&set.job)
+		if containsTarget(c.Received, path) {
+			if _, err := os.Stat(path); err == nil {
+				log.AppLogger.Noticef("Skipping %s, it was written completely by a previous run.", path)
+				continue
+			}
+		}
+		if path == c.Partial && c.matches(set.manifest.Volumes, path) {
+			log.AppLogger.Noticef("Resuming %s after the %d volume(s) written by a previous run.", path, len(c.Volumes))
+			set.skip = len(c.Volumes)
+			set.offset = c.StreamBytes
+		}
+		remaining = append(remaining, set)
+	}
+	return remaining
+}
+
+// matches returns true if the volumes recorded are the first volumes of the backup set, and the partial stream file
+// still holds them.
+func (c *restoreCheckpoint) matches(volumes []*files.VolumeInfo, path string) bool {
+	if len(c.Volumes) == 0 || len(c.Volumes) > len(volumes) {
+		return false
+	}
+	for idx, name := range c.Volumes {
+		if volumes[idx].ObjectName != name {
+			return false
+		}
+	}
+	info, err := os.Stat(path + ".partial")
+	return err == nil && uint64(info.Size()) >= c.StreamBytes
+}
+
+// start records the stream file being written, keeping the volumes recorded when resuming it.
+func (c *restoreCheckpoint) start(path string, resuming bool) error {
+	if c == nil {
+		return nil
+	}
+	if !resuming {
+		c.Volumes = nil
+		c.StreamBytes = 0
+	}
+	c.Partial = path
+	return c.save()
+}
+
+// volumeWritten records the volume as written to the stream file, which now holds size bytes.
+func (c *restoreCheckpoint) volumeWritten(vol *files.VolumeInfo, size uint64) error {
+	if c == nil {
+		return nil
+	}
+	c.Volumes = append(c.Volumes, vol.ObjectName)
+	c.StreamBytes = size
+	return c.save()
+}
+
+// written records the stream file as written completely.
+func (c *restoreCheckpoint) written(path string) error {
+	if c == nil {
+		return nil
+	}
+	c.Received = append(c.Received, path)
+	c.Partial = ""
+	c.Volumes = nil
+	c.StreamBytes = 0
+	return c.save()
+}
+
+// remove deletes the checkpoint once the restore completed.
+func (c *restoreCheckpoint) remove() {
+	if c == nil {
+		return
+	}
+	if err := os.Remove(c.path); err != nil && !os.IsNotExist(err) {
+		log.AppLogger.Warningf("Could not remove the restore checkpoint %s - %v", c.path, err)
+	}
+}
+
+func (c *restoreCheckpoint) save() error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	// Replace the checkpoint in one step so an interruption never leaves it half written
+	if err = os.WriteFile(c.path+".tmp", data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(c.path+".tmp", c.path)
+}
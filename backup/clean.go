@@ -23,24 +23,34 @@ package backup
 import (
 	"context"
 	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/cenkalti/backoff"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/files"
 	"github.com/jdfalk/zfsbackup-go/log"
 )
 
+// OrphanedObject is an object found in the target that no manifest references, along with why it is thought to be left over.
+type OrphanedObject struct {
+	ObjectName string
+	Reason     string
+}
+
 // Clean will remove files found in the desination that are not found in any of the manifests found locally or in the destination.
 // If cleanLocal is true, then local manifests not found in the destination are ignored and deleted. This function will optionally
-// delete broken backup sets in the destination if the --force flag is provided.
+// delete broken backup sets in the destination if the --force flag is provided. When gc is set, every object that would be
+// deleted is reported first, including the broken backup sets, and nothing is deleted unless the --force flag is provided.
 // nolint:funlen,gocyclo // Difficult to break this up
-func Clean(pctx context.Context, jobInfo *files.JobInfo, cleanLocal bool) error {
+func Clean(pctx context.Context, jobInfo *files.JobInfo, cleanLocal, gc bool) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
 
@@ -53,8 +63,18 @@ func Clean(pctx context.Context, jobInfo *files.JobInfo, cleanLocal bool) error
 	}
 	defer backend.Close()
 
+	// Nothing may be uploading while the objects no manifest references are deleted, they may belong to a backup
+	// whose manifest is not written yet. Only reporting them needs no lock.
+	if !gc || jobInfo.Force {
+		lock, lerr := lockHost(ctx, jobInfo, backend, target)
+		if lerr != nil {
+			return lerr
+		}
+		defer lock.release()
+	}
+
 	// Get the local cache dir
-	localCachePath, cerr := getCacheDir(target)
+	localCachePath, cerr := getCacheDir(jobInfo, target)
 	if cerr != nil {
 		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
 		return cerr
@@ -104,82 +124,167 @@ func Clean(pctx context.Context, jobInfo *files.JobInfo, cleanLocal bool) error
 				log.AppLogger.Errorf("Could not delete local manifest %s due to error - %v", manifestPath, err)
 				return err
 			}
+			if err = os.Remove(signaturePath(manifestPath)); err != nil && !os.IsNotExist(err) {
+				log.AppLogger.Warningf("Could not delete the signature of local manifest %s due to error - %v", manifestPath, err)
+			}
 			log.AppLogger.Debugf("Deleted %s.", manifestPath)
 		}
 	}
 
 	// TODO: The following can be done in a much more efficient way (probably)
-	allObjects, err := backend.List(ctx, "")
+	allObjects, err := backend.List(ctx, jobInfo.ObjectNamespace())
 	if err != nil {
 		log.AppLogger.Errorf("Could not list objects in backend %s due to error - %v", target, err)
 		return err
 	}
 
-	// Remove Manifest Files
+	// The objects of other hosts are listed too when their namespace is beneath this job's, e.g. every host's when no
+	// prefix is used, and none of them are referenced by this job's manifests
+	namespaces := otherNamespaces(jobInfo, allObjects)
+	for _, namespace := range namespaces {
+		log.AppLogger.Noticef("Ignoring the objects under %s, they belong to the namespace of another host.", namespace)
+	}
+
+	// Remove Manifest, Index, Lock, and superseded Manifest Files along with the objects of other namespaces
 	for idx := 0; idx < len(allObjects); idx++ {
-		if strings.HasPrefix(allObjects[idx], jobInfo.ManifestPrefix) {
+		name := allObjects[idx]
+		if strings.HasPrefix(name, jobInfo.ManifestListPrefix()) || strings.HasPrefix(name, jobInfo.IndexListPrefix()) ||
+			strings.HasPrefix(name, jobInfo.GenerationListPrefix()) || strings.HasPrefix(name, jobInfo.LockListPrefix()) ||
+			hasAnyPrefix(name, namespaces) {
 			allObjects = append(allObjects[:idx], allObjects[idx+1:]...)
 			idx--
 		}
 	}
 
-	// Go through all manifests and remove from the allObjects list what we know should exist
+	existing := make(map[string]bool, len(allObjects))
+	for _, obj := range allObjects {
+		existing[obj] = true
+	}
+
+	// Go through all manifests and note which objects should be kept. Content addressed volumes
+	// may be referenced by several manifests so nothing is deleted until every manifest was checked.
+	referenced := make(map[string]bool, len(allObjects))
+	stems := make(map[string]string)
+	reasons := make(map[string]string)
+	var (
+		brokenManifests []string
+		brokenSets      []*files.JobInfo
+	)
 	for _, manifest := range decodedManifests {
-		for vidx, vol := range manifest.Volumes {
-			found := false
-			for idx := range allObjects {
-				if strings.Compare(vol.ObjectName, allObjects[idx]) == 0 {
-					allObjects = append(allObjects[:idx], allObjects[idx+1:]...)
-					found = true
-					break
-				}
+		var missing *files.VolumeInfo
+		for _, vol := range manifest.Volumes {
+			if !existing[vol.ObjectName] {
+				missing = vol
+				break
 			}
+		}
 
-			if !found {
-				// Broken backup set! inform the user!
-				if jobInfo.Force {
-					log.AppLogger.Warningf(
-						"The following backup set is missing volume %s. Removing entire backupset:\n\n%s",
-						vol.ObjectName, manifest.String(),
-					)
-
-					// Compute the manifest object name and cache name to delete
-					manifest.ManifestPrefix = jobInfo.ManifestPrefix
-					manifest.SignKey = jobInfo.SignKey
-					manifest.EncryptKey = jobInfo.EncryptKey
-					tempManifest, terr := files.CreateManifestVolume(ctx, manifest)
-					if terr != nil {
-						log.AppLogger.Errorf("Could not compute manifest path due to error - %v.", terr)
-						return terr
-					}
-					allObjects = append(allObjects, tempManifest.ObjectName)
-					if err = tempManifest.Close(); err != nil {
-						log.AppLogger.Warningf("Could not close temporary manifest %v", err)
-					}
-					if err = tempManifest.DeleteVolume(); err != nil {
-						log.AppLogger.Warningf("Could not delete temporary manifest %v", err)
-					}
-					// nolint:gosec // MD5 not used for cryptographic purposes here
-					manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(tempManifest.ObjectName))))
-					err = os.Remove(manifestPath)
-					if err != nil {
-						log.AppLogger.Errorf("Could not delete local manifest %s due to error - %v. Continuing.", manifestPath, err)
-					}
+		if missing == nil || !(jobInfo.Force || gc) {
+			if missing != nil {
+				log.AppLogger.Warningf(
+					"The following backup set is missing volume %s:\n\n%s\n\nPass the --force flag to delete this backup set.",
+					missing.ObjectName, manifest.String(),
+				)
+			}
+			for _, vol := range manifest.Volumes {
+				referenced[vol.ObjectName] = true
+				stems[volumeStem(vol.ObjectName)] = "extra volume of the backup set " + backupSetName(manifest)
+			}
+			continue
+		}
 
-					// Delete all volumes already processed in the manifest
-					for i := 0; i < vidx; i++ {
-						allObjects = append(allObjects, manifest.Volumes[i].ObjectName)
-					}
-					break
-				} else {
-					log.AppLogger.Warningf(
-						"The following backup set is missing volume %s:\n\n%s\n\nPass the --force flag to delete this backup set.",
-						vol.ObjectName, manifest.String(),
-					)
-				}
+		// Broken backup set! inform the user!
+		if jobInfo.Force {
+			log.AppLogger.Warningf(
+				"The following backup set is missing volume %s. Removing entire backupset:\n\n%s",
+				missing.ObjectName, manifest.String(),
+			)
+		} else {
+			log.AppLogger.Warningf(
+				"The following backup set is missing volume %s. Pass the --force flag to remove the entire backupset:\n\n%s",
+				missing.ObjectName, manifest.String(),
+			)
+		}
+		for _, vol := range manifest.Volumes {
+			if _, ok := stems[volumeStem(vol.ObjectName)]; !ok {
+				stems[volumeStem(vol.ObjectName)] = "volume of the broken backup set " + backupSetName(manifest)
 			}
 		}
+
+		// Compute the manifest object name and cache name to delete
+		manifest.ManifestPrefix = jobInfo.ManifestPrefix
+		manifest.ObjectPrefix = jobInfo.ObjectPrefix
+		manifest.CopyKeys(jobInfo)
+		tempManifest, terr := files.CreateManifestVolume(ctx, manifest)
+		if terr != nil {
+			log.AppLogger.Errorf("Could not compute manifest path due to error - %v.", terr)
+			return terr
+		}
+		names := []string{tempManifest.ObjectName}
+		if signed, serr := objectExists(ctx, backend, tempManifest.ObjectName+files.SignatureSuffix); serr == nil && signed {
+			names = append(names, tempManifest.ObjectName+files.SignatureSuffix)
+		}
+		if superseded, serr := backend.List(ctx, manifest.ManifestGenerationPrefix(tempManifest.ObjectName)); serr == nil {
+			names = append(names, superseded...)
+		} else {
+			log.AppLogger.Warningf("Could not list the superseded generations of %s - %v", tempManifest.ObjectName, serr)
+		}
+		for _, name := range names {
+			reasons[name] = fmt.Sprintf("manifest of the broken backup set %s, missing volume %s", backupSetName(manifest), missing.ObjectName)
+		}
+		brokenManifests = append(brokenManifests, names...)
+		brokenSets = append(brokenSets, manifest)
+		if err = tempManifest.Close(); err != nil {
+			log.AppLogger.Warningf("Could not close temporary manifest %v", err)
+		}
+		if err = tempManifest.DeleteVolume(); err != nil {
+			log.AppLogger.Warningf("Could not delete temporary manifest %v", err)
+		}
+	}
+
+	// Whatever is not referenced by a remaining manifest can be deleted, including the volumes of broken backup sets
+	for idx := 0; idx < len(allObjects); idx++ {
+		if referenced[allObjects[idx]] {
+			allObjects = append(allObjects[:idx], allObjects[idx+1:]...)
+			idx--
+		}
+	}
+
+	if gc {
+		orphans := make([]*OrphanedObject, 0, len(allObjects)+len(brokenManifests))
+		for _, obj := range allObjects {
+			orphans = append(orphans, &OrphanedObject{ObjectName: obj, Reason: orphanReason(jobInfo, obj, stems)})
+		}
+		for _, obj := range brokenManifests {
+			orphans = append(orphans, &OrphanedObject{ObjectName: obj, Reason: reasons[obj]})
+		}
+		if err = reportOrphans(orphans, target); err != nil {
+			return err
+		}
+		if !jobInfo.Force {
+			log.AppLogger.Noticef("Found %d orphaned objects in %s, pass the --force flag to delete them.", len(orphans), target)
+			return nil
+		}
+	}
+
+	for _, manifest := range brokenSets {
+		// nolint:gosec // MD5 not used for cryptographic purposes here
+		manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifest.ManifestObjectName()))))
+		err = os.Remove(manifestPath)
+		if err != nil {
+			log.AppLogger.Errorf("Could not delete local manifest %s due to error - %v. Continuing.", manifestPath, err)
+		}
+
+		// The index would still list the deleted backup set, the next send rebuilds it
+		if err = deleteDatasetIndex(ctx, manifest, backend); err != nil {
+			log.AppLogger.Warningf("Could not delete the index of %s due to error - %v. Continuing.", manifest.VolumeName, err)
+		}
+
+		if jobInfo.HoldTag != "" {
+			releaseChainHold(ctx, jobInfo.HoldTag, fmt.Sprintf("%s@%s", manifest.VolumeName, manifest.BaseSnapshot.Name))
+		}
 	}
+	allObjects = append(allObjects, brokenManifests...)
 
 	log.AppLogger.Noticef("Starting to delete %d objects in destination.", len(allObjects))
 
@@ -235,3 +340,89 @@ func Clean(pctx context.Context, jobInfo *files.JobInfo, cleanLocal bool) error
 	log.AppLogger.Noticef("Done.")
 	return nil
 }
+
+// volumeStem returns the name of the volume without its extensions, which is shared by every volume of a backup set.
+func volumeStem(objectName string) string {
+	if idx := strings.Index(objectName, ".zstream"); idx >= 0 {
+		return objectName[:idx]
+	}
+	return objectName
+}
+
+// backupSetName returns the volume and snapshot of the backup set, as in volume@snapshot.
+func backupSetName(manifest *files.JobInfo) string {
+	return fmt.Sprintf("%s@%s", manifest.VolumeName, manifest.BaseSnapshot.Name)
+}
+
+// orphanReason returns why the object, which no manifest references, is thought to be left over. The stems map the names
+// of the volumes of known backup sets, without their extensions, to the reason given for other volumes sharing them.
+func orphanReason(jobInfo *files.JobInfo, objectName string, stems map[string]string) string {
+	if reason, ok := stems[volumeStem(objectName)]; ok {
+		return reason
+	}
+	if strings.HasPrefix(objectName, jobInfo.ObjectNamespace()+"objects/") {
+		return "content addressed volume no longer referenced by any manifest"
+	}
+	return "not referenced by any manifest, e.g. left by a failed upload or a pruned backup set"
+}
+
+// reportOrphans will output the orphaned objects found in the target.
+func reportOrphans(orphans []*OrphanedObject, target string) error {
+	if config.JSONOutput {
+		j, jerr := json.Marshal(orphans)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf("Found %d orphaned objects in %s:", len(orphans), target)}
+	for _, orphan := range orphans {
+		output = append(output, fmt.Sprintf("\t%s - %s", orphan.ObjectName, orphan.Reason))
+	}
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	return nil
+}
+
+// otherNamespaces returns the namespaces of other hosts found beneath the job's namespace, going by the manifests,
+// indexes, superseded generations and locks stored under them. A volume of this job whose dataset is named like one of
+// these may be mistaken for a namespace, which only keeps its orphans from being deleted.
+func otherNamespaces(jobInfo *files.JobInfo, objects []string) []string {
+	namespace := jobInfo.ObjectNamespace()
+	markers := []string{
+		"/" + strings.TrimPrefix(jobInfo.ManifestListPrefix(), namespace) + jobInfo.Separator,
+		"/" + strings.TrimPrefix(jobInfo.IndexListPrefix(), namespace),
+		"/" + strings.TrimPrefix(jobInfo.GenerationListPrefix(), namespace),
+		"/" + strings.TrimPrefix(jobInfo.LockListPrefix(), namespace),
+	}
+
+	found := make(map[string]bool)
+	for _, name := range objects {
+		relative := strings.TrimPrefix(name, namespace)
+		for _, marker := range markers {
+			// A namespace never holds the separator, unlike the names of this job's manifests and volumes
+			if idx := strings.Index(relative, marker); idx > 0 && !strings.Contains(relative[:idx], jobInfo.Separator) {
+				found[namespace+relative[:idx+1]] = true
+			}
+		}
+	}
+
+	namespaces := make([]string, 0, len(found))
+	for name := range found {
+		namespaces = append(namespaces, name)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// hasAnyPrefix returns true if the name starts with one of the prefixes.
+func hasAnyPrefix(name string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
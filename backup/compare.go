@@ -0,0 +1,347 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// Reasons reported for a Divergence.
+const (
+	DivergenceMissing          = "missing"
+	DivergenceSizeMismatch     = "size mismatch"
+	DivergenceChecksumMismatch = "checksum mismatch"
+)
+
+var errTargetsDiverged = errors.New("the targets provided have diverged")
+
+// Divergence describes an object that is missing from, or does not match the manifest in, a target.
+type Divergence struct {
+	Target     string
+	ObjectName string
+	IsManifest bool
+	Reason     string
+	Details    string `json:",omitempty"`
+}
+
+// UncheckedVolume is a volume found in a target whose content could not be checked against the manifest, because the
+// target reported no checksum for it, only its presence and, where the target reports it, its size were checked.
+type UncheckedVolume struct {
+	Target     string
+	ObjectName string
+}
+
+// CompareResult describes the divergences found between two targets, and the volumes whose content was not checked
+// and so cannot be said to match.
+type CompareResult struct {
+	Divergences []Divergence
+	Unchecked   []UncheckedVolume
+}
+
+// targetState holds the manifests and objects found in a target.
+type targetState struct {
+	uri       string
+	backend   backends.Backend
+	manifests map[string]*files.JobInfo // keyed by manifest object name
+	objects   map[string]bool
+}
+
+// Compare will cross-check the manifests, volume lists, sizes, and checksums between two targets
+// and report any divergence found. Targets do not report a checksum for every object, e.g. S3 for multipart or
+// SSE-KMS uploads, the content of such volumes is reported as unchecked unless deep is set, in which case every
+// volume is downloaded and its digest checked against the manifest's. An error is returned if the targets have
+// diverged.
+func Compare(pctx context.Context, jobInfo *files.JobInfo, targetA, targetB string, deep bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	states := make([]*targetState, 0, 2)
+	for _, target := range []string{targetA, targetB} {
+		backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+		if berr != nil {
+			log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+			return berr
+		}
+		defer backend.Close()
+
+		state, serr := loadTargetState(ctx, jobInfo, target, backend)
+		if serr != nil {
+			return serr
+		}
+		states = append(states, state)
+	}
+
+	result, err := compareTargetStates(ctx, deep, states[0], states[1])
+	if err != nil {
+		return err
+	}
+
+	if config.JSONOutput {
+		j, jerr := json.Marshal(result)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+	} else {
+		output := []string{fmt.Sprintf("Found %d divergences between %s and %s.", len(result.Divergences), targetA, targetB)}
+		for _, d := range result.Divergences {
+			line := fmt.Sprintf("\t%s: %s is %s", d.Target, d.ObjectName, d.Reason)
+			if d.Details != "" {
+				line += " (" + d.Details + ")"
+			}
+			output = append(output, line)
+		}
+		if len(result.Unchecked) > 0 {
+			output = append(output, fmt.Sprintf(
+				"The content of %d volumes was not checked, the targets reported no checksum for them, use --deep to download and check them:",
+				len(result.Unchecked),
+			))
+			for _, u := range result.Unchecked {
+				output = append(output, fmt.Sprintf("\t%s: %s", u.Target, u.ObjectName))
+			}
+		}
+		fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	}
+
+	if len(result.Divergences) > 0 {
+		return errTargetsDiverged
+	}
+	return nil
+}
+
+// loadTargetState will sync the manifests of the target and list all objects found in it.
+func loadTargetState(ctx context.Context, jobInfo *files.JobInfo, target string, backend backends.Backend) (*targetState, error) {
+	localCachePath, cerr := getCacheDir(jobInfo, target)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return nil, cerr
+	}
+
+	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	if serr != nil {
+		log.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return nil, serr
+	}
+
+	decodedManifests, derr := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if derr != nil {
+		return nil, derr
+	}
+
+	objects, lerr := backend.List(ctx, jobInfo.ObjectNamespace())
+	if lerr != nil {
+		log.AppLogger.Errorf("Could not list objects in target %s due to error - %v", target, lerr)
+		return nil, lerr
+	}
+
+	state := &targetState{
+		uri:       target,
+		backend:   backend,
+		manifests: make(map[string]*files.JobInfo, len(decodedManifests)),
+		objects:   make(map[string]bool, len(objects)),
+	}
+	for _, manifest := range decodedManifests {
+		manifest.ManifestPrefix = jobInfo.ManifestPrefix
+		manifest.ObjectPrefix = jobInfo.ObjectPrefix
+		manifest.CopyKeys(jobInfo)
+		state.manifests[manifest.ManifestObjectName()] = manifest
+	}
+	for _, obj := range objects {
+		state.objects[obj] = true
+	}
+
+	return state, nil
+}
+
+// compareTargetStates will verify that every manifest found in either target, and every volume they describe,
+// exists in both targets and matches the size and checksum recorded in the manifest where the target can report them,
+// or by downloading every volume when deep is set. Volumes whose content could not be checked are reported apart.
+// nolint:funlen,gocyclo // Difficult to break this up
+func compareTargetStates(ctx context.Context, deep bool, states ...*targetState) (CompareResult, error) {
+	allManifests := make(map[string]*files.JobInfo)
+	for _, state := range states {
+		for name, manifest := range state.manifests {
+			allManifests[name] = manifest
+		}
+	}
+
+	var (
+		result CompareResult
+		mutex  sync.Mutex
+	)
+	addDivergence := func(d Divergence) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		result.Divergences = append(result.Divergences, d)
+	}
+	addUnchecked := func(u UncheckedVolume) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		result.Unchecked = append(result.Unchecked, u)
+	}
+
+	var group *errgroup.Group
+	group, ctx = errgroup.WithContext(ctx)
+	// Let's not slam the endpoint with a lot of concurrent requests, pick a sensible default and stick to it
+	statBuffer := make(chan bool, 5)
+
+	for _, state := range states {
+		state := state
+		stater, canStat := state.backend.(backends.Stater)
+		for name, manifest := range allManifests {
+			if _, ok := state.manifests[name]; !ok {
+				addDivergence(Divergence{Target: state.uri, ObjectName: name, IsManifest: true, Reason: DivergenceMissing})
+			}
+
+			for _, vol := range manifest.Volumes {
+				vol := vol
+				if !state.objects[vol.ObjectName] {
+					addDivergence(Divergence{Target: state.uri, ObjectName: vol.ObjectName, Reason: DivergenceMissing})
+					continue
+				}
+				if !deep && !canStat {
+					addUnchecked(UncheckedVolume{Target: state.uri, ObjectName: vol.ObjectName})
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					return CompareResult{}, group.Wait()
+				case statBuffer <- true:
+				}
+				group.Go(func() error {
+					defer func() { <-statBuffer }()
+					var (
+						d       *Divergence
+						checked bool
+						err     error
+					)
+					if deep {
+						d, err = verifyVolumeContent(ctx, state.backend, vol)
+						checked = true
+					} else {
+						d, checked, err = verifyVolume(ctx, stater, vol)
+					}
+					if err != nil {
+						log.AppLogger.Errorf("Could not check %s in target %s due to error - %v", vol.ObjectName, state.uri, err)
+						return err
+					}
+					if d != nil {
+						d.Target = state.uri
+						addDivergence(*d)
+					} else if !checked {
+						addUnchecked(UncheckedVolume{Target: state.uri, ObjectName: vol.ObjectName})
+					}
+					return nil
+				})
+			}
+		}
+	}
+
+	if err := group.Wait(); err != nil {
+		return CompareResult{}, err
+	}
+
+	sort.SliceStable(result.Divergences, func(i, j int) bool {
+		if result.Divergences[i].Target != result.Divergences[j].Target {
+			return result.Divergences[i].Target < result.Divergences[j].Target
+		}
+		return result.Divergences[i].ObjectName < result.Divergences[j].ObjectName
+	})
+	sort.SliceStable(result.Unchecked, func(i, j int) bool {
+		if result.Unchecked[i].Target != result.Unchecked[j].Target {
+			return result.Unchecked[i].Target < result.Unchecked[j].Target
+		}
+		return result.Unchecked[i].ObjectName < result.Unchecked[j].ObjectName
+	})
+
+	return result, nil
+}
+
+// verifyVolume will compare the metadata reported by the target with what is recorded in the manifest, reporting
+// whether the content of the volume was checked, which it only is when both record an MD5 checksum.
+func verifyVolume(ctx context.Context, stater backends.Stater, vol *files.VolumeInfo) (*Divergence, bool, error) {
+	info, err := stater.Stat(ctx, vol.ObjectName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if uint64(info.Size) != vol.Size {
+		return &Divergence{
+			ObjectName: vol.ObjectName,
+			Reason:     DivergenceSizeMismatch,
+			Details:    fmt.Sprintf("expected %d bytes, found %d bytes", vol.Size, info.Size),
+		}, true, nil
+	}
+
+	if info.MD5Sum == "" || vol.MD5Sum == "" {
+		return nil, false, nil
+	}
+	if !strings.EqualFold(info.MD5Sum, vol.MD5Sum) {
+		return &Divergence{
+			ObjectName: vol.ObjectName,
+			Reason:     DivergenceChecksumMismatch,
+			Details:    fmt.Sprintf("expected MD5 %s, found %s", vol.MD5Sum, info.MD5Sum),
+		}, true, nil
+	}
+
+	return nil, true, nil
+}
+
+// verifyVolumeContent will download the volume and compare its size and digest with what is recorded in the manifest.
+func verifyVolumeContent(ctx context.Context, backend backends.Backend, vol *files.VolumeInfo) (*Divergence, error) {
+	size, sum, err := volumeDigest(ctx, backend, vol)
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(size) != vol.Size {
+		return &Divergence{
+			ObjectName: vol.ObjectName,
+			Reason:     DivergenceSizeMismatch,
+			Details:    fmt.Sprintf("expected %d bytes, found %d bytes", vol.Size, size),
+		}, nil
+	}
+
+	if sum != vol.Checksum() {
+		return &Divergence{
+			ObjectName: vol.ObjectName,
+			Reason:     DivergenceChecksumMismatch,
+			Details:    fmt.Sprintf("expected %s %s, found %s", vol.ChecksumAlgorithm(), vol.Checksum(), sum),
+		}, nil
+	}
+
+	return nil, nil
+}
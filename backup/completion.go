@@ -0,0 +1,124 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+)
+
+// completionDBTimeout is how long shell completion will wait on the manifest database before giving up on it.
+const completionDBTimeout = 500 * time.Millisecond
+
+// BackedUpVolumes returns the volumes, and the volume@snapshot names of their backup sets, found in the local
+// manifest cache of the job's namespace on the targets provided, or of every target cached in the working directory if
+// none are. Nothing is downloaded or decrypted: manifests already decoded into the manifest database are used along
+// with those cached unencrypted, so encrypted manifests only show up once they were read with the manifest database
+// enabled. It is meant for shell completion, so errors are ignored and whatever could be read is returned.
+func BackedUpVolumes(ctx context.Context, jobInfo *files.JobInfo, targets []string) []string {
+	var cacheDirs []string
+	if len(targets) == 0 {
+		entries, err := os.ReadDir(filepath.Join(config.WorkingDir, "cache"))
+		if err != nil {
+			return nil
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				cacheDirs = append(cacheDirs, filepath.Join(config.WorkingDir, "cache", entry.Name()))
+			}
+		}
+	} else {
+		for _, target := range targets {
+			cacheDirs = append(cacheDirs, cacheDirPath(jobInfo, target))
+		}
+	}
+
+	var db *bolt.DB
+	dbPath := filepath.Join(config.WorkingDir, manifestDBName)
+	if _, err := os.Stat(dbPath); err == nil {
+		if db, err = bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: true, Timeout: completionDBTimeout}); err == nil {
+			defer db.Close()
+		}
+	}
+
+	names := make(map[string]bool)
+	for _, cacheDir := range cacheDirs {
+		for _, manifest := range cachedVolumeManifests(ctx, db, cacheDir) {
+			names[manifest.VolumeName] = true
+			names[manifest.VolumeName+"@"+manifest.BaseSnapshot.Name] = true
+		}
+	}
+
+	volumes := make([]string, 0, len(names))
+	for name := range names {
+		volumes = append(volumes, name)
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// cachedVolumeManifests returns the manifests of the cache dir that can be read without any keys, taking them from
+// the manifest database when it holds them.
+func cachedVolumeManifests(ctx context.Context, db *bolt.DB, cacheDir string) []*files.JobInfo {
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		return nil
+	}
+
+	var cached map[string]*cachedManifest
+	if db != nil {
+		cached, _ = loadCachedManifests(db, []byte(filepath.Base(cacheDir)))
+	}
+
+	var manifests []*files.JobInfo
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), files.SignatureSuffix) {
+			continue
+		}
+		if c, ok := cached[entry.Name()]; ok {
+			manifests = append(manifests, c.Manifest)
+			continue
+		}
+		if manifest, err := decodeCachedManifest(ctx, filepath.Join(cacheDir, entry.Name())); err == nil {
+			manifests = append(manifests, manifest)
+		}
+	}
+	return manifests
+}
+
+// decodeCachedManifest decodes a cached manifest without verifying it, which only works for unencrypted manifests.
+func decodeCachedManifest(ctx context.Context, manifestPath string) (*files.JobInfo, error) {
+	manifestVol, err := files.ExtractLocal(ctx, &files.JobInfo{}, manifestPath, true)
+	if err != nil {
+		return nil, err
+	}
+	defer manifestVol.Close()
+	return files.DecodeManifest(manifestVol)
+}
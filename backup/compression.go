@@ -0,0 +1,94 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+const (
+	// incompressibleRatio is the compressed to zfs stream size ratio above which a volume is considered incompressible,
+	// e.g. zvols of encrypted guests or datasets of media files
+	incompressibleRatio = 0.95
+	// resampleInterval is how many volumes are stored without compression before compressing one again, in case the
+	// data became compressible
+	resampleInterval = 8
+)
+
+// compressionSampler tracks how well the volumes of a backup compress to stop compressing them when it only costs CPU.
+type compressionSampler struct {
+	enabled   bool
+	storeOnly bool
+	stored    int
+}
+
+func newCompressionSampler(j *files.JobInfo) *compressionSampler {
+	enabled := j.AdaptiveCompression && j.Compressor != "" && j.Compressor != files.ZfsCompressor
+	return &compressionSampler{enabled: enabled}
+}
+
+// nextStoreOnly returns true if the next volume should be stored without compression.
+func (s *compressionSampler) nextStoreOnly() bool {
+	if !s.enabled || !s.storeOnly {
+		return false
+	}
+	if s.stored >= resampleInterval {
+		s.stored = 0
+		return false
+	}
+	s.stored++
+	return true
+}
+
+// observe records the compression ratio of a finished volume. Volumes too small to tell, such as the last one of a
+// backup, are ignored.
+func (s *compressionSampler) observe(volume *files.VolumeInfo) {
+	if !s.enabled || volume.StoreOnly || volume.ZFSStreamBytes < files.BufferSize {
+		return
+	}
+	ratio := float64(volume.Size) / float64(volume.ZFSStreamBytes)
+	storeOnly := ratio >= incompressibleRatio
+	if storeOnly != s.storeOnly {
+		if storeOnly {
+			log.AppLogger.Infof(
+				"Volume %d only compressed to %.0f%% of its size, storing the following volumes without compression.",
+				volume.VolumeNumber, ratio*100,
+			)
+		} else {
+			log.AppLogger.Infof(
+				"Volume %d compressed to %.0f%% of its size, compressing the following volumes again.",
+				volume.VolumeNumber, ratio*100,
+			)
+		}
+	}
+	s.storeOnly = storeOnly
+}
+
+// volumeJob returns the job to name and write the volume with, which leaves the compressor out of store-only volumes.
+func volumeJob(j *files.JobInfo, storeOnly bool) *files.JobInfo {
+	if !storeOnly {
+		return j
+	}
+	stored := cloneJobInfo(j)
+	stored.Compressor = ""
+	return stored
+}
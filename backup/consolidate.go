@@ -0,0 +1,311 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/cenkalti/backoff"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// Consolidate will restore the incremental chain ending with the latest backup of the volume (or the snapshot
+// provided) into the scratch dataset and upload a new full backup of its snapshot from there, so restores and
+// future incremental backups no longer depend on the rest of the chain. The source host is never touched.
+// The backup sets of the old chain no other backup set depends on are deleted afterwards when prune is true.
+// nolint:funlen // Difficult to break this up
+func Consolidate(ctx context.Context, jobInfo *files.JobInfo, scratch string, prune, keepScratch bool) error {
+	target := jobInfo.Destinations[0]
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	head := consolidateHead(linkManifests(manifests)[jobInfo.VolumeName], jobInfo.BaseSnapshot.Name)
+	if head == nil {
+		log.AppLogger.Errorf("Could not find a backup of %s to consolidate in %s.", jobInfo.VolumeName, target)
+		return errors.New("could not find a backup to consolidate")
+	}
+	if length, _ := backupChain(head); length == 0 {
+		log.AppLogger.Noticef("The backup of %s@%s is already a full backup, nothing to consolidate.", head.VolumeName, head.BaseSnapshot.Name)
+		return nil
+	}
+
+	if _, derr := zfs.GetDatasets(ctx, scratch); derr == nil {
+		log.AppLogger.Errorf("The scratch dataset %s already exists, provide a dataset that does not exist yet.", scratch)
+		return fmt.Errorf("scratch dataset %s already exists", scratch)
+	}
+
+	// Restore the chain into the scratch dataset
+	restoreJob := cloneJobInfo(jobInfo)
+	restoreJob.Destinations = []string{target}
+	restoreJob.LocalVolume = scratch
+	restoreJob.BaseSnapshot = head.BaseSnapshot
+	restoreJob.IncrementalSnapshot = files.SnapshotInfo{}
+	restoreJob.NotMounted = true
+	log.AppLogger.Noticef("Restoring %s@%s into the scratch dataset %s.", head.VolumeName, head.BaseSnapshot.Name, scratch)
+	if err = AutoRestore(ctx, restoreJob); err != nil {
+		log.AppLogger.Errorf("Could not restore the backup chain into %s - %v", scratch, err)
+		return err
+	}
+	if !keepScratch {
+		defer func() {
+			log.AppLogger.Infof("Destroying the scratch dataset %s.", scratch)
+			if derr := zfs.DestroyDataset(context.Background(), scratch); derr != nil {
+				log.AppLogger.Warningf("Could not destroy the scratch dataset %s - %v", scratch, derr)
+			}
+		}()
+	}
+
+	// Upload a full backup of the head snapshot, sent the same way as the backup it replaces
+	sendJob := cloneJobInfo(jobInfo)
+	sendJob.Destinations = []string{target}
+	sendJob.LocalVolume = scratch
+	sendJob.StartTime = time.Now()
+	sendJob.Version = config.VersionNumber
+	sendJob.SchemaVersion = files.ManifestSchemaVersion
+	sendJob.BaseSnapshot = head.BaseSnapshot
+	sendJob.IncrementalSnapshot = files.SnapshotInfo{}
+	sendJob.IntermediaryIncremental = false
+	sendJob.Raw = head.Raw
+	sendJob.Compressed = head.Compressed
+	sendJob.LargeBlocks = head.LargeBlocks
+	sendJob.EmbeddedData = head.EmbeddedData
+	sendJob.Properties = head.Properties
+	sendJob.StreamCompression = head.StreamCompression
+	sendJob.Compressor = head.Compressor
+	sendJob.Decompressor = head.Decompressor
+	sendJob.ZstdWindowLog = head.ZstdWindowLog
+	sendJob.ZstdDictionary = head.ZstdDictionary
+	sendJob.CompressionLevel = head.CompressionLevel
+	sendJob.Separator = head.Separator
+	sendJob.RecursiveRoot = head.RecursiveRoot
+	sendJob.Include = head.Include
+	sendJob.Exclude = head.Exclude
+	sendJob.ContentAddressed = head.ContentAddressed
+	sendJob.AdaptiveCompression = head.AdaptiveCompression
+	sendJob.Tags = head.Tags
+	sendJob.LocalProperties = head.LocalProperties
+	sendJob.SnapshotGUID = head.SnapshotGUID
+	sendJob.DatasetGUID = head.DatasetGUID
+	sendJob.Hostname = head.Hostname
+	sendJob.PoolName = head.PoolName
+	sendJob.PoolGUID = head.PoolGUID
+	sendJob.ManifestEncoding = head.ManifestEncoding
+	sendJob.DigestAlgorithm = head.DigestAlgorithm
+	log.AppLogger.Noticef("Uploading a full backup of %s@%s.", head.VolumeName, head.BaseSnapshot.Name)
+	if err = Backup(ctx, sendJob); err != nil {
+		log.AppLogger.Errorf("Could not upload the consolidated backup - %v", err)
+		return err
+	}
+
+	if prune {
+		// The backup above held the lock of the volume until it completed
+		locks, lerr := lockVolumes(ctx, jobInfo, target, []*files.JobInfo{head})
+		if lerr != nil {
+			return lerr
+		}
+		defer locks.release()
+		return pruneChain(ctx, jobInfo, target, head)
+	}
+	return nil
+}
+
+// consolidateHead returns the backup of the snapshot provided, or of the latest snapshot backed up if no snapshot
+// is provided, preferring a full backup when the snapshot was backed up more than once.
+func consolidateHead(volumeSnaps []*files.JobInfo, snapshot string) *files.JobInfo {
+	if snapshot == "" && len(volumeSnaps) > 0 {
+		snapshot = volumeSnaps[len(volumeSnaps)-1].BaseSnapshot.Name
+	}
+	var head *files.JobInfo
+	for _, job := range volumeSnaps {
+		if job.BaseSnapshot.Name == snapshot && (head == nil || job.IncrementalSnapshot.Name == "") {
+			head = job
+		}
+	}
+	return head
+}
+
+// prunableChain returns the backup sets in the chain ending with the head provided that none of the other
+// backup sets provided depend on, along with the volumes only those backup sets reference.
+func prunableChain(head *files.JobInfo, manifests []*files.JobInfo) (prunable []*files.JobInfo, volumes []string) {
+	inChain := make(map[*files.JobInfo]bool)
+	for job := head; job != nil; job = job.ParentSnap {
+		inChain[job] = true
+	}
+
+	needed := make(map[*files.JobInfo]bool)
+	referenced := make(map[string]bool)
+	for _, manifest := range manifests {
+		if inChain[manifest] {
+			continue
+		}
+		for job := manifest; job != nil; job = job.ParentSnap {
+			needed[job] = true
+			for _, vol := range job.Volumes {
+				referenced[vol.ObjectName] = true
+			}
+		}
+	}
+
+	for job := head; job != nil; job = job.ParentSnap {
+		if needed[job] {
+			continue
+		}
+		prunable = append(prunable, job)
+		for _, vol := range job.Volumes {
+			if !referenced[vol.ObjectName] {
+				referenced[vol.ObjectName] = true
+				volumes = append(volumes, vol.ObjectName)
+			}
+		}
+	}
+	return prunable, volumes
+}
+
+// pruneChain will delete the backup sets of the old chain ending with the head provided that no other backup set
+// depends on, manifests first so a partially deleted backup set is never visible in the target. The manifests are
+// read again so backup sets taken after the head are linked to the new full backup instead of the old chain.
+func pruneChain(ctx context.Context, jobInfo *files.JobInfo, target string, head *files.JobInfo) error {
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+	linkManifests(manifests)
+
+	var oldHead *files.JobInfo
+	for _, manifest := range manifests {
+		if manifest.VolumeName == head.VolumeName && manifest.BaseSnapshot.Equal(&head.BaseSnapshot) &&
+			manifest.IncrementalSnapshot.Equal(&head.IncrementalSnapshot) {
+			oldHead = manifest
+			break
+		}
+	}
+	if oldHead == nil {
+		log.AppLogger.Errorf("Could not find the backup set of %s@%s to prune in %s.", head.VolumeName, head.BaseSnapshot.Name, target)
+		return errors.New("could not find the backup set to prune")
+	}
+
+	prunable, volumes := prunableChain(oldHead, manifests)
+	if len(prunable) == 0 {
+		log.AppLogger.Noticef("Every backup set in the old chain is still needed by another backup set, nothing to prune.")
+		return nil
+	}
+
+	if err = deleteBackupSets(ctx, jobInfo, target, prunable, volumes, manifests); err != nil {
+		return err
+	}
+	log.AppLogger.Noticef("Pruned %d backup sets (%d volumes) from %s.", len(prunable), len(volumes), target)
+	return nil
+}
+
+// deleteBackupSets will delete the manifests of the backup sets provided, along with their detached signatures and
+// superseded generations, then the volumes provided, so a partially deleted backup set is never visible in the target.
+// The index of every volume whose backup sets were deleted is deleted as well, the next send rebuilds it.
+// With the HoldTag option, the hold is released from the local snapshot of each backup set deleted no remaining backup
+// set in the manifests provided needs.
+func deleteBackupSets(
+	ctx context.Context, jobInfo *files.JobInfo, target string, backupSets []*files.JobInfo, volumes []string, manifests []*files.JobInfo,
+) error {
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	localCachePath, cerr := getCacheDir(jobInfo, target)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	indexes := make(map[string]*files.JobInfo)
+	for _, job := range backupSets {
+		manifestName := job.ManifestObjectName()
+		log.AppLogger.Noticef("Pruning the backup set %s.", manifestName)
+		if err := deleteObject(ctx, backend, manifestName); err != nil {
+			return err
+		}
+		deleteSignature(ctx, backend, manifestName)
+		if superseded, err := backend.List(ctx, job.ManifestGenerationPrefix(manifestName)); err != nil {
+			log.AppLogger.Warningf("Could not list the superseded generations of %s - %v", manifestName, err)
+		} else {
+			for _, name := range superseded {
+				if err = deleteObject(ctx, backend, name); err != nil {
+					return err
+				}
+			}
+		}
+		// nolint:gosec // MD5 not used for cryptographic purposes here
+		manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(manifestName))))
+		if err := os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+			log.AppLogger.Warningf("Could not delete local manifest %s due to error - %v.", manifestPath, err)
+		}
+		indexes[job.VolumeName] = job
+	}
+
+	for _, volume := range volumes {
+		if err := deleteObject(ctx, backend, volume); err != nil {
+			return err
+		}
+	}
+
+	// The index would still list the pruned backup sets, the next send rebuilds it
+	for volumeName, job := range indexes {
+		if err := deleteDatasetIndex(ctx, job, backend); err != nil {
+			log.AppLogger.Warningf("Could not delete the index of %s due to error - %v.", volumeName, err)
+		}
+	}
+
+	if jobInfo.HoldTag != "" {
+		releasePrunedHolds(ctx, jobInfo.HoldTag, backupSets, manifests)
+	}
+	return nil
+}
+
+func deleteObject(ctx context.Context, backend backends.Backend, objectPath string) error {
+	be := backoff.NewExponentialBackOff()
+	be.MaxInterval = time.Minute
+	be.MaxElapsedTime = 10 * time.Minute
+	retryconf := backoff.WithContext(be, ctx)
+
+	operation := func() error {
+		return backend.Delete(ctx, objectPath)
+	}
+	if err := backoff.Retry(operation, retryconf); err != nil {
+		log.AppLogger.Errorf("Could not delete object %s due to error - %v", objectPath, err)
+		return err
+	}
+	log.AppLogger.Debugf("Deleted %s.", objectPath)
+	return nil
+}
@@ -0,0 +1,256 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cenkalti/backoff"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var errBackupSetNotFound = errors.New("could not find the requested backup set")
+
+// Copy will copy the backup set described by the jobInfo from the source target to the destination target.
+// A server-side copy is used when both targets are serviced by the same provider, otherwise each object is
+// streamed through a local temporary file. The manifest is copied last so a partially copied backup set is
+// never visible in the destination.
+// nolint:funlen // Difficult to break this up
+func Copy(pctx context.Context, jobInfo *files.JobInfo, source, destination string) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the source backend client
+	srcBackend, berr := prepareBackend(ctx, jobInfo, source, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", source, berr)
+		return berr
+	}
+	defer srcBackend.Close()
+
+	manifest, merr := findBackupSet(ctx, jobInfo, source, srcBackend)
+	if merr != nil {
+		return merr
+	}
+
+	// Prepare the destination backend client
+	uploadBuffer := make(chan bool, jobInfo.MaxParallelUploads)
+	defer close(uploadBuffer)
+	dstBackend, berr := prepareBackend(ctx, jobInfo, destination, uploadBuffer)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", destination, berr)
+		return berr
+	}
+	defer dstBackend.Close()
+
+	objects := make([]string, 0, len(manifest.Volumes))
+	for _, vol := range manifest.Volumes {
+		objects = append(objects, vol.ObjectName)
+	}
+	manifestObjectName := manifest.ManifestObjectName()
+
+	if err := srcBackend.PreDownload(ctx, append(objects, manifestObjectName)); err != nil {
+		log.AppLogger.Errorf("Error trying to pre download backup set volumes - %v", err)
+		return err
+	}
+
+	log.AppLogger.Noticef("Copying %d volumes from %s to %s.", len(objects), source, destination)
+
+	if err := copyObjects(ctx, jobInfo, srcBackend, dstBackend, objects); err != nil {
+		log.AppLogger.Errorf("Could not finish copy operation due to error, aborting: %v", err)
+		return err
+	}
+
+	if err := retryCopyObject(ctx, jobInfo, srcBackend, dstBackend, manifestObjectName); err != nil {
+		log.AppLogger.Errorf("Could not copy manifest due to error, aborting: %v", err)
+		return err
+	}
+
+	if signed, err := objectExists(ctx, srcBackend, manifestObjectName+files.SignatureSuffix); err != nil {
+		return err
+	} else if signed {
+		if err = retryCopyObject(ctx, jobInfo, srcBackend, dstBackend, manifestObjectName+files.SignatureSuffix); err != nil {
+			log.AppLogger.Errorf("Could not copy the manifest signature due to error, aborting: %v", err)
+			return err
+		}
+	}
+
+	log.AppLogger.Noticef("Done.")
+	return nil
+}
+
+// findBackupSet will sync the manifests found in the target and return the one matching the volume,
+// snapshot, and (optionally) incremental snapshot provided in the jobInfo, linked to the backup set it is
+// incremental from.
+func findBackupSet(ctx context.Context, jobInfo *files.JobInfo, target string, backend backends.Backend) (*files.JobInfo, error) {
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(jobInfo, target)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return nil, cerr
+	}
+
+	// Sync the local cache
+	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	if serr != nil {
+		log.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return nil, serr
+	}
+
+	decodedManifests, derr := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if derr != nil {
+		return nil, derr
+	}
+	linkManifests(decodedManifests)
+
+	for _, manifest := range decodedManifests {
+		if manifest.VolumeName != jobInfo.VolumeName || manifest.BaseSnapshot.Name != jobInfo.BaseSnapshot.Name {
+			continue
+		}
+		if jobInfo.IncrementalSnapshot.Name != "" && manifest.IncrementalSnapshot.Name != jobInfo.IncrementalSnapshot.Name {
+			continue
+		}
+
+		manifest.ManifestPrefix = jobInfo.ManifestPrefix
+		manifest.ObjectPrefix = jobInfo.ObjectPrefix
+		manifest.CopyKeys(jobInfo)
+		return manifest, nil
+	}
+
+	log.AppLogger.Errorf(
+		"Could not find the snapshot %v for volume %s in target %s.",
+		jobInfo.BaseSnapshot.Name, jobInfo.VolumeName, target,
+	)
+	return nil, errBackupSetNotFound
+}
+
+// copyObjects will copy the objects provided between backends using up to MaxParallelUploads workers.
+func copyObjects(ctx context.Context, j *files.JobInfo, source, destination backends.Backend, objects []string) error {
+	var group *errgroup.Group
+	group, ctx = errgroup.WithContext(ctx)
+
+	copyChan := make(chan string, len(objects))
+	for _, obj := range objects {
+		copyChan <- obj
+	}
+	close(copyChan)
+
+	for i := 0; i < j.MaxParallelUploads; i++ {
+		group.Go(func() error {
+			for {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case objectName, ok := <-copyChan:
+					if !ok {
+						return nil
+					}
+
+					if err := retryCopyObject(ctx, j, source, destination, objectName); err != nil {
+						return err
+					}
+				}
+			}
+		})
+	}
+
+	return group.Wait()
+}
+
+func retryCopyObject(ctx context.Context, j *files.JobInfo, source, destination backends.Backend, objectName string) error {
+	be := backoff.NewExponentialBackOff()
+	be.MaxInterval = j.MaxBackoffTime
+	be.MaxElapsedTime = j.MaxRetryTime
+	retryconf := backoff.WithContext(be, ctx)
+
+	operation := func() error {
+		oerr := copyObject(ctx, source, destination, objectName)
+		if oerr != nil {
+			log.AppLogger.Warningf("error trying to copy file %s - %v", objectName, oerr)
+		}
+		return oerr
+	}
+
+	log.AppLogger.Debugf("Copying volume %s.", objectName)
+
+	if berr := backoff.Retry(operation, retryconf); berr != nil {
+		log.AppLogger.Errorf("Failed to copy volume %s due to error: %v, aborting...", objectName, berr)
+		return berr
+	}
+
+	log.AppLogger.Infof("Copied volume %s.", objectName)
+	return nil
+}
+
+// copyObject copies a single object between backends, preferring a server-side copy when available.
+func copyObject(ctx context.Context, source, destination backends.Backend, objectName string) error {
+	if copier, ok := destination.(backends.ServerSideCopier); ok {
+		err := copier.CopyFrom(ctx, source, objectName)
+		if err != backends.ErrUnsupported {
+			return err
+		}
+		log.AppLogger.Debugf("Server-side copy not available for %s, streaming it instead.", objectName)
+	}
+	return streamObject(ctx, source, destination, objectName, objectName)
+}
+
+// streamObject downloads the object named objectName from the source and uploads it to the destination as toName.
+func streamObject(ctx context.Context, source, destination backends.Backend, objectName, toName string) error {
+	r, rerr := source.Download(ctx, objectName)
+	if rerr != nil {
+		return rerr
+	}
+	defer r.Close()
+	r = limitDownload(r)
+
+	vol, err := files.CreateSimpleVolume(ctx, false)
+	if err != nil {
+		return fmt.Errorf("could not create temporary file to copy %s due to error - %v", objectName, err)
+	}
+	defer func() {
+		if derr := vol.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete temporary file for %s due to error - %v", objectName, derr)
+		}
+	}()
+
+	vol.ObjectName = toName
+	if _, err = io.Copy(vol, r); err != nil {
+		_ = vol.Close()
+		return err
+	}
+	if err = vol.Close(); err != nil {
+		return err
+	}
+
+	if err = vol.OpenVolume(); err != nil {
+		return err
+	}
+	defer vol.Close()
+
+	return destination.Upload(ctx, vol)
+}
@@ -0,0 +1,146 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/kms"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// getKeyService is replaced in tests so no key management service is needed.
+var getKeyService = kms.GetKeyService
+
+// prepareDataKey generates the data key the volumes of the backup are encrypted with, and wraps it with each key
+// management service key provided so only the wrapped keys have to be stored in the manifest. A resumed backup keeps
+// the data key the volumes already uploaded were encrypted with.
+func prepareDataKey(ctx context.Context, j *files.JobInfo) error {
+	if len(j.KMSKeys) == 0 {
+		return nil
+	}
+
+	if len(j.WrappedKeys) > 0 {
+		identity, err := unwrapDataKey(ctx, j.WrappedKeys, "")
+		if err != nil {
+			return err
+		}
+		j.AgeRecipientKeys = []age.Recipient{identity.Recipient()}
+		return nil
+	}
+
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	wrapped := make([]files.WrappedKey, 0, len(j.KMSKeys))
+	for _, uri := range j.KMSKeys {
+		service, serr := getKeyService(ctx, uri)
+		if serr != nil {
+			log.AppLogger.Errorf("Could not use the key management service key %s - %v", uri, serr)
+			return serr
+		}
+		ciphertext, werr := service.Wrap(ctx, []byte(identity.String()))
+		if werr != nil {
+			log.AppLogger.Errorf("Could not wrap the data key with %s - %v", uri, werr)
+			return werr
+		}
+		wrapped = append(wrapped, files.WrappedKey{KeyURI: uri, Ciphertext: ciphertext})
+	}
+	log.AppLogger.Infof("Will be encrypting %s with a data key wrapped by %s", j.VolumeName, strings.Join(j.KMSKeys, ", "))
+
+	j.WrappedKeys = wrapped
+	j.AgeRecipientKeys = []age.Recipient{identity.Recipient()}
+	return nil
+}
+
+// unwrapDataKey returns the data key unwrapped by the first key management service key that can, trying the keys
+// held by the same provider as the target first.
+func unwrapDataKey(ctx context.Context, wrapped []files.WrappedKey, target string) (*age.X25519Identity, error) {
+	preferred := keyServiceForTarget(target)
+	ordered := make([]files.WrappedKey, 0, len(wrapped))
+	for _, key := range wrapped {
+		if preferred != "" && strings.HasPrefix(key.KeyURI, preferred+"://") {
+			ordered = append(ordered, key)
+		}
+	}
+	for _, key := range wrapped {
+		if preferred == "" || !strings.HasPrefix(key.KeyURI, preferred+"://") {
+			ordered = append(ordered, key)
+		}
+	}
+
+	var err error
+	for _, key := range ordered {
+		var service kms.KeyService
+		if service, err = getKeyService(ctx, key.KeyURI); err == nil {
+			var plaintext []byte
+			if plaintext, err = service.Unwrap(ctx, key.Ciphertext); err == nil {
+				return age.ParseX25519Identity(string(plaintext))
+			}
+		}
+		log.AppLogger.Warningf("Could not unwrap the data key with %s - %v", key.KeyURI, err)
+	}
+	return nil, fmt.Errorf("could not unwrap the data key with any of the %d key(s) it was wrapped with", len(wrapped))
+}
+
+// extractManifest opens the manifest (or index) cached at manifestPath for reading, unwrapping the data key of its
+// backup when it is encrypted with one. The data key is returned too so the manifest can be encrypted with it again.
+func extractManifest(
+	ctx context.Context, j *files.JobInfo, manifestPath string,
+) (*files.VolumeInfo, *age.X25519Identity, error) {
+	vol, err := files.ExtractLocal(ctx, j, manifestPath, true)
+	var encrypted *files.EncryptedManifestError
+	if !errors.As(err, &encrypted) {
+		return vol, nil, err
+	}
+	_ = vol.Close()
+
+	identity, err := unwrapDataKey(ctx, encrypted.WrappedKeys, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	vol, err = files.ExtractLocal(ctx, &files.JobInfo{AgeIdentities: []age.Identity{identity}}, manifestPath, true)
+	return vol, identity, err
+}
+
+// keyServiceForTarget returns the prefix of the key management service run by the provider of the target, or an
+// empty string if it has none.
+func keyServiceForTarget(target string) string {
+	switch strings.SplitN(target, "://", 2)[0] {
+	case backends.AWSS3BackendPrefix:
+		return kms.AWSKMSPrefix
+	case backends.GoogleCloudStorageBackendPrefix:
+		return kms.GCPKMSPrefix
+	case backends.AzureBackendPrefix:
+		return kms.AzureKeyVaultPrefix
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// BackupDatasets will backup each of the datasets provided, given as volume@snapshot or just the
+// volume when using a smart option, using the rest of the configuration in jobInfo. Glob patterns
+// in the volume names are expanded, and at most parallel backups are run at once while sharing
+// the same limit on parallel uploads.
+// nolint:funlen,gocyclo // Difficult to break this up
+func BackupDatasets(ctx context.Context, jobInfo *files.JobInfo, datasets []string, parallel int) error {
+	expanded, err := expandDatasets(ctx, datasets)
+	if err != nil {
+		log.AppLogger.Errorf("Could not expand the datasets provided - %v", err)
+		return err
+	}
+	if len(expanded) == 0 {
+		return fmt.Errorf("no datasets found matching %s", strings.Join(datasets, ", "))
+	}
+
+	if running := len(expanded); parallel > 1 && running > 1 {
+		if running > parallel {
+			running = parallel
+		}
+		if err := checkScratchSpace(ctx, jobInfo, running); err != nil {
+			return err
+		}
+	}
+
+	smart := jobInfo.Full || jobInfo.Incremental || jobInfo.FullIfOlderThan != -1*time.Minute || jobInfo.Differential
+	uploadBuffer := make(chan bool, jobInfo.MaxParallelUploads)
+	defer close(uploadBuffer)
+
+	var (
+		group  errgroup.Group
+		mtx    sync.Mutex
+		failed []string
+	)
+	workers := make(chan struct{}, parallel)
+	for _, dataset := range expanded {
+		dataset := dataset
+		workers <- struct{}{}
+		group.Go(func() error {
+			defer func() { <-workers }()
+
+			child := cloneJobInfo(jobInfo)
+			parts := strings.SplitN(dataset, "@", 2)
+			child.VolumeName = parts[0]
+			child.LocalVolume = ""
+			if len(parts) == 2 {
+				child.BaseSnapshot = files.SnapshotInfo{Name: parts[1]}
+			}
+			child.ApplyDatasetKeys()
+			child.ApplyDatasetCompression()
+
+			log.AppLogger.Noticef("Backing up %s.", child.VolumeName)
+			if berr := backupDataset(ctx, child, smart, uploadBuffer); berr == ErrNoOp {
+				log.AppLogger.Noticef("Nothing new to backup for %s, skipping.", child.VolumeName)
+			} else if berr != nil {
+				log.AppLogger.Errorf("Failed to backup %s - %v", child.VolumeName, berr)
+				mtx.Lock()
+				failed = append(failed, child.VolumeName)
+				mtx.Unlock()
+			}
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not backup %d dataset(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// backupDataset resolves the snapshots to use for a single dataset before backing it up.
+func backupDataset(ctx context.Context, child *files.JobInfo, smart bool, uploadBuffer chan bool) error {
+	if child.SnapshotBefore != "" {
+		if err := SnapshotBefore(ctx, child); err != nil {
+			return err
+		}
+	}
+
+	if child.Recursive {
+		if !smart {
+			if err := resolveSnapshots(ctx, child); err != nil {
+				return err
+			}
+		}
+		return backupRecursive(ctx, child, uploadBuffer)
+	}
+
+	if smart {
+		if err := ProcessSmartOptions(ctx, child); err != nil {
+			return err
+		}
+	} else if err := resolveSnapshots(ctx, child); err != nil {
+		return err
+	}
+
+	return runBackup(ctx, child, uploadBuffer)
+}
+
+// resolveSnapshots will lookup the creation time of the snapshots selected for the job.
+func resolveSnapshots(ctx context.Context, j *files.JobInfo) error {
+	volume := zfs.GetLocalVolumeName(j)
+	creationTime, err := zfs.GetCreationDate(ctx, fmt.Sprintf("%s@%s", volume, j.BaseSnapshot.Name))
+	if err != nil {
+		return fmt.Errorf("could not get the creation date of the base snapshot - %v", err)
+	}
+	j.BaseSnapshot.CreationTime = creationTime
+
+	if j.IncrementalSnapshot.Name == "" {
+		return nil
+	}
+
+	targetName := fmt.Sprintf("%s@%s", volume, j.IncrementalSnapshot.Name)
+	if j.IncrementalSnapshot.Bookmark {
+		targetName = fmt.Sprintf("%s#%s", volume, j.IncrementalSnapshot.Name)
+	}
+	creationTime, err = zfs.GetCreationDate(ctx, targetName)
+	if err != nil {
+		return fmt.Errorf("could not get the creation date of the incremental snapshot/bookmark - %v", err)
+	}
+	j.IncrementalSnapshot.CreationTime = creationTime
+	return nil
+}
+
+// expandDatasets will replace any dataset whose volume name contains a glob pattern with the
+// matching filesystems and volumes, keeping any snapshot given.
+func expandDatasets(ctx context.Context, datasets []string) ([]string, error) {
+	var expanded []string
+	for _, dataset := range datasets {
+		parts := strings.SplitN(dataset, "@", 2)
+		if !strings.ContainsAny(parts[0], "*?[") {
+			expanded = append(expanded, dataset)
+			continue
+		}
+
+		candidates, err := zfs.GetDatasets(ctx, globRoot(parts[0]))
+		if err != nil {
+			return nil, err
+		}
+		for _, candidate := range candidates {
+			matched, merr := path.Match(parts[0], candidate)
+			if merr != nil {
+				return nil, merr
+			}
+			if !matched {
+				continue
+			}
+			if len(parts) == 2 {
+				candidate = fmt.Sprintf("%s@%s", candidate, parts[1])
+			}
+			expanded = append(expanded, candidate)
+		}
+	}
+	return expanded, nil
+}
+
+// globRoot returns the deepest dataset that is a parent of every dataset the pattern can match.
+func globRoot(pattern string) string {
+	components := strings.Split(pattern, "/")
+	for idx, component := range components {
+		if strings.ContainsAny(component, "*?[") {
+			return strings.Join(components[:idx], "/")
+		}
+	}
+	return pattern
+}
@@ -0,0 +1,305 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// The changes reported by Diff, as reported by zfs diff.
+const (
+	DiffAdded    = "+"
+	DiffRemoved  = "-"
+	DiffModified = "M"
+	DiffRenamed  = "R"
+)
+
+// DiffEntry is a file changed between two backed up snapshots, with its path relative to the root of the filesystem.
+// NewPath is only set for renamed files.
+type DiffEntry struct {
+	Change  string
+	Path    string
+	NewPath string `json:",omitempty"`
+}
+
+// Diff will restore the backups of the two snapshots provided (volume@snapshot) into temporary datasets under the
+// scratch dataset and report the files changed between them, in the format of zfs diff. When the first snapshot is
+// restored along with the second, as part of its incremental chain, zfs diff is used. Otherwise both snapshots are
+// restored and their files compared, in which case renamed files are reported as removed and added. The temporary
+// datasets are destroyed afterwards.
+func Diff(ctx context.Context, jobInfo *files.JobInfo, from, to, scratch string) error {
+	if _, err := zfs.GetDatasets(ctx, scratch); err != nil {
+		log.AppLogger.Errorf("Could not find the scratch dataset %s - %v", scratch, err)
+		return err
+	}
+
+	prefix := fmt.Sprintf("%s/zfsbackup_diff_%s", scratch, time.Now().Format("20060102150405"))
+	var datasets, mountpoints []string
+	defer func() {
+		for _, dataset := range datasets {
+			if _, err := zfs.GetDatasets(context.Background(), dataset); err != nil {
+				continue
+			}
+			if err := zfs.DestroyDataset(context.Background(), dataset); err != nil {
+				log.AppLogger.Warningf("Could not destroy the temporary dataset %s - %v", dataset, err)
+			}
+		}
+		for _, mountpoint := range mountpoints {
+			os.Remove(mountpoint)
+		}
+	}()
+
+	restoreDiffSnapshot := func(snapshot, dataset string) (string, error) {
+		datasets = append(datasets, dataset)
+		if err := restoreForDiff(ctx, jobInfo, snapshot, dataset); err != nil {
+			log.AppLogger.Errorf("Could not restore %s into %s - %v", snapshot, dataset, err)
+			return "", err
+		}
+		mountpoint, err := mountForDiff(ctx, dataset)
+		if mountpoint != "" {
+			mountpoints = append(mountpoints, mountpoint)
+		}
+		return mountpoint, err
+	}
+
+	toDataset := prefix + "_to"
+	toRoot, err := restoreDiffSnapshot(to, toDataset)
+	if err != nil {
+		return err
+	}
+
+	var entries []DiffEntry
+	fromParts, toParts := strings.SplitN(from, "@", 2), strings.SplitN(to, "@", 2)
+	if fromParts[0] == toParts[0] && hasSnapshot(ctx, toDataset, fromParts[1]) {
+		log.AppLogger.Infof("%s was restored along with %s, comparing them with zfs diff.", from, to)
+		lines, derr := zfs.Diff(ctx, toDataset+"@"+fromParts[1], toDataset+"@"+toParts[1])
+		if derr != nil {
+			log.AppLogger.Errorf("Could not diff %s and %s - %v", from, to, derr)
+			return derr
+		}
+		entries = parseZFSDiff(lines, toRoot)
+	} else {
+		log.AppLogger.Infof("%s is not part of the incremental chain of %s, restoring it to compare their files.", from, to)
+		fromRoot, rerr := restoreDiffSnapshot(from, prefix+"_from")
+		if rerr != nil {
+			return rerr
+		}
+		if entries, err = compareTrees(fromRoot, toRoot); err != nil {
+			log.AppLogger.Errorf("Could not compare the files of %s and %s - %v", from, to, err)
+			return err
+		}
+	}
+
+	return printDiff(entries)
+}
+
+// restoreForDiff will restore the snapshot provided (volume@snapshot), along with its incremental chain, into the
+// dataset provided without mounting it.
+func restoreForDiff(ctx context.Context, jobInfo *files.JobInfo, snapshot, dataset string) error {
+	parts := strings.SplitN(snapshot, "@", 2)
+	restoreJob := cloneJobInfo(jobInfo)
+	restoreJob.VolumeName = parts[0]
+	restoreJob.BaseSnapshot = files.SnapshotInfo{Name: parts[1]}
+	restoreJob.LocalVolume = dataset
+	restoreJob.AutoRestore = true
+	restoreJob.NotMounted = true
+	log.AppLogger.Noticef("Restoring %s into the temporary dataset %s.", snapshot, dataset)
+	return AutoRestore(ctx, restoreJob)
+}
+
+// mountForDiff will mount the filesystem restored, read only, at a new temporary directory and return it.
+func mountForDiff(ctx context.Context, dataset string) (string, error) {
+	if datasetType, err := zfs.GetZFSProperty(ctx, "type", dataset); err != nil {
+		return "", err
+	} else if datasetType != "filesystem" {
+		log.AppLogger.Errorf("%s is a %s, only the files of filesystems can be compared.", dataset, datasetType)
+		return "", fmt.Errorf("cannot compare the files of %s", dataset)
+	}
+
+	mountpoint, err := os.MkdirTemp("", "zfsbackup-diff-")
+	if err != nil {
+		log.AppLogger.Errorf("Could not create a temporary mountpoint - %v", err)
+		return "", err
+	}
+	for _, prop := range [][2]string{{"readonly", "on"}, {"mountpoint", mountpoint}} {
+		if err = zfs.SetZFSProperty(ctx, prop[0], prop[1], dataset); err != nil {
+			log.AppLogger.Errorf("Could not set %s on %s - %v", prop[0], dataset, err)
+			return mountpoint, err
+		}
+	}
+	if mounted, _ := zfs.GetZFSProperty(ctx, "mounted", dataset); mounted != "yes" {
+		if err = zfs.MountDataset(ctx, dataset); err != nil {
+			log.AppLogger.Errorf("Could not mount %s, an encrypted restore needs its key loaded first - %v", dataset, err)
+			return mountpoint, err
+		}
+	}
+	return mountpoint, nil
+}
+
+// hasSnapshot reports whether the dataset has a snapshot with the name provided.
+func hasSnapshot(ctx context.Context, dataset, name string) bool {
+	snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, dataset)
+	if err != nil {
+		return false
+	}
+	for i := range snapshots {
+		if !snapshots[i].Bookmark && snapshots[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// parseZFSDiff reads the lines output by zfs diff -H, making the paths relative to the mountpoint of the filesystem.
+func parseZFSDiff(lines []string, mountpoint string) []DiffEntry {
+	relative := func(path string) string {
+		if rel := strings.TrimPrefix(path, strings.TrimSuffix(mountpoint, "/")); rel != "" {
+			return rel
+		}
+		return "/"
+	}
+
+	entries := make([]DiffEntry, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		entry := DiffEntry{Change: fields[0], Path: relative(fields[1])}
+		if len(fields) > 2 {
+			entry.NewPath = relative(fields[2])
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// treeEntry is the state of a file compared by compareTrees.
+type treeEntry struct {
+	mode    fs.FileMode
+	size    int64
+	modTime int64
+	link    string
+}
+
+// compareTrees compares the files found under both roots and returns the files added, removed, or modified, sorted
+// by path. A file is modified when its type, permissions, size, modification time, or symlink target changed, so
+// the contents of files are not read.
+func compareTrees(fromRoot, toRoot string) ([]DiffEntry, error) {
+	fromTree, err := readTree(fromRoot)
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := readTree(toRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]DiffEntry, 0)
+	for path, to := range toTree {
+		if fromEntry, ok := fromTree[path]; !ok {
+			entries = append(entries, DiffEntry{Change: DiffAdded, Path: path})
+		} else if fromEntry != to {
+			entries = append(entries, DiffEntry{Change: DiffModified, Path: path})
+		}
+	}
+	for path := range fromTree {
+		if _, ok := toTree[path]; !ok {
+			entries = append(entries, DiffEntry{Change: DiffRemoved, Path: path})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+// readTree returns the state of every file found under the root, keyed by its path relative to the root.
+func readTree(root string) (map[string]treeEntry, error) {
+	tree := make(map[string]treeEntry)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, werr error) error {
+		if werr != nil {
+			return werr
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := treeEntry{mode: info.Mode(), modTime: info.ModTime().UnixNano()}
+		if !info.IsDir() {
+			entry.size = info.Size()
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			if entry.link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		tree["/"+filepath.ToSlash(rel)] = entry
+		return nil
+	})
+	return tree, err
+}
+
+// printDiff will output the changes in the format of zfs diff -H, or as JSON.
+func printDiff(entries []DiffEntry) error {
+	if config.JSONOutput {
+		j, err := json.Marshal(entries)
+		if err != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", err)
+			return err
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	if len(entries) == 0 {
+		log.AppLogger.Noticef("No files changed between the snapshots.")
+		return nil
+	}
+	output := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		line := entry.Change + "\t" + entry.Path
+		if entry.NewPath != "" {
+			line += "\t" + entry.NewPath
+		}
+		output = append(output, line)
+	}
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	return nil
+}
@@ -0,0 +1,91 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// errFreeSpaceUnsupported is returned when the free space of a directory cannot be determined on this platform.
+var errFreeSpaceUnsupported = errors.New("determining free space is not supported on this platform")
+
+// requiredScratchSpace estimates how much space the volumes of a backup can take up in the working directory at
+// once: up to MaxFileBuffer volumes of VolumeSize (volumes may run slightly over), bounded by the size of the stream
+// when it is known, for each of the backups running in parallel.
+func requiredScratchSpace(j *files.JobInfo, parallel int, streamSize uint64) uint64 {
+	if j.MaxFileBuffer == 0 {
+		// Volumes are piped straight to the target
+		return 0
+	}
+	required := uint64(j.MaxFileBuffer) * (j.VolumeSize + 1) * humanize.MiByte
+	if streamSize > 0 && streamSize+humanize.MiByte < required {
+		required = streamSize + humanize.MiByte
+	}
+	return required * uint64(parallel)
+}
+
+// checkScratchSpace will fail fast when the working directory does not have enough free space for the volumes of the
+// backup, rather than running out of space part way through it. The size of the zfs send stream is only estimated
+// when the volumes alone would not fit.
+func checkScratchSpace(ctx context.Context, j *files.JobInfo, parallel int) error {
+	required := requiredScratchSpace(j, parallel, 0)
+	if required == 0 {
+		return nil
+	}
+
+	dir := config.BackupTempdir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	available, err := freeSpace(dir)
+	if err != nil {
+		log.AppLogger.Debugf("Not checking the free space in %s - %v", dir, err)
+		return nil
+	}
+	if available >= required {
+		return nil
+	}
+
+	if !j.Stdin && parallel == 1 {
+		if size, eerr := zfs.EstimateSendSize(ctx, j); eerr != nil {
+			log.AppLogger.Debugf("Could not estimate the size of the zfs send stream - %v", eerr)
+		} else if required = requiredScratchSpace(j, parallel, size); available >= required {
+			return nil
+		}
+	}
+
+	log.AppLogger.Errorf(
+		"Not enough free space in %s: %s available but up to %s is needed for %d volume(s) of %dMiB at once. "+
+			"Free up space, or lower the --maxFileBuffer or --volsize options.",
+		dir, humanize.IBytes(available), humanize.IBytes(required), j.MaxFileBuffer*parallel, j.VolumeSize,
+	)
+	return fmt.Errorf("not enough free space in %s (%s available, %s required)", dir, humanize.IBytes(available), humanize.IBytes(required))
+}
@@ -0,0 +1,373 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// The results of a doctor check. Only failed checks make the doctor command fail.
+const (
+	DoctorOK      = "ok"
+	DoctorWarning = "warning"
+	DoctorFailed  = "failed"
+)
+
+var errDoctorFailed = errors.New("some of the checks failed")
+
+// The permissions that must be delegated with zfs allow to back a dataset up, and to restore into it, as a regular user.
+var (
+	sendPermissions    = []string{"send", "snapshot", "hold", "release"}
+	receivePermissions = []string{"receive", "create", "mount"}
+)
+
+// DoctorCheck is the result of one of the checks of the doctor command, with the fix to apply when it did not pass.
+type DoctorCheck struct {
+	Name   string
+	Result string
+	Detail string
+	Fix    string `json:",omitempty"`
+}
+
+// Doctor will check that zfsbackup can run on this host: that the zfs binary is available, that the current user
+// was delegated the permissions needed on the datasets provided, that the working directory can hold the volumes of
+// a backup, that the keys given could be loaded (keysErr), that the compressor is available, and that each of the
+// targets can be reached. Every check is reported along with how to fix it, and an error is returned if any failed.
+func Doctor(ctx context.Context, jobInfo *files.JobInfo, datasets, targets []string, keysErr error) error {
+	checks := []DoctorCheck{checkZFS(ctx)}
+	checks = append(checks, checkPermissions(ctx, datasets)...)
+	checks = append(checks, checkWorkingDirectory(jobInfo), checkKeys(jobInfo, keysErr), checkCompressor(jobInfo))
+	for _, target := range targets {
+		checks = append(checks, checkTarget(ctx, jobInfo, target))
+	}
+
+	if err := printDoctorChecks(checks); err != nil {
+		return err
+	}
+	for _, check := range checks {
+		if check.Result == DoctorFailed {
+			return errDoctorFailed
+		}
+	}
+	return nil
+}
+
+// checkZFS checks the zfs binary can be found and reports its version.
+func checkZFS(ctx context.Context) DoctorCheck {
+	check := DoctorCheck{Name: "zfs", Result: DoctorOK}
+	path, err := exec.LookPath(zfs.ZFSPath)
+	if err != nil {
+		check.Result, check.Detail = DoctorFailed, fmt.Sprintf("could not find %s - %v", zfs.ZFSPath, err)
+		check.Fix = "Install the OpenZFS utilities, or point --zfsPath to the zfs binary."
+		return check
+	}
+	version, err := zfs.Version(ctx)
+	if err != nil {
+		check.Result, check.Detail = DoctorWarning, fmt.Sprintf("%s could not report its version - %v", path, err)
+		check.Fix = "Upgrade to OpenZFS 0.8 or later, earlier releases lack features such as resumable and raw sends."
+		return check
+	}
+	check.Detail = fmt.Sprintf("%s (%s)", path, version)
+	return check
+}
+
+// checkPermissions checks the current user can back up and restore the datasets, as root or through the
+// permissions delegated with zfs allow.
+func checkPermissions(ctx context.Context, datasets []string) []DoctorCheck {
+	if os.Geteuid() == 0 {
+		return []DoctorCheck{{Name: "permissions", Result: DoctorOK, Detail: "running as root"}}
+	}
+
+	current, err := user.Current()
+	if err != nil {
+		return []DoctorCheck{{Name: "permissions", Result: DoctorWarning, Detail: fmt.Sprintf("could not get the current user - %v", err)}}
+	}
+	if len(datasets) == 0 {
+		return []DoctorCheck{{
+			Name:   "permissions",
+			Result: DoctorWarning,
+			Detail: fmt.Sprintf("running as %s rather than root, no dataset given to check the permissions delegated on", current.Username),
+			Fix:    "Give the datasets to back up with --dataset to check the permissions delegated to this user on them.",
+		}}
+	}
+	var groups []string
+	if gids, gerr := current.GroupIds(); gerr == nil {
+		for _, gid := range gids {
+			if group, lerr := user.LookupGroupId(gid); lerr == nil {
+				groups = append(groups, group.Name)
+			}
+		}
+	}
+
+	checks := make([]DoctorCheck, 0, len(datasets))
+	for _, dataset := range datasets {
+		check := DoctorCheck{Name: "permissions " + dataset, Result: DoctorOK}
+		allowed, perr := zfs.GetPermissions(ctx, dataset)
+		if perr != nil {
+			check.Result, check.Detail = DoctorFailed, fmt.Sprintf("could not list the permissions delegated - %v", perr)
+			check.Fix = "Check the dataset exists, and run zfsbackup as root or through sudo if permissions cannot be delegated."
+			checks = append(checks, check)
+			continue
+		}
+
+		granted := delegatedPermissions(allowed, dataset, current.Username, groups)
+		missingSend, missingReceive := missingPermissions(granted, sendPermissions), missingPermissions(granted, receivePermissions)
+		switch {
+		case len(missingSend) > 0:
+			check.Result = DoctorFailed
+			check.Detail = fmt.Sprintf("%s cannot back it up, missing %s", current.Username, strings.Join(missingSend, ","))
+			check.Fix = fmt.Sprintf("Run zfs allow -u %s %s %s, or run zfsbackup as root or through sudo.",
+				current.Username, strings.Join(append(missingSend, missingReceive...), ","), dataset)
+		case len(missingReceive) > 0:
+			check.Result = DoctorWarning
+			check.Detail = fmt.Sprintf("%s can back it up but not restore into it, missing %s",
+				current.Username, strings.Join(missingReceive, ","))
+			check.Fix = fmt.Sprintf("Run zfs allow -u %s %s %s to restore as this user.",
+				current.Username, strings.Join(missingReceive, ","), dataset)
+		default:
+			check.Detail = fmt.Sprintf("%s can back it up and restore into it", current.Username)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// delegatedPermissions returns the permissions the output of zfs allow on the dataset grants the user, directly, to
+// one of their groups, or to everyone. Permissions delegated on a parent only apply when they are inherited by its
+// descendents, and permission sets are not expanded.
+func delegatedPermissions(allowed, dataset, username string, groups []string) map[string]bool {
+	granted := make(map[string]bool)
+	applies := false
+	onDataset := false
+	for _, line := range strings.Split(allowed, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "---- Permissions on "):
+			name := strings.Fields(strings.TrimPrefix(trimmed, "---- Permissions on "))
+			onDataset = len(name) > 0 && name[0] == dataset
+			continue
+		case strings.HasSuffix(trimmed, "permissions:") || strings.HasSuffix(trimmed, "sets:"):
+			switch trimmed {
+			case "Local+Descendent permissions:", "Descendent permissions:":
+				applies = !onDataset || trimmed == "Local+Descendent permissions:"
+			case "Local permissions:":
+				applies = onDataset
+			default:
+				// Permission sets and create time permissions are not granted to the user
+				applies = false
+			}
+			continue
+		}
+		if !applies {
+			continue
+		}
+
+		fields := strings.Fields(trimmed)
+		var perms string
+		switch {
+		case len(fields) == 2 && fields[0] == "everyone":
+			perms = fields[1]
+		case len(fields) == 3 && fields[0] == "user" && fields[1] == username:
+			perms = fields[2]
+		case len(fields) == 3 && fields[0] == "group":
+			for _, group := range groups {
+				if fields[1] == group {
+					perms = fields[2]
+				}
+			}
+		}
+		for _, perm := range strings.Split(perms, ",") {
+			if perm != "" {
+				granted[perm] = true
+			}
+		}
+	}
+	return granted
+}
+
+// missingPermissions returns the permissions required that were not granted.
+func missingPermissions(granted map[string]bool, required []string) []string {
+	var missing []string
+	for _, perm := range required {
+		if !granted[perm] {
+			missing = append(missing, perm)
+		}
+	}
+	return missing
+}
+
+// checkWorkingDirectory checks a file can be written to the temporary directory of the working directory, and that it
+// has enough free space for the volumes of a backup.
+func checkWorkingDirectory(jobInfo *files.JobInfo) DoctorCheck {
+	check := DoctorCheck{Name: "working directory", Result: DoctorOK}
+	dir := config.BackupTempdir
+	probe, err := os.CreateTemp(dir, "doctor")
+	if err != nil {
+		check.Result, check.Detail = DoctorFailed, fmt.Sprintf("could not write to %s - %v", dir, err)
+		check.Fix = "Fix the ownership or permissions of the working directory, or point --workingDirectory elsewhere."
+		return check
+	}
+	_ = probe.Close()
+	_ = os.Remove(probe.Name())
+
+	available, err := freeSpace(dir)
+	if err != nil {
+		check.Result, check.Detail = DoctorWarning, fmt.Sprintf("could not determine the free space in %s - %v", dir, err)
+		return check
+	}
+	required := requiredScratchSpace(jobInfo, 1, 0)
+	check.Detail = fmt.Sprintf("%s, %s free, up to %s needed for the volumes of a backup",
+		dir, humanize.IBytes(available), humanize.IBytes(required))
+	if available < required {
+		check.Result = DoctorWarning
+		check.Fix = "Free up space, point --workingDirectory elsewhere, or lower the --maxFileBuffer or --volsize options of send."
+	}
+	return check
+}
+
+// checkKeys reports the keys the backups are encrypted and signed with, or the error loading them.
+func checkKeys(jobInfo *files.JobInfo, keysErr error) DoctorCheck {
+	check := DoctorCheck{Name: "keys", Result: DoctorOK}
+	if keysErr != nil {
+		check.Result, check.Detail = DoctorFailed, fmt.Sprintf("could not load the keys - %v, see the errors logged above", keysErr)
+		check.Fix = "Check the keyring paths, the encryptTo and signFrom options, and the passphrase of the secret key."
+		return check
+	}
+
+	var keys []string
+	switch {
+	case len(jobInfo.KMSKeys) > 0:
+		keys = append(keys, fmt.Sprintf("data keys wrapped with %s", strings.Join(jobInfo.KMSKeys, ", ")))
+	case len(jobInfo.AgeRecipientKeys) > 0:
+		keys = append(keys, fmt.Sprintf("encrypting with age to %d recipient(s)", len(jobInfo.AgeRecipientKeys)))
+	case jobInfo.GPGAgent:
+		keys = append(keys, "using gpg-agent")
+	case jobInfo.EncryptKey != nil:
+		keys = append(keys, "encrypting to "+jobInfo.EncryptTo)
+	}
+	if jobInfo.SignKey != nil && !jobInfo.GPGAgent {
+		keys = append(keys, "signing as "+jobInfo.SignFrom)
+	}
+	if len(keys) == 0 {
+		check.Result, check.Detail = DoctorWarning, "the backups will not be encrypted or signed"
+		check.Fix = "Encrypt the backups with --encryptTo and --publicKeyRingPath, --ageRecipient, or --kmsKey."
+		return check
+	}
+	check.Detail = strings.Join(keys, ", ")
+	return check
+}
+
+// checkCompressor checks the external compressor, and decompressor, if any, can be found.
+func checkCompressor(jobInfo *files.JobInfo) DoctorCheck {
+	check := DoctorCheck{Name: "compressor", Result: DoctorOK}
+	var external []string
+	for _, compressor := range []string{jobInfo.Compressor, jobInfo.Decompressor} {
+		switch compressor {
+		case "", files.InternalCompressor, files.InternalLZ4Compressor, files.InternalZstdCompressor, files.ZfsCompressor, files.NoCompressor:
+		default:
+			external = append(external, strings.Fields(compressor)[0])
+		}
+	}
+	if len(external) == 0 {
+		check.Detail = "using a built in compressor"
+		if jobInfo.Compressor != "" {
+			check.Detail = "using the built in compressor " + jobInfo.Compressor
+		}
+		return check
+	}
+
+	found := make([]string, 0, len(external))
+	for _, binary := range external {
+		path, err := exec.LookPath(binary)
+		if err != nil {
+			check.Result, check.Detail = DoctorFailed, fmt.Sprintf("could not find %s - %v", binary, err)
+			check.Fix = fmt.Sprintf("Install %s, or use a built in compressor such as %s.", binary, files.InternalZstdCompressor)
+			return check
+		}
+		found = append(found, path)
+	}
+	check.Detail = strings.Join(found, ", ")
+	return check
+}
+
+// checkTarget checks the target can be reached by listing its manifests, reporting how long it took.
+func checkTarget(ctx context.Context, jobInfo *files.JobInfo, target string) DoctorCheck {
+	check := DoctorCheck{Name: "target " + target, Result: DoctorOK}
+	fix := "Check the credentials for the target are set up, that the bucket or directory exists, and that it can be reached from this host."
+
+	start := time.Now()
+	backend, err := prepareBackend(ctx, jobInfo, target, nil)
+	if err != nil {
+		check.Result, check.Detail, check.Fix = DoctorFailed, fmt.Sprintf("could not initialize the backend - %v", err), fix
+		return check
+	}
+	defer backend.Close()
+
+	manifests, err := backend.List(ctx, jobInfo.ManifestPrefix)
+	if err != nil {
+		check.Result, check.Detail, check.Fix = DoctorFailed, fmt.Sprintf("could not list the manifests - %v", err), fix
+		return check
+	}
+	check.Detail = fmt.Sprintf("listed %d manifest object(s) in %v", len(manifests), time.Since(start).Round(time.Millisecond))
+	return check
+}
+
+func printDoctorChecks(checks []DoctorCheck) error {
+	if config.JSONOutput {
+		j, err := json.Marshal(checks)
+		if err != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", err)
+			return err
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for _, check := range checks {
+		counts[check.Result]++
+		fmt.Fprintf(config.Stdout, "%-8s %s: %s\n", check.Result, check.Name, check.Detail)
+		if check.Fix != "" {
+			fmt.Fprintf(config.Stdout, "%-8s fix: %s\n", "", check.Fix)
+		}
+	}
+	results := make([]string, 0, len(counts))
+	for _, result := range []string{DoctorOK, DoctorWarning, DoctorFailed} {
+		results = append(results, fmt.Sprintf("%d %s", counts[result], result))
+	}
+	fmt.Fprintf(config.Stdout, "\n%s.\n", strings.Join(results, ", "))
+	return nil
+}
@@ -0,0 +1,160 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+
+	"github.com/cenkalti/backoff"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// downloadPool downloads the volumes queued to it in order. At most MaxFileBuffer volumes are downloaded, or waiting
+// to be received, at once, which bounds both the parallel downloads and the space used in the working directory.
+// A slot is taken before the next volume is picked from the queue, so the earliest volumes always get one first.
+type downloadPool struct {
+	ctx     context.Context
+	jobs    chan downloadJob
+	pending []downloadJob
+	buffer  chan interface{}
+	usePipe bool
+	p       *progress
+}
+
+// downloadJob is a volume to download, along with the targets it can be downloaded from.
+type downloadJob struct {
+	sequence downloadSequence
+	targets  []restoreTarget
+}
+
+// newDownloadPool will start the download workers in the group provided, a slot is given back to the buffer of the
+// pool every time a volume has been received.
+func newDownloadPool(ctx context.Context, group *errgroup.Group, j *files.JobInfo, p *progress) *downloadPool {
+	workers := j.MaxFileBuffer
+	pool := &downloadPool{ctx: ctx, jobs: make(chan downloadJob), p: p}
+	if workers == 0 {
+		workers = 1
+		pool.usePipe = true
+	}
+	pool.buffer = make(chan interface{}, workers)
+
+	for i := 0; i < workers; i++ {
+		group.Go(func() error {
+			return pool.work(j)
+		})
+	}
+	return pool
+}
+
+// queue will add the volumes provided to the pool, returning the channel each downloaded volume is sent to.
+func (d *downloadPool) queue(volumes []*files.VolumeInfo, targets []restoreTarget) []chan *files.VolumeInfo {
+	channels := make([]chan *files.VolumeInfo, len(volumes))
+	for idx := range volumes {
+		channels[idx] = make(chan *files.VolumeInfo, 1)
+		d.pending = append(d.pending, downloadJob{downloadSequence{volumes[idx], channels[idx]}, targets})
+	}
+	return channels
+}
+
+// close will hand the volumes queued to the workers, in order, in the background.
+func (d *downloadPool) close() {
+	pending := d.pending
+	d.pending = nil
+	go func() {
+		defer close(d.jobs)
+		for _, job := range pending {
+			select {
+			case <-d.ctx.Done():
+				return
+			case d.jobs <- job:
+			}
+		}
+	}()
+}
+
+func (d *downloadPool) work(j *files.JobInfo) error {
+	ctx := d.ctx
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d.buffer <- nil:
+		}
+
+		var (
+			job downloadJob
+			ok  bool
+		)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case job, ok = <-d.jobs:
+		}
+		if !ok {
+			<-d.buffer
+			return nil
+		}
+
+		if err := d.download(ctx, j, job); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *downloadPool) download(ctx context.Context, j *files.JobInfo, job downloadJob) error {
+	defer close(job.sequence.c)
+
+	be := backoff.NewExponentialBackOff()
+	be.MaxInterval = j.MaxBackoffTime
+	be.MaxElapsedTime = j.MaxRetryTime
+	retryconf := backoff.WithContext(be, ctx)
+
+	candidates := orderTargetsForVolume(job.targets, job.sequence.volume)
+	operation := func() error {
+		var oerr error
+		// Fall back to the next target as soon as one fails, only backing off once every target has failed
+		for _, t := range candidates {
+			if oerr = processSequence(ctx, job.sequence, t.backend, d.usePipe); oerr == nil {
+				return nil
+			}
+			log.AppLogger.Warningf("error trying to download file %s from %s - %v", job.sequence.volume.ObjectName, t.uri, oerr)
+			var perr *backoff.PermanentError
+			if errors.As(oerr, &perr) {
+				return oerr
+			}
+		}
+		return oerr
+	}
+
+	log.AppLogger.Debugf("Downloading volume %s.", job.sequence.volume.ObjectName)
+	d.p.setVolumeStage(job.sequence.volume, volumeDownloading)
+
+	if err := backoff.Retry(operation, retryconf); err != nil {
+		log.AppLogger.Errorf("Failed to download volume %s due to error: %v, aborting...", job.sequence.volume.ObjectName, err)
+		return err
+	}
+	d.p.volumeDownloaded(job.sequence.volume)
+	return nil
+}
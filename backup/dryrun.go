@@ -0,0 +1,255 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// DryRunResult describes the backup a send would perform.
+type DryRunResult struct {
+	VolumeName          string
+	BaseSnapshot        files.SnapshotInfo
+	IncrementalSnapshot files.SnapshotInfo
+	EstimatedZFSBytes   uint64
+	EstimatedVolumes    uint64
+}
+
+// DryRun will estimate the size of the zfs send stream for the backup described by jobInfo and
+// report the snapshots that would be used along with the number of volumes the stream would be
+// split into, without uploading anything.
+func DryRun(ctx context.Context, jobInfo *files.JobInfo) error {
+	size, err := zfs.EstimateSendSize(ctx, jobInfo)
+	if err != nil {
+		log.AppLogger.Errorf("Could not estimate the size of the zfs send stream - %v", err)
+		return err
+	}
+
+	result := DryRunResult{
+		VolumeName:          jobInfo.VolumeName,
+		BaseSnapshot:        jobInfo.BaseSnapshot,
+		IncrementalSnapshot: jobInfo.IncrementalSnapshot,
+		EstimatedZFSBytes:   size,
+		EstimatedVolumes:    estimateVolumes(size, jobInfo.VolumeSize),
+	}
+
+	if config.JSONOutput {
+		j, jerr := json.Marshal(result)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{
+		"Dry run, nothing was uploaded.",
+		fmt.Sprintf("Volume: %s", result.VolumeName),
+		fmt.Sprintf("Snapshot: %s (%v)", result.BaseSnapshot.Name, result.BaseSnapshot.CreationTime),
+	}
+	if result.IncrementalSnapshot.Name != "" {
+		output = append(
+			output,
+			fmt.Sprintf("Incremental From Snapshot: %s (%v)", result.IncrementalSnapshot.Name, result.IncrementalSnapshot.CreationTime),
+		)
+	} else {
+		output = append(output, "Incremental From Snapshot: none, this is a full backup")
+	}
+	output = append(
+		output,
+		fmt.Sprintf("Estimated ZFS Stream Bytes: %d (%s)", size, humanize.IBytes(size)),
+		fmt.Sprintf("Estimated Volumes: %d of up to %dMiB each (before compression)", result.EstimatedVolumes, jobInfo.VolumeSize),
+	)
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n\t"))
+
+	return nil
+}
+
+// estimateVolumes returns how many volumes of volumeSize MiB a stream of the given size is split into.
+func estimateVolumes(size, volumeSize uint64) uint64 {
+	volumeBytes := volumeSize * humanize.MiByte
+	if volumeBytes == 0 || size == 0 {
+		return 1
+	}
+	return (size + volumeBytes - 1) / volumeBytes
+}
+
+// RestoreStep describes a backup set a receive would restore.
+type RestoreStep struct {
+	BaseSnapshot        files.SnapshotInfo
+	IncrementalSnapshot files.SnapshotInfo
+	Volumes             int
+	DownloadBytes       uint64
+	ZFSStreamBytes      uint64
+	MissingVolumes      []string `json:",omitempty"`
+}
+
+// RestoreDryRunResult describes the restore a receive would perform.
+type RestoreDryRunResult struct {
+	VolumeName  string
+	LocalVolume string `json:",omitempty"`
+	Steps       []RestoreStep
+}
+
+// RestoreDryRun will resolve the backup sets a receive would restore, in order, and check that every volume they
+// need can be found in at least one of the targets, reporting the restore plan without downloading or receiving
+// anything.
+func RestoreDryRun(ctx context.Context, jobInfo *files.JobInfo) error {
+	return restoreDryRun(ctx, config.Stdout, jobInfo)
+}
+
+// restoreDryRun will report the restore plan as RestoreDryRun does, writing it to out.
+func restoreDryRun(ctx context.Context, out io.Writer, jobInfo *files.JobInfo) error {
+	jobs := []*files.JobInfo{jobInfo}
+	if jobInfo.AutoRestore {
+		chain, _, err := resolveRestoreChain(ctx, jobInfo)
+		if err != nil {
+			return err
+		}
+		jobs = make([]*files.JobInfo, 0, len(chain))
+		for i := len(chain) - 1; i >= 0; i-- {
+			jobs = append(jobs, chain[i])
+		}
+	}
+
+	targets, err := prepareRestoreTargets(ctx, jobInfo)
+	if err != nil {
+		return err
+	}
+	defer closeRestoreTargets(targets)
+
+	result := RestoreDryRunResult{VolumeName: jobInfo.VolumeName}
+	if jobInfo.ToFile == "" {
+		result.LocalVolume = restoreVolumeName(jobInfo)
+	}
+	missing := 0
+	for _, job := range jobs {
+		setInfo := *jobInfo
+		setInfo.BaseSnapshot = job.BaseSnapshot
+		setInfo.IncrementalSnapshot = job.IncrementalSnapshot
+		setInfo.Separator = job.Separator
+
+		var manifest *files.JobInfo
+		for _, t := range targets {
+			if manifest, err = fetchManifest(ctx, &setInfo, t); err == nil {
+				break
+			}
+			log.AppLogger.Warningf("Could not retrieve the manifest from target %s - %v", t.uri, err)
+		}
+		if err != nil {
+			log.AppLogger.Errorf("Error trying to retrieve manifest volume - %v", err)
+			return err
+		}
+
+		step := RestoreStep{
+			BaseSnapshot:        manifest.BaseSnapshot,
+			IncrementalSnapshot: manifest.IncrementalSnapshot,
+			Volumes:             len(manifest.Volumes),
+			ZFSStreamBytes:      manifest.ZFSStreamBytes,
+		}
+		for _, vol := range manifest.Volumes {
+			step.DownloadBytes += vol.Size
+			if !volumeAvailable(ctx, targets, vol) {
+				step.MissingVolumes = append(step.MissingVolumes, vol.ObjectName)
+			}
+		}
+		missing += len(step.MissingVolumes)
+		result.Steps = append(result.Steps, step)
+	}
+
+	if err = printRestoreDryRun(out, &result, jobInfo); err != nil {
+		return err
+	}
+
+	if missing > 0 {
+		log.AppLogger.Errorf("%d volume(s) needed for the restore could not be found in any of the targets.", missing)
+		return fmt.Errorf("%d volume(s) needed for the restore are missing", missing)
+	}
+	return nil
+}
+
+// volumeAvailable reports whether the volume can be found in any of the targets provided.
+func volumeAvailable(ctx context.Context, targets []restoreTarget, vol *files.VolumeInfo) bool {
+	for _, t := range orderTargetsForVolume(targets, vol) {
+		exists, err := objectExists(ctx, t.backend, vol.ObjectName)
+		if err != nil {
+			log.AppLogger.Warningf("Could not check if volume %s exists in target %s - %v", vol.ObjectName, t.uri, err)
+			continue
+		}
+		if exists {
+			return true
+		}
+	}
+	return false
+}
+
+func printRestoreDryRun(out io.Writer, result *RestoreDryRunResult, jobInfo *files.JobInfo) error {
+	if config.JSONOutput {
+		j, jerr := json.Marshal(result)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(out, string(j))
+		return nil
+	}
+
+	output := []string{
+		"Dry run, nothing was downloaded or received.",
+		fmt.Sprintf("Volume: %s", result.VolumeName),
+	}
+	if jobInfo.ToFile != "" {
+		output = append(output, fmt.Sprintf("Restore To: stream files in %s", jobInfo.ToFile))
+	} else {
+		output = append(output, fmt.Sprintf("Restore To: %s", result.LocalVolume))
+	}
+	if len(result.Steps) == 0 {
+		output = append(output, "Nothing to restore, the snapshot already exists locally.")
+	}
+	for idx, step := range result.Steps {
+		from := "full backup"
+		if step.IncrementalSnapshot.Name != "" {
+			from = fmt.Sprintf("incremental from %s", step.IncrementalSnapshot.Name)
+		}
+		output = append(output, fmt.Sprintf(
+			"%d. Snapshot %s (%s): %d volume(s), %s to download, %s ZFS stream",
+			idx+1, step.BaseSnapshot.Name, from, step.Volumes, humanize.IBytes(step.DownloadBytes), humanize.IBytes(step.ZFSStreamBytes),
+		))
+		for _, name := range step.MissingVolumes {
+			output = append(output, fmt.Sprintf("   Missing from every target: %s", name))
+		}
+	}
+	fmt.Fprintln(out, strings.Join(output, "\n\t"))
+
+	return nil
+}
@@ -0,0 +1,315 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// The retrieval tiers of archive storage classes, from the fastest and most expensive to the slowest and cheapest.
+// Azure's high priority rehydration is priced as the expedited tier.
+const (
+	TierExpedited = "expedited"
+	TierStandard  = "standard"
+	TierBulk      = "bulk"
+)
+
+// retrievalCost is the approximate cost, in USD per GiB, of reading data stored in a storage class with a retrieval
+// tier, and how long it takes before the data can be downloaded.
+type retrievalCost struct {
+	perGiB       float64
+	rehydrateMin time.Duration
+	rehydrateMax time.Duration
+}
+
+// immediate returns the retrieval costs of a storage class that can be downloaded right away with every tier.
+func immediate(perGiB float64) map[string]retrievalCost {
+	cost := retrievalCost{perGiB: perGiB}
+	return map[string]retrievalCost{TierExpedited: cost, TierStandard: cost, TierBulk: cost}
+}
+
+// storageClassCosts are the retrieval costs of the storage classes of S3, GCS and Azure, as reported by their backends,
+// per retrieval tier. Prices are list prices in us-east regions and only meant to give an idea of the cost, they vary
+// by region and change over time. Deep Archive has no expedited tier and Azure has no bulk tier, the standard tier is
+// used instead.
+var storageClassCosts = map[string]map[string]retrievalCost{
+	// S3
+	"STANDARD":            immediate(0),
+	"REDUCED_REDUNDANCY":  immediate(0),
+	"INTELLIGENT_TIERING": immediate(0),
+	"STANDARD_IA":         immediate(0.01),
+	"ONEZONE_IA":          immediate(0.01),
+	"GLACIER_IR":          immediate(0.03),
+	"GLACIER": {
+		TierExpedited: {perGiB: 0.03, rehydrateMin: time.Minute, rehydrateMax: 5 * time.Minute},
+		TierStandard:  {perGiB: 0.01, rehydrateMin: 3 * time.Hour, rehydrateMax: 5 * time.Hour},
+		TierBulk:      {perGiB: 0, rehydrateMin: 5 * time.Hour, rehydrateMax: 12 * time.Hour},
+	},
+	"DEEP_ARCHIVE": {
+		TierExpedited: {perGiB: 0.02, rehydrateMax: 12 * time.Hour},
+		TierStandard:  {perGiB: 0.02, rehydrateMax: 12 * time.Hour},
+		TierBulk:      {perGiB: 0.0025, rehydrateMax: 48 * time.Hour},
+	},
+	// GCS
+	"MULTI_REGIONAL": immediate(0),
+	"REGIONAL":       immediate(0),
+	"NEARLINE":       immediate(0.01),
+	"COLDLINE":       immediate(0.02),
+	"ARCHIVE":        immediate(0.05),
+	// Azure
+	"Hot":  immediate(0),
+	"Cool": immediate(0.01),
+	"Cold": immediate(0.03),
+	"Archive": {
+		TierExpedited: {perGiB: 0.10, rehydrateMax: time.Hour},
+		TierStandard:  {perGiB: 0.02, rehydrateMax: 15 * time.Hour},
+		TierBulk:      {perGiB: 0.02, rehydrateMax: 15 * time.Hour},
+	},
+}
+
+// StorageClassEstimate totals the volumes to download stored in a storage class, with the cost of retrieving them and
+// how long they take to be readable. Storage classes that are not known, or could not be determined, are not priced.
+type StorageClassEstimate struct {
+	StorageClass   string
+	Volumes        int
+	Bytes          uint64
+	Priced         bool
+	RetrievalCost  float64
+	RehydrationMin time.Duration
+	RehydrationMax time.Duration
+}
+
+// RestoreEstimate is the approximate cost, in USD, and time before the download can start, of restoring a snapshot
+// from a target.
+type RestoreEstimate struct {
+	VolumeName     string
+	Snapshot       string
+	Target         string
+	Tier           string
+	BackupSets     int
+	Volumes        int
+	Bytes          uint64
+	StorageClasses []StorageClassEstimate
+	RetrievalCost  float64
+	EgressPrice    float64
+	EgressCost     float64
+	TotalCost      float64
+	RehydrationMax time.Duration
+}
+
+// EstimateRestore will resolve the backup sets a restore of the job's snapshot from its first target would download,
+// as AutoRestore does, look up the storage class of each of their volumes, and report the approximate cost of
+// retrieving them with the retrieval tier provided, by default the one the S3 backend restores with, of downloading
+// them at egressPrice USD per GiB, and how long archived volumes take to be readable, without downloading or restoring
+// anything.
+func EstimateRestore(ctx context.Context, jobInfo *files.JobInfo, tier string, egressPrice float64) error {
+	if tier == "" {
+		tier = defaultRetrievalTier()
+	}
+	chain, _, err := resolveRestoreChain(ctx, jobInfo)
+	if err != nil {
+		return err
+	}
+
+	target := jobInfo.Destinations[0]
+	backend, err := prepareBackend(ctx, jobInfo, target, nil)
+	if err != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, err)
+		return err
+	}
+	defer backend.Close()
+
+	var volumes []*files.VolumeInfo
+	for _, set := range chain {
+		volumes = append(volumes, set.Volumes...)
+	}
+	classes, err := volumeStorageClasses(ctx, backend, target, volumes)
+	if err != nil {
+		log.AppLogger.Errorf("Could not look up the storage class of the volumes in %s - %v", target, err)
+		return err
+	}
+
+	if strings.HasPrefix(target, backends.FileBackendPrefix+"://") {
+		// Nothing leaves the host
+		egressPrice = 0
+	}
+	estimate := estimateRestore(volumes, classes, tier, egressPrice)
+	estimate.VolumeName, estimate.Snapshot, estimate.Target, estimate.BackupSets =
+		jobInfo.VolumeName, jobInfo.BaseSnapshot.Name, target, len(chain)
+
+	return printRestoreEstimate(estimate)
+}
+
+// volumeStorageClasses returns the storage class of each of the volumes, a few at a time, as reported by the target.
+// The storage classes are left empty when the target cannot report them.
+func volumeStorageClasses(ctx context.Context, backend backends.Backend, target string, volumes []*files.VolumeInfo) ([]string, error) {
+	classes := make([]string, len(volumes))
+	stater, ok := backend.(backends.Stater)
+	if !ok || strings.HasPrefix(target, backends.FileBackendPrefix+"://") {
+		// The file backend has no storage classes, and would read every volume to stat it
+		return classes, nil
+	}
+
+	var mutex sync.Mutex
+	group, gctx := errgroup.WithContext(ctx)
+	// Let's not slam the endpoint with a lot of concurrent requests, pick a sensible default and stick to it
+	buffer := make(chan bool, 5)
+	for i, vol := range volumes {
+		i, vol := i, vol
+		select {
+		case <-gctx.Done():
+			return nil, group.Wait()
+		case buffer <- true:
+		}
+		group.Go(func() error {
+			defer func() { <-buffer }()
+			info, err := stater.Stat(gctx, vol.ObjectName)
+			if err != nil {
+				return fmt.Errorf("%s: %v", vol.ObjectName, err)
+			}
+			mutex.Lock()
+			classes[i] = info.StorageClass
+			mutex.Unlock()
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return classes, nil
+}
+
+// estimateRestore totals the volumes per storage class and prices their retrieval with the tier and their download.
+// The rehydration of every archived volume is requested at once, so the restore can start after the longest one.
+func estimateRestore(volumes []*files.VolumeInfo, classes []string, tier string, egressPrice float64) RestoreEstimate {
+	estimate := RestoreEstimate{Tier: tier, EgressPrice: egressPrice, Volumes: len(volumes)}
+	byClass := make(map[string]*StorageClassEstimate)
+	for i, vol := range volumes {
+		class, ok := byClass[classes[i]]
+		if !ok {
+			class = &StorageClassEstimate{StorageClass: classes[i]}
+			byClass[classes[i]] = class
+		}
+		class.Volumes++
+		class.Bytes += vol.Size
+		estimate.Bytes += vol.Size
+	}
+
+	for name, class := range byClass {
+		if costs, ok := storageClassCosts[name]; ok {
+			cost := costs[tier]
+			class.Priced = true
+			class.RetrievalCost = cost.perGiB * float64(class.Bytes) / humanize.GiByte
+			class.RehydrationMin, class.RehydrationMax = cost.rehydrateMin, cost.rehydrateMax
+		} else if name != "" {
+			log.AppLogger.Warningf("The storage class %s is not known, the retrieval of its volumes is not priced.", name)
+		}
+		estimate.RetrievalCost += class.RetrievalCost
+		if class.RehydrationMax > estimate.RehydrationMax {
+			estimate.RehydrationMax = class.RehydrationMax
+		}
+		estimate.StorageClasses = append(estimate.StorageClasses, *class)
+	}
+	sort.Slice(estimate.StorageClasses, func(i, j int) bool {
+		return estimate.StorageClasses[i].StorageClass < estimate.StorageClasses[j].StorageClass
+	})
+
+	estimate.EgressCost = egressPrice * float64(estimate.Bytes) / humanize.GiByte
+	estimate.TotalCost = estimate.RetrievalCost + estimate.EgressCost
+	return estimate
+}
+
+// defaultRetrievalTier returns the retrieval tier the S3 backend restores archived volumes with.
+func defaultRetrievalTier() string {
+	switch tier := strings.ToLower(os.Getenv("AWS_S3_GLACIER_RESTORE_TIER")); tier {
+	case TierExpedited, TierStandard:
+		return tier
+	}
+	return TierBulk
+}
+
+func printRestoreEstimate(estimate RestoreEstimate) error {
+	if config.JSONOutput {
+		j, err := json.Marshal(estimate)
+		if err != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", err)
+			return err
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf(
+		"Restoring %s@%s from %s downloads %d backup sets of %d volumes totaling %s:",
+		estimate.VolumeName, estimate.Snapshot, estimate.Target, estimate.BackupSets, estimate.Volumes, humanize.IBytes(estimate.Bytes),
+	)}
+	for _, class := range estimate.StorageClasses {
+		name := class.StorageClass
+		if name == "" {
+			name = "unknown storage class"
+		}
+		line := fmt.Sprintf("\t%s: %d volumes, %s", name, class.Volumes, humanize.IBytes(class.Bytes))
+		switch {
+		case !class.Priced:
+			line += ", not priced"
+		case class.RehydrationMax > 0:
+			line += fmt.Sprintf(", $%.2f to retrieve with the %s tier, readable after %s", class.RetrievalCost, estimate.Tier,
+				formatRehydration(class.RehydrationMin, class.RehydrationMax))
+		default:
+			line += fmt.Sprintf(", $%.2f to retrieve, readable right away", class.RetrievalCost)
+		}
+		output = append(output, line)
+	}
+	output = append(output, fmt.Sprintf(
+		"Estimated cost: $%.2f retrieval + $%.2f egress at $%.2f/GiB = $%.2f.",
+		estimate.RetrievalCost, estimate.EgressCost, estimate.EgressPrice, estimate.TotalCost,
+	))
+	if estimate.RehydrationMax > 0 {
+		output = append(output, fmt.Sprintf("The download can start after up to %v, once the archived volumes are readable.",
+			estimate.RehydrationMax))
+	}
+	output = append(output, "Prices are approximate list prices, check your provider's pricing for your region.")
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	return nil
+}
+
+// formatRehydration describes how long a rehydration takes.
+func formatRehydration(shortest, longest time.Duration) string {
+	if shortest == 0 {
+		return fmt.Sprintf("up to %v", longest)
+	}
+	return fmt.Sprintf("%v to %v", shortest, longest)
+}
@@ -0,0 +1,100 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+)
+
+// FreshnessState is the state of a freshness check, its value being the exit code Nagios and Icinga expect of a plugin.
+type FreshnessState int
+
+// The states of a freshness check
+const (
+	FreshnessOK FreshnessState = iota
+	FreshnessWarning
+	FreshnessCritical
+	FreshnessUnknown
+)
+
+// String returns the name of the state, as printed at the start of the status line.
+func (s FreshnessState) String() string {
+	switch s {
+	case FreshnessOK:
+		return "OK"
+	case FreshnessWarning:
+		return "WARNING"
+	case FreshnessCritical:
+		return "CRITICAL"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// CheckFreshness will output a single status line, in the format of a Nagios or Icinga plugin, telling how long ago
+// the last backup of the dataset found in the target completed. The state is warning once that is longer ago than
+// warn, and critical once it is longer ago than crit or if there is no backup at all. It is unknown if the backups
+// could not be read.
+func CheckFreshness(ctx context.Context, jobInfo *files.JobInfo, dataset, target string, warn, crit time.Duration) FreshnessState {
+	jobInfo.VolumeName = dataset
+	backups, err := getBackupsForTarget(ctx, dataset, target, jobInfo)
+	if err != nil {
+		fmt.Fprintf(config.Stdout, "%s - could not read the backups of %s in %s: %v\n", FreshnessUnknown, dataset, target, err)
+		return FreshnessUnknown
+	}
+
+	var last time.Time
+	for _, manifest := range backups {
+		if manifest.EndTime.After(last) {
+			last = manifest.EndTime
+		}
+	}
+	state, status := freshness(dataset, last, time.Now(), warn, crit)
+	fmt.Fprintln(config.Stdout, status)
+	return state
+}
+
+// freshness returns the state and status line for a dataset last backed up at the time given, zero if never. The age
+// of the backup is appended as performance data.
+func freshness(dataset string, last, now time.Time, warn, crit time.Duration) (FreshnessState, string) {
+	if last.IsZero() {
+		return FreshnessCritical, fmt.Sprintf("%s - no backup of %s found", FreshnessCritical, dataset)
+	}
+
+	age := now.Sub(last)
+	state := FreshnessOK
+	switch {
+	case age >= crit:
+		state = FreshnessCritical
+	case age >= warn:
+		state = FreshnessWarning
+	}
+	return state, fmt.Sprintf(
+		"%s - last backup of %s completed %v ago at %s | age=%ds;%d;%d;0",
+		state, dataset, age.Round(time.Second), last.Format(time.RFC3339),
+		int64(age.Seconds()), int64(warn.Seconds()), int64(crit.Seconds()),
+	)
+}
@@ -0,0 +1,325 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// SupersededManifest is a previous generation of a manifest, kept when the manifest was written again.
+type SupersededManifest struct {
+	ObjectName string
+	Generation int
+	Manifest   *files.JobInfo
+}
+
+// listManifestGenerations returns the generations kept of the manifest named objectName, oldest first.
+func listManifestGenerations(ctx context.Context, jobInfo *files.JobInfo, backend backends.Backend, objectName string) ([]int, error) {
+	prefix := jobInfo.ManifestGenerationPrefix(objectName)
+	names, err := backend.List(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	generations := make([]int, 0, len(names))
+	for _, name := range names {
+		generation, perr := strconv.Atoi(strings.TrimPrefix(name, prefix))
+		if perr != nil {
+			// Signatures, or the generations of another manifest whose name starts with this one
+			continue
+		}
+		generations = append(generations, generation)
+	}
+	sort.Ints(generations)
+	return generations, nil
+}
+
+// supersedeManifest will keep the manifest the target holds, if any, as a new generation along with its detached
+// signature before it is written again, and delete the oldest generations beyond the number kept. It returns the
+// generation the manifest written next should record.
+func supersedeManifest(ctx context.Context, backend backends.Backend, manifest *files.JobInfo) (int, error) {
+	objectName := manifest.ManifestObjectName()
+	exists, err := objectExists(ctx, backend, objectName)
+	if err != nil || !exists {
+		return manifest.ManifestGeneration, err
+	}
+
+	generations, err := listManifestGenerations(ctx, manifest, backend, objectName)
+	if err != nil {
+		return 0, err
+	}
+	generation := manifest.ManifestGeneration
+	if n := len(generations); n > 0 && generations[n-1] >= generation {
+		generation = generations[n-1] + 1
+	}
+	if config.ManifestGenerations <= 0 {
+		return generation + 1, nil
+	}
+
+	name := manifest.ManifestGenerationName(objectName, generation)
+	if err = streamObject(ctx, backend, backend, objectName, name); err != nil {
+		return 0, err
+	}
+	if signed, serr := objectExists(ctx, backend, objectName+files.SignatureSuffix); serr != nil {
+		return 0, serr
+	} else if signed {
+		if err = streamObject(ctx, backend, backend, objectName+files.SignatureSuffix, name+files.SignatureSuffix); err != nil {
+			return 0, err
+		}
+	}
+	log.AppLogger.Debugf("Kept generation %d of the manifest %s as %s.", generation, objectName, name)
+
+	generations = append(generations, generation)
+	for len(generations) > config.ManifestGenerations {
+		oldest := manifest.ManifestGenerationName(objectName, generations[0])
+		if err = backend.Delete(ctx, oldest); err != nil {
+			log.AppLogger.Warningf("Could not delete the superseded manifest %s - %v", oldest, err)
+		}
+		deleteSignature(ctx, backend, oldest)
+		generations = generations[1:]
+	}
+	return generation + 1, nil
+}
+
+// readManifestGenerations will read every superseded generation of the manifests found in the target. Generations
+// are cached locally as they never change once written.
+func readManifestGenerations(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	localCachePath string,
+	backend backends.Backend,
+) ([]*SupersededManifest, error) {
+	prefix := jobInfo.GenerationListPrefix()
+	names, err := backend.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list superseded manifests from the backend due to error - %v", err)
+	}
+
+	superseded := make([]*SupersededManifest, 0, len(names))
+	for _, name := range names {
+		rest := strings.TrimPrefix(name, prefix)
+		idx := strings.LastIndex(rest, jobInfo.Separator)
+		if idx < 0 {
+			continue
+		}
+		generation, perr := strconv.Atoi(rest[idx+len(jobInfo.Separator):])
+		if perr != nil {
+			continue
+		}
+
+		manifest, merr := readManifestGeneration(ctx, jobInfo, localCachePath, backend, name)
+		if merr != nil {
+			return nil, merr
+		}
+		superseded = append(superseded, &SupersededManifest{
+			ObjectName: jobInfo.ObjectNamespace() + rest[:idx],
+			Generation: generation,
+			Manifest:   manifest,
+		})
+	}
+
+	sort.SliceStable(superseded, func(i, j int) bool {
+		if superseded[i].ObjectName != superseded[j].ObjectName {
+			return superseded[i].ObjectName < superseded[j].ObjectName
+		}
+		return superseded[i].Generation < superseded[j].Generation
+	})
+	return superseded, nil
+}
+
+// readManifestGeneration will read the superseded manifest named objectName, downloading it and its detached signature
+// to the local cache if required.
+func readManifestGeneration(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	localCachePath string,
+	backend backends.Backend,
+	objectName string,
+) (*files.JobInfo, error) {
+	generationCachePath := filepath.Join(localCachePath, "generations")
+	if err := os.MkdirAll(generationCachePath, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create cache directory %s due to an error: %v", generationCachePath, err)
+	}
+
+	// nolint:gosec // MD5 not used for cryptographic purposes here
+	safeManifestPath := filepath.Join(generationCachePath, fmt.Sprintf("%x", md5.Sum([]byte(objectName))))
+	if _, err := os.Stat(safeManifestPath); os.IsNotExist(err) {
+		if err = downloadTo(ctx, backend, objectName, safeManifestPath); err != nil {
+			return nil, err
+		}
+	}
+	if err := fetchSignature(ctx, backend, objectName, safeManifestPath); err != nil {
+		return nil, err
+	}
+
+	manifest, err := readManifest(ctx, safeManifestPath, jobInfo)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read superseded manifest %s due to error - %v", objectName, err)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// RecoverManifests will check that every manifest in the target can be read, replacing those that cannot, e.g. because
+// they were corrupted, with their latest superseded generation that can. When dryRun is set the manifests that would be
+// recovered are reported instead.
+func RecoverManifests(pctx context.Context, jobInfo *files.JobInfo, target string, dryRun bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Manifests are uploaded one at a time
+	uploadBuffer := make(chan bool, 1)
+	defer close(uploadBuffer)
+	backend, berr := prepareBackend(ctx, jobInfo, target, uploadBuffer)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	localCachePath, cerr := getCacheDir(jobInfo, target)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	if _, _, serr := syncCache(ctx, jobInfo, localCachePath, backend); serr != nil {
+		log.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return serr
+	}
+
+	names, err := backend.List(ctx, jobInfo.ManifestListPrefix())
+	if err != nil {
+		log.AppLogger.Errorf("Could not list the manifests in target %s due to error - %v", target, err)
+		return err
+	}
+
+	var recovered, unrecoverable int
+	for _, name := range names {
+		if strings.HasSuffix(name, files.SignatureSuffix) {
+			continue
+		}
+		// nolint:gosec // MD5 not used for cryptographic purposes here
+		manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(name))))
+		_, rerr := readManifest(ctx, manifestPath, jobInfo)
+		if rerr == nil {
+			continue
+		}
+		log.AppLogger.Warningf("Could not read the manifest %s - %v", name, rerr)
+
+		generation, gerr := latestReadableGeneration(ctx, jobInfo, localCachePath, backend, name)
+		if gerr != nil {
+			log.AppLogger.Errorf("Could not recover the manifest %s - %v", name, gerr)
+			unrecoverable++
+			continue
+		}
+		if dryRun {
+			log.AppLogger.Noticef("Would recover %s from its superseded generation %d.", name, generation)
+			recovered++
+			continue
+		}
+
+		if err = restoreManifestGeneration(ctx, jobInfo, backend, name, generation, manifestPath); err != nil {
+			log.AppLogger.Errorf("Could not recover the manifest %s from its generation %d due to error - %v", name, generation, err)
+			return err
+		}
+		log.AppLogger.Noticef("Recovered %s from its superseded generation %d.", name, generation)
+		recovered++
+	}
+
+	if dryRun {
+		log.AppLogger.Noticef("%d manifests would be recovered, %d cannot be.", recovered, unrecoverable)
+	} else {
+		log.AppLogger.Noticef("Recovered %d manifests, %d could not be recovered.", recovered, unrecoverable)
+	}
+	if unrecoverable > 0 {
+		return fmt.Errorf("%d manifests could not be read nor recovered from a superseded generation", unrecoverable)
+	}
+	return nil
+}
+
+// latestReadableGeneration returns the newest superseded generation of the manifest named objectName that can be read.
+func latestReadableGeneration(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	localCachePath string,
+	backend backends.Backend,
+	objectName string,
+) (int, error) {
+	generations, err := listManifestGenerations(ctx, jobInfo, backend, objectName)
+	if err != nil {
+		return 0, err
+	}
+	for idx := len(generations) - 1; idx >= 0; idx-- {
+		name := jobInfo.ManifestGenerationName(objectName, generations[idx])
+		if _, rerr := readManifestGeneration(ctx, jobInfo, localCachePath, backend, name); rerr == nil {
+			return generations[idx], nil
+		}
+	}
+	return 0, fmt.Errorf("none of the %d superseded generations kept can be read", len(generations))
+}
+
+// restoreManifestGeneration will replace the manifest named objectName, and its detached signature, with the given
+// superseded generation and drop the copy of the manifest from the local cache so the next sync fetches it again.
+func restoreManifestGeneration(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	backend backends.Backend,
+	objectName string,
+	generation int,
+	manifestPath string,
+) error {
+	name := jobInfo.ManifestGenerationName(objectName, generation)
+	if err := streamObject(ctx, backend, backend, name, objectName); err != nil {
+		return err
+	}
+	signed, err := objectExists(ctx, backend, name+files.SignatureSuffix)
+	if err != nil {
+		return err
+	}
+	if signed {
+		if err = streamObject(ctx, backend, backend, name+files.SignatureSuffix, objectName+files.SignatureSuffix); err != nil {
+			return err
+		}
+	} else {
+		deleteSignature(ctx, backend, objectName)
+	}
+
+	if err = os.Remove(manifestPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = os.Remove(signaturePath(manifestPath)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// ManifestVersion is a previous generation of a manifest kept by a target with versioning enabled.
+type ManifestVersion struct {
+	VersionID    string
+	LastModified time.Time
+	Manifest     *files.JobInfo
+}
+
+// readManifestHistory will read every previous (non-current) version of the manifests found in the target.
+// Versions are cached locally as they never change once written.
+func readManifestHistory(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	localCachePath string,
+	backend backends.Backend,
+) ([]*ManifestVersion, error) {
+	versioned, ok := backend.(backends.VersionedBackend)
+	if !ok {
+		return nil, backends.ErrUnsupported
+	}
+
+	versions, err := versioned.ListVersions(ctx, jobInfo.ManifestListPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("could not list manifest versions from the backend due to error - %v", err)
+	}
+
+	history := make([]*ManifestVersion, 0, len(versions))
+	for _, version := range versions {
+		// Unversioned objects in a bucket that later had versioning enabled are reported with a "null" version ID
+		if version.IsLatest || version.VersionID == "" || version.VersionID == "null" {
+			continue
+		}
+
+		manifest, merr := readManifestVersion(ctx, jobInfo, localCachePath, versioned, version.Name, version.VersionID)
+		if merr != nil {
+			return nil, merr
+		}
+		history = append(history, &ManifestVersion{
+			VersionID:    version.VersionID,
+			LastModified: version.LastModified,
+			Manifest:     manifest,
+		})
+	}
+
+	sort.SliceStable(history, func(i, j int) bool {
+		return history[i].LastModified.Before(history[j].LastModified)
+	})
+
+	return history, nil
+}
+
+// readManifestVersion will read the requested version of a manifest, downloading it to the local cache if required.
+func readManifestVersion(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	localCachePath string,
+	versioned backends.VersionedBackend,
+	objectName, versionID string,
+) (*files.JobInfo, error) {
+	versionCachePath := filepath.Join(localCachePath, "versions")
+	if err := os.MkdirAll(versionCachePath, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create cache directory %s due to an error: %v", versionCachePath, err)
+	}
+
+	// nolint:gosec // MD5 not used for cryptographic purposes here
+	safeManifestPath := filepath.Join(versionCachePath, fmt.Sprintf("%x", md5.Sum([]byte(objectName+"@"+versionID))))
+	if _, err := os.Stat(safeManifestPath); os.IsNotExist(err) {
+		if err = downloadVersionTo(ctx, versioned, objectName, versionID, safeManifestPath); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := readManifest(ctx, safeManifestPath, jobInfo)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read manifest %s (version %s) due to error - %v", objectName, versionID, err)
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+func downloadVersionTo(ctx context.Context, versioned backends.VersionedBackend, objectName, versionID, toPath string) error {
+	r, rerr := versioned.DownloadVersion(ctx, objectName, versionID)
+	if rerr != nil {
+		log.AppLogger.Errorf("Could not download file %s (version %s) due to error - %v.", objectName, versionID, rerr)
+		return rerr
+	}
+	defer r.Close()
+
+	out, oerr := os.Create(toPath)
+	if oerr != nil {
+		log.AppLogger.Errorf("Could not create file in the local cache dir due to error - %v.", oerr)
+		return oerr
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		os.Remove(toPath)
+		log.AppLogger.Errorf("Could not download file %s (version %s) due to error - %v.", objectName, versionID, err)
+		return err
+	}
+	log.AppLogger.Debugf("Downloaded %s (version %s) to local cache.", objectName, versionID)
+
+	return out.Close()
+}
@@ -0,0 +1,140 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// updateChainHolds will place a hold on the snapshot just backed up, as future incremental backups
+// depend on it, and release the holds with the same tag from snapshots no longer needed by the chain.
+// The fullIfOlderThan option only continues a chain while the snapshot of its full backup exists
+// locally, so that snapshot keeps its hold as well.
+// Differential backups only depend on the snapshot of the last full backup, so only it is held.
+func updateChainHolds(ctx context.Context, jobInfo *files.JobInfo) error {
+	volume := zfs.GetLocalVolumeName(jobInfo)
+	keep := map[string]bool{jobInfo.BaseSnapshot.Name: true}
+	if jobInfo.Differential && jobInfo.IncrementalSnapshot.Name != "" {
+		// Differential backups only ever depend on the last full backup
+		keep = map[string]bool{jobInfo.IncrementalSnapshot.Name: true}
+	}
+	if jobInfo.ChainFullSnapshot.Name != "" {
+		keep[jobInfo.ChainFullSnapshot.Name] = true
+	}
+
+	snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, volume)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if !snapshot.Bookmark {
+			names = append(names, fmt.Sprintf("%s@%s", volume, snapshot.Name))
+		}
+	}
+	holds, err := zfs.GetHolds(ctx, names...)
+	if err != nil {
+		return err
+	}
+
+	for name := range keep {
+		snapshot := fmt.Sprintf("%s@%s", volume, name)
+		if hasHoldTag(holds[snapshot], jobInfo.HoldTag) {
+			continue
+		}
+		log.AppLogger.Infof("Placing hold %s on %s.", jobInfo.HoldTag, snapshot)
+		if err = zfs.HoldSnapshot(ctx, jobInfo.HoldTag, snapshot); err != nil {
+			return err
+		}
+	}
+
+	for snapshot, tags := range holds {
+		if keep[snapshot[strings.Index(snapshot, "@")+1:]] || !hasHoldTag(tags, jobInfo.HoldTag) {
+			continue
+		}
+		log.AppLogger.Infof("Releasing hold %s on superseded snapshot %s.", jobInfo.HoldTag, snapshot)
+		if err = zfs.ReleaseSnapshot(ctx, jobInfo.HoldTag, snapshot); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseChainHold will release the hold with the given tag from the snapshot, if it is found locally.
+func releaseChainHold(ctx context.Context, tag, snapshot string) {
+	holds, err := zfs.GetHolds(ctx, snapshot)
+	if err != nil {
+		log.AppLogger.Debugf("Not releasing hold %s on %s, could not list its holds - %v", tag, snapshot, err)
+		return
+	}
+	if !hasHoldTag(holds[snapshot], tag) {
+		return
+	}
+	log.AppLogger.Infof("Releasing hold %s on %s.", tag, snapshot)
+	if err = zfs.ReleaseSnapshot(ctx, tag, snapshot); err != nil {
+		log.AppLogger.Warningf("Could not release hold %s on %s - %v", tag, snapshot, err)
+	}
+}
+
+// releasePrunedHolds will release the hold with the given tag from the local snapshots of the backup sets pruned,
+// unless a backup set left in the target was taken of, or increments from, the same snapshot.
+func releasePrunedHolds(ctx context.Context, tag string, pruned, manifests []*files.JobInfo) {
+	deleted := make(map[*files.JobInfo]bool, len(pruned))
+	for _, job := range pruned {
+		deleted[job] = true
+	}
+	needed := make(map[string]bool)
+	for _, manifest := range manifests {
+		if deleted[manifest] {
+			continue
+		}
+		needed[fmt.Sprintf("%s@%s", manifest.VolumeName, manifest.BaseSnapshot.Name)] = true
+		if manifest.IncrementalSnapshot.Name != "" {
+			needed[fmt.Sprintf("%s@%s", manifest.VolumeName, manifest.IncrementalSnapshot.Name)] = true
+		}
+	}
+
+	released := make(map[string]bool)
+	for _, job := range pruned {
+		snapshot := fmt.Sprintf("%s@%s", job.VolumeName, job.BaseSnapshot.Name)
+		if needed[snapshot] || released[snapshot] {
+			continue
+		}
+		released[snapshot] = true
+		releaseChainHold(ctx, tag, snapshot)
+	}
+}
+
+func hasHoldTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
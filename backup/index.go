@@ -0,0 +1,298 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// DatasetIndex summarizes every backup set of a volume in a target, so they can be listed by downloading a single
+// object instead of every manifest. It is rebuilt from the manifests and replaced after each send.
+type DatasetIndex struct {
+	VolumeName string
+	Updated    time.Time
+	BackupSets []IndexEntry
+}
+
+// IndexEntry summarizes a backup set in a DatasetIndex.
+type IndexEntry struct {
+	Manifest            string
+	BaseSnapshot        files.SnapshotInfo
+	IncrementalSnapshot files.SnapshotInfo
+	Volumes             int
+	Size                uint64
+	ZFSStreamBytes      uint64
+	StartTime           time.Time
+	EndTime             time.Time
+	Tags                map[string]string `json:",omitempty"`
+	Hostname            string            `json:",omitempty"`
+}
+
+// String returns a summary of the backup set similar to the one list outputs for its manifest.
+func (e *IndexEntry) String(volumeName string) string {
+	output := []string{
+		fmt.Sprintf("Volume: %s", volumeName),
+		fmt.Sprintf("Snapshot: %s (%v)", e.BaseSnapshot.Name, e.BaseSnapshot.CreationTime),
+	}
+	if e.IncrementalSnapshot.Name != "" {
+		output = append(
+			output,
+			fmt.Sprintf("Incremental From Snapshot: %s (%v)", e.IncrementalSnapshot.Name, e.IncrementalSnapshot.CreationTime),
+		)
+	}
+	if len(e.Tags) > 0 {
+		output = append(output, fmt.Sprintf("Tags: %s", (&files.JobInfo{Tags: e.Tags}).TagsString()))
+	}
+	if e.Hostname != "" {
+		output = append(output, fmt.Sprintf("Host: %s", e.Hostname))
+	}
+	output = append(
+		output,
+		fmt.Sprintf("Archives: %d - %d bytes (%s)", e.Volumes, e.Size, humanize.IBytes(e.Size)),
+		fmt.Sprintf("Volume Size (Raw): %d bytes (%s)", e.ZFSStreamBytes, humanize.IBytes(e.ZFSStreamBytes)),
+		fmt.Sprintf("Uploaded: %v (took %v)\n\n", e.StartTime, e.EndTime.Sub(e.StartTime)),
+	)
+	return strings.Join(output, "\n\t")
+}
+
+// newDatasetIndex summarizes the backup sets of the volume provided, sorted by the creation time of their snapshot.
+func newDatasetIndex(jobInfo *files.JobInfo, volumeName string, manifests []*files.JobInfo) *DatasetIndex {
+	index := &DatasetIndex{VolumeName: volumeName, Updated: time.Now(), BackupSets: make([]IndexEntry, 0, len(manifests))}
+	for _, manifest := range manifests {
+		if manifest.VolumeName != volumeName {
+			continue
+		}
+		manifest.ManifestPrefix = jobInfo.ManifestPrefix
+		manifest.ObjectPrefix = jobInfo.ObjectPrefix
+		manifest.CopyKeys(jobInfo)
+		index.BackupSets = append(index.BackupSets, IndexEntry{
+			Manifest:            manifest.ManifestObjectName(),
+			BaseSnapshot:        manifest.BaseSnapshot,
+			IncrementalSnapshot: manifest.IncrementalSnapshot,
+			Volumes:             len(manifest.Volumes),
+			Size:                manifest.TotalBytesWritten(),
+			ZFSStreamBytes:      manifest.ZFSStreamBytes,
+			StartTime:           manifest.StartTime,
+			EndTime:             manifest.EndTime,
+			Tags:                manifest.Tags,
+			Hostname:            manifest.Hostname,
+		})
+	}
+	sort.SliceStable(index.BackupSets, func(i, j int) bool {
+		return index.BackupSets[i].BaseSnapshot.CreationTime.Before(index.BackupSets[j].BaseSnapshot.CreationTime)
+	})
+	return index
+}
+
+// canReadManifests returns true if the keys of the job can decrypt the manifests it writes, which is needed to
+// rebuild the index from them.
+func canReadManifests(j *files.JobInfo) bool {
+	switch {
+	case len(j.KMSKeys) > 0 || j.GPGAgent:
+		return true
+	case len(j.AgeRecipientKeys) > 0:
+		return len(j.AgeIdentities) > 0
+	case j.EncryptKey != nil:
+		return j.EncryptKey.PrivateKey != nil
+	default:
+		return true
+	}
+}
+
+// updateDatasetIndex will rebuild the index of the job's volume from its manifests in the target and replace it.
+// When the manifests cannot be read with the keys provided, e.g. when sending with only the public key, the index
+// is deleted instead so it never lists stale backup sets.
+func updateDatasetIndex(ctx context.Context, jobInfo *files.JobInfo, target string, backend backends.Backend) error {
+	if !canReadManifests(jobInfo) {
+		log.AppLogger.Infof("Cannot read the manifests in %s with the keys provided, deleting the index of %s instead of updating it.",
+			target, jobInfo.VolumeName)
+		return deleteDatasetIndex(ctx, jobInfo, backend)
+	}
+
+	manifests, err := getBackupsForTarget(ctx, jobInfo.VolumeName, target, jobInfo)
+	if err != nil {
+		return err
+	}
+	index := newDatasetIndex(jobInfo, jobInfo.VolumeName, manifests)
+
+	vol, err := files.CreateIndexVolume(ctx, jobInfo)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if derr := vol.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete temporary index file - %v", derr)
+		}
+	}()
+	if err = json.NewEncoder(vol).Encode(index); err != nil {
+		_ = vol.Close()
+		return err
+	}
+	if err = vol.Close(); err != nil {
+		return err
+	}
+	if err = vol.OpenVolume(); err != nil {
+		return err
+	}
+	defer vol.Close()
+
+	// Replacing the object is atomic, readers either get the previous index or this one
+	if err = backend.Upload(ctx, vol); err != nil {
+		return err
+	}
+	log.AppLogger.Debugf("Updated the index of %s in %s with %d backup sets.", jobInfo.VolumeName, target, len(index.BackupSets))
+	return nil
+}
+
+// deleteDatasetIndex will delete the index of the job's volume, if any, so it is rebuilt by the next send.
+func deleteDatasetIndex(ctx context.Context, jobInfo *files.JobInfo, backend backends.Backend) error {
+	name := jobInfo.IndexObjectName()
+	exists, err := objectExists(ctx, backend, name)
+	if err != nil || !exists {
+		return err
+	}
+	return backend.Delete(ctx, name)
+}
+
+// readDatasetIndex will download and decode the index object provided.
+func readDatasetIndex(ctx context.Context, jobInfo *files.JobInfo, backend backends.Backend, name string) (*DatasetIndex, error) {
+	tempdir, err := os.MkdirTemp(config.BackupTempdir, "index")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempdir)
+
+	indexPath := filepath.Join(tempdir, "index")
+	if err = downloadTo(ctx, backend, name, indexPath); err != nil {
+		return nil, err
+	}
+	indexVol, _, err := extractManifest(ctx, jobInfo, indexPath)
+	if err != nil {
+		return nil, err
+	}
+	defer indexVol.Close()
+
+	index := new(DatasetIndex)
+	if err = json.NewDecoder(indexVol).Decode(index); err != nil {
+		return nil, fmt.Errorf("could not decode the index %s - %v", name, err)
+	}
+	return index, nil
+}
+
+// ListIndex will output the backup sets found in the index objects of the target, downloading a single object per
+// volume instead of every manifest. Only a volume whose index exists is listed, filtered like List does.
+func ListIndex(
+	pctx context.Context, jobInfo *files.JobInfo, startswith string, before, after time.Time, tags map[string]string,
+	host string,
+) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// A single volume can be looked up directly, unless its index name is hidden
+	var names []string
+	if startswith != "" && !strings.HasSuffix(startswith, "*") {
+		single := cloneJobInfo(jobInfo)
+		single.VolumeName = startswith
+		exists, err := objectExists(ctx, backend, single.IndexObjectName())
+		if err != nil {
+			return err
+		}
+		if exists {
+			names = []string{single.IndexObjectName()}
+		}
+	}
+	if names == nil {
+		var err error
+		if names, err = backend.List(ctx, jobInfo.IndexListPrefix()); err != nil {
+			log.AppLogger.Errorf("Could not list the indexes in target %s due to error - %v", target, err)
+			return err
+		}
+	}
+
+	indexes := make([]*DatasetIndex, 0, len(names))
+	for _, name := range names {
+		index, err := readDatasetIndex(ctx, jobInfo, backend, name)
+		if err != nil {
+			log.AppLogger.Errorf("Could not read the index %s due to error - %v", name, err)
+			return err
+		}
+
+		filtered := index.BackupSets[:0]
+		for i := range index.BackupSets {
+			entry := &index.BackupSets[i]
+			summary := &files.JobInfo{
+				VolumeName: index.VolumeName, BaseSnapshot: entry.BaseSnapshot, Tags: entry.Tags, Hostname: entry.Hostname,
+			}
+			if manifestMatchesFilter(summary, startswith, before, after) && manifestMatchesTags(summary, tags) &&
+				manifestMatchesHost(summary, host) {
+				filtered = append(filtered, *entry)
+			}
+		}
+		if index.BackupSets = filtered; len(filtered) > 0 {
+			indexes = append(indexes, index)
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].VolumeName < indexes[j].VolumeName })
+
+	if config.JSONOutput {
+		j, err := json.Marshal(indexes)
+		if err != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", err)
+			return err
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	count := 0
+	var output []string
+	for _, index := range indexes {
+		count += len(index.BackupSets)
+		for i := range index.BackupSets {
+			output = append(output, index.BackupSets[i].String(index.VolumeName))
+		}
+	}
+	output = append([]string{fmt.Sprintf("Found %d backup sets:\n", count)}, output...)
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// InitTargets will initialize each of the destinations provided in the jobInfo and install the
+// provided lifecycle policy on them, transitioning the volumes of backup sets that are no longer among the daily
+// backup sets kept by the retention policy to a colder storage class. Targets that cannot manage lifecycle rules
+// will cause an error.
+func InitTargets(pctx context.Context, jobInfo *files.JobInfo, retention RetentionPolicy, policy *backends.LifecyclePolicy) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	policy.TransitionAfterDays = transitionAfterDays(retention)
+	if policy.TransitionAfterDays > 0 {
+		log.AppLogger.Noticef(
+			"Volumes will be transitioned to a colder storage class after %d days, once prune only keeps their backup sets as weekly or monthly backups.",
+			policy.TransitionAfterDays,
+		)
+	}
+
+	for _, target := range jobInfo.Destinations {
+		backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+		if berr != nil {
+			log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+			return berr
+		}
+
+		manager, ok := backend.(backends.LifecycleManager)
+		if !ok {
+			backend.Close()
+			log.AppLogger.Errorf("The target %s does not support managing lifecycle rules.", target)
+			return backends.ErrUnsupported
+		}
+
+		if err := manager.SetLifecyclePolicy(ctx, policy); err != nil {
+			backend.Close()
+			log.AppLogger.Errorf("Could not set lifecycle policy on target %s due to error - %v.", target, err)
+			return err
+		}
+		backend.Close()
+
+		log.AppLogger.Noticef("Installed lifecycle policy on target %s.", target)
+	}
+
+	return nil
+}
+
+// transitionAfterDays returns after how many days volumes can be transitioned to a colder storage class under the
+// retention policy: once their backup sets are older than the daily backup sets kept, they are only kept as weekly or
+// monthly backups, rarely restored. Nothing is transitioned when no daily backup sets are kept, nor when only they
+// are, as prune deletes everything else.
+func transitionAfterDays(retention RetentionPolicy) int {
+	if retention.KeepDaily <= 0 || (retention.KeepWeekly <= 0 && retention.KeepMonthly <= 0) {
+		return 0
+	}
+	return retention.KeepDaily
+}
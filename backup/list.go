@@ -25,11 +25,14 @@ import (
 	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
 	"encoding/json"
 	"fmt"
+	"io"
 	"path/filepath"
 	"sort"
 	"strings"
 	"time"
 
+	"filippo.io/age"
+
 	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/files"
 	"github.com/jdfalk/zfsbackup-go/log"
@@ -37,10 +40,16 @@ import (
 
 // List will sync the manifests found in the target destination to the local cache
 // and then read and output the manifest information describing the backup sets
-// found in the target destination.
+// found in the target destination. If history is true, previous versions of the manifests
+// kept by a target with versioning enabled are output as well, and if superseded is true the
+// superseded generations of the manifests kept by zfsbackup itself are. Only the backup sets with
+// all of the tags provided, and taken on the host provided, are output.
 // TODO: Group by volume name?
-// nolint:gocyclo // Difficult to break this up
-func List(pctx context.Context, jobInfo *files.JobInfo, startswith string, before, after time.Time) error {
+// nolint:gocyclo,funlen // Difficult to break this up
+func List(
+	pctx context.Context, jobInfo *files.JobInfo, startswith string, before, after time.Time, history, superseded, long bool,
+	tags map[string]string, host string,
+) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
 
@@ -54,7 +63,7 @@ func List(pctx context.Context, jobInfo *files.JobInfo, startswith string, befor
 	defer backend.Close()
 
 	// Get the local cache dir
-	localCachePath, cerr := getCacheDir(jobInfo.Destinations[0])
+	localCachePath, cerr := getCacheDir(jobInfo, jobInfo.Destinations[0])
 	if cerr != nil {
 		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
 		return cerr
@@ -75,37 +84,63 @@ func List(pctx context.Context, jobInfo *files.JobInfo, startswith string, befor
 	// Filter Manifests to only results we care about
 	filteredResults := decodedManifests[:0]
 	for _, manifest := range decodedManifests {
-		if startswith != "" {
-			if startswith[len(startswith)-1:] == "*" {
-				if len(startswith) != 1 && !strings.HasPrefix(manifest.VolumeName, startswith[:len(startswith)-1]) {
-					continue
-				}
-			} else if strings.Compare(startswith, manifest.VolumeName) != 0 {
-				continue
-			}
+		if manifestMatchesFilter(manifest, startswith, before, after) && manifestMatchesTags(manifest, tags) &&
+			manifestMatchesHost(manifest, host) {
+			filteredResults = append(filteredResults, manifest)
 		}
+	}
 
-		if !before.IsZero() && !manifest.BaseSnapshot.CreationTime.Before(before) {
-			continue
+	decodedManifests = filteredResults
+	for _, manifest := range decodedManifests {
+		if manifest.Compression == nil {
+			manifest.Compression = manifest.CompressionSummary()
 		}
+	}
 
-		if !after.IsZero() && !manifest.BaseSnapshot.CreationTime.After(after) {
-			continue
+	var manifestHistory []*ManifestVersion
+	if history {
+		versions, herr := readManifestHistory(ctx, jobInfo, localCachePath, backend)
+		if herr != nil {
+			log.AppLogger.Errorf("Could not read manifest history for target %s due to error - %v.", target, herr)
+			return herr
+		}
+		for _, version := range versions {
+			if manifestMatchesFilter(version.Manifest, startswith, before, after) && manifestMatchesTags(version.Manifest, tags) &&
+				manifestMatchesHost(version.Manifest, host) {
+				manifestHistory = append(manifestHistory, version)
+			}
 		}
-
-		filteredResults = append(filteredResults, manifest)
 	}
 
-	decodedManifests = filteredResults
+	var supersededManifests []*SupersededManifest
+	if superseded {
+		generations, gerr := readManifestGenerations(ctx, jobInfo, localCachePath, backend)
+		if gerr != nil {
+			log.AppLogger.Errorf("Could not read superseded manifests for target %s due to error - %v.", target, gerr)
+			return gerr
+		}
+		for _, generation := range generations {
+			if manifestMatchesFilter(generation.Manifest, startswith, before, after) && manifestMatchesTags(generation.Manifest, tags) &&
+				manifestMatchesHost(generation.Manifest, host) {
+				supersededManifests = append(supersededManifests, generation)
+			}
+		}
+	}
 
 	if !config.JSONOutput {
 		var output []string
 
 		output = append(output, fmt.Sprintf("Found %d backup sets:\n", len(decodedManifests)))
 		for _, manifest := range decodedManifests {
-			output = append(output, manifest.String())
+			if long {
+				output = append(output, manifest.LongString())
+			} else {
+				output = append(output, manifest.String())
+			}
 		}
 
+		output = append(output, datasetRenames(decodedManifests)...)
+
 		if len(localOnlyFiles) > 0 {
 			output = append(output, fmt.Sprintf("There are %d manifests found locally that are not on the target destination.", len(localOnlyFiles)))
 			localOnlyOuput := []string{"The following manifests were found locally and can be removed using the clean command."}
@@ -120,10 +155,34 @@ func List(pctx context.Context, jobInfo *files.JobInfo, startswith string, befor
 			}
 			log.AppLogger.Infof(strings.Join(localOnlyOuput, "\n"))
 		}
+		if history {
+			output = append(output, fmt.Sprintf("Found %d previous manifest versions:\n", len(manifestHistory)))
+			for _, version := range manifestHistory {
+				output = append(output, fmt.Sprintf("Version: %s (written %v)\n\t%s", version.VersionID, version.LastModified, version.Manifest.String()))
+			}
+		}
+		if superseded {
+			output = append(output, fmt.Sprintf("Found %d superseded manifests:\n", len(supersededManifests)))
+			for _, generation := range supersededManifests {
+				output = append(output, fmt.Sprintf(
+					"Generation: %d of %s\n\t%s", generation.Generation, generation.ObjectName, generation.Manifest.String(),
+				))
+			}
+		}
 		fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
 	} else {
-		organizedManifests := linkManifests(decodedManifests)
-		j, jerr := json.Marshal(organizedManifests)
+		var results interface{} = linkManifests(decodedManifests)
+		if history || superseded {
+			extended := map[string]interface{}{"Manifests": results}
+			if history {
+				extended["History"] = manifestHistory
+			}
+			if superseded {
+				extended["Superseded"] = supersededManifests
+			}
+			results = extended
+		}
+		j, jerr := json.Marshal(results)
 		if jerr != nil {
 			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
 			return jerr
@@ -135,6 +194,80 @@ func List(pctx context.Context, jobInfo *files.JobInfo, startswith string, befor
 	return nil
 }
 
+func manifestMatchesFilter(manifest *files.JobInfo, startswith string, before, after time.Time) bool {
+	if startswith != "" {
+		if startswith[len(startswith)-1:] == "*" {
+			if len(startswith) != 1 && !strings.HasPrefix(manifest.VolumeName, startswith[:len(startswith)-1]) {
+				return false
+			}
+		} else if strings.Compare(startswith, manifest.VolumeName) != 0 {
+			return false
+		}
+	}
+
+	if !before.IsZero() && !manifest.BaseSnapshot.CreationTime.Before(before) {
+		return false
+	}
+
+	if !after.IsZero() && !manifest.BaseSnapshot.CreationTime.After(after) {
+		return false
+	}
+
+	return true
+}
+
+// datasetRenames returns a line for each rename found in the backup sets provided, that is when backup sets of the same
+// dataset, told apart by its guid, were taken under different volume names over time.
+func datasetRenames(manifests []*files.JobInfo) []string {
+	byGUID := make(map[string][]*files.JobInfo)
+	var guids []string
+	for _, manifest := range manifests {
+		if manifest.DatasetGUID == "" {
+			continue
+		}
+		if _, ok := byGUID[manifest.DatasetGUID]; !ok {
+			guids = append(guids, manifest.DatasetGUID)
+		}
+		byGUID[manifest.DatasetGUID] = append(byGUID[manifest.DatasetGUID], manifest)
+	}
+
+	var renames []string
+	for _, guid := range guids {
+		sets := byGUID[guid]
+		sort.SliceStable(sets, func(i, k int) bool {
+			return sets[i].BaseSnapshot.CreationTime.Before(sets[k].BaseSnapshot.CreationTime)
+		})
+		for idx := 1; idx < len(sets); idx++ {
+			if sets[idx].VolumeName != sets[idx-1].VolumeName {
+				renames = append(renames, fmt.Sprintf(
+					"Volume %s was renamed to %s before snapshot %s (dataset guid %s)",
+					sets[idx-1].VolumeName, sets[idx].VolumeName, sets[idx].BaseSnapshot.Name, guid,
+				))
+			}
+		}
+	}
+	return renames
+}
+
+// manifestMatchesHost returns true if the manifest was taken on the host provided, which can end with a '*' to match
+// as only a prefix. Every manifest matches an empty host.
+func manifestMatchesHost(manifest *files.JobInfo, host string) bool {
+	if prefix := strings.TrimSuffix(host, "*"); prefix != host {
+		return strings.HasPrefix(manifest.Hostname, prefix)
+	}
+	return host == "" || manifest.Hostname == host
+}
+
+// manifestMatchesTags returns true if the manifest has every tag provided.
+func manifestMatchesTags(manifest *files.JobInfo, tags map[string]string) bool {
+	for key, value := range tags {
+		if tagged, ok := manifest.Tags[key]; !ok || tagged != value {
+			return false
+		}
+	}
+	return true
+}
+
 func readAndSortManifests(
 	ctx context.Context,
 	localCachePath string,
@@ -142,15 +275,9 @@ func readAndSortManifests(
 	jobInfo *files.JobInfo,
 ) ([]*files.JobInfo, error) {
 	// Read in Manifests and display
-	decodedManifests := make([]*files.JobInfo, 0, len(manifests))
-	for _, manifest := range manifests {
-		manifestPath := filepath.Join(localCachePath, manifest)
-		decodedManifest, oerr := readManifest(ctx, manifestPath, jobInfo)
-		if oerr != nil {
-			log.AppLogger.Errorf("Could not read manifest %s due to error - %v", manifestPath, oerr)
-			return nil, oerr
-		}
-		decodedManifests = append(decodedManifests, decodedManifest)
+	decodedManifests, err := readManifests(ctx, localCachePath, manifests, jobInfo)
+	if err != nil {
+		return nil, err
 	}
 
 	sort.SliceStable(decodedManifests, func(i, j int) bool {
@@ -213,17 +340,30 @@ func linkManifests(manifests []*files.JobInfo) map[string][]*files.JobInfo {
 }
 
 func readManifest(ctx context.Context, manifestPath string, j *files.JobInfo) (*files.JobInfo, error) {
-	decodedManifest := new(files.JobInfo)
-	manifestVol, err := files.ExtractLocal(ctx, j, manifestPath, true)
+	if err := verifyManifest(ctx, manifestPath, j); err != nil {
+		return nil, err
+	}
+
+	manifestVol, dataKey, err := extractManifest(ctx, j, manifestPath)
 	if err != nil {
 		return nil, err
 	}
 	defer manifestVol.Close()
-	decoder := json.NewDecoder(manifestVol)
-	err = decoder.Decode(decodedManifest)
+	decodedManifest, err := files.DecodeManifest(manifestVol)
 	if err != nil {
 		return nil, err
 	}
+	if dataKey != nil {
+		// Keep the manifest encrypted with its data key when it is written again
+		decodedManifest.AgeRecipientKeys = []age.Recipient{dataKey.Recipient()}
+	}
+	// Read to the end so the embedded signature, if any, is checked
+	if _, err = io.Copy(io.Discard, manifestVol); err != nil {
+		return nil, err
+	}
+	if err = decodedManifest.CheckSchemaVersion(); err != nil {
+		return nil, err
+	}
 
 	return decodedManifest, nil
 }
@@ -0,0 +1,497 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	// errLockHeld is returned when the local lock of a volume is held by another process.
+	errLockHeld = errors.New("the lock is held by another process")
+	// errDatasetLocked is returned when another run is already backing up the volume.
+	errDatasetLocked = errors.New("the volume is being backed up by another run")
+)
+
+// lockMarker is the content of the object marking a volume as being backed up in a target.
+type lockMarker struct {
+	Host      string
+	PID       int
+	Started   time.Time
+	Refreshed time.Time
+}
+
+// heldBy returns true if the marker was written by the same run as the other one.
+func (m *lockMarker) heldBy(other *lockMarker) bool {
+	return m.Host == other.Host && m.PID == other.PID && m.Started.Equal(other.Started)
+}
+
+// stale returns true if the run holding the marker is gone: either it was running on this host, which only happens
+// once the local lock could be taken, or it did not refresh the marker within the timeout.
+func (m *lockMarker) stale(host string, timeout time.Duration, now time.Time) bool {
+	return m.Host == host || now.Sub(m.Refreshed) > timeout
+}
+
+// String describes who holds the lock.
+func (m *lockMarker) String() string {
+	return fmt.Sprintf("process %d on %s since %v, last refreshed %v", m.PID, m.Host, m.Started.Format(time.RFC3339),
+		m.Refreshed.Format(time.RFC3339))
+}
+
+// hostLockName is the lock file every run on this host holds shared, and clean exclusively, see lockHost.
+const hostLockName = "host.lck"
+
+// datasetLock is held while backing up a volume so overlapping runs, e.g. a cron run colliding with a manual one,
+// cannot interleave their uploads. It is made of a local lock file and, with the TargetLock option, a lock object in
+// every target that is refreshed until the lock is released. The commands deleting or rewriting backup sets hold the
+// local lock too, see lockVolumes and lockHost.
+type datasetLock struct {
+	host    *os.File
+	file    *os.File
+	path    string
+	marker  *lockMarker
+	name    string
+	targets map[string]backends.Backend
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// lockDir returns the directory of the local lock files in the working directory, creating it if needed. Only the
+// user running zfsbackup may write to it, so nobody else can put a file or a symlink in place of a lock file.
+func lockDir() (string, error) {
+	if config.WorkingDir == "" {
+		return "", errors.New("no working directory to keep the lock files in")
+	}
+	dir := filepath.Join(config.WorkingDir, "locks")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if err = checkLockDir(info); err != nil {
+		return "", fmt.Errorf("refusing to keep the lock files in %s - %v", dir, err)
+	}
+	return dir, nil
+}
+
+// localLockPath returns the path of the local lock file of the volume in the lock directory.
+func localLockPath(dir, volumeName string) string {
+	// nolint:gosec // MD5 not used for cryptographic purposes here
+	return filepath.Join(dir, fmt.Sprintf("%x.lck", md5.Sum([]byte(volumeName))))
+}
+
+// pidPath returns the path of the file recording the process holding the lock file at lockPath. It is kept apart
+// from the lock file so the lock file is never written to.
+func pidPath(lockPath string) string {
+	return strings.TrimSuffix(lockPath, ".lck") + ".pid"
+}
+
+// takeLocalLock opens the lock file at path, refusing to follow a symlink in its place, and locks it without waiting,
+// returning errLockHeld if another process holds it.
+func takeLocalLock(path string, exclusive bool) (*os.File, error) {
+	f, err := openLockFile(path)
+	if err != nil {
+		log.AppLogger.Errorf("Could not open the lock file %s due to error - %v", path, err)
+		return nil, err
+	}
+	if err = flockFile(f, exclusive); err != nil {
+		f.Close()
+		if !errors.Is(err, errLockHeld) {
+			log.AppLogger.Errorf("Could not lock %s due to error - %v", path, err)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// lockLocal will take the local lock of the volume, along with the lock of the host shared by every run, failing
+// with errDatasetLocked if another process holds the lock of the volume or clean holds the lock of the host.
+func lockLocal(volumeName string) (*datasetLock, error) {
+	dir, err := lockDir()
+	if err != nil {
+		log.AppLogger.Errorf("Could not lock %s due to error - %v", volumeName, err)
+		return nil, err
+	}
+
+	lock := &datasetLock{path: localLockPath(dir, volumeName)}
+	if lock.host, err = takeLocalLock(filepath.Join(dir, hostLockName), false); err != nil {
+		if errors.Is(err, errLockHeld) {
+			log.AppLogger.Errorf("Cannot lock %s, the clean command is deleting objects on this host.", volumeName)
+			return nil, errDatasetLocked
+		}
+		return nil, err
+	}
+	if lock.file, err = takeLocalLock(lock.path, true); err != nil {
+		lock.release()
+		if errors.Is(err, errLockHeld) {
+			holder, _ := os.ReadFile(pidPath(lock.path))
+			log.AppLogger.Errorf("Cannot lock %s, it is in use by process %s on this host (lock file %s).",
+				volumeName, strings.TrimSpace(string(holder)), lock.path)
+			return nil, errDatasetLocked
+		}
+		return nil, err
+	}
+
+	// The process holding the lock is recorded for the error above. The file is replaced rather than written to, the
+	// lock directory is only writable by this user so the name cannot be pointed elsewhere.
+	if err = writePID(pidPath(lock.path)); err != nil {
+		log.AppLogger.Warningf("Could not record the process holding the lock file %s - %v", lock.path, err)
+	}
+	return lock, nil
+}
+
+// writePID will write the id of this process to a new file, renamed over the file at path.
+func writePID(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// lockDataset will take the local lock of the job's volume and, with the TargetLock option, its lock object in every
+// target, failing with errDatasetLocked if another run holds either of them.
+func lockDataset(ctx context.Context, jobInfo *files.JobInfo) (*datasetLock, error) {
+	lock, err := lockLocal(jobInfo.VolumeName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !jobInfo.TargetLock {
+		return lock, nil
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	now := time.Now()
+	lock.marker = &lockMarker{Host: host, PID: os.Getpid(), Started: now, Refreshed: now}
+	lock.name = jobInfo.LockObjectName()
+	lock.targets = make(map[string]backends.Backend, len(jobInfo.Destinations))
+	for _, destination := range jobInfo.Destinations {
+		backend, berr := prepareBackend(ctx, jobInfo, destination, make(chan bool, 1))
+		if berr != nil {
+			log.AppLogger.Errorf("Could not initialize backend due to error - %v.", berr)
+			lock.release()
+			return nil, berr
+		}
+		if err = lockTarget(ctx, jobInfo, backend, destination, lock.name, lock.marker); err != nil {
+			backend.Close()
+			lock.release()
+			return nil, err
+		}
+		lock.targets[destination] = backend
+	}
+
+	refreshCtx, cancel := context.WithCancel(ctx)
+	lock.cancel, lock.done = cancel, make(chan struct{})
+	go lock.refresh(refreshCtx, jobInfo.LockTimeout/4)
+	return lock, nil
+}
+
+// lockTarget will write the lock object to the target unless another run holds it. A stale lock object is replaced,
+// and any lock object with the BreakLock option.
+func lockTarget(ctx context.Context, jobInfo *files.JobInfo, backend backends.Backend, target, name string, marker *lockMarker) error {
+	existing, err := readLockMarker(ctx, backend, name)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the lock of %s in %s due to error - %v", jobInfo.VolumeName, target, err)
+		return err
+	}
+	if existing != nil {
+		switch {
+		case jobInfo.BreakLock:
+			log.AppLogger.Warningf("Breaking the lock of %s in %s held by %s.", jobInfo.VolumeName, target, existing)
+		case existing.stale(marker.Host, jobInfo.LockTimeout, time.Now()):
+			log.AppLogger.Warningf("Replacing the stale lock of %s in %s held by %s.", jobInfo.VolumeName, target, existing)
+		default:
+			log.AppLogger.Errorf(
+				"Cannot lock %s in %s, it is being backed up by %s. If that run is gone, wait for the lock to be older than "+
+					"the lock timeout or use the --breakLock option.",
+				jobInfo.VolumeName, target, existing,
+			)
+			return errDatasetLocked
+		}
+	}
+
+	if err = writeLockMarker(ctx, backend, name, marker); err != nil {
+		log.AppLogger.Errorf("Could not write the lock of %s to %s due to error - %v", jobInfo.VolumeName, target, err)
+		return err
+	}
+
+	// Two runs may not have found any lock at the same time, the last one to write its lock holds it
+	holder, err := readLockMarker(ctx, backend, name)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the lock of %s in %s due to error - %v", jobInfo.VolumeName, target, err)
+		return err
+	}
+	if holder == nil || !holder.heldBy(marker) {
+		log.AppLogger.Errorf("Cannot lock %s in %s, another run locked it at the same time.", jobInfo.VolumeName, target)
+		return errDatasetLocked
+	}
+	return nil
+}
+
+// volumeLocks are the local locks of the volumes a command deletes or rewrites backup sets of, see lockVolumes.
+type volumeLocks []*datasetLock
+
+// release will release every lock held.
+func (l volumeLocks) release() {
+	for _, lock := range l {
+		lock.release()
+	}
+}
+
+// lockVolumes will take the local lock of the volume of every backup set provided, as a backup of it does, so a command
+// deleting or rewriting its backup sets cannot interleave with a backup of it on this host. A backup run from another
+// host with the TargetLock option is refused by checking the lock object of each volume in the target, without
+// writing one. The lock objects are named after the manifests, as their names may be hidden.
+func lockVolumes(ctx context.Context, jobInfo *files.JobInfo, target string, manifests []*files.JobInfo) (volumeLocks, error) {
+	volumes := backupSetVolumes(manifests)
+	locks := make(volumeLocks, 0, len(volumes))
+	for _, volume := range volumes {
+		lock, err := lockLocal(volume)
+		if err != nil {
+			locks.release()
+			return nil, err
+		}
+		locks = append(locks, lock)
+	}
+
+	backend, err := prepareBackend(ctx, jobInfo, target, make(chan bool, 1))
+	if err != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, err)
+		locks.release()
+		return nil, err
+	}
+	defer backend.Close()
+
+	seen := make(map[string]bool, len(manifests))
+	names := make([]string, 0, len(volumes))
+	for _, manifest := range manifests {
+		job := cloneJobInfo(manifest)
+		job.ObjectPrefix = jobInfo.ObjectPrefix
+		if name := job.LockObjectName(); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if err = checkTargetLocks(ctx, jobInfo, backend, target, names); err != nil {
+		locks.release()
+		return nil, err
+	}
+	return locks, nil
+}
+
+// backupSetVolumes returns the volumes of the backup sets, sorted and without duplicates.
+func backupSetVolumes(manifests []*files.JobInfo) []string {
+	seen := make(map[string]bool, len(manifests))
+	volumes := make([]string, 0, len(manifests))
+	for _, manifest := range manifests {
+		if !seen[manifest.VolumeName] {
+			seen[manifest.VolumeName] = true
+			volumes = append(volumes, manifest.VolumeName)
+		}
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// lockHost will take the lock of the host exclusively, which every run holds shared while it holds the lock of a
+// volume, so clean cannot delete the objects of a backup still being uploaded from this host. Backup runs from other
+// hosts with the TargetLock option are refused by checking every lock object in the target, without writing one.
+func lockHost(ctx context.Context, jobInfo *files.JobInfo, backend backends.Backend, target string) (*datasetLock, error) {
+	dir, err := lockDir()
+	if err != nil {
+		log.AppLogger.Errorf("Could not lock this host due to error - %v", err)
+		return nil, err
+	}
+	lock := new(datasetLock)
+	if lock.host, err = takeLocalLock(filepath.Join(dir, hostLockName), true); err != nil {
+		if errors.Is(err, errLockHeld) {
+			log.AppLogger.Errorf("Cannot lock this host, another run is using a volume on it (lock files in %s).", dir)
+			return nil, errDatasetLocked
+		}
+		return nil, err
+	}
+
+	names, err := backend.List(ctx, jobInfo.LockListPrefix())
+	if err != nil {
+		log.AppLogger.Errorf("Could not list the locks in %s due to error - %v", target, err)
+		lock.release()
+		return nil, err
+	}
+	if err = checkTargetLocks(ctx, jobInfo, backend, target, names); err != nil {
+		lock.release()
+		return nil, err
+	}
+	return lock, nil
+}
+
+// checkTargetLocks returns errDatasetLocked if any of the lock objects named is held by a backup run, that is one
+// that is not stale. Lock objects left by this host are stale since its local locks are held.
+func checkTargetLocks(ctx context.Context, jobInfo *files.JobInfo, backend backends.Backend, target string, names []string) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	timeout := jobInfo.LockTimeout
+	if timeout <= 0 {
+		timeout = time.Hour
+	}
+	for _, name := range names {
+		marker, rerr := readLockMarker(ctx, backend, name)
+		if rerr != nil {
+			log.AppLogger.Errorf("Could not read the lock %s in %s due to error - %v", name, target, rerr)
+			return rerr
+		}
+		if marker != nil && !marker.stale(host, timeout, time.Now()) {
+			log.AppLogger.Errorf("Cannot go on while %s in %s is held by %s.", name, target, marker)
+			return errDatasetLocked
+		}
+	}
+	return nil
+}
+
+// refresh will rewrite the lock objects at every interval so other runs do not consider them stale.
+func (l *datasetLock) refresh(ctx context.Context, interval time.Duration) {
+	defer close(l.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			l.marker.Refreshed = time.Now()
+			for target, backend := range l.targets {
+				if err := writeLockMarker(ctx, backend, l.name, l.marker); err != nil && ctx.Err() == nil {
+					log.AppLogger.Warningf("Could not refresh the lock %s in %s - %v", l.name, target, err)
+				}
+			}
+		}
+	}
+}
+
+// release will delete the lock objects still held by this run, even when the backup was canceled, and release the
+// local lock. The local lock file is left in place, removing it could let two runs lock different files.
+func (l *datasetLock) release() {
+	ctx := context.Background()
+	if l.cancel != nil {
+		l.cancel()
+		<-l.done
+	}
+	for target, backend := range l.targets {
+		holder, err := readLockMarker(ctx, backend, l.name)
+		switch {
+		case err != nil:
+			log.AppLogger.Warningf("Could not read the lock %s in %s - %v", l.name, target, err)
+		case holder == nil || !holder.heldBy(l.marker):
+			log.AppLogger.Warningf("The lock %s in %s was broken by another run while backing up.", l.name, target)
+		default:
+			if err = backend.Delete(ctx, l.name); err != nil {
+				log.AppLogger.Warningf("Could not delete the lock %s in %s - %v", l.name, target, err)
+			}
+		}
+		backend.Close()
+	}
+
+	if l.file != nil {
+		if err := os.Remove(pidPath(l.path)); err != nil && !os.IsNotExist(err) {
+			log.AppLogger.Warningf("Could not delete the process holding the lock %s - %v", l.path, err)
+		}
+		if err := funlockFile(l.file); err != nil {
+			log.AppLogger.Warningf("Could not release lock %s: %v", l.path, err)
+		}
+		l.file.Close()
+	}
+	if l.host != nil {
+		if err := funlockFile(l.host); err != nil {
+			log.AppLogger.Warningf("Could not release the lock of the host: %v", err)
+		}
+		l.host.Close()
+	}
+}
+
+// readLockMarker will download and decode the lock object, returning nil if there is none.
+func readLockMarker(ctx context.Context, backend backends.Backend, name string) (*lockMarker, error) {
+	exists, err := objectExists(ctx, backend, name)
+	if err != nil || !exists {
+		return nil, err
+	}
+	r, err := backend.Download(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	marker := new(lockMarker)
+	if err = json.NewDecoder(r).Decode(marker); err != nil {
+		return nil, fmt.Errorf("could not decode the lock %s - %v", name, err)
+	}
+	return marker, nil
+}
+
+// writeLockMarker will encode the marker and upload it as the lock object, replacing any existing one.
+func writeLockMarker(ctx context.Context, backend backends.Backend, name string, marker *lockMarker) error {
+	// Lock objects are small, keep them in memory so nothing is written to disk, as with the --noCache option
+	vol := files.CreateMemoryVolume()
+	if err := json.NewEncoder(vol).Encode(marker); err != nil {
+		_ = vol.Close()
+		return err
+	}
+	if err := vol.Close(); err != nil {
+		return err
+	}
+	vol.ObjectName = name
+	if err := vol.OpenVolume(); err != nil {
+		return err
+	}
+	defer vol.Close()
+	return backend.Upload(ctx, vol)
+}
@@ -0,0 +1,193 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// manifestDBName is the name of the database, in the working directory, holding the decoded manifests of each target.
+const manifestDBName = "manifests.db"
+
+// Only one handle to the database can be opened at a time, even within the process
+var manifestDBMutex sync.Mutex
+
+// cachedManifest is a decoded manifest along with the digest of the manifest file it was decoded from.
+type cachedManifest struct {
+	Digest   string
+	Manifest *files.JobInfo
+}
+
+// readManifests will decode the manifests found in the local cache dir of a target. When the manifest database is
+// enabled, manifests that were decoded before are read from it instead of being decrypted and verified again. The
+// database holds a bucket per target, with a bucket per dataset of the manifests backing it up.
+func readManifests(ctx context.Context, localCachePath string, manifests []string, j *files.JobInfo) ([]*files.JobInfo, error) {
+	if !config.ManifestDB {
+		decodedManifests := make([]*files.JobInfo, 0, len(manifests))
+		for _, manifest := range manifests {
+			manifestPath := filepath.Join(localCachePath, manifest)
+			decodedManifest, err := readManifest(ctx, manifestPath, j)
+			if err != nil {
+				log.AppLogger.Errorf("Could not read manifest %s due to error - %v", manifestPath, err)
+				return nil, err
+			}
+			decodedManifests = append(decodedManifests, decodedManifest)
+		}
+		return decodedManifests, nil
+	}
+
+	manifestDBMutex.Lock()
+	defer manifestDBMutex.Unlock()
+
+	db, err := bolt.Open(filepath.Join(config.WorkingDir, manifestDBName), 0600, &bolt.Options{Timeout: time.Minute})
+	if err != nil {
+		log.AppLogger.Errorf("Could not open the manifest database due to error - %v", err)
+		return nil, err
+	}
+	defer db.Close()
+
+	target := []byte(filepath.Base(localCachePath))
+	cached, err := loadCachedManifests(db, target)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the manifest database due to error - %v", err)
+		return nil, err
+	}
+
+	decodedManifests := make([]*files.JobInfo, 0, len(manifests))
+	updated := make(map[string]*cachedManifest)
+	for _, manifest := range manifests {
+		manifestPath := filepath.Join(localCachePath, manifest)
+		digest, derr := fileDigest(manifestPath)
+		if derr != nil {
+			return nil, derr
+		}
+		if entry, ok := cached[manifest]; ok && entry.Digest == digest {
+			decodedManifests = append(decodedManifests, entry.Manifest)
+			delete(cached, manifest)
+			continue
+		}
+
+		decodedManifest, rerr := readManifest(ctx, manifestPath, j)
+		if rerr != nil {
+			log.AppLogger.Errorf("Could not read manifest %s due to error - %v", manifestPath, rerr)
+			return nil, rerr
+		}
+		decodedManifests = append(decodedManifests, decodedManifest)
+		updated[manifest] = &cachedManifest{Digest: digest, Manifest: decodedManifest}
+	}
+
+	// What is left in cached are manifests that no longer exist, or changed, and were superseded
+	if len(updated) > 0 || len(cached) > 0 {
+		log.AppLogger.Debugf("Updating %d and removing %d manifests in the manifest database.", len(updated), len(cached))
+		if err = storeCachedManifests(db, target, updated, cached); err != nil {
+			log.AppLogger.Errorf("Could not update the manifest database due to error - %v", err)
+			return nil, err
+		}
+	}
+
+	return decodedManifests, nil
+}
+
+// loadCachedManifests reads all the manifests of the target in the database, by the name of their file in the cache.
+func loadCachedManifests(db *bolt.DB, target []byte) (map[string]*cachedManifest, error) {
+	cached := make(map[string]*cachedManifest)
+	err := db.View(func(tx *bolt.Tx) error {
+		targetBucket := tx.Bucket(target)
+		if targetBucket == nil {
+			return nil
+		}
+		return targetBucket.ForEach(func(dataset, _ []byte) error {
+			datasetBucket := targetBucket.Bucket(dataset)
+			if datasetBucket == nil {
+				return nil
+			}
+			return datasetBucket.ForEach(func(name, value []byte) error {
+				entry := new(cachedManifest)
+				if err := json.Unmarshal(value, entry); err != nil {
+					return fmt.Errorf("could not decode the manifest %s of %s - %v", name, dataset, err)
+				}
+				cached[string(name)] = entry
+				return nil
+			})
+		})
+	})
+	return cached, err
+}
+
+// storeCachedManifests adds the updated manifests to the database and deletes the removed ones.
+func storeCachedManifests(db *bolt.DB, target []byte, updated, removed map[string]*cachedManifest) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		targetBucket, err := tx.CreateBucketIfNotExists(target)
+		if err != nil {
+			return err
+		}
+		for name, entry := range removed {
+			if datasetBucket := targetBucket.Bucket([]byte(entry.Manifest.VolumeName)); datasetBucket != nil {
+				if err = datasetBucket.Delete([]byte(name)); err != nil {
+					return err
+				}
+			}
+		}
+		for name, entry := range updated {
+			datasetBucket, berr := targetBucket.CreateBucketIfNotExists([]byte(entry.Manifest.VolumeName))
+			if berr != nil {
+				return berr
+			}
+			value, merr := json.Marshal(entry)
+			if merr != nil {
+				return merr
+			}
+			if err = datasetBucket.Put([]byte(name), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// fileDigest returns the SHA256 hash of the file, to tell when a cached manifest changed.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
@@ -0,0 +1,100 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// MigrateManifests will upgrade every manifest in the target written with an older schema version to the current
+// one, replacing them in place. When dryRun is set the manifests that would be upgraded are reported instead.
+func MigrateManifests(pctx context.Context, jobInfo *files.JobInfo, target string, dryRun bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Manifests are uploaded one at a time
+	uploadBuffer := make(chan bool, 1)
+	defer close(uploadBuffer)
+	backend, berr := prepareBackend(ctx, jobInfo, target, uploadBuffer)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	localCachePath, cerr := getCacheDir(jobInfo, target)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	if serr != nil {
+		log.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return serr
+	}
+
+	decodedManifests, derr := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if derr != nil {
+		return derr
+	}
+
+	migrated := 0
+	for _, manifest := range decodedManifests {
+		from := manifest.SchemaVersion
+		changed, err := manifest.MigrateSchema()
+		if err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+
+		manifest.ManifestPrefix = jobInfo.ManifestPrefix
+		manifest.ObjectPrefix = jobInfo.ObjectPrefix
+		manifest.CopyKeys(jobInfo)
+		name := manifest.ManifestObjectName()
+		if dryRun {
+			log.AppLogger.Noticef("Would migrate %s from schema version %d to %d.", name, from, manifest.SchemaVersion)
+			migrated++
+			continue
+		}
+
+		if err = writeManifest(ctx, manifest, backend, target); err != nil {
+			log.AppLogger.Errorf("Could not replace the manifest %s in %s due to error - %v", name, target, err)
+			return err
+		}
+		log.AppLogger.Infof("Migrated %s from schema version %d to %d.", name, from, manifest.SchemaVersion)
+		migrated++
+	}
+
+	if dryRun {
+		log.AppLogger.Noticef("%d of %d manifests would be migrated to schema version %d.",
+			migrated, len(decodedManifests), files.ManifestSchemaVersion)
+		return nil
+	}
+	log.AppLogger.Noticef("Migrated %d of %d manifests to schema version %d.",
+		migrated, len(decodedManifests), files.ManifestSchemaVersion)
+	return nil
+}
@@ -0,0 +1,147 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"path"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// Sync will copy any volumes and manifests that are missing or corrupt in the destination target from the
+// source target. Objects that are also missing or corrupt in the source are reported and skipped.
+func Sync(pctx context.Context, jobInfo *files.JobInfo, source, destination string) error {
+	return syncTargets(pctx, jobInfo, source, destination, "", false)
+}
+
+// Replicate will recreate every backup set found in the source target, optionally limited to the volumes
+// matching the glob provided, in the destination target. Objects already intact in the destination are
+// skipped so an interrupted replication can be resumed by running it again. When dryRun is set the objects
+// that would be copied are reported without copying anything.
+func Replicate(pctx context.Context, jobInfo *files.JobInfo, source, destination, volumeGlob string, dryRun bool) error {
+	return syncTargets(pctx, jobInfo, source, destination, volumeGlob, dryRun)
+}
+
+// nolint:funlen,gocyclo // Difficult to break this up
+func syncTargets(pctx context.Context, jobInfo *files.JobInfo, source, destination, volumeGlob string, dryRun bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	srcBackend, berr := prepareBackend(ctx, jobInfo, source, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", source, berr)
+		return berr
+	}
+	defer srcBackend.Close()
+
+	uploadBuffer := make(chan bool, jobInfo.MaxParallelUploads)
+	defer close(uploadBuffer)
+	dstBackend, berr := prepareBackend(ctx, jobInfo, destination, uploadBuffer)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", destination, berr)
+		return berr
+	}
+	defer dstBackend.Close()
+
+	srcState, serr := loadTargetState(ctx, jobInfo, source, srcBackend)
+	if serr != nil {
+		return serr
+	}
+	dstState, serr := loadTargetState(ctx, jobInfo, destination, dstBackend)
+	if serr != nil {
+		return serr
+	}
+
+	if volumeGlob != "" {
+		for _, state := range []*targetState{srcState, dstState} {
+			for name, manifest := range state.manifests {
+				if matched, _ := path.Match(volumeGlob, manifest.VolumeName); !matched {
+					delete(state.manifests, name)
+				}
+			}
+		}
+		log.AppLogger.Infof("Found %d backup sets for volumes matching %s in %s.", len(srcState.manifests), volumeGlob, source)
+	}
+
+	compared, err := compareTargetStates(ctx, false, srcState, dstState)
+	if err != nil {
+		return err
+	}
+	divergences := compared.Divergences
+
+	brokenInSource := make(map[string]bool)
+	for _, d := range divergences {
+		if d.Target == source {
+			brokenInSource[d.ObjectName] = true
+		}
+	}
+
+	var volumes, manifests []string
+	for _, d := range divergences {
+		if d.Target != destination {
+			continue
+		}
+		if brokenInSource[d.ObjectName] {
+			log.AppLogger.Warningf("Cannot repair %s as it is %s in the destination and not intact in the source either.", d.ObjectName, d.Reason)
+			continue
+		}
+		if dryRun {
+			log.AppLogger.Noticef("Would copy %s, it is %s in the destination.", d.ObjectName, d.Reason)
+		} else {
+			log.AppLogger.Infof("Will repair %s, it is %s in the destination.", d.ObjectName, d.Reason)
+		}
+		if d.IsManifest {
+			manifests = append(manifests, d.ObjectName)
+		} else {
+			volumes = append(volumes, d.ObjectName)
+		}
+	}
+
+	if len(volumes)+len(manifests) == 0 {
+		log.AppLogger.Noticef("Nothing to sync, the destination is up to date.")
+		return nil
+	}
+
+	if dryRun {
+		log.AppLogger.Noticef("Dry run: would copy %d volumes and %d manifests from %s to %s.", len(volumes), len(manifests), source, destination)
+		return nil
+	}
+
+	if err = srcBackend.PreDownload(ctx, append(append([]string{}, volumes...), manifests...)); err != nil {
+		log.AppLogger.Errorf("Error trying to pre download volumes - %v", err)
+		return err
+	}
+
+	log.AppLogger.Noticef("Syncing %d volumes and %d manifests from %s to %s.", len(volumes), len(manifests), source, destination)
+
+	// Copy all volumes before any manifests so partially synced backup sets are never visible in the destination
+	for _, objects := range [][]string{volumes, manifests} {
+		if err = copyObjects(ctx, jobInfo, srcBackend, dstBackend, objects); err != nil {
+			log.AppLogger.Errorf("Could not finish sync operation due to error, aborting: %v", err)
+			return err
+		}
+	}
+
+	log.AppLogger.Noticef("Done.")
+	return nil
+}
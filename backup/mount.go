@@ -0,0 +1,260 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// The files found in the directory of each backup set of a mounted target.
+const (
+	mountStreamName   = "stream.zfs"
+	mountManifestName = "manifest.json"
+)
+
+// mountDataset is a directory of a mounted target, holding the backup sets of a dataset and the directories of its
+// child datasets.
+type mountDataset struct {
+	children map[string]*mountDataset
+	sets     map[string]*files.JobInfo
+}
+
+func newMountDataset() *mountDataset {
+	return &mountDataset{children: make(map[string]*mountDataset), sets: make(map[string]*files.JobInfo)}
+}
+
+// buildMountTree arranges the manifests by dataset, nesting the directories of child datasets under their parents as
+// they are in the pool.
+func buildMountTree(manifests []*files.JobInfo) *mountDataset {
+	root := newMountDataset()
+	for _, manifest := range manifests {
+		dir := root
+		for _, part := range strings.Split(manifest.VolumeName, "/") {
+			if part == "" {
+				continue
+			}
+			child, ok := dir.children[part]
+			if !ok {
+				child = newMountDataset()
+				dir.children[part] = child
+			}
+			dir = child
+		}
+		dir.sets[mountSetName(manifest)] = manifest
+	}
+	return root
+}
+
+// mountSetName names the directory of a backup set. It starts with an @ so it cannot clash with the directory of a
+// child dataset, and incremental backup sets are named after the range of snapshots they hold.
+func mountSetName(manifest *files.JobInfo) string {
+	if manifest.IncrementalSnapshot.Name == "" {
+		return "@" + manifest.BaseSnapshot.Name
+	}
+	return "@" + manifest.IncrementalSnapshot.Name + "..@" + manifest.BaseSnapshot.Name
+}
+
+// streamReader reads the zfs stream of a backup set back from its volumes. When every volume records the size of its
+// share of the stream, only the volume holding the offset read is downloaded, otherwise the stream is read from the
+// start of the first volume. The volumes downloaded are checked against the checksums in the manifest.
+type streamReader struct {
+	ctx       context.Context
+	manifest  *files.JobInfo
+	backend   backends.Backend
+	target    string
+	offsets   []uint64
+	size      uint64
+	unwrapped bool
+
+	mu     sync.Mutex
+	index  int
+	volume *files.VolumeInfo
+	pos    uint64
+}
+
+func newStreamReader(ctx context.Context, manifest *files.JobInfo, backend backends.Backend, target string) *streamReader {
+	r := &streamReader{ctx: ctx, manifest: manifest, backend: backend, target: target, index: -1}
+	offsets := make([]uint64, 0, len(manifest.Volumes))
+	for _, vol := range manifest.Volumes {
+		if vol.ZFSStreamBytes == 0 {
+			offsets = nil
+			break
+		}
+		offsets = append(offsets, r.size)
+		r.size += vol.ZFSStreamBytes
+	}
+	r.offsets = offsets
+	if r.offsets == nil {
+		r.size = manifest.ZFSStreamBytes
+	}
+	return r
+}
+
+// ReadAt reads the stream from the offset provided, opening the volume holding it if it is not the one being read.
+func (r *streamReader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if r.offsets != nil && uint64(off) >= r.size {
+		return 0, io.EOF
+	}
+	if err := r.seek(uint64(off)); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for n < len(p) {
+		if r.volume == nil {
+			return n, io.EOF
+		}
+		m, err := r.volume.Read(p[n:])
+		n += m
+		r.pos += uint64(m)
+		if errors.Is(err, io.EOF) {
+			err = r.next()
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// seek positions the reader at the offset provided, reopening the volume holding it when it was already read past.
+func (r *streamReader) seek(off uint64) error {
+	reopen := r.index < 0 || off < r.pos
+	if r.offsets != nil && r.index+1 < len(r.offsets) && off >= r.offsets[r.index+1] {
+		reopen = true
+	}
+	if reopen {
+		index, start := 0, uint64(0)
+		if r.offsets != nil {
+			index = sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > off }) - 1
+			if index < 0 {
+				index = 0
+			} else {
+				start = r.offsets[index]
+			}
+		}
+		if err := r.open(index, start); err != nil {
+			return err
+		}
+	}
+
+	for r.volume != nil && r.pos < off {
+		n, err := io.CopyN(io.Discard, r.volume, int64(off-r.pos))
+		r.pos += uint64(n)
+		if errors.Is(err, io.EOF) {
+			err = r.next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// next moves on to the volume after the one read to its end. The volume is closed first so an error checking its
+// signature, or from an external decompressor, is not missed.
+func (r *streamReader) next() error {
+	if err := r.volume.Close(); err != nil {
+		log.AppLogger.Errorf("Could not read volume %s back - %v", r.volume.ObjectName, err)
+		return err
+	}
+	return r.open(r.index+1, r.pos)
+}
+
+// open starts reading the volume at the index provided, which starts at the stream offset given. The volume already
+// downloaded is decoded again from its start rather than downloaded again.
+func (r *streamReader) open(index int, start uint64) error {
+	if r.volume != nil && r.index != index {
+		r.release()
+	} else if r.volume != nil {
+		if err := r.volume.Close(); err != nil {
+			log.AppLogger.Debugf("Could not close volume %s read partially - %v", r.volume.ObjectName, err)
+		}
+	}
+
+	r.index, r.pos = index, start
+	if index >= len(r.manifest.Volumes) {
+		return nil
+	}
+	if len(r.manifest.WrappedKeys) > 0 && !r.unwrapped {
+		identity, err := unwrapDataKey(r.ctx, r.manifest.WrappedKeys, r.target)
+		if err != nil {
+			log.AppLogger.Errorf("Could not unwrap the data key of the backup - %v", err)
+			return err
+		}
+		manifest := *r.manifest
+		manifest.AgeIdentities = []age.Identity{identity}
+		r.manifest, r.unwrapped = &manifest, true
+	}
+	if r.volume == nil {
+		local, err := downloadVolume(r.ctx, r.backend, r.manifest.Volumes[index])
+		if err != nil {
+			log.AppLogger.Errorf("Could not download volume %s - %v", r.manifest.Volumes[index].ObjectName, err)
+			return err
+		}
+		r.volume = local
+	}
+	if err := r.volume.Extract(r.ctx, r.manifest, false); err != nil {
+		log.AppLogger.Errorf("Could not decrypt volume %s - %v", r.volume.ObjectName, err)
+		r.release()
+		return err
+	}
+	return nil
+}
+
+// release closes and deletes the volume being read, if any.
+func (r *streamReader) release() {
+	if r.volume == nil {
+		return
+	}
+	if err := r.volume.Close(); err != nil {
+		log.AppLogger.Debugf("Could not close volume %s read partially - %v", r.volume.ObjectName, err)
+	}
+	if err := r.volume.DeleteVolume(); err != nil {
+		log.AppLogger.Warningf("Could not delete the temporary file of %s due to error - %v", r.volume.ObjectName, err)
+	}
+	r.volume = nil
+}
+
+// Close releases the volume being read.
+func (r *streamReader) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.release()
+	return nil
+}
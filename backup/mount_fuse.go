@@ -0,0 +1,182 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux || darwin
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// Mount will mount a read-only view of every backup set found in the target at the mountpoint provided. Each dataset
+// is a directory holding a directory per backup set, with its manifest and its reassembled zfs stream, whose volumes
+// are only downloaded when it is read. Mount returns once the mountpoint is unmounted or on an interrupt.
+func Mount(pctx context.Context, jobInfo *files.JobInfo, target, mountpoint string) error {
+	ctx, stop := signal.NotifyContext(pctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	backend, err := prepareBackend(ctx, jobInfo, target, nil)
+	if err != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, err)
+		return err
+	}
+	defer backend.Close()
+
+	root := &mountDir{ctx: ctx, backend: backend, target: target, dataset: buildMountTree(manifests)}
+	server, err := fs.Mount(mountpoint, root, &fs.Options{
+		MountOptions: fuse.MountOptions{FsName: "zfsbackup", Name: "zfsbackup", Options: []string{"ro"}, DirectMount: true},
+	})
+	if err != nil {
+		log.AppLogger.Errorf("Could not mount target %s at %s - %v", target, mountpoint, err)
+		return err
+	}
+	log.AppLogger.Noticef("Mounted %d backup sets of %s at %s, unmount it or interrupt to stop.", len(manifests), target, mountpoint)
+
+	unmounted := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if uerr := server.Unmount(); uerr != nil {
+				log.AppLogger.Warningf("Could not unmount %s - %v", mountpoint, uerr)
+			}
+		case <-unmounted:
+		}
+	}()
+	server.Wait()
+	close(unmounted)
+
+	return nil
+}
+
+// mountDir is the directory of a dataset in a mounted target.
+type mountDir struct {
+	fs.Inode
+	ctx     context.Context
+	backend backends.Backend
+	target  string
+	dataset *mountDataset
+}
+
+var _ = (fs.NodeOnAdder)((*mountDir)(nil))
+
+// OnAdd adds the directories of the child datasets and of the backup sets of the dataset.
+func (d *mountDir) OnAdd(ctx context.Context) {
+	for name, child := range d.dataset.children {
+		node := &mountDir{ctx: d.ctx, backend: d.backend, target: d.target, dataset: child}
+		d.AddChild(name, d.NewPersistentInode(ctx, node, fs.StableAttr{Mode: fuse.S_IFDIR}), false)
+	}
+
+	for name, manifest := range d.dataset.sets {
+		set := d.NewPersistentInode(ctx, &fs.Inode{}, fs.StableAttr{Mode: fuse.S_IFDIR})
+		d.AddChild(name, set, false)
+
+		data, err := json.MarshalIndent(manifest, "", "  ")
+		if err != nil {
+			log.AppLogger.Warningf("Could not marshal the manifest of %s to JSON - %v", backupSetName(manifest), err)
+		} else {
+			attr := fuse.Attr{Mode: 0o444}
+			attr.SetTimes(nil, &manifest.EndTime, nil)
+			file := &fs.MemRegularFile{Data: data, Attr: attr}
+			set.AddChild(mountManifestName, set.NewPersistentInode(ctx, file, fs.StableAttr{}), false)
+		}
+
+		stream := &mountStream{ctx: d.ctx, backend: d.backend, target: d.target, manifest: manifest}
+		set.AddChild(mountStreamName, set.NewPersistentInode(ctx, stream, fs.StableAttr{}), false)
+	}
+}
+
+// mountStream is the reassembled zfs stream of a backup set in a mounted target.
+type mountStream struct {
+	fs.Inode
+	ctx      context.Context
+	backend  backends.Backend
+	target   string
+	manifest *files.JobInfo
+}
+
+var (
+	_ = (fs.NodeGetattrer)((*mountStream)(nil))
+	_ = (fs.NodeOpener)((*mountStream)(nil))
+)
+
+// Getattr reports the size of the zfs stream and the time the backup set was completed.
+func (s *mountStream) Getattr(ctx context.Context, fh fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
+	out.Mode = 0o444
+	out.Size = newStreamReader(s.ctx, s.manifest, s.backend, s.target).size
+	out.SetTimes(nil, &s.manifest.EndTime, nil)
+	return fs.OK
+}
+
+// Open will start a new reader of the zfs stream, so every open file reads the volumes on its own. The kernel is told
+// not to trust the size reported when the volumes do not record their share of the stream.
+func (s *mountStream) Open(ctx context.Context, flags uint32) (fs.FileHandle, uint32, syscall.Errno) {
+	if flags&(syscall.O_WRONLY|syscall.O_RDWR) != 0 {
+		return nil, 0, syscall.EROFS
+	}
+	reader := newStreamReader(s.ctx, s.manifest, s.backend, s.target)
+	if reader.offsets == nil {
+		return &mountStreamHandle{name: backupSetName(s.manifest), reader: reader}, fuse.FOPEN_DIRECT_IO, fs.OK
+	}
+	return &mountStreamHandle{name: backupSetName(s.manifest), reader: reader}, fuse.FOPEN_KEEP_CACHE, fs.OK
+}
+
+// mountStreamHandle is an open zfs stream of a mounted target.
+type mountStreamHandle struct {
+	name   string
+	reader *streamReader
+}
+
+var (
+	_ = (fs.FileReader)((*mountStreamHandle)(nil))
+	_ = (fs.FileReleaser)((*mountStreamHandle)(nil))
+)
+
+func (h *mountStreamHandle) Read(ctx context.Context, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	n, err := h.reader.ReadAt(dest, off)
+	if err != nil && !errors.Is(err, io.EOF) {
+		log.AppLogger.Errorf("Could not read the zfs stream of %s at offset %d - %v", h.name, off, err)
+		return nil, syscall.EIO
+	}
+	return fuse.ReadResultData(dest[:n]), fs.OK
+}
+
+func (h *mountStreamHandle) Release(ctx context.Context) syscall.Errno {
+	_ = h.reader.Close()
+	return fs.OK
+}
@@ -0,0 +1,225 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var errReplicationIncomplete = errors.New("could not replicate every backup set to all of its pending targets")
+
+// ReplicatePending will push every backup set in the source target that has secondary targets pending in its
+// manifest, optionally limited to the volumes matching the glob provided, to those targets. The manifest in the
+// source target is updated as each target completes so an interrupted run can be resumed by running it again.
+// When dryRun is set the backup sets that would be replicated are reported without copying anything.
+// nolint:funlen,gocyclo // Difficult to break this up
+func ReplicatePending(pctx context.Context, jobInfo *files.JobInfo, source, volumeGlob string, dryRun bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// The source target is uploaded to as well when the manifests recording the progress are rewritten
+	uploadBuffer := make(chan bool, jobInfo.MaxParallelUploads)
+	defer close(uploadBuffer)
+	srcBackend, berr := prepareBackend(ctx, jobInfo, source, uploadBuffer)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", source, berr)
+		return berr
+	}
+	defer srcBackend.Close()
+
+	srcState, serr := loadTargetState(ctx, jobInfo, source, srcBackend)
+	if serr != nil {
+		return serr
+	}
+
+	names := make([]string, 0, len(srcState.manifests))
+	for name, manifest := range srcState.manifests {
+		if len(manifest.PendingTargets) == 0 {
+			continue
+		}
+		if matched, _ := path.Match(volumeGlob, manifest.VolumeName); volumeGlob != "" && !matched {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if len(names) == 0 {
+		log.AppLogger.Noticef("Nothing to replicate, no backup sets in %s have pending targets.", source)
+		return nil
+	}
+
+	dstBackends := make(map[string]backends.Backend)
+	defer func() {
+		for _, b := range dstBackends {
+			b.Close()
+		}
+	}()
+
+	failed := false
+	for _, name := range names {
+		manifest := srcState.manifests[name]
+		remaining := make([]string, 0, len(manifest.PendingTargets))
+		for _, target := range manifest.PendingTargets {
+			if dryRun {
+				log.AppLogger.Noticef("Would replicate %s (%d volumes) to %s.", name, len(manifest.Volumes), target)
+				continue
+			}
+
+			dstBackend, ok := dstBackends[target]
+			if !ok {
+				if dstBackend, berr = prepareBackend(ctx, jobInfo, target, uploadBuffer); berr != nil {
+					log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+					failed = true
+					remaining = append(remaining, target)
+					continue
+				}
+				dstBackends[target] = dstBackend
+			}
+
+			if err := replicateBackupSet(ctx, jobInfo, manifest, srcBackend, dstBackend, target); err != nil {
+				log.AppLogger.Errorf("Could not replicate %s to %s due to error - %v", name, target, err)
+				failed = true
+				remaining = append(remaining, target)
+				continue
+			}
+			log.AppLogger.Infof("Replicated %s to %s.", name, target)
+		}
+
+		if dryRun || len(remaining) == len(manifest.PendingTargets) {
+			continue
+		}
+
+		// Record the progress made in the source target
+		manifest.PendingTargets = remaining
+		if err := writeManifest(ctx, manifest, srcBackend, source); err != nil {
+			log.AppLogger.Errorf("Could not update the manifest %s in %s due to error - %v", name, source, err)
+			return err
+		}
+	}
+
+	if failed {
+		return errReplicationIncomplete
+	}
+
+	log.AppLogger.Noticef("Done.")
+	return nil
+}
+
+// replicateBackupSet will copy the volumes of the backup set missing from the destination target followed by
+// its manifest. The destination's copy of the manifest does not carry any pending targets.
+func replicateBackupSet(
+	ctx context.Context, jobInfo, manifest *files.JobInfo, srcBackend, dstBackend backends.Backend, target string,
+) error {
+	existing, err := dstBackend.List(ctx, manifest.ObjectNamespace())
+	if err != nil {
+		return err
+	}
+	present := make(map[string]bool, len(existing))
+	for _, obj := range existing {
+		present[obj] = true
+	}
+
+	objects := make([]string, 0, len(manifest.Volumes))
+	for _, vol := range manifest.Volumes {
+		if !present[vol.ObjectName] {
+			objects = append(objects, vol.ObjectName)
+		}
+	}
+
+	if err = srcBackend.PreDownload(ctx, objects); err != nil {
+		return err
+	}
+	if err = copyObjects(ctx, jobInfo, srcBackend, dstBackend, objects); err != nil {
+		return err
+	}
+
+	pending := manifest.PendingTargets
+	manifest.PendingTargets = nil
+	defer func() { manifest.PendingTargets = pending }()
+
+	return writeManifest(ctx, manifest, dstBackend, target)
+}
+
+// writeManifest will encode the manifest provided and upload it to the target, updating the local cache as well. The
+// manifest it replaces is kept as a superseded generation.
+func writeManifest(ctx context.Context, manifest *files.JobInfo, backend backends.Backend, target string) error {
+	generation, err := supersedeManifest(ctx, backend, manifest)
+	if err != nil {
+		return fmt.Errorf("could not keep the manifest it replaces - %v", err)
+	}
+	manifest.ManifestGeneration = generation
+
+	vol, err := files.CreateManifestVolume(ctx, manifest)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if derr := vol.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete temporary manifest file - %v", derr)
+		}
+	}()
+
+	vol.IsFinalManifest = true
+	if err = files.EncodeManifest(vol, manifest); err != nil {
+		_ = vol.Close()
+		return err
+	}
+	if err = vol.Close(); err != nil {
+		return err
+	}
+	if err = vol.SignDetached(ctx, manifest); err != nil {
+		return err
+	}
+
+	localCachePath, err := getCacheDir(manifest, target)
+	if err != nil {
+		return err
+	}
+	// nolint:gosec // MD5 not used for cryptographic purposes here
+	manifestPath := filepath.Join(localCachePath, fmt.Sprintf("%x", md5.Sum([]byte(vol.ObjectName))))
+	if err = vol.CopyTo(manifestPath); err != nil {
+		return err
+	}
+	if err = cacheSignature(vol, manifestPath); err != nil {
+		return err
+	}
+
+	if err = vol.OpenVolume(); err != nil {
+		return err
+	}
+	defer vol.Close()
+
+	if err = backend.Upload(ctx, vol); err != nil {
+		return err
+	}
+	return replaceSignature(ctx, backend, vol)
+}
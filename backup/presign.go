@@ -0,0 +1,169 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// PresignedObject pairs an object in a target with a URL that can be used to download it.
+type PresignedObject struct {
+	ObjectName string
+	URL        string
+}
+
+// PresignedBackupSet holds the pre-signed URLs for every object that makes up a backup set.
+type PresignedBackupSet struct {
+	Snapshot    string
+	Incremental string `json:",omitempty"`
+	Manifest    PresignedObject
+	Volumes     []PresignedObject
+}
+
+// PresignedChain holds the pre-signed URLs for the backup sets needed to restore a backup set, from the full backup
+// it is based on to the backup set itself.
+type PresignedChain struct {
+	Expires    time.Time
+	BackupSets []PresignedBackupSet
+}
+
+// Presign will output time-limited URLs for the manifest and volumes of the backup set described by the jobInfo, and
+// of every backup set it is incremental from, so the whole chain can be restored. Downloading every object into a
+// directory, keeping the object names, will allow it to be restored from a file:// target.
+func Presign(pctx context.Context, jobInfo *files.JobInfo, expires time.Duration) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Prepare the backend client
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	presigner, ok := backend.(backends.Presigner)
+	if !ok {
+		log.AppLogger.Errorf("The target %s does not support generating pre-signed URLs.", target)
+		return backends.ErrUnsupported
+	}
+
+	manifest, merr := findBackupSet(ctx, jobInfo, target, backend)
+	if merr != nil {
+		return merr
+	}
+	chain, cerr := backupSetChain(manifest)
+	if cerr != nil {
+		return cerr
+	}
+
+	results := PresignedChain{
+		Expires:    time.Now().Add(expires),
+		BackupSets: make([]PresignedBackupSet, 0, len(chain)),
+	}
+	for _, set := range chain {
+		set.ManifestPrefix = jobInfo.ManifestPrefix
+		set.ObjectPrefix = jobInfo.ObjectPrefix
+		presigned, err := presignBackupSet(ctx, presigner, set, expires)
+		if err != nil {
+			return err
+		}
+		results.BackupSets = append(results.BackupSets, presigned)
+	}
+
+	if config.JSONOutput {
+		j, jerr := json.Marshal(results)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	log.AppLogger.Noticef(
+		"The following URLs expire at %v. Download each object to a directory using the name provided to restore from it with a file:// target.",
+		results.Expires,
+	)
+	for _, set := range results.BackupSets {
+		fmt.Fprintf(config.Stdout, "%s\t%s\n", set.Manifest.ObjectName, set.Manifest.URL)
+		for _, vol := range set.Volumes {
+			fmt.Fprintf(config.Stdout, "%s\t%s\n", vol.ObjectName, vol.URL)
+		}
+	}
+
+	return nil
+}
+
+// backupSetChain returns the backup sets needed to restore the backup set provided, from the full backup it is based
+// on to the backup set itself. An error is returned if any backup set it is incremental from is missing.
+func backupSetChain(manifest *files.JobInfo) ([]*files.JobInfo, error) {
+	chain := []*files.JobInfo{manifest}
+	for set := manifest; set.IncrementalSnapshot.Name != ""; set = set.ParentSnap {
+		if set.ParentSnap == nil {
+			log.AppLogger.Errorf(
+				"The backup set %s of %s is incremental from %s, which could not be found in the target.",
+				set.BaseSnapshot.Name, set.VolumeName, set.IncrementalSnapshot.Name,
+			)
+			return nil, errors.New("could not find parent snapshot")
+		}
+		chain = append([]*files.JobInfo{set.ParentSnap}, chain...)
+	}
+	return chain, nil
+}
+
+// presignBackupSet will generate pre-signed URLs for the manifest and volumes of the backup set.
+func presignBackupSet(ctx context.Context, presigner backends.Presigner, set *files.JobInfo, expires time.Duration) (PresignedBackupSet, error) {
+	presigned := PresignedBackupSet{
+		Snapshot:    set.BaseSnapshot.Name,
+		Incremental: set.IncrementalSnapshot.Name,
+		Manifest:    PresignedObject{ObjectName: set.ManifestObjectName()},
+		Volumes:     make([]PresignedObject, 0, len(set.Volumes)),
+	}
+
+	var err error
+	if presigned.Manifest.URL, err = presigner.PresignURL(ctx, presigned.Manifest.ObjectName, expires); err != nil {
+		log.AppLogger.Errorf("Could not generate pre-signed URL for %s due to error - %v.", presigned.Manifest.ObjectName, err)
+		return presigned, err
+	}
+
+	for _, vol := range set.Volumes {
+		u, perr := presigner.PresignURL(ctx, vol.ObjectName, expires)
+		if perr != nil {
+			log.AppLogger.Errorf("Could not generate pre-signed URL for %s due to error - %v.", vol.ObjectName, perr)
+			return presigned, perr
+		}
+		presigned.Volumes = append(presigned.Volumes, PresignedObject{ObjectName: vol.ObjectName, URL: u})
+	}
+
+	return presigned, nil
+}
@@ -0,0 +1,362 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/term"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+const (
+	// progressRefreshInterval is how often the progress line is redrawn on a terminal
+	progressRefreshInterval = time.Second
+	// progressLogInterval is how often progress is logged when not attached to a terminal
+	progressLogInterval = 30 * time.Second
+)
+
+// The stages a volume goes through during a receive, it is decrypted, decompressed and fed to zfs while receiving.
+const (
+	volumeDownloading = "downloading"
+	volumeDownloaded  = "downloaded"
+	volumeReceiving   = "receiving"
+)
+
+// ProgressReport is the progress of a send or receive, as output with the jsonOutput option.
+type ProgressReport struct {
+	Action        string
+	Step          string `json:",omitempty"`
+	StreamedBytes uint64
+	TotalBytes    uint64           `json:",omitempty"`
+	WrittenBytes  uint64           `json:",omitempty"`
+	TransferRate  uint64           `json:",omitempty"`
+	ETASeconds    int64            `json:",omitempty"`
+	Volumes       []VolumeProgress `json:",omitempty"`
+}
+
+// VolumeProgress is the stage a volume being restored is in.
+type VolumeProgress struct {
+	ObjectName   string
+	VolumeNumber int64
+	Size         uint64
+	Stage        string
+}
+
+// progress tracks how far along a send or receive is. All methods are safe to call on a nil
+// progress so callers do not need to check if progress reporting is enabled.
+type progress struct {
+	action      string
+	transfer    string
+	start       time.Time
+	total       uint64
+	streamed    uint64
+	written     uint64
+	transferred uint64
+
+	mu      sync.Mutex
+	step    string
+	volumes []VolumeProgress
+}
+
+// newProgress returns a progress tracker if progress reporting was requested, nil otherwise. The action
+// describes what is done with the zfs stream and transfer what is done with the volumes (e.g. upload).
+func newProgress(action, transfer string) *progress {
+	if !config.ShowProgress {
+		return nil
+	}
+	return &progress{action: action, transfer: transfer, start: time.Now()}
+}
+
+func (p *progress) setTotal(n uint64) {
+	if p != nil {
+		atomic.StoreUint64(&p.total, n)
+	}
+}
+
+func (p *progress) setStreamed(n uint64) {
+	if p != nil {
+		atomic.StoreUint64(&p.streamed, n)
+	}
+}
+
+func (p *progress) addStreamed(n uint64) {
+	if p != nil {
+		atomic.AddUint64(&p.streamed, n)
+	}
+}
+
+func (p *progress) addWritten(n uint64) {
+	if p != nil {
+		atomic.AddUint64(&p.written, n)
+	}
+}
+
+func (p *progress) addTransferred(n uint64) {
+	if p != nil {
+		atomic.AddUint64(&p.transferred, n)
+	}
+}
+
+// setStep will set the step shown ahead of the progress, e.g. the backup set of a chain being restored.
+func (p *progress) setStep(step string) {
+	if p != nil {
+		p.mu.Lock()
+		p.step = step
+		p.mu.Unlock()
+	}
+}
+
+// setVolumeStage will record the stage the volume is in, adding the volume to the ones shown if needed.
+func (p *progress) setVolumeStage(vol *files.VolumeInfo, stage string) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for idx := range p.volumes {
+		if p.volumes[idx].ObjectName == vol.ObjectName {
+			p.volumes[idx].Stage = stage
+			return
+		}
+	}
+	p.volumes = append(p.volumes, VolumeProgress{
+		ObjectName:   vol.ObjectName,
+		VolumeNumber: vol.VolumeNumber,
+		Size:         vol.Size,
+		Stage:        stage,
+	})
+}
+
+// volumeDownloaded will mark the volume as downloaded, unless it is already being received. Volumes are handed
+// over before their download completes when streaming, so this may be called after the receive started or finished.
+func (p *progress) volumeDownloaded(vol *files.VolumeInfo) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for idx := range p.volumes {
+		if p.volumes[idx].ObjectName == vol.ObjectName && p.volumes[idx].Stage == volumeDownloading {
+			p.volumes[idx].Stage = volumeDownloaded
+		}
+	}
+}
+
+// volumeDone will stop showing the volume once it was received.
+func (p *progress) volumeDone(vol *files.VolumeInfo) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for idx := range p.volumes {
+		if p.volumes[idx].ObjectName == vol.ObjectName {
+			p.volumes = append(p.volumes[:idx], p.volumes[idx+1:]...)
+			return
+		}
+	}
+}
+
+// Write counts the bytes written as part of the zfs stream.
+func (p *progress) Write(b []byte) (int, error) {
+	p.addStreamed(uint64(len(b)))
+	return len(b), nil
+}
+
+// report returns a snapshot of the current progress.
+func (p *progress) report() *ProgressReport {
+	r := &ProgressReport{
+		Action:        p.action,
+		StreamedBytes: atomic.LoadUint64(&p.streamed),
+		TotalBytes:    atomic.LoadUint64(&p.total),
+		WrittenBytes:  atomic.LoadUint64(&p.written),
+	}
+	elapsed := time.Since(p.start)
+	if transferred := atomic.LoadUint64(&p.transferred); transferred > 0 && elapsed > 0 {
+		r.TransferRate = uint64(float64(transferred) / elapsed.Seconds())
+	}
+	if r.TotalBytes > r.StreamedBytes && r.StreamedBytes > 0 {
+		eta := time.Duration(float64(elapsed) * float64(r.TotalBytes-r.StreamedBytes) / float64(r.StreamedBytes))
+		r.ETASeconds = int64(eta.Round(time.Second).Seconds())
+	}
+
+	p.mu.Lock()
+	r.Step = p.step
+	r.Volumes = append([]VolumeProgress(nil), p.volumes...)
+	p.mu.Unlock()
+	return r
+}
+
+// String renders the current progress on a single line.
+func (p *progress) String() string {
+	r := p.report()
+
+	output := []string{fmt.Sprintf("%s %s", p.action, humanize.IBytes(r.StreamedBytes))}
+	if r.Step != "" {
+		output[0] = fmt.Sprintf("%s: %s", r.Step, output[0])
+	}
+	if r.TotalBytes > 0 {
+		output[0] = fmt.Sprintf(
+			"%s of %s (%.1f%%)", output[0], humanize.IBytes(r.TotalBytes), 100*float64(r.StreamedBytes)/float64(r.TotalBytes),
+		)
+	}
+	if r.WrittenBytes > 0 {
+		output = append(output, fmt.Sprintf("%s compressed", humanize.IBytes(r.WrittenBytes)))
+	}
+	if r.TransferRate > 0 {
+		output = append(output, fmt.Sprintf("%s/s %s", humanize.IBytes(r.TransferRate), p.transfer))
+	}
+	if r.ETASeconds > 0 {
+		output = append(output, fmt.Sprintf("ETA %v", time.Duration(r.ETASeconds)*time.Second))
+	}
+	for _, stage := range []string{volumeReceiving, volumeDownloaded, volumeDownloading} {
+		var numbers []string
+		for _, vol := range r.Volumes {
+			if vol.Stage == stage {
+				numbers = append(numbers, strconv.FormatInt(vol.VolumeNumber, 10))
+			}
+		}
+		if len(numbers) > 0 {
+			output = append(output, fmt.Sprintf("%s vol %s", stage, strings.Join(numbers, ",")))
+		}
+	}
+	return strings.Join(output, ", ")
+}
+
+// run will display the progress until the returned function is called. On a terminal a single
+// line is redrawn in place, otherwise the progress is logged periodically.
+func (p *progress) run(ctx context.Context) func() {
+	if p == nil {
+		return func() {}
+	}
+
+	tty := term.IsTerminal(int(os.Stderr.Fd()))
+	interval := progressLogInterval
+	if tty {
+		interval = progressRefreshInterval
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				if tty || config.JSONOutput {
+					p.display(tty, true)
+				}
+				return
+			case <-ticker.C:
+				p.display(tty, false)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// display will output the current progress, as a JSON line on stderr with the jsonOutput option.
+func (p *progress) display(tty, final bool) {
+	switch {
+	case config.JSONOutput:
+		j, err := json.Marshal(p.report())
+		if err != nil {
+			log.AppLogger.Errorf("could not marshal progress to JSON - %v", err)
+			return
+		}
+		fmt.Fprintln(os.Stderr, string(j))
+	case tty && final:
+		fmt.Fprintf(os.Stderr, "\r%s\033[K\n", p)
+	case tty:
+		fmt.Fprintf(os.Stderr, "\r%s\033[K", p)
+	default:
+		log.AppLogger.Noticef("%s", p)
+	}
+}
+
+// zfsProgressWriter parses the output of a zfs send run with the -v and -P flags, updating the
+// progress with the estimated stream size and bytes sent. Any other output is passed through.
+type zfsProgressWriter struct {
+	p       *progress
+	out     io.Writer
+	partial bytes.Buffer
+}
+
+func (w *zfsProgressWriter) Write(b []byte) (int, error) {
+	w.partial.Write(b)
+	for {
+		line, err := w.partial.ReadString('\n')
+		if err != nil {
+			// Keep the incomplete line for the next write
+			w.partial.Reset()
+			w.partial.WriteString(line)
+			return len(b), nil
+		}
+		if !w.parseLine(strings.TrimSpace(line)) {
+			if _, werr := io.WriteString(w.out, line); werr != nil {
+				return len(b), werr
+			}
+		}
+	}
+}
+
+// parseLine handles the size estimate and progress lines of the parsable zfs send output, returning
+// false for any other line.
+func (w *zfsProgressWriter) parseLine(line string) bool {
+	fields := strings.Split(line, "\t")
+	switch {
+	case len(fields) == 2 && fields[0] == "size":
+		if size, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			w.p.setTotal(size)
+			return true
+		}
+	case len(fields) >= 3 && (fields[0] == "full" || fields[0] == "incremental"):
+		return true
+	case len(fields) == 3 && strings.Count(fields[0], ":") == 2:
+		if sent, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			w.p.setStreamed(sent)
+			return true
+		}
+	}
+	return false
+}
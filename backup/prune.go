@@ -0,0 +1,263 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// RetentionPolicy is a grandfather-father-son policy, keeping the latest backup set (or snapshot) of each of the most
+// recent days, weeks, and months that have one, along with the KeepLast latest ones. A zero count keeps none.
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+}
+
+// PruneDecision describes whether a backup set is kept under a retention policy, and why.
+type PruneDecision struct {
+	VolumeName string
+	Snapshot   string
+	Manifest   string
+	Keep       bool
+	Reasons    []string `json:",omitempty"` // The periods the backup set is kept for, or the backup sets depending on it
+}
+
+// Prune will delete the backup sets in the target, for volumes matching volumeName using the same rules as the list
+// command, that are expired under the retention policy provided, along with the volumes no remaining backup set
+// references. The latest backup set of each volume, and every backup set a kept backup set depends on, are always
+// kept. When dryRun is set the decisions are reported without deleting anything.
+func Prune(pctx context.Context, jobInfo *files.JobInfo, target, volumeName string, policy RetentionPolicy, dryRun bool) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	decisions, prunable, volumes := pruneBackupSets(manifests, volumeName, policy)
+	if err = reportPruneDecisions(decisions, target); err != nil {
+		return err
+	}
+	if dryRun {
+		log.AppLogger.Noticef("Would prune %d backup sets (%d volumes) from %s.", len(prunable), len(volumes), target)
+		return nil
+	}
+	if len(prunable) == 0 {
+		log.AppLogger.Noticef("No backup set is expired, nothing to prune.")
+		return nil
+	}
+
+	// A backup finishing after the manifests were read only adds backup sets depending on the ones kept
+	locks, err := lockVolumes(ctx, jobInfo, target, prunable)
+	if err != nil {
+		return err
+	}
+	defer locks.release()
+
+	if err = deleteBackupSets(ctx, jobInfo, target, prunable, volumes, manifests); err != nil {
+		return err
+	}
+	log.AppLogger.Noticef("Pruned %d backup sets (%d volumes) from %s.", len(prunable), len(volumes), target)
+	return nil
+}
+
+// pruneBackupSets returns the decision made for every backup set of the volumes matching volumeName, along with the
+// backup sets expired under the policy and the volumes only they reference.
+func pruneBackupSets(
+	manifests []*files.JobInfo,
+	volumeName string,
+	policy RetentionPolicy,
+) (decisions []*PruneDecision, prunable []*files.JobInfo, volumes []string) {
+	manifestTree := linkManifests(manifests)
+	names := make([]string, 0, len(manifestTree))
+	for volume := range manifestTree {
+		names = append(names, volume)
+	}
+	sort.Strings(names)
+
+	reasons := make(map[*files.JobInfo][]string)
+	for _, volume := range names {
+		snapList := manifestTree[volume]
+		if !manifestMatchesFilter(snapList[0], volumeName, time.Time{}, time.Time{}) {
+			for _, manifest := range snapList {
+				reasons[manifest] = []string{"not selected"}
+			}
+			continue
+		}
+
+		sort.SliceStable(snapList, func(i, j int) bool {
+			return snapList[i].BaseSnapshot.CreationTime.Before(snapList[j].BaseSnapshot.CreationTime)
+		})
+		retained := retainedBackupSets(snapList, policy, time.Local)
+		for manifest, periods := range retained {
+			reasons[manifest] = periods
+		}
+		// Never break the chain of a kept backup set, crediting the latest backup set that needs each parent
+		for idx := len(snapList) - 1; idx >= 0; idx-- {
+			if retained[snapList[idx]] == nil {
+				continue
+			}
+			for parent := snapList[idx].ParentSnap; parent != nil; parent = parent.ParentSnap {
+				if len(reasons[parent]) == 0 {
+					reasons[parent] = []string{"needed by " + backupSetName(snapList[idx])}
+				}
+			}
+		}
+
+		for _, manifest := range snapList {
+			keep := len(reasons[manifest]) > 0
+			decisions = append(decisions, &PruneDecision{
+				VolumeName: manifest.VolumeName,
+				Snapshot:   manifest.BaseSnapshot.Name,
+				Manifest:   manifest.ManifestObjectName(),
+				Keep:       keep,
+				Reasons:    reasons[manifest],
+			})
+			if !keep {
+				prunable = append(prunable, manifest)
+			}
+		}
+	}
+
+	// Content addressed volumes may be shared with a backup set that is kept
+	referenced := make(map[string]bool)
+	for _, manifest := range manifests {
+		if len(reasons[manifest]) == 0 {
+			continue
+		}
+		for _, vol := range manifest.Volumes {
+			referenced[vol.ObjectName] = true
+		}
+	}
+	for _, manifest := range prunable {
+		for _, vol := range manifest.Volumes {
+			if !referenced[vol.ObjectName] {
+				referenced[vol.ObjectName] = true
+				volumes = append(volumes, vol.ObjectName)
+			}
+		}
+	}
+	return decisions, prunable, volumes
+}
+
+// retainedBackupSets returns the backup sets of a volume kept by the policy, along with the periods they are kept
+// for, in the location provided.
+func retainedBackupSets(snapList []*files.JobInfo, policy RetentionPolicy, loc *time.Location) map[*files.JobInfo][]string {
+	newest := make([]*files.JobInfo, len(snapList))
+	copy(newest, snapList)
+	sort.SliceStable(newest, func(i, j int) bool {
+		return newest[i].BaseSnapshot.CreationTime.After(newest[j].BaseSnapshot.CreationTime)
+	})
+
+	times := make([]time.Time, len(newest))
+	for idx, manifest := range newest {
+		times[idx] = manifest.BaseSnapshot.CreationTime
+	}
+	retained := make(map[*files.JobInfo][]string)
+	for idx, periods := range retainedByPolicy(times, policy, loc) {
+		if len(periods) > 0 {
+			retained[newest[idx]] = periods
+		}
+	}
+	return retained
+}
+
+// retainedByPolicy returns the periods each of the times provided, sorted newest first, is kept for under the policy.
+// The latest time of each period is kept, for the most recent periods that have one, in the location provided. The
+// latest time is always kept, along with the KeepLast latest times.
+func retainedByPolicy(times []time.Time, policy RetentionPolicy, loc *time.Location) [][]string {
+	retained := make([][]string, len(times))
+	if len(times) == 0 {
+		return retained
+	}
+	retained[0] = []string{"latest"}
+	for idx := 0; idx < policy.KeepLast && idx < len(times); idx++ {
+		retained[idx] = append(retained[idx], "last")
+	}
+
+	periods := []struct {
+		name   string
+		keep   int
+		period func(time.Time) string
+	}{
+		{"daily", policy.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", policy.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{"monthly", policy.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, p := range periods {
+		last, kept := "", 0
+		for idx, t := range times {
+			if kept >= p.keep {
+				break
+			}
+			period := p.period(t.In(loc))
+			if period == last {
+				continue
+			}
+			last = period
+			kept++
+			retained[idx] = append(retained[idx], p.name)
+		}
+	}
+	return retained
+}
+
+// reportPruneDecisions will output whether every backup set is kept, and why.
+func reportPruneDecisions(decisions []*PruneDecision, target string) error {
+	if config.JSONOutput {
+		j, jerr := json.Marshal(decisions)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	kept := 0
+	var output []string
+	for _, decision := range decisions {
+		if decision.Keep {
+			kept++
+			output = append(output, fmt.Sprintf("\tkeep  %s@%s (%s)", decision.VolumeName, decision.Snapshot, strings.Join(decision.Reasons, ", ")))
+		} else {
+			output = append(output, fmt.Sprintf("\tprune %s@%s", decision.VolumeName, decision.Snapshot))
+		}
+	}
+	output = append([]string{fmt.Sprintf("Keeping %d of %d backup sets in %s:", kept, len(decisions), target)}, output...)
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n"))
+	return nil
+}
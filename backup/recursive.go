@@ -0,0 +1,345 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// BackupRecursive will backup the volume described by jobInfo along with every filesystem and
+// volume beneath it. Each dataset is backed up as its own backup set with the same options, and
+// its manifest records the volume the recursive backup was started from.
+func BackupRecursive(ctx context.Context, jobInfo *files.JobInfo) error {
+	return backupRecursive(ctx, jobInfo, nil)
+}
+
+// nolint:funlen,gocyclo // Difficult to break this up
+func backupRecursive(ctx context.Context, jobInfo *files.JobInfo, uploadBuffer chan bool) error {
+	localRoot := zfs.GetLocalVolumeName(jobInfo)
+	datasets, err := zfs.GetDatasets(ctx, localRoot)
+	if err != nil {
+		log.AppLogger.Errorf("Could not list the datasets beneath %s due to error - %v", localRoot, err)
+		return err
+	}
+
+	filter, err := newDatasetFilter(jobInfo.Include, jobInfo.Exclude)
+	if err != nil {
+		log.AppLogger.Errorf("Invalid include or exclude pattern provided - %v", err)
+		return err
+	}
+	datasets = filter.apply(localRoot, datasets)
+
+	smart := jobInfo.Full || jobInfo.Incremental || jobInfo.FullIfOlderThan != -1*time.Minute || jobInfo.Differential
+	var failed []string
+	for idx, dataset := range datasets {
+		child := recursiveJobInfo(jobInfo, localRoot, dataset)
+		if smart {
+			child.BaseSnapshot = files.SnapshotInfo{}
+			child.IncrementalSnapshot = files.SnapshotInfo{}
+			if serr := ProcessSmartOptions(ctx, child); serr == ErrNoOp {
+				log.AppLogger.Noticef("Nothing new to backup for %s, skipping.", child.VolumeName)
+				continue
+			} else if serr != nil {
+				log.AppLogger.Errorf("Error while trying to process smart option for %s - %v", child.VolumeName, serr)
+				failed = append(failed, child.VolumeName)
+				continue
+			}
+		} else if dataset != localRoot {
+			if ok := resolveRecursiveSnapshots(ctx, child, dataset); !ok {
+				continue
+			}
+		}
+
+		log.AppLogger.Noticef("Backing up %s (%d/%d)", child.VolumeName, idx+1, len(datasets))
+		if berr := runBackup(ctx, child, uploadBuffer); berr != nil {
+			log.AppLogger.Errorf("Failed to backup %s - %v", child.VolumeName, berr)
+			failed = append(failed, child.VolumeName)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("could not backup %d dataset(s): %s", len(failed), strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// regexpPatternPrefix marks an include or exclude pattern as a regular expression instead of a glob.
+const regexpPatternPrefix = "regexp:"
+
+// datasetFilter selects the datasets beneath the root of a recursive backup to include.
+type datasetFilter struct {
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// newDatasetFilter compiles the include and exclude patterns provided. Patterns are globs matched
+// against the full dataset name where * may match across a /, or regular expressions when
+// prefixed with "regexp:".
+func newDatasetFilter(include, exclude []string) (*datasetFilter, error) {
+	filter := &datasetFilter{}
+	for _, pattern := range include {
+		re, err := compileDatasetPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, re)
+	}
+	for _, pattern := range exclude {
+		re, err := compileDatasetPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, re)
+	}
+	return filter, nil
+}
+
+func compileDatasetPattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, regexpPatternPrefix) {
+		return regexp.Compile(strings.TrimPrefix(pattern, regexpPatternPrefix))
+	}
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	return regexp.Compile("^" + expr + "$")
+}
+
+// apply returns the datasets that should be backed up. The root is always included, and the
+// descendants of an excluded dataset are excluded with it.
+func (f *datasetFilter) apply(root string, datasets []string) []string {
+	var (
+		selected []string
+		excluded []string
+	)
+	for _, dataset := range datasets {
+		if dataset == root {
+			selected = append(selected, dataset)
+			continue
+		}
+		if matchesAnyPattern(f.exclude, dataset) || hasExcludedParent(excluded, dataset) {
+			log.AppLogger.Infof("Excluding %s from the recursive backup.", dataset)
+			excluded = append(excluded, dataset)
+			continue
+		}
+		if len(f.include) > 0 && !matchesAnyPattern(f.include, dataset) {
+			log.AppLogger.Infof("Skipping %s, it does not match any include pattern.", dataset)
+			continue
+		}
+		selected = append(selected, dataset)
+	}
+	return selected
+}
+
+func matchesAnyPattern(patterns []*regexp.Regexp, dataset string) bool {
+	for _, re := range patterns {
+		if re.MatchString(dataset) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasExcludedParent(excluded []string, dataset string) bool {
+	for _, parent := range excluded {
+		if strings.HasPrefix(dataset, parent+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// recursiveJobInfo returns a copy of jobInfo that will backup the provided local dataset, which is
+// found beneath localRoot, to the matching volume name beneath jobInfo.VolumeName.
+func recursiveJobInfo(jobInfo *files.JobInfo, localRoot, dataset string) *files.JobInfo {
+	child := cloneJobInfo(jobInfo)
+	child.RecursiveRoot = jobInfo.VolumeName
+	child.VolumeName = jobInfo.VolumeName + strings.TrimPrefix(dataset, localRoot)
+	if jobInfo.LocalVolume != "" {
+		child.LocalVolume = dataset
+	}
+	child.ApplyDatasetKeys()
+	child.ApplyDatasetCompression()
+	return child
+}
+
+// cloneJobInfo returns a copy of jobInfo, without any volumes, that can be backed up on its own.
+func cloneJobInfo(jobInfo *files.JobInfo) *files.JobInfo {
+	clone := *jobInfo
+	clone.Destinations = append([]string(nil), jobInfo.Destinations...)
+	clone.PendingTargets = append([]string(nil), jobInfo.PendingTargets...)
+	clone.Volumes = nil
+	return &clone
+}
+
+// resolveRecursiveSnapshots will lookup the snapshots selected for the recursive backup on the
+// provided dataset, returning false if the dataset should be skipped.
+func resolveRecursiveSnapshots(ctx context.Context, child *files.JobInfo, dataset string) bool {
+	creationTime, err := zfs.GetCreationDate(ctx, fmt.Sprintf("%s@%s", dataset, child.BaseSnapshot.Name))
+	if err != nil {
+		log.AppLogger.Warningf("Skipping %s, could not find snapshot %s on it - %v", dataset, child.BaseSnapshot.Name, err)
+		return false
+	}
+	child.BaseSnapshot.CreationTime = creationTime
+
+	if child.IncrementalSnapshot.Name == "" {
+		return true
+	}
+
+	targetName := fmt.Sprintf("%s@%s", dataset, child.IncrementalSnapshot.Name)
+	if child.IncrementalSnapshot.Bookmark {
+		targetName = fmt.Sprintf("%s#%s", dataset, child.IncrementalSnapshot.Name)
+	}
+	creationTime, err = zfs.GetCreationDate(ctx, targetName)
+	if err != nil {
+		// Datasets created since the incremental source was taken can only be sent in full
+		log.AppLogger.Warningf("Could not find %s, performing a full backup of %s instead - %v", targetName, dataset, err)
+		child.IncrementalSnapshot = files.SnapshotInfo{}
+		child.IntermediaryIncremental = false
+		return true
+	}
+	child.IncrementalSnapshot.CreationTime = creationTime
+	return true
+}
+
+// RestoreRecursive will automatically restore the volume described by jobInfo along with every
+// volume backed up beneath it, recreating the hierarchy beneath the local volume provided. The volume
+// may be a glob pattern such as tank/vm/*, every volume matching it is then restored beneath the local
+// volume, along with the volumes beneath them for recursive restores.
+// nolint:funlen,gocyclo // Difficult to break this up
+func RestoreRecursive(pctx context.Context, jobInfo *files.JobInfo) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	target := jobInfo.Destinations[0]
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	localCachePath, cerr := getCacheDir(jobInfo, target)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
+		return cerr
+	}
+
+	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
+	if serr != nil {
+		log.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
+		return serr
+	}
+
+	decodedManifests, derr := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
+	if derr != nil {
+		return derr
+	}
+	manifestTree := linkManifests(decodedManifests)
+
+	volumes := recursiveVolumes(manifestTree, jobInfo.VolumeName, jobInfo.Recursive)
+	if len(volumes) == 0 {
+		log.AppLogger.Errorf("Could not find any snapshots for volume %s, none found on target.", jobInfo.VolumeName)
+		return fmt.Errorf("could not determine any snapshots for provided volume")
+	}
+
+	for idx, volume := range volumes {
+		if jobInfo.BaseSnapshot.Name != "" && !hasBackupOf(manifestTree[volume], jobInfo.BaseSnapshot.Name) {
+			log.AppLogger.Warningf("Skipping %s, no backup of snapshot %s found for it.", volume, jobInfo.BaseSnapshot.Name)
+			continue
+		}
+
+		child := *jobInfo
+		child.VolumeName = volume
+		child.LocalVolume = recursiveLocalVolume(jobInfo, volume)
+		log.AppLogger.Noticef("Restoring %s (%d/%d)", volume, idx+1, len(volumes))
+		if err := AutoRestore(ctx, &child); err != nil {
+			log.AppLogger.Errorf("Failed to restore %s.", volume)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recursiveVolumes returns the volumes found in the manifest tree matching the root, which may be a glob
+// pattern, along with every volume beneath them when children is set, sorted so parents are always restored
+// before their children.
+func recursiveVolumes(manifestTree map[string][]*files.JobInfo, root string, children bool) []string {
+	var volumes []string
+	for volume := range manifestTree {
+		if matchesRestoreRoot(root, volume, children) {
+			volumes = append(volumes, volume)
+		}
+	}
+	sort.Strings(volumes)
+	return volumes
+}
+
+// matchesRestoreRoot returns true if the volume matches the root, or is beneath a volume that does when
+// children is set.
+func matchesRestoreRoot(root, volume string, children bool) bool {
+	for candidate := volume; ; candidate = path.Dir(candidate) {
+		if candidate == root {
+			return true
+		}
+		if matched, _ := path.Match(root, candidate); matched && strings.ContainsAny(root, "*?[") {
+			return true
+		}
+		if !children || !strings.Contains(candidate, "/") {
+			return false
+		}
+	}
+}
+
+func hasBackupOf(jobs []*files.JobInfo, snapshot string) bool {
+	for _, job := range jobs {
+		if job.BaseSnapshot.Name == snapshot {
+			return true
+		}
+	}
+	return false
+}
+
+// recursiveLocalVolume translates the local volume provided for the recursive restore into the one
+// the given volume should be restored to, taking the -d and -e options into account. When restoring
+// a glob pattern, the volumes are restored beneath the local volume relative to the root of the pattern.
+func recursiveLocalVolume(jobInfo *files.JobInfo, volume string) string {
+	relative := strings.TrimPrefix(volume, globRoot(jobInfo.VolumeName))
+	switch {
+	case jobInfo.FullPath:
+		return jobInfo.LocalVolume
+	case jobInfo.LastPath:
+		return path.Dir(path.Join(jobInfo.LocalVolume, path.Base(jobInfo.VolumeName)) + relative)
+	default:
+		return jobInfo.LocalVolume + relative
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"github.com/cenkalti/backoff"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// Rekey will encrypt the backup sets of the volume in the target (or only those of the snapshot provided) again with
+// the keys of the jobInfo, reading them with the old keys provided. Each volume is downloaded, decrypted, and
+// encrypted again without decompressing it, then uploaded under a new name. The manifest of a backup set is only
+// replaced once all of its volumes were uploaded, and the old volumes are deleted once every backup set was rekeyed,
+// so the backups can be restored at any point.
+// nolint:funlen,gocyclo // Difficult to break this up
+func Rekey(pctx context.Context, jobInfo, oldKeys *files.JobInfo, target string) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	manifests, err := readTargetManifests(ctx, withKeys(jobInfo, oldKeys), target)
+	if err != nil {
+		return err
+	}
+
+	uploadBuffer := make(chan bool, jobInfo.MaxParallelUploads)
+	defer close(uploadBuffer)
+	backend, berr := prepareBackend(ctx, jobInfo, target, uploadBuffer)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	// Volumes the backup sets that are not rekeyed reference must be kept
+	var selected []*files.JobInfo
+	referenced := make(map[string]bool)
+	for _, manifest := range manifests {
+		if manifest.VolumeName == jobInfo.VolumeName &&
+			(jobInfo.BaseSnapshot.Name == "" || manifest.BaseSnapshot.Name == jobInfo.BaseSnapshot.Name) {
+			selected = append(selected, manifest)
+			continue
+		}
+		for _, vol := range manifest.Volumes {
+			referenced[vol.ObjectName] = true
+		}
+	}
+	if len(selected) == 0 {
+		log.AppLogger.Errorf("Could not find a backup of %s to rekey in %s.", jobInfo.VolumeName, target)
+		return errBackupSetNotFound
+	}
+
+	locks, err := lockVolumes(ctx, jobInfo, target, selected)
+	if err != nil {
+		return err
+	}
+	defer locks.release()
+
+	log.AppLogger.Noticef("Rekeying %d backup set(s) of %s in %s.", len(selected), jobInfo.VolumeName, target)
+	for _, manifest := range selected {
+		rekeyed, rerr := rekeyBackupSet(ctx, jobInfo, manifest, target, backend)
+		if rerr != nil {
+			log.AppLogger.Errorf("Could not rekey the backup set %s, aborting - %v", manifest.ManifestObjectName(), rerr)
+			return rerr
+		}
+		for _, vol := range rekeyed.Volumes {
+			referenced[vol.ObjectName] = true
+		}
+	}
+
+	// Every manifest now references the rekeyed volumes, the old ones can go
+	for _, manifest := range selected {
+		for _, vol := range manifest.Volumes {
+			if referenced[vol.ObjectName] {
+				continue
+			}
+			referenced[vol.ObjectName] = true
+			if derr := backend.Delete(ctx, vol.ObjectName); derr != nil {
+				log.AppLogger.Warningf("Could not delete the old volume %s, use the clean command to remove it - %v", vol.ObjectName, derr)
+			}
+		}
+	}
+
+	log.AppLogger.Noticef("Done.")
+	return nil
+}
+
+// rekeyBackupSet encrypts the volumes of the backup set again with the keys of the jobInfo, then replaces its
+// manifest with one referencing them.
+func rekeyBackupSet(
+	ctx context.Context,
+	jobInfo, manifest *files.JobInfo,
+	target string,
+	backend backends.Backend,
+) (*files.JobInfo, error) {
+	if len(manifest.WrappedKeys) > 0 {
+		identity, err := unwrapDataKey(ctx, manifest.WrappedKeys, target)
+		if err != nil {
+			return nil, err
+		}
+		manifest.AgeIdentities = []age.Identity{identity}
+	}
+
+	rekeyed := withKeys(manifest, jobInfo)
+	rekeyed.KeyGeneration = manifest.KeyGeneration + 1
+	rekeyed.Destinations = []string{target}
+	if err := prepareDataKey(ctx, rekeyed); err != nil {
+		return nil, err
+	}
+
+	log.AppLogger.Infof("Rekeying the %d volume(s) of %s.", len(manifest.Volumes), manifest.ManifestObjectName())
+	volumes := make([]*files.VolumeInfo, len(manifest.Volumes))
+	indexes := make(chan int, len(manifest.Volumes))
+	for idx := range manifest.Volumes {
+		indexes <- idx
+	}
+	close(indexes)
+
+	group, gctx := errgroup.WithContext(ctx)
+	for i := 0; i < jobInfo.MaxParallelUploads; i++ {
+		group.Go(func() error {
+			for idx := range indexes {
+				be := backoff.NewExponentialBackOff()
+				be.MaxInterval = jobInfo.MaxBackoffTime
+				be.MaxElapsedTime = jobInfo.MaxRetryTime
+				operation := func() (err error) {
+					if volumes[idx], err = rekeyVolume(gctx, manifest, rekeyed, backend, manifest.Volumes[idx]); err != nil {
+						log.AppLogger.Warningf("error trying to rekey volume %s - %v", manifest.Volumes[idx].ObjectName, err)
+					}
+					return err
+				}
+				if err := backoff.Retry(operation, backoff.WithContext(be, gctx)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	rekeyed.Volumes = volumes
+
+	// Replace the manifest, keeping the previous generation when its name did not change
+	generation, err := supersedeManifest(ctx, backend, rekeyed)
+	if err != nil {
+		log.AppLogger.Errorf("Could not keep the manifest %s before replacing it - %v", rekeyed.ManifestObjectName(), err)
+		return nil, err
+	}
+	rekeyed.ManifestGeneration = generation
+	manifestVol, err := saveManifest(ctx, rekeyed, true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if derr := manifestVol.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete the temporary manifest %s - %v", manifestVol.ObjectName, derr)
+		}
+	}()
+	if err = manifestVol.OpenVolume(); err != nil {
+		return nil, err
+	}
+	err = backend.Upload(ctx, manifestVol)
+	if err == nil {
+		err = replaceSignature(ctx, backend, manifestVol)
+	}
+	if cerr := manifestVol.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		log.AppLogger.Errorf("Could not upload the rekeyed manifest %s - %v", manifestVol.ObjectName, err)
+		return nil, err
+	}
+
+	if old := manifest.ManifestObjectName(); old != manifestVol.ObjectName {
+		if derr := backend.Delete(ctx, old); derr != nil {
+			log.AppLogger.Warningf("Could not delete the old manifest %s, delete it to hide the old backup set - %v", old, derr)
+		}
+		deleteSignature(ctx, backend, old)
+	}
+	log.AppLogger.Infof("Replaced the manifest %s.", manifestVol.ObjectName)
+
+	return rekeyed, nil
+}
+
+// rekeyVolume downloads the volume, decrypts it with the keys of the manifest, and uploads it encrypted with the keys
+// of the rekeyed manifest. The volume is never decompressed.
+func rekeyVolume(
+	ctx context.Context,
+	manifest, rekeyed *files.JobInfo,
+	backend backends.Backend,
+	vol *files.VolumeInfo,
+) (*files.VolumeInfo, error) {
+	r, err := backend.Download(ctx, vol.ObjectName)
+	if err != nil {
+		return nil, err
+	}
+	r = limitDownload(r)
+	defer r.Close()
+
+	downloaded, err := files.CreateSimpleVolume(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	if err = downloaded.UseDigest(vol.DigestAlgorithm); err != nil {
+		_ = downloaded.Close()
+		_ = downloaded.DeleteVolume()
+		return nil, err
+	}
+	defer func() {
+		if derr := downloaded.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete the temporary file for %s - %v", vol.ObjectName, derr)
+		}
+	}()
+	if _, err = io.Copy(downloaded, r); err != nil {
+		_ = downloaded.Close()
+		return nil, err
+	}
+	if err = downloaded.Close(); err != nil {
+		return nil, err
+	}
+	if downloaded.Checksum() != vol.Checksum() {
+		return nil, fmt.Errorf(
+			"%s hash mismatch for %s, got %s but expected %s", vol.ChecksumAlgorithm(), vol.ObjectName, downloaded.Checksum(), vol.Checksum(),
+		)
+	}
+
+	// Leave the compressor out so the volume is only decrypted and encrypted again
+	decrypt := cloneJobInfo(manifest)
+	decrypt.Compressor = ""
+	if err = downloaded.Extract(ctx, decrypt, false); err != nil {
+		return nil, err
+	}
+	defer downloaded.Close()
+
+	encrypt := cloneJobInfo(rekeyed)
+	encrypt.Compressor = ""
+	encrypt.MaxFileBuffer = 1
+	volume, err := files.CreateBackupVolume(ctx, encrypt, vol.VolumeNumber)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if derr := volume.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete the temporary file for %s - %v", volume.ObjectName, derr)
+		}
+	}()
+	if _, err = io.Copy(volume, downloaded); err != nil {
+		_ = volume.Close()
+		return nil, err
+	}
+	if err = volume.Close(); err != nil {
+		return nil, err
+	}
+
+	named := volumeJob(rekeyed, vol.StoreOnly)
+	volume.ObjectName = named.BackupVolumeObjectName(vol.VolumeNumber)
+	volume.ZFSStreamBytes = vol.ZFSStreamBytes
+	volume.ZFSStreamSHA256 = vol.ZFSStreamSHA256
+	volume.Targets = vol.Targets
+	volume.StoreOnly = vol.StoreOnly
+	contentAddress(named, volume)
+
+	if err = volume.OpenVolume(); err != nil {
+		return nil, err
+	}
+	defer volume.Close()
+	if err = backend.Upload(ctx, volume); err != nil {
+		return nil, err
+	}
+	log.AppLogger.Debugf("Rekeyed %s as %s.", vol.ObjectName, volume.ObjectName)
+
+	return volume, nil
+}
+
+// withKeys returns a copy of the job using the encryption and signing keys of keys instead.
+func withKeys(j, keys *files.JobInfo) *files.JobInfo {
+	clone := cloneJobInfo(j)
+	clone.EncryptTo, clone.SignFrom = keys.EncryptTo, keys.SignFrom
+	clone.EncryptKey, clone.SignKey = keys.EncryptKey, keys.SignKey
+	clone.GPGAgent = keys.GPGAgent
+	clone.AgeRecipients, clone.AgeRecipientKeys, clone.AgeIdentities = keys.AgeRecipients, keys.AgeRecipientKeys, keys.AgeIdentities
+	clone.KMSKeys = keys.KMSKeys
+	clone.WrappedKeys = nil
+	return clone
+}
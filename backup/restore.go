@@ -24,20 +24,26 @@ import (
 	"bytes"
 	"context"
 	"crypto/md5" // nolint:gosec // MD5 not used for cryptographic purposes here
+	"crypto/sha256"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"filippo.io/age"
 	"github.com/cenkalti/backoff"
+	"github.com/juju/ratelimit"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/files"
 	"github.com/jdfalk/zfsbackup-go/log"
 	"github.com/jdfalk/zfsbackup-go/zfs"
@@ -50,44 +56,117 @@ type downloadSequence struct {
 
 // AutoRestore will compute which snapshots need to be restored to get to the snapshot provided,
 // or to the latest snapshot of the volume provided
-// nolint:funlen,gocyclo // Difficult to break this up
 func AutoRestore(pctx context.Context, jobInfo *files.JobInfo) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
 
+	jobsToRestore, volume, err := resolveRestoreChain(ctx, jobInfo)
+	if err != nil {
+		return err
+	}
+
+	if len(jobsToRestore) == 0 {
+		log.AppLogger.Noticef("Done.")
+		return nil
+	}
+
+	targets, terr := prepareRestoreTargets(ctx, jobInfo)
+	if terr != nil {
+		return terr
+	}
+	defer closeRestoreTargets(targets)
+
+	if jobInfo.ToFile == "" {
+		if err = checkPartialReceive(ctx, jobInfo, volume); err != nil {
+			return err
+		}
+		if err = checkForcedRollback(ctx, jobInfo, volume, jobsToRestore[len(jobsToRestore)-1].IncrementalSnapshot.Name); err != nil {
+			return err
+		}
+	}
+
+	// We have a list of snapshots we need to restore, start at the end and work our way down. Every backup set is
+	// prepared up front so the volumes of the next one are downloaded while the current one is being received.
+	sets := make([]*restoreSet, 0, len(jobsToRestore))
+	decompressor := jobInfo.Decompressor
+	for i := len(jobsToRestore) - 1; i >= 0; i-- {
+		jobInfo.BaseSnapshot = jobsToRestore[i].BaseSnapshot
+		jobInfo.IncrementalSnapshot = jobsToRestore[i].IncrementalSnapshot
+		jobInfo.Volumes = jobsToRestore[i].Volumes
+		jobInfo.Compressor = jobsToRestore[i].Compressor
+		jobInfo.Decompressor = jobsToRestore[i].Decompressor
+		jobInfo.ZstdWindowLog = jobsToRestore[i].ZstdWindowLog
+		jobInfo.ZstdDictionary = jobsToRestore[i].ZstdDictionary
+		if decompressor != "" {
+			jobInfo.Decompressor = decompressor
+		}
+		jobInfo.Separator = jobsToRestore[i].Separator
+		set, serr := prepareRestoreSet(ctx, jobInfo, targets, volume)
+		if serr != nil {
+			log.AppLogger.Errorf("Failed to restore snapshot.")
+			return serr
+		}
+		sets = append(sets, set)
+	}
+
+	if err = restoreSets(ctx, jobInfo, sets); err != nil {
+		log.AppLogger.Errorf("Failed to restore snapshot.")
+		return err
+	}
+
+	log.AppLogger.Noticef("Done.")
+
+	return nil
+}
+
+// resolveRestoreChain will compute which backup sets need to be restored, from the last one to the first, to get
+// the local volume returned to the snapshot provided, or to the latest snapshot of the volume provided.
+// nolint:funlen,gocyclo // Difficult to break this up
+func resolveRestoreChain(ctx context.Context, jobInfo *files.JobInfo) ([]*files.JobInfo, string, error) {
 	// Prepare the backend client
 	target := jobInfo.Destinations[0]
 	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
 	if berr != nil {
 		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
-		return berr
+		return nil, "", berr
 	}
 	defer backend.Close()
 
 	// Get the local cache dir
-	localCachePath, cerr := getCacheDir(jobInfo.Destinations[0])
+	localCachePath, cerr := getCacheDir(jobInfo, jobInfo.Destinations[0])
 	if cerr != nil {
 		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
-		return cerr
+		return nil, "", cerr
 	}
 
 	// Sync the local cache
 	safeManifests, _, serr := syncCache(ctx, jobInfo, localCachePath, backend)
 	if serr != nil {
 		log.AppLogger.Errorf("Could not sync cache dir for target %s due to error - %v.", target, serr)
-		return serr
+		return nil, "", serr
 	}
 
 	decodedManifests, derr := readAndSortManifests(ctx, localCachePath, safeManifests, jobInfo)
 	if derr != nil {
-		return derr
+		return nil, "", derr
 	}
 	manifestTree := linkManifests(decodedManifests)
 	var ok bool
 	var volumeSnaps []*files.JobInfo
 	if volumeSnaps, ok = manifestTree[jobInfo.VolumeName]; !ok {
 		log.AppLogger.Errorf("Could not find any snapshots for volume %s, none found on target.", jobInfo.VolumeName)
-		return errors.New("could not determine any snapshots for provided volume")
+		return nil, "", errors.New("could not determine any snapshots for provided volume")
+	}
+
+	// Skip the incremental backups, restoring the latest full backup up to the snapshot provided instead
+	if jobInfo.FullOnly {
+		full := latestFullBackup(volumeSnaps, jobInfo.BaseSnapshot.Name)
+		if full == nil {
+			log.AppLogger.Errorf("Could not find a full backup of volume %s to restore.", jobInfo.VolumeName)
+			return nil, "", errors.New("could not find a full backup to restore")
+		}
+		log.AppLogger.Noticef("Restoring only the full backup of snapshot %s.", full.BaseSnapshot.Name)
+		jobInfo.BaseSnapshot = full.BaseSnapshot
 	}
 
 	// Restore to the latest snapshot available for the volume provided if no snapshot was provided
@@ -97,44 +176,40 @@ func AutoRestore(pctx context.Context, jobInfo *files.JobInfo) error {
 		log.AppLogger.Infof("Restoring to snapshot %s.", jobInfo.BaseSnapshot.Name)
 	}
 
-	// Find the matching backup job for the snapshot we want to restore to
+	// Find the matching backup job for the snapshot we want to restore to, preferring a full backup of it (e.g. one
+	// uploaded by the consolidate command) over an incremental one
 	var jobToRestore *files.JobInfo
 	for _, job := range volumeSnaps {
 		if strings.Compare(job.BaseSnapshot.Name, jobInfo.BaseSnapshot.Name) == 0 {
-			jobToRestore = job
-			break
+			if jobToRestore == nil || job.IncrementalSnapshot.Name == "" {
+				jobToRestore = job
+			}
 		}
 	}
 	if jobToRestore == nil {
 		log.AppLogger.Errorf("Could not find the snapshot %v for volume %s on backend.", jobInfo.BaseSnapshot.Name, jobInfo.VolumeName)
-		return errors.New("could not find snapshot provided")
+		return nil, "", errors.New("could not find snapshot provided")
 	}
 
 	// We have the snapshot we'd like to restore to, let's figure out whats already found locally and restore as required
 	jobsToRestore := make([]*files.JobInfo, 0, 10)
 	log.AppLogger.Infof("Calculating how to restore to %s.", jobInfo.BaseSnapshot.Name)
-	volume := jobInfo.LocalVolume
-	parts := strings.Split(jobInfo.VolumeName, "/")
-	if jobInfo.FullPath {
-		parts[0] = volume
-		volume = strings.Join(parts, "/")
-	}
+	volume := restoreVolumeName(jobInfo)
 
-	if jobInfo.LastPath {
-		volume = fmt.Sprintf("%s/%s", volume, parts[len(parts)-1])
-	}
-
-	snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, volume)
-	if err != nil {
+	// Every stream of the chain is written out when reassembling it on disk
+	snapshots := []files.SnapshotInfo{}
+	if jobInfo.ToFile == "" {
 		// TODO: There are some error cases that are ok to ignore!
-		snapshots = []files.SnapshotInfo{}
+		if local, err := zfs.GetSnapshotsAndBookmarks(ctx, volume); err == nil {
+			snapshots = local
+		}
 	}
 
 	if jobInfo.Origin != "" {
 		originSnapshot, oerr := zfs.GetSnapshotsAndBookmarks(ctx, jobInfo.Origin)
 		if oerr != nil {
 			log.AppLogger.Errorf("Could not get origin snapshot %s info due to error: %v", jobInfo.Origin, oerr)
-			return oerr
+			return nil, "", oerr
 		}
 
 		if len(originSnapshot) == 1 {
@@ -142,7 +217,7 @@ func AutoRestore(pctx context.Context, jobInfo *files.JobInfo) error {
 			snapshots = append(snapshots, originSnapshot[0])
 		} else {
 			log.AppLogger.Errorf("Could not find origin snapshot %s", jobInfo.Origin)
-			return fmt.Errorf("could not find origin snapshot %s", jobInfo.Origin)
+			return nil, "", fmt.Errorf("could not find origin snapshot %s", jobInfo.Origin)
 		}
 	}
 
@@ -163,56 +238,66 @@ func AutoRestore(pctx context.Context, jobInfo *files.JobInfo) error {
 				"Want to restore parent snap %s but it is not found in the backend, aborting.",
 				jobToRestore.IncrementalSnapshot.Name,
 			)
-			return errors.New("could not find parent snapshot")
+			return nil, "", errors.New("could not find parent snapshot")
 		}
 		jobToRestore = jobToRestore.ParentSnap
 	}
 
 	log.AppLogger.Infof("Need to restore %d snapshots.", len(jobsToRestore))
+	return jobsToRestore, volume, nil
+}
 
-	// We have a list of snapshots we need to restore, start at the end and work our way down
-	for i := len(jobsToRestore) - 1; i >= 0; i-- {
-		jobInfo.BaseSnapshot = jobsToRestore[i].BaseSnapshot
-		jobInfo.IncrementalSnapshot = jobsToRestore[i].IncrementalSnapshot
-		jobInfo.Volumes = jobsToRestore[i].Volumes
-		jobInfo.Compressor = jobsToRestore[i].Compressor
-		jobInfo.Separator = jobsToRestore[i].Separator
-		log.AppLogger.Infof("Restoring snapshot %s (%d/%d)", jobInfo.BaseSnapshot.Name, len(jobsToRestore)-i, len(jobsToRestore))
-		if err := Receive(ctx, jobInfo); err != nil {
-			log.AppLogger.Errorf("Failed to restore snapshot.")
-			return err
+// latestFullBackup returns the latest full backup of the volume, in the order the backups were sorted, up to the
+// snapshot provided when one is given.
+func latestFullBackup(volumeSnaps []*files.JobInfo, snapshot string) *files.JobInfo {
+	last := len(volumeSnaps) - 1
+	if snapshot != "" {
+		for last >= 0 && volumeSnaps[last].BaseSnapshot.Name != snapshot {
+			last--
+		}
+	}
+	for idx := last; idx >= 0; idx-- {
+		if volumeSnaps[idx].IncrementalSnapshot.Name == "" {
+			return volumeSnaps[idx]
 		}
 	}
-
-	log.AppLogger.Noticef("Done.")
-
 	return nil
 }
 
 // Receive will download and restore the backup job described to the Volume target provided.
-// nolint:funlen,gocyclo // Difficult to break this up
 func Receive(pctx context.Context, jobInfo *files.JobInfo) error {
 	ctx, cancel := context.WithCancel(pctx)
 	defer cancel()
 
-	target := jobInfo.Destinations[0]
+	// Prepare the backend clients, in order of preference
+	targets, terr := prepareRestoreTargets(ctx, jobInfo)
+	if terr != nil {
+		return terr
+	}
+	defer closeRestoreTargets(targets)
 
-	// Prepare the backend client
-	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
-	if berr != nil {
-		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
-		return berr
+	// See if the snapshots we want to restore already exist
+	volume := restoreVolumeName(jobInfo)
+	if jobInfo.ToFile == "" {
+		if done, verr := checkLocalVolume(ctx, jobInfo, volume); verr != nil || done {
+			return verr
+		}
+		if ferr := checkForcedRollback(ctx, jobInfo, volume, jobInfo.IncrementalSnapshot.Name); ferr != nil {
+			return ferr
+		}
 	}
-	defer backend.Close()
 
-	// Get the local cache dir
-	localCachePath, cerr := getCacheDir(target)
-	if cerr != nil {
-		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", target, cerr)
-		return cerr
+	set, err := prepareRestoreSet(ctx, jobInfo, targets, volume)
+	if err != nil {
+		return err
 	}
 
-	// See if the snapshots we want to restore already exist
+	return restoreSets(ctx, jobInfo, []*restoreSet{set})
+}
+
+// restoreVolumeName returns the local volume the backup set is received into, taking the -d and -e options
+// into account.
+func restoreVolumeName(jobInfo *files.JobInfo) string {
 	volume := jobInfo.LocalVolume
 	parts := strings.Split(jobInfo.VolumeName, "/")
 	if jobInfo.FullPath {
@@ -223,166 +308,544 @@ func Receive(pctx context.Context, jobInfo *files.JobInfo) error {
 	if jobInfo.LastPath {
 		volume = fmt.Sprintf("%s/%s", volume, parts[len(parts)-1])
 	}
+	return volume
+}
 
-	if jobInfo.BaseSnapshot.CreationTime.IsZero() {
-		if ok, verr := validateSnapShotExists(ctx, &jobInfo.BaseSnapshot, volume, false); verr != nil {
-			log.AppLogger.Errorf("Cannot validate if selected base snapshot exists due to error - %v", verr)
-			return verr
-		} else if ok {
-			log.AppLogger.Noticef("Selected base snapshot already exists, nothing to do!")
-			return nil
+// restoreSet is a backup set to restore, along with the targets its volumes can be downloaded from.
+type restoreSet struct {
+	job      files.JobInfo
+	manifest *files.JobInfo
+	targets  []restoreTarget
+	// Volumes already written to the stream file by an interrupted restore, and the size they take in it
+	skip   int
+	offset uint64
+}
+
+// prepareRestoreSet will retrieve the manifest of the backup set described by the jobInfo and prepare the targets
+// to download its volumes from.
+func prepareRestoreSet(ctx context.Context, jobInfo *files.JobInfo, targets []restoreTarget, volume string) (*restoreSet, error) {
+	var (
+		manifest *files.JobInfo
+		source   string
+		err      error
+	)
+	for _, t := range targets {
+		if manifest, err = fetchManifest(ctx, jobInfo, t); err == nil {
+			source = t.uri
+			break
 		}
+		log.AppLogger.Warningf("Could not retrieve the manifest from target %s - %v", t.uri, err)
+	}
+	if err != nil {
+		log.AppLogger.Errorf("Error trying to retrieve manifest volume - %v", err)
+		return nil, err
 	}
 
-	// Check that we have the parent snap shot this wants to restore from
-	if jobInfo.IncrementalSnapshot.Name != "" && jobInfo.IncrementalSnapshot.CreationTime.IsZero() {
-		if ok, verr := validateSnapShotExists(ctx, &jobInfo.IncrementalSnapshot, volume, false); verr != nil {
-			log.AppLogger.Errorf("Cannot validate if selected incremental snapshot exists due to error - %v", verr)
-			return verr
-		} else if !ok {
-			log.AppLogger.Errorf("Selected incremental snapshot does not exist!")
-			return fmt.Errorf("selected incremental snapshot does not exist")
+	manifest.ManifestPrefix = jobInfo.ManifestPrefix
+	manifest.ObjectPrefix = jobInfo.ObjectPrefix
+	manifest.CopyKeys(jobInfo)
+	manifest.Verify = jobInfo.Verify
+
+	if len(manifest.WrappedKeys) > 0 {
+		identity, uerr := unwrapDataKey(ctx, manifest.WrappedKeys, source)
+		if uerr != nil {
+			log.AppLogger.Errorf("Could not unwrap the data key of the backup - %v", uerr)
+			return nil, uerr
 		}
+		manifest.AgeIdentities = []age.Identity{identity}
 	}
 
-	manifestObjectName := jobInfo.ManifestObjectName()
-	// nolint:gosec // MD5 not used for cryptographic purposes here
-	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifestObjectName)))
-	safeManifestPath := filepath.Join(localCachePath, safeManifestFile)
-
-	// Check to see if we have the manifest file locally
-	manifest, err := readManifest(ctx, safeManifestPath, jobInfo)
-	if err != nil {
-		if os.IsNotExist(err) {
-			if bErr := backend.PreDownload(ctx, []string{manifestObjectName}); bErr != nil {
-				log.AppLogger.Errorf("Error trying to pre download manifest volume %s - %v", manifestObjectName, bErr)
-				return bErr
-			}
-			// Try and download the manifest file from the backend
-			if dErr := downloadTo(ctx, backend, manifestObjectName, safeManifestPath); dErr != nil {
-				return dErr
-			}
-			manifest, err = readManifest(ctx, safeManifestPath, jobInfo)
-		}
-		if err != nil {
-			log.AppLogger.Errorf("Error trying to retrieve manifest volume - %v", err)
-			return err
+	// Make sure the receiving pool can accept the stream before downloading anything
+	if jobInfo.ToFile == "" {
+		if err = validatePoolFeatures(ctx, manifest, volume); err != nil {
+			log.AppLogger.Errorf("Cannot restore to %s - %v", volume, err)
+			return nil, err
 		}
 	}
 
-	manifest.ManifestPrefix = jobInfo.ManifestPrefix
-	manifest.SignKey = jobInfo.SignKey
-	manifest.EncryptKey = jobInfo.EncryptKey
-
 	// Get list of Objects
 	toDownload := make([]string, len(manifest.Volumes))
 	for idx := range manifest.Volumes {
 		toDownload[idx] = manifest.Volumes[idx].ObjectName
 	}
 
-	// PreDownload step
-	err = backend.PreDownload(ctx, toDownload)
-	if err != nil {
+	// PreDownload step, targets that cannot prepare the volumes are not used
+	available := make([]restoreTarget, 0, len(targets))
+	for _, t := range targets {
+		if err = t.backend.PreDownload(ctx, toDownload); err != nil {
+			log.AppLogger.Warningf("Error trying to pre download backup set volumes from target %s - %v", t.uri, err)
+			continue
+		}
+		available = append(available, t)
+	}
+	if len(available) == 0 {
 		log.AppLogger.Errorf("Error trying to pre download backup set volumes - %v", err)
-		return err
+		return nil, err
 	}
-	toDownload = nil
 
-	// Prepare Download Pipeline
-	usePipe := false
-	fileBufferSize := jobInfo.MaxFileBuffer
-	if fileBufferSize == 0 {
-		fileBufferSize = 1
-		usePipe = true
-	}
+	return &restoreSet{job: *jobInfo, manifest: manifest, targets: available}, nil
+}
 
-	downloadChannel := make(chan downloadSequence, len(manifest.Volumes))
-	bufferChannel := make(chan interface{}, fileBufferSize)
-	orderedChannels := make([]chan *files.VolumeInfo, len(manifest.Volumes))
-	defer close(bufferChannel)
+// restoreSets will receive each of the backup sets in order. The volumes of every set are queued for download at
+// once, so the downloads run ahead of the receive across backup sets, bounded by the MaxFileBuffer option.
+func restoreSets(pctx context.Context, jobInfo *files.JobInfo, sets []*restoreSet) error {
+	group, ctx := errgroup.WithContext(pctx)
 
-	// Queue up files to download
-	for idx := range manifest.Volumes {
-		c := make(chan *files.VolumeInfo, 1)
-		orderedChannels[idx] = c
-		downloadChannel <- downloadSequence{manifest.Volumes[idx], c}
-	}
-	close(downloadChannel)
-
-	var wg *errgroup.Group
-	wg, ctx = errgroup.WithContext(ctx)
-
-	// Kick off go routines to download
-	for i := 0; i < fileBufferSize; i++ {
-		wg.Go(func() error {
-			for {
-				select {
-				case <-ctx.Done():
-					return ctx.Err()
-				case sequence, ok := <-downloadChannel:
-					if !ok {
-						return nil
-					}
-					defer close(sequence.c)
-					select {
-					case <-ctx.Done():
-						return ctx.Err()
-					case bufferChannel <- nil:
-					}
-
-					be := backoff.NewExponentialBackOff()
-					be.MaxInterval = jobInfo.MaxBackoffTime
-					be.MaxElapsedTime = jobInfo.MaxRetryTime
-					retryconf := backoff.WithContext(be, ctx)
-
-					operation := func() error {
-						oerr := processSequence(ctx, sequence, backend, usePipe)
-						if oerr != nil {
-							log.AppLogger.Warningf("error trying to download file %s - %v", sequence.volume.ObjectName, oerr)
-						}
-						return oerr
-					}
-
-					log.AppLogger.Debugf("Downloading volume %s.", sequence.volume.ObjectName)
-
-					if berr := backoff.Retry(operation, retryconf); berr != nil {
-						log.AppLogger.Errorf("Failed to download volume %s due to error: %v, aborting...", sequence.volume.ObjectName, berr)
-						return berr
-					}
-				}
+	// Pick up where an interrupted restore to stream files stopped
+	checkpoint := loadRestoreCheckpoint(jobInfo, sets)
+	pending := checkpoint.resume(sets)
+
+	// Report the progress across the whole chain
+	var total uint64
+	for _, set := range pending {
+		total += set.manifest.ZFSStreamBytes - set.offset
+	}
+	prog := newProgress("Received", "download")
+	prog.setTotal(total)
+	stopProgress := prog.run(ctx)
+
+	pool := newDownloadPool(ctx, group, jobInfo, prog)
+	volumes := make([][]chan *files.VolumeInfo, len(pending))
+	for idx, set := range pending {
+		volumes[idx] = pool.queue(set.manifest.Volumes[set.skip:], set.targets)
+	}
+	pool.close()
+
+	group.Go(func() error {
+		for idx, set := range pending {
+			if len(sets) > 1 {
+				log.AppLogger.Infof("Restoring snapshot %s (%d/%d)", set.job.BaseSnapshot.Name, idx+1, len(sets))
+				prog.setStep(fmt.Sprintf("Snapshot %s (%d/%d)", set.job.BaseSnapshot.Name, idx+1, len(sets)))
 			}
-		})
+			if err := receiveSet(ctx, set, volumes[idx], pool.buffer, prog, checkpoint); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// Wait for processes to finish
+	err := group.Wait()
+	stopProgress()
+	if err != nil {
+		log.AppLogger.Errorf("There was an error during the restore process, aborting: %v", err)
+		return err
+	}
+	checkpoint.remove()
+
+	if jobInfo.RestoreProperties && len(sets) > 0 {
+		last := sets[len(sets)-1]
+		restoreProperties(pctx, last.manifest.LocalProperties, jobInfo.ExcludeProperties, restoreVolumeName(&last.job))
+	}
+
+	if (jobInfo.LoadKey || jobInfo.KeyLocation != "") && len(sets) > 0 {
+		if err = loadRestoredKey(pctx, jobInfo, restoreVolumeName(&sets[len(sets)-1].job)); err != nil {
+			return err
+		}
 	}
 
+	log.AppLogger.Noticef("Done. Elapsed Time: %v", time.Since(jobInfo.StartTime))
+	return nil
+}
+
+// receiveSet will receive the volumes of the backup set, in order, into zfs or the stream file requested.
+func receiveSet(
+	ctx context.Context,
+	set *restoreSet,
+	volumes []chan *files.VolumeInfo,
+	buffer <-chan interface{},
+	prog *progress,
+	checkpoint *restoreCheckpoint,
+) error {
 	// Order the downloaded Volumes
-	orderedVolumes := make(chan *files.VolumeInfo, len(toDownload))
-	wg.Go(func() error {
-		defer close(orderedVolumes)
-		for _, c := range orderedChannels {
+	orderedVolumes := make(chan *files.VolumeInfo, len(volumes))
+	var group *errgroup.Group
+	group, ctx = errgroup.WithContext(ctx)
+	group.Go(func() error {
+		for _, c := range volumes {
 			select {
 			case <-ctx.Done():
 				return ctx.Err()
-			case orderedVolumes <- <-c:
-				continue
+			case vol, ok := <-c:
+				if !ok {
+					return fmt.Errorf("could not download every volume of the backup set")
+				}
+				orderedVolumes <- vol
 			}
 		}
+		// Only signal the end of the stream once every volume was received
+		close(orderedVolumes)
 		return nil
 	})
 
-	// Prepare ZFS Receive command
-	cmd := zfs.GetZFSReceiveCommand(ctx, jobInfo)
-	wg.Go(func() error {
-		return receiveStream(ctx, cmd, manifest, orderedVolumes, bufferChannel)
-	})
+	if set.job.ToFile != "" {
+		// Reassemble the stream on disk instead of receiving it
+		path := streamFilePath(&set.job)
+		group.Go(func() error {
+			return receiveToFile(ctx, path, set, orderedVolumes, buffer, prog, checkpoint)
+		})
+	} else {
+		// Prepare ZFS Receive command
+		cmd := zfs.GetZFSReceiveCommand(ctx, &set.job)
+		group.Go(func() error {
+			return receiveStream(ctx, cmd, set.manifest, orderedVolumes, buffer, prog)
+		})
+	}
 
-	// Wait for processes to finish
-	err = wg.Wait()
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	if set.job.Verify && set.job.ToFile == "" {
+		return verifyRestoredSnapshot(ctx, set)
+	}
+	return nil
+}
+
+// verifyStreamDigest will compare the zfs stream extracted from the volume with the digest recorded in the manifest
+// when the Verify option is used. Volumes backed up before the digests were recorded cannot be checked.
+func verifyStreamDigest(j *files.JobInfo, vol *files.VolumeInfo, streamHash hash.Hash) error {
+	if !j.Verify {
+		return nil
+	}
+	if vol.ZFSStreamSHA256 == "" {
+		log.AppLogger.Warningf("No zfs stream digest was recorded for volume %s, it cannot be verified.", vol.ObjectName)
+		return nil
+	}
+	if sum := fmt.Sprintf("%x", streamHash.Sum(nil)); sum != vol.ZFSStreamSHA256 {
+		return fmt.Errorf(
+			"the zfs stream of volume %s does not match the one backed up, expected SHA256 %s but got %s",
+			vol.ObjectName, vol.ZFSStreamSHA256, sum,
+		)
+	}
+	log.AppLogger.Debugf("Verified the zfs stream of volume %s.", vol.ObjectName)
+	return nil
+}
+
+// verifyRestoredSnapshot will check the snapshot received has the guid of the snapshot that was backed up.
+func verifyRestoredSnapshot(ctx context.Context, set *restoreSet) error {
+	snapshot := fmt.Sprintf("%s@%s", restoreVolumeName(&set.job), set.job.BaseSnapshot.Name)
+	guid, err := zfs.GetZFSProperty(ctx, "guid", snapshot)
 	if err != nil {
-		log.AppLogger.Errorf("There was an error during the restore process, aborting: %v", err)
+		log.AppLogger.Errorf("Could not find the restored snapshot %s to verify it - %v", snapshot, err)
 		return err
 	}
+	if set.manifest.SnapshotGUID == "" {
+		log.AppLogger.Warningf("No guid was recorded for %s when it was backed up, only its zfs stream was verified.", snapshot)
+		return nil
+	}
+	if guid != set.manifest.SnapshotGUID {
+		return fmt.Errorf("the restored snapshot %s has guid %s, expected %s as backed up", snapshot, guid, set.manifest.SnapshotGUID)
+	}
+	log.AppLogger.Noticef("Verified the restored snapshot %s (guid %s).", snapshot, guid)
+	return nil
+}
 
-	log.AppLogger.Noticef("Done. Elapsed Time: %v", time.Since(jobInfo.StartTime))
+// unrestorableProperties can only be set when a volume is created or are managed by other options, so they are never
+// set again by restoreProperties.
+var unrestorableProperties = map[string]bool{
+	"volsize":         true,
+	"volblocksize":    true,
+	"encryption":      true,
+	"keyformat":       true,
+	"keylocation":     true,
+	"pbkdf2iters":     true,
+	"casesensitivity": true,
+	"normalization":   true,
+	"utf8only":        true,
+}
+
+// restorableProperties returns the names of the properties recorded that may be set on the volume restored, sorted,
+// leaving out the properties excluded and those that cannot be set once a volume exists.
+func restorableProperties(properties map[string]string, exclude []string) []string {
+	excluded := make(map[string]bool, len(exclude))
+	for _, prop := range exclude {
+		excluded[prop] = true
+	}
+
+	names := make([]string, 0, len(properties))
+	for prop := range properties {
+		if excluded[prop] || unrestorableProperties[prop] {
+			continue
+		}
+		names = append(names, prop)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// restoreProperties will set the properties recorded when the volume was backed up on the volume restored. A property
+// that cannot be set is only warned about so the rest are still restored.
+func restoreProperties(ctx context.Context, properties map[string]string, exclude []string, volume string) {
+	if len(properties) == 0 {
+		log.AppLogger.Warningf("No properties were recorded for %s, there is nothing to restore.", volume)
+		return
+	}
+
+	for _, prop := range restorableProperties(properties, exclude) {
+		if err := zfs.SetZFSProperty(ctx, prop, properties[prop], volume); err != nil {
+			log.AppLogger.Warningf("Could not set %s=%s on %s - %v", prop, properties[prop], volume, err)
+			continue
+		}
+		log.AppLogger.Infof("Restored %s=%s on %s", prop, properties[prop], volume)
+	}
+}
+
+// loadRestoredKey will set the keylocation requested on the encryption root of the volume restored and load its key
+// so the volume can be used right away, mounting it unless the restore should not be mounted.
+func loadRestoredKey(ctx context.Context, jobInfo *files.JobInfo, volume string) error {
+	root, err := zfs.GetZFSProperty(ctx, "encryptionroot", volume)
+	if err != nil {
+		log.AppLogger.Errorf("Could not get the encryption root of %s - %v", volume, err)
+		return err
+	}
+	if root == "" || root == "-" {
+		log.AppLogger.Warningf("%s is not natively encrypted, there is no key to load.", volume)
+		return nil
+	}
+
+	if jobInfo.KeyLocation != "" {
+		log.AppLogger.Infof("Setting the keylocation of %s to %s.", root, jobInfo.KeyLocation)
+		if err = zfs.SetZFSProperty(ctx, "keylocation", jobInfo.KeyLocation, root); err != nil {
+			log.AppLogger.Errorf("Could not set the keylocation of %s - %v", root, err)
+			return err
+		}
+	}
+	if !jobInfo.LoadKey {
+		return nil
+	}
+
+	if status, _ := zfs.GetZFSProperty(ctx, "keystatus", root); status != "available" {
+		log.AppLogger.Noticef("Loading the encryption key of %s.", root)
+		if err = zfs.LoadKey(ctx, root); err != nil {
+			log.AppLogger.Errorf("Could not load the encryption key of %s - %v", root, err)
+			return err
+		}
+	}
+
+	if datasetType, _ := zfs.GetZFSProperty(ctx, "type", volume); datasetType == "filesystem" && !jobInfo.NotMounted {
+		if mounted, _ := zfs.GetZFSProperty(ctx, "mounted", volume); mounted != "yes" {
+			if err = zfs.MountDataset(ctx, volume); err != nil {
+				log.AppLogger.Warningf("Could not mount %s - %v", volume, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkLocalVolume will check the local volume can receive the backup set, returning true when the snapshot
+// it would restore already exists and there is nothing to do.
+func checkLocalVolume(ctx context.Context, jobInfo *files.JobInfo, volume string) (bool, error) {
+	if err := checkPartialReceive(ctx, jobInfo, volume); err != nil {
+		return false, err
+	}
+
+	if jobInfo.BaseSnapshot.CreationTime.IsZero() {
+		if ok, verr := validateSnapShotExists(ctx, &jobInfo.BaseSnapshot, volume, false); verr != nil {
+			log.AppLogger.Errorf("Cannot validate if selected base snapshot exists due to error - %v", verr)
+			return false, verr
+		} else if ok {
+			log.AppLogger.Noticef("Selected base snapshot already exists, nothing to do!")
+			return true, nil
+		}
+	}
+
+	// Check that we have the parent snap shot this wants to restore from
+	if jobInfo.IncrementalSnapshot.Name != "" && jobInfo.IncrementalSnapshot.CreationTime.IsZero() {
+		if ok, verr := validateSnapShotExists(ctx, &jobInfo.IncrementalSnapshot, volume, false); verr != nil {
+			log.AppLogger.Errorf("Cannot validate if selected incremental snapshot exists due to error - %v", verr)
+			return false, verr
+		} else if !ok {
+			log.AppLogger.Errorf("Selected incremental snapshot does not exist!")
+			return false, fmt.Errorf("selected incremental snapshot does not exist")
+		}
+	}
+
+	return false, nil
+}
+
+// checkPartialReceive will fail before anything is downloaded when the volume holds the state of an interrupted
+// resumable receive (zfs receive -s), which zfs would refuse to receive a new stream on top of. Such a receive can
+// only be resumed with the stream "zfs send -t" generates on the source pool, not with the backed up stream, so
+// the partial state is discarded when the AbortPartial option is set.
+func checkPartialReceive(ctx context.Context, j *files.JobInfo, volume string) error {
+	token, err := zfs.GetZFSProperty(ctx, "receive_resume_token", volume)
+	if err != nil || token == "" || token == "-" {
+		// The volume does not exist yet or holds no partial state
+		return nil
+	}
+
+	if !j.AbortPartial {
+		log.AppLogger.Errorf(
+			"%s holds the state of an interrupted resumable receive, which can only be resumed by running \"zfs send -t\" with "+
+				"its receive_resume_token on the source pool. Use the --abortPartial option to discard it and restore from the backup.",
+			volume,
+		)
+		return fmt.Errorf("%s holds the state of an interrupted resumable receive", volume)
+	}
+
+	log.AppLogger.Noticef("Discarding the state of the interrupted resumable receive found on %s.", volume)
+	if err = zfs.AbortReceive(ctx, volume); err != nil {
+		log.AppLogger.Errorf("Could not discard the partially received state of %s - %v", volume, err)
+		return err
+	}
+	return nil
+}
+
+// restoreTarget is a target a backup set can be restored from.
+type restoreTarget struct {
+	uri     string
+	backend backends.Backend
+}
+
+// closeRestoreTargets will close the backends of the targets provided.
+func closeRestoreTargets(targets []restoreTarget) {
+	for _, t := range targets {
+		t.backend.Close()
+	}
+}
+
+// prepareRestoreTargets will initialize the targets provided in the jobInfo, ordered by their priority and then
+// the order they were provided in. Targets that cannot be initialized are skipped so long as one target remains.
+func prepareRestoreTargets(ctx context.Context, jobInfo *files.JobInfo) ([]restoreTarget, error) {
+	uris := append([]string{}, jobInfo.Destinations...)
+	sort.SliceStable(uris, func(i, j int) bool {
+		return targetOptions(uris[i]).Priority > targetOptions(uris[j]).Priority
+	})
+
+	var (
+		targets []restoreTarget
+		err     error
+	)
+	for _, uri := range uris {
+		backend, berr := prepareBackend(ctx, jobInfo, uri, nil)
+		if berr != nil {
+			log.AppLogger.Warningf("Could not initialize backend for target %s due to error - %v.", uri, berr)
+			err = berr
+			continue
+		}
+		targets = append(targets, restoreTarget{uri: uri, backend: backend})
+	}
+
+	if len(targets) == 0 {
+		log.AppLogger.Errorf("Could not initialize a backend for any of the targets provided.")
+		return nil, err
+	}
+
+	return targets, nil
+}
+
+// orderTargetsForVolume will order the targets so those the manifest records as holding the volume are tried first.
+func orderTargetsForVolume(targets []restoreTarget, vol *files.VolumeInfo) []restoreTarget {
+	if len(vol.Targets) == 0 {
+		return targets
+	}
+
+	ordered := make([]restoreTarget, 0, len(targets))
+	var others []restoreTarget
+	for _, t := range targets {
+		if containsTarget(vol.Targets, t.uri) {
+			ordered = append(ordered, t)
+		} else {
+			others = append(others, t)
+		}
+	}
+
+	// Backups made with a relaxed target policy may not have every volume in every target
+	if len(ordered) == 0 {
+		log.AppLogger.Warningf(
+			"Volume %s is not recorded as being stored in any of the targets provided, it should be found in: %s",
+			vol.ObjectName, strings.Join(vol.Targets, ", "),
+		)
+	}
+
+	return append(ordered, others...)
+}
+
+// fetchManifest will read the manifest for the backup set described by the jobInfo from the local cache
+// for the target, downloading it from the target if required.
+func fetchManifest(ctx context.Context, jobInfo *files.JobInfo, t restoreTarget) (*files.JobInfo, error) {
+	// Get the local cache dir
+	localCachePath, cerr := getCacheDir(jobInfo, t.uri)
+	if cerr != nil {
+		log.AppLogger.Errorf("Could not get cache dir for target %s due to error - %v.", t.uri, cerr)
+		return nil, cerr
+	}
+
+	manifestObjectName := jobInfo.ManifestObjectName()
+	if jobInfo.ManifestVersion != "" {
+		// Read the requested version of the manifest instead of the current one
+		versioned, ok := t.backend.(backends.VersionedBackend)
+		if !ok {
+			log.AppLogger.Errorf("The target %s does not support reading previous manifest versions.", t.uri)
+			return nil, backends.ErrUnsupported
+		}
+		return readManifestVersion(ctx, jobInfo, localCachePath, versioned, manifestObjectName, jobInfo.ManifestVersion)
+	}
+
+	// nolint:gosec // MD5 not used for cryptographic purposes here
+	safeManifestFile := fmt.Sprintf("%x", md5.Sum([]byte(manifestObjectName)))
+	safeManifestPath := filepath.Join(localCachePath, safeManifestFile)
+
+	if err := fetchSignature(ctx, t.backend, manifestObjectName, safeManifestPath); err != nil {
+		log.AppLogger.Errorf("Could not download the signature of manifest %s - %v", manifestObjectName, err)
+		return nil, err
+	}
+
+	// Check to see if we have the manifest file locally
+	manifest, err := readManifest(ctx, safeManifestPath, jobInfo)
+	if os.IsNotExist(err) {
+		// Backups sent with hideNamesKeyFile can only be found by reading the manifests
+		if exists, eerr := objectExists(ctx, t.backend, manifestObjectName); eerr == nil && !exists {
+			return findManifest(ctx, jobInfo, t.uri)
+		}
+		if bErr := t.backend.PreDownload(ctx, []string{manifestObjectName}); bErr != nil {
+			log.AppLogger.Errorf("Error trying to pre download manifest volume %s - %v", manifestObjectName, bErr)
+			return nil, bErr
+		}
+		// Try and download the manifest file from the backend
+		if dErr := downloadTo(ctx, t.backend, manifestObjectName, safeManifestPath); dErr != nil {
+			return nil, dErr
+		}
+		manifest, err = readManifest(ctx, safeManifestPath, jobInfo)
+	}
+
+	return manifest, err
+}
+
+// findManifest will read every manifest in the target to find the one for the backup set described by the jobInfo.
+func findManifest(ctx context.Context, jobInfo *files.JobInfo, target string) (*files.JobInfo, error) {
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return nil, err
+	}
+	for _, manifest := range manifests {
+		if manifest.VolumeName == jobInfo.VolumeName && manifest.BaseSnapshot.Name == jobInfo.BaseSnapshot.Name &&
+			manifest.IncrementalSnapshot.Name == jobInfo.IncrementalSnapshot.Name {
+			return manifest, nil
+		}
+	}
+	log.AppLogger.Errorf("Could not find a manifest for the backup set in the target %s.", target)
+	return nil, errBackupSetNotFound
+}
+
+// validatePoolFeatures will check that the pool the volume is restored to supports every
+// feature required by the stream flags recorded in the manifest.
+func validatePoolFeatures(ctx context.Context, manifest *files.JobInfo, volume string) error {
+	if manifest.CompressedStream() && manifest.StreamCompression == "" {
+		log.AppLogger.Warningf(
+			"The compression of the compressed stream of %s was not recorded when it was backed up, the pool cannot be checked "+
+				"for the lz4_compress or zstd_compress features it may require before receiving it.", manifest.VolumeName,
+		)
+	}
+	for _, feature := range zfs.RequiredPoolFeatures(manifest) {
+		state, err := zfs.GetPoolFeature(ctx, feature, volume)
+		if err != nil {
+			return fmt.Errorf("could not determine if the pool supports the %s feature required by this backup - %v", feature, err)
+		}
+		if state != "enabled" && state != "active" {
+			return fmt.Errorf("the pool does not have the %s feature enabled, which is required by this backup", feature)
+		}
+	}
 	return nil
 }
 
@@ -392,6 +855,7 @@ func processSequence(ctx context.Context, sequence downloadSequence, backend bac
 		log.AppLogger.Infof("Could not get %s due to error %v.", sequence.volume.ObjectName, rerr)
 		return rerr
 	}
+	r = limitDownload(r)
 	defer r.Close()
 	vol, err := files.CreateSimpleVolume(ctx, usePipe)
 	if err != nil {
@@ -400,6 +864,10 @@ func processSequence(ctx context.Context, sequence downloadSequence, backend bac
 	}
 
 	vol.ObjectName = sequence.volume.ObjectName
+	vol.StoreOnly = sequence.volume.StoreOnly
+	if err = vol.UseDigest(sequence.volume.DigestAlgorithm); err != nil {
+		return backoff.Permanent(err)
+	}
 	if usePipe {
 		sequence.c <- vol
 	}
@@ -423,11 +891,11 @@ func processSequence(ctx context.Context, sequence downloadSequence, backend bac
 		return cerr
 	}
 
-	// Verify the SHA256 Hash, if it doesn't match, ditch it!
-	if vol.SHA256Sum != sequence.volume.SHA256Sum {
+	// Verify the Hash, if it doesn't match, ditch it!
+	if vol.Checksum() != sequence.volume.Checksum() {
 		log.AppLogger.Infof(
 			"Hash mismatch for %s, got %s but expected %s. Retrying.",
-			sequence.volume.ObjectName, vol.SHA256Sum, sequence.volume.SHA256Sum,
+			sequence.volume.ObjectName, vol.Checksum(), sequence.volume.Checksum(),
 		)
 		if usePipe {
 			return backoff.Permanent(fmt.Errorf("cannot retry when using no file buffer, aborting"))
@@ -436,8 +904,8 @@ func processSequence(ctx context.Context, sequence downloadSequence, backend bac
 			log.AppLogger.Noticef("Could not delete temporary file to download %s due to error - %v.", sequence.volume.ObjectName, err)
 		}
 		return fmt.Errorf(
-			"SHA256 hash mismatch for %s, got %s but expected %s",
-			sequence.volume.ObjectName, vol.SHA256Sum, sequence.volume.SHA256Sum,
+			"%s hash mismatch for %s, got %s but expected %s",
+			sequence.volume.ChecksumAlgorithm(), sequence.volume.ObjectName, vol.Checksum(), sequence.volume.Checksum(),
 		)
 	}
 	log.AppLogger.Debugf("Downloaded %s.", sequence.volume.ObjectName)
@@ -449,7 +917,14 @@ func processSequence(ctx context.Context, sequence downloadSequence, backend bac
 	return nil
 }
 
-func receiveStream(ctx context.Context, cmd *exec.Cmd, j *files.JobInfo, c <-chan *files.VolumeInfo, buffer <-chan interface{}) error {
+func receiveStream(
+	ctx context.Context,
+	cmd *exec.Cmd,
+	j *files.JobInfo,
+	c <-chan *files.VolumeInfo,
+	buffer <-chan interface{},
+	p *progress,
+) error {
 	buf := bytes.NewBuffer(nil)
 	cin, cout := io.Pipe()
 	cmd.Stdin = cin
@@ -484,36 +959,7 @@ func receiveStream(ctx context.Context, cmd *exec.Cmd, j *files.JobInfo, c <-cha
 	// Extract ZFS stream from files and send it to the zfs command
 	group.Go(func() error {
 		defer once.Do(func() { cout.Close() })
-		for {
-			select {
-			case vol, ok := <-c:
-				if !ok {
-					return nil
-				}
-				log.AppLogger.Debugf("Processing %s.", vol.ObjectName)
-				eerr := vol.Extract(ctx, j, false)
-				if eerr != nil {
-					log.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, eerr)
-					return err
-				}
-				_, eerr = io.Copy(cout, vol)
-				if eerr != nil {
-					log.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, eerr)
-					return eerr
-				}
-				if err = vol.Close(); err != nil {
-					log.AppLogger.Warningf("Could not close volume %s due to error - %v", vol.ObjectName, err)
-				}
-				if err = vol.DeleteVolume(); err != nil {
-					log.AppLogger.Warningf("Could not delete volume %s due to error - %v", vol.ObjectName, err)
-				}
-				log.AppLogger.Debugf("Processed %s.", vol.ObjectName)
-				vol = nil
-				<-buffer
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
+		return extractVolumes(ctx, j, c, buffer, p, cout, nil)
 	})
 
 	group.Go(func() error {
@@ -532,6 +978,17 @@ func receiveStream(ctx context.Context, cmd *exec.Cmd, j *files.JobInfo, c <-cha
 	return nil
 }
 
+// limitDownload will rate limit the reads from a download when a maximum download speed was set.
+func limitDownload(r io.ReadCloser) io.ReadCloser {
+	if config.BackupDownloadBucket == nil {
+		return r
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{ratelimit.Reader(r, config.BackupDownloadBucket), r}
+}
+
 func downloadTo(ctx context.Context, backend backends.Backend, objectName, toPath string) error {
 	r, rerr := backend.Download(ctx, objectName)
 	if rerr == nil {
@@ -543,7 +1000,7 @@ func downloadTo(ctx context.Context, backend backends.Backend, objectName, toPat
 		}
 		defer out.Close()
 
-		_, err := io.Copy(out, r)
+		_, err := io.Copy(out, limitDownload(r))
 		if err != nil {
 			log.AppLogger.Errorf("Could not download file %s to the local cache dir due to error - %v.", objectName, err)
 			return err
@@ -555,3 +1012,156 @@ func downloadTo(ctx context.Context, backend backends.Backend, objectName, toPat
 	}
 	return nil
 }
+
+// extractVolumes will write the zfs stream extracted from each of the volumes received, in order, to the writer,
+// calling done, if provided, once each volume was written.
+func extractVolumes(
+	ctx context.Context,
+	j *files.JobInfo,
+	c <-chan *files.VolumeInfo,
+	buffer <-chan interface{},
+	p *progress,
+	w io.Writer,
+	done func(*files.VolumeInfo) error,
+) error {
+	for {
+		select {
+		case vol, ok := <-c:
+			if !ok {
+				return nil
+			}
+			log.AppLogger.Debugf("Processing %s.", vol.ObjectName)
+			p.setVolumeStage(vol, volumeReceiving)
+			if err := vol.Extract(ctx, j, false); err != nil {
+				log.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, err)
+				return err
+			}
+			streamHash := sha256.New()
+			if _, err := io.Copy(io.MultiWriter(w, p, streamHash), vol); err != nil {
+				log.AppLogger.Errorf("Error while trying to read from volume %s - %v", vol.ObjectName, err)
+				return err
+			}
+			if err := verifyStreamDigest(j, vol, streamHash); err != nil {
+				log.AppLogger.Errorf("%v", err)
+				return err
+			}
+			if done != nil {
+				if err := done(vol); err != nil {
+					log.AppLogger.Errorf("Error while recording volume %s as written - %v", vol.ObjectName, err)
+					return err
+				}
+			}
+			if err := vol.Close(); err != nil {
+				log.AppLogger.Warningf("Could not close volume %s due to error - %v", vol.ObjectName, err)
+			}
+			if err := vol.DeleteVolume(); err != nil {
+				log.AppLogger.Warningf("Could not delete volume %s due to error - %v", vol.ObjectName, err)
+			}
+			log.AppLogger.Debugf("Processed %s.", vol.ObjectName)
+			p.volumeDone(vol)
+			p.addWritten(vol.Size)
+			p.addTransferred(vol.Size)
+			<-buffer
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// openPartialStream opens the temporary stream file, keeping the offset bytes already written to it when resuming.
+func openPartialStream(partial string, offset uint64) (*os.File, error) {
+	if offset == 0 {
+		return os.Create(partial)
+	}
+	f, err := os.OpenFile(partial, os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// Drop anything written after the last volume recorded
+	if err = f.Truncate(int64(offset)); err == nil {
+		_, err = f.Seek(int64(offset), io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// streamFilePath returns the path the ToFile option writes the zfs stream of the backup set to, named after the
+// volume and snapshot(s) so the files of a chain can be told apart, e.g. Tank_Dataset@snap1..snap2.zstream.
+func streamFilePath(j *files.JobInfo) string {
+	name := strings.ReplaceAll(j.VolumeName, "/", "_") + "@"
+	if j.IncrementalSnapshot.Name != "" {
+		name += j.IncrementalSnapshot.Name + ".."
+	}
+	name += j.BaseSnapshot.Name + ".zstream"
+	return filepath.Join(j.ToFile, name)
+}
+
+// receiveToFile will write the zfs stream of the backup set to the path provided, so it can be received with
+// "zfs receive" later or on another machine. The stream is written to a temporary file next to it that is only
+// renamed once complete, and an existing file is never overwritten. With a checkpoint, the temporary file is kept
+// when interrupted and the restore resumes after the last volume written to it.
+func receiveToFile(
+	ctx context.Context,
+	path string,
+	set *restoreSet,
+	c <-chan *files.VolumeInfo,
+	buffer <-chan interface{},
+	p *progress,
+	checkpoint *restoreCheckpoint,
+) error {
+	if _, err := os.Stat(path); err == nil {
+		log.AppLogger.Errorf("The stream file %s already exists, remove it to write it again.", path)
+		return fmt.Errorf("%s already exists", path)
+	}
+
+	partial := path + ".partial"
+	f, err := openPartialStream(partial, set.offset)
+	if err != nil {
+		log.AppLogger.Errorf("Could not create the stream file %s - %v", partial, err)
+		return err
+	}
+	log.AppLogger.Infof("Writing the zfs stream to %s.", path)
+
+	if err = checkpoint.start(path, set.offset > 0); err == nil {
+		err = extractVolumes(ctx, set.manifest, c, buffer, p, f, func(vol *files.VolumeInfo) error {
+			if checkpoint == nil {
+				return nil
+			}
+			// Only record the volume once it is safely on disk
+			if serr := f.Sync(); serr != nil {
+				return serr
+			}
+			size, serr := f.Seek(0, io.SeekCurrent)
+			if serr != nil {
+				return serr
+			}
+			return checkpoint.volumeWritten(vol, uint64(size))
+		})
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(partial, path)
+	}
+	if err != nil {
+		if checkpoint != nil {
+			log.AppLogger.Noticef("Kept the incomplete stream file %s, run the same restore again to resume it.", partial)
+		} else if rerr := os.Remove(partial); rerr != nil && !os.IsNotExist(rerr) {
+			log.AppLogger.Warningf("Could not remove the incomplete stream file %s - %v", partial, rerr)
+		}
+		return err
+	}
+	if err = checkpoint.written(path); err != nil {
+		log.AppLogger.Warningf("Could not record %s as written in the restore checkpoint - %v", path, err)
+	}
+
+	log.AppLogger.Noticef("Wrote the zfs stream to %s, it can be restored with: zfs receive <volume> < %s", path, path)
+	return nil
+}
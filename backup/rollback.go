@@ -0,0 +1,103 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+var errRollbackNotConfirmed = errors.New("the forced rollback of the local volume was not confirmed")
+
+// checkForcedRollback will look for local data the Force option would discard when receiving the backup set
+// incremental from the snapshot provided (a full backup when empty) into the volume: the snapshots taken after that
+// snapshot, and the changes written since the latest snapshot. The restore only goes ahead when this was confirmed,
+// with the AssumeYes option or interactively.
+func checkForcedRollback(ctx context.Context, jobInfo *files.JobInfo, volume, from string) error {
+	if !jobInfo.Force || jobInfo.ToFile != "" {
+		return nil
+	}
+
+	snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, volume)
+	if zfs.IsDatasetNotExist(err) {
+		// The volume does not exist yet, there is nothing to discard
+		return nil
+	} else if err != nil {
+		log.AppLogger.Errorf("Could not list the snapshots of %s to check what the -F flag would discard - %v", volume, err)
+		return err
+	}
+	losses := forcedRollbackLosses(snapshots, from)
+	if written, werr := zfs.GetZFSProperty(ctx, "written", volume); werr == nil && written != "0" && written != "-" {
+		losses = append(losses, fmt.Sprintf("the changes written to %s since its latest snapshot (%s bytes)", volume, written))
+	}
+	if len(losses) == 0 {
+		return nil
+	}
+
+	log.AppLogger.Warningf("Receiving into %s with the -F flag will discard: %s", volume, strings.Join(losses, "; "))
+	if jobInfo.AssumeYes {
+		return nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		log.AppLogger.Errorf("Refusing to discard local data on %s without confirmation, use the --yes option to proceed.", volume)
+		return errRollbackNotConfirmed
+	}
+
+	if !Confirm(fmt.Sprintf("Discard this data on %s and continue the restore?", volume)) {
+		log.AppLogger.Errorf("The restore into %s was cancelled.", volume)
+		return errRollbackNotConfirmed
+	}
+	return nil
+}
+
+// forcedRollbackLosses describes the snapshots a forced receive incremental from the snapshot provided would destroy,
+// every snapshot for a full receive. The snapshots are expected newest first.
+func forcedRollbackLosses(snapshots []files.SnapshotInfo, from string) []string {
+	var newer []string
+	for _, snapshot := range snapshots {
+		if snapshot.Bookmark {
+			continue
+		}
+		if from != "" && snapshot.Name == from {
+			break
+		}
+		newer = append(newer, snapshot.Name)
+	}
+	if len(newer) == 0 {
+		if from == "" {
+			return []string{"the existing volume"}
+		}
+		return nil
+	}
+	if from == "" {
+		return []string{fmt.Sprintf("the existing volume and its snapshots %s", strings.Join(newer, ", "))}
+	}
+	return []string{fmt.Sprintf("the snapshots taken after %s: %s", from, strings.Join(newer, ", "))}
+}
@@ -0,0 +1,146 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// sandboxSuffix is appended to the name of the local volume to get the dataset a sandboxed restore is received into.
+const sandboxSuffix = "_zfsbackup_sandbox"
+
+// SandboxRestore will restore into a temporary dataset next to the local volume instead of the local volume itself,
+// run the hook provided against it, and only then rename it to the local volume. A restore that fails part way, or
+// does not pass the hook, never replaces the local volume. An existing local volume is only replaced with the Force
+// option, and is kept under a new name rather than destroyed.
+func SandboxRestore(ctx context.Context, jobInfo *files.JobInfo, hook string) error {
+	target := jobInfo.LocalVolume
+	sandbox := target + sandboxSuffix
+
+	if _, err := zfs.GetDatasets(ctx, sandbox); err == nil {
+		log.AppLogger.Errorf("The sandbox dataset %s was left by a previous restore, inspect and destroy it before restoring again.", sandbox)
+		return fmt.Errorf("sandbox dataset %s already exists", sandbox)
+	}
+	_, terr := zfs.GetDatasets(ctx, target)
+	targetExists := terr == nil
+	if targetExists && !jobInfo.Force {
+		log.AppLogger.Errorf("The local volume %s already exists, use the -F option to replace it once the sandboxed restore succeeded.", target)
+		return fmt.Errorf("local volume %s already exists", target)
+	}
+
+	// Restore the whole chain into the sandbox, never mounting it over the paths of the local volume
+	restoreJob := cloneJobInfo(jobInfo)
+	restoreJob.LocalVolume = sandbox
+	restoreJob.BaseSnapshot.CreationTime = time.Time{}
+	restoreJob.NotMounted = true
+	restore := Receive
+	if jobInfo.AutoRestore {
+		restore = AutoRestore
+	}
+	log.AppLogger.Noticef("Restoring into the sandbox dataset %s.", sandbox)
+	if err := restore(ctx, restoreJob); err != nil {
+		log.AppLogger.Errorf("Could not restore into the sandbox dataset %s, %s was left untouched - %v", sandbox, target, err)
+		if _, derr := zfs.GetDatasets(context.Background(), sandbox); derr == nil {
+			if derr = zfs.DestroyDataset(context.Background(), sandbox); derr != nil {
+				log.AppLogger.Warningf("Could not destroy the sandbox dataset %s - %v", sandbox, derr)
+			}
+		}
+		return err
+	}
+
+	if hook != "" {
+		if err := runSandboxHook(ctx, hook, sandbox, target); err != nil {
+			log.AppLogger.Errorf("The verification hook failed, the restore was left in the sandbox dataset %s for inspection - %v", sandbox, err)
+			return err
+		}
+	}
+
+	return promoteSandbox(ctx, jobInfo, sandbox, target, targetExists)
+}
+
+// runSandboxHook will run the hook through the shell, with the names of the sandbox dataset and of the local volume
+// it will replace in the ZFSBACKUP_SANDBOX and ZFSBACKUP_TARGET environment variables.
+func runSandboxHook(ctx context.Context, hook, sandbox, target string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+	cmd.Env = append(os.Environ(), "ZFSBACKUP_SANDBOX="+sandbox, "ZFSBACKUP_TARGET="+target)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	log.AppLogger.Noticef("Running the verification hook against %s: %s", sandbox, hook)
+	return cmd.Run()
+}
+
+// promoteSandbox will rename the sandbox dataset to the local volume, moving the local volume out of the way first
+// when it exists, and mount it unless the restore should not be mounted. When the sandbox cannot be renamed, the
+// local volume moved out of the way is renamed back.
+func promoteSandbox(ctx context.Context, jobInfo *files.JobInfo, sandbox, target string, targetExists bool) error {
+	var replaced string
+	var wasMounted bool
+	if targetExists {
+		if mounted, _ := zfs.GetZFSProperty(ctx, "mounted", target); mounted == "yes" {
+			wasMounted = true
+			if err := zfs.UnmountDataset(ctx, target); err != nil {
+				log.AppLogger.Errorf("Could not unmount %s to replace it, the restore was left in the sandbox dataset %s - %v", target, sandbox, err)
+				return err
+			}
+		}
+		replaced = fmt.Sprintf("%s_replaced_%s", target, time.Now().Format("20060102150405"))
+		if err := zfs.RenameDataset(ctx, target, replaced); err != nil {
+			log.AppLogger.Errorf("Could not rename %s to %s, the restore was left in the sandbox dataset %s - %v", target, replaced, sandbox, err)
+			return err
+		}
+	}
+
+	if err := zfs.RenameDataset(ctx, sandbox, target); err != nil {
+		log.AppLogger.Errorf("Could not rename the sandbox dataset %s to %s - %v", sandbox, target, err)
+		if replaced != "" {
+			if rerr := zfs.RenameDataset(context.Background(), replaced, target); rerr != nil {
+				log.AppLogger.Errorf("Could not rename %s back to %s, rename it by hand - %v", replaced, target, rerr)
+			} else {
+				log.AppLogger.Noticef("Renamed %s back to %s, the restore was left in the sandbox dataset %s.", replaced, target, sandbox)
+				if wasMounted {
+					if merr := zfs.MountDataset(context.Background(), target); merr != nil {
+						log.AppLogger.Warningf("Could not mount %s again - %v", target, merr)
+					}
+				}
+			}
+		}
+		return err
+	}
+	if replaced != "" {
+		log.AppLogger.Noticef("The previous %s was kept as %s, destroy it once it is no longer needed.", target, replaced)
+	}
+
+	if datasetType, _ := zfs.GetZFSProperty(ctx, "type", target); datasetType == "filesystem" && !jobInfo.NotMounted {
+		if err := zfs.MountDataset(ctx, target); err != nil {
+			log.AppLogger.Warningf("Could not mount %s - %v", target, err)
+		}
+	}
+	log.AppLogger.Noticef("Restored %s from the sandbox dataset.", target)
+	return nil
+}
@@ -0,0 +1,475 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// The actions that can be triggered from the dashboard.
+const (
+	ActionVerify        = "verify"
+	ActionRestoreDryRun = "restore-dry-run"
+)
+
+// Serve will run a web dashboard on the address provided showing, for each of the targets, the datasets backed up,
+// when they were last backed up, their current incremental chain, and the storage they consume. Verifying the backup
+// sets of a dataset, checking only a sample of their volumes, and a dry run of its restore can be triggered from the
+// dashboard. Actions run one at a time in the background. Serve returns on an interrupt.
+func Serve(pctx context.Context, jobInfo *files.JobInfo, targets []string, listen string, verifySample int) error {
+	ctx, stop := signal.NotifyContext(pctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+	d := &dashboard{ctx: ctx, jobInfo: jobInfo, targets: targets, verifySample: verifySample, token: hex.EncodeToString(token)}
+	server := &http.Server{Handler: d.handler(), ReadHeaderTimeout: 10 * time.Second}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		log.AppLogger.Errorf("Could not listen on %s - %v", listen, err)
+		return err
+	}
+	log.AppLogger.Noticef("Serving the dashboard on http://%s/, interrupt to stop.", listener.Addr())
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if serr := server.Shutdown(shutdownCtx); serr != nil {
+			log.AppLogger.Warningf("Could not shut the dashboard down cleanly - %v", serr)
+		}
+	}()
+	if err = server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		log.AppLogger.Errorf("The dashboard stopped unexpectedly - %v", err)
+		return err
+	}
+	return nil
+}
+
+// dashboard serves the web dashboard and runs the actions triggered from it.
+type dashboard struct {
+	ctx          context.Context
+	jobInfo      *files.JobInfo
+	targets      []string
+	verifySample int
+	// token is generated for each run and required by actions, so other sites cannot trigger them
+	token string
+
+	mu      sync.Mutex
+	actions []*serverAction
+	running sync.Mutex
+}
+
+// serverAction is an action triggered from the dashboard, along with the output it wrote.
+type serverAction struct {
+	ID       int
+	Kind     string
+	Target   string
+	Volume   string
+	Started  time.Time
+	Finished time.Time
+	Error    string
+	Output   string
+
+	output *lockedBuffer
+}
+
+// lockedBuffer is a buffer that can be written by an action while it is read by the dashboard.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// dashboardTarget is a target as shown on the dashboard.
+type dashboardTarget struct {
+	URI         string
+	Error       string
+	BackupSets  int
+	StoredBytes uint64
+	Datasets    []dashboardDataset
+}
+
+// dashboardDataset is a dataset as shown on the dashboard, with the backup sets of its current incremental chain
+// from its full backup to its latest backup set.
+type dashboardDataset struct {
+	*DatasetStats
+	LastBackup time.Time
+	Chain      []files.SnapshotInfo
+}
+
+func (d *dashboard) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", d.serveIndex)
+	mux.HandleFunc("/actions", d.serveStartAction)
+	mux.HandleFunc("/actions/", d.serveAction)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowedDashboardHost(r.Host) {
+			http.Error(w, "the dashboard must be reached by IP address or as localhost", http.StatusMisdirectedRequest)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// allowedDashboardHost reports whether the dashboard may answer a request for the Host provided. Only IP addresses
+// and localhost are accepted, so a page served from a name resolving to the dashboard (DNS rebinding) is refused.
+func allowedDashboardHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	return strings.EqualFold(host, "localhost") || net.ParseIP(host) != nil
+}
+
+// sameOrigin reports whether the request was sent by a page of the dashboard itself, from its Origin header, or its
+// Referer header when the browser sent no Origin.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Referer()
+	}
+	if origin == "" {
+		// Not sent by a browser, the token is still required
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (d *dashboard) serveIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	targets := make([]dashboardTarget, 0, len(d.targets))
+	for _, target := range d.targets {
+		entry := dashboardTarget{URI: target}
+		manifests, err := readTargetManifests(r.Context(), d.jobInfo, target)
+		if err != nil {
+			entry.Error = err.Error()
+		} else {
+			entry.BackupSets = len(manifests)
+			entry.Datasets = buildDashboardDatasets(manifests)
+			for _, dataset := range entry.Datasets {
+				entry.StoredBytes += dataset.StoredBytes
+			}
+		}
+		targets = append(targets, entry)
+	}
+
+	d.render(w, indexTemplate, struct {
+		Generated time.Time
+		Token     string
+		Targets   []dashboardTarget
+		Actions   []serverAction
+	}{time.Now(), d.token, targets, d.listActions()})
+}
+
+func (d *dashboard) serveStartAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "actions must be triggered with a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !sameOrigin(r) || subtle.ConstantTimeCompare([]byte(r.FormValue("token")), []byte(d.token)) != 1 {
+		http.Error(w, "actions can only be triggered from the dashboard", http.StatusForbidden)
+		return
+	}
+
+	action, err := d.startAction(r.FormValue("kind"), r.FormValue("target"), r.FormValue("volume"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, "/actions/"+strconv.Itoa(action.ID), http.StatusSeeOther)
+}
+
+func (d *dashboard) serveAction(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/actions/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	for _, action := range d.listActions() {
+		if action.ID == id {
+			d.render(w, actionTemplate, action)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (d *dashboard) render(w http.ResponseWriter, tmpl *template.Template, data interface{}) {
+	var page bytes.Buffer
+	if err := tmpl.Execute(&page, data); err != nil {
+		log.AppLogger.Errorf("Could not render the dashboard - %v", err)
+		http.Error(w, "could not render the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = page.WriteTo(w)
+}
+
+// startAction will queue the action on the volume of the target provided, returning an error if either is unknown.
+func (d *dashboard) startAction(kind, target, volume string) (*serverAction, error) {
+	if kind != ActionVerify && kind != ActionRestoreDryRun {
+		return nil, errors.New("unknown action " + kind)
+	}
+	known := false
+	for _, t := range d.targets {
+		known = known || t == target
+	}
+	if !known {
+		return nil, errors.New("unknown target " + target)
+	}
+	if volume == "" {
+		return nil, errors.New("no volume provided")
+	}
+
+	d.mu.Lock()
+	action := &serverAction{ID: len(d.actions) + 1, Kind: kind, Target: target, Volume: volume, Started: time.Now(), output: new(lockedBuffer)}
+	d.actions = append(d.actions, action)
+	d.mu.Unlock()
+
+	log.AppLogger.Noticef("Starting %s of %s in %s from the dashboard.", kind, volume, target)
+	go d.runAction(action)
+	return action, nil
+}
+
+// runAction runs the action, once any other action finished, writing its output to the action rather than stdout.
+func (d *dashboard) runAction(action *serverAction) {
+	d.running.Lock()
+	defer d.running.Unlock()
+
+	job := cloneJobInfo(d.jobInfo)
+	job.Destinations = []string{action.Target}
+	var err error
+	switch action.Kind {
+	case ActionVerify:
+		err = verifyBackupSets(d.ctx, action.output, job, action.Volume, action.Target, d.verifySample)
+	case ActionRestoreDryRun:
+		job.VolumeName = action.Volume
+		job.LocalVolume = action.Volume
+		job.AutoRestore = true
+		err = restoreDryRun(d.ctx, action.output, job)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	action.Finished = time.Now()
+	if err != nil {
+		action.Error = err.Error()
+	}
+}
+
+// listActions returns a copy of the actions triggered, the latest first.
+func (d *dashboard) listActions() []serverAction {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	actions := make([]serverAction, 0, len(d.actions))
+	for i := len(d.actions) - 1; i >= 0; i-- {
+		action := d.actions[i]
+		actions = append(actions, serverAction{
+			ID:       action.ID,
+			Kind:     action.Kind,
+			Target:   action.Target,
+			Volume:   action.Volume,
+			Started:  action.Started,
+			Finished: action.Finished,
+			Error:    action.Error,
+			Output:   action.output.String(),
+		})
+	}
+	return actions
+}
+
+// buildDashboardDatasets returns the datasets of the manifests, sorted by name, with their current incremental chain.
+func buildDashboardDatasets(manifests []*files.JobInfo) []dashboardDataset {
+	stats := aggregateStats(manifests)
+
+	latest := make(map[string]*files.JobInfo)
+	for _, manifest := range manifests {
+		if last, ok := latest[manifest.VolumeName]; !ok || manifest.BaseSnapshot.CreationTime.After(last.BaseSnapshot.CreationTime) {
+			latest[manifest.VolumeName] = manifest
+		}
+	}
+
+	datasets := make([]dashboardDataset, 0, len(stats))
+	for _, stat := range stats {
+		dataset := dashboardDataset{DatasetStats: stat}
+		if last := latest[stat.VolumeName]; last != nil {
+			dataset.LastBackup = last.EndTime
+			for set := last; set != nil; set = set.ParentSnap {
+				dataset.Chain = append(dataset.Chain, set.BaseSnapshot)
+				if set.IncrementalSnapshot.Name == "" {
+					break
+				}
+			}
+			// Show the chain from its full backup
+			for i, j := 0, len(dataset.Chain)-1; i < j; i, j = i+1, j-1 {
+				dataset.Chain[i], dataset.Chain[j] = dataset.Chain[j], dataset.Chain[i]
+			}
+		}
+		datasets = append(datasets, dataset)
+	}
+	return datasets
+}
+
+var templateFuncs = template.FuncMap{
+	"bytes": humanize.IBytes,
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return humanize.Time(t)
+	},
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	},
+}
+
+const dashboardStyle = `<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border-bottom: 1px solid #ddd; padding: 0.4em 0.8em; text-align: left; vertical-align: top; }
+.error { color: #b00020; }
+.chain span { display: inline-block; padding: 0.1em 0.4em; margin: 0.1em; border-radius: 3px; font-size: 0.85em; }
+.chain .full { background: #1e6bb8; color: #fff; }
+.chain .incremental { background: #d6e6f5; }
+form { display: inline; }
+pre { background: #f4f4f4; padding: 1em; overflow-x: auto; }
+</style>`
+
+var indexTemplate = template.Must(template.New("index").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>zfsbackup</title>` + dashboardStyle + `</head>
+<body>
+<h1>zfsbackup</h1>
+<p>As of {{time .Generated}}.</p>
+{{range $target := .Targets}}
+<h2>{{$target.URI}}</h2>
+{{if $target.Error}}<p class="error">Could not read the target - {{$target.Error}}</p>{{else}}
+<p>{{$target.BackupSets}} backup sets of {{len $target.Datasets}} datasets, {{bytes $target.StoredBytes}} stored.</p>
+<table>
+<tr><th>Dataset</th><th>Last Backup</th><th>Sets</th><th>Stored</th><th>Logical</th><th>Current Chain</th><th></th></tr>
+{{range $target.Datasets}}
+<tr>
+<td>{{.VolumeName}}</td>
+<td>{{ago .LastBackup}}<br><small>{{time .LastBackup}}</small></td>
+<td>{{.BackupSets}} ({{.FullBackups}} full)</td>
+<td>{{bytes .StoredBytes}}</td>
+<td>{{bytes .LogicalBytes}}</td>
+<td class="chain">{{range $i, $s := .Chain}}
+<span class="{{if eq $i 0}}full{{else}}incremental{{end}}" title="{{time $s.CreationTime}}">{{$s.Name}}</span>
+{{- end}}</td>
+<td>
+<form method="post" action="/actions">
+<input type="hidden" name="kind" value="verify">
+<input type="hidden" name="target" value="{{$target.URI}}">
+<input type="hidden" name="volume" value="{{.VolumeName}}">
+<input type="hidden" name="token" value="{{$.Token}}">
+<button>Verify</button>
+</form>
+<form method="post" action="/actions">
+<input type="hidden" name="kind" value="restore-dry-run">
+<input type="hidden" name="target" value="{{$target.URI}}">
+<input type="hidden" name="volume" value="{{.VolumeName}}">
+<input type="hidden" name="token" value="{{$.Token}}">
+<button>Restore Dry Run</button>
+</form>
+</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+{{end}}
+{{if .Actions}}
+<h2>Actions</h2>
+<table>
+<tr><th>Action</th><th>Dataset</th><th>Target</th><th>Started</th><th>Status</th></tr>
+{{range .Actions}}
+<tr>
+<td><a href="/actions/{{.ID}}">{{.Kind}}</a></td><td>{{.Volume}}</td><td>{{.Target}}</td><td>{{time .Started}}</td>
+<td>{{if .Finished.IsZero}}running{{else if .Error}}<span class="error">failed</span>{{else}}succeeded{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+var actionTemplate = template.Must(template.New("action").Funcs(templateFuncs).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">{{if .Finished.IsZero}}<meta http-equiv="refresh" content="2">{{end}}
+<title>zfsbackup - {{.Kind}} of {{.Volume}}</title>` + dashboardStyle + `</head>
+<body>
+<p><a href="/">Back to the dashboard</a></p>
+<h1>{{.Kind}} of {{.Volume}}</h1>
+<p>Target {{.Target}}, started {{time .Started}}.</p>
+{{if .Finished.IsZero}}<p>Running...</p>
+{{else if .Error}}<p class="error">Failed at {{time .Finished}} - {{.Error}}</p>
+{{else}}<p>Succeeded at {{time .Finished}}.</p>{{end}}
+<pre>{{.Output}}</pre>
+</body>
+</html>
+`))
@@ -0,0 +1,138 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// signaturePath returns where the detached signature of the manifest cached at manifestPath is kept.
+func signaturePath(manifestPath string) string {
+	return filepath.Join(filepath.Dir(manifestPath), "signatures", filepath.Base(manifestPath))
+}
+
+// verifyManifest will check the detached signature of the manifest cached at manifestPath when a key to verify it
+// with was provided. Manifests uploaded before detached signatures were written only have the signature embedded
+// in them, which is checked as they are read instead.
+func verifyManifest(ctx context.Context, manifestPath string, j *files.JobInfo) error {
+	if j.SignKey == nil && !(j.GPGAgent && j.SignFrom != "") {
+		return nil
+	}
+
+	sigPath := signaturePath(manifestPath)
+	if _, err := os.Stat(sigPath); os.IsNotExist(err) {
+		log.AppLogger.Debugf("No detached signature found for %s, relying on its embedded signature.", manifestPath)
+		return nil
+	}
+
+	if err := files.VerifySignature(ctx, j, manifestPath, sigPath); err != nil {
+		return fmt.Errorf("the detached signature of the manifest %s could not be verified - %v", manifestPath, err)
+	}
+	return nil
+}
+
+// cacheSignature will keep the detached signature of the manifest, if any, next to its copy at manifestPath, removing
+// the signature of a manifest it replaced otherwise.
+func cacheSignature(vol *files.VolumeInfo, manifestPath string) error {
+	sigPath := signaturePath(manifestPath)
+	if vol.Signature == nil {
+		if err := os.Remove(sigPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(sigPath), os.ModePerm); err != nil {
+		return err
+	}
+	return os.WriteFile(sigPath, vol.Signature, 0o600)
+}
+
+// uploadSignature will upload the detached signature of the manifest, if any, next to it. Use replaceSignature when
+// the manifest may replace a signed one.
+func uploadSignature(ctx context.Context, b backends.Backend, vol *files.VolumeInfo) error {
+	if vol.Signature == nil {
+		return nil
+	}
+
+	// Signatures are small, keep them in memory so nothing is written to disk, as with the --noCache option
+	sig := files.CreateMemoryVolume()
+	sig.ObjectName = vol.ObjectName + files.SignatureSuffix
+	if _, err := sig.Write(vol.Signature); err != nil {
+		_ = sig.Close()
+		return err
+	}
+	if err := sig.Close(); err != nil {
+		return err
+	}
+
+	if err := sig.OpenVolume(); err != nil {
+		return err
+	}
+	defer sig.Close()
+	return b.Upload(ctx, sig)
+}
+
+// replaceSignature will upload the detached signature of the manifest, or delete the signature of the manifest it
+// replaced when it has none.
+func replaceSignature(ctx context.Context, b backends.Backend, vol *files.VolumeInfo) error {
+	if vol.Signature == nil {
+		deleteSignature(ctx, b, vol.ObjectName)
+		return nil
+	}
+	return uploadSignature(ctx, b, vol)
+}
+
+// fetchSignature will download the detached signature of the manifest named objectName to the local cache, if the
+// target holds one and it was not downloaded yet.
+func fetchSignature(ctx context.Context, b backends.Backend, objectName, manifestPath string) error {
+	sigPath := signaturePath(manifestPath)
+	if _, err := os.Stat(sigPath); err == nil {
+		return nil
+	}
+
+	exists, err := objectExists(ctx, b, objectName+files.SignatureSuffix)
+	if err != nil || !exists {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(sigPath), os.ModePerm); err != nil {
+		return err
+	}
+	return downloadTo(ctx, b, objectName+files.SignatureSuffix, sigPath)
+}
+
+// deleteSignature will delete the detached signature of the manifest named objectName, if the target holds one.
+func deleteSignature(ctx context.Context, b backends.Backend, objectName string) {
+	exists, err := objectExists(ctx, b, objectName+files.SignatureSuffix)
+	if err == nil && exists {
+		err = b.Delete(ctx, objectName+files.SignatureSuffix)
+	}
+	if err != nil {
+		log.AppLogger.Warningf("Could not delete the signature of the manifest %s - %v", objectName, err)
+	}
+}
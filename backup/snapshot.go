@@ -0,0 +1,120 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// Snapshot will take a snapshot of the dataset named using the nameTemplate, the same way the SnapshotBefore option
+// names them, along with the snapshots of its descendants when the job is recursive. The snapshots matching the
+// snapshot prefix and regexp of the job that are expired under the policy are then destroyed, for the dataset and
+// each of its descendants when recursive. Snapshots that cannot be destroyed, e.g. because they are held, are skipped.
+// When dryRun is set the snapshots that would be taken and destroyed are reported instead.
+func Snapshot(ctx context.Context, jobInfo *files.JobInfo, dataset, nameTemplate string, policy RetentionPolicy, dryRun bool) error {
+	filter := newSnapshotFilter(jobInfo.SnapshotPrefix, jobInfo.SnapshotRegexp)
+	if nameTemplate != "" {
+		name, err := snapshotName(nameTemplate, dataset, time.Now())
+		if err != nil {
+			return err
+		}
+		if !includeSnapshot(&files.SnapshotInfo{Name: name}, filter) {
+			return fmt.Errorf("the snapshot name %s does not match the snapshot prefix or regex provided and would never expire", name)
+		}
+
+		if dryRun {
+			log.AppLogger.Noticef("Would take snapshot %s@%s.", dataset, name)
+		} else {
+			log.AppLogger.Noticef("Taking snapshot %s@%s.", dataset, name)
+			if err = zfs.CreateSnapshot(ctx, dataset, name, jobInfo.Recursive); err != nil {
+				log.AppLogger.Errorf("Could not take snapshot %s@%s - %v", dataset, name, err)
+				return err
+			}
+		}
+	}
+
+	if policy.KeepLast == 0 && policy.KeepDaily == 0 && policy.KeepWeekly == 0 && policy.KeepMonthly == 0 {
+		return nil
+	}
+
+	datasets := []string{dataset}
+	if jobInfo.Recursive {
+		var err error
+		if datasets, err = zfs.GetDatasets(ctx, dataset); err != nil {
+			log.AppLogger.Errorf("Could not list the datasets beneath %s - %v", dataset, err)
+			return err
+		}
+	}
+
+	destroyed, kept := 0, 0
+	for _, ds := range datasets {
+		snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, ds)
+		if err != nil {
+			log.AppLogger.Errorf("Could not list the snapshots of %s - %v", ds, err)
+			return err
+		}
+
+		// Snapshots are listed newest first
+		var managed []files.SnapshotInfo
+		for idx := range snapshots {
+			if !snapshots[idx].Bookmark && includeSnapshot(&snapshots[idx], filter) {
+				managed = append(managed, snapshots[idx])
+			}
+		}
+		times := make([]time.Time, len(managed))
+		for idx := range managed {
+			times[idx] = managed[idx].CreationTime
+		}
+
+		for idx, periods := range retainedByPolicy(times, policy, time.Local) {
+			snapshot := fmt.Sprintf("%s@%s", ds, managed[idx].Name)
+			switch {
+			case len(periods) > 0:
+				kept++
+				log.AppLogger.Debugf("Keeping snapshot %s (%v).", snapshot, periods)
+			case dryRun:
+				destroyed++
+				log.AppLogger.Noticef("Would destroy snapshot %s.", snapshot)
+			default:
+				if err = zfs.DestroySnapshot(ctx, snapshot); err != nil {
+					kept++
+					log.AppLogger.Warningf("Could not destroy snapshot %s, it may be held or cloned - %v", snapshot, err)
+					continue
+				}
+				destroyed++
+				log.AppLogger.Infof("Destroyed snapshot %s.", snapshot)
+			}
+		}
+	}
+
+	if dryRun {
+		log.AppLogger.Noticef("Would destroy %d expired snapshots and keep %d.", destroyed, kept)
+	} else {
+		log.AppLogger.Noticef("Destroyed %d expired snapshots and kept %d.", destroyed, kept)
+	}
+	return nil
+}
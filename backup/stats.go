@@ -0,0 +1,153 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	humanize "github.com/dustin/go-humanize"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+const week = 7 * 24 * time.Hour
+
+// DatasetStats aggregates the backup sets of a volume found in a target.
+type DatasetStats struct {
+	VolumeName      string
+	BackupSets      int
+	FullBackups     int
+	StoredBytes     uint64    // The bytes stored in the target, after compression and encryption
+	LogicalBytes    uint64    // The bytes of the zfs send streams backed up
+	FirstSnapshot   time.Time // The creation time of the oldest snapshot backed up
+	LastSnapshot    time.Time // The creation time of the newest snapshot backed up
+	GrowthPerWeek   uint64    // The bytes stored per week after the oldest backup set
+	AverageDuration time.Duration
+	CurrentChain    int // The backup sets to restore to arrive at the newest backup set
+	LongestChain    int
+}
+
+// Stats will aggregate the manifests found in the target into totals per volume, for capacity planning.
+// Only the volumes matching volumeName, using the same rules as the list command, are included.
+func Stats(pctx context.Context, jobInfo *files.JobInfo, target, volumeName string) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	filtered := manifests[:0]
+	for _, manifest := range manifests {
+		if manifestMatchesFilter(manifest, volumeName, time.Time{}, time.Time{}) {
+			filtered = append(filtered, manifest)
+		}
+	}
+	stats := aggregateStats(filtered)
+
+	if config.JSONOutput {
+		j, jerr := json.Marshal(stats)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	var output strings.Builder
+	fmt.Fprintf(&output, "Found %d backup sets for %d volumes:\n\n", len(filtered), len(stats))
+	w := tabwriter.NewWriter(&output, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME\tSETS\tFULL\tSTORED\tLOGICAL\tGROWTH/WEEK\tAVG DURATION\tCHAIN (CURRENT/LONGEST)\tLAST SNAPSHOT")
+	for _, stat := range stats {
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%v\t%d/%d\t%s\n",
+			stat.VolumeName, stat.BackupSets, stat.FullBackups, humanize.IBytes(stat.StoredBytes),
+			humanize.IBytes(stat.LogicalBytes), humanize.IBytes(stat.GrowthPerWeek), stat.AverageDuration.Round(time.Second),
+			stat.CurrentChain, stat.LongestChain, stat.LastSnapshot.Format(time.RFC3339),
+		)
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprint(config.Stdout, output.String())
+
+	return nil
+}
+
+// aggregateStats groups the manifests by volume and returns their totals, sorted by volume name.
+func aggregateStats(manifests []*files.JobInfo) []*DatasetStats {
+	manifestTree := linkManifests(manifests)
+	stats := make([]*DatasetStats, 0, len(manifestTree))
+	for volume, snapList := range manifestTree {
+		sort.SliceStable(snapList, func(i, j int) bool {
+			return snapList[i].BaseSnapshot.CreationTime.Before(snapList[j].BaseSnapshot.CreationTime)
+		})
+
+		stat := &DatasetStats{VolumeName: volume, BackupSets: len(snapList)}
+		var (
+			elapsed time.Duration
+			timed   int
+		)
+		for _, manifest := range snapList {
+			if manifest.IncrementalSnapshot.Name == "" {
+				stat.FullBackups++
+			}
+			stat.StoredBytes += manifest.TotalBytesWritten()
+			stat.LogicalBytes += manifest.ZFSStreamBytes
+			if !manifest.StartTime.IsZero() && manifest.EndTime.After(manifest.StartTime) {
+				elapsed += manifest.EndTime.Sub(manifest.StartTime)
+				timed++
+			}
+
+			length, _ := backupChain(manifest)
+			stat.CurrentChain = length + 1
+			if stat.CurrentChain > stat.LongestChain {
+				stat.LongestChain = stat.CurrentChain
+			}
+		}
+		if timed > 0 {
+			stat.AverageDuration = elapsed / time.Duration(timed)
+		}
+
+		first, last := snapList[0], snapList[len(snapList)-1]
+		stat.FirstSnapshot, stat.LastSnapshot = first.BaseSnapshot.CreationTime, last.BaseSnapshot.CreationTime
+		if span := stat.LastSnapshot.Sub(stat.FirstSnapshot); span > 0 {
+			grown := stat.StoredBytes - first.TotalBytesWritten()
+			stat.GrowthPerWeek = uint64(float64(grown) / (float64(span) / float64(week)))
+		}
+
+		stats = append(stats, stat)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].VolumeName < stats[j].VolumeName
+	})
+	return stats
+}
@@ -0,0 +1,176 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// The next backup a smart run would perform, as reported by Status.
+const (
+	NextBackupFull        = "full"
+	NextBackupIncremental = "incremental"
+	NextBackupNone        = "none"
+	NextBackupError       = "error"
+)
+
+// BackupStatus compares the local snapshots of a dataset with the backups found in a target.
+type BackupStatus struct {
+	VolumeName       string
+	Target           string
+	LastBackup       *files.SnapshotInfo `json:",omitempty"`
+	LastBackupTime   time.Time           `json:",omitempty"`
+	LastBackupLocal  string              `json:",omitempty"`
+	ChainLength      int
+	PendingSnapshots []string
+	NextBackup       string
+	NextBackupFrom   string `json:",omitempty"`
+	NextBackupReason string `json:",omitempty"`
+}
+
+// Status will compare the local snapshots and bookmarks of the dataset with the backups found in the target and
+// report when the last backup completed, the snapshots not yet backed up, the length of the incremental chain and
+// whether the next smart backup would be a full or an incremental backup.
+func Status(ctx context.Context, jobInfo *files.JobInfo, dataset, target string) error {
+	jobInfo.VolumeName = dataset
+	snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, zfs.GetLocalVolumeName(jobInfo))
+	if err != nil {
+		log.AppLogger.Errorf("Could not list the snapshots of %s - %v", zfs.GetLocalVolumeName(jobInfo), err)
+		return err
+	}
+
+	backups, err := getBackupsForTarget(ctx, dataset, target, jobInfo)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the backups of %s in target %s - %v", dataset, target, err)
+		return err
+	}
+
+	status := backupStatus(snapshots, backups, newSnapshotFilter(jobInfo.SnapshotPrefix, jobInfo.SnapshotRegexp))
+	status.VolumeName = dataset
+	status.Target = target
+
+	// Run the smart option selection on a copy of the job to find out what the next backup would do
+	next := cloneJobInfo(jobInfo)
+	next.Destinations = []string{target}
+	if !next.Incremental && !next.Differential && next.FullIfOlderThan == -1*time.Minute {
+		next.Incremental = true
+	}
+	switch perr := ProcessSmartOptions(ctx, next); {
+	case errors.Is(perr, ErrNoOp):
+		status.NextBackup = NextBackupNone
+	case perr != nil:
+		status.NextBackup = NextBackupError
+		status.NextBackupReason = perr.Error()
+	case next.IncrementalSnapshot.Name != "":
+		status.NextBackup = NextBackupIncremental
+		status.NextBackupFrom = next.IncrementalSnapshot.Name
+	default:
+		status.NextBackup = NextBackupFull
+	}
+
+	return printStatus(status)
+}
+
+// backupStatus compares the local snapshots, newest first, with the backups found in the target, newest first.
+func backupStatus(snapshots []files.SnapshotInfo, backups []*files.JobInfo, filter *snapshotFilter) *BackupStatus {
+	status := &BackupStatus{PendingSnapshots: []string{}}
+
+	var last *files.JobInfo
+	if len(backups) > 0 {
+		last = backups[0]
+		status.LastBackup = &last.BaseSnapshot
+		status.LastBackupTime = last.EndTime
+		status.LastBackupLocal = "missing"
+		length, _ := backupChain(last)
+		status.ChainLength = length + 1
+	}
+
+	for i := range snapshots {
+		snapshot := &snapshots[i]
+		if last != nil && snapshot.Name == last.BaseSnapshot.Name {
+			if !snapshot.Bookmark {
+				status.LastBackupLocal = "snapshot"
+			} else if status.LastBackupLocal != "snapshot" {
+				status.LastBackupLocal = "bookmark"
+			}
+		}
+		if snapshot.Bookmark || !includeSnapshot(snapshot, filter) {
+			continue
+		}
+		if last == nil || snapshot.CreationTime.After(last.BaseSnapshot.CreationTime) {
+			status.PendingSnapshots = append(status.PendingSnapshots, snapshot.Name)
+		}
+	}
+
+	return status
+}
+
+func printStatus(status *BackupStatus) error {
+	if config.JSONOutput {
+		j, err := json.Marshal(status)
+		if err != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", err)
+			return err
+		}
+		fmt.Fprintln(config.Stdout, string(j))
+		return nil
+	}
+
+	output := []string{fmt.Sprintf("Volume: %s", status.VolumeName), fmt.Sprintf("Target: %s", status.Target)}
+	if status.LastBackup != nil {
+		output = append(
+			output,
+			fmt.Sprintf("Last Backup: %s (completed %v)", status.LastBackup.Name, status.LastBackupTime),
+			fmt.Sprintf("Last Backup Snapshot Found Locally As: %s", status.LastBackupLocal),
+			fmt.Sprintf("Chain Length: %d", status.ChainLength),
+		)
+	} else {
+		output = append(output, "Last Backup: none")
+	}
+	if len(status.PendingSnapshots) > 0 {
+		output = append(output, fmt.Sprintf("Snapshots Not Backed Up: %s", strings.Join(status.PendingSnapshots, ", ")))
+	} else {
+		output = append(output, "Snapshots Not Backed Up: none")
+	}
+	switch status.NextBackup {
+	case NextBackupIncremental:
+		output = append(output, fmt.Sprintf("Next Backup: incremental from %s", status.NextBackupFrom))
+	case NextBackupError:
+		output = append(output, fmt.Sprintf("Next Backup: cannot be taken - %s", status.NextBackupReason))
+	case NextBackupNone:
+		output = append(output, "Next Backup: none, the target is up to date")
+	default:
+		output = append(output, fmt.Sprintf("Next Backup: %s", status.NextBackup))
+	}
+	fmt.Fprintln(config.Stdout, strings.Join(output, "\n\t"))
+
+	return nil
+}
@@ -38,16 +38,24 @@ import (
 
 func prepareBackend(ctx context.Context, j *files.JobInfo, backendURI string, uploadBuffer chan bool) (backends.Backend, error) {
 	log.AppLogger.Debugf("Initializing Backend %s", backendURI)
+	targetURI, opts, err := backends.ParseTargetURI(backendURI)
+	if err != nil {
+		return nil, err
+	}
+
 	conf := &backends.BackendConfig{
 		MaxParallelUploadBuffer: uploadBuffer,
-		TargetURI:               backendURI,
+		TargetURI:               targetURI,
 		MaxParallelUploads:      j.MaxParallelUploads,
 		MaxBackoffTime:          j.MaxBackoffTime,
 		MaxRetryTime:            j.MaxRetryTime,
 		UploadChunkSize:         j.UploadChunkSize * 1024 * 1024,
 	}
+	if opts.MaxParallelUploads > 0 {
+		conf.MaxParallelUploads = opts.MaxParallelUploads
+	}
 
-	backend, err := backends.GetBackendForURI(backendURI)
+	backend, err := backends.GetBackendForURI(targetURI)
 	if err != nil {
 		return nil, err
 	}
@@ -57,10 +65,30 @@ func prepareBackend(ctx context.Context, j *files.JobInfo, backendURI string, up
 	return backend, err
 }
 
-func getCacheDir(backendURI string) (string, error) {
+// targetOptions returns the per-target options provided on the URI, ignoring any parse errors
+// as those are reported when the backend is prepared.
+func targetOptions(backendURI string) *backends.TargetOptions {
+	_, opts, err := backends.ParseTargetURI(backendURI)
+	if err != nil {
+		return &backends.TargetOptions{}
+	}
+	return opts
+}
+
+// cacheDirPath returns the local cache directory path for the manifests of the job's namespace on the target, ignoring
+// any per-target options on the URI. Each namespace sharing a target gets its own directory, and so its own bucket in
+// the manifest database.
+func cacheDirPath(j *files.JobInfo, backendURI string) string {
+	if targetURI, _, err := backends.ParseTargetURI(backendURI); err == nil {
+		backendURI = targetURI
+	}
 	// nolint:gosec // MD5 not used for cryptographic purposes here
-	safeFolder := fmt.Sprintf("%x", md5.Sum([]byte(backendURI)))
-	dest := filepath.Join(config.WorkingDir, "cache", safeFolder)
+	safeFolder := fmt.Sprintf("%x", md5.Sum([]byte(backendURI+"\x00"+j.ManifestListPrefix())))
+	return filepath.Join(config.WorkingDir, "cache", safeFolder)
+}
+
+func getCacheDir(j *files.JobInfo, backendURI string) (string, error) {
+	dest := cacheDirPath(j, backendURI)
 	oerr := os.MkdirAll(dest, os.ModePerm)
 	if oerr != nil {
 		return "", fmt.Errorf("could not create cache directory %s due to an error: %v", dest, oerr)
@@ -73,11 +101,28 @@ func getCacheDir(backendURI string) (string, error) {
 // nolint:gocritic // Don't need to name the results
 func syncCache(ctx context.Context, j *files.JobInfo, localCache string, backend backends.Backend) ([]string, []string, error) {
 	// List all manifests at the destination
-	manifests, merr := backend.List(ctx, j.ManifestPrefix)
+	objects, merr := backend.List(ctx, j.ManifestListPrefix())
 	if merr != nil {
 		return nil, nil, fmt.Errorf("could not list manifest files from the backed due to error - %v", merr)
 	}
 
+	// Detached signatures are stored next to the manifests
+	manifests := make([]string, 0, len(objects))
+	signed := make(map[string]bool)
+	for _, object := range objects {
+		if strings.HasSuffix(object, files.SignatureSuffix) {
+			signed[strings.TrimSuffix(object, files.SignatureSuffix)] = true
+		} else {
+			manifests = append(manifests, object)
+		}
+	}
+	if len(manifests) == 0 && j.ObjectNamespace() != "" {
+		warnUnprefixedManifests(ctx, j, backend)
+	}
+	if err := syncSignatures(ctx, localCache, manifests, signed, backend); err != nil {
+		return nil, nil, err
+	}
+
 	// Make it safe for local file system storage
 	safeManifests := make([]string, len(manifests))
 	for idx := range manifests {
@@ -135,6 +180,49 @@ func syncCache(ctx context.Context, j *files.JobInfo, localCache string, backend
 	return safeManifests, localOnlyFiles, nil
 }
 
+// warnUnprefixedManifests will point to the manifests found in the target without any prefix, e.g. made before
+// object names were prefixed with the hostname by default, as they are not found under the job's prefix.
+func warnUnprefixedManifests(ctx context.Context, j *files.JobInfo, backend backends.Backend) {
+	objects, err := backend.List(ctx, j.ManifestPrefix+j.Separator)
+	if err != nil {
+		return
+	}
+	unprefixed := 0
+	for _, object := range objects {
+		if !strings.HasSuffix(object, files.SignatureSuffix) {
+			unprefixed++
+		}
+	}
+	if unprefixed > 0 {
+		log.AppLogger.Warningf(
+			"No manifests were found under the prefix %s, but %d manifests were found without any prefix. "+
+				"Use --prefix \"\" to access the backups made without a prefix, e.g. by a version that did not prefix object names.",
+			j.ObjectNamespace(), unprefixed,
+		)
+	}
+}
+
+// syncSignatures will download the detached signatures of the manifests that are missing from the local cache.
+func syncSignatures(ctx context.Context, localCache string, manifests []string, signed map[string]bool, backend backends.Backend) error {
+	for _, manifest := range manifests {
+		if !signed[manifest] {
+			continue
+		}
+		// nolint:gosec // MD5 not used for cryptographic purposes here
+		sigPath := signaturePath(filepath.Join(localCache, fmt.Sprintf("%x", md5.Sum([]byte(manifest)))))
+		if _, err := os.Stat(sigPath); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(sigPath), os.ModePerm); err != nil {
+			return err
+		}
+		if err := downloadTo(ctx, backend, manifest+files.SignatureSuffix, sigPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // nolint:unparam // Some errors are not ok to ignore
 func validateSnapShotExists(ctx context.Context, snapshot *files.SnapshotInfo, target string, includeBookmarks bool) (bool, error) {
 	snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, target)
@@ -0,0 +1,170 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// tarCloneSuffix is appended to the name of the volume restored to get the clone its files are read from.
+const tarCloneSuffix = "_zfsbackup_tar"
+
+// WriteTar will write the files of the snapshot restored by the jobInfo to a tar archive at the path provided, or to
+// stdout when the path is -. The snapshot is cloned, read only, to a temporary mountpoint to read its files, so it
+// does not matter whether the volume restored is mounted.
+func WriteTar(ctx context.Context, jobInfo *files.JobInfo, tarPath string) error {
+	volume := restoreVolumeName(jobInfo)
+	if datasetType, err := zfs.GetZFSProperty(ctx, "type", volume); err != nil {
+		log.AppLogger.Errorf("Could not find the restored volume %s - %v", volume, err)
+		return err
+	} else if datasetType != "filesystem" {
+		log.AppLogger.Errorf("%s is a %s, only the files of a filesystem can be written to a tar archive.", volume, datasetType)
+		return fmt.Errorf("cannot write a tar archive of %s", volume)
+	}
+
+	snapshot, err := restoredSnapshot(ctx, jobInfo, volume)
+	if err != nil {
+		return err
+	}
+
+	mountpoint, err := os.MkdirTemp("", "zfsbackup-tar-")
+	if err != nil {
+		log.AppLogger.Errorf("Could not create a temporary mountpoint - %v", err)
+		return err
+	}
+	defer os.Remove(mountpoint)
+
+	clone := volume + tarCloneSuffix
+	if err = zfs.CloneSnapshot(ctx, snapshot, clone, "mountpoint="+mountpoint, "readonly=on"); err != nil {
+		log.AppLogger.Errorf("Could not clone %s to read its files - %v", snapshot, err)
+		return err
+	}
+	defer func() {
+		if derr := zfs.DestroyDataset(context.Background(), clone); derr != nil {
+			log.AppLogger.Warningf("Could not destroy the clone %s - %v", clone, derr)
+		}
+	}()
+
+	log.AppLogger.Noticef("Writing the files of %s to %s.", snapshot, tarPath)
+	if tarPath == "-" {
+		return writeTarArchive(ctx, mountpoint, config.Stdout)
+	}
+
+	// Write to a temporary file so an incomplete archive is never left under the name requested
+	partial := tarPath + ".partial"
+	f, err := os.OpenFile(partial, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.AppLogger.Errorf("Could not create %s - %v", partial, err)
+		return err
+	}
+	if err = writeTarArchive(ctx, mountpoint, f); err != nil {
+		f.Close()
+		os.Remove(partial)
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, tarPath)
+}
+
+// restoredSnapshot returns the snapshot of the volume the restore was made to, the latest snapshot of the volume
+// when no snapshot was requested.
+func restoredSnapshot(ctx context.Context, jobInfo *files.JobInfo, volume string) (string, error) {
+	if jobInfo.BaseSnapshot.Name != "" {
+		return fmt.Sprintf("%s@%s", volume, jobInfo.BaseSnapshot.Name), nil
+	}
+
+	snapshots, err := zfs.GetSnapshotsAndBookmarks(ctx, volume)
+	if err != nil {
+		log.AppLogger.Errorf("Could not list the snapshots of %s - %v", volume, err)
+		return "", err
+	}
+	for _, snapshot := range snapshots {
+		if !snapshot.Bookmark {
+			return fmt.Sprintf("%s@%s", volume, snapshot.Name), nil
+		}
+	}
+	return "", fmt.Errorf("could not find a snapshot of %s", volume)
+}
+
+// writeTarArchive will write every file beneath the root to a tar archive written to w, named relative to the root.
+func writeTarArchive(ctx context.Context, root string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if cerr := ctx.Err(); cerr != nil {
+			return cerr
+		}
+		name, rerr := filepath.Rel(root, filePath)
+		if rerr != nil || name == "." {
+			return rerr
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(filePath); err != nil {
+				return err
+			}
+		}
+		header, herr := tar.FileInfoHeader(info, link)
+		if herr != nil {
+			log.AppLogger.Warningf("Skipping %s, it cannot be stored in a tar archive - %v", name, herr)
+			return nil
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err = tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, oerr := os.Open(filePath)
+		if oerr != nil {
+			return oerr
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		log.AppLogger.Errorf("Could not write the tar archive - %v", err)
+		return err
+	}
+	return tw.Close()
+}
@@ -0,0 +1,476 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/term"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var errNotATerminal = errors.New("the terminal UI needs a terminal")
+
+// The keys read from the terminal, other than printable characters which are returned as is.
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyLeft      = "left"
+	keyRight     = "right"
+	keyPageUp    = "pgup"
+	keyPageDown  = "pgdn"
+	keyHome      = "home"
+	keyEnd       = "end"
+	keyEnter     = "enter"
+	keyBackspace = "backspace"
+	keyEscape    = "esc"
+	keyInterrupt = "ctrl-c"
+)
+
+// The actions picked in the terminal UI, along with ActionVerify and ActionRestoreDryRun.
+const (
+	tuiQuit    = "quit"
+	tuiRestore = "restore"
+)
+
+// The screens of the terminal UI, each opened from the previous one.
+const (
+	tuiDatasets = iota
+	tuiBackupSets
+	tuiManifest
+)
+
+// tuiAction is an action picked in the terminal UI, on every backup set of a volume when Manifest is nil.
+type tuiAction struct {
+	Kind     string
+	Volume   string
+	Manifest *files.JobInfo
+}
+
+// tuiModel is the state of the terminal UI: the datasets found in the target, their backup sets newest first, and
+// what is selected on each screen.
+type tuiModel struct {
+	target  string
+	volumes []string
+	sets    map[string][]*files.JobInfo
+	message string
+	height  int
+
+	screen   int
+	volume   int
+	set      int
+	scroll   int
+	manifest []string
+}
+
+// TUI will run a terminal UI to browse the datasets and backup sets found in the target and inspect their manifests.
+// The backup sets of a dataset, or a single backup set, can be verified, reading back only a sample of their volumes
+// when verifySample is greater than 0, and a backup set restored, or a dry run of its restore made, from the UI. The
+// UI is left while an action runs so its output and any prompt show in the terminal as usual.
+func TUI(ctx context.Context, jobInfo *files.JobInfo, target string, verifySample int) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		log.AppLogger.Errorf("The terminal UI must be run with a terminal as its input and output.")
+		return errNotATerminal
+	}
+
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	model := newTUIModel(target, manifests)
+	input := bufio.NewReader(config.Stdin)
+	for {
+		action, berr := browse(fd, model, input)
+		if berr != nil {
+			return berr
+		}
+		if action.Kind == tuiQuit {
+			return nil
+		}
+		model.message = runTUIAction(ctx, jobInfo, target, verifySample, action, input)
+	}
+}
+
+// browse will show the model in the alternate screen of the terminal, in raw mode, until an action is picked.
+func browse(fd int, model *tuiModel, input *bufio.Reader) (tuiAction, error) {
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		log.AppLogger.Errorf("Could not set up the terminal - %v", err)
+		return tuiAction{}, err
+	}
+	fmt.Fprint(config.Stdout, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(config.Stdout, "\x1b[?25h\x1b[?1049l")
+		_ = term.Restore(fd, state)
+	}()
+
+	for {
+		width, height, serr := term.GetSize(int(os.Stdout.Fd()))
+		if serr != nil || width <= 0 || height <= 0 {
+			width, height = 80, 24
+		}
+		fmt.Fprint(config.Stdout, "\x1b[H\x1b[2J"+strings.Join(model.render(width, height), "\r\n"))
+
+		key, kerr := readKey(input)
+		if kerr != nil {
+			return tuiAction{}, kerr
+		}
+		if action := model.handleKey(key); action.Kind != "" {
+			return action, nil
+		}
+	}
+}
+
+// runTUIAction will run the action picked outside of the UI, returning a message describing how it went.
+func runTUIAction(
+	ctx context.Context,
+	jobInfo *files.JobInfo,
+	target string,
+	verifySample int,
+	action tuiAction,
+	input *bufio.Reader,
+) string {
+	// Interrupting the action returns to the UI rather than exiting
+	actx, stop := signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+
+	name := action.Volume
+	if action.Manifest != nil {
+		name = backupSetName(action.Manifest)
+	}
+	job := cloneJobInfo(jobInfo)
+	job.Destinations = []string{target}
+
+	var err error
+	switch action.Kind {
+	case ActionVerify:
+		if action.Manifest != nil {
+			err = verifyBackupSet(actx, job, action.Manifest, target, verifySample)
+		} else {
+			err = VerifyBackupSets(actx, job, action.Volume, target, verifySample)
+		}
+	case ActionRestoreDryRun, tuiRestore:
+		job.VolumeName = action.Volume
+		job.BaseSnapshot = files.SnapshotInfo{Name: action.Manifest.BaseSnapshot.Name}
+		job.AutoRestore = true
+		job.LocalVolume = prompt(input, fmt.Sprintf("Local volume to restore %s into [%s]: ", name, action.Volume), action.Volume)
+		if action.Kind == ActionRestoreDryRun {
+			err = RestoreDryRun(actx, job)
+			break
+		}
+		job.Force = confirm(input, "Roll the local volume back if needed, as with zfs receive -F?")
+		if !confirm(input, fmt.Sprintf("Restore %s into %s?", name, job.LocalVolume)) {
+			return fmt.Sprintf("The restore of %s was cancelled.", name)
+		}
+		// The rollback was confirmed above, do not prompt again with another reader of the terminal
+		job.AssumeYes = job.Force
+		err = AutoRestore(actx, job)
+	}
+
+	prompt(input, "Press enter to return to the browser.", "")
+	if err != nil {
+		return fmt.Sprintf("The %s of %s failed - %v", action.Kind, name, err)
+	}
+	return fmt.Sprintf("The %s of %s succeeded.", action.Kind, name)
+}
+
+// prompt will ask the question on stderr and return the line answered, lower cased for yes or no questions, or the
+// default provided when nothing was answered.
+func prompt(input *bufio.Reader, question, defaultAnswer string) string {
+	fmt.Fprint(os.Stderr, question)
+	answer, _ := input.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+	if answer == "" {
+		return defaultAnswer
+	}
+	if strings.HasSuffix(question, "[y/N] ") {
+		answer = strings.ToLower(answer)
+		if answer == "yes" {
+			answer = "y"
+		}
+	}
+	return answer
+}
+
+// confirm will ask the yes or no question on stderr, returning true only when it was answered with y or yes.
+func confirm(input *bufio.Reader, question string) bool {
+	return prompt(input, question+" [y/N] ", "n") == "y"
+}
+
+// Confirm will ask the yes or no question on stderr and read the answer from stdin, returning true only when it was
+// answered with y or yes.
+func Confirm(question string) bool {
+	return confirm(bufio.NewReader(config.Stdin), question)
+}
+
+// readKey will read a key press from a terminal in raw mode, returning an empty string for keys that are not handled.
+func readKey(r *bufio.Reader) (string, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch b {
+	case 3:
+		return keyInterrupt, nil
+	case '\r', '\n':
+		return keyEnter, nil
+	case 8, 127:
+		return keyBackspace, nil
+	case 27:
+		// The rest of an escape sequence is read along with the escape
+		if r.Buffered() == 0 {
+			return keyEscape, nil
+		}
+		if next, _ := r.ReadByte(); next != '[' && next != 'O' {
+			return keyEscape, nil
+		}
+		var seq []byte
+		for r.Buffered() > 0 {
+			c, _ := r.ReadByte()
+			seq = append(seq, c)
+			if c >= 0x40 && c <= 0x7e {
+				break
+			}
+		}
+		switch string(seq) {
+		case "A":
+			return keyUp, nil
+		case "B":
+			return keyDown, nil
+		case "C":
+			return keyRight, nil
+		case "D":
+			return keyLeft, nil
+		case "5~":
+			return keyPageUp, nil
+		case "6~":
+			return keyPageDown, nil
+		case "H", "1~":
+			return keyHome, nil
+		case "F", "4~":
+			return keyEnd, nil
+		}
+		return "", nil
+	}
+	_ = r.UnreadByte()
+	key, _, err := r.ReadRune()
+	return string(key), err
+}
+
+// newTUIModel returns the model of the terminal UI for the manifests read from the target.
+func newTUIModel(target string, manifests []*files.JobInfo) *tuiModel {
+	sets := linkManifests(manifests)
+	volumes := make([]string, 0, len(sets))
+	for volume, list := range sets {
+		volumes = append(volumes, volume)
+		sort.SliceStable(list, func(i, j int) bool {
+			return list[i].BaseSnapshot.CreationTime.After(list[j].BaseSnapshot.CreationTime)
+		})
+	}
+	sort.Strings(volumes)
+	return &tuiModel{target: target, volumes: volumes, sets: sets}
+}
+
+// handleKey will update the model for the key pressed, returning the action it picked, if any.
+func (m *tuiModel) handleKey(key string) tuiAction {
+	m.message = ""
+	switch key {
+	case "q", keyInterrupt:
+		return tuiAction{Kind: tuiQuit}
+	case keyUp, "k":
+		m.move(-1)
+	case keyDown, "j":
+		m.move(1)
+	case keyPageUp:
+		m.move(-m.pageSize())
+	case keyPageDown:
+		m.move(m.pageSize())
+	case keyHome, "g":
+		m.move(-m.length())
+	case keyEnd, "G":
+		m.move(m.length())
+	case keyEnter, keyRight, "l":
+		m.open()
+	case keyEscape, keyBackspace, keyLeft, "h":
+		if m.screen > tuiDatasets {
+			m.screen--
+		}
+	case "v":
+		return m.action(ActionVerify)
+	case "d":
+		return m.action(ActionRestoreDryRun)
+	case "r":
+		return m.action(tuiRestore)
+	}
+	return tuiAction{}
+}
+
+// pageSize is the number of rows shown, between the two lines of header and of footer.
+func (m *tuiModel) pageSize() int {
+	if m.height < 5 {
+		return 1
+	}
+	return m.height - 4
+}
+
+// length is the number of rows of the current screen.
+func (m *tuiModel) length() int {
+	switch m.screen {
+	case tuiBackupSets:
+		return len(m.sets[m.volumes[m.volume]])
+	case tuiManifest:
+		return len(m.manifest)
+	}
+	return len(m.volumes)
+}
+
+// move will move the selection, or scroll the manifest, by delta rows within the current screen.
+func (m *tuiModel) move(delta int) {
+	selected, last := &m.volume, m.length()-1
+	switch m.screen {
+	case tuiBackupSets:
+		selected = &m.set
+	case tuiManifest:
+		selected, last = &m.scroll, m.length()-m.pageSize()
+	}
+	*selected += delta
+	if *selected > last {
+		*selected = last
+	}
+	if *selected < 0 {
+		*selected = 0
+	}
+}
+
+// open will open the screen of the dataset or backup set selected.
+func (m *tuiModel) open() {
+	switch m.screen {
+	case tuiDatasets:
+		if len(m.volumes) > 0 {
+			m.screen, m.set = tuiBackupSets, 0
+		}
+	case tuiBackupSets:
+		data, err := json.MarshalIndent(m.sets[m.volumes[m.volume]][m.set], "", "  ")
+		if err != nil {
+			m.message = fmt.Sprintf("Could not show the manifest - %v", err)
+			return
+		}
+		m.screen, m.scroll, m.manifest = tuiManifest, 0, strings.Split(string(data), "\n")
+	}
+}
+
+// action returns the action on the backup set selected, or on the dataset selected, picking its latest backup set to
+// restore.
+func (m *tuiModel) action(kind string) tuiAction {
+	if len(m.volumes) == 0 {
+		return tuiAction{}
+	}
+	volume := m.volumes[m.volume]
+	if m.screen == tuiDatasets {
+		if kind == ActionVerify {
+			return tuiAction{Kind: kind, Volume: volume}
+		}
+		return tuiAction{Kind: kind, Volume: volume, Manifest: m.sets[volume][0]}
+	}
+	return tuiAction{Kind: kind, Volume: volume, Manifest: m.sets[volume][m.set]}
+}
+
+// render returns the lines of the current screen, fitting the width and height of the terminal.
+func (m *tuiModel) render(width, height int) []string {
+	m.height = height
+	title := "zfsbackup - " + m.target
+	var (
+		rows  []string
+		first int
+		help  string
+	)
+	selected := -1
+	switch m.screen {
+	case tuiDatasets:
+		for _, volume := range m.volumes {
+			latest := m.sets[volume][0]
+			rows = append(rows, fmt.Sprintf("%-40s %4d backup sets, latest %s %s",
+				volume, len(m.sets[volume]), latest.BaseSnapshot.Name, humanize.Time(latest.BaseSnapshot.CreationTime)))
+		}
+		if len(rows) == 0 {
+			rows = append(rows, "No backup sets found in the target.")
+		} else {
+			selected = m.volume
+		}
+		help = "up/down move  enter open  v verify  d dry run  r restore latest  q quit"
+	case tuiBackupSets:
+		title += " - " + m.volumes[m.volume]
+		for _, set := range m.sets[m.volumes[m.volume]] {
+			kind := "full"
+			if set.IncrementalSnapshot.Name != "" {
+				kind = "incremental from " + set.IncrementalSnapshot.Name
+			}
+			rows = append(rows, fmt.Sprintf("%-30s %-35s %s %4d volumes %10s", set.BaseSnapshot.Name, kind,
+				set.BaseSnapshot.CreationTime.Format("2006-01-02 15:04:05"), len(set.Volumes), humanize.IBytes(set.TotalBytesWritten())))
+		}
+		selected = m.set
+		help = "up/down move  enter manifest  esc back  v verify  d dry run  r restore  q quit"
+	case tuiManifest:
+		title += " - " + backupSetName(m.sets[m.volumes[m.volume]][m.set])
+		rows, first = m.manifest, m.scroll
+		help = "up/down scroll  esc back  v verify  d dry run  r restore  q quit"
+	}
+
+	page := m.pageSize()
+	if selected >= page {
+		first = selected - page + 1
+	}
+	lines := []string{"\x1b[1m" + truncate(title, width) + "\x1b[0m", ""}
+	for i := first; i < first+page; i++ {
+		switch {
+		case i >= len(rows):
+			lines = append(lines, "")
+		case i == selected:
+			line := truncate(rows[i], width)
+			lines = append(lines, "\x1b[7m"+line+strings.Repeat(" ", width-len([]rune(line)))+"\x1b[0m")
+		default:
+			lines = append(lines, truncate(rows[i], width))
+		}
+	}
+	return append(lines, truncate(m.message, width), "\x1b[2m"+truncate(help, width)+"\x1b[0m")
+}
+
+// truncate returns the line cut to the width provided.
+func truncate(line string, width int) string {
+	if runes := []rune(line); len(runes) > width {
+		return string(runes[:width])
+	}
+	return line
+}
@@ -0,0 +1,471 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// Results reported for a VerifyResult.
+const (
+	VerifyPassed = "passed"
+	VerifyFailed = "failed"
+	// Backup sets that are neither encrypted nor signed have nothing to check with cryptoOnly
+	VerifySkipped = "skipped"
+)
+
+// cryptoSampleSize is how much of each volume is downloaded to check its encryption, enough for the age header and
+// its first 64KiB chunk, or the OpenPGP session key and signature packets, to be decrypted and authenticated.
+const cryptoSampleSize = 128 * humanize.KiByte
+
+var errVerifyFailed = errors.New("some backup sets failed verification")
+
+// VerifyResult describes the outcome of verifying a backup set.
+type VerifyResult struct {
+	VolumeName string
+	Snapshot   string
+	Manifest   string
+	Volumes    int
+	Sampled    int `json:",omitempty"` // How many of the volumes were checked, when only a sample of them was
+	Result     string
+	Errors     []string `json:",omitempty"`
+}
+
+// VerifyCrypto will download only the start of every volume of the backup sets in the target for volumes matching
+// volumeGlob, and check it decrypts and was signed by the expected key, so the keys provided are proven to still
+// work without restoring anything. An error is returned if any backup set failed verification.
+func VerifyCrypto(pctx context.Context, jobInfo *files.JobInfo, volumeGlob, target string) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	// Reading the manifests already checks they decrypt and verify
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	results := make([]VerifyResult, 0, len(manifests))
+	for _, manifest := range manifests {
+		if matched, _ := path.Match(volumeGlob, manifest.VolumeName); !matched {
+			continue
+		}
+		result, verr := verifyBackupSetKeys(ctx, manifest, target, backend, 0, verifyVolumeCrypto)
+		if verr != nil {
+			return verr
+		}
+		results = append(results, result)
+	}
+
+	return reportVerifyResults(config.Stdout, results, target)
+}
+
+// VerifyDigests will download every volume of the backup sets in the target for volumes matching volumeGlob, and
+// check its size and digest match the ones recorded in the manifest when it was uploaded, catching volumes
+// corrupted at rest or in transit without decrypting or restoring anything. When sample is greater than 0, only
+// that many volumes picked at random are checked per backup set. An error is returned if any backup set failed
+// verification.
+func VerifyDigests(pctx context.Context, jobInfo *files.JobInfo, volumeGlob, target string, sample int) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	results := make([]VerifyResult, 0, len(manifests))
+	for _, manifest := range manifests {
+		if matched, _ := path.Match(volumeGlob, manifest.VolumeName); !matched {
+			continue
+		}
+		result, verr := verifyBackupSetVolumes(ctx, newVerifyResult(manifest), manifest, backend, sample, verifyVolumeDigest)
+		if verr != nil {
+			return verr
+		}
+		results = append(results, result)
+	}
+
+	return reportVerifyResults(config.Stdout, results, target)
+}
+
+// VerifyBackupSets will download every volume of the backup sets in the target for volumes matching volumeGlob,
+// check its size and digest match the manifest's, then read it back through decryption, signature verification and
+// decompression, checking the zfs stream it holds against the one backed up, without restoring anything. When sample
+// is greater than 0, only that many volumes picked at random are checked per backup set. An error is returned if any
+// backup set failed verification.
+func VerifyBackupSets(pctx context.Context, jobInfo *files.JobInfo, volumeGlob, target string, sample int) error {
+	return verifyBackupSets(pctx, config.Stdout, jobInfo, volumeGlob, target, sample)
+}
+
+// verifyBackupSets will verify the backup sets as VerifyBackupSets does, writing the results to out.
+func verifyBackupSets(pctx context.Context, out io.Writer, jobInfo *files.JobInfo, volumeGlob, target string, sample int) error {
+	ctx, cancel := context.WithCancel(pctx)
+	defer cancel()
+
+	manifests, err := readTargetManifests(ctx, jobInfo, target)
+	if err != nil {
+		return err
+	}
+
+	backend, berr := prepareBackend(ctx, jobInfo, target, nil)
+	if berr != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, berr)
+		return berr
+	}
+	defer backend.Close()
+
+	results := make([]VerifyResult, 0, len(manifests))
+	for _, manifest := range manifests {
+		if matched, _ := path.Match(volumeGlob, manifest.VolumeName); !matched {
+			continue
+		}
+		result, verr := verifyBackupSetKeys(ctx, manifest, target, backend, sample, verifyVolumeFull)
+		if verr != nil {
+			return verr
+		}
+		results = append(results, result)
+	}
+
+	return reportVerifyResults(out, results, target)
+}
+
+// verifyBackupSet will check the volumes of a single backup set of the target, as VerifyBackupSets does, reporting the
+// result. An error is returned if the backup set failed verification.
+func verifyBackupSet(ctx context.Context, jobInfo, manifest *files.JobInfo, target string, sample int) error {
+	backend, err := prepareBackend(ctx, jobInfo, target, nil)
+	if err != nil {
+		log.AppLogger.Errorf("Could not initialize backend for target %s due to error - %v.", target, err)
+		return err
+	}
+	defer backend.Close()
+
+	result, err := verifyBackupSetKeys(ctx, manifest, target, backend, sample, verifyVolumeFull)
+	if err != nil {
+		return err
+	}
+	return reportVerifyResults(config.Stdout, []VerifyResult{result}, target)
+}
+
+// newVerifyResult returns a passing result for the backup set of the manifest.
+func newVerifyResult(manifest *files.JobInfo) VerifyResult {
+	return VerifyResult{
+		VolumeName: manifest.VolumeName,
+		Snapshot:   manifest.BaseSnapshot.Name,
+		Manifest:   manifest.ManifestObjectName(),
+		Volumes:    len(manifest.Volumes),
+		Result:     VerifyPassed,
+	}
+}
+
+// verifyBackupSetKeys will unwrap the data key of the backup set, if any, then check its volumes with verifyVolume.
+// Only errors that prevent the verification from completing, such as the context being canceled, are returned.
+func verifyBackupSetKeys(
+	ctx context.Context,
+	manifest *files.JobInfo,
+	target string,
+	backend backends.Backend,
+	sample int,
+	verifyVolume func(context.Context, *files.JobInfo, backends.Backend, *files.VolumeInfo) error,
+) (VerifyResult, error) {
+	result := newVerifyResult(manifest)
+
+	if len(manifest.WrappedKeys) > 0 {
+		identity, err := unwrapDataKey(ctx, manifest.WrappedKeys, target)
+		if err != nil {
+			result.Result = VerifyFailed
+			result.Errors = append(result.Errors, err.Error())
+			return result, nil
+		}
+		manifest.AgeIdentities = []age.Identity{identity}
+	}
+
+	return verifyBackupSetVolumes(ctx, result, manifest, backend, sample, verifyVolume)
+}
+
+// verifyBackupSetVolumes will check every volume of the backup set, or a sample of them when sample is greater than 0,
+// with verifyVolume, a few at a time, and record any failure in the result. Only errors that prevent the verification
+// from completing are returned.
+func verifyBackupSetVolumes(
+	ctx context.Context,
+	result VerifyResult,
+	manifest *files.JobInfo,
+	backend backends.Backend,
+	sample int,
+	verifyVolume func(context.Context, *files.JobInfo, backends.Backend, *files.VolumeInfo) error,
+) (VerifyResult, error) {
+	volumes := sampleVolumes(manifest.Volumes, sample)
+	if len(volumes) < len(manifest.Volumes) {
+		result.Sampled = len(volumes)
+	}
+
+	var (
+		failures []string
+		mutex    sync.Mutex
+	)
+	group, gctx := errgroup.WithContext(ctx)
+	// Let's not slam the endpoint with a lot of concurrent requests, pick a sensible default and stick to it
+	downloadBuffer := make(chan bool, 5)
+	for _, vol := range volumes {
+		vol := vol
+		select {
+		case <-gctx.Done():
+			return result, group.Wait()
+		case downloadBuffer <- true:
+		}
+		group.Go(func() error {
+			defer func() { <-downloadBuffer }()
+			err := verifyVolume(gctx, manifest, backend, vol)
+			switch {
+			case err == nil:
+			case errors.Is(err, files.ErrNotEncrypted):
+				mutex.Lock()
+				result.Result = VerifySkipped
+				mutex.Unlock()
+			case gctx.Err() != nil:
+				return gctx.Err()
+			default:
+				log.AppLogger.Debugf("Could not verify %s - %v", vol.ObjectName, err)
+				mutex.Lock()
+				failures = append(failures, fmt.Sprintf("%s: %v", vol.ObjectName, err))
+				mutex.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return result, err
+	}
+
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		result.Result = VerifyFailed
+		result.Errors = failures
+	}
+	return result, nil
+}
+
+// verifyVolumeCrypto will download the first cryptoSampleSize bytes of the volume and check they decrypt and verify.
+func verifyVolumeCrypto(ctx context.Context, manifest *files.JobInfo, backend backends.Backend, vol *files.VolumeInfo) error {
+	r, err := backend.Download(ctx, vol.ObjectName)
+	if err != nil {
+		return err
+	}
+	r = limitDownload(r)
+	defer r.Close()
+
+	return files.CheckEncryptionHeader(ctx, manifest, io.LimitReader(r, cryptoSampleSize))
+}
+
+// verifyVolumeDigest will download the whole volume and check its size and digest match the manifest's.
+func verifyVolumeDigest(ctx context.Context, _ *files.JobInfo, backend backends.Backend, vol *files.VolumeInfo) error {
+	size, sum, err := volumeDigest(ctx, backend, vol)
+	if err != nil {
+		return err
+	}
+	if vol.Size != 0 && uint64(size) != vol.Size {
+		return fmt.Errorf("size mismatch, expected %d bytes but got %d", vol.Size, size)
+	}
+	if sum != vol.Checksum() {
+		return fmt.Errorf("%s hash mismatch, expected %s but got %s", vol.ChecksumAlgorithm(), vol.Checksum(), sum)
+	}
+	return nil
+}
+
+// volumeDigest will download the whole volume and return its size and its digest, computed with the algorithm
+// recorded in the manifest.
+func volumeDigest(ctx context.Context, backend backends.Backend, vol *files.VolumeInfo) (int64, string, error) {
+	r, err := backend.Download(ctx, vol.ObjectName)
+	if err != nil {
+		return 0, "", err
+	}
+	r = limitDownload(r)
+	defer r.Close()
+
+	hasher, err := files.NewDigest(vol.DigestAlgorithm)
+	if err != nil {
+		return 0, "", err
+	}
+	size, err := io.Copy(hasher, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+// sampleVolumes returns up to sample volumes picked at random, in their original order, or every volume when sample is
+// not greater than 0.
+func sampleVolumes(volumes []*files.VolumeInfo, sample int) []*files.VolumeInfo {
+	if sample <= 0 || sample >= len(volumes) {
+		return volumes
+	}
+
+	// nolint:gosec // The sample does not need to be unpredictable
+	picked := rand.Perm(len(volumes))[:sample]
+	sort.Ints(picked)
+	sampled := make([]*files.VolumeInfo, 0, sample)
+	for _, idx := range picked {
+		sampled = append(sampled, volumes[idx])
+	}
+	return sampled
+}
+
+// verifyVolumeFull will download the whole volume, check its size and digest match the manifest's, then read it back
+// through decryption, signature verification and decompression, checking the zfs stream it holds when it was recorded.
+func verifyVolumeFull(ctx context.Context, manifest *files.JobInfo, backend backends.Backend, vol *files.VolumeInfo) error {
+	local, err := downloadVolume(ctx, backend, vol)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if derr := local.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete the temporary file of %s due to error - %v", vol.ObjectName, derr)
+		}
+	}()
+
+	// Reading the volume to the end checks its signature, and closing it waits for any external decompressor
+	if err = local.Extract(ctx, manifest, false); err != nil {
+		return fmt.Errorf("could not decrypt the volume - %v", err)
+	}
+	streamHash := sha256.New()
+	streamBytes, err := io.Copy(streamHash, local)
+	if cerr := local.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not read the volume back - %v", err)
+	}
+
+	if vol.ZFSStreamBytes != 0 && uint64(streamBytes) != vol.ZFSStreamBytes {
+		return fmt.Errorf("zfs stream size mismatch, expected %d bytes but got %d", vol.ZFSStreamBytes, streamBytes)
+	}
+	if sum := fmt.Sprintf("%x", streamHash.Sum(nil)); vol.ZFSStreamSHA256 != "" && sum != vol.ZFSStreamSHA256 {
+		return fmt.Errorf("zfs stream hash mismatch, expected SHA256 %s but got %s", vol.ZFSStreamSHA256, sum)
+	}
+	return nil
+}
+
+// downloadVolume downloads the volume to a temporary file, checking its size and checksum against the ones recorded in
+// the manifest. The caller is responsible for deleting the temporary file.
+func downloadVolume(ctx context.Context, backend backends.Backend, vol *files.VolumeInfo) (*files.VolumeInfo, error) {
+	r, err := backend.Download(ctx, vol.ObjectName)
+	if err != nil {
+		return nil, err
+	}
+	r = limitDownload(r)
+	defer r.Close()
+
+	local, err := files.CreateSimpleVolume(ctx, false)
+	if err != nil {
+		return nil, fmt.Errorf("could not create a temporary file to download the volume to - %v", err)
+	}
+	local.ObjectName = vol.ObjectName
+	local.StoreOnly = vol.StoreOnly
+	if err = local.UseDigest(vol.DigestAlgorithm); err == nil {
+		var size int64
+		size, err = io.Copy(local, r)
+		if cerr := local.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil && vol.Size != 0 && uint64(size) != vol.Size {
+			err = fmt.Errorf("size mismatch, expected %d bytes but got %d", vol.Size, size)
+		}
+		if err == nil && local.Checksum() != vol.Checksum() {
+			err = fmt.Errorf("%s hash mismatch, expected %s but got %s", vol.ChecksumAlgorithm(), vol.Checksum(), local.Checksum())
+		}
+	}
+	if err != nil {
+		if derr := local.DeleteVolume(); derr != nil {
+			log.AppLogger.Warningf("Could not delete the temporary file of %s due to error - %v", vol.ObjectName, derr)
+		}
+		return nil, err
+	}
+	return local, nil
+}
+
+// reportVerifyResults will write the results to out and return an error if any backup set failed verification.
+func reportVerifyResults(out io.Writer, results []VerifyResult, target string) error {
+	failed := 0
+	for _, result := range results {
+		if result.Result == VerifyFailed {
+			failed++
+		}
+	}
+
+	if config.JSONOutput {
+		j, jerr := json.Marshal(results)
+		if jerr != nil {
+			log.AppLogger.Errorf("could not marshal results to JSON - %v", jerr)
+			return jerr
+		}
+		fmt.Fprintln(out, string(j))
+	} else {
+		output := []string{fmt.Sprintf("Verified %d backup sets in %s, %d failed.", len(results), target, failed)}
+		for _, result := range results {
+			volumes := fmt.Sprintf("%d volumes", result.Volumes)
+			if result.Sampled > 0 {
+				volumes = fmt.Sprintf("%d of %d volumes", result.Sampled, result.Volumes)
+			}
+			output = append(output, fmt.Sprintf("\t%s@%s: %s (%s)", result.VolumeName, result.Snapshot, result.Result, volumes))
+			for _, e := range result.Errors {
+				output = append(output, "\t\t"+e)
+			}
+		}
+		fmt.Fprintln(out, strings.Join(output, "\n"))
+	}
+
+	if failed > 0 {
+		return errVerifyFailed
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"context"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// uploadWindow is the daily period of time, in local time, uploads are allowed to run in.
+type uploadWindow struct {
+	window     string
+	start, end time.Duration // offsets from midnight, the window spans midnight when end is before start
+}
+
+// newUploadWindow returns the upload window described by the provided HH:MM-HH:MM string, or nil if
+// no window was provided and uploads may run at any time.
+func newUploadWindow(window string) (*uploadWindow, error) {
+	if window == "" {
+		return nil, nil
+	}
+	start, end, err := files.ParseUploadWindow(window)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadWindow{window: window, start: start, end: end}, nil
+}
+
+// nextOpen returns when the window will next allow uploads, which is now if the window is currently open.
+func (w *uploadWindow) nextOpen(now time.Time) time.Time {
+	if w == nil {
+		return now
+	}
+
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+	if w.start < w.end {
+		if offset >= w.start && offset < w.end {
+			return now
+		}
+	} else if offset >= w.start || offset < w.end {
+		return now
+	}
+
+	if offset < w.start {
+		return midnight.Add(w.start)
+	}
+	return time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location()).Add(w.start)
+}
+
+// wait will block until the window allows uploads or the context is canceled.
+func (w *uploadWindow) wait(ctx context.Context, prefix string) error {
+	now := time.Now()
+	open := w.nextOpen(now)
+	if !open.After(now) {
+		return nil
+	}
+
+	log.AppLogger.Noticef(
+		"%s backend: Outside of the upload window %s, pausing uploads until %s.",
+		prefix, w.window, open.Format(time.RFC1123),
+	)
+	timer := time.NewTimer(open.Sub(now))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		log.AppLogger.Noticef("%s backend: Upload window %s opened, resuming uploads.", prefix, w.window)
+		return nil
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// zvolSignatureBytes is how much of the start of a zvol is read to look for signatures
+const zvolSignatureBytes = 128 * 1024
+
+// zvolSignatures are the filesystem (and container) signatures looked for at the start of a zvol.
+var zvolSignatures = []struct {
+	name   string
+	offset int
+	magic  []byte
+}{
+	{"crypto_LUKS", 0, []byte("LUKS\xba\xbe")},
+	{"xfs", 0, []byte("XFSB")},
+	{"ntfs", 3, []byte("NTFS    ")},
+	{"vfat", 82, []byte("FAT32   ")},
+	{"vfat", 54, []byte("FAT1")},
+	{"btrfs", 0x10040, []byte("_BHRfS_M")},
+	{"swap", 4086, []byte("SWAPSPACE2")},
+	{"swap", 4086, []byte("SWAP-SPACE")},
+}
+
+// recordZvolInfo will record the size and block size of the volume being backed up in the manifest when it is
+// a zvol, along with the partition table and filesystem signatures found at its start if requested.
+func recordZvolInfo(ctx context.Context, jobInfo *files.JobInfo) error {
+	volume := zfs.GetLocalVolumeName(jobInfo)
+	datasetType, err := zfs.GetZFSProperty(ctx, "type", volume)
+	if err != nil || datasetType != "volume" {
+		return err
+	}
+
+	info := new(files.ZvolInfo)
+	for prop, value := range map[string]*uint64{"volsize": &info.VolSize, "volblocksize": &info.VolBlockSize} {
+		raw, perr := zfs.GetZFSProperty(ctx, prop, volume)
+		if perr != nil {
+			return perr
+		}
+		if *value, perr = strconv.ParseUint(raw, 10, 64); perr != nil {
+			return fmt.Errorf("could not parse the %s property of %s (%s) - %v", prop, volume, raw, perr)
+		}
+	}
+
+	if jobInfo.ZvolSignatures {
+		if data, rerr := readZvolStart(volume, jobInfo.BaseSnapshot.Name); rerr != nil {
+			log.AppLogger.Warningf("Could not read the start of the zvol %s to look for signatures - %v", volume, rerr)
+		} else {
+			info.PartitionTable, info.Filesystem = detectZvolSignatures(data)
+		}
+	}
+
+	jobInfo.Zvol = info
+	return nil
+}
+
+// readZvolStart reads the start of the snapshot's block device when it is visible (snapdev=visible), or of the
+// zvol itself otherwise.
+func readZvolStart(volume, snapshot string) ([]byte, error) {
+	f, err := os.Open(filepath.Join(zfs.ZvolDeviceDir, fmt.Sprintf("%s@%s", volume, snapshot)))
+	if os.IsNotExist(err) {
+		log.AppLogger.Debugf("The device of snapshot %s@%s is not visible, reading the zvol instead.", volume, snapshot)
+		f, err = os.Open(filepath.Join(zfs.ZvolDeviceDir, volume))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, zvolSignatureBytes)
+	n, err := io.ReadFull(f, data)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return data[:n], nil
+}
+
+// detectZvolSignatures returns the partition table and filesystem found in the data read from the start of a zvol.
+func detectZvolSignatures(data []byte) (partitionTable, filesystem string) {
+	hasMagic := func(offset int, magic []byte) bool {
+		return len(data) >= offset+len(magic) && bytes.Equal(data[offset:offset+len(magic)], magic)
+	}
+
+	for _, signature := range zvolSignatures {
+		if hasMagic(signature.offset, signature.magic) {
+			return "", signature.name
+		}
+	}
+
+	// The ext superblock starts 1024 bytes in, its feature flags tell the versions apart
+	if hasMagic(1080, []byte{0x53, 0xEF}) && len(data) >= 1124 {
+		filesystem = "ext2"
+		if binary.LittleEndian.Uint32(data[1116:1120])&0x4 != 0 { // has_journal
+			filesystem = "ext3"
+		}
+		if binary.LittleEndian.Uint32(data[1120:1124])&0x40 != 0 { // extents
+			filesystem = "ext4"
+		}
+		return "", filesystem
+	}
+
+	switch {
+	case hasMagic(512, []byte("EFI PART")):
+		partitionTable = "gpt"
+	case hasMagic(510, []byte{0x55, 0xAA}):
+		partitionTable = "dos"
+	}
+	return partitionTable, ""
+}
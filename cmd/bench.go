@@ -0,0 +1,114 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	benchSize       string
+	benchObjectSize string
+	benchParallel   []int
+
+	benchSizeBytes       uint64
+	benchObjectSizeBytes uint64
+)
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench [flags] uri(s)",
+	Short: "bench will upload and download random data to and from each target and report how they perform.",
+	Long: `bench will upload and download random data to and from each target and report how they perform.
+The data is written to the working directory in objects of --objectSize, then uploaded to each target, downloaded
+back and deleted, with each number of transfers running in parallel given with --parallel. The throughput and the
+median latency, the time an object took to upload and the time to the first byte of a download, are reported for
+each. Use it to pick the --maxParallelUploads and --uploadChunkSize options of send, e.g. running it again with a
+different --uploadChunkSize. The objects are stored under a zfsbackup-bench- prefix while the benchmark runs.`,
+	SilenceErrors: true,
+	PreRunE:       validateBenchFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.BenchTarget(cmd.Context(), &jobInfo, args, benchSizeBytes, benchObjectSizeBytes, benchParallel)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+
+	benchCmd.Flags().StringVar(
+		&benchSize,
+		"size",
+		"1GiB",
+		"the amount of data to transfer at each level of parallelism, e.g. 512MiB or 10GiB.",
+	)
+	benchCmd.Flags().StringVar(
+		&benchObjectSize,
+		"objectSize",
+		"64MiB",
+		"the size of each object transferred, e.g. the --volsize used with send.",
+	)
+	benchCmd.Flags().IntSliceVar(
+		&benchParallel,
+		"parallel",
+		[]int{1, 2, 4, 8},
+		"the numbers of transfers to run in parallel.",
+	)
+	benchCmd.Flags().IntVar(
+		&jobInfo.UploadChunkSize,
+		"uploadChunkSize",
+		10,
+		"the chunk size, in MiB, to use when uploading. A minimum of 5MiB and maximum of 100MiB is enforced.",
+	)
+}
+
+func validateBenchFlags(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	var err error
+	if benchSizeBytes, err = humanize.ParseBytes(benchSize); err != nil || benchSizeBytes == 0 {
+		log.AppLogger.Errorf("The size must be a positive amount of data such as 1GiB, was given %s", benchSize)
+		return errInvalidInput
+	}
+	if benchObjectSizeBytes, err = humanize.ParseBytes(benchObjectSize); err != nil || benchObjectSizeBytes == 0 {
+		log.AppLogger.Errorf("The object size must be a positive amount of data such as 64MiB, was given %s", benchObjectSize)
+		return errInvalidInput
+	}
+
+	if len(benchParallel) == 0 {
+		log.AppLogger.Errorf("At least one number of transfers to run in parallel must be provided.")
+		return errInvalidInput
+	}
+	for _, parallel := range benchParallel {
+		if parallel < 1 {
+			log.AppLogger.Errorf("The number of transfers to run in parallel must be at least 1, was given %d", parallel)
+			return errInvalidInput
+		}
+	}
+
+	return validateTargetURIs(args)
+}
@@ -0,0 +1,153 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os/exec"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// externalCompressors are the gzip compatible compressors benchmarked by default when found on the host.
+var externalCompressors = []string{"gzip", "pigz", "bzip2", "xz", "zstd", "lz4"}
+
+var (
+	benchCompressors []string
+	benchLevels      []int
+	benchSampleSize  uint64
+)
+
+// benchCompressCmd represents the bench-compress command
+var benchCompressCmd = &cobra.Command{
+	Use:   "bench-compress [flags] filesystem|volume@snapshot",
+	Short: "bench-compress will compress a sample of a snapshot's send stream with each compressor and report how they perform.",
+	Long: `bench-compress will compress a sample of a snapshot's send stream with each compressor and report how they perform.
+The start of the zfs send stream of the snapshot is read into memory and compressed with each compressor at each
+compression level provided, reporting the compression ratio and throughput of each. Use it to pick the --compressor
+and --compressionLevel options before committing to a large full backup.
+
+By default the internal compressors and any of the gzip, pigz, bzip2, xz, zstd, and lz4 binaries found are benchmarked.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeLocalDatasets),
+	PreRunE:           validateBenchCompressFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.BenchCompress(cmd.Context(), &jobInfo, benchCompressors, benchLevels, benchSampleSize*humanize.MiByte)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(benchCompressCmd)
+
+	benchCompressCmd.Flags().StringSliceVar(
+		&benchCompressors,
+		"compressors",
+		nil,
+		"the compressors to benchmark, either internal, internal-lz4, internal-zstd, or an external binary that is compatible with the gzip "+
+			"command line options. External binaries given with their own arguments, e.g. \"zstd -T0 -19\", are run once as given. Defaults to the internal compressors and any of the common external ones found on this host.",
+	)
+	benchCompressCmd.Flags().IntSliceVar(
+		&benchLevels,
+		"levels",
+		[]int{1, 6, 9},
+		"the compression levels to benchmark each compressor at. Valid values are between 1-9.",
+	)
+	benchCompressCmd.Flags().Uint64Var(
+		&benchSampleSize,
+		"sampleSize",
+		64,
+		"the size (in MiB) of the start of the send stream to compress. The sample is held in memory.",
+	)
+	benchCompressCmd.Flags().IntVar(
+		&jobInfo.CompressionThreads,
+		"compressionThreads",
+		0,
+		"the number of threads the internal compressors use to compress in parallel. Set to 0 to use one per CPU.",
+	)
+	benchCompressCmd.Flags().StringVarP(
+		&jobInfo.IncrementalSnapshot.Name,
+		"incremental",
+		"i",
+		"",
+		"benchmark the incremental stream from this snapshot instead of the full stream of the snapshot.",
+	)
+}
+
+func validateBenchCompressFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := parseBackupSet(args[0]); err != nil {
+		return err
+	}
+
+	if benchSampleSize == 0 {
+		log.AppLogger.Errorf("The sample size must be greater than 0.")
+		return errInvalidInput
+	}
+
+	if len(benchLevels) == 0 {
+		log.AppLogger.Errorf("At least one compression level must be provided.")
+		return errInvalidInput
+	}
+	for _, level := range benchLevels {
+		if level < 1 || level > 9 {
+			log.AppLogger.Errorf("The compression levels must be between 1 and 9. Was given %d", level)
+			return errInvalidInput
+		}
+	}
+
+	if len(benchCompressors) == 0 {
+		benchCompressors = []string{files.InternalCompressor, files.InternalLZ4Compressor, files.InternalZstdCompressor}
+		for _, compressor := range externalCompressors {
+			if _, err := exec.LookPath(compressor); err == nil {
+				benchCompressors = append(benchCompressors, compressor)
+			}
+		}
+		return nil
+	}
+
+	for _, compressor := range benchCompressors {
+		switch strings.TrimSpace(compressor) {
+		case "":
+			log.AppLogger.Errorf("An empty compressor cannot be benchmarked.")
+			return errInvalidInput
+		case files.InternalCompressor, files.InternalLZ4Compressor, files.InternalZstdCompressor:
+		case files.ZfsCompressor:
+			log.AppLogger.Errorf("The %q compressor cannot be benchmarked.", compressor)
+			return errInvalidInput
+		default:
+			if _, err := exec.LookPath(strings.Fields(compressor)[0]); err != nil {
+				log.AppLogger.Errorf("Could not find the compressor %s - %v", compressor, err)
+				return errInvalidInput
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// catCmd represents the cat command
+var catCmd = &cobra.Command{
+	Use:   "cat [flags] filesystem|volume@snapshot uri(s)",
+	Short: "cat will write the zfs send stream of a backup set to stdout.",
+	Long: `cat will write the zfs send stream of a backup set to stdout.
+The stream is reassembled from the volumes of the backup set, which are checked against the manifest, decrypted and
+decompressed, so it can be piped to zfs receive, zstream dump or any other tool reading zfs send streams. Use the -i
+option to select an incremental backup set. Multiple targets can be provided separated by commas, the first target
+the manifest is found in is read from.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes),
+	PreRunE:           validateCatFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Cat(cmd.Context(), &jobInfo)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(catCmd)
+
+	catCmd.Flags().StringVarP(
+		&jobInfo.IncrementalSnapshot.Name,
+		"incremental",
+		"i",
+		"",
+		"Used to specify the snapshot the incremental backup set to write was taken from.",
+	)
+}
+
+func validateCatFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	parts := strings.Split(args[0], "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		log.AppLogger.Errorf("Invalid snapshot provided. Expected format <volume>@<snapshot>, got %s instead", args[0])
+		return errInvalidInput
+	}
+	jobInfo.VolumeName = parts[0]
+	jobInfo.BaseSnapshot = files.SnapshotInfo{Name: parts[1]}
+	jobInfo.Destinations = strings.Split(args[1], ",")
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(jobInfo.Destinations)
+}
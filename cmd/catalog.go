@@ -0,0 +1,68 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+)
+
+var catalogVolumeName string
+
+// catalogCmd represents the catalog command
+var catalogCmd = &cobra.Command{
+	Use:   "catalog [flags] uri [uri...]",
+	Short: "catalog will output a merged view of the backup sets found across all of the provided targets.",
+	Long: `catalog will output a merged view of the backup sets found across all of the provided targets.
+Backup sets found in more than one target are only listed once along with every target holding them. For each
+backup set the chain of snapshots required to restore it is listed along with the targets that hold the entire
+chain. Use the --jsonOutput flag to export the catalog for use by external tooling.`,
+	PreRunE: validateCatalogFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Catalog(cmd.Context(), &jobInfo, args, catalogVolumeName)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(catalogCmd)
+
+	catalogCmd.Flags().StringVar(
+		&catalogVolumeName,
+		"volumeName",
+		"",
+		"Filter results to only this volume name, can end with a '*' to match as only a prefix",
+	)
+	_ = catalogCmd.RegisterFlagCompletionFunc("volumeName", completeTargetVolumes)
+}
+
+func validateCatalogFlags(cmd *cobra.Command, args []string) error {
+	if len(args) == 0 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args)
+}
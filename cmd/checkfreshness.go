@@ -0,0 +1,94 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	freshnessWarn time.Duration
+	freshnessCrit time.Duration
+)
+
+// checkFreshnessCmd represents the check-freshness command
+var checkFreshnessCmd = &cobra.Command{
+	Use:   "check-freshness [flags] filesystem|volume uri",
+	Short: "check-freshness will check the last backup of a volume in the target is recent enough, as a Nagios/Icinga plugin.",
+	Long: `check-freshness will check the last backup of a volume in the target is recent enough, as a Nagios/Icinga plugin.
+A single status line telling how long ago the last backup completed is output, with its age in seconds as performance
+data, and the command exits with 0 (OK), 1 (WARNING) once the backup is older than --warn, 2 (CRITICAL) once it is
+older than --crit or if there is no backup at all, or 3 (UNKNOWN) if the backups could not be read.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes),
+	PreRunE:           validateCheckFreshnessFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if state := backup.CheckFreshness(cmd.Context(), &jobInfo, args[0], args[1], freshnessWarn, freshnessCrit); state != backup.FreshnessOK {
+			return exitCodeError(state)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(checkFreshnessCmd)
+
+	checkFreshnessCmd.Flags().DurationVar(
+		&freshnessWarn,
+		"warn",
+		26*time.Hour,
+		"the age of the last backup after which the check is in a warning state.",
+	)
+	checkFreshnessCmd.Flags().DurationVar(
+		&freshnessCrit,
+		"crit",
+		50*time.Hour,
+		"the age of the last backup after which the check is in a critical state.",
+	)
+}
+
+// validateCheckFreshnessFlags exits as UNKNOWN on invalid input, as monitoring systems expect of a plugin.
+func validateCheckFreshnessFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return exitCodeError(backup.FreshnessUnknown)
+	}
+
+	if freshnessWarn <= 0 || freshnessCrit < freshnessWarn {
+		log.AppLogger.Errorf("The --warn age must be greater than 0 and no greater than the --crit age, was given %v and %v",
+			freshnessWarn, freshnessCrit)
+		return exitCodeError(backup.FreshnessUnknown)
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return exitCodeError(backup.FreshnessUnknown)
+	}
+
+	if err := validateTargetURIs(args[1:]); err != nil {
+		return exitCodeError(backup.FreshnessUnknown)
+	}
+	return nil
+}
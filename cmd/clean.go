@@ -24,9 +24,13 @@ import (
 	"github.com/spf13/cobra"
 
 	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
 )
 
-var cleanLocal bool
+var (
+	cleanLocal bool
+	cleanGC    bool
+)
 
 // cleanCmd represents the clean command
 var cleanCmd = &cobra.Command{
@@ -37,7 +41,7 @@ var cleanCmd = &cobra.Command{
 	PreRunE:       validateCleanFlags,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		jobInfo.Destinations = []string{args[0]}
-		return backup.Clean(cmd.Context(), &jobInfo, cleanLocal)
+		return backup.Clean(cmd.Context(), &jobInfo, cleanLocal, cleanGC)
 	},
 }
 
@@ -48,6 +52,12 @@ func init() {
 	cleanCmd.Flags().BoolVarP(&jobInfo.Force, "force", "", false,
 		"This will force the deletion of broken backup sets (sets where volumes expected in the manifest file are not found). Use with caution.",
 	)
+	cleanCmd.Flags().BoolVar(&cleanGC, "gc", false,
+		"Report every object not referenced by a manifest, and every broken backup set, deleting nothing unless --force is provided.",
+	)
+	cleanCmd.Flags().StringVar(&jobInfo.HoldTag, "holdTag", "",
+		"Release the zfs hold with the given tag from the local snapshots of any backup sets deleted by the --force flag.",
+	)
 }
 
 func validateCleanFlags(cmd *cobra.Command, args []string) error {
@@ -56,6 +66,11 @@ func validateCleanFlags(cmd *cobra.Command, args []string) error {
 		return errInvalidInput
 	}
 
+	if cleanGC && cleanLocal && !jobInfo.Force {
+		log.AppLogger.Errorf("The --cleanLocal flag deletes the local manifests, it can only be used with --gc along with --force.")
+		return errInvalidInput
+	}
+
 	if err := loadReceiveKeys(); err != nil {
 		return err
 	}
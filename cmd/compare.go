@@ -0,0 +1,77 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var compareDeep bool
+
+// compareCmd represents the compare command
+var compareCmd = &cobra.Command{
+	Use:   "compare [flags] uriA uriB",
+	Short: "compare will cross-check the backup sets found in two targets and report any divergence.",
+	Long: `compare will cross-check the manifests, volume lists, sizes, and checksums between two targets
+and report any divergence found. Sizes and checksums are compared against the values recorded in the manifests
+where the target can report them. Volumes whose checksum the target does not report, e.g. S3 multipart or SSE-KMS
+uploads, are listed as not checked, use --deep to download every volume and check its digest instead. Exits with an
+error if the targets have diverged.`,
+	SilenceErrors: true,
+	PreRunE:       validateCompareFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Compare(cmd.Context(), &jobInfo, args[0], args[1], compareDeep)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(compareCmd)
+
+	compareCmd.Flags().BoolVar(
+		&compareDeep,
+		"deep",
+		false,
+		"download every volume and check its digest against the manifest, rather than relying on the checksums reported by the targets.",
+	)
+}
+
+func validateCompareFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	if strings.TrimRight(args[0], "/") == strings.TrimRight(args[1], "/") {
+		log.AppLogger.Errorf("The targets provided must be different.")
+		return errInvalidInput
+	}
+
+	return validateTargetURIs(args)
+}
@@ -0,0 +1,107 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/zfs"
+)
+
+// completionFunc suggests the values of an argument or flag while the shell completes a command line.
+type completionFunc func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective)
+
+// completeArgs completes each positional argument with the function at its position, if any.
+func completeArgs(completions ...completionFunc) completionFunc {
+	return func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+		if len(args) >= len(completions) || completions[len(args)] == nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		return completions[len(args)](cmd, args, toComplete)
+	}
+}
+
+// completeLocalDatasets suggests the local filesystems and volumes, and their snapshots once an @ is typed.
+func completeLocalDatasets(cmd *cobra.Command, _ []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if idx := strings.Index(toComplete, "@"); idx >= 0 {
+		snapshots, err := zfs.GetSnapshotsAndBookmarks(cmd.Context(), toComplete[:idx])
+		if err != nil {
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		}
+		names := make([]string, 0, len(snapshots))
+		for _, snapshot := range snapshots {
+			if !snapshot.Bookmark {
+				names = append(names, toComplete[:idx+1]+snapshot.Name)
+			}
+		}
+		return names, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	datasets, err := zfs.GetDatasets(cmd.Context(), "")
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return datasets, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeBackedUpVolumes suggests the volumes, and their backed up snapshots, found in the manifest cache of every
+// target since the target is only given after the volume.
+func completeBackedUpVolumes(cmd *cobra.Command, _ []string, _ string) ([]string, cobra.ShellCompDirective) {
+	setupCompletionWorkingDirectory()
+	return backup.BackedUpVolumes(cmd.Context(), &jobInfo, nil), cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeTargetVolumes suggests the volumes found in the manifest cache of the targets given as arguments.
+func completeTargetVolumes(cmd *cobra.Command, args []string, _ string) ([]string, cobra.ShellCompDirective) {
+	var targets []string
+	for _, arg := range args {
+		targets = append(targets, strings.Split(arg, ",")...)
+	}
+	if len(targets) == 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	setupCompletionWorkingDirectory()
+	var volumes []string
+	for _, name := range backup.BackedUpVolumes(cmd.Context(), &jobInfo, targets) {
+		if !strings.Contains(name, "@") {
+			volumes = append(volumes, name)
+		}
+	}
+	return volumes, cobra.ShellCompDirectiveNoFileComp
+}
+
+// setupCompletionWorkingDirectory points to the working directory holding the manifest cache, which is otherwise only
+// done before running a command. Nothing is created since completion should not leave anything behind.
+func setupCompletionWorkingDirectory() {
+	config.WorkingDir = workingDirectory
+	if strings.HasPrefix(workingDirectory, "~") {
+		if usr, err := user.Current(); err == nil {
+			config.WorkingDir = filepath.Join(usr.HomeDir, strings.TrimPrefix(workingDirectory, "~"))
+		}
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	consolidateScratch     string
+	consolidatePrune       bool
+	consolidateKeepScratch bool
+)
+
+// consolidateCmd represents the consolidate command
+var consolidateCmd = &cobra.Command{
+	Use:   "consolidate [flags] filesystem|volume[@snapshot] uri",
+	Short: "consolidate will replace an incremental chain with a full backup of its latest snapshot.",
+	Long: `consolidate will restore the incremental chain ending with the latest backup of the volume (or the snapshot
+provided) into a scratch dataset, then upload a full backup of that snapshot from the scratch dataset, bounding
+the number of backup sets a restore needs without touching the host the backups were taken on. The scratch
+dataset must not exist yet and is destroyed afterwards. Use --prune to delete the backup sets of the old chain
+that no other backup set depends on once the full backup is uploaded.`,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes),
+	PreRunE:           validateConsolidateFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Consolidate(cmd.Context(), &jobInfo, consolidateScratch, consolidatePrune, consolidateKeepScratch)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(consolidateCmd)
+
+	consolidateCmd.Flags().StringVar(
+		&consolidateScratch,
+		"scratch",
+		"",
+		"the dataset to restore the chain into before uploading the full backup, e.g. tank/scratch. It must not exist yet.",
+	)
+	consolidateCmd.Flags().BoolVar(
+		&consolidatePrune,
+		"prune",
+		false,
+		"delete the backup sets of the old chain that no other backup set depends on after the full backup is uploaded.",
+	)
+	consolidateCmd.Flags().BoolVar(
+		&consolidateKeepScratch,
+		"keepScratch",
+		false,
+		"keep the scratch dataset instead of destroying it once done.",
+	)
+	consolidateCmd.Flags().StringVar(
+		&jobInfo.HoldTag,
+		"holdTag",
+		"",
+		"release the zfs hold with the given tag from the local snapshots of the backup sets deleted by the --prune flag.",
+	)
+	consolidateCmd.Flags().Uint64Var(
+		&jobInfo.VolumeSize,
+		"volsize",
+		200,
+		"the maximum size (in MiB) a volume should be before splitting to a new volume.",
+	)
+	consolidateCmd.Flags().IntVar(
+		&jobInfo.MaxFileBuffer,
+		"maxFileBuffer",
+		5,
+		"the maximum number of files to have active during the download and upload processes.",
+	)
+	consolidateCmd.Flags().IntVar(
+		&jobInfo.MaxParallelUploads,
+		"maxParallelUploads",
+		4,
+		"the maximum number of uploads to run in parallel.",
+	)
+	consolidateCmd.Flags().DurationVar(
+		&jobInfo.MaxRetryTime,
+		"maxRetryTime",
+		12*time.Hour,
+		"the maximum time that can elapse when retrying a failed download or upload. Use 0 for no limit.",
+	)
+	consolidateCmd.Flags().DurationVar(
+		&jobInfo.MaxBackoffTime,
+		"maxBackoffTime",
+		30*time.Minute,
+		"the maximum delay you'd want a worker to sleep before retrying a download or upload.",
+	)
+	consolidateCmd.Flags().IntVar(
+		&jobInfo.UploadChunkSize,
+		"uploadChunkSize",
+		10,
+		"the chunk size, in MiB, to use when uploading. A minimum of 5MiB and maximum of 100MiB is enforced.",
+	)
+}
+
+// ResetConsolidateJobInfo exists solely for integration testing
+func ResetConsolidateJobInfo() {
+	resetRootFlags()
+	consolidateScratch = ""
+	consolidatePrune = false
+	consolidateKeepScratch = false
+	jobInfo.BaseSnapshot = files.SnapshotInfo{}
+	jobInfo.VolumeSize = 200
+	jobInfo.MaxFileBuffer = 5
+	jobInfo.MaxParallelUploads = 4
+	jobInfo.MaxRetryTime = 12 * time.Hour
+	jobInfo.MaxBackoffTime = 30 * time.Minute
+	jobInfo.UploadChunkSize = 10
+}
+
+func validateConsolidateFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadConsolidateKeys(); err != nil {
+		return err
+	}
+
+	if consolidateScratch == "" || strings.ContainsAny(consolidateScratch, "@#") {
+		log.AppLogger.Errorf("A scratch dataset to restore the chain into must be provided with the --scratch option.")
+		return errInvalidInput
+	}
+
+	if jobInfo.VolumeSize == 0 || jobInfo.MaxParallelUploads <= 0 || jobInfo.MaxFileBuffer < 0 {
+		log.AppLogger.Errorf("The volsize and maxParallelUploads options must be greater than 0, and maxFileBuffer at least 0.")
+		return errInvalidInput
+	}
+
+	if jobInfo.UploadChunkSize < 5 || jobInfo.UploadChunkSize > 100 {
+		log.AppLogger.Errorf("The uploadChunkSize provided (%d) is not between 5 and 100", jobInfo.UploadChunkSize)
+		return errInvalidInput
+	}
+
+	parts := strings.Split(args[0], "@")
+	if len(parts) > 2 {
+		log.AppLogger.Errorf("Invalid volume provided. Expected format <volume>[@<snapshot>], got %s instead", args[0])
+		return errInvalidInput
+	}
+	jobInfo.VolumeName = parts[0]
+	if len(parts) == 2 {
+		jobInfo.BaseSnapshot = files.SnapshotInfo{Name: parts[1]}
+	}
+	jobInfo.Destinations = []string{args[1]}
+
+	return validateTargetURIs(jobInfo.Destinations)
+}
+
+// loadConsolidateKeys loads the private keys needed to both read the existing backup sets and write the new one.
+func loadConsolidateKeys() error {
+	if len(jobInfo.KMSKeys) > 0 {
+		return checkKMSKeys()
+	}
+
+	if err := loadAgeKeys(true); err != nil {
+		return err
+	}
+
+	if jobInfo.GPGAgent {
+		return checkGPGAgent()
+	}
+
+	if (jobInfo.EncryptTo != "" || jobInfo.SignFrom != "") && secretKeyRingPath == "" {
+		log.AppLogger.Errorf("You must specify a secret keyring path if you provide an encryptTo or signFrom option")
+		return errInvalidInput
+	}
+
+	var err error
+	if jobInfo.EncryptTo != "" {
+		if jobInfo.EncryptKey, err = getAndDecryptPrivateKey(jobInfo.EncryptTo); err != nil {
+			return err
+		}
+	}
+
+	if jobInfo.SignFrom != "" {
+		if jobInfo.SignKey, err = getAndDecryptPrivateKey(jobInfo.SignFrom); err != nil {
+			return err
+		}
+	}
+
+	return checkSendKeys(&jobInfo, encryptSubkey, signSubkey)
+}
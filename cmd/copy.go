@@ -0,0 +1,157 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// copyCmd represents the copy command
+var copyCmd = &cobra.Command{
+	Use:   "copy [flags] filesystem|volume@snapshot source_uri destination_uri",
+	Short: "copy will copy a backup set from one target to another.",
+	Long: `copy will copy a backup set from one target to another. When both targets are serviced by the same
+provider (e.g. S3 to S3, Azure to Azure) a server-side copy is used, otherwise each volume is streamed
+through a local temporary file. The manifest is copied last.`,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes),
+	PreRunE:           validateCopyFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Copy(cmd.Context(), &jobInfo, args[1], args[2])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(copyCmd)
+
+	copyCmd.Flags().StringVarP(
+		&jobInfo.IncrementalSnapshot.Name,
+		"incremental",
+		"i",
+		"",
+		"Used to specify the snapshot the backup set is incremental from when more than one backup set exists for the snapshot.",
+	)
+	copyCmd.Flags().Uint64Var(
+		&maxDownloadSpeed,
+		"maxDownloadSpeed",
+		0,
+		"the maximum speed (in KB/s) to download volumes that cannot be copied server-side at, between all workers. Use 0 for no limit",
+	)
+	addTransferFlags(copyCmd)
+}
+
+// addTransferFlags will add the options controlling how volumes are copied between targets to the command, shared by
+// the commands copying backup sets from one target to another.
+func addTransferFlags(cmd *cobra.Command) {
+	cmd.Flags().IntVar(
+		&jobInfo.MaxParallelUploads,
+		"maxParallelUploads",
+		4,
+		"the maximum number of volumes to copy in parallel.",
+	)
+	cmd.Flags().DurationVar(
+		&jobInfo.MaxRetryTime,
+		"maxRetryTime",
+		12*time.Hour,
+		"the maximum time that can elapse when retrying a failed copy. Use 0 for no limit.",
+	)
+	cmd.Flags().DurationVar(
+		&jobInfo.MaxBackoffTime,
+		"maxBackoffTime",
+		30*time.Minute,
+		"the maximum delay you'd want a worker to sleep before retrying a copy.",
+	)
+	cmd.Flags().IntVar(
+		&jobInfo.UploadChunkSize,
+		"uploadChunkSize",
+		10,
+		"the chunk size, in MiB, to use when uploading. A minimum of 5MiB and maximum of 100MiB is enforced.",
+	)
+}
+
+// validateTransferFlags will check the options added by addTransferFlags.
+func validateTransferFlags() error {
+	if jobInfo.MaxParallelUploads <= 0 {
+		log.AppLogger.Errorf("The number of parallel uploads must be set to a value greater than 0. Was given %d", jobInfo.MaxParallelUploads)
+		return errInvalidInput
+	}
+	return nil
+}
+
+// ResetCopyJobInfo exists solely for integration testing
+func ResetCopyJobInfo() {
+	resetRootFlags()
+	jobInfo.BaseSnapshot = files.SnapshotInfo{}
+	jobInfo.IncrementalSnapshot = files.SnapshotInfo{}
+	jobInfo.MaxParallelUploads = 4
+	maxDownloadSpeed = 0
+	jobInfo.MaxRetryTime = 12 * time.Hour
+	jobInfo.MaxBackoffTime = 30 * time.Minute
+	jobInfo.UploadChunkSize = 10
+}
+
+func validateCopyFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 3 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	if err := parseBackupSet(args[0]); err != nil {
+		return err
+	}
+
+	if err := validateTransferFlags(); err != nil {
+		return err
+	}
+
+	if strings.TrimRight(args[1], "/") == strings.TrimRight(args[2], "/") {
+		log.AppLogger.Errorf("The source and destination targets must be different.")
+		return errInvalidInput
+	}
+
+	return validateTargetURIs(args[1:])
+}
+
+// parseBackupSet will populate the jobInfo with the volume and snapshot provided in the <volume>@<snapshot> format,
+// normalizing any incremental snapshot name provided.
+func parseBackupSet(arg string) error {
+	parts := strings.Split(arg, "@")
+	if len(parts) != 2 {
+		log.AppLogger.Errorf("Invalid backup set provided. Expected format <volume>@<snapshot>, got %s instead", arg)
+		return errInvalidInput
+	}
+	jobInfo.VolumeName = parts[0]
+	jobInfo.BaseSnapshot = files.SnapshotInfo{Name: parts[1]}
+	jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, jobInfo.VolumeName)
+	jobInfo.IncrementalSnapshot.Name = strings.TrimPrefix(jobInfo.IncrementalSnapshot.Name, "@")
+
+	return nil
+}
@@ -0,0 +1,88 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var diffScratch string
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff [flags] filesystem@snapshot filesystem@snapshot uri(s)",
+	Short: "diff will report the files changed between two backed up snapshots.",
+	Long: `diff will report the files changed between two backed up snapshots.
+Both snapshots are restored into temporary datasets created under the --scratch dataset, which are destroyed
+afterwards. When the first snapshot is part of the incremental chain of the second, only the second is restored and
+zfs diff is used to compare them. Otherwise both are restored and their files are compared, reporting renamed files
+as removed and added. The changes are output in the format of zfs diff -H, with paths relative to the root of the
+filesystem, or as JSON with the --jsonOutput flag.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes, completeBackedUpVolumes),
+	PreRunE:           validateDiffFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Diff(cmd.Context(), &jobInfo, args[0], args[1], diffScratch)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(diffCmd)
+
+	diffCmd.Flags().StringVar(
+		&diffScratch,
+		"scratch",
+		"",
+		"An existing dataset to restore the snapshots compared under, into temporary datasets that are destroyed afterwards.",
+	)
+}
+
+func validateDiffFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 3 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	for _, snapshot := range args[:2] {
+		if parts := strings.Split(snapshot, "@"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			log.AppLogger.Errorf("Invalid snapshot provided. Expected format <volume>@<snapshot>, got %s instead", snapshot)
+			return errInvalidInput
+		}
+	}
+
+	if diffScratch == "" {
+		log.AppLogger.Errorf("The --scratch option is required to restore the snapshots into temporary datasets.")
+		return errInvalidInput
+	}
+
+	jobInfo.Destinations = strings.Split(args[2], ",")
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(jobInfo.Destinations)
+}
@@ -0,0 +1,81 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/files"
+)
+
+var doctorDatasets []string
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor [flags] [uri(s)]",
+	Short: "doctor will check this host is set up to back up to, and restore from, the targets provided.",
+	Long: `doctor will check this host is set up to back up to, and restore from, the targets provided.
+It checks the zfs binary can be found and reports its version, checks the permissions delegated with zfs allow to
+the current user on each dataset given with --dataset when not running as root, checks the working directory can be
+written to and has room for the volumes of a backup, loads the keys given as send would, checks the compressor can
+be found, and lists the manifests of each target. Each check is reported along with how to fix it, and the command
+fails if any check failed. Warnings, e.g. when the backups would not be encrypted, do not make it fail.`,
+	SilenceErrors: true,
+	PreRunE:       validateDoctorFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Doctor(cmd.Context(), &jobInfo, doctorDatasets, args, loadSendKeys())
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().StringSliceVar(
+		&doctorDatasets,
+		"dataset",
+		nil,
+		"a dataset to check the permissions delegated on, when not running as root. Can be given more than once.",
+	)
+	_ = doctorCmd.RegisterFlagCompletionFunc("dataset", completeLocalDatasets)
+	doctorCmd.Flags().StringVar(
+		&jobInfo.Compressor,
+		"compressor",
+		files.InternalCompressor,
+		"the compressor send will be used with, to check it can be found.",
+	)
+	doctorCmd.Flags().Uint64Var(
+		&jobInfo.VolumeSize,
+		"volsize",
+		200,
+		"the volume size (in MiB) send will be used with, to check the working directory has room for its volumes.",
+	)
+	doctorCmd.Flags().IntVar(
+		&jobInfo.MaxFileBuffer,
+		"maxFileBuffer",
+		5,
+		"the maximum number of files send will be used with, to check the working directory has room for its volumes.",
+	)
+}
+
+func validateDoctorFlags(cmd *cobra.Command, args []string) error {
+	return validateTargetURIs(args)
+}
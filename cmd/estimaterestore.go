@@ -0,0 +1,108 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	estimateTier        string
+	estimateEgressPrice float64
+)
+
+// estimateRestoreCmd represents the estimate-restore command
+var estimateRestoreCmd = &cobra.Command{
+	Use:   "estimate-restore [flags] filesystem|volume[@snapshot] uri [local_volume]",
+	Short: "estimate-restore will estimate the cost and time of restoring a snapshot from the target.",
+	Long: `estimate-restore will estimate the cost and time of restoring a snapshot from the target.
+The backup sets a receive with the --auto option would download are resolved, skipping those already restored into
+the local_volume (the volume itself when omitted), the latest snapshot being restored when none is given. The storage
+class of each of their volumes is looked up in the target and the volumes are totaled per storage class, along with
+the approximate cost of retrieving them from archive storage classes with the --tier retrieval tier, the cost of
+downloading them at --egressPrice, and how long archived volumes take to be readable. Prices are approximate list
+prices. Nothing is downloaded or restored.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes, nil, completeLocalDatasets),
+	PreRunE:           validateEstimateRestoreFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.EstimateRestore(cmd.Context(), &jobInfo, estimateTier, estimateEgressPrice)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(estimateRestoreCmd)
+
+	estimateRestoreCmd.Flags().StringVar(
+		&estimateTier,
+		"tier",
+		"",
+		"the retrieval tier to price archived volumes with, expedited, standard or bulk. "+
+			"Defaults to the tier set with the AWS_S3_GLACIER_RESTORE_TIER environment variable, or bulk.",
+	)
+	estimateRestoreCmd.Flags().Float64Var(
+		&estimateEgressPrice,
+		"egressPrice",
+		0.09,
+		"the price, in USD per GiB, of downloading from the target. Use 0 when restoring from within the provider's network.",
+	)
+}
+
+func validateEstimateRestoreFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 && len(args) != 3 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	switch estimateTier = strings.ToLower(estimateTier); estimateTier {
+	case "", backup.TierExpedited, backup.TierStandard, backup.TierBulk:
+	default:
+		log.AppLogger.Errorf("The retrieval tier must be expedited, standard or bulk, was given %s", estimateTier)
+		return errInvalidInput
+	}
+
+	if estimateEgressPrice < 0 {
+		log.AppLogger.Errorf("The egress price cannot be negative, was given %v", estimateEgressPrice)
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	parts := strings.Split(args[0], "@")
+	jobInfo.VolumeName = parts[0]
+	if len(parts) == 2 {
+		jobInfo.BaseSnapshot = files.SnapshotInfo{Name: parts[1]}
+	}
+	jobInfo.Destinations = []string{args[1]}
+	if len(args) == 3 {
+		jobInfo.LocalVolume = args[2]
+	}
+
+	return validateTargetURIs(jobInfo.Destinations)
+}
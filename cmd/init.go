@@ -0,0 +1,84 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var lifecyclePolicy backends.LifecyclePolicy
+
+// initCmd represents the init command
+var initCmd = &cobra.Command{
+	Use:   "init [flags] uri(s)",
+	Short: "Initialize the provided target(s) with lifecycle rules derived from your retention options.",
+	Long: `Initialize the provided target(s) with lifecycle rules derived from your retention options.
+Pass the --keepDaily, --keepWeekly, and --keepMonthly options given to prune: volumes are transitioned to a colder
+storage class once their backup sets are older than the daily backup sets kept, when weekly or monthly backup sets
+are kept too. Only volumes are transitioned, manifests always stay readable, and nothing is expired, prune deletes
+the backup sets no longer needed without breaking incremental chains. Incomplete multipart uploads can be aborted
+automatically. Rules are scoped to the prefix in the target URI.`,
+	PreRunE: validateInitFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobInfo.Destinations = strings.Split(args[0], ",")
+		return backup.InitTargets(cmd.Context(), &jobInfo, prunePolicy, &lifecyclePolicy)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(initCmd)
+
+	initCmd.Flags().IntVar(&prunePolicy.KeepDaily, "keepDaily", 0, "the number of the most recent days prune keeps the latest backup set of.")
+	initCmd.Flags().IntVar(&prunePolicy.KeepWeekly, "keepWeekly", 0, "the number of the most recent weeks prune keeps the latest backup set of.")
+	initCmd.Flags().IntVar(&prunePolicy.KeepMonthly, "keepMonthly", 0, "the number of the most recent months prune keeps the latest backup set of.")
+	initCmd.Flags().StringVar(
+		&lifecyclePolicy.TransitionStorageClass,
+		"storageClass",
+		"",
+		"the storage class to transition volumes to (default GLACIER for S3 and COLDLINE for GCS).",
+	)
+	initCmd.Flags().IntVar(
+		&lifecyclePolicy.AbortIncompleteUploadsAfterDays,
+		"abortIncompleteAfter",
+		7,
+		"the number of days after which incomplete multipart uploads should be aborted. Use 0 to disable.",
+	)
+}
+
+func validateInitFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if prunePolicy.KeepDaily < 0 || prunePolicy.KeepWeekly < 0 || prunePolicy.KeepMonthly < 0 || lifecyclePolicy.AbortIncompleteUploadsAfterDays < 0 {
+		log.AppLogger.Errorf("The counts provided for the retention and lifecycle options must be greater than or equal to 0.")
+		return errInvalidInput
+	}
+
+	return nil
+}
@@ -35,6 +35,12 @@ var (
 	afterStr   string
 	before     time.Time
 	after      time.Time
+	history    bool
+	listLong   bool
+	listTags   map[string]string
+	listIndex  bool
+	listHost   string
+	superseded bool
 )
 
 // listCmd represents the list command
@@ -61,7 +67,10 @@ var listCmd = &cobra.Command{
 		}
 
 		jobInfo.Destinations = []string{args[0]}
-		return backup.List(cmd.Context(), &jobInfo, startsWith, before, after)
+		if listIndex {
+			return backup.ListIndex(cmd.Context(), &jobInfo, startsWith, before, after, listTags, listHost)
+		}
+		return backup.List(cmd.Context(), &jobInfo, startsWith, before, after, history, superseded, listLong, listTags, listHost)
 	},
 }
 
@@ -74,6 +83,7 @@ func init() {
 		"",
 		"Filter results to only this volume name, can end with a '*' to match as only a prefix",
 	)
+	_ = listCmd.RegisterFlagCompletionFunc("volumeName", completeTargetVolumes)
 	listCmd.Flags().StringVar(
 		&beforeStr,
 		"before",
@@ -86,6 +96,43 @@ func init() {
 		"",
 		"Filter results to only this backups after this specified date & time (format: yyyy-MM-ddTHH:mm:ss, parsed in local TZ)",
 	)
+	listCmd.Flags().BoolVar(
+		&history,
+		"history",
+		false,
+		"Also list previous versions of manifests kept by the target. Requires a target with versioning enabled.",
+	)
+	listCmd.Flags().BoolVar(
+		&superseded,
+		"showSupersededManifests",
+		false,
+		"Also list the previous generations of manifests kept when they were written again, see --manifestGenerations.",
+	)
+	listCmd.Flags().BoolVarP(
+		&listLong,
+		"long",
+		"l",
+		false,
+		"Also show the compressor, how well the backup compressed, and the details of each volume of the backup sets.",
+	)
+	listCmd.Flags().StringToStringVar(
+		&listTags,
+		"tag",
+		nil,
+		"Filter results to only backup sets with this key=value tag, can be given more than once to require all of them",
+	)
+	listCmd.Flags().StringVar(
+		&listHost,
+		"host",
+		"",
+		"Filter results to only backup sets taken on this host, can end with a '*' to match as only a prefix",
+	)
+	listCmd.Flags().BoolVar(
+		&listIndex,
+		"index",
+		false,
+		"Read the index kept for each volume by the send command instead of every manifest. Volumes without an index are not listed.",
+	)
 }
 
 func validateListFlags(cmd *cobra.Command, args []string) error {
@@ -98,6 +145,11 @@ func validateListFlags(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if listIndex && (history || listLong || superseded) {
+		log.AppLogger.Errorf("The --index option cannot be used along with the --history, --long, or --showSupersededManifests options.")
+		return errInvalidInput
+	}
+
 	if beforeStr != "" {
 		parsed, perr := time.ParseInLocation(time.RFC3339[:19], beforeStr, time.Local)
 		if perr != nil {
@@ -126,4 +178,10 @@ func ResetListJobInfo() {
 	afterStr = ""
 	before = time.Time{}
 	after = time.Time{}
+	history = false
+	listLong = false
+	listTags = nil
+	listIndex = false
+	listHost = ""
+	superseded = false
 }
@@ -0,0 +1,106 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+)
+
+var manifestVolumeName string
+
+// manifestCmd represents the manifest command
+var manifestCmd = &cobra.Command{
+	Use:   "manifest",
+	Short: "manifest will export the manifests of a target to a local bundle, or import them to another target.",
+	Long: `manifest will export the manifests of a target to a local bundle, or import them to another target.
+Use it to catalog backups offline, or to seed the manifests onto a new target when moving the volumes to another
+provider.`,
+}
+
+// manifestExportCmd represents the manifest export command
+var manifestExportCmd = &cobra.Command{
+	Use:   "export [flags] target_uri bundle_path",
+	Short: "export will write the manifests found in the target to a local bundle.",
+	Long: `export will write the manifests found in the target to a tar archive at the bundle path, as they are stored
+in the target, still encrypted and signed. Use the --volumeName flag to only export the manifests of a volume. The
+manifests are read to select them, so the keys used to read them are needed.`,
+	SilenceErrors: true,
+	PreRunE:       validateManifestExportFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.ExportManifests(cmd.Context(), &jobInfo, args[0], manifestVolumeName, args[1])
+	},
+}
+
+// manifestImportCmd represents the manifest import command
+var manifestImportCmd = &cobra.Command{
+	Use:   "import [flags] bundle_path target_uri",
+	Short: "import will upload the manifests of a local bundle to the target.",
+	Long: `import will upload the manifests of a bundle written by export to the target, under the same names. Every
+manifest is read, and its signature checked, before any is uploaded, and manifests the target already holds are left
+alone. Only the manifests are imported, the volumes they reference must be copied to the target separately.`,
+	SilenceErrors: true,
+	PreRunE:       validateManifestImportFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.ImportManifests(cmd.Context(), &jobInfo, args[1], args[0])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(manifestCmd)
+	manifestCmd.AddCommand(manifestExportCmd)
+	manifestCmd.AddCommand(manifestImportCmd)
+
+	manifestExportCmd.Flags().StringVar(
+		&manifestVolumeName,
+		"volumeName",
+		"",
+		"Filter results to only this volume name, can end with a '*' to match as only a prefix",
+	)
+	_ = manifestExportCmd.RegisterFlagCompletionFunc("volumeName", completeTargetVolumes)
+}
+
+func validateManifestExportFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args[:1])
+}
+
+func validateManifestImportFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args[1:])
+}
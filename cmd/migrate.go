@@ -0,0 +1,69 @@
+// Copyright © 2017 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+)
+
+var migrateDryRun bool
+
+// migrateManifestsCmd represents the migrate-manifests command
+var migrateManifestsCmd = &cobra.Command{
+	Use:   "migrate-manifests [flags] target_uri",
+	Short: "migrate-manifests will upgrade the manifests in the target to the current schema version.",
+	Long: `migrate-manifests will upgrade the manifests in the target written by older releases to the current schema
+version, replacing them in place. Manifests of older schema versions can still be read without migrating them, this
+only saves newer releases from having to understand them. The manifests are encrypted and signed again with the keys
+provided, so the private keys are needed.`,
+	SilenceErrors: true,
+	PreRunE:       validateMigrateManifestsFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobInfo.Destinations = []string{args[0]}
+		return backup.MigrateManifests(cmd.Context(), &jobInfo, args[0], migrateDryRun)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(migrateManifestsCmd)
+
+	migrateManifestsCmd.Flags().BoolVar(
+		&migrateDryRun,
+		"dryRun",
+		false,
+		"report the manifests that would be migrated without replacing them.",
+	)
+}
+
+func validateMigrateManifestsFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadConsolidateKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args)
+}
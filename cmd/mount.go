@@ -0,0 +1,61 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+)
+
+// mountCmd represents the mount command
+var mountCmd = &cobra.Command{
+	Use:   "mount [flags] uri mountpoint",
+	Short: "mount will mount a read-only view of every backup set found in the target using FUSE.",
+	Long: `mount will mount a read-only view of every backup set found in the target using FUSE.
+Each dataset is a directory, nested under the directory of its parent dataset, holding a directory per backup set
+named after its snapshot (or the range of snapshots of an incremental backup set) starting with an @. The directory
+of a backup set holds its manifest as manifest.json and its reassembled zfs send stream as stream.zfs, e.g. to be
+piped to zfs receive. The volumes of a stream are downloaded, checked and decrypted only when it is read. The
+command runs until the mountpoint is unmounted or it is interrupted. Only available on Linux and macOS.`,
+	SilenceErrors: true,
+	PreRunE:       validateMountFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Mount(cmd.Context(), &jobInfo, args[0], args[1])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mountCmd)
+}
+
+func validateMountFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args[:1])
+}
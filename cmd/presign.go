@@ -0,0 +1,98 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// Pre-signed URLs signed with AWS Signature Version 4 (and GCS V4 signing) cannot be valid for more than 7 days.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+var presignExpiry time.Duration
+
+// presignCmd represents the presign command
+var presignCmd = &cobra.Command{
+	Use:   "presign [flags] volume@snapshot uri",
+	Short: "presign will output time-limited URLs for the manifest and volumes of a backup set.",
+	Long: `presign will output time-limited URLs for the manifest and volumes of a backup set.
+URLs are also output for every backup set it is incremental from, back to its full backup, so the whole
+chain can be restored. The URLs can be handed to another machine, or a colleague, to perform a restore
+without distributing cloud credentials. Download each object into a directory using the object name
+provided and then restore from it using a file:// target.`,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes),
+	PreRunE:           validatePresignFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Presign(cmd.Context(), &jobInfo, presignExpiry)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(presignCmd)
+
+	presignCmd.Flags().DurationVar(
+		&presignExpiry,
+		"expires",
+		24*time.Hour,
+		"how long the generated URLs should remain valid for. Cannot exceed 7 days.",
+	)
+	presignCmd.Flags().StringVarP(
+		&jobInfo.IncrementalSnapshot.Name,
+		"incremental",
+		"i",
+		"",
+		"Used to specify the snapshot the backup set is incremental from when more than one backup set exists for the snapshot.",
+	)
+}
+
+func validatePresignFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	if err := parseBackupSet(args[0]); err != nil {
+		return err
+	}
+
+	if presignExpiry <= 0 || presignExpiry > maxPresignExpiry {
+		log.AppLogger.Errorf("The expires option must be greater than 0 and no more than %v, was given %v", maxPresignExpiry, presignExpiry)
+		return errInvalidInput
+	}
+
+	if _, err := backends.GetBackendForURI(args[1]); err != nil {
+		log.AppLogger.Errorf("Invalid target URI, was given %s", args[1])
+		return errInvalidInput
+	}
+	jobInfo.Destinations = []string{args[1]}
+
+	return nil
+}
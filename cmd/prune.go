@@ -0,0 +1,94 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	pruneVolumeName string
+	prunePolicy     backup.RetentionPolicy
+	pruneDryRun     bool
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune [flags] target_uri",
+	Short: "prune will delete the backup sets in the target that are expired under a grandfather-father-son retention policy.",
+	Long: `prune will delete the backup sets in the target that are expired under a grandfather-father-son retention policy.
+The latest backup set of each of the most recent days, weeks, and months that have one is kept, as set by the
+--keepDaily, --keepWeekly, and --keepMonthly options, using the creation time of the snapshot backed up. The latest
+backup set of each volume is always kept, and so is every backup set a kept backup set depends on, so incremental
+chains are never broken. The manifests of the expired backup sets are deleted first, then the volumes no remaining
+backup set references. Use the --dryRun flag to only report what would be kept and pruned.`,
+	SilenceErrors: true,
+	PreRunE:       validatePruneFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobInfo.Destinations = []string{args[0]}
+		return backup.Prune(cmd.Context(), &jobInfo, args[0], pruneVolumeName, prunePolicy, pruneDryRun)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().StringVar(
+		&pruneVolumeName,
+		"volumeName",
+		"",
+		"Only prune the backup sets of this volume name, can end with a '*' to match as only a prefix",
+	)
+	_ = pruneCmd.RegisterFlagCompletionFunc("volumeName", completeTargetVolumes)
+	pruneCmd.Flags().IntVar(&prunePolicy.KeepDaily, "keepDaily", 0, "keep the latest backup set of this many of the most recent days.")
+	pruneCmd.Flags().IntVar(&prunePolicy.KeepWeekly, "keepWeekly", 0, "keep the latest backup set of this many of the most recent weeks.")
+	pruneCmd.Flags().IntVar(&prunePolicy.KeepMonthly, "keepMonthly", 0, "keep the latest backup set of this many of the most recent months.")
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dryRun", false, "report the backup sets that would be kept and pruned without deleting anything.")
+	pruneCmd.Flags().StringVar(&jobInfo.HoldTag, "holdTag", "",
+		"release the zfs hold with the given tag from the local snapshots of the backup sets pruned.",
+	)
+}
+
+func validatePruneFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if prunePolicy.KeepDaily < 0 || prunePolicy.KeepWeekly < 0 || prunePolicy.KeepMonthly < 0 {
+		log.AppLogger.Errorf("The number of backup sets to keep cannot be negative.")
+		return errInvalidInput
+	}
+
+	if prunePolicy.KeepDaily == 0 && prunePolicy.KeepWeekly == 0 && prunePolicy.KeepMonthly == 0 {
+		log.AppLogger.Errorf("At least one of --keepDaily, --keepWeekly, or --keepMonthly must be provided.")
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args)
+}
@@ -23,31 +23,68 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"os"
+	"path"
 	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 
-	"github.com/jdfalk/zfsbackup-go/backends"
 	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/files"
 	"github.com/jdfalk/zfsbackup-go/log"
 	"github.com/jdfalk/zfsbackup-go/zfs"
 )
 
+var (
+	// Resolve and validate the restore without downloading or receiving anything
+	receiveDryRun    bool
+	maxDownloadSpeed uint64
+	// The ssh://[user@]host[:port] URI of the host to receive on
+	receiveRemote string
+	// Restore into a temporary dataset, checked by the hook, before it replaces the local volume
+	receiveSandbox bool
+	sandboxHook    string
+	// Write the files of the snapshot restored to a tar archive
+	receiveTar string
+)
+
 // receiveCmd represents the receive command
 var receiveCmd = &cobra.Command{
-	Use:     "receive [flags] filesystem|volume|snapshot-to-restore uri local_volume",
-	Short:   "receive will restore a snapshot of a ZFS volume similar to how the \"zfs recv\" command works.",
-	Long:    `receive will restore a snapshot of a ZFS volume similar to how the "zfs recv" command works.`,
-	PreRunE: validateReceiveFlags,
+	Use:   "receive [flags] filesystem|volume|snapshot-to-restore uri [local_volume]",
+	Short: "receive will restore a snapshot of a ZFS volume similar to how the \"zfs recv\" command works.",
+	Long: `receive will restore a snapshot of a ZFS volume similar to how the "zfs recv" command works.
+When the backup exists in multiple targets, provide them as a comma separated list in order of preference.
+Each volume is downloaded from the first target that can provide it, falling back to the next target when
+a download fails. Append ?priority=N to a target URI to move it ahead of targets with a lower priority.
+With the --toFile option, the local_volume is omitted and the zfs stream of each backup set is written to a
+file in the directory provided instead of being received.`,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes, nil, completeLocalDatasets),
+	PreRunE:           validateReceiveFlags,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		log.AppLogger.Infof("Limiting the number of active files to %d", jobInfo.MaxFileBuffer)
 
-		if jobInfo.AutoRestore {
-			return backup.AutoRestore(cmd.Context(), &jobInfo)
+		if receiveDryRun {
+			return backup.RestoreDryRun(cmd.Context(), &jobInfo)
+		}
+		if jobInfo.Recursive || isVolumePattern(jobInfo.VolumeName) {
+			return backup.RestoreRecursive(cmd.Context(), &jobInfo)
+		}
+
+		var err error
+		switch {
+		case receiveSandbox:
+			err = backup.SandboxRestore(cmd.Context(), &jobInfo, sandboxHook)
+		case jobInfo.AutoRestore:
+			err = backup.AutoRestore(cmd.Context(), &jobInfo)
+		default:
+			err = backup.Receive(cmd.Context(), &jobInfo)
+		}
+		if err != nil || receiveTar == "" {
+			return err
 		}
-		return backup.Receive(cmd.Context(), &jobInfo)
+		return backup.WriteTar(cmd.Context(), &jobInfo, receiveTar)
 	},
 }
 
@@ -62,6 +99,21 @@ func init() {
 		"Automatically restore to the snapshot provided, or to the latest snapshot of the volume provided, cannot be "+
 			"used with the --incremental flag.",
 	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.FullOnly,
+		"fullOnly",
+		false,
+		"Restore only the most recent full backup, up to the snapshot provided, skipping the incremental backups after "+
+			"it. Useful to quickly stand up an approximate copy when the incremental chain is suspect. Must be used with "+
+			"the --auto flag.",
+	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.Recursive,
+		"recursive",
+		false,
+		"Automatically restore the volume provided along with every volume backed up beneath it, recreating the "+
+			"hierarchy beneath the local volume. Must be used with the --auto flag.",
+	)
 	receiveCmd.Flags().BoolVarP(
 		&jobInfo.FullPath,
 		"fullPath",
@@ -82,6 +134,13 @@ func init() {
 		false,
 		"See the -F flag for zfs recv for more information.",
 	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.AssumeYes,
+		"yes",
+		false,
+		"Proceed without asking for confirmation when the -F flag would roll back or destroy data on the local volume, "+
+			"such as snapshots taken after the one restored from or changes written since its latest snapshot.",
+	)
 	receiveCmd.Flags().BoolVarP(
 		&jobInfo.NotMounted,
 		"unmounted",
@@ -89,6 +148,86 @@ func init() {
 		false,
 		"See the -u flag for zfs recv for more information.",
 	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.NotMounted,
+		"noMount",
+		false,
+		"Do not mount the restored filesystems, so restores on servers with conflicting mountpoint properties do not mount "+
+			"over live paths. Same as the -u/--unmounted flag.",
+	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.AbortPartial,
+		"abortPartial",
+		false,
+		"Discard the state left on the local volume by an interrupted resumable receive (zfs receive -s) before "+
+			"restoring, see the -A flag on zfs recv for more information.",
+	)
+	receiveCmd.Flags().StringVar(
+		&jobInfo.ToFile,
+		"toFile",
+		"",
+		"Write the zfs stream of each backup set restored to a file in the directory provided, instead of receiving it, so "+
+			"it can be staged or inspected without the destination pool. With the --auto flag, every stream of the chain is "+
+			"written. The local_volume argument must be omitted and the zfs recv options cannot be used.",
+	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.Verify,
+		"verify",
+		false,
+		"Check the zfs stream extracted from every volume against the SHA256 digest recorded when it was backed up, and "+
+			"the guid of each snapshot received against the guid of the snapshot backed up.",
+	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.LoadKey,
+		"loadKey",
+		false,
+		"Load the key of a natively encrypted dataset restored from a raw send (zfs load-key) once it is received, so "+
+			"it can be used right away. The key is read from the keylocation of its encryption root, prompting for it when "+
+			"the keylocation is prompt.",
+	)
+	receiveCmd.Flags().StringVar(
+		&jobInfo.KeyLocation,
+		"keyLocation",
+		"",
+		"Set the keylocation of the encryption root of a natively encrypted dataset once it is received, e.g. "+
+			"file:///etc/zfs/keys/tank.key or prompt. Used by --loadKey and when loading the key later.",
+	)
+	receiveCmd.Flags().BoolVar(
+		&jobInfo.RestoreProperties,
+		"restoreProperties",
+		false,
+		"Set the properties recorded on the volume when it was backed up on the volume once it is received, except those "+
+			"excluded with -x and those that can only be set when a volume is created (e.g. encryption, volsize).",
+	)
+	receiveCmd.Flags().BoolVar(
+		&receiveSandbox,
+		"sandbox",
+		false,
+		"Restore into a temporary dataset next to the local_volume, run the --sandboxHook against it, and only then rename "+
+			"it to the local_volume. An existing local_volume is only replaced with the -F flag and is kept under a new name.",
+	)
+	receiveCmd.Flags().StringVar(
+		&sandboxHook,
+		"sandboxHook",
+		"",
+		"A shell command to verify the sandboxed restore with, the restore is only renamed to the local_volume if it exits "+
+			"successfully. The ZFSBACKUP_SANDBOX and ZFSBACKUP_TARGET environment variables hold the dataset names.",
+	)
+	receiveCmd.Flags().StringVar(
+		&receiveTar,
+		"tar",
+		"",
+		"Once restored, write the files of the snapshot to a tar archive at the path provided, or to stdout for -, so "+
+			"they can be copied to a system without ZFS. The snapshot is cloned to a temporary mountpoint to read its files.",
+	)
+	receiveCmd.Flags().StringVar(
+		&receiveRemote,
+		"remote",
+		"",
+		"Receive on another machine by piping the stream into zfs receive over SSH, provided as ssh://[user@]host[:port]. "+
+			"The downloads and decryption happen locally while every zfs and zpool command of the restore runs on the remote "+
+			"host, which must allow key based logins.",
+	)
 	receiveCmd.Flags().StringVarP(
 		&jobInfo.Origin,
 		"origin",
@@ -96,6 +235,14 @@ func init() {
 		"",
 		"See the -o flag on zfs recv for more information.",
 	)
+	receiveCmd.Flags().StringSliceVarP(
+		&jobInfo.ExcludeProperties,
+		"excludeProperty",
+		"x",
+		nil,
+		"Exclude the property from the stream so the restored datasets inherit it or keep their default instead, e.g. "+
+			"-x mountpoint -x sharenfs. Can be repeated. See the -x flag on zfs recv for more information.",
+	)
 	receiveCmd.Flags().StringVarP(
 		&jobInfo.IncrementalSnapshot.Name,
 		"incremental",
@@ -103,6 +250,28 @@ func init() {
 		"",
 		"Used to specify the snapshot target to restore from.",
 	)
+	receiveCmd.Flags().StringVar(
+		&jobInfo.ManifestVersion,
+		"manifestVersion",
+		"",
+		"Restore using a previous version of the manifest, as shown by the list --history command. Requires a target with "+
+			"versioning enabled and cannot be used with the --auto flag.",
+	)
+	receiveCmd.Flags().BoolVar(
+		&receiveDryRun,
+		"dryRun",
+		false,
+		"Resolve the backup sets the restore needs, in order, check every volume they need can be found in one of the "+
+			"targets, and show the restore plan without downloading or receiving anything.",
+	)
+	receiveCmd.Flags().BoolVar(
+		&config.ShowProgress,
+		"progress",
+		false,
+		"Display the progress of the restore (bytes received, download rate, ETA, and the volumes being downloaded or "+
+			"received). The progress is redrawn in place on a terminal and logged periodically otherwise, or written to stderr "+
+			"as JSON lines with the --jsonOutput option.",
+	)
 	receiveCmd.Flags().IntVar(
 		&jobInfo.MaxFileBuffer,
 		"maxFileBuffer",
@@ -111,6 +280,12 @@ func init() {
 			"of max parallel uploads. Set to 0 to bypass local storage and upload straight to your destination - this will "+
 			"limit you to a single destination and disable any hash checks for the upload where available.",
 	)
+	receiveCmd.Flags().Uint64Var(
+		&maxDownloadSpeed,
+		"maxDownloadSpeed",
+		0,
+		"the maximum download speed (in KB/s) the program should use between all download workers. Use 0 for no limit",
+	)
 	receiveCmd.Flags().DurationVar(
 		&jobInfo.MaxRetryTime,
 		"maxRetryTime",
@@ -129,17 +304,43 @@ func init() {
 		"|",
 		"the separator to use between object component names (used only for the initial manifest we are looking for).",
 	)
+	receiveCmd.Flags().StringVar(
+		&jobInfo.Decompressor,
+		"decompressor",
+		"",
+		"the command line of the external decompressor to use instead of the one recorded in the manifest, e.g. when the "+
+			"binary is installed elsewhere on this host. It must read the compressed stream from stdin and write to stdout.",
+	)
 }
 
 // ResetReceiveJobInfo exists solely for integration testing
 func ResetReceiveJobInfo() {
 	resetRootFlags()
 	jobInfo.AutoRestore = false
+	jobInfo.FullOnly = false
+	jobInfo.Recursive = false
 	jobInfo.FullPath = false
 	jobInfo.LastPath = false
 	jobInfo.Force = false
+	jobInfo.AssumeYes = false
 	jobInfo.NotMounted = false
+	jobInfo.AbortPartial = false
+	jobInfo.ToFile = ""
+	jobInfo.Verify = false
+	jobInfo.Decompressor = ""
+	receiveDryRun = false
+	maxDownloadSpeed = 0
+	receiveRemote = ""
+	receiveSandbox = false
+	sandboxHook = ""
+	receiveTar = ""
+	_ = zfs.SetRemote("")
 	jobInfo.Origin = ""
+	jobInfo.ExcludeProperties = nil
+	jobInfo.LoadKey = false
+	jobInfo.KeyLocation = ""
+	jobInfo.RestoreProperties = false
+	jobInfo.ManifestVersion = ""
 	jobInfo.BaseSnapshot = files.SnapshotInfo{}
 	jobInfo.IncrementalSnapshot = files.SnapshotInfo{}
 	jobInfo.MaxFileBuffer = 5
@@ -148,8 +349,39 @@ func ResetReceiveJobInfo() {
 	jobInfo.Separator = "|"
 }
 
+// isVolumePattern returns true if the volume to restore is a glob pattern matching several volumes.
+func isVolumePattern(volume string) bool {
+	return strings.ContainsAny(volume, "*?[")
+}
+
 // nolint:gocyclo // Will do later
 func validateReceiveFlags(cmd *cobra.Command, args []string) error {
+	if jobInfo.ToFile != "" {
+		if len(args) != 2 {
+			log.AppLogger.Errorf("The --toFile option writes the stream to a file, do not provide a local_volume.")
+			_ = cmd.Usage()
+			return errInvalidInput
+		}
+		if jobInfo.FullPath || jobInfo.LastPath || jobInfo.Force || jobInfo.NotMounted || jobInfo.Origin != "" ||
+			jobInfo.AbortPartial || len(jobInfo.ExcludeProperties) > 0 || jobInfo.LoadKey || jobInfo.KeyLocation != "" ||
+			jobInfo.RestoreProperties {
+			log.AppLogger.Errorf(
+				"The zfs recv options (-d, -e, -F, -u, -o, -x, --abortPartial, --loadKey, --keyLocation, --restoreProperties) " +
+					"cannot be used with the --toFile option.",
+			)
+			return errInvalidInput
+		}
+		if receiveRemote != "" {
+			log.AppLogger.Errorf("The --remote option cannot be used with the --toFile option.")
+			return errInvalidInput
+		}
+		if dir, err := os.Stat(jobInfo.ToFile); err != nil || !dir.IsDir() {
+			log.AppLogger.Errorf("The --toFile option must be an existing directory, was given %s", jobInfo.ToFile)
+			return errInvalidInput
+		}
+		args = append(args, "")
+	}
+
 	if len(args) != 3 {
 		_ = cmd.Usage()
 		return errInvalidInput
@@ -159,6 +391,11 @@ func validateReceiveFlags(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if err := zfs.SetRemote(receiveRemote); err != nil {
+		log.AppLogger.Errorf("Invalid --remote option provided - %v", err)
+		return errInvalidInput
+	}
+
 	jobInfo.StartTime = time.Now()
 
 	parts := strings.Split(args[0], "@")
@@ -184,10 +421,92 @@ func validateReceiveFlags(cmd *cobra.Command, args []string) error {
 		return errInvalidInput
 	}
 
+	if jobInfo.FullOnly && !jobInfo.AutoRestore {
+		log.AppLogger.Errorf("The --fullOnly option can only be used with the --auto option.")
+		return errInvalidInput
+	}
+
+	if jobInfo.Recursive && !jobInfo.AutoRestore {
+		log.AppLogger.Errorf("The --recursive option can only be used with the --auto option.")
+		return errInvalidInput
+	}
+
+	if jobInfo.Recursive && receiveDryRun {
+		log.AppLogger.Errorf("The --dryRun option cannot be used with the --recursive option.")
+		return errInvalidInput
+	}
+
+	if isVolumePattern(jobInfo.VolumeName) {
+		if !jobInfo.AutoRestore || jobInfo.FullPath || jobInfo.LastPath || receiveDryRun || receiveSandbox {
+			log.AppLogger.Errorf(
+				"A volume pattern such as %s must be used with the --auto option, and cannot be used with -d, -e, --dryRun, or --sandbox.",
+				jobInfo.VolumeName,
+			)
+			return errInvalidInput
+		}
+		if _, err := path.Match(jobInfo.VolumeName, ""); err != nil {
+			log.AppLogger.Errorf("Invalid volume pattern %s provided - %v", jobInfo.VolumeName, err)
+			return errInvalidInput
+		}
+	}
+
+	if jobInfo.KeyLocation != "" && jobInfo.KeyLocation != "prompt" && !strings.Contains(jobInfo.KeyLocation, "://") {
+		log.AppLogger.Errorf("Invalid keylocation provided, expected prompt or a URI such as file:///path/to/key, got %s", jobInfo.KeyLocation)
+		return errInvalidInput
+	}
+
+	if receiveTar != "" && (jobInfo.ToFile != "" || receiveRemote != "" || receiveDryRun || jobInfo.Recursive ||
+		isVolumePattern(jobInfo.VolumeName)) {
+		log.AppLogger.Errorf(
+			"The --tar option restores a single filesystem locally, it cannot be used with --toFile, --remote, --dryRun, " +
+				"--recursive, or a volume pattern.",
+		)
+		return errInvalidInput
+	}
+
+	if receiveTar != "" && receiveTar != "-" {
+		if _, err := os.Stat(receiveTar); err == nil {
+			log.AppLogger.Errorf("The tar archive %s already exists, it will not be overwritten.", receiveTar)
+			return errInvalidInput
+		}
+	}
+
+	if sandboxHook != "" && !receiveSandbox {
+		log.AppLogger.Errorf("The --sandboxHook option can only be used with the --sandbox option.")
+		return errInvalidInput
+	}
+
+	if sandboxHook != "" && receiveRemote != "" {
+		log.AppLogger.Errorf("The --sandboxHook option runs locally, it cannot verify a sandbox received on the --remote host.")
+		return errInvalidInput
+	}
+
+	if receiveSandbox && (jobInfo.ToFile != "" || jobInfo.Recursive || receiveDryRun) {
+		log.AppLogger.Errorf("The --sandbox option cannot be used with the --toFile, --recursive, or --dryRun options.")
+		return errInvalidInput
+	}
+
+	if receiveSandbox && (jobInfo.FullPath || jobInfo.LastPath || jobInfo.IncrementalSnapshot.Name != "") {
+		log.AppLogger.Errorf("The --sandbox option restores the whole backup into a new dataset, it cannot be used with -d, -e, or -i.")
+		return errInvalidInput
+	}
+
+	if jobInfo.AutoRestore && jobInfo.ManifestVersion != "" {
+		log.AppLogger.Errorf("Cannot request auto restore option and provide a manifest version to restore with.")
+		return errInvalidInput
+	}
+
 	// Remove 'origin=' from beginning of -o argument
 	jobInfo.Origin = strings.TrimPrefix(jobInfo.Origin, "origin=")
 
-	if !jobInfo.AutoRestore {
+	for _, prop := range jobInfo.ExcludeProperties {
+		if prop == "" || strings.ContainsAny(prop, "= ") {
+			log.AppLogger.Errorf("Invalid property provided to -x, expected a property name such as mountpoint, got %q instead", prop)
+			return errInvalidInput
+		}
+	}
+
+	if !jobInfo.AutoRestore && jobInfo.ToFile == "" {
 		// Let's see if we already have this snap shot
 		creationTime, err := zfs.GetCreationDate(context.TODO(), fmt.Sprintf("%s@%s", jobInfo.LocalVolume, jobInfo.BaseSnapshot.Name))
 		if err == nil {
@@ -203,16 +522,5 @@ func validateReceiveFlags(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	for _, destination := range jobInfo.Destinations {
-		_, err := backends.GetBackendForURI(destination)
-		if err == backends.ErrInvalidPrefix {
-			log.AppLogger.Errorf("Unsupported prefix provided in destination URI, was given %s", destination)
-			return errInvalidInput
-		} else if err == backends.ErrInvalidURI {
-			log.AppLogger.Errorf("Invalid destination URI, was given %s", destination)
-			return errInvalidInput
-		}
-	}
-
-	return nil
+	return validateTargetURIs(jobInfo.Destinations)
 }
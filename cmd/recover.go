@@ -0,0 +1,70 @@
+// Copyright © 2017 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+)
+
+var recoverDryRun bool
+
+// recoverManifestsCmd represents the recover-manifests command
+var recoverManifestsCmd = &cobra.Command{
+	Use:   "recover-manifests [flags] target_uri",
+	Short: "recover-manifests will replace the manifests in the target that cannot be read with a superseded generation.",
+	Long: `recover-manifests will read every manifest in the target and replace those that cannot be read, e.g. because
+they were corrupted or only partially written, with their latest superseded generation that can be read. Generations
+are kept when a manifest is written again, see the --manifestGenerations option. Only the keys needed to read the
+manifests are required, as the generations are restored as they were written without encrypting or signing them
+again.`,
+	SilenceErrors: true,
+	PreRunE:       validateRecoverManifestsFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobInfo.Destinations = []string{args[0]}
+		return backup.RecoverManifests(cmd.Context(), &jobInfo, args[0], recoverDryRun)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(recoverManifestsCmd)
+
+	recoverManifestsCmd.Flags().BoolVar(
+		&recoverDryRun,
+		"dryRun",
+		false,
+		"report the manifests that would be recovered without replacing them.",
+	)
+}
+
+func validateRecoverManifestsFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args)
+}
@@ -0,0 +1,203 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	rekeyFrom          files.JobInfo
+	oldAgeIdentityFile string
+)
+
+// rekeyCmd represents the rekey command
+var rekeyCmd = &cobra.Command{
+	Use:   "rekey [flags] filesystem|volume[@snapshot] target_uri",
+	Short: "rekey will encrypt the backups of a volume again with new keys.",
+	Long: `rekey will encrypt the backups of a volume (or only the backup sets of the snapshot provided) in the target
+again with new keys. Each volume is downloaded, decrypted with the old keys, and uploaded encrypted with the new keys
+given with the usual encryptTo, signFrom, ageRecipient, or kmsKey options. The manifest of a backup set is replaced
+once all of its volumes were uploaded, and the old volumes are deleted once every backup set was rekeyed.`,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes),
+	PreRunE:           validateRekeyFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Rekey(cmd.Context(), &jobInfo, &rekeyFrom, args[1])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rekeyCmd)
+
+	rekeyCmd.Flags().StringVar(
+		&rekeyFrom.EncryptTo,
+		"oldEncryptTo",
+		"",
+		"the email of the user the backups are currently encrypted to. The private key must be in the secret keyring.",
+	)
+	rekeyCmd.Flags().StringVar(
+		&rekeyFrom.SignFrom,
+		"oldSignFrom",
+		"",
+		"the email of the user the backups are currently signed from. The public key must be in the public keyring.",
+	)
+	rekeyCmd.Flags().StringVar(
+		&oldAgeIdentityFile,
+		"oldAgeIdentityFile",
+		"",
+		"the path to the age identity file the backups are currently encrypted to.",
+	)
+	rekeyCmd.Flags().IntVar(
+		&jobInfo.MaxParallelUploads,
+		"maxParallelUploads",
+		4,
+		"the maximum number of volumes to rekey in parallel.",
+	)
+	rekeyCmd.Flags().Uint64Var(
+		&maxDownloadSpeed,
+		"maxDownloadSpeed",
+		0,
+		"the maximum speed (in KB/s) to download volumes at, between all workers. Use 0 for no limit",
+	)
+	rekeyCmd.Flags().DurationVar(
+		&jobInfo.MaxRetryTime,
+		"maxRetryTime",
+		12*time.Hour,
+		"the maximum time that can elapse when retrying a failed rekey. Use 0 for no limit.",
+	)
+	rekeyCmd.Flags().DurationVar(
+		&jobInfo.MaxBackoffTime,
+		"maxBackoffTime",
+		30*time.Minute,
+		"the maximum delay you'd want a worker to sleep before retrying a rekey.",
+	)
+	rekeyCmd.Flags().IntVar(
+		&jobInfo.UploadChunkSize,
+		"uploadChunkSize",
+		10,
+		"the chunk size, in MiB, to use when uploading. A minimum of 5MiB and maximum of 100MiB is enforced.",
+	)
+}
+
+// ResetRekeyJobInfo exists solely for integration testing
+func ResetRekeyJobInfo() {
+	resetRootFlags()
+	rekeyFrom = files.JobInfo{}
+	oldAgeIdentityFile = ""
+	jobInfo.BaseSnapshot = files.SnapshotInfo{}
+	jobInfo.MaxParallelUploads = 4
+	maxDownloadSpeed = 0
+	jobInfo.MaxRetryTime = 12 * time.Hour
+	jobInfo.MaxBackoffTime = 30 * time.Minute
+	jobInfo.UploadChunkSize = 10
+}
+
+// nolint:gocyclo // Mostly flag checks
+func validateRekeyFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if jobInfo.EncryptTo == "" && jobInfo.SignFrom == "" && len(jobInfo.AgeRecipients) == 0 && len(jobInfo.KMSKeys) == 0 {
+		log.AppLogger.Errorf("You must provide the new keys to use with the encryptTo, signFrom, ageRecipient, or kmsKey options")
+		return errInvalidInput
+	}
+
+	if err := loadSendKeys(); err != nil {
+		return err
+	}
+
+	if err := loadOldKeys(); err != nil {
+		return err
+	}
+
+	if err := parseRekeySet(args[0]); err != nil {
+		return err
+	}
+
+	if jobInfo.MaxParallelUploads <= 0 {
+		log.AppLogger.Errorf("The number of parallel uploads must be set to a value greater than 0. Was given %d", jobInfo.MaxParallelUploads)
+		return errInvalidInput
+	}
+
+	return validateTargetURIs(args[1:])
+}
+
+// loadOldKeys loads the keys the backups are currently encrypted and signed with. Backups whose data key is wrapped
+// by a key management service need none, the key is unwrapped with the service instead.
+func loadOldKeys() error {
+	if oldAgeIdentityFile != "" {
+		if rekeyFrom.EncryptTo != "" {
+			log.AppLogger.Errorf("The oldAgeIdentityFile option cannot be used along with the oldEncryptTo option")
+			return errInvalidInput
+		}
+		var err error
+		if rekeyFrom.AgeIdentities, err = parseAgeIdentities(oldAgeIdentityFile); err != nil {
+			return err
+		}
+	}
+
+	if jobInfo.GPGAgent {
+		rekeyFrom.GPGAgent = true
+		return nil
+	}
+
+	if rekeyFrom.EncryptTo != "" {
+		if secretKeyRingPath == "" {
+			log.AppLogger.Errorf("You must specify a secret keyring path if you provide an oldEncryptTo option")
+			return errInvalidInput
+		}
+		var err error
+		if rekeyFrom.EncryptKey, err = getAndDecryptPrivateKey(rekeyFrom.EncryptTo); err != nil {
+			return err
+		}
+	}
+
+	if rekeyFrom.SignFrom != "" {
+		if publicKeyRingPath == "" && !fetchKeys {
+			log.AppLogger.Errorf("You must specify a public keyring path, or the fetchKeys option, if you provide an oldSignFrom option")
+			return errInvalidInput
+		}
+		var err error
+		if rekeyFrom.SignKey, err = getPublicKey(rekeyFrom.SignFrom); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseRekeySet will populate the jobInfo with the volume, and the snapshot if provided.
+func parseRekeySet(arg string) error {
+	if !strings.Contains(arg, "@") {
+		jobInfo.VolumeName = arg
+		return nil
+	}
+	return parseBackupSet(arg)
+}
@@ -0,0 +1,120 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	replicateVolumeGlob string
+	replicateDryRun     bool
+	replicatePending    bool
+)
+
+// replicateCmd represents the replicate command
+var replicateCmd = &cobra.Command{
+	Use:   "replicate [flags] source_uri destination_uri|--pending source_uri",
+	Short: "replicate will recreate every backup set found in the source target in the destination target.",
+	Long: `replicate will recreate every backup set found in the source target in the destination target.
+Use this for one-time migrations between providers. Volumes are copied before the manifest describing them
+so partially replicated backup sets are never visible in the destination. Objects already present and intact
+in the destination are skipped, so an interrupted replication can be resumed by running the same command again.
+
+With the --pending option, every backup set in the source target that was sent with secondary targets is pushed
+to the targets still pending in its manifest instead, and the manifest in the source target is updated as each
+target completes.`,
+	PreRunE: validateReplicateFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if replicatePending {
+			return backup.ReplicatePending(cmd.Context(), &jobInfo, args[0], replicateVolumeGlob, replicateDryRun)
+		}
+		return backup.Replicate(cmd.Context(), &jobInfo, args[0], args[1], replicateVolumeGlob, replicateDryRun)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(replicateCmd)
+
+	replicateCmd.Flags().StringVar(
+		&replicateVolumeGlob,
+		"volumeName",
+		"",
+		"only replicate backup sets for volumes matching this glob pattern (e.g. pool/data*). Replicates all backup sets by default.",
+	)
+	_ = replicateCmd.RegisterFlagCompletionFunc("volumeName", completeTargetVolumes)
+	replicateCmd.Flags().BoolVar(
+		&replicateDryRun,
+		"dryRun",
+		false,
+		"report the volumes and manifests that would be copied without copying anything.",
+	)
+	replicateCmd.Flags().BoolVar(
+		&replicatePending,
+		"pending",
+		false,
+		"push the backup sets in the source target to the secondary targets still pending in their manifests.",
+	)
+	replicateCmd.Flags().Uint64Var(
+		&maxDownloadSpeed,
+		"maxDownloadSpeed",
+		0,
+		"the maximum speed (in KB/s) to download volumes that cannot be copied server-side at, between all workers. Use 0 for no limit",
+	)
+	addTransferFlags(replicateCmd)
+}
+
+func validateReplicateFlags(cmd *cobra.Command, args []string) error {
+	expectedArgs := 2
+	if replicatePending {
+		expectedArgs = 1
+	}
+	if len(args) != expectedArgs {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	if _, err := path.Match(replicateVolumeGlob, ""); err != nil {
+		log.AppLogger.Errorf("Invalid volume name pattern provided, was given %s - %v", replicateVolumeGlob, err)
+		return errInvalidInput
+	}
+
+	if err := validateTransferFlags(); err != nil {
+		return err
+	}
+
+	if !replicatePending && strings.TrimRight(args[0], "/") == strings.TrimRight(args[1], "/") {
+		log.AppLogger.Errorf("The source and destination targets must be different.")
+		return errInvalidInput
+	}
+
+	return validateTargetURIs(args)
+}
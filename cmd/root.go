@@ -21,15 +21,19 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"time"
 
+	"filippo.io/age"
 	humanize "github.com/dustin/go-humanize"
 	"github.com/juju/ratelimit"
 	"github.com/op/go-logging"
@@ -37,8 +41,11 @@ import (
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/ssh/terminal"
 
+	"github.com/jdfalk/zfsbackup-go/backends"
+	"github.com/jdfalk/zfsbackup-go/backup"
 	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/files"
+	"github.com/jdfalk/zfsbackup-go/kms"
 	"github.com/jdfalk/zfsbackup-go/log"
 	"github.com/jdfalk/zfsbackup-go/pgp"
 	"github.com/jdfalk/zfsbackup-go/zfs"
@@ -49,8 +56,19 @@ var (
 	logLevel          string
 	secretKeyRingPath string
 	publicKeyRingPath string
+	ageIdentityFile   string
 	workingDirectory  string
-	errInvalidInput   = errors.New("invalid input")
+	// Where the passphrase of the secret keys is read from before prompting for it
+	keyPassphraseFile string
+	keyPassphraseEnv  string
+	// Fingerprints of the subkeys to encrypt and sign with instead of the ones openpgp would pick
+	encryptSubkey string
+	signSubkey    string
+	// Fetch the public keys missing from the public keyring with WKD or from the keyserver, pinning them once confirmed
+	fetchKeys       bool
+	keyserver       string
+	keyFingerprints []string
+	errInvalidInput = errors.New("invalid input")
 )
 
 // RootCmd represents the base command when called without any subcommands
@@ -74,10 +92,21 @@ destination of your choosing.`,
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute(ctx context.Context) {
 	if err := RootCmd.ExecuteContext(ctx); err != nil {
+		var exitCode exitCodeError
+		if errors.As(err, &exitCode) {
+			os.Exit(int(exitCode))
+		}
 		os.Exit(-1)
 	}
 }
 
+// exitCodeError is returned by commands that exit with a code of their own, e.g. the state of a monitoring check.
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit code %d", int(e))
+}
+
 func init() {
 	RootCmd.PersistentFlags().IntVar(
 		&numCores,
@@ -103,6 +132,18 @@ func init() {
 		"",
 		"the path to the PGP public key ring",
 	)
+	RootCmd.PersistentFlags().StringVar(
+		&keyPassphraseFile,
+		"keyPassphraseFile",
+		"",
+		"the path to a file holding the passphrase of the secret keys in the secret keyring.",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&keyPassphraseEnv,
+		"keyPassphraseEnv",
+		"PGP_PASSPHRASE",
+		"the environment variable holding the passphrase of the secret keys in the secret keyring, if keyPassphraseFile is not given.",
+	)
 	RootCmd.PersistentFlags().StringVar(
 		&workingDirectory,
 		"workingDirectory",
@@ -114,6 +155,13 @@ func init() {
 		"manifestPrefix",
 		"manifests", "the prefix to use for all manifest files.",
 	)
+	RootCmd.PersistentFlags().StringVar(
+		&jobInfo.ObjectPrefix,
+		"prefix",
+		defaultObjectPrefix(),
+		"the namespace to prefix all object names with so many hosts can share the same target. Defaults to the hostname, "+
+			"use an empty string to access backups made without a prefix.",
+	)
 	RootCmd.PersistentFlags().StringVar(
 		&jobInfo.EncryptTo,
 		"encryptTo",
@@ -126,19 +174,107 @@ func init() {
 		"",
 		"the email of the user to sign on behalf of from the provided private keyring.",
 	)
+	RootCmd.PersistentFlags().StringVar(
+		&encryptSubkey,
+		"encryptSubkey",
+		"",
+		"the fingerprint of the key or subkey of the encryptTo key to encrypt the data to, instead of its newest encryption subkey.",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&signSubkey,
+		"signSubkey",
+		"",
+		"the fingerprint of the key or subkey of the signFrom key to sign with, instead of its first signing subkey.",
+	)
+	RootCmd.PersistentFlags().BoolVar(
+		&fetchKeys,
+		"fetchKeys",
+		false,
+		"look up the public keys of encryptTo and signFrom missing from the public keyring with WKD, then on the keyServer, "+
+			"and pin them to the working directory once their fingerprint was confirmed.",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&keyserver,
+		"keyServer",
+		"",
+		"the keyserver (e.g. hkps://keys.openpgp.org) to look up public keys on with fetchKeys when WKD has none.",
+	)
+	RootCmd.PersistentFlags().StringSliceVar(
+		&keyFingerprints,
+		"keyFingerprint",
+		nil,
+		"the fingerprint expected of a key looked up with fetchKeys, to confirm it without being prompted. Can be given more than once.",
+	)
+	RootCmd.PersistentFlags().StringSliceVar(
+		&jobInfo.AgeRecipients,
+		"ageRecipient",
+		nil,
+		"the age public key (age1...) to encrypt the data to instead of using PGP. Can be given more than once.",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&ageIdentityFile,
+		"ageIdentityFile",
+		"",
+		"the path to the age identity file to decrypt data encrypted with age.",
+	)
+	RootCmd.PersistentFlags().BoolVar(
+		&jobInfo.GPGAgent,
+		"gpgAgent",
+		false,
+		"sign and decrypt with the keys held by gpg-agent (including smartcards) through the gpg executable instead of the keyrings.",
+	)
+	RootCmd.PersistentFlags().StringVar(
+		&pgp.GPGPath,
+		"gpgPath",
+		"gpg",
+		"the path to the gpg executable used with gpgAgent.",
+	)
+	RootCmd.PersistentFlags().StringSliceVar(
+		&jobInfo.KMSKeys,
+		"kmsKey",
+		nil,
+		"the key management service key (awskms://, gcpkms://, or azurekeyvault://) to wrap the data key of each backup with, "+
+			"instead of using PGP or age. Can be given more than once, e.g. once per target.",
+	)
 	RootCmd.PersistentFlags().StringVar(
 		&zfs.ZFSPath,
 		"zfsPath",
 		"zfs",
 		"the path to the zfs executable.",
 	)
+	RootCmd.PersistentFlags().StringVar(
+		&zfs.ZPoolPath,
+		"zpoolPath",
+		"zpool",
+		"the path to the zpool executable.",
+	)
+	RootCmd.PersistentFlags().BoolVar(
+		&config.FIPS,
+		"fips",
+		config.FIPS,
+		"only use FIPS approved algorithms (AES-256, SHA-2, RSA and ECDSA keys) and refuse to run with keys that are not. "+
+			"Cannot be disabled in builds with the fips tag.",
+	)
+	RootCmd.PersistentFlags().BoolVar(
+		&config.ManifestDB,
+		"manifestDB",
+		false,
+		"keep the manifests of each target, once decrypted and verified, in a database in the working directory so they are only "+
+			"read again when they change. Note the manifests are stored unencrypted.",
+	)
+	RootCmd.PersistentFlags().IntVar(
+		&config.ManifestGenerations,
+		"manifestGenerations",
+		3,
+		"the number of superseded generations of a manifest to keep when it is written again (e.g. by replicate, rekey, or "+
+			"migrate-manifests), so a corrupted manifest can be recovered. Use 0 to overwrite manifests in place.",
+	)
 	RootCmd.PersistentFlags().BoolVar(
 		&config.JSONOutput,
 		"jsonOutput",
 		false,
 		"dump results as a JSON string - on success only",
 	)
-	passphrase = []byte(os.Getenv("PGP_PASSPHRASE"))
 }
 
 func resetRootFlags() {
@@ -147,12 +283,37 @@ func resetRootFlags() {
 	logLevel = "notice"
 	secretKeyRingPath = ""
 	publicKeyRingPath = ""
+	ageIdentityFile = ""
+	keyPassphraseFile = ""
+	keyPassphraseEnv = "PGP_PASSPHRASE"
+	passphrase = nil
 	workingDirectory = "~/.zfsbackup"
 	jobInfo.ManifestPrefix = "manifests"
+	jobInfo.ObjectPrefix = defaultObjectPrefix()
 	jobInfo.EncryptTo = ""
 	jobInfo.SignFrom = ""
+	encryptSubkey = ""
+	signSubkey = ""
+	fetchKeys = false
+	keyserver = ""
+	keyFingerprints = nil
 	zfs.ZFSPath = "zfs"
+	zfs.ZPoolPath = "zpool"
+	pgp.GPGPath = "gpg"
 	config.JSONOutput = false
+	config.ManifestDB = false
+	config.ManifestGenerations = 3
+	config.ShowProgress = false
+	config.FIPS = config.FIPSBuild
+}
+
+// defaultObjectPrefix returns the hostname of this machine, or nothing if it cannot be determined.
+func defaultObjectPrefix() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
 }
 
 // nolint:gocyclo,funlen // Will do later
@@ -190,6 +351,10 @@ func processFlags(cmd *cobra.Command, args []string) error {
 	log.AppLogger.Infof("Setting number of cores to: %d", numCores)
 	runtime.GOMAXPROCS(numCores)
 
+	if err := checkFIPSOptions(); err != nil {
+		return err
+	}
+
 	if secretKeyRingPath != "" {
 		if err := pgp.LoadPrivateRing(secretKeyRingPath); err != nil {
 			log.AppLogger.Errorf("Could not load private keyring due to an error - %v", err)
@@ -214,6 +379,30 @@ func processFlags(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
+// checkFIPSOptions refuses the options relying on algorithms that are not FIPS approved when running in FIPS mode:
+// age uses X25519 and ChaCha20-Poly1305, as does the data key wrapped with kmsKey, and the keys gpg-agent holds
+// cannot be inspected.
+func checkFIPSOptions() error {
+	if !config.FIPS {
+		if config.FIPSBuild {
+			log.AppLogger.Errorf("FIPS mode cannot be disabled in this build")
+			return errInvalidInput
+		}
+		return nil
+	}
+	log.AppLogger.Infof("Running in FIPS mode, only FIPS approved algorithms will be used")
+
+	if len(jobInfo.AgeRecipients) > 0 || ageIdentityFile != "" || len(jobInfo.KMSKeys) > 0 || jobInfo.GPGAgent {
+		log.AppLogger.Errorf("The age, kmsKey, and gpgAgent options cannot be used in FIPS mode, use the PGP keyrings instead")
+		return errInvalidInput
+	}
+	if jobInfo.DigestAlgorithm == files.DigestBLAKE3 {
+		log.AppLogger.Errorf("The blake3 digest algorithm cannot be used in FIPS mode, use sha256 or sha512 instead")
+		return errInvalidInput
+	}
+	return nil
+}
+
 func getAndDecryptPrivateKey(email string) (*openpgp.Entity, error) {
 	var entity *openpgp.Entity
 	if entity = pgp.GetPrivateKeyByEmail(email); entity == nil {
@@ -222,7 +411,9 @@ func getAndDecryptPrivateKey(email string) (*openpgp.Entity, error) {
 	}
 
 	if entity.PrivateKey != nil && entity.PrivateKey.Encrypted {
-		validatePassphrase()
+		if err := validatePassphrase(); err != nil {
+			return nil, err
+		}
 		if err := entity.PrivateKey.Decrypt(passphrase); err != nil {
 			log.AppLogger.Errorf("Error decrypting private key: %v", err)
 			return nil, errInvalidInput
@@ -231,7 +422,9 @@ func getAndDecryptPrivateKey(email string) (*openpgp.Entity, error) {
 
 	for _, subkey := range entity.Subkeys {
 		if subkey.PrivateKey != nil && subkey.PrivateKey.Encrypted {
-			validatePassphrase()
+			if err := validatePassphrase(); err != nil {
+				return nil, err
+			}
 			if err := subkey.PrivateKey.Decrypt(passphrase); err != nil {
 				log.AppLogger.Errorf("Error decrypting subkey's private key: %v", err)
 				return nil, errInvalidInput
@@ -242,13 +435,217 @@ func getAndDecryptPrivateKey(email string) (*openpgp.Entity, error) {
 	return entity, nil
 }
 
+// loadAgeKeys parses the age recipients and identities provided, requiring the identities when needed to read back
+// what was encrypted to the recipients.
+func loadAgeKeys(needIdentities bool) error {
+	if len(jobInfo.AgeRecipients) == 0 && ageIdentityFile == "" {
+		return nil
+	}
+
+	// The signFrom key only signs the manifests then, which record the checksum of every volume
+	if jobInfo.EncryptTo != "" {
+		log.AppLogger.Errorf("The age options cannot be used along with the encryptTo option")
+		return errInvalidInput
+	}
+
+	for _, recipient := range jobInfo.AgeRecipients {
+		key, err := age.ParseX25519Recipient(recipient)
+		if err != nil {
+			log.AppLogger.Errorf("Could not parse the age recipient %s - %v", recipient, err)
+			return errInvalidInput
+		}
+		jobInfo.AgeRecipientKeys = append(jobInfo.AgeRecipientKeys, key)
+	}
+
+	if ageIdentityFile == "" {
+		if needIdentities {
+			log.AppLogger.Errorf("You must specify an age identity file to read back data encrypted with ageRecipient")
+			return errInvalidInput
+		}
+		return nil
+	}
+
+	var err error
+	jobInfo.AgeIdentities, err = parseAgeIdentities(ageIdentityFile)
+	return err
+}
+
+// parseAgeIdentities reads the age identities from the file provided.
+func parseAgeIdentities(path string) ([]age.Identity, error) {
+	identityFile, err := os.Open(path)
+	if err != nil {
+		log.AppLogger.Errorf("Could not open the age identity file due to an error - %v", err)
+		return nil, errInvalidInput
+	}
+	defer identityFile.Close()
+
+	identities, err := age.ParseIdentities(identityFile)
+	if err != nil {
+		log.AppLogger.Errorf("Could not parse the age identity file %s - %v", path, err)
+		return nil, errInvalidInput
+	}
+	log.AppLogger.Infof("Loaded %d age identities from %s", len(identities), path)
+
+	return identities, nil
+}
+
+// getPublicKey returns the public key for email from the public keyring, or else the key pinned for it or looked up
+// with fetchKeys.
+func getPublicKey(email string) (*openpgp.Entity, error) {
+	if key := pgp.GetPublicKeyByEmail(email); key != nil {
+		return key, nil
+	}
+	if !fetchKeys {
+		log.AppLogger.Errorf("Could not find public key for %s", email)
+		return nil, errInvalidInput
+	}
+
+	keysDir := filepath.Join(config.WorkingDir, "keys")
+	pinPath := filepath.Join(keysDir, strings.ToLower(email)+".asc")
+	if key, err := pgp.LoadPinnedKey(pinPath); err == nil {
+		fingerprint := fmt.Sprintf("%X", key.PrimaryKey.Fingerprint)
+		if len(keyFingerprints) > 0 && !expectedFingerprint(fingerprint) {
+			log.AppLogger.Errorf("The key pinned for %s in %s has the fingerprint %s, not the one expected", email, pinPath, fingerprint)
+			return nil, errInvalidInput
+		}
+		log.AppLogger.Infof("Using the key %s pinned for %s", fingerprint, email)
+		pgp.AddPublicKeys(openpgp.EntityList{key})
+		return key, nil
+	} else if !os.IsNotExist(err) {
+		log.AppLogger.Errorf("Could not read the key pinned for %s in %s - %v", email, pinPath, err)
+		return nil, errInvalidInput
+	}
+
+	keys, source, err := pgp.FetchPublicKey(RootCmd.Context(), email, keyserver)
+	if err != nil {
+		log.AppLogger.Errorf("Could not fetch the public key for %s - %v", email, err)
+		return nil, errInvalidInput
+	}
+	key, err := confirmFetchedKey(email, source, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(keysDir, 0o700); err != nil {
+		log.AppLogger.Errorf("Could not create the directory to pin keys to - %v", err)
+		return nil, err
+	}
+	if err = pgp.PinKey(pinPath, key); err != nil {
+		log.AppLogger.Errorf("Could not pin the key for %s to %s - %v", email, pinPath, err)
+		return nil, err
+	}
+	log.AppLogger.Noticef("Pinned the key %X for %s to %s.", key.PrimaryKey.Fingerprint, email, pinPath)
+	pgp.AddPublicKeys(openpgp.EntityList{key})
+
+	return key, nil
+}
+
+// confirmFetchedKey picks the key fetched for email whose fingerprint was given with keyFingerprint, or else asks
+// to confirm the fingerprint of the only key found on the terminal.
+func confirmFetchedKey(email, source string, keys openpgp.EntityList) (*openpgp.Entity, error) {
+	if len(keyFingerprints) > 0 {
+		for _, key := range keys {
+			if expectedFingerprint(fmt.Sprintf("%X", key.PrimaryKey.Fingerprint)) {
+				return key, nil
+			}
+		}
+		log.AppLogger.Errorf("None of the %d key(s) found for %s at %s have the fingerprint expected", len(keys), email, source)
+		return nil, errInvalidInput
+	}
+
+	if len(keys) != 1 {
+		log.AppLogger.Errorf("Found %d keys for %s at %s, use the keyFingerprint option to pick one", len(keys), email, source)
+		return nil, errInvalidInput
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		log.AppLogger.Errorf(
+			"Refusing to use the key %X found for %s at %s without confirmation, use the keyFingerprint option to confirm it",
+			keys[0].PrimaryKey.Fingerprint, email, source,
+		)
+		return nil, errInvalidInput
+	}
+
+	if !backup.Confirm(fmt.Sprintf("Found the key %X for %s at %s. Trust and pin this key?", keys[0].PrimaryKey.Fingerprint, email, source)) {
+		log.AppLogger.Errorf("The key found for %s was not trusted.", email)
+		return nil, errInvalidInput
+	}
+	return keys[0], nil
+}
+
+// expectedFingerprint returns true if the fingerprint was given with the keyFingerprint option.
+func expectedFingerprint(fingerprint string) bool {
+	for _, expected := range keyFingerprints {
+		if strings.EqualFold(strings.ReplaceAll(expected, " ", ""), fingerprint) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGPGAgent validates the options used to sign and decrypt through gpg-agent, which holds the keys instead of the
+// keyrings.
+func checkGPGAgent() error {
+	if jobInfo.EncryptTo == "" && jobInfo.SignFrom == "" {
+		log.AppLogger.Errorf("You must provide an encryptTo or signFrom option to use gpgAgent")
+		return errInvalidInput
+	}
+
+	if secretKeyRingPath != "" || publicKeyRingPath != "" {
+		log.AppLogger.Errorf("The keyring paths cannot be used along with gpgAgent, the keys are read from gpg instead")
+		return errInvalidInput
+	}
+
+	if encryptSubkey != "" || signSubkey != "" {
+		log.AppLogger.Errorf("The encryptSubkey and signSubkey options cannot be used along with gpgAgent, " +
+			"give the fingerprint of the subkey followed by ! as encryptTo or signFrom instead")
+		return errInvalidInput
+	}
+
+	if _, err := exec.LookPath(pgp.GPGPath); err != nil {
+		log.AppLogger.Errorf("Could not find the gpg executable %s - %v", pgp.GPGPath, err)
+		return errInvalidInput
+	}
+	log.AppLogger.Infof("Will be using gpg-agent through %s", pgp.GPGPath)
+
+	return nil
+}
+
+// checkKMSKeys validates the key management service keys the data key of each backup is wrapped with.
+func checkKMSKeys() error {
+	if jobInfo.EncryptTo != "" || jobInfo.SignFrom != "" || len(jobInfo.AgeRecipients) > 0 || ageIdentityFile != "" || jobInfo.GPGAgent {
+		log.AppLogger.Errorf("The kmsKey option cannot be used along with the PGP or age options")
+		return errInvalidInput
+	}
+
+	for _, uri := range jobInfo.KMSKeys {
+		if err := kms.CheckKeyURI(uri); err != nil {
+			log.AppLogger.Errorf("Invalid key management service key %s, expected an awskms://, gcpkms://, or azurekeyvault:// URI", uri)
+			return errInvalidInput
+		}
+	}
+
+	return nil
+}
+
 func loadSendKeys() error {
+	if len(jobInfo.KMSKeys) > 0 {
+		return checkKMSKeys()
+	}
+
+	if err := loadAgeKeys(usingSmartOption()); err != nil {
+		return err
+	}
+
+	if jobInfo.GPGAgent {
+		return checkGPGAgent()
+	}
+
 	if jobInfo.EncryptTo != "" {
 		if usingSmartOption() && secretKeyRingPath == "" {
 			log.AppLogger.Errorf("You must specify a secret keyring path if you use a smart option with encryptTo")
 			return errInvalidInput
-		} else if publicKeyRingPath == "" {
-			log.AppLogger.Errorf("You must specify a public keyring path if you provide an encryptTo option")
+		} else if publicKeyRingPath == "" && !fetchKeys {
+			log.AppLogger.Errorf("You must specify a public keyring path, or the fetchKeys option, if you provide an encryptTo option")
 			return errInvalidInput
 		}
 	}
@@ -259,15 +656,14 @@ func loadSendKeys() error {
 	}
 
 	if jobInfo.EncryptTo != "" {
+		var err error
 		if usingSmartOption() {
-			var err error
 			jobInfo.EncryptKey, err = getAndDecryptPrivateKey(jobInfo.EncryptTo)
 			if err != nil {
 				return err
 			}
-		} else if jobInfo.EncryptKey = pgp.GetPublicKeyByEmail(jobInfo.EncryptTo); jobInfo.EncryptKey == nil {
-			log.AppLogger.Errorf("Could not find public key for %s", jobInfo.EncryptTo)
-			return errInvalidInput
+		} else if jobInfo.EncryptKey, err = getPublicKey(jobInfo.EncryptTo); err != nil {
+			return err
 		}
 	}
 
@@ -279,17 +675,103 @@ func loadSendKeys() error {
 		}
 	}
 
+	return checkSendKeys(&jobInfo, encryptSubkey, signSubkey)
+}
+
+// checkSendKeys restricts the keys used to encrypt and sign new backups to the subkeys selected, if any, and makes
+// sure they have not expired or been revoked so the backup does not fail part way through.
+func checkSendKeys(keys *files.JobInfo, encryptFingerprint, signFingerprint string) error {
+	if (encryptFingerprint != "" && keys.EncryptKey == nil) || (signFingerprint != "" && keys.SignKey == nil) {
+		log.AppLogger.Errorf("The encryptSubkey and signSubkey options can only be used along with the encryptTo and signFrom options")
+		return errInvalidInput
+	}
+
+	var err error
+	if keys.EncryptKey, err = checkEncryptionKey(keys.EncryptTo, keys.EncryptKey, encryptFingerprint); err != nil {
+		return err
+	}
+	keys.SignKey, err = checkSigningKey(keys.SignFrom, keys.SignKey, signFingerprint)
+	return err
+}
+
+// checkEncryptionKey returns the key to encrypt to on behalf of email, restricted to the subkey with the fingerprint
+// provided, or an error when it cannot be used.
+func checkEncryptionKey(email string, key *openpgp.Entity, fingerprint string) (*openpgp.Entity, error) {
+	if key == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var err error
+	if fingerprint != "" {
+		if key, err = pgp.SelectEncryptionKey(key, fingerprint, now); err != nil {
+			log.AppLogger.Errorf("Could not select the encryption key for %s - %v", email, err)
+			return nil, errInvalidInput
+		}
+	}
+	if err = pgp.CheckEncryptionKey(key, now); err != nil {
+		log.AppLogger.Errorf("Cannot encrypt to %s - %v", email, err)
+		return nil, errInvalidInput
+	}
+	if err = checkFIPSKey(email, key, true); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkSigningKey returns the key to sign with on behalf of email, restricted to the subkey with the fingerprint
+// provided, or an error when it cannot be used.
+func checkSigningKey(email string, key *openpgp.Entity, fingerprint string) (*openpgp.Entity, error) {
+	if key == nil {
+		return nil, nil
+	}
+
+	now := time.Now()
+	var err error
+	if fingerprint != "" {
+		if key, err = pgp.SelectSigningKey(key, fingerprint, now); err != nil {
+			log.AppLogger.Errorf("Could not select the signing key for %s - %v", email, err)
+			return nil, errInvalidInput
+		}
+	}
+	if err = pgp.CheckSigningKey(key, now); err != nil {
+		log.AppLogger.Errorf("Cannot sign as %s - %v", email, err)
+		return nil, errInvalidInput
+	}
+	if err = checkFIPSKey(email, key, false); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// checkFIPSKey refuses keys using algorithms that are not FIPS approved when running in FIPS mode.
+func checkFIPSKey(email string, key *openpgp.Entity, encrypt bool) error {
+	if !config.FIPS || key == nil {
+		return nil
+	}
+	if err := pgp.CheckFIPSKey(key, encrypt); err != nil {
+		log.AppLogger.Errorf("Cannot use the key for %s in FIPS mode - %v", email, err)
+		return errInvalidInput
+	}
 	return nil
 }
 
 func loadReceiveKeys() error {
+	if err := loadAgeKeys(true); err != nil {
+		return err
+	}
+
+	if jobInfo.GPGAgent {
+		return checkGPGAgent()
+	}
+
 	if jobInfo.EncryptTo != "" && secretKeyRingPath == "" {
 		log.AppLogger.Errorf("You must specify a secret keyring path if you provide an encryptTo option")
 		return errInvalidInput
 	}
 
-	if jobInfo.SignFrom != "" && publicKeyRingPath == "" {
-		log.AppLogger.Errorf("You must specify a public keyring path if you provide a signFrom option")
+	if jobInfo.SignFrom != "" && publicKeyRingPath == "" && !fetchKeys {
+		log.AppLogger.Errorf("You must specify a public keyring path, or the fetchKeys option, if you provide a signFrom option")
 		return errInvalidInput
 	}
 
@@ -302,13 +784,16 @@ func loadReceiveKeys() error {
 	}
 
 	if jobInfo.SignFrom != "" {
-		if jobInfo.SignKey = pgp.GetPublicKeyByEmail(jobInfo.SignFrom); jobInfo.SignKey == nil {
-			log.AppLogger.Errorf("Could not find public key for %s", jobInfo.SignFrom)
-			return errInvalidInput
+		var err error
+		if jobInfo.SignKey, err = getPublicKey(jobInfo.SignFrom); err != nil {
+			return err
 		}
 	}
 
-	return nil
+	if err := checkFIPSKey(jobInfo.EncryptTo, jobInfo.EncryptKey, true); err != nil {
+		return err
+	}
+	return checkFIPSKey(jobInfo.SignFrom, jobInfo.SignKey, false)
 }
 
 func postRunCleanup(cmd *cobra.Command, args []string) {
@@ -388,17 +873,73 @@ func setupGlobalVars() error {
 		log.AppLogger.Infof("Limiting the upload speed to %s/s.", humanize.Bytes(maxUploadSpeed*humanize.KByte))
 		config.BackupUploadBucket = ratelimit.NewBucketWithRate(float64(maxUploadSpeed*humanize.KByte), int64(maxUploadSpeed*humanize.KByte))
 	}
+
+	if maxDownloadSpeed != 0 {
+		log.AppLogger.Infof("Limiting the download speed to %s/s.", humanize.Bytes(maxDownloadSpeed*humanize.KByte))
+		rate := maxDownloadSpeed * humanize.KByte
+		config.BackupDownloadBucket = ratelimit.NewBucketWithRate(float64(rate), int64(rate))
+	}
 	return nil
 }
 
-func validatePassphrase() {
-	var err error
-	if len(passphrase) == 0 {
+// validatePassphrase will read the passphrase of the secret keys, once, from the keyPassphraseFile, the
+// keyPassphraseEnv environment variable, or by prompting for it on the terminal, in that order.
+func validatePassphrase() error {
+	if len(passphrase) != 0 {
+		return nil
+	}
+
+	switch {
+	case keyPassphraseFile != "":
+		contents, err := os.ReadFile(keyPassphraseFile)
+		if err != nil {
+			log.AppLogger.Errorf("Could not read the key passphrase file due to an error - %v", err)
+			return errInvalidInput
+		}
+		passphrase = bytes.TrimRight(contents, "\r\n")
+	case keyPassphraseEnv != "" && os.Getenv(keyPassphraseEnv) != "":
+		passphrase = []byte(os.Getenv(keyPassphraseEnv))
+	case terminal.IsTerminal(int(os.Stdin.Fd())):
 		fmt.Fprint(config.Stdout, "Enter passphrase to decrypt encryption key: ")
-		passphrase, err = terminal.ReadPassword(0)
+		var err error
+		passphrase, err = terminal.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(config.Stdout)
 		if err != nil {
 			log.AppLogger.Errorf("Error reading user input for encryption key passphrase: %v", err)
-			panic(err)
+			return err
+		}
+	default:
+		log.AppLogger.Errorf(
+			"The secret key is protected by a passphrase, provide it with keyPassphraseFile or the %s environment variable",
+			keyPassphraseEnv,
+		)
+		return errInvalidInput
+	}
+
+	if len(passphrase) == 0 {
+		log.AppLogger.Errorf("An empty passphrase was provided for the secret key")
+		return errInvalidInput
+	}
+	return nil
+}
+
+// validateTargetURIs will verify each target URI provided can be handled by a backend.
+func validateTargetURIs(targets []string) error {
+	for _, target := range targets {
+		targetURI, _, err := backends.ParseTargetURI(target)
+		if err != nil {
+			log.AppLogger.Errorf("Invalid options provided in target URI %s - %v", target, err)
+			return errInvalidInput
+		}
+		_, err = backends.GetBackendForURI(targetURI)
+		if err == backends.ErrInvalidPrefix {
+			log.AppLogger.Errorf("Unsupported prefix provided in target URI, was given %s", target)
+			return errInvalidInput
+		} else if err == backends.ErrInvalidURI {
+			log.AppLogger.Errorf("Invalid target URI, was given %s", target)
+			return errInvalidInput
 		}
 	}
+
+	return nil
 }
@@ -0,0 +1,150 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jdfalk/zfsbackup-go/config"
+	"github.com/jdfalk/zfsbackup-go/files"
+)
+
+func TestCheckFIPSOptions(t *testing.T) {
+	oldFIPS, oldJobInfo, oldAgeIdentityFile := config.FIPS, jobInfo, ageIdentityFile
+	defer func() {
+		config.FIPS, jobInfo, ageIdentityFile = oldFIPS, oldJobInfo, oldAgeIdentityFile
+	}()
+
+	testCases := []struct {
+		name   string
+		fips   bool
+		modify func()
+		valid  bool
+	}{
+		{name: "age outside of FIPS mode", modify: func() { jobInfo.AgeRecipients = []string{"age1test"} }, valid: !config.FIPSBuild},
+		{name: "FIPS mode", fips: true, modify: func() { jobInfo.DigestAlgorithm = files.DigestSHA256 }, valid: true},
+		{name: "age recipients", fips: true, modify: func() { jobInfo.AgeRecipients = []string{"age1test"} }},
+		{name: "age identity", fips: true, modify: func() { ageIdentityFile = "identity.txt" }},
+		{name: "kms keys", fips: true, modify: func() { jobInfo.KMSKeys = []string{"awskms://alias/backup"} }},
+		{name: "gpg-agent", fips: true, modify: func() { jobInfo.GPGAgent = true }},
+		{name: "blake3 digests", fips: true, modify: func() { jobInfo.DigestAlgorithm = files.DigestBLAKE3 }},
+	}
+
+	for _, testCase := range testCases {
+		config.FIPS, jobInfo, ageIdentityFile = testCase.fips, files.JobInfo{}, ""
+		testCase.modify()
+
+		err := checkFIPSOptions()
+		if testCase.valid && err != nil {
+			t.Errorf("%s: Expected nil error, got %v", testCase.name, err)
+		} else if !testCase.valid && err != errInvalidInput {
+			t.Errorf("%s: Expected %v, got %v", testCase.name, errInvalidInput, err)
+		}
+	}
+}
+
+func TestUpdateStdinJobInfo(t *testing.T) {
+	oldJobInfo := jobInfo
+	defer func() { jobInfo = oldJobInfo }()
+
+	testCases := []struct {
+		name   string
+		modify func()
+		valid  bool
+	}{
+		{name: "full stream", modify: func() {}, valid: true},
+		{name: "incremental stream", modify: func() { jobInfo.IncrementalSnapshot.Name = "a" }},
+		{name: "resumed stream", modify: func() { jobInfo.Resume = true }},
+		{name: "smart option", modify: func() { jobInfo.Full = true }},
+	}
+
+	for _, testCase := range testCases {
+		jobInfo = files.JobInfo{VolumeName: "tank/data", FullIfOlderThan: -1 * time.Minute}
+		testCase.modify()
+
+		err := updateStdinJobInfo([]string{"tank/data", "b"})
+		if testCase.valid && err != nil {
+			t.Errorf("%s: Expected nil error, got %v", testCase.name, err)
+		} else if !testCase.valid && err != errInvalidInput {
+			t.Errorf("%s: Expected %v, got %v", testCase.name, errInvalidInput, err)
+		}
+	}
+	if jobInfo = (files.JobInfo{FullIfOlderThan: -1 * time.Minute}); updateStdinJobInfo([]string{"tank/data", "b"}) != nil || jobInfo.BaseSnapshot.Name != "b" {
+		t.Errorf("expected the stream to be stored as the snapshot named, got %v", jobInfo.BaseSnapshot)
+	}
+}
+
+func TestValidatePassphrase(t *testing.T) {
+	oldPassphrase, oldFile, oldEnv := passphrase, keyPassphraseFile, keyPassphraseEnv
+	defer func() { passphrase, keyPassphraseFile, keyPassphraseEnv = oldPassphrase, oldFile, oldEnv }()
+
+	passphraseFile := filepath.Join(t.TempDir(), "passphrase")
+	if err := os.WriteFile(passphraseFile, []byte("from file\n"), 0600); err != nil {
+		t.Fatalf("could not write the passphrase file: %v", err)
+	}
+	emptyFile := filepath.Join(t.TempDir(), "empty")
+	if err := os.WriteFile(emptyFile, []byte("\r\n"), 0600); err != nil {
+		t.Fatalf("could not write the passphrase file: %v", err)
+	}
+	t.Setenv("ZFSBACKUP_TEST_PASSPHRASE", "from env")
+
+	// Never prompt, even when the tests are run from a terminal
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("could not open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+	oldStdin := os.Stdin
+	os.Stdin = devNull
+	defer func() { os.Stdin = oldStdin }()
+
+	testCases := []struct {
+		name     string
+		file     string
+		env      string
+		expected string
+		valid    bool
+	}{
+		{name: "file", file: passphraseFile, env: "ZFSBACKUP_TEST_PASSPHRASE", expected: "from file", valid: true},
+		{name: "env", env: "ZFSBACKUP_TEST_PASSPHRASE", expected: "from env", valid: true},
+		{name: "missing file", file: filepath.Join(t.TempDir(), "missing")},
+		{name: "empty file", file: emptyFile},
+		{name: "unset env", env: "ZFSBACKUP_TEST_UNSET_PASSPHRASE"},
+		{name: "not interactive"},
+	}
+
+	for _, testCase := range testCases {
+		passphrase, keyPassphraseFile, keyPassphraseEnv = nil, testCase.file, testCase.env
+
+		err := validatePassphrase()
+		if testCase.valid && err != nil {
+			t.Errorf("%s: Expected nil error, got %v", testCase.name, err)
+		} else if !testCase.valid && err != errInvalidInput {
+			t.Errorf("%s: Expected %v, got %v", testCase.name, errInvalidInput, err)
+		}
+		if testCase.valid && string(passphrase) != testCase.expected {
+			t.Errorf("%s: Expected the passphrase %q, got %q", testCase.name, testCase.expected, passphrase)
+		}
+	}
+}
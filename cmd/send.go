@@ -21,8 +21,12 @@
 package cmd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"path"
 	"strings"
 	"time"
 
@@ -41,14 +45,29 @@ var (
 	fullIncremental string
 	maxUploadSpeed  uint64
 	passphrase      []byte
+	// Set when more than one dataset, or a glob pattern, is given to the send command
+	sendDatasets     []string
+	parallelDatasets int
+	sendDryRun       bool
+	// Name of the volume and snapshot an externally produced stream read from stdin is stored as
+	streamName string
+	// Path to the file mapping datasets to the keys to use for them
+	datasetKeysFile string
+	// Path to the secret the hidden object names are keyed with
+	hideNamesKeyFile string
+	// Path to the file mapping datasets to the compression to use for them
+	datasetCompressionFile string
+	// Path to the trained dictionary to prime the internal zstd compressor with
+	zstdDictionaryFile string
 )
 
 // sendCmd represents the send command
 var sendCmd = &cobra.Command{
-	Use:     "send [flags] filesystem|volume|snapshot uri(s)",
-	Short:   "send will backup of a ZFS volume similar to how the \"zfs send\" command works.",
-	Long:    `send take a subset of the`,
-	PreRunE: validateSendFlags,
+	Use:               "send [flags] filesystem|volume|snapshot [filesystem|volume|snapshot...] uri(s)",
+	Short:             "send will backup of a ZFS volume similar to how the \"zfs send\" command works.",
+	Long:              `send take a subset of the`,
+	ValidArgsFunction: completeLocalDatasets,
+	PreRunE:           validateSendFlags,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		log.AppLogger.Infof("Limiting the number of active files to %d", jobInfo.MaxFileBuffer)
 		log.AppLogger.Infof("Limiting the number of parallel uploads to %d", jobInfo.MaxParallelUploads)
@@ -63,6 +82,19 @@ var sendCmd = &cobra.Command{
 			log.AppLogger.Infof("Will be signed from %s", jobInfo.SignFrom)
 		}
 
+		if len(jobInfo.AgeRecipientKeys) > 0 {
+			log.AppLogger.Infof("Will be using age encryption to %s", strings.Join(jobInfo.AgeRecipients, ", "))
+		}
+
+		if sendDryRun {
+			return backup.DryRun(cmd.Context(), &jobInfo)
+		}
+		if len(sendDatasets) > 0 {
+			return backup.BackupDatasets(cmd.Context(), &jobInfo, sendDatasets, parallelDatasets)
+		}
+		if jobInfo.Recursive {
+			return backup.BackupRecursive(cmd.Context(), &jobInfo)
+		}
 		return backup.Backup(cmd.Context(), &jobInfo)
 	},
 }
@@ -79,6 +111,9 @@ func init() {
 	sendCmd.Flags().StringVarP(&fullIncremental, "intermediary", "I", "", "See the -I flag on zfs send for more information")
 	sendCmd.Flags().BoolVarP(&jobInfo.Properties, "properties", "p", false, "See the -p flag on zfs send for more information.")
 	sendCmd.Flags().BoolVarP(&jobInfo.Raw, "raw", "w", false, "See the -w flag on zfs send for more information.")
+	sendCmd.Flags().BoolVarP(&jobInfo.Compressed, "compressed", "c", false, "See the -c flag on zfs send for more information.")
+	sendCmd.Flags().BoolVarP(&jobInfo.LargeBlocks, "large-block", "L", false, "See the -L flag on zfs send for more information.")
+	sendCmd.Flags().BoolVarP(&jobInfo.EmbeddedData, "embed", "e", false, "See the -e flag on zfs send for more information.")
 
 	// Specific to download only
 	sendCmd.Flags().Uint64Var(
@@ -94,6 +129,12 @@ func init() {
 		6,
 		"the compression level to use with the compressor. Valid values are between 1-9.",
 	)
+	sendCmd.Flags().IntVar(
+		&jobInfo.CompressionThreads,
+		"compressionThreads",
+		0,
+		"the number of threads the internal compressors use to compress each volume in parallel. Set to 0 to use one per CPU.",
+	)
 	sendCmd.Flags().BoolVar(
 		&jobInfo.Resume,
 		"resume",
@@ -101,6 +142,35 @@ func init() {
 		"set this flag to true when you want to try and resume a previously cancled or failed backup. It is up to the caller to ensure the same "+
 			"command line arguments are provided between the original backup and the resumed one.",
 	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.ZvolSignatures,
+		"zvolSignatures",
+		false,
+		"when backing up a zvol, read the start of its snapshot (or of the zvol itself when the snapshot's device is not "+
+			"visible) to record the partition table and filesystem signatures found in the manifest.",
+	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.ContentAddressed,
+		"contentAddressed",
+		false,
+		"store volumes under a hash of their content and skip uploading volumes already found in the target, so retried "+
+			"backups and datasets with identical data do not transfer it again. Requires a maxFileBuffer greater than 0.",
+	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.AdaptiveCompression,
+		"adaptiveCompression",
+		true,
+		"store volumes without compression while the data is found to be incompressible (e.g. already compressed or encrypted), "+
+			"checking again every few volumes. Set to false to compress every volume.",
+	)
+	sendCmd.Flags().StringVar(
+		&hideNamesKeyFile,
+		"hideNamesKeyFile",
+		"",
+		"the path to a file holding a secret of at least 32 bytes to name the manifest and volumes after an HMAC of the "+
+			"volume and snapshot names keyed with it, so only the encrypted manifest reveals them. Keep the same secret across "+
+			"backups of a volume. Requires the encryptTo, ageRecipient, or kmsKey option.",
+	)
 	sendCmd.Flags().BoolVar(
 		&jobInfo.Full,
 		"full",
@@ -113,6 +183,13 @@ func init() {
 		false,
 		"set this flag to do an incremental backup of the most recent snapshot from the most recent snapshot found in the target.",
 	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.Differential,
+		"differential",
+		false,
+		"set this flag to do an incremental backup of the most recent snapshot from the snapshot of the most recent full "+
+			"backup found in the target, rather than from the previous incremental backup, so a restore needs at most two backup sets.",
+	)
 	sendCmd.Flags().StringVar(
 		&jobInfo.SnapshotPrefix,
 		"snapshotPrefix",
@@ -125,6 +202,36 @@ func init() {
 		"",
 		"Only consider snapshots matching given regex",
 	)
+	sendCmd.Flags().IntVar(
+		&jobInfo.MaxChainLength,
+		"maxChainLength",
+		0,
+		"used with the --increment option to perform a full backup instead once the incremental chain already has this "+
+			"many incremental backups. Use 0 for no limit.",
+	)
+	sendCmd.Flags().DurationVar(
+		&jobInfo.MaxChainAge,
+		"maxChainAge",
+		0,
+		"used with the --increment option to perform a full backup instead once the full backup the incremental chain "+
+			"started with is older than this, relative to the snapshot to backup. Use 0 for no limit.",
+	)
+	sendCmd.Flags().StringVar(
+		&jobInfo.SnapshotBefore,
+		"snapshotBefore",
+		"",
+		"take a new snapshot of the volume named using the given template before processing a smart option, so the new "+
+			"snapshot is the one backed up. The template may use the strftime directives %Y, %y, %m, %d, %j, %H, %M, %S, %F, %T "+
+			"(the backup start time) and %s (as a unix timestamp), e.g. zfsbackup-%Y%m%dT%H%M%S, or Go template syntax with "+
+			"the .Time and .Dataset fields, e.g. zfsbackup-{{.Time.UTC.Format \"20060102T150405\"}}.",
+	)
+	sendCmd.Flags().StringVar(
+		&jobInfo.HoldTag,
+		"holdTag",
+		"",
+		"place a zfs hold with the given tag on the snapshot backed up so it cannot be destroyed while future incremental "+
+			"backups depend on it. Holds with the same tag on snapshots the chain no longer depends on are released.",
+	)
 	sendCmd.Flags().DurationVar(
 		&jobInfo.FullIfOlderThan,
 		"fullIfOlderThan",
@@ -136,11 +243,34 @@ func init() {
 		&jobInfo.Compressor,
 		"compressor",
 		files.InternalCompressor,
-		"specify to use the internal (parallel) gzip implementation or an external binary (e.g. gzip, bzip2, pigz, lzma, xz, etc.) Syntax "+
-			"must be similar to the gzip compression tool) to compress the stream for storage. Please take into consideration time, memory, "+
+		"specify to use the internal (parallel) gzip implementation, internal-lz4 or internal-zstd for the internal (parallel) lz4 or zstd implementations, or an external binary (e.g. gzip, bzip2, pigz, lzma, xz, etc.) Syntax "+
+			"must be similar to the gzip compression tool) to compress the stream for storage. An external binary can be given with its own "+
+			"arguments, e.g. \"zstd -T0 -19\", in which case it is run as given and must write to stdout. Please take into consideration time, memory, "+
 			"and CPU usage for any of the compressors used. All manifests utilize the internal compressor. If value is zfs, the zfs stream "+
 			"will be created compressed. See the -c flag on zfs send for more information.",
 	)
+	sendCmd.Flags().IntVar(
+		&jobInfo.ZstdWindowLog,
+		"zstdLong",
+		0,
+		"the base 2 log of the window size the internal-zstd compressor uses to find matches (e.g. 27 for 128MiB, up to 29), "+
+			"similar to the --long option of zstd. Larger windows improve the ratio of streams with redundancy far apart, such as "+
+			"VM images, at the cost of memory. Set to 0 to use the default of the compression level.",
+	)
+	sendCmd.Flags().StringVar(
+		&zstdDictionaryFile,
+		"zstdDictionary",
+		"",
+		"the path to a dictionary trained with zstd --train to prime the internal-zstd compressor with. The dictionary is stored "+
+			"in the manifest, which is encrypted along with the volumes, so receive can decompress them without it.",
+	)
+	sendCmd.Flags().StringVar(
+		&jobInfo.Decompressor,
+		"decompressor",
+		"",
+		"the command line of the external decompressor to restore the volumes with, e.g. \"zstd -d -c\". It is recorded in the manifest "+
+			"and must read the compressed stream from stdin and write to stdout. Defaults to the compressor binary with the -c -d options.",
+	)
 	sendCmd.Flags().IntVar(
 		&jobInfo.MaxFileBuffer,
 		"maxFileBuffer",
@@ -149,6 +279,13 @@ func init() {
 			"Set to 0 to bypass local storage and upload straight to your destination - this will limit you to a single destination and disable "+
 			"any hash checks for the upload where available.",
 	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.NoCache,
+		"noCache",
+		false,
+		"stream the backup straight to the destination without writing volumes or manifests to the working directory. "+
+			"Implies a maxFileBuffer of 0, so only a single destination is supported and the backup cannot be resumed.",
+	)
 	sendCmd.Flags().IntVar(
 		&jobInfo.MaxParallelUploads,
 		"maxParallelUploads",
@@ -161,6 +298,33 @@ func init() {
 		0,
 		"the maximum upload speed (in KB/s) the program should use between all upload workers. Use 0 for no limit",
 	)
+	sendCmd.Flags().StringVar(
+		&jobInfo.UploadWindow,
+		"uploadWindow",
+		"",
+		"only upload during the given daily window of local time, e.g. 22:00-06:00. Outside of the window uploads are paused "+
+			"and volumes are buffered in the working directory, up to the maxFileBuffer option, until the window opens.",
+	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.TargetLock,
+		"targetLock",
+		false,
+		"also lock the volume with an object in each target while backing up, so runs from other hosts sharing the target are "+
+			"refused as well. The local lock only keeps runs on this host apart.",
+	)
+	sendCmd.Flags().DurationVar(
+		&jobInfo.LockTimeout,
+		"lockTimeout",
+		time.Hour,
+		"used with the --targetLock option, a lock object not refreshed for this long is considered left over by a crashed run "+
+			"and replaced. Lock objects are refreshed every quarter of this. At least 1m.",
+	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.BreakLock,
+		"breakLock",
+		false,
+		"used with the --targetLock option, replace the lock object of the volume in each target even if it is not stale.",
+	)
 	sendCmd.Flags().DurationVar(
 		&jobInfo.MaxRetryTime,
 		"maxRetryTime",
@@ -179,6 +343,43 @@ func init() {
 		"|",
 		"the separator to use between object component names.",
 	)
+	sendCmd.Flags().StringVar(
+		&jobInfo.TargetPolicy,
+		"targetPolicy",
+		files.TargetPolicyAll,
+		"the number of targets that must accept every volume for the backup to succeed when multiple targets are provided. "+
+			"Valid values are all, quorum (a majority of the targets), or any. Failed uploads are still retried as configured "+
+			"by the maxRetryTime option before moving on, the manifest records which targets hold each volume.",
+	)
+	sendCmd.Flags().StringSliceVar(
+		&jobInfo.PendingTargets,
+		"secondaryTargets",
+		nil,
+		"a comma separated list of targets to replicate this backup to after the send completes. The send only uploads to "+
+			"the destination provided and records these targets as pending in the manifest, run the replicate command with "+
+			"the --pending option against the destination to push the backup to them.",
+	)
+	sendCmd.Flags().StringVar(
+		&jobInfo.ManifestEncoding,
+		"manifestEncoding",
+		files.ManifestEncodingJSON,
+		"the encoding of the manifest. Valid values are json, readable by every release, or cbor, a compact binary "+
+			"encoding that is smaller and faster to parse for backup sets of many volumes but needs this release or newer to read.",
+	)
+	sendCmd.Flags().StringVar(
+		&jobInfo.DigestAlgorithm,
+		"digestAlgorithm",
+		files.DigestSHA256,
+		"the algorithm each volume is digested with to check it when it is downloaded. Valid values are sha256, sha512, "+
+			"or blake3, much faster on large volumes but not FIPS approved. The algorithm is recorded for each volume in the manifest.",
+	)
+	sendCmd.Flags().StringToStringVar(
+		&jobInfo.Tags,
+		"tag",
+		nil,
+		"a key=value label to record in the manifest, e.g. --tag reason=pre-migration, to tell backup sets apart. Can be "+
+			"given more than once. Use the --tag option of the list command to filter backup sets by their tags.",
+	)
 	sendCmd.Flags().IntVar(
 		&jobInfo.UploadChunkSize,
 		"uploadChunkSize",
@@ -191,6 +392,77 @@ func init() {
 		"",
 		"the local volume name if different from the S3 volume",
 	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.Recursive,
+		"recursive",
+		false,
+		"backup the volume along with every filesystem and volume beneath it, each as its own backup set using the same "+
+			"snapshot (or smart option). Restore the hierarchy with the --recursive flag on the receive command.",
+	)
+	sendCmd.Flags().BoolVar(
+		&jobInfo.Stdin,
+		"stdin",
+		false,
+		"read the stream to backup from stdin instead of running zfs send, e.g. zfs send tank/data@a | zfsbackup send "+
+			"--stdin --streamName tank/data@a target. Only the target is given as an argument, use the --streamName option "+
+			"to name the stream. Only full streams can be read, the -i, -I, and --resume options are not available.",
+	)
+	sendCmd.Flags().StringVar(
+		&streamName,
+		"streamName",
+		"",
+		"the volume@snapshot name to store the stream read with the --stdin option as.",
+	)
+	sendCmd.Flags().BoolVar(
+		&sendDryRun,
+		"dryRun",
+		false,
+		"estimate the size of the zfs send stream and the number of volumes it would be split into, and show the snapshots "+
+			"that would be used, without uploading anything.",
+	)
+	sendCmd.Flags().BoolVar(
+		&config.ShowProgress,
+		"progress",
+		false,
+		"display the progress of the backup (bytes sent, compressed size, upload rate, and ETA). The progress is redrawn in "+
+			"place on a terminal and logged periodically otherwise.",
+	)
+	sendCmd.Flags().IntVar(
+		&parallelDatasets,
+		"parallelDatasets",
+		1,
+		"the maximum number of datasets to backup at once when more than one dataset, or a glob pattern such as tank/vm/*, "+
+			"is provided. All datasets share the limit set by the maxParallelUploads option.",
+	)
+	sendCmd.Flags().StringSliceVar(
+		&jobInfo.Include,
+		"include",
+		nil,
+		"a comma separated list of patterns, only datasets beneath the volume matching one of them are backed up with the "+
+			"--recursive option. Patterns are globs matched against the full dataset name (* may match across a /), prefix "+
+			"a pattern with regexp: to use a regular expression instead.",
+	)
+	sendCmd.Flags().StringSliceVar(
+		&jobInfo.Exclude,
+		"exclude",
+		nil,
+		"a comma separated list of patterns, datasets beneath the volume matching one of them, along with their descendants, "+
+			"are skipped with the --recursive option (e.g. */tmp,*/cache). Uses the same syntax as the --include option.",
+	)
+	sendCmd.Flags().StringVar(
+		&datasetKeysFile,
+		"datasetKeys",
+		"",
+		"the path to a JSON file mapping datasets (or glob patterns, matching the datasets beneath them too) to the "+
+			"encryptTo and signFrom keys to use for them instead of the ones given on the command line.",
+	)
+	sendCmd.Flags().StringVar(
+		&datasetCompressionFile,
+		"datasetCompression",
+		"",
+		"the path to a JSON file mapping datasets (or glob patterns, matching the datasets beneath them too) to the "+
+			"compressor, compressionLevel, and decompressor to use for them instead of the ones given on the command line.",
+	)
 	sendCmd.Flags().BoolVar(
 		&jobInfo.SmartIntermediaryIncremental,
 		"smartIntermediaryIncremental",
@@ -204,44 +476,86 @@ func ResetSendJobInfo() {
 	resetRootFlags()
 	// ZFS send command options
 	jobInfo.Replication = false
+	jobInfo.Recursive = false
+	jobInfo.Include = nil
+	jobInfo.Exclude = nil
+	jobInfo.Tags = nil
+	jobInfo.ManifestEncoding = files.ManifestEncodingJSON
+	jobInfo.DigestAlgorithm = files.DigestSHA256
 	jobInfo.SkipMissing = false
 	jobInfo.Deduplication = false
 	jobInfo.IncrementalSnapshot = files.SnapshotInfo{}
 	jobInfo.BaseSnapshot = files.SnapshotInfo{}
 	fullIncremental = ""
 	jobInfo.Properties = false
+	jobInfo.Raw = false
+	jobInfo.Compressed = false
+	jobInfo.LargeBlocks = false
+	jobInfo.EmbeddedData = false
 
 	// Specific to download only
 	jobInfo.VolumeSize = 200
 	jobInfo.CompressionLevel = 6
+	jobInfo.CompressionThreads = 0
 	jobInfo.Resume = false
+	jobInfo.ContentAddressed = false
+	jobInfo.AdaptiveCompression = true
+	jobInfo.HideNames = false
+	jobInfo.NamesKey = nil
+	jobInfo.ZvolSignatures = false
 	jobInfo.Full = false
 	jobInfo.Incremental = false
 	jobInfo.FullIfOlderThan = -1 * time.Minute
+	jobInfo.Differential = false
+	jobInfo.MaxChainLength = 0
+	jobInfo.MaxChainAge = 0
+	jobInfo.SnapshotBefore = ""
+	jobInfo.HoldTag = ""
 
 	jobInfo.MaxFileBuffer = 5
+	jobInfo.NoCache = false
 	jobInfo.MaxParallelUploads = 4
 	maxUploadSpeed = 0
+	jobInfo.UploadWindow = ""
+	jobInfo.TargetLock = false
+	jobInfo.LockTimeout = time.Hour
+	jobInfo.BreakLock = false
+	sendDatasets = nil
+	parallelDatasets = 1
+	sendDryRun = false
+	jobInfo.Stdin = false
+	streamName = ""
+	datasetKeysFile = ""
+	hideNamesKeyFile = ""
+	datasetCompressionFile = ""
 	jobInfo.MaxRetryTime = 12 * time.Hour
 	jobInfo.MaxBackoffTime = 30 * time.Minute
 	jobInfo.Separator = "|"
 	jobInfo.UploadChunkSize = 10
+	jobInfo.TargetPolicy = files.TargetPolicyAll
+	jobInfo.PendingTargets = nil
 	jobInfo.Compressor = files.InternalCompressor
+	jobInfo.Decompressor = ""
+	jobInfo.ZstdWindowLog = 0
+	jobInfo.ZstdDictionary = nil
+	zstdDictionaryFile = ""
 }
 
 // nolint:gocyclo,funlen // Will do later
 func updateJobInfo(args []string) error {
 	jobInfo.StartTime = time.Now()
 	jobInfo.Version = config.VersionNumber
+	jobInfo.SchemaVersion = files.ManifestSchemaVersion
 
 	if fullIncremental != "" {
 		jobInfo.IncrementalSnapshot.Name = fullIncremental
 		jobInfo.IntermediaryIncremental = true
 	}
 
-	parts := strings.Split(args[0], "@")
+	datasetArgs := args[:len(args)-1]
+	parts := strings.Split(datasetArgs[0], "@")
 	jobInfo.VolumeName = parts[0]
-	jobInfo.Destinations = strings.Split(args[1], ",")
+	jobInfo.Destinations = strings.Split(args[len(args)-1], ",")
 
 	if len(jobInfo.Destinations) > 1 && jobInfo.MaxFileBuffer == 0 {
 		log.AppLogger.Errorf("Specifying multiple destinations and a MaxFileBuffer size of 0 is unsupported.")
@@ -249,7 +563,16 @@ func updateJobInfo(args []string) error {
 	}
 
 	for _, destination := range jobInfo.Destinations {
-		_, err := backends.GetBackendForURI(destination)
+		targetURI, _, err := backends.ParseTargetURI(destination)
+		if err != nil {
+			log.AppLogger.Errorf("Invalid options provided in destination URI %s - %v", destination, err)
+			return errInvalidInput
+		}
+		if strings.HasPrefix(targetURI, backends.StripedBackendPrefix+"://") && jobInfo.MaxFileBuffer == 0 {
+			log.AppLogger.Errorf("Striped destinations require a MaxFileBuffer size greater than 0.")
+			return errInvalidInput
+		}
+		_, err = backends.GetBackendForURI(targetURI)
 		if err == backends.ErrInvalidPrefix {
 			log.AppLogger.Errorf("Unsupported prefix provided in destination URI, was given %s", destination)
 			return err
@@ -259,6 +582,62 @@ func updateJobInfo(args []string) error {
 		}
 	}
 
+	if len(jobInfo.PendingTargets) > 0 {
+		if err := validateTargetURIs(jobInfo.PendingTargets); err != nil {
+			return err
+		}
+		for _, target := range jobInfo.PendingTargets {
+			for _, destination := range jobInfo.Destinations {
+				if strings.TrimRight(target, "/") == strings.TrimRight(destination, "/") {
+					log.AppLogger.Errorf("The target %s cannot be both a destination and a secondary target.", target)
+					return errInvalidInput
+				}
+			}
+		}
+	}
+
+	if jobInfo.Stdin {
+		jobInfo.ApplyDatasetKeys()
+		jobInfo.ApplyDatasetCompression()
+		return updateStdinJobInfo(parts)
+	}
+
+	if jobInfo.SnapshotBefore != "" && !usingSmartOption() {
+		log.AppLogger.Errorf("The --snapshotBefore option can only be used with a \"smart\" option.")
+		return errInvalidInput
+	}
+
+	// Some basic checks here
+	onlyOneCheck := 0
+	if jobInfo.Full {
+		onlyOneCheck++
+	}
+	if jobInfo.Incremental {
+		onlyOneCheck++
+	}
+	if jobInfo.FullIfOlderThan != -1*time.Minute {
+		onlyOneCheck++
+	}
+	if jobInfo.Differential {
+		onlyOneCheck++
+	}
+	if onlyOneCheck > 1 {
+		log.AppLogger.Errorf("Please specify only one \"smart\" option at a time")
+		return errInvalidInput
+	}
+
+	if sendDryRun && (jobInfo.Recursive || jobInfo.SnapshotBefore != "" || len(datasetArgs) > 1 || strings.ContainsAny(parts[0], "*?[")) {
+		log.AppLogger.Errorf("The --dryRun option can only be used with a single dataset, without the --recursive or --snapshotBefore options.")
+		return errInvalidInput
+	}
+
+	sendDatasets = nil
+	if len(datasetArgs) > 1 || strings.ContainsAny(parts[0], "*?[") {
+		return updateDatasetsJobInfo(datasetArgs)
+	}
+	jobInfo.ApplyDatasetKeys()
+	jobInfo.ApplyDatasetCompression()
+
 	// If we aren't using a "smart" option, rely on the user to provide the snapshots to use!
 	if !usingSmartOption() {
 		if len(parts) != 2 {
@@ -295,25 +674,20 @@ func updateJobInfo(args []string) error {
 			jobInfo.IncrementalSnapshot.CreationTime = creationTime
 		}
 	} else {
-		// Some basic checks here
-		onlyOneCheck := 0
-		if jobInfo.Full {
-			onlyOneCheck++
-		}
-		if jobInfo.Incremental {
-			onlyOneCheck++
-		}
-		if jobInfo.FullIfOlderThan != -1*time.Minute {
-			onlyOneCheck++
-		}
-		if onlyOneCheck > 1 {
-			log.AppLogger.Errorf("Please specify only one \"smart\" option at a time")
-			return errInvalidInput
-		}
 		if len(parts) != 1 {
 			log.AppLogger.Errorf("When using a smart option, please only specify the volume to backup, do not include any snapshot information.")
 			return errInvalidInput
 		}
+		if jobInfo.SnapshotBefore != "" {
+			if err := backup.SnapshotBefore(context.Background(), &jobInfo); err != nil {
+				log.AppLogger.Errorf("Error while trying to take a snapshot before the backup - %v", err)
+				return err
+			}
+		}
+		if jobInfo.Recursive {
+			// Smart options are resolved for each dataset as it is backed up
+			return nil
+		}
 		if err := backup.ProcessSmartOptions(context.Background(), &jobInfo); err != nil {
 			log.AppLogger.Errorf("Error while trying to process smart option - %v", err)
 			return err
@@ -324,6 +698,68 @@ func updateJobInfo(args []string) error {
 	return nil
 }
 
+// updateStdinJobInfo validates the options used to backup an externally produced stream read from stdin.
+// The snapshots cannot be inspected so the stream is recorded as created when the backup started.
+func updateStdinJobInfo(parts []string) error {
+	if usingSmartOption() || jobInfo.Recursive || jobInfo.SnapshotBefore != "" ||
+		sendDryRun || jobInfo.HoldTag != "" || jobInfo.LocalVolume != "" {
+		log.AppLogger.Errorf(
+			"The --stdin option cannot be used with a \"smart\" option or the --recursive, --snapshotBefore, --dryRun, " +
+				"--holdTag, or --localVolume options.",
+		)
+		return errInvalidInput
+	}
+
+	// The creation time of the incremental source cannot be inspected, so the backup could not be linked to the
+	// backup of its source, and a resumed backup would skip the start of a stream that may not be the same one
+	if jobInfo.IncrementalSnapshot.Name != "" || jobInfo.Resume {
+		log.AppLogger.Errorf("The --stdin option cannot be used with the -i, -I, or --resume options, only full streams can be read from stdin.")
+		return errInvalidInput
+	}
+
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || strings.ContainsAny(parts[0], "*?[") {
+		log.AppLogger.Errorf("Invalid stream name provided. Expected format <volume>@<snapshot>, got %s instead", streamName)
+		return errInvalidInput
+	}
+	jobInfo.BaseSnapshot = files.SnapshotInfo{Name: parts[1], CreationTime: jobInfo.StartTime}
+
+	return nil
+}
+
+// updateDatasetsJobInfo validates the datasets provided when backing up more than one dataset at once,
+// the snapshots used for each are resolved as they are backed up.
+func updateDatasetsJobInfo(datasets []string) error {
+	if jobInfo.LocalVolume != "" {
+		log.AppLogger.Errorf("The --localVolume option cannot be used when backing up more than one dataset.")
+		return errInvalidInput
+	}
+
+	if parallelDatasets < 1 {
+		log.AppLogger.Errorf("The number of parallel datasets must be set to a value greater than 0. Was given %d", parallelDatasets)
+		return errInvalidInput
+	}
+
+	for _, dataset := range datasets {
+		hasSnapshot := strings.Contains(dataset, "@")
+		if usingSmartOption() && hasSnapshot {
+			log.AppLogger.Errorf("When using a smart option, please only specify the volumes to backup, got %s instead.", dataset)
+			return errInvalidInput
+		} else if !usingSmartOption() && !hasSnapshot {
+			log.AppLogger.Errorf("Invalid base snapshot provided. Expected format <volume>@<snapshot>, got %s instead", dataset)
+			return errInvalidInput
+		}
+	}
+
+	// The incremental source is shared by every dataset, so only keep the snapshot or bookmark name
+	if idx := strings.LastIndexAny(jobInfo.IncrementalSnapshot.Name, "@#"); idx >= 0 {
+		jobInfo.IncrementalSnapshot.Bookmark = jobInfo.IncrementalSnapshot.Name[idx] == '#'
+		jobInfo.IncrementalSnapshot.Name = jobInfo.IncrementalSnapshot.Name[idx+1:]
+	}
+
+	sendDatasets = datasets
+	return nil
+}
+
 // getLocalBaseSnapshotName takes a provided name of the destination snapshot and optionally
 // translates it into the local snapshot if --localVolume is given
 func getLocalBaseSnapshotName(name string) string {
@@ -341,12 +777,172 @@ func getLocalBaseSnapshotName(name string) string {
 	return localBaseSnapVolumeName
 }
 
+// loadDatasetKeys reads the keys to use for specific datasets from the file provided, which holds a list of
+// {"dataset": "tank/tenants/a*", "encryptTo": "a@domain.com", "signFrom": "a@domain.com"} entries.
+func loadDatasetKeys() error {
+	if datasetKeysFile == "" {
+		return nil
+	}
+
+	if jobInfo.UsesAge() || len(jobInfo.KMSKeys) > 0 {
+		log.AppLogger.Errorf("The datasetKeys option cannot be used along with the age or kmsKey options")
+		return errInvalidInput
+	}
+
+	data, err := os.ReadFile(datasetKeysFile)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the dataset keys file due to an error - %v", err)
+		return errInvalidInput
+	}
+	if err = json.Unmarshal(data, &jobInfo.DatasetKeys); err != nil {
+		log.AppLogger.Errorf("Could not parse the dataset keys file %s - %v", datasetKeysFile, err)
+		return errInvalidInput
+	}
+
+	for _, keys := range jobInfo.DatasetKeys {
+		if _, perr := path.Match(keys.Dataset, ""); perr != nil || keys.Dataset == "" {
+			log.AppLogger.Errorf("Invalid dataset pattern %q in the dataset keys file", keys.Dataset)
+			return errInvalidInput
+		}
+		if jobInfo.GPGAgent {
+			continue
+		}
+		if keys.EncryptTo != "" {
+			if usingSmartOption() {
+				if keys.EncryptKey, err = getAndDecryptPrivateKey(keys.EncryptTo); err != nil {
+					return err
+				}
+			} else if keys.EncryptKey, err = getPublicKey(keys.EncryptTo); err != nil {
+				return err
+			}
+		}
+		if keys.SignFrom != "" {
+			if keys.SignKey, err = getAndDecryptPrivateKey(keys.SignFrom); err != nil {
+				return err
+			}
+		}
+		if keys.EncryptKey, err = checkEncryptionKey(keys.EncryptTo, keys.EncryptKey, ""); err != nil {
+			return err
+		}
+		if keys.SignKey, err = checkSigningKey(keys.SignFrom, keys.SignKey, ""); err != nil {
+			return err
+		}
+	}
+	log.AppLogger.Infof("Loaded the keys of %d dataset pattern(s) from %s", len(jobInfo.DatasetKeys), datasetKeysFile)
+
+	return nil
+}
+
+// loadNamesKey reads the secret the hidden object names are keyed with, hiding the names only when the manifest that
+// holds them is encrypted.
+func loadNamesKey() error {
+	if hideNamesKeyFile == "" {
+		return nil
+	}
+
+	if jobInfo.EncryptTo == "" && len(jobInfo.AgeRecipients) == 0 && len(jobInfo.KMSKeys) == 0 {
+		log.AppLogger.Errorf("The hideNamesKeyFile option requires the manifest to be encrypted with the encryptTo, ageRecipient, or kmsKey option")
+		return errInvalidInput
+	}
+
+	key, err := os.ReadFile(hideNamesKeyFile)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the hideNamesKeyFile due to an error - %v", err)
+		return errInvalidInput
+	}
+	if key = bytes.TrimSpace(key); len(key) < 32 {
+		log.AppLogger.Errorf("The hideNamesKeyFile %s must hold a secret of at least 32 bytes", hideNamesKeyFile)
+		return errInvalidInput
+	}
+	jobInfo.HideNames = true
+	jobInfo.NamesKey = key
+
+	return nil
+}
+
+// loadDatasetCompression reads the compression to use for specific datasets from the file provided, which holds a
+// list of {"dataset": "tank/media*", "compressor": "none"} or {"dataset": "tank/docs", "compressor": "xz",
+// "compressionLevel": 9} entries.
+func loadDatasetCompression() error {
+	if datasetCompressionFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(datasetCompressionFile)
+	if err != nil {
+		log.AppLogger.Errorf("Could not read the dataset compression file due to an error - %v", err)
+		return errInvalidInput
+	}
+	if err = json.Unmarshal(data, &jobInfo.DatasetCompression); err != nil {
+		log.AppLogger.Errorf("Could not parse the dataset compression file %s - %v", datasetCompressionFile, err)
+		return errInvalidInput
+	}
+
+	for _, compression := range jobInfo.DatasetCompression {
+		if _, perr := path.Match(compression.Dataset, ""); perr != nil || compression.Dataset == "" {
+			log.AppLogger.Errorf("Invalid dataset pattern %q in the dataset compression file", compression.Dataset)
+			return errInvalidInput
+		}
+		if compression.CompressionLevel < 0 || compression.CompressionLevel > 9 {
+			log.AppLogger.Errorf(
+				"The compression level for %s must be between 1 and 9. Was given %d", compression.Dataset, compression.CompressionLevel,
+			)
+			return errInvalidInput
+		}
+		if compression.Decompressor != "" && (compression.Compressor == "" || compression.Compressor == files.NoCompressor) {
+			log.AppLogger.Errorf("A decompressor was given for %s without an external compressor", compression.Dataset)
+			return errInvalidInput
+		}
+	}
+	log.AppLogger.Infof(
+		"Loaded the compression of %d dataset pattern(s) from %s", len(jobInfo.DatasetCompression), datasetCompressionFile,
+	)
+
+	return nil
+}
+
+// loadZstdOptions reads the dictionary for the internal zstd compressor and checks the zstd options are only used
+// along with it.
+func loadZstdOptions() error {
+	if jobInfo.ZstdWindowLog == 0 && zstdDictionaryFile == "" {
+		return nil
+	}
+
+	if jobInfo.Compressor != files.InternalZstdCompressor && datasetCompressionFile == "" {
+		log.AppLogger.Errorf("The zstdLong and zstdDictionary options can only be used with the %s compressor.", files.InternalZstdCompressor)
+		return errInvalidInput
+	}
+
+	if zstdDictionaryFile != "" {
+		dictionary, err := os.ReadFile(zstdDictionaryFile)
+		if err != nil {
+			log.AppLogger.Errorf("Could not read the zstd dictionary due to an error - %v", err)
+			return errInvalidInput
+		}
+		jobInfo.ZstdDictionary = dictionary
+	}
+
+	return nil
+}
+
 func usingSmartOption() bool {
-	return jobInfo.Full || jobInfo.Incremental || jobInfo.FullIfOlderThan != -1*time.Minute
+	return jobInfo.Full || jobInfo.Incremental || jobInfo.FullIfOlderThan != -1*time.Minute || jobInfo.Differential
 }
 
 func validateSendFlags(cmd *cobra.Command, args []string) error {
-	if len(args) != 2 {
+	if jobInfo.Stdin {
+		if len(args) != 1 || streamName == "" {
+			log.AppLogger.Errorf("The --stdin option requires the --streamName option and only the target as an argument.")
+			_ = cmd.Usage()
+			return errInvalidInput
+		}
+		args = []string{streamName, args[0]}
+	} else if streamName != "" {
+		log.AppLogger.Errorf("The --streamName option can only be used with the --stdin option.")
+		return errInvalidInput
+	}
+
+	if len(args) < 2 {
 		_ = cmd.Usage()
 		return errInvalidInput
 	}
@@ -355,11 +951,40 @@ func validateSendFlags(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	if err := loadDatasetKeys(); err != nil {
+		return err
+	}
+
+	if err := loadDatasetCompression(); err != nil {
+		return err
+	}
+
+	if err := loadNamesKey(); err != nil {
+		return err
+	}
+
 	if jobInfo.IncrementalSnapshot.Name != "" && fullIncremental != "" {
 		log.AppLogger.Errorf("The flags -i and -I are mutually exclusive. Please specify only one of these flags.")
 		return errInvalidInput
 	}
 
+	if jobInfo.BreakLock && !jobInfo.TargetLock {
+		log.AppLogger.Errorf("The --breakLock option requires the --targetLock option, the local lock is never left behind.")
+		return errInvalidInput
+	}
+
+	if jobInfo.NoCache {
+		if cmd.Flags().Changed("maxFileBuffer") && jobInfo.MaxFileBuffer != 0 {
+			log.AppLogger.Errorf("The --noCache option pipes volumes straight to the destination and requires a maxFileBuffer of 0.")
+			return errInvalidInput
+		}
+		jobInfo.MaxFileBuffer = 0
+	}
+
+	if err := loadZstdOptions(); err != nil {
+		return err
+	}
+
 	if err := jobInfo.ValidateSendFlags(); err != nil {
 		log.AppLogger.Error(err)
 		return err
@@ -0,0 +1,85 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	serveListen       string
+	serveVerifySample int
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve [flags] uri(s)",
+	Short: "serve will run a web dashboard of the backup sets found in the targets.",
+	Long: `serve will run a web dashboard of the backup sets found in the targets.
+For every target, the dashboard shows the datasets backed up, when each was last backed up, the backup sets of its
+current incremental chain, and the storage it consumes. The backup sets of a dataset can be verified, and its restore
+checked with a dry run, from the dashboard. Actions run one at a time in the background, and their output can be
+followed from the dashboard. The dashboard has no authentication and only listens on localhost by default. The
+command runs until it is interrupted.`,
+	SilenceErrors: true,
+	PreRunE:       validateServeFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Serve(cmd.Context(), &jobInfo, args, serveListen, serveVerifySample)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	serveCmd.Flags().StringVar(
+		&serveListen,
+		"listen",
+		"127.0.0.1:8080",
+		"the address the dashboard listens on.",
+	)
+	serveCmd.Flags().IntVar(
+		&serveVerifySample,
+		"verifySample",
+		1,
+		"the number of volumes of each backup set read back when verifying from the dashboard, 0 to read every volume.",
+	)
+}
+
+func validateServeFlags(cmd *cobra.Command, args []string) error {
+	if len(args) < 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if serveVerifySample < 0 {
+		log.AppLogger.Errorf("The number of volumes to sample cannot be negative, was given %d", serveVerifySample)
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args)
+}
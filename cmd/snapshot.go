@@ -0,0 +1,131 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"regexp"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	snapshotNameTemplate string
+	snapshotPrefix       string
+	snapshotRegexp       string
+	snapshotRecursive    bool
+	snapshotPolicy       backup.RetentionPolicy
+	snapshotDryRun       bool
+)
+
+// snapshotCmd represents the snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot [flags] filesystem|volume",
+	Short: "snapshot will take a snapshot of a dataset and destroy its snapshots expired under a retention policy.",
+	Long: `snapshot will take a snapshot of a dataset and destroy its snapshots expired under a retention policy.
+The snapshot is named with the --snapshotName template, which supports the same syntax as the --snapshotBefore
+option of send, and only the snapshots matching --snapshotPrefix (or --snapshotRegexp) are ever destroyed, so the
+same options can select the snapshots to back up. The --keep option keeps that many of the latest snapshots, and the
+--keepDaily, --keepWeekly, and --keepMonthly options keep the latest snapshot of the most recent days, weeks, and
+months, as the prune command does for backup sets. The latest snapshot is always kept, and snapshots that cannot be
+destroyed, e.g. because a hold was placed on them with --holdTag, are skipped.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeLocalDatasets),
+	PreRunE:           validateSnapshotFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jobInfo.SnapshotPrefix = snapshotPrefix
+		jobInfo.SnapshotRegexp = snapshotRegexp
+		jobInfo.Recursive = snapshotRecursive
+		return backup.Snapshot(cmd.Context(), &jobInfo, args[0], snapshotNameTemplate, snapshotPolicy, snapshotDryRun)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(snapshotCmd)
+
+	snapshotCmd.Flags().StringVar(
+		&snapshotNameTemplate,
+		"snapshotName",
+		"zfsbackup-%Y%m%dT%H%M%S",
+		"the template to name the new snapshot with, using the same syntax as the --snapshotBefore option of send. Use an empty "+
+			"name to only destroy the expired snapshots.",
+	)
+	snapshotCmd.Flags().StringVar(
+		&snapshotPrefix,
+		"snapshotPrefix",
+		"zfsbackup-",
+		"Only consider snapshots starting with the given snapshot prefix for expiry",
+	)
+	snapshotCmd.Flags().StringVar(
+		&snapshotRegexp,
+		"snapshotRegexp",
+		"",
+		"Only consider snapshots matching given regex for expiry",
+	)
+	snapshotCmd.Flags().BoolVarP(
+		&snapshotRecursive,
+		"recursive",
+		"r",
+		false,
+		"take the snapshot of every descendant dataset as well, atomically, and expire the snapshots of each of them.",
+	)
+	snapshotCmd.Flags().IntVar(&snapshotPolicy.KeepLast, "keep", 0, "keep this many of the latest snapshots.")
+	snapshotCmd.Flags().IntVar(&snapshotPolicy.KeepDaily, "keepDaily", 0, "keep the latest snapshot of this many of the most recent days.")
+	snapshotCmd.Flags().IntVar(&snapshotPolicy.KeepWeekly, "keepWeekly", 0, "keep the latest snapshot of this many of the most recent weeks.")
+	snapshotCmd.Flags().IntVar(
+		&snapshotPolicy.KeepMonthly, "keepMonthly", 0, "keep the latest snapshot of this many of the most recent months.",
+	)
+	snapshotCmd.Flags().BoolVar(
+		&snapshotDryRun, "dryRun", false, "report the snapshots that would be taken and destroyed without changing anything.",
+	)
+}
+
+func validateSnapshotFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if snapshotPolicy.KeepLast < 0 || snapshotPolicy.KeepDaily < 0 || snapshotPolicy.KeepWeekly < 0 || snapshotPolicy.KeepMonthly < 0 {
+		log.AppLogger.Errorf("The number of snapshots to keep cannot be negative.")
+		return errInvalidInput
+	}
+
+	if _, err := regexp.Compile(snapshotRegexp); err != nil {
+		log.AppLogger.Errorf("Invalid snapshot regex provided, was given %s - %v", snapshotRegexp, err)
+		return errInvalidInput
+	}
+
+	expiring := snapshotPolicy.KeepLast > 0 || snapshotPolicy.KeepDaily > 0 || snapshotPolicy.KeepWeekly > 0 || snapshotPolicy.KeepMonthly > 0
+	if expiring && snapshotPrefix == "" && snapshotRegexp == "" {
+		log.AppLogger.Errorf("A --snapshotPrefix or --snapshotRegexp must be provided to expire snapshots, so other snapshots are left alone.")
+		return errInvalidInput
+	}
+
+	if snapshotNameTemplate == "" && !expiring {
+		log.AppLogger.Errorf("Nothing to do, provide a --snapshotName or a retention option such as --keep.")
+		return errInvalidInput
+	}
+
+	return nil
+}
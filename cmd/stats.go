@@ -0,0 +1,69 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+)
+
+var statsVolumeName string
+
+// statsCmd represents the stats command
+var statsCmd = &cobra.Command{
+	Use:   "stats [flags] uri",
+	Short: "stats will output totals per volume of the backup sets found at the provided target.",
+	Long: `stats will output totals per volume of the backup sets found at the provided target.
+For each volume the number of backup sets, the bytes stored in the target and the bytes of the zfs send streams
+backed up, how much the stored bytes grow per week, the average duration of a backup, and the length of the
+current and longest incremental chains are listed. Use the --jsonOutput flag to export the totals for use by
+capacity planning tools.`,
+	PreRunE: validateStatsFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Stats(cmd.Context(), &jobInfo, args[0], statsVolumeName)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statsCmd)
+
+	statsCmd.Flags().StringVar(
+		&statsVolumeName,
+		"volumeName",
+		"",
+		"Filter results to only this volume name, can end with a '*' to match as only a prefix",
+	)
+	_ = statsCmd.RegisterFlagCompletionFunc("volumeName", completeTargetVolumes)
+}
+
+func validateStatsFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args)
+}
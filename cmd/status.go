@@ -0,0 +1,127 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [flags] filesystem|volume uri",
+	Short: "status will compare the local snapshots of a dataset with the backups found in the provided target.",
+	Long: `status will compare the local snapshots of a dataset with the backups found in the provided target.
+The time the last backup completed, whether its snapshot is still found locally as a snapshot or a bookmark, the
+local snapshots taken since that were not backed up yet, the length of the incremental chain, and whether the
+next "smart" backup would be a full or an incremental backup are listed. The same "smart" options as the send
+command can be given to predict the next backup, --increment is assumed if none are. Use the --jsonOutput flag
+for use by monitoring scripts.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeLocalDatasets),
+	PreRunE:           validateStatusFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Status(cmd.Context(), &jobInfo, args[0], args[1])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().BoolVar(
+		&jobInfo.Incremental,
+		"increment",
+		false,
+		"predict the next backup as if it was taken with the --increment option of send. This is the default.",
+	)
+	statusCmd.Flags().BoolVar(
+		&jobInfo.Differential,
+		"differential",
+		false,
+		"predict the next backup as if it was taken with the --differential option of send.",
+	)
+	statusCmd.Flags().DurationVar(
+		&jobInfo.FullIfOlderThan,
+		"fullIfOlderThan",
+		-1*time.Minute,
+		"predict the next backup as if it was taken with the --fullIfOlderThan option of send.",
+	)
+	statusCmd.Flags().IntVar(
+		&jobInfo.MaxChainLength,
+		"maxChainLength",
+		0,
+		"used with the --increment option to predict a full backup once the incremental chain already has this many "+
+			"incremental backups. Use 0 for no limit.",
+	)
+	statusCmd.Flags().DurationVar(
+		&jobInfo.MaxChainAge,
+		"maxChainAge",
+		0,
+		"used with the --increment option to predict a full backup once the full backup the incremental chain started "+
+			"with is older than this, relative to the latest snapshot. Use 0 for no limit.",
+	)
+	statusCmd.Flags().StringVar(
+		&jobInfo.SnapshotPrefix,
+		"snapshotPrefix",
+		"",
+		"Only consider snapshots starting with the given snapshot prefix",
+	)
+	statusCmd.Flags().StringVar(
+		&jobInfo.SnapshotRegexp,
+		"snapshotRegexp",
+		"",
+		"Only consider snapshots matching given regex",
+	)
+}
+
+func validateStatusFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	smartOptions := 0
+	for _, set := range []bool{jobInfo.Incremental, jobInfo.Differential, jobInfo.FullIfOlderThan != -1*time.Minute} {
+		if set {
+			smartOptions++
+		}
+	}
+	if smartOptions > 1 {
+		log.AppLogger.Errorf("Please specify only one \"smart\" option at a time")
+		return errInvalidInput
+	}
+
+	if _, err := regexp.Compile(jobInfo.SnapshotRegexp); err != nil {
+		log.AppLogger.Errorf("Invalid snapshot regex provided, was given %s - %v", jobInfo.SnapshotRegexp, err)
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args[1:])
+}
@@ -0,0 +1,71 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync [flags] source_uri destination_uri",
+	Short: "sync will copy any volumes and manifests missing or corrupt in the destination target from the source target.",
+	Long: `sync will copy any volumes and manifests missing or corrupt in the destination target from the source target.
+Use this to repair a mirror that was unreachable during past backups. Volumes are verified against the sizes and
+checksums recorded in the manifests where the target can report them. Manifests are copied after their volumes.`,
+	PreRunE: validateSyncFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.Sync(cmd.Context(), &jobInfo, args[0], args[1])
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(syncCmd)
+
+	addTransferFlags(syncCmd)
+}
+
+func validateSyncFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	if err := validateTransferFlags(); err != nil {
+		return err
+	}
+
+	if strings.TrimRight(args[0], "/") == strings.TrimRight(args[1], "/") {
+		log.AppLogger.Errorf("The source and destination targets must be different.")
+		return errInvalidInput
+	}
+
+	return validateTargetURIs(args)
+}
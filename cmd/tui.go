@@ -0,0 +1,76 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var tuiVerifySample int
+
+// tuiCmd represents the tui command
+var tuiCmd = &cobra.Command{
+	Use:   "tui [flags] uri",
+	Short: "tui will run a terminal UI to browse, verify and restore the backup sets found in the target.",
+	Long: `tui will run a terminal UI to browse, verify and restore the backup sets found in the target.
+The datasets backed up are listed first, opening one lists its backup sets newest first, and opening a backup set
+shows its manifest. Use the arrow keys (or j and k) to move, enter to open, escape to go back and q to quit. Press v
+to verify the backup sets of the dataset or the backup set selected, d for a dry run of its restore, and r to restore
+it, restoring the latest backup set of a dataset. The local volume to restore into is asked for, and a restore must
+be confirmed. The UI is left while an action runs, so its output shows in the terminal as usual.`,
+	SilenceErrors: true,
+	PreRunE:       validateTUIFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return backup.TUI(cmd.Context(), &jobInfo, args[0], tuiVerifySample)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(tuiCmd)
+
+	tuiCmd.Flags().IntVar(
+		&tuiVerifySample,
+		"verifySample",
+		1,
+		"the number of volumes of each backup set read back when verifying from the UI, 0 to read every volume.",
+	)
+}
+
+func validateTUIFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 1 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if tuiVerifySample < 0 {
+		log.AppLogger.Errorf("The number of volumes to sample cannot be negative, was given %d", tuiVerifySample)
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	return validateTargetURIs(args)
+}
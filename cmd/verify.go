@@ -0,0 +1,125 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package cmd
+
+import (
+	"path"
+
+	"github.com/spf13/cobra"
+
+	"github.com/jdfalk/zfsbackup-go/backup"
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+var (
+	verifyCryptoOnly bool
+	verifyDigests    bool
+	verifySample     int
+)
+
+// verifyCmd represents the verify command
+var verifyCmd = &cobra.Command{
+	Use:   "verify [flags] filesystem|volume uri",
+	Short: "verify will check the backup sets of a volume in the target can still be read back.",
+	Long: `verify will check the backup sets of a volume in the target can still be read back.
+The volume can be a glob pattern (e.g. pool/data*) to verify the backup sets of every matching volume.
+
+By default, every volume is downloaded in full to confirm its size and digest match the ones recorded in the
+manifest, then read back through decryption, signature verification and decompression to confirm the zfs stream
+it holds matches the one backed up, without restoring anything. Use the --sample option to only check a few
+volumes picked at random per backup set.
+
+With the --cryptoOnly option, only the first bytes of each volume are downloaded to confirm they decrypt, and
+were signed by the expected key, with the keys provided. This proves the keys still work without a full restore.
+
+With the --digests option, every volume is downloaded in full to confirm its size and digest still match the
+ones recorded in the manifest when it was uploaded, catching volumes corrupted in the target or in transit.
+Exits with an error if any backup set failed verification.`,
+	SilenceErrors:     true,
+	ValidArgsFunction: completeArgs(completeBackedUpVolumes),
+	PreRunE:           validateVerifyFlags,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		switch {
+		case verifyDigests:
+			return backup.VerifyDigests(cmd.Context(), &jobInfo, args[0], args[1], verifySample)
+		case verifyCryptoOnly:
+			return backup.VerifyCrypto(cmd.Context(), &jobInfo, args[0], args[1])
+		default:
+			return backup.VerifyBackupSets(cmd.Context(), &jobInfo, args[0], args[1], verifySample)
+		}
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().BoolVar(
+		&verifyCryptoOnly,
+		"cryptoOnly",
+		false,
+		"only download the start of each volume to check it decrypts and verifies with the keys provided.",
+	)
+	verifyCmd.Flags().BoolVar(
+		&verifyDigests,
+		"digests",
+		false,
+		"download each volume to check its size and digest match the ones recorded in the manifest.",
+	)
+	verifyCmd.Flags().IntVar(
+		&verifySample,
+		"sample",
+		0,
+		"only check this many volumes, picked at random, of each backup set. 0 checks every volume.",
+	)
+}
+
+func validateVerifyFlags(cmd *cobra.Command, args []string) error {
+	if len(args) != 2 {
+		_ = cmd.Usage()
+		return errInvalidInput
+	}
+
+	if verifyCryptoOnly && verifyDigests {
+		log.AppLogger.Errorf("Only one of the --cryptoOnly or --digests verifications can be selected.")
+		return errInvalidInput
+	}
+
+	if verifySample < 0 {
+		log.AppLogger.Errorf("The number of volumes to sample cannot be negative, was given %d", verifySample)
+		return errInvalidInput
+	}
+
+	if verifySample > 0 && verifyCryptoOnly {
+		log.AppLogger.Errorf("The --sample option cannot be used with --cryptoOnly, which already only reads the start of every volume.")
+		return errInvalidInput
+	}
+
+	if err := loadReceiveKeys(); err != nil {
+		return err
+	}
+
+	if _, err := path.Match(args[0], ""); err != nil {
+		log.AppLogger.Errorf("Invalid volume name pattern provided, was given %s - %v", args[0], err)
+		return errInvalidInput
+	}
+
+	return validateTargetURIs(args[1:])
+}
@@ -8,12 +8,24 @@ import (
 )
 
 var (
+	// Stdin is where externally produced streams are read from
+	Stdin io.Reader = os.Stdin
 	// Stdout is where to output standard messaging to
 	Stdout io.Writer = os.Stdout
 	// JSONOutput will signal if we should dump the results to Stdout JSON formatted
 	JSONOutput = false
+	// ShowProgress will signal if we should display the progress of sends and receives
+	ShowProgress = false
+	// ManifestDB will signal if decoded manifests should be kept in a database in the working directory
+	ManifestDB = false
+	// ManifestGenerations is how many superseded generations of a manifest are kept when it is written again
+	ManifestGenerations = 3
+	// FIPS restricts the ciphers, hashes, and keys used to FIPS approved algorithms, see the fips build tag
+	FIPS = FIPSBuild
 	// BackupUploadBucket is the bandwidth rate-limit bucket if we need one.
 	BackupUploadBucket *ratelimit.Bucket
+	// BackupDownloadBucket is the bandwidth rate-limit bucket for downloads if we need one.
+	BackupDownloadBucket *ratelimit.Bucket
 	// BackupTempdir is the scratch space for our output
 	BackupTempdir string
 	// WorkingDir is the directory that all the cache/scratch work is done for this program
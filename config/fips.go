@@ -0,0 +1,6 @@
+//go:build fips
+
+package config
+
+// FIPSBuild is true for builds with the fips tag, which always run in FIPS mode.
+const FIPSBuild = true
@@ -0,0 +1,6 @@
+//go:build !fips
+
+package config
+
+// FIPSBuild is false for builds without the fips tag; FIPS mode is then enabled by configuration.
+const FIPSBuild = false
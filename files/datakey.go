@@ -0,0 +1,79 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package files
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// dataKeyManifestMagic starts the manifests encrypted with the data key of their backup. It is followed by the
+// wrapped data key on a single line, so it can be unwrapped before the rest is decrypted with it.
+const dataKeyManifestMagic = "zfsbackup-datakey-manifest/1\n"
+
+// EncryptedManifestError is returned when reading a manifest encrypted with the data key of its backup without the
+// data key. Unwrap one of the WrappedKeys and read the manifest again with the data key as an age identity.
+type EncryptedManifestError struct {
+	WrappedKeys []WrappedKey
+}
+
+func (e *EncryptedManifestError) Error() string {
+	return fmt.Sprintf("the manifest is encrypted with a data key wrapped by %d key management service key(s)", len(e.WrappedKeys))
+}
+
+// writeDataKeyHeader writes the header of a manifest encrypted with the data key wrapped as wrapped.
+func writeDataKeyHeader(w io.Writer, wrapped []WrappedKey) error {
+	line, err := json.Marshal(wrapped)
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, dataKeyManifestMagic); err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// readDataKeyHeader returns the wrapped data key the manifest read from r is encrypted with, or nil if it is not.
+// The header is consumed from r when present.
+func readDataKeyHeader(r *bufio.Reader) ([]WrappedKey, error) {
+	magic, err := r.Peek(len(dataKeyManifestMagic))
+	if err != nil || !bytes.Equal(magic, []byte(dataKeyManifestMagic)) {
+		// Not encrypted with a data key, anything too short to be is left for the decompressor to report
+		return nil, nil
+	}
+	if _, err = r.Discard(len(dataKeyManifestMagic)); err != nil {
+		return nil, err
+	}
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("could not read the wrapped data key of the manifest - %v", err)
+	}
+	var wrapped []WrappedKey
+	if err = json.Unmarshal(line, &wrapped); err != nil {
+		return nil, fmt.Errorf("could not decode the wrapped data key of the manifest - %v", err)
+	}
+	return wrapped, nil
+}
@@ -0,0 +1,102 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package files
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"github.com/zeebo/blake3"
+)
+
+const (
+	// DigestSHA256 is the default algorithm volumes are digested with, recorded in VolumeInfo.SHA256Sum
+	DigestSHA256 = "sha256"
+	// DigestSHA512 digests volumes with SHA-512, faster than SHA-256 on 64-bit CPUs without SHA extensions
+	DigestSHA512 = "sha512"
+	// DigestBLAKE3 digests volumes with BLAKE3, much faster than either on large volumes but not FIPS approved
+	DigestBLAKE3 = "blake3"
+)
+
+// NewDigest returns a hash computing the digest of the algorithm named, SHA-256 when none is.
+func NewDigest(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "", DigestSHA256:
+		return sha256.New(), nil
+	case DigestSHA512:
+		return sha512.New(), nil
+	case DigestBLAKE3:
+		return blake3.New(), nil
+	default:
+		return nil, fmt.Errorf(
+			"the digest algorithm provided (%s) must be one of %s, %s, or %s", algorithm, DigestSHA256, DigestSHA512, DigestBLAKE3,
+		)
+	}
+}
+
+// UseDigest will digest the volume with the algorithm named instead of SHA-256. It must be called before anything is
+// written to the volume.
+func (v *VolumeInfo) UseDigest(algorithm string) error {
+	if algorithm == "" || algorithm == DigestSHA256 {
+		return nil
+	}
+	digest, err := NewDigest(algorithm)
+	if err != nil {
+		return err
+	}
+	v.DigestAlgorithm = algorithm
+	v.Digest = digest
+	v.SHA256 = nil
+	return nil
+}
+
+// Checksum returns the digest of the volume computed with the algorithm returned by ChecksumAlgorithm.
+func (v *VolumeInfo) Checksum() string {
+	if v.DigestAlgorithm != "" {
+		return v.DigestSum
+	}
+	return v.SHA256Sum
+}
+
+// ChecksumAlgorithm returns the algorithm the volume was digested with.
+func (v *VolumeInfo) ChecksumAlgorithm() string {
+	if v.DigestAlgorithm != "" {
+		return v.DigestAlgorithm
+	}
+	return DigestSHA256
+}
+
+// digestWriter feeds the writes made to the volume to whichever digest it computes.
+type digestWriter struct {
+	v *VolumeInfo
+}
+
+func (d digestWriter) Write(p []byte) (int, error) {
+	if d.v.SHA256 != nil {
+		d.v.SHA256.Write(p)
+	}
+	if d.v.Digest != nil {
+		d.v.Digest.Write(p)
+	}
+	return len(p), nil
+}
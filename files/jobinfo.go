@@ -21,32 +21,59 @@
 package files
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"fmt"
+	"math/bits"
+	"path"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"time"
 
+	"filippo.io/age"
 	humanize "github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
 	"golang.org/x/crypto/openpgp"
 
+	"github.com/jdfalk/zfsbackup-go/config"
 	"github.com/jdfalk/zfsbackup-go/log"
 )
 
 var disallowedSeps = regexp.MustCompile(`^[\w\-:\.]+`) // Disallowed by ZFS
 
+const (
+	// TargetPolicyAll requires every target to accept every volume for a backup to succeed.
+	TargetPolicyAll = "all"
+	// TargetPolicyQuorum requires a majority of the targets to accept every volume for a backup to succeed.
+	TargetPolicyQuorum = "quorum"
+	// TargetPolicyAny requires at least one target to accept every volume for a backup to succeed.
+	TargetPolicyAny = "any"
+)
+
 // JobInfo represents the relevant information for a job that can be used to read
 // in details of that job at a later time.
 type JobInfo struct {
-	StartTime                    time.Time
-	EndTime                      time.Time
-	VolumeName                   string
-	BaseSnapshot                 SnapshotInfo
-	IncrementalSnapshot          SnapshotInfo
-	SnapshotPrefix               string
-	SnapshotRegexp               string
-	Raw                          bool
-	Compressor                   string
-	CompressionLevel             int
+	StartTime           time.Time
+	EndTime             time.Time
+	VolumeName          string
+	BaseSnapshot        SnapshotInfo
+	IncrementalSnapshot SnapshotInfo
+	SnapshotPrefix      string
+	SnapshotRegexp      string
+	Raw                 bool
+	Compressed          bool
+	LargeBlocks         bool
+	EmbeddedData        bool
+	Compressor          string
+	CompressionLevel    int
+	CompressionThreads  int    `json:"-"`
+	Decompressor        string `json:",omitempty"`
+	// The base 2 log of the window size of the internal zstd compressor, larger windows find matches further apart
+	ZstdWindowLog int `json:",omitempty"`
+	// The dictionary the internal zstd compressor was primed with, needed to decompress the volumes
+	ZstdDictionary               []byte `json:",omitempty"`
 	Separator                    string
 	ZFSCommandLine               string
 	ZFSStreamBytes               uint64
@@ -61,10 +88,83 @@ type JobInfo struct {
 	IntermediaryIncremental      bool
 	SmartIntermediaryIncremental bool
 	Resume                       bool `json:"-"`
+	// Inspect the start of zvols for partition tables and filesystem signatures to record in the manifest
+	ZvolSignatures bool `json:"-"`
+	// Read the stream to backup from stdin instead of running zfs send
+	Stdin bool `json:"-"`
+	// Pipe volumes straight to the target and keep manifests in memory so nothing is written to the working directory
+	NoCache bool `json:"-"`
+	// Backup every filesystem and volume beneath VolumeName as its own backup set
+	Recursive bool `json:"-"`
+	// The volume a recursive backup was started from, empty for non-recursive backups
+	RecursiveRoot string `json:",omitempty"`
+	// Patterns selecting which datasets beneath the root a recursive backup included or excluded
+	Include []string `json:",omitempty"`
+	Exclude []string `json:",omitempty"`
+	// Targets this backup set still needs to be replicated to, see the replicate command's --pending option
+	PendingTargets []string `json:",omitempty"`
+	// The compression property of the volume when a compressed stream was sent
+	StreamCompression string `json:",omitempty"`
+	// Volumes are named after a hash of their content so identical data is only stored once per target
+	ContentAddressed bool `json:",omitempty"`
+	// Details of the zvol backed up, nil for filesystems
+	Zvol *ZvolInfo `json:",omitempty"`
+	// The guid of the snapshot backed up, zfs receive preserves it so a restore can be checked against it
+	SnapshotGUID string `json:",omitempty"`
+	// The guid of the dataset backed up, it changes when a dataset is destroyed and created again but not when renamed
+	DatasetGUID string `json:",omitempty"`
+	// Where the backup was taken, so backups of many machines sharing a target can be told apart
+	Hostname string `json:",omitempty"`
+	PoolName string `json:",omitempty"`
+	PoolGUID string `json:",omitempty"`
+	// The age recipients the volumes were encrypted to, set when age is used instead of OpenPGP
+	AgeRecipients []string `json:",omitempty"`
+	// The data key the volumes were encrypted with, wrapped by each key management service key provided
+	WrappedKeys []WrappedKey `json:",omitempty"`
+	// The number of times the volumes were encrypted again with new keys, see the rekey command
+	KeyGeneration int `json:",omitempty"`
+	// Objects are named after an HMAC of the volume and snapshot names instead, so only the encrypted manifest holds
+	// them. The HMAC is keyed with NamesKey, which is not stored in the manifest.
+	HideNames bool `json:",omitempty"`
+	// The hidden names the objects of the backup set were given, by the names they hide, so they can be found again
+	// without the NamesKey
+	HiddenNames map[string]string `json:",omitempty"`
+	// Volumes of incompressible data are stored without compression, see VolumeInfo.StoreOnly
+	AdaptiveCompression bool `json:",omitempty"`
+	// What compressing the volumes bought, recorded once the backup completed
+	Compression *CompressionStats `json:",omitempty"`
+	// The version of the manifest format, see ManifestSchemaVersion
+	SchemaVersion int `json:",omitempty"`
+	// How the manifest is encoded, see EncodeManifest
+	ManifestEncoding string `json:",omitempty"`
+	// The algorithm the volumes are digested with, see NewDigest
+	DigestAlgorithm string `json:",omitempty"`
+	// Labels given with the --tag option to tell backup sets apart, e.g. a one-off backup from the nightly ones
+	Tags map[string]string `json:",omitempty"`
+	// How many times the manifest was written again, the generations it superseded are kept, see ManifestGenerationName
+	ManifestGeneration int `json:",omitempty"`
+	// The properties set locally on the volume when it was backed up, see the receive command's --restoreProperties option
+	LocalProperties map[string]string `json:",omitempty"`
 	// "Smart" Options
 	Full            bool          `json:"-"`
 	Incremental     bool          `json:"-"`
 	FullIfOlderThan time.Duration `json:"-"`
+	Differential    bool          `json:"-"`
+	MaxChainLength  int           `json:"-"`
+	MaxChainAge     time.Duration `json:"-"`
+	SnapshotBefore  string        `json:"-"`
+	// Tag of the zfs hold placed on snapshots active incremental chains depend on, empty to disable
+	HoldTag string `json:"-"`
+	// Snapshot of the full backup the incremental chain of a fullIfOlderThan backup continues from
+	ChainFullSnapshot SnapshotInfo `json:"-"`
+	// Daily window (HH:MM-HH:MM, local time) uploads are allowed in, empty to allow uploads at any time
+	UploadWindow string `json:"-"`
+	// Mark the volume as being backed up with an object in each target, so runs from other hosts are refused as well
+	TargetLock bool `json:"-"`
+	// How long the lock object can go without being refreshed before it is considered left over by a crashed run
+	LockTimeout time.Duration `json:"-"`
+	// Remove the lock object of the volume from each target, whether it is stale or not, before backing it up
+	BreakLock bool `json:"-"`
 
 	// ZFS Receive options
 	Force       bool   `json:"-"`
@@ -74,18 +174,102 @@ type JobInfo struct {
 	Origin      string `json:"-"`
 	LocalVolume string `json:"-"`
 	AutoRestore bool   `json:"-"`
+	// Previous manifest version to restore with (versioned targets only)
+	ManifestVersion string `json:"-"`
+	// Discard the state left on the local volume by an interrupted resumable receive before restoring
+	AbortPartial bool `json:"-"`
+	// Directory to write the zfs stream of each backup set restored to instead of running zfs receive
+	ToFile string `json:"-"`
+	// Check the zfs stream and the restored snapshot against the digests and guid recorded when backing up
+	Verify bool `json:"-"`
+	// Properties to exclude from the stream when receiving, see the -x flag on zfs recv
+	ExcludeProperties []string `json:"-"`
+	// Load the key of natively encrypted datasets once received, after setting their keylocation if provided
+	LoadKey     bool   `json:"-"`
+	KeyLocation string `json:"-"`
+	// Set the properties recorded in the manifest on the volume once received, less the ExcludeProperties
+	RestoreProperties bool `json:"-"`
+	// Restore only the latest full backup, skipping the incremental backups after it
+	FullOnly bool `json:"-"`
+	// Discard the local data a forced receive (-F) rolls back or destroys without asking for confirmation
+	AssumeYes bool `json:"-"`
+
+	Destinations       []string              `json:"-"`
+	TargetPolicy       string                `json:"-"`
+	VolumeSize         uint64                `json:"-"`
+	ManifestPrefix     string                `json:"-"`
+	ObjectPrefix       string                `json:"-"`
+	MaxBackoffTime     time.Duration         `json:"-"`
+	MaxRetryTime       time.Duration         `json:"-"`
+	MaxParallelUploads int                   `json:"-"`
+	MaxFileBuffer      int                   `json:"-"`
+	EncryptKey         *openpgp.Entity       `json:"-"`
+	SignKey            *openpgp.Entity       `json:"-"`
+	AgeRecipientKeys   []age.Recipient       `json:"-"`
+	AgeIdentities      []age.Identity        `json:"-"`
+	NamesKey           []byte                `json:"-"`
+	GPGAgent           bool                  `json:"-"`
+	KMSKeys            []string              `json:"-"`
+	DatasetKeys        []*DatasetKeys        `json:"-"`
+	DatasetCompression []*DatasetCompression `json:"-"`
+	ParentSnap         *JobInfo              `json:"-"`
+	UploadChunkSize    int                   `json:"-"`
+}
+
+// DatasetKeys are the keys used instead of the job's to backup the datasets matching Dataset, a glob pattern, and
+// the datasets beneath them.
+type DatasetKeys struct {
+	Dataset    string
+	EncryptTo  string          `json:",omitempty"`
+	SignFrom   string          `json:",omitempty"`
+	EncryptKey *openpgp.Entity `json:"-"`
+	SignKey    *openpgp.Entity `json:"-"`
+}
+
+// DatasetCompression is the compression used instead of the job's to backup the datasets matching Dataset, a glob
+// pattern, and the datasets beneath them. An empty Compressor keeps the job's, use NoCompressor to disable it.
+type DatasetCompression struct {
+	Dataset          string
+	Compressor       string `json:",omitempty"`
+	CompressionLevel int    `json:",omitempty"`
+	Decompressor     string `json:",omitempty"`
+}
+
+// CompressionStats describe how well the volumes of a backup compressed.
+type CompressionStats struct {
+	// RawBytes is the size of the zfs send stream and CompressedBytes its size once compressed
+	RawBytes        uint64
+	CompressedBytes uint64
+	// Ratio is RawBytes divided by CompressedBytes
+	Ratio float64
+	// Throughput is the number of raw bytes written to the volumes per second
+	Throughput float64
+}
+
+// WrappedKey is the data key of a backup as encrypted by a key management service key.
+type WrappedKey struct {
+	KeyURI     string
+	Ciphertext []byte
+}
+
+// ZvolInfo describes the zvol a backup was taken of, so operators know what it contains before restoring it.
+type ZvolInfo struct {
+	VolSize        uint64
+	VolBlockSize   uint64
+	PartitionTable string `json:",omitempty"`
+	Filesystem     string `json:",omitempty"`
+}
 
-	Destinations       []string        `json:"-"`
-	VolumeSize         uint64          `json:"-"`
-	ManifestPrefix     string          `json:"-"`
-	MaxBackoffTime     time.Duration   `json:"-"`
-	MaxRetryTime       time.Duration   `json:"-"`
-	MaxParallelUploads int             `json:"-"`
-	MaxFileBuffer      int             `json:"-"`
-	EncryptKey         *openpgp.Entity `json:"-"`
-	SignKey            *openpgp.Entity `json:"-"`
-	ParentSnap         *JobInfo        `json:"-"`
-	UploadChunkSize    int             `json:"-"`
+// String describes the zvol on a single line.
+func (z *ZvolInfo) String() string {
+	output := fmt.Sprintf("%d bytes (%s), volblocksize %s", z.VolSize, humanize.IBytes(z.VolSize), humanize.IBytes(z.VolBlockSize))
+	if z.PartitionTable != "" {
+		output += fmt.Sprintf(", %s partition table", z.PartitionTable)
+	}
+	if z.Filesystem != "" {
+		output += fmt.Sprintf(", %s signature", z.Filesystem)
+	}
+	return output
 }
 
 // SnapshotInfo represents a snapshot with relevant information.
@@ -115,8 +299,120 @@ func (j *JobInfo) TotalBytesWritten() uint64 {
 	return total
 }
 
+// CompressionSummary sums up how well the volumes of the backup compressed, or returns nil for backups whose volumes
+// did not record their compressed size.
+func (j *JobInfo) CompressionSummary() *CompressionStats {
+	stats := new(CompressionStats)
+	var elapsed time.Duration
+	for _, vol := range j.Volumes {
+		if vol.CompressedBytes == 0 {
+			return nil
+		}
+		stats.RawBytes += vol.ZFSStreamBytes
+		stats.CompressedBytes += vol.CompressedBytes
+		elapsed += vol.CloseTime.Sub(vol.CreateTime)
+	}
+	if stats.CompressedBytes == 0 {
+		return nil
+	}
+
+	stats.Ratio = float64(stats.RawBytes) / float64(stats.CompressedBytes)
+	if elapsed > 0 {
+		stats.Throughput = float64(stats.RawBytes) / elapsed.Seconds()
+	}
+	return stats
+}
+
+// TagsString returns the tags of the backup set as a sorted, comma separated list of key=value pairs.
+func (j *JobInfo) TagsString() string {
+	return joinPairs(j.Tags)
+}
+
+// joinPairs returns the map as a sorted, comma separated list of key=value pairs.
+func joinPairs(pairs map[string]string) string {
+	joined := make([]string, 0, len(pairs))
+	for key, value := range pairs {
+		joined = append(joined, key+"="+value)
+	}
+	sort.Strings(joined)
+	return strings.Join(joined, ",")
+}
+
+// compressionThreads returns how many blocks of a volume the internal compressors may compress in parallel, defaulting
+// to one per CPU.
+func (j *JobInfo) compressionThreads() int {
+	if j.CompressionThreads > 0 {
+		return j.CompressionThreads
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// zstdEncoderOptions returns the options of the internal zstd compressor.
+func (j *JobInfo) zstdEncoderOptions() []zstd.EOption {
+	options := []zstd.EOption{
+		zstd.WithEncoderLevel(zstdLevel(j.CompressionLevel)),
+		zstd.WithEncoderConcurrency(j.compressionThreads()),
+	}
+	if j.ZstdWindowLog > 0 {
+		options = append(options, zstd.WithWindowSize(1<<j.ZstdWindowLog))
+	}
+	if len(j.ZstdDictionary) > 0 {
+		options = append(options, zstd.WithEncoderDict(j.ZstdDictionary))
+	}
+	return options
+}
+
+// zstdDecoderOptions returns the options to decompress what the internal zstd compressor produced.
+func (j *JobInfo) zstdDecoderOptions() []zstd.DOption {
+	options := []zstd.DOption{zstd.WithDecoderConcurrency(j.compressionThreads())}
+	if j.ZstdWindowLog > 0 {
+		options = append(options, zstd.WithDecoderMaxWindow(1<<j.ZstdWindowLog))
+	}
+	if len(j.ZstdDictionary) > 0 {
+		options = append(options, zstd.WithDecoderDicts(j.ZstdDictionary))
+	}
+	return options
+}
+
+// compressorArgs returns the command line of the external compressor. A compressor given with its own arguments, such
+// as "zstd -T0 -19", is run as given, otherwise the gzip style options to compress to stdout are added.
+func (j *JobInfo) compressorArgs() []string {
+	args := strings.Fields(j.Compressor)
+	if len(args) > 1 {
+		return args
+	}
+	return append(args, "-c", fmt.Sprintf("-%d", j.CompressionLevel))
+}
+
+// decompressorArgs returns the command line of the external decompressor, the Decompressor when one was given or the
+// compressor binary with the gzip style options to decompress to stdout.
+func (j *JobInfo) decompressorArgs() []string {
+	if args := strings.Fields(j.Decompressor); len(args) > 0 {
+		return args
+	}
+	return []string{j.compressorBinary(), "-c", "-d"}
+}
+
+// compressorBinary returns the binary of the external compressor, without its arguments.
+func (j *JobInfo) compressorBinary() string {
+	if args := strings.Fields(j.Compressor); len(args) > 0 {
+		return args[0]
+	}
+	return j.Compressor
+}
+
 // String will return a string representation of this JobInfo.
 func (j *JobInfo) String() string {
+	return j.describe(false)
+}
+
+// LongString will return a string representation of this JobInfo along with how well it compressed and the details of
+// each of its volumes.
+func (j *JobInfo) LongString() string {
+	return j.describe(true)
+}
+
+func (j *JobInfo) describe(long bool) string {
 	var output []string
 	output = append(
 		output,
@@ -138,11 +434,84 @@ func (j *JobInfo) String() string {
 		fmt.Sprintf("Replication: %v", j.Replication),
 		fmt.Sprintf("SkipMissing: %v", j.SkipMissing),
 		fmt.Sprintf("Raw: %v", j.Raw),
+		fmt.Sprintf("Compressed: %v", j.CompressedStream()),
+		fmt.Sprintf("LargeBlocks: %v", j.LargeBlocks),
+		fmt.Sprintf("EmbeddedData: %v", j.EmbeddedData),
+	)
+	if j.Zvol != nil {
+		output = append(output, fmt.Sprintf("Zvol: %s", j.Zvol.String()))
+	}
+	if len(j.Tags) > 0 {
+		output = append(output, fmt.Sprintf("Tags: %s", j.TagsString()))
+	}
+	if long && j.Hostname != "" {
+		output = append(output, fmt.Sprintf(
+			"Host: %s (pool %s, guid %s), %s v%.2g", j.Hostname, j.PoolName, j.PoolGUID, config.ProgramName, j.Version,
+		))
+	}
+	if long && j.DatasetGUID != "" {
+		output = append(output, fmt.Sprintf("GUID: dataset %s, snapshot %s", j.DatasetGUID, j.SnapshotGUID))
+	}
+	if long && len(j.LocalProperties) > 0 {
+		output = append(output, fmt.Sprintf("Properties: %s", joinPairs(j.LocalProperties)))
+	}
+	output = append(
+		output,
 		fmt.Sprintf("Archives: %d - %d bytes (%s)", len(j.Volumes), totalWrittenBytes, humanize.IBytes(totalWrittenBytes)),
 		fmt.Sprintf("Volume Size (Raw): %d bytes (%s)", j.ZFSStreamBytes, humanize.IBytes(j.ZFSStreamBytes)),
-		fmt.Sprintf("Uploaded: %v (took %v)\n\n", j.StartTime, j.EndTime.Sub(j.StartTime)),
 	)
-	return strings.Join(output, "\n\t")
+	if !long {
+		output = append(output, fmt.Sprintf("Uploaded: %v (took %v)\n\n", j.StartTime, j.EndTime.Sub(j.StartTime)))
+		return strings.Join(output, "\n\t")
+	}
+
+	output = append(output, fmt.Sprintf("Compressor: %s (level %d)", j.compressorDescription(), j.CompressionLevel))
+	if stats := j.Compression; stats != nil {
+		output = append(output, fmt.Sprintf(
+			"Compression: %s compressed to %s, %.2fx ratio, %s/s",
+			humanize.IBytes(stats.RawBytes), humanize.IBytes(stats.CompressedBytes), stats.Ratio, humanize.IBytes(uint64(stats.Throughput)),
+		))
+	} else {
+		output = append(output, "Compression: not recorded")
+	}
+	output = append(output, fmt.Sprintf("Uploaded: %v (took %v)", j.StartTime, j.EndTime.Sub(j.StartTime)))
+	for _, vol := range j.Volumes {
+		line := fmt.Sprintf("Volume %d: %s - %s", vol.VolumeNumber, vol.ObjectName, humanize.IBytes(vol.Size))
+		if vol.CompressedBytes > 0 {
+			line += fmt.Sprintf(
+				", %s compressed to %s (%.2fx)", humanize.IBytes(vol.ZFSStreamBytes), humanize.IBytes(vol.CompressedBytes),
+				float64(vol.ZFSStreamBytes)/float64(vol.CompressedBytes),
+			)
+		}
+		if vol.StoreOnly {
+			line += ", stored without compression"
+		}
+		output = append(output, line)
+	}
+	return strings.Join(output, "\n\t") + "\n\n"
+}
+
+// compressorDescription names the compressor the volumes were compressed with.
+func (j *JobInfo) compressorDescription() string {
+	switch j.Compressor {
+	case "":
+		return "none"
+	case InternalCompressor:
+		return "internal gzip"
+	case InternalLZ4Compressor:
+		return "internal lz4"
+	case InternalZstdCompressor:
+		return "internal zstd"
+	case ZfsCompressor:
+		return "zfs compressed stream"
+	default:
+		return j.Compressor
+	}
+}
+
+// CompressedStream returns true if the zfs send stream for this job was, or will be, sent compressed.
+func (j *JobInfo) CompressedStream() bool {
+	return j.Compressed || j.Compressor == ZfsCompressor
 }
 
 // TotalBytesStreamedAndVols will sum up the streamed bytes of all underlying Volumes to give a total
@@ -190,10 +559,35 @@ func (j *JobInfo) ValidateSendFlags() error {
 		return fmt.Errorf("the max backoff time must be set to a value greater than 0. Was given %d", j.MaxBackoffTime)
 	}
 
+	// Lock objects are refreshed every quarter of the timeout, a shorter one would keep uploading them
+	if j.TargetLock && j.LockTimeout < time.Minute {
+		return fmt.Errorf("the lock timeout must be set to at least 1m. Was given %v", j.LockTimeout)
+	}
+
 	if j.CompressionLevel < 1 || j.CompressionLevel > 9 {
 		return fmt.Errorf("the compression level specified must be between 1 and 9. Was given %d", j.CompressionLevel)
 	}
 
+	if j.ZstdWindowLog != 0 && (1<<j.ZstdWindowLog < zstd.MinWindowSize || 1<<j.ZstdWindowLog > zstd.MaxWindowSize) {
+		return fmt.Errorf(
+			"the zstd window log must be between %d and %d. Was given %d",
+			bits.Len(zstd.MinWindowSize)-1, bits.Len(zstd.MaxWindowSize)-1, j.ZstdWindowLog,
+		)
+	}
+
+	if j.ZstdWindowLog != 0 || len(j.ZstdDictionary) > 0 {
+		// Creating an encoder checks the dictionary can be loaded
+		encoder, err := zstd.NewWriter(nil, j.zstdEncoderOptions()...)
+		if err != nil {
+			return fmt.Errorf("the zstd options are invalid - %v", err)
+		}
+		encoder.Close()
+	}
+
+	if j.CompressionThreads < 0 {
+		return fmt.Errorf("the compression threads must be set to a value greater than or equal to 0. Was given %d", j.CompressionThreads)
+	}
+
 	if disallowedSeps.MatchString(j.Separator) {
 		return fmt.Errorf(
 			"the separator provided (%s) should not be used as it can conflict with allowed characters in zfs components",
@@ -205,9 +599,105 @@ func (j *JobInfo) ValidateSendFlags() error {
 		return fmt.Errorf("the uploadChunkSize provided (%d) is not between 5 and 100", j.UploadChunkSize)
 	}
 
+	if !j.Recursive && (len(j.Include) > 0 || len(j.Exclude) > 0) {
+		return fmt.Errorf("the include and exclude options can only be used with the recursive option")
+	}
+
+	if j.MaxChainLength < 0 || j.MaxChainAge < 0 {
+		return fmt.Errorf("the max chain length and max chain age must be set to values greater than or equal to 0")
+	}
+
+	if (j.MaxChainLength > 0 || j.MaxChainAge > 0) && !j.Incremental {
+		return fmt.Errorf("the max chain length and max chain age options can only be used with the increment option")
+	}
+
+	if j.NoCache && j.Resume {
+		return fmt.Errorf("backups made with the noCache option keep no manifest in the working directory and cannot be resumed")
+	}
+
+	if j.ContentAddressed && j.MaxFileBuffer == 0 {
+		return fmt.Errorf("content addressed volumes must be hashed before they are uploaded and cannot be used with a maxFileBuffer of 0")
+	}
+
+	if j.UploadWindow != "" {
+		if _, _, err := ParseUploadWindow(j.UploadWindow); err != nil {
+			return err
+		}
+	}
+
+	if j.Recursive && j.Replication {
+		return fmt.Errorf("the recursive and replication options are mutually exclusive, a replication stream already includes all descendants")
+	}
+
+	switch j.ManifestEncoding {
+	case "", ManifestEncodingJSON, ManifestEncodingCBOR:
+	default:
+		return fmt.Errorf(
+			"the manifest encoding provided (%s) must be one of %s or %s",
+			j.ManifestEncoding, ManifestEncodingJSON, ManifestEncodingCBOR,
+		)
+	}
+
+	if _, err := NewDigest(j.DigestAlgorithm); err != nil {
+		return err
+	}
+
+	for key := range j.Tags {
+		if key == "" {
+			return fmt.Errorf("the tags provided must be in the key=value form with a non-empty key")
+		}
+	}
+
+	switch j.TargetPolicy {
+	case TargetPolicyAll, TargetPolicyQuorum, TargetPolicyAny:
+	default:
+		return fmt.Errorf(
+			"the target policy provided (%s) must be one of %s, %s, or %s",
+			j.TargetPolicy, TargetPolicyAll, TargetPolicyQuorum, TargetPolicyAny,
+		)
+	}
+
 	return nil
 }
 
+// ParseUploadWindow parses a daily window in the HH:MM-HH:MM format (e.g. 22:00-06:00), returning the start
+// and end of the window as offsets from midnight. The window spans midnight when it ends before it starts.
+func ParseUploadWindow(window string) (start, end time.Duration, err error) {
+	bounds := strings.Split(window, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("the upload window provided (%s) must be in the HH:MM-HH:MM format", window)
+	}
+
+	offsets := make([]time.Duration, 2)
+	for idx, bound := range bounds {
+		t, perr := time.Parse("15:04", strings.TrimSpace(bound))
+		if perr != nil {
+			return 0, 0, fmt.Errorf("the upload window provided (%s) must be in the HH:MM-HH:MM format - %v", window, perr)
+		}
+		offsets[idx] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+
+	if offsets[0] == offsets[1] {
+		return 0, 0, fmt.Errorf("the upload window provided (%s) must start and end at different times", window)
+	}
+
+	return offsets[0], offsets[1], nil
+}
+
+// RequiredTargets returns how many of the provided number of targets must accept a volume
+// for it to be considered safely backed up under the configured target policy.
+func (j *JobInfo) RequiredTargets(total int) int {
+	switch j.TargetPolicy {
+	case TargetPolicyQuorum:
+		return total/2 + 1
+	case TargetPolicyAny:
+		if total > 0 {
+			return 1
+		}
+	}
+	return total
+}
+
 func (j *JobInfo) ManifestObjectName() string {
 	extensions := []string{"manifest"}
 	nameParts := []string{j.ManifestPrefix}
@@ -216,7 +706,183 @@ func (j *JobInfo) ManifestObjectName() string {
 	extensions = append(extensions, ext...)
 	nameParts = append(nameParts, baseParts...)
 
-	return fmt.Sprintf("%s.%s", strings.Join(nameParts, j.Separator), strings.Join(extensions, "."))
+	return fmt.Sprintf("%s%s.%s", j.ObjectNamespace(), strings.Join(nameParts, j.Separator), strings.Join(extensions, "."))
+}
+
+// UsesAge returns true if the volumes are encrypted with age instead of OpenPGP, either because the job was given age
+// keys or because the manifest records the age recipients the backup was encrypted to.
+func (j *JobInfo) UsesAge() bool {
+	return len(j.AgeRecipients) > 0 || len(j.AgeRecipientKeys) > 0 || len(j.AgeIdentities) > 0
+}
+
+// CopyKeys gives the manifest the keys loaded for the job that are needed to read its volumes, picking the
+// encryption scheme recorded in the manifest.
+func (j *JobInfo) CopyKeys(keys *JobInfo) {
+	if len(j.AgeRecipients) > 0 {
+		// The signing key only verifies the detached signatures of manifests
+		j.AgeIdentities = keys.AgeIdentities
+		j.SignKey = keys.SignKey
+		return
+	}
+	j.SignKey = keys.SignKey
+	j.EncryptKey = keys.EncryptKey
+	j.GPGAgent = keys.GPGAgent
+}
+
+// ApplyDatasetKeys will use the keys configured for the volume, or else for its closest parent, instead of the
+// job's. The first entry matching a dataset is used.
+func (j *JobInfo) ApplyDatasetKeys() {
+	for name := j.VolumeName; name != ""; name = parentDataset(name) {
+		for _, keys := range j.DatasetKeys {
+			if matched, _ := path.Match(keys.Dataset, name); !matched {
+				continue
+			}
+			j.EncryptTo, j.SignFrom = keys.EncryptTo, keys.SignFrom
+			j.EncryptKey, j.SignKey = keys.EncryptKey, keys.SignKey
+			log.AppLogger.Infof("Will be using the keys configured for %s to backup %s", keys.Dataset, j.VolumeName)
+			return
+		}
+	}
+}
+
+// ApplyDatasetCompression will use the compression configured for the volume, or else for its closest parent,
+// instead of the job's. The first entry matching a dataset is used.
+func (j *JobInfo) ApplyDatasetCompression() {
+	for name := j.VolumeName; name != ""; name = parentDataset(name) {
+		for _, compression := range j.DatasetCompression {
+			if matched, _ := path.Match(compression.Dataset, name); !matched {
+				continue
+			}
+			switch compression.Compressor {
+			case "":
+			case NoCompressor:
+				j.Compressor, j.Decompressor = "", ""
+			default:
+				j.Compressor, j.Decompressor = compression.Compressor, compression.Decompressor
+			}
+			if compression.CompressionLevel != 0 {
+				j.CompressionLevel = compression.CompressionLevel
+			}
+			if j.Compressor != InternalZstdCompressor {
+				j.ZstdWindowLog, j.ZstdDictionary = 0, nil
+			}
+			log.AppLogger.Infof("Will be using the compression configured for %s to backup %s", compression.Dataset, j.VolumeName)
+			return
+		}
+	}
+}
+
+// parentDataset returns the name of the dataset the one provided is beneath, if any.
+func parentDataset(name string) string {
+	idx := strings.LastIndex(name, "/")
+	if idx < 0 {
+		return ""
+	}
+	return name[:idx]
+}
+
+// usesKMS returns true if the data key of the backup is wrapped by a key management service. The manifest is left
+// unencrypted then, so the wrapped key can be read from it.
+func (j *JobInfo) usesKMS() bool {
+	return len(j.KMSKeys) > 0 || len(j.WrappedKeys) > 0
+}
+
+// usesGPGAgent returns true if the volumes are encrypted and/or signed through gpg-agent instead of the keyrings.
+func (j *JobInfo) usesGPGAgent() bool {
+	return j.GPGAgent && (j.EncryptTo != "" || j.SignFrom != "")
+}
+
+// ManifestListPrefix returns the prefix shared by the names of all manifest objects for this job's namespace.
+func (j *JobInfo) ManifestListPrefix() string {
+	return j.ObjectNamespace() + j.ManifestPrefix
+}
+
+// IndexListPrefix returns the prefix shared by the names of the index objects summarizing the backup sets of each
+// volume in this job's namespace.
+func (j *JobInfo) IndexListPrefix() string {
+	return j.ObjectNamespace() + "index" + j.Separator
+}
+
+// GenerationListPrefix returns the prefix shared by the names of the superseded generations of the manifests in this
+// job's namespace.
+func (j *JobInfo) GenerationListPrefix() string {
+	return j.ObjectNamespace() + "generations" + j.Separator
+}
+
+// ManifestGenerationPrefix returns the prefix shared by the names of the superseded generations of the manifest named
+// objectName.
+func (j *JobInfo) ManifestGenerationPrefix(objectName string) string {
+	return j.GenerationListPrefix() + strings.TrimPrefix(objectName, j.ObjectNamespace()) + j.Separator
+}
+
+// ManifestGenerationName returns the name of the given superseded generation of the manifest named objectName.
+func (j *JobInfo) ManifestGenerationName(objectName string, generation int) string {
+	return fmt.Sprintf("%s%06d", j.ManifestGenerationPrefix(objectName), generation)
+}
+
+// IndexObjectName returns the name of the object summarizing every backup set of the volume.
+func (j *JobInfo) IndexObjectName() string {
+	_, ext := j.volumeNameParts(true)
+	extensions := append([]string{"index"}, ext...)
+
+	name := j.VolumeName
+	if j.HideNames {
+		name = j.hiddenName(j.VolumeName)
+	}
+
+	return fmt.Sprintf("%s%s.%s", j.IndexListPrefix(), name, strings.Join(extensions, "."))
+}
+
+// LockListPrefix returns the prefix shared by the names of the objects marking the volumes being backed up in this
+// job's namespace.
+func (j *JobInfo) LockListPrefix() string {
+	return j.ObjectNamespace() + "locks" + j.Separator
+}
+
+// LockObjectName returns the name of the object marking the volume as being backed up.
+func (j *JobInfo) LockObjectName() string {
+	name := j.VolumeName
+	if j.HideNames {
+		name = j.hiddenName(j.VolumeName)
+	}
+	return j.LockListPrefix() + name + ".lock"
+}
+
+// hiddenName returns the name of an object under the HideNames option, an HMAC of the names provided keyed with the
+// NamesKey, so the names cannot be confirmed by guessing them without the key. Without the NamesKey, e.g. for a
+// manifest read back from a target, the hidden name recorded in the manifest is used.
+func (j *JobInfo) hiddenName(names ...string) string {
+	key := strings.Join(names, "\x00")
+	if hidden, ok := j.HiddenNames[key]; ok && len(j.NamesKey) == 0 {
+		return hidden
+	}
+	mac := hmac.New(sha256.New, j.NamesKey)
+	_, _ = mac.Write([]byte(key))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// RecordHiddenNames records the hidden names of the volume and of the backup set in the manifest, see HiddenNames.
+// Nothing is recorded without the NamesKey.
+func (j *JobInfo) RecordHiddenNames() {
+	if !j.HideNames || len(j.NamesKey) == 0 {
+		return
+	}
+	setParts := j.plainNameParts()
+	if j.HiddenNames == nil {
+		j.HiddenNames = make(map[string]string, 2)
+	}
+	j.HiddenNames[j.VolumeName] = j.hiddenName(j.VolumeName)
+	j.HiddenNames[strings.Join(setParts, "\x00")] = j.hiddenName(setParts...)
+}
+
+// ObjectNamespace returns the namespace, derived from the ObjectPrefix, that every object name for this job
+// starts with. This allows many hosts to share the same target without their objects colliding.
+func (j *JobInfo) ObjectNamespace() string {
+	prefix := strings.Trim(j.ObjectPrefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return prefix + "/"
 }
 
 func (j *JobInfo) BackupVolumeObjectName(volumeNumber int64) string {
@@ -226,16 +892,68 @@ func (j *JobInfo) BackupVolumeObjectName(volumeNumber int64) string {
 	extensions = append(extensions, ext...)
 	extensions = append(extensions, fmt.Sprintf("vol%d", volumeNumber))
 
-	return fmt.Sprintf("%s.%s", strings.Join(nameParts, j.Separator), strings.Join(extensions, "."))
+	return fmt.Sprintf("%s%s.%s", j.ObjectNamespace(), strings.Join(nameParts, j.Separator), strings.Join(extensions, "."))
+}
+
+// IsVolumeObject reports whether the object named holds a volume of a backup set, rather than a manifest, an index, a
+// lock or a signature, from the extensions its name ends with. Volume names may contain any of these extensions
+// themselves, so only the last one found is considered.
+func IsVolumeObject(name string) bool {
+	tokens := strings.Split(name, ".")
+	for idx := len(tokens) - 1; idx > 0; idx-- {
+		switch tokens[idx] {
+		case "zstream":
+			return true
+		case "manifest", "index", "lock":
+			return false
+		}
+	}
+	return false
+}
+
+// ContentVolumeObjectName returns the name a volume is stored under when content addressing is enabled.
+// The name is derived from the hex encoded SHA256 of the zfs stream bytes in the volume along with the
+// keys it is encrypted and signed with, so volumes only share an object when they can be restored the same way.
+func (j *JobInfo) ContentVolumeObjectName(streamSum string) string {
+	extensions := []string{"zstream"}
+	_, ext := j.volumeNameParts(false)
+	extensions = append(extensions, ext...)
+
+	key := streamSum
+	if j.EncryptTo != "" || j.SignFrom != "" || len(j.AgeRecipients) > 0 || len(j.WrappedKeys) > 0 {
+		parts := append([]string{streamSum, j.EncryptTo, j.SignFrom}, j.AgeRecipients...)
+		// Every backup has its own data key, so volumes are only shared within the backup
+		for _, wrapped := range j.WrappedKeys {
+			parts = append(parts, wrapped.KeyURI, fmt.Sprintf("%x", wrapped.Ciphertext))
+		}
+		key = fmt.Sprintf("%x", sha256.Sum256([]byte(strings.Join(parts, "\x00"))))
+	}
+
+	return fmt.Sprintf("%sobjects/%s/%s.%s", j.ObjectNamespace(), key[:2], key, strings.Join(extensions, "."))
+}
+
+// plainNameParts returns the volume and snapshot names the objects of the backup set are named after.
+func (j *JobInfo) plainNameParts() []string {
+	if j.IncrementalSnapshot.Name != "" {
+		return []string{j.VolumeName, j.IncrementalSnapshot.Name, "to", j.BaseSnapshot.Name}
+	}
+	return []string{j.VolumeName, j.BaseSnapshot.Name}
 }
 
 func (j *JobInfo) volumeNameParts(isManifest bool) (nameParts, extensions []string) {
 	extensions = make([]string, 0, 2)
 
-	if j.EncryptKey != nil || j.SignKey != nil {
+	if j.UsesAge() && !(isManifest && j.usesKMS()) {
+		extensions = append(extensions, "age")
+	} else if j.EncryptKey != nil || j.SignKey != nil || j.usesGPGAgent() {
 		extensions = append(extensions, "pgp")
 	}
 
+	// Rekeyed volumes get new names so the volumes the previous manifest references are left untouched
+	if !isManifest && j.KeyGeneration > 0 {
+		extensions = append(extensions, fmt.Sprintf("key%d", j.KeyGeneration))
+	}
+
 	compressorName := j.Compressor
 	if isManifest {
 		compressorName = InternalCompressor
@@ -244,16 +962,18 @@ func (j *JobInfo) volumeNameParts(isManifest bool) (nameParts, extensions []stri
 	switch compressorName {
 	case InternalCompressor:
 		extensions = append([]string{"gz"}, extensions...)
+	case InternalLZ4Compressor:
+		extensions = append([]string{"lz4"}, extensions...)
+	case InternalZstdCompressor:
+		extensions = append([]string{"zst"}, extensions...)
 	case "", ZfsCompressor:
 	default:
-		extensions = append([]string{compressorName}, extensions...)
+		extensions = append([]string{path.Base(j.compressorBinary())}, extensions...)
 	}
 
-	nameParts = []string{j.VolumeName}
-	if j.IncrementalSnapshot.Name != "" {
-		nameParts = append(nameParts, j.IncrementalSnapshot.Name, "to", j.BaseSnapshot.Name)
-	} else {
-		nameParts = append(nameParts, j.BaseSnapshot.Name)
+	nameParts = j.plainNameParts()
+	if j.HideNames {
+		nameParts = []string{j.hiddenName(nameParts...)}
 	}
 
 	return nameParts, extensions
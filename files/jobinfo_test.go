@@ -0,0 +1,77 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package files
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCompressionThreads(t *testing.T) {
+	j := &JobInfo{
+		MaxParallelUploads: 1,
+		MaxBackoffTime:     time.Minute,
+		CompressionLevel:   6,
+		Compressor:         InternalCompressor,
+		Separator:          "|",
+		UploadChunkSize:    10,
+		TargetPolicy:       TargetPolicyAll,
+	}
+
+	if err := j.ValidateSendFlags(); err != nil {
+		t.Fatalf("expected the default compression threads to be valid, got %v", err)
+	}
+	if threads := j.compressionThreads(); threads != runtime.GOMAXPROCS(0) {
+		t.Errorf("expected one compression thread per CPU by default, got %d", threads)
+	}
+
+	j.CompressionThreads = 3
+	if err := j.ValidateSendFlags(); err != nil {
+		t.Errorf("expected 3 compression threads to be valid, got %v", err)
+	}
+	if threads := j.compressionThreads(); threads != 3 {
+		t.Errorf("expected the compression threads set to be used, got %d", threads)
+	}
+
+	j.CompressionThreads = -1
+	if err := j.ValidateSendFlags(); err == nil {
+		t.Errorf("expected negative compression threads to be rejected")
+
+	}
+
+	j.CompressionThreads = 2
+	for _, compressor := range []string{InternalCompressor, InternalLZ4Compressor, InternalZstdCompressor} {
+		var buf bytes.Buffer
+		w, err := newInternalCompressor(j, compressor, &buf)
+		if err != nil {
+			t.Errorf("%s: could not create the compressor with %d threads - %v", compressor, j.CompressionThreads, err)
+			continue
+		}
+		if _, err = w.Write(bytes.Repeat([]byte("zfsbackup"), CompressionBlockSize/4)); err != nil {
+			t.Errorf("%s: could not compress - %v", compressor, err)
+		}
+		if err = w.Close(); err != nil || buf.Len() == 0 {
+			t.Errorf("%s: expected compressed output, got %d bytes and error %v", compressor, buf.Len(), err)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package files
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+const (
+	// ManifestEncodingJSON is the default encoding of manifests, readable by every release
+	ManifestEncodingJSON = "json"
+	// ManifestEncodingCBOR is a compact binary encoding of manifests, faster to parse for backup sets of many volumes
+	ManifestEncodingCBOR = "cbor"
+)
+
+// ManifestSchemaVersion is the version of the manifest format written by this release. It is bumped whenever a change
+// to the format needs old manifests to be migrated, and a migration from the previous version is added below.
+//
+// Manifests written with an older schema version remain readable: fields are only ever added to the format and their
+// zero value must keep the behaviour of manifests that predate them. Manifests written with a newer schema version are
+// refused, rather than misread, and need a newer release. The migrate-manifests command upgrades old manifests in a
+// target so the migrations can eventually be retired.
+const ManifestSchemaVersion = 3
+
+// manifestMigrations upgrade a manifest from the schema version of their index to the next one. Manifests without a
+// schema version predate versioning and are version 0.
+var manifestMigrations = []func(j *JobInfo){
+	// 0 -> 1: record the compression statistics, computed on the fly for older manifests, once and for all.
+	func(j *JobInfo) {
+		if j.Compression == nil {
+			j.Compression = j.CompressionSummary()
+		}
+	},
+	// 1 -> 2: manifests may be encoded with CBOR, see EncodeManifest. JSON manifests are unchanged.
+	func(j *JobInfo) {},
+	// 2 -> 3: volumes may be digested with another algorithm than SHA-256, see VolumeInfo.UseDigest. Volumes of older
+	// manifests all were.
+	func(j *JobInfo) {},
+}
+
+// manifestHeader precedes the body of manifests not encoded with JSON. Being JSON itself, releases that predate the
+// encoding read it as a manifest of a newer schema version and refuse it, instead of failing to parse the body.
+type manifestHeader struct {
+	SchemaVersion    int
+	ManifestEncoding string
+}
+
+// CheckSchemaVersion returns an error if the manifest was written with a schema version this release cannot read.
+func (j *JobInfo) CheckSchemaVersion() error {
+	if j.SchemaVersion > ManifestSchemaVersion {
+		return fmt.Errorf(
+			"the manifest of %s uses schema version %d but only versions up to %d are supported, upgrade to read it",
+			j.VolumeName, j.SchemaVersion, ManifestSchemaVersion,
+		)
+	}
+	return nil
+}
+
+// MigrateSchema will upgrade the manifest to the current schema version, returning false if it already was.
+func (j *JobInfo) MigrateSchema() (bool, error) {
+	if err := j.CheckSchemaVersion(); err != nil {
+		return false, err
+	}
+	if j.SchemaVersion == ManifestSchemaVersion {
+		return false, nil
+	}
+	for ; j.SchemaVersion < ManifestSchemaVersion; j.SchemaVersion++ {
+		manifestMigrations[j.SchemaVersion](j)
+	}
+	return true, nil
+}
+
+// EncodeManifest will write the manifest with the encoding it selects, JSON by default.
+func EncodeManifest(w io.Writer, j *JobInfo) error {
+	switch j.ManifestEncoding {
+	case "", ManifestEncodingJSON:
+		return json.NewEncoder(w).Encode(j)
+	case ManifestEncodingCBOR:
+		// Not followed by a newline so the body starts right after the header
+		header, err := json.Marshal(manifestHeader{SchemaVersion: j.SchemaVersion, ManifestEncoding: j.ManifestEncoding})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(header); err != nil {
+			return err
+		}
+		return cbor.NewEncoder(w).Encode(j)
+	default:
+		return fmt.Errorf("unknown manifest encoding %s", j.ManifestEncoding)
+	}
+}
+
+// DecodeManifest will read a manifest written by EncodeManifest, whatever its encoding.
+func DecodeManifest(r io.Reader) (*JobInfo, error) {
+	j := new(JobInfo)
+	decoder := json.NewDecoder(r)
+	if err := decoder.Decode(j); err != nil {
+		return nil, err
+	}
+
+	switch j.ManifestEncoding {
+	case "", ManifestEncodingJSON:
+		return j, nil
+	case ManifestEncodingCBOR:
+		if err := j.CheckSchemaVersion(); err != nil {
+			return nil, err
+		}
+		body := new(JobInfo)
+		if err := cbor.NewDecoder(io.MultiReader(decoder.Buffered(), r)).Decode(body); err != nil {
+			return nil, fmt.Errorf("could not decode the CBOR manifest - %v", err)
+		}
+		return body, nil
+	default:
+		return nil, fmt.Errorf("the manifest of %s uses an unknown encoding %s, upgrade to read it", j.VolumeName, j.ManifestEncoding)
+	}
+}
@@ -22,11 +22,13 @@ package files
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/md5"  // nolint:gosec // MD5 not used for cryptographic purposes here
 	"crypto/sha1" // nolint:gosec // SHA1 not used for cryptographic purposes here
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/crc32"
@@ -37,10 +39,13 @@ import (
 	"sync"
 	"time"
 
+	"filippo.io/age"
 	"github.com/dustin/go-humanize"
 	"github.com/juju/ratelimit"
+	"github.com/klauspost/compress/zstd"
 	gzip "github.com/klauspost/pgzip"
 	"github.com/miolini/datacounter"
+	"github.com/pierrec/lz4/v4"
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
 
@@ -58,7 +63,17 @@ const (
 	BufferSize = 256 * humanize.KiByte // 256KiB
 	// InternalCompressor is the key used to indicate we want to utilize the internal compressor
 	InternalCompressor = "internal"
-	ZfsCompressor      = "zfs"
+	// InternalLZ4Compressor is the key used to indicate we want to utilize the internal (parallel) lz4 compressor
+	InternalLZ4Compressor = "internal-lz4"
+	// InternalZstdCompressor is the key used to indicate we want to utilize the internal (parallel) zstd compressor
+	InternalZstdCompressor = "internal-zstd"
+	ZfsCompressor          = "zfs"
+	// NoCompressor is the key used in the dataset compression options to store the volumes without compression
+	NoCompressor = "none"
+	// CompressionBlockSize is the size of the blocks the internal gzip compressor splits a volume into to compress in parallel
+	CompressionBlockSize = 1 * humanize.MiByte
+	// SignatureSuffix is appended to the name of a manifest to name the object holding its detached signature
+	SignatureSuffix = ".sig"
 )
 
 // VolumeInfo holds all necessary information for a Volume as part of a backup
@@ -75,10 +90,22 @@ type VolumeInfo struct {
 	CRC32CSum32     uint32
 	Size            uint64
 	ZFSStreamBytes  uint64
+	ZFSStreamSHA256 string `json:",omitempty"`
 	CreateTime      time.Time
 	CloseTime       time.Time
 	IsManifest      bool
 	IsFinalManifest bool
+	Targets         []string `json:",omitempty"`
+	// The volume was stored without compression as the data was found to be incompressible
+	StoreOnly bool `json:",omitempty"`
+	// The size of the volume after compression, before it was encrypted and/or signed
+	CompressedBytes uint64 `json:",omitempty"`
+	// Detached signature of the closed volume, uploaded next to manifests
+	Signature []byte `json:"-"`
+	// The digest of the volume when it is not SHA256Sum, computed with DigestAlgorithm, see UseDigest
+	Digest          hash.Hash `json:"-"`
+	DigestAlgorithm string    `json:",omitempty"`
+	DigestSum       string    `json:",omitempty"`
 
 	filename string
 	w        io.Writer
@@ -88,19 +115,32 @@ type VolumeInfo struct {
 	// Pipe Objects
 	pw *io.PipeWriter
 	pr *io.PipeReader
+	// In memory objects
+	mem  *bytes.Buffer
+	memr *bytes.Reader
 	// (de)compressor objects
 	cw  io.WriteCloser
 	rw  io.ReadCloser
 	cmd *exec.Cmd
 	// PGP objects
-	pgpw io.WriteCloser
-	pgpr *openpgp.MessageDetails
+	pgpw      io.WriteCloser
+	pgpr      *openpgp.MessageDetails
+	pgpSigner *openpgp.Entity
+	// age objects
+	agew io.WriteCloser
+	// gpg-agent objects
+	gpg       *exec.Cmd
+	gpgw      io.WriteCloser
+	gpgr      io.ReadCloser
+	gpgStatus *bytes.Buffer
+	gpgSigner string
 	// Detail Objects
-	counter   *datacounter.WriterCounter
-	usingPipe bool
-	isClosed  bool
-	isOpened  bool
-	lock      sync.Mutex
+	counter           *datacounter.WriterCounter
+	compressedCounter *datacounter.WriterCounter
+	usingPipe         bool
+	isClosed          bool
+	isOpened          bool
+	lock              sync.Mutex
 }
 
 // ByVolumeNumber is used to sort a VolumeInfo slice by VolumeNumber.
@@ -122,6 +162,11 @@ func (v *VolumeInfo) Read(p []byte) (int, error) {
 		return 0, fmt.Errorf("nothing to read from")
 	}
 	i, err := v.r.Read(p)
+	if err == io.EOF && v.gpg != nil {
+		if gerr := v.waitGPG(); gerr != nil {
+			return i, gerr
+		}
+	}
 	if err == io.EOF && v.pgpr != nil {
 		if v.pgpr.IsSigned {
 			if v.pgpr.SignatureError != nil {
@@ -130,6 +175,11 @@ func (v *VolumeInfo) Read(p []byte) (int, error) {
 			if v.pgpr.SignedBy == nil {
 				return i, fmt.Errorf("did not have ths key signature to verify the message with")
 			}
+			if v.pgpSigner != nil && v.pgpr.SignedBy.Entity.PrimaryKey.Fingerprint != v.pgpSigner.PrimaryKey.Fingerprint {
+				return i, fmt.Errorf("the message was not signed by the expected key")
+			}
+		} else if v.pgpSigner != nil {
+			return i, fmt.Errorf("the message is not signed, expected a signature to verify it with")
 		}
 	}
 	return i, err
@@ -145,6 +195,9 @@ func (v *VolumeInfo) Seek(offset int64, whence int) (int64, error) {
 	if v.usingPipe {
 		return 0, fmt.Errorf("cannot Seek on a piped reader")
 	}
+	if v.memr != nil {
+		return v.memr.Seek(offset, whence)
+	}
 	return v.fw.Seek(offset, whence)
 }
 
@@ -153,6 +206,9 @@ func (v *VolumeInfo) ReadAt(p []byte, off int64) (int, error) {
 	if v.usingPipe {
 		return 0, fmt.Errorf("cannot ReadAt on a piped reader")
 	}
+	if v.memr != nil {
+		return v.memr.ReadAt(p, off)
+	}
 	return v.fw.ReadAt(p, off)
 }
 
@@ -165,12 +221,17 @@ func (v *VolumeInfo) OpenVolume() error {
 	if v.isOpened {
 		return nil
 	}
-	f, err := os.Open(v.filename)
-	if err != nil {
-		return err
+	if v.mem != nil {
+		v.memr = bytes.NewReader(v.mem.Bytes())
+		v.r = v.memr
+	} else {
+		f, err := os.Open(v.filename)
+		if err != nil {
+			return err
+		}
+		v.fw = f
+		v.r = f
 	}
-	v.fw = f
-	v.r = f
 	v.isClosed = false
 	v.isOpened = true
 	if config.BackupUploadBucket != nil {
@@ -202,7 +263,44 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 		v.isOpened = true
 	}
 
-	if j.EncryptKey != nil || j.SignKey != nil {
+	// Manifests of backups encrypted with a data key lead with the wrapped data key
+	var wrapped []WrappedKey
+	if isManifest {
+		headerReader := bufio.NewReader(v.r)
+		v.r = headerReader
+		var herr error
+		if wrapped, herr = readDataKeyHeader(headerReader); herr != nil {
+			return herr
+		}
+		if wrapped != nil && len(j.AgeIdentities) == 0 {
+			return &EncryptedManifestError{WrappedKeys: wrapped}
+		}
+	}
+
+	if wrapped != nil || (len(j.AgeIdentities) > 0 && !(isManifest && j.usesKMS())) {
+		ageReader, aerr := age.Decrypt(v.r, j.AgeIdentities...)
+		if aerr != nil {
+			return aerr
+		}
+		v.r = ageReader
+	} else if j.usesGPGAgent() {
+		v.gpg = pgp.AgentDecryptCommand(ctx)
+		v.gpg.Stdin = v.r
+		v.gpgStatus = new(bytes.Buffer)
+		v.gpg.Stderr = v.gpgStatus
+		v.gpgSigner = j.SignFrom
+
+		gpgReader, gerr := v.gpg.StdoutPipe()
+		if gerr != nil {
+			return gerr
+		}
+		v.gpgr = gpgReader
+		v.r = v.gpgr
+
+		if gerr = v.gpg.Start(); gerr != nil {
+			return gerr
+		}
+	} else if j.EncryptKey != nil || j.SignKey != nil {
 		pgpConfig := new(packet.Config)
 		pgpConfig.DefaultCompressionAlgo = packet.CompressionNone // We will do our own, thank you very much!
 		pgpConfig.DefaultCipher = packet.CipherAES256
@@ -211,6 +309,7 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 			return perr
 		}
 		v.pgpr = pgpReader
+		v.pgpSigner = j.SignKey
 		v.r = pgpReader.UnverifiedBody
 	}
 
@@ -218,6 +317,8 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 	compressor := j.Compressor
 	if isManifest {
 		compressor = InternalCompressor
+	} else if v.StoreOnly {
+		compressor = ""
 	}
 
 	switch compressor {
@@ -227,10 +328,21 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 			return err
 		}
 		v.r = v.rw
+	case InternalLZ4Compressor:
+		v.rw = io.NopCloser(lz4.NewReader(v.r))
+		v.r = v.rw
+	case InternalZstdCompressor:
+		decoder, zerr := zstd.NewReader(v.r, j.zstdDecoderOptions()...)
+		if zerr != nil {
+			return zerr
+		}
+		v.rw = decoder.IOReadCloser()
+		v.r = v.rw
 	case "":
 	case ZfsCompressor:
 	default:
-		v.cmd = exec.CommandContext(ctx, compressor, "-c", "-d")
+		args := j.decompressorArgs()
+		v.cmd = exec.CommandContext(ctx, args[0], args[1:]...)
 		v.cmd.Stdin = v.r
 
 		decompressor, err := v.cmd.StdoutPipe()
@@ -248,12 +360,167 @@ func (v *VolumeInfo) Extract(ctx context.Context, j *JobInfo, isManifest bool) e
 	return nil
 }
 
+// waitGPG waits for the gpg command to exit, checking the signature of what it decrypted.
+func (v *VolumeInfo) waitGPG() error {
+	cmd := v.gpg
+	v.gpg = nil
+	if v.gpgw != nil {
+		if err := v.gpgw.Close(); err != nil {
+			return err
+		}
+		v.gpgw = nil
+	}
+
+	err := cmd.Wait()
+	if v.gpgStatus == nil {
+		return err
+	}
+	status := v.gpgStatus.Bytes()
+	v.gpgStatus = nil
+	if err != nil {
+		return fmt.Errorf("gpg could not decrypt the volume - %v: %s", err, strings.TrimSpace(string(status)))
+	}
+	return pgp.CheckAgentSignature(status, v.gpgSigner)
+}
+
+// ErrNotEncrypted is returned by CheckEncryptionHeader when the job has no keys the volume could be encrypted or
+// signed with.
+var ErrNotEncrypted = errors.New("the volume is neither encrypted nor signed")
+
+// CheckEncryptionHeader will confirm the start of a volume, read from r, decrypts with the keys of the job and was
+// signed by the expected key, without needing the rest of the volume. With gpg-agent, the signer is only known once
+// the whole volume was read so only the decryption is checked.
+func CheckEncryptionHeader(ctx context.Context, j *JobInfo, r io.Reader) error {
+	first := make([]byte, 1)
+	switch {
+	case len(j.AgeIdentities) > 0:
+		ageReader, err := age.Decrypt(r, j.AgeIdentities...)
+		if err != nil {
+			return err
+		}
+		// Reading the first byte authenticates the whole first chunk
+		if _, err = io.ReadFull(ageReader, first); err != nil && err != io.EOF {
+			return err
+		}
+	case j.usesGPGAgent():
+		cmd := pgp.AgentDecryptCommand(ctx)
+		cmd.Stdin = r
+		status := new(bytes.Buffer)
+		cmd.Stderr = status
+		// gpg fails once it reaches the end of the truncated volume, the status lines tell how far it got
+		_ = cmd.Run()
+		return pgp.CheckAgentDecryption(status.Bytes(), j.EncryptTo != "")
+	case j.EncryptKey != nil || j.SignKey != nil:
+		pgpConfig := new(packet.Config)
+		pgpConfig.DefaultCompressionAlgo = packet.CompressionNone
+		pgpConfig.DefaultCipher = packet.CipherAES256
+		md, err := openpgp.ReadMessage(r, pgp.GetCombinedKeyRing(), pgp.PromptFunc, pgpConfig)
+		if err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(md.UnverifiedBody, first); err != nil && err != io.EOF {
+			return err
+		}
+		if j.EncryptKey != nil && !md.IsEncrypted {
+			return fmt.Errorf("the volume is not encrypted")
+		}
+		if j.SignKey != nil {
+			switch {
+			case !md.IsSigned:
+				return fmt.Errorf("the volume is not signed")
+			case md.SignedBy == nil:
+				return fmt.Errorf("the volume was signed by the unknown key %X", md.SignedByKeyId)
+			case md.SignedBy.Entity.PrimaryKey.Fingerprint != j.SignKey.PrimaryKey.Fingerprint:
+				return fmt.Errorf("the volume was not signed by the expected key")
+			}
+		}
+	default:
+		return ErrNotEncrypted
+	}
+	return nil
+}
+
+// SignDetached will compute a detached signature of the closed volume with the job's signing key, if any. Nothing is
+// done when only the public part of the key was loaded.
+func (v *VolumeInfo) SignDetached(ctx context.Context, j *JobInfo) error {
+	if (j.SignKey == nil || j.SignKey.PrivateKey == nil) && !(j.GPGAgent && j.SignFrom != "") {
+		return nil
+	}
+
+	var in io.Reader
+	if v.mem != nil {
+		in = bytes.NewReader(v.mem.Bytes())
+	} else {
+		f, err := os.Open(v.filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	signature := new(bytes.Buffer)
+	if j.GPGAgent {
+		cmd := pgp.AgentDetachSignCommand(ctx, j.SignFrom)
+		cmd.Stdin = in
+		cmd.Stdout = signature
+		stderr := new(bytes.Buffer)
+		cmd.Stderr = stderr
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("gpg could not sign %s - %v: %s", v.ObjectName, err, strings.TrimSpace(stderr.String()))
+		}
+	} else {
+		pgpConfig := new(packet.Config)
+		pgpConfig.DefaultHash = crypto.SHA256
+		if err := openpgp.DetachSign(signature, j.SignKey, in, pgpConfig); err != nil {
+			return err
+		}
+	}
+	v.Signature = signature.Bytes()
+
+	return nil
+}
+
+// VerifySignature will check the detached signature at signaturePath of the file at path against the job's signing
+// key, or through gpg when the job uses gpg-agent.
+func VerifySignature(ctx context.Context, j *JobInfo, path, signaturePath string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if j.GPGAgent {
+		status := new(bytes.Buffer)
+		cmd := pgp.AgentVerifyCommand(ctx, signaturePath)
+		cmd.Stdin = f
+		cmd.Stderr = status
+		if err = cmd.Run(); err != nil {
+			return fmt.Errorf("gpg could not verify the signature - %v: %s", err, strings.TrimSpace(status.String()))
+		}
+		return pgp.CheckAgentSignature(status.Bytes(), j.SignFrom)
+	}
+
+	signature, err := os.Open(signaturePath)
+	if err != nil {
+		return err
+	}
+	defer signature.Close()
+
+	_, err = openpgp.CheckDetachedSignature(openpgp.EntityList{j.SignKey}, f, signature)
+	return err
+}
+
 // DeleteVolume will delete the volume from the temporary directory it was written to.
 // Only valid to be called after creating a new Volume and closing it.
 func (v *VolumeInfo) DeleteVolume() error {
 	if v.usingPipe {
 		return nil // Nothing to delete
 	}
+	if v.mem != nil {
+		v.mem = nil
+		return nil
+	}
 	return os.Remove(v.filename)
 }
 
@@ -307,6 +574,28 @@ func (v *VolumeInfo) Close() error {
 		}
 	}
 
+	// Wait for gpg to finish (de/en)crypting, if used
+	if v.gpg != nil {
+		if v.gpgr != nil {
+			// Let gpg reach the end of the volume so it can check the signature
+			if _, err := io.Copy(io.Discard, v.gpgr); err != nil {
+				return err
+			}
+		}
+		if err := v.waitGPG(); err != nil {
+			return err
+		}
+	}
+	v.gpgr = nil
+
+	// Close the age encrypter, if any
+	if v.agew != nil {
+		if err := v.agew.Close(); err != nil {
+			return err
+		}
+		v.agew = nil
+	}
+
 	// Close the (de/en)crypter, if any
 	if v.pgpw != nil || v.pgpr != nil {
 		if v.pgpw != nil {
@@ -356,12 +645,21 @@ func (v *VolumeInfo) Close() error {
 		v.Size = v.counter.Count()
 		v.counter = nil
 	}
+	if v.compressedCounter != nil {
+		v.CompressedBytes = v.compressedCounter.Count()
+		v.compressedCounter = nil
+	}
 
 	if v.SHA256 != nil {
 		v.SHA256Sum = fmt.Sprintf("%x", v.SHA256.Sum(nil))
 		v.SHA256 = nil
 	}
 
+	if v.Digest != nil {
+		v.DigestSum = fmt.Sprintf("%x", v.Digest.Sum(nil))
+		v.Digest = nil
+	}
+
 	if v.CRC32C != nil {
 		v.CRC32CSum32 = v.CRC32C.Sum32()
 		v.CRC32C = nil
@@ -378,6 +676,7 @@ func (v *VolumeInfo) Close() error {
 	}
 
 	v.w = nil
+	v.memr = nil
 	if v.pr == nil {
 		v.r = nil
 	}
@@ -387,11 +686,17 @@ func (v *VolumeInfo) Close() error {
 
 // CopyTo will write out the volume to the path specified
 func (v *VolumeInfo) CopyTo(dest string) (err error) {
-	in, err := os.Open(v.filename)
-	if err != nil {
-		return
+	var in io.Reader
+	if v.mem != nil {
+		in = bytes.NewReader(v.mem.Bytes())
+	} else {
+		f, ferr := os.Open(v.filename)
+		if ferr != nil {
+			return ferr
+		}
+		defer f.Close()
+		in = f
 	}
-	defer in.Close()
 	out, err := os.Create(dest)
 	if err != nil {
 		return
@@ -407,13 +712,47 @@ func (v *VolumeInfo) CopyTo(dest string) (err error) {
 // prepareVolume returns a VolumeInfo, filename parts, extension parts, and an error
 // compress -> encrypt/sign -> output
 func prepareVolume(ctx context.Context, j *JobInfo, pipe, isManifest bool) (*VolumeInfo, error) {
-	v, err := CreateSimpleVolume(ctx, pipe)
-	if err != nil {
+	var v *VolumeInfo
+	var err error
+	if isManifest && j.NoCache {
+		v = CreateMemoryVolume()
+	} else if v, err = CreateSimpleVolume(ctx, pipe); err != nil {
 		return nil, err
 	}
+	if !isManifest {
+		if err = v.UseDigest(j.DigestAlgorithm); err != nil {
+			return nil, err
+		}
+	}
 
 	// Prepare the Encryption/Signing writer, if required
-	if j.EncryptKey != nil || j.SignKey != nil {
+	if isManifest && len(j.WrappedKeys) > 0 && len(j.AgeRecipientKeys) > 0 {
+		// The manifest is encrypted with the data key too, which it leads with wrapped so it can be read back
+		if err = writeDataKeyHeader(v.w, j.WrappedKeys); err != nil {
+			return nil, err
+		}
+		if v.agew, err = age.Encrypt(v.w, j.AgeRecipientKeys...); err != nil {
+			return nil, err
+		}
+		v.w = v.agew
+	} else if len(j.AgeRecipientKeys) > 0 && !(isManifest && j.usesKMS()) {
+		if v.agew, err = age.Encrypt(v.w, j.AgeRecipientKeys...); err != nil {
+			return nil, err
+		}
+		v.w = v.agew
+	} else if j.usesGPGAgent() {
+		v.gpg = pgp.AgentEncryptCommand(ctx, j.EncryptTo, j.SignFrom)
+		v.gpg.Stdout = v.w
+		v.gpg.Stderr = os.Stderr
+		if v.gpgw, err = v.gpg.StdinPipe(); err != nil {
+			return nil, err
+		}
+		v.w = v.gpgw
+
+		if err = v.gpg.Start(); err != nil {
+			return nil, err
+		}
+	} else if j.EncryptKey != nil || j.SignKey != nil {
 		pgpConfig := new(packet.Config)
 		pgpConfig.DefaultCompressionAlgo = packet.CompressionNone // We will do our own, thank you very much!
 		pgpConfig.DefaultCipher = packet.CipherAES256
@@ -441,21 +780,54 @@ func prepareVolume(ctx context.Context, j *JobInfo, pipe, isManifest bool) (*Vol
 		compressorName = InternalCompressor
 	}
 
+	// Count what the compressor outputs to record how well the volume compressed
+	v.compressedCounter = datacounter.NewWriterCounter(v.w)
+	v.w = v.compressedCounter
+
 	// Prepare the compression writer, if any
 	switch compressorName {
 	case InternalCompressor:
-		v.cw, _ = gzip.NewWriterLevel(v.w, j.CompressionLevel)
+		if v.cw, err = newInternalCompressor(j, compressorName, v.w); err != nil {
+			return nil, err
+		}
+		v.w = v.cw
+
+		printCompressCMD.Do(func() {
+			log.AppLogger.Infof(
+				"Will be using internal gzip compressor with compression level %d across %d threads.",
+				j.CompressionLevel, j.compressionThreads(),
+			)
+		})
+	case InternalLZ4Compressor:
+		if v.cw, err = newInternalCompressor(j, compressorName, v.w); err != nil {
+			return nil, err
+		}
 		v.w = v.cw
 
 		printCompressCMD.Do(func() {
-			log.AppLogger.Infof("Will be using internal gzip compressor with compression level %d.", j.CompressionLevel)
+			log.AppLogger.Infof(
+				"Will be using internal lz4 compressor with compression level %d across %d threads.",
+				j.CompressionLevel, j.compressionThreads(),
+			)
+		})
+	case InternalZstdCompressor:
+		if v.cw, err = newInternalCompressor(j, compressorName, v.w); err != nil {
+			return nil, err
+		}
+		v.w = v.cw
+
+		printCompressCMD.Do(func() {
+			log.AppLogger.Infof(
+				"Will be using internal zstd compressor with compression level %d across %d threads (window log %d, dictionary: %v).",
+				j.CompressionLevel, j.compressionThreads(), j.ZstdWindowLog, len(j.ZstdDictionary) > 0,
+			)
 		})
 	case "":
 		printCompressCMD.Do(func() { log.AppLogger.Infof("Will not be using any compression.") })
 	case ZfsCompressor:
 		printCompressCMD.Do(func() { log.AppLogger.Infof("Will send a ZFS compressed stream") })
 	default:
-		v.cmd = exec.CommandContext(ctx, compressorName, "-c", fmt.Sprintf("-%d", j.CompressionLevel))
+		v.cmd = compressorCommand(ctx, j)
 		v.cmd.Stdout = v.w
 
 		compressor, err := v.cmd.StdinPipe()
@@ -484,6 +856,106 @@ func prepareVolume(ctx context.Context, j *JobInfo, pipe, isManifest bool) (*Vol
 	return v, nil
 }
 
+// NewCompressor returns a writer compressing to w the way the job's volumes are compressed. External compressors are
+// started right away and waited on when the writer is closed.
+func NewCompressor(ctx context.Context, j *JobInfo, w io.Writer) (io.WriteCloser, error) {
+	switch j.Compressor {
+	case InternalCompressor, InternalLZ4Compressor, InternalZstdCompressor:
+		return newInternalCompressor(j, j.Compressor, w)
+	case "", ZfsCompressor:
+		return &nopWriteCloser{w}, nil
+	default:
+		cmd := compressorCommand(ctx, j)
+		cmd.Stdout = w
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err = cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &commandWriter{WriteCloser: stdin, cmd: cmd}, nil
+	}
+}
+
+// newInternalCompressor returns the internal gzip, lz4, or zstd compressor writing to w.
+func newInternalCompressor(j *JobInfo, compressorName string, w io.Writer) (io.WriteCloser, error) {
+	switch compressorName {
+	case InternalLZ4Compressor:
+		lw := lz4.NewWriter(w)
+		if err := lw.Apply(lz4.CompressionLevelOption(lz4Level(j.CompressionLevel)), lz4.ConcurrencyOption(j.compressionThreads())); err != nil {
+			return nil, err
+		}
+		return lw, nil
+	case InternalZstdCompressor:
+		return zstd.NewWriter(w, j.zstdEncoderOptions()...)
+	}
+
+	gw, err := gzip.NewWriterLevel(w, j.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	if err = gw.SetConcurrency(CompressionBlockSize, j.compressionThreads()); err != nil {
+		return nil, err
+	}
+	return gw, nil
+}
+
+// compressorCommand returns the command to compress with the job's external compressor, reading from stdin.
+func compressorCommand(ctx context.Context, j *JobInfo) *exec.Cmd {
+	args := j.compressorArgs()
+	return exec.CommandContext(ctx, args[0], args[1:]...)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// commandWriter closes the stdin of an external command and waits for it to exit when closed.
+type commandWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *commandWriter) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.cmd.Wait()
+}
+
+// zstdLevel maps the gzip style compression levels of 1-9 onto the zstd encoder levels.
+func zstdLevel(level int) zstd.EncoderLevel {
+	switch {
+	case level <= 1:
+		return zstd.SpeedFastest
+	case level < 6:
+		return zstd.SpeedDefault
+	case level < 9:
+		return zstd.SpeedBetterCompression
+	default:
+		return zstd.SpeedBestCompression
+	}
+}
+
+// lz4Level maps the gzip style compression levels of 1-9 onto the lz4 levels, where 1 is the fast (non-HC) mode.
+func lz4Level(level int) lz4.CompressionLevel {
+	levels := []lz4.CompressionLevel{
+		lz4.Fast, lz4.Level1, lz4.Level2, lz4.Level3, lz4.Level4, lz4.Level5, lz4.Level6, lz4.Level7, lz4.Level8,
+	}
+	switch {
+	case level <= 1:
+		return lz4.Fast
+	case level > len(levels):
+		return lz4.Level9
+	default:
+		return levels[level-1]
+	}
+}
+
 // CreateManifestVolume will call CreateSimpleVolume and add options to compress,
 // encrypt, and/or sign the file as it is written depending on the provided options.
 // It will also name the file accordingly as a manifest file.
@@ -494,12 +966,27 @@ func CreateManifestVolume(ctx context.Context, j *JobInfo) (*VolumeInfo, error)
 		return nil, err
 	}
 
+	j.RecordHiddenNames()
 	v.ObjectName = j.ManifestObjectName()
 	v.IsManifest = true
 
 	return v, nil
 }
 
+// CreateIndexVolume will call CreateSimpleVolume and add options to compress, encrypt, and/or sign the file as it
+// is written, like a manifest. It will also name the file accordingly as the index of the volume's backup sets.
+func CreateIndexVolume(ctx context.Context, j *JobInfo) (*VolumeInfo, error) {
+	v, err := prepareVolume(ctx, j, false, true)
+	if err != nil {
+		return nil, err
+	}
+
+	v.ObjectName = j.IndexObjectName()
+	v.IsManifest = true
+
+	return v, nil
+}
+
 // CreateBackupVolume will call CreateSimpleVolume and add options to compress,
 // encrypt, and/or sign the file as it is written depending on the provided options.
 // It will also name the file accordingly as a volume as part of backup set.
@@ -524,13 +1011,7 @@ func CreateBackupVolume(ctx context.Context, j *JobInfo, volnum int64) (*VolumeI
 // MaxParallelUploads is set to 0, no temporary file will be used and an OS Pipe
 // will be used instead.
 func CreateSimpleVolume(ctx context.Context, pipe bool) (*VolumeInfo, error) {
-	v := &VolumeInfo{
-		SHA256:     sha256.New(),
-		CRC32C:     crc32.New(crc32.MakeTable(crc32.Castagnoli)),
-		MD5:        md5.New(),  // nolint:gosec // MD5 not used for cryptographic purposes here
-		SHA1:       sha1.New(), // nolint:gosec // SHA1 not used for cryptographic purposes here
-		CreateTime: time.Now(),
-	}
+	v := newVolumeInfo()
 
 	if pipe {
 		v.pr, v.pw = io.Pipe()
@@ -551,16 +1032,41 @@ func CreateSimpleVolume(ctx context.Context, pipe bool) (*VolumeInfo, error) {
 		v.w = v.fw
 	}
 
+	v.wrapWriter()
+
+	return v, nil
+}
+
+// CreateMemoryVolume will create a volume that is held in memory instead of a temporary file. Only meant
+// for small volumes, such as manifests, that should not be written to the working directory.
+func CreateMemoryVolume() *VolumeInfo {
+	v := newVolumeInfo()
+	v.mem = new(bytes.Buffer)
+	v.w = v.mem
+	v.wrapWriter()
+	return v
+}
+
+func newVolumeInfo() *VolumeInfo {
+	return &VolumeInfo{
+		SHA256:     sha256.New(),
+		CRC32C:     crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		MD5:        md5.New(),  // nolint:gosec // MD5 not used for cryptographic purposes here
+		SHA1:       sha1.New(), // nolint:gosec // SHA1 not used for cryptographic purposes here
+		CreateTime: time.Now(),
+	}
+}
+
+// wrapWriter will buffer, hash, and count the writes made to the underlying writer of the volume.
+func (v *VolumeInfo) wrapWriter() {
 	// Buffer the writes to double the default block size (128KB)
 	v.bufw = bufio.NewWriterSize(v.w, BufferSize)
 	v.w = v.bufw
 
 	// Compute hashes
-	v.w = io.MultiWriter(v.w, v.SHA256, v.CRC32C, v.MD5, v.SHA1)
+	v.w = io.MultiWriter(v.w, digestWriter{v}, v.CRC32C, v.MD5, v.SHA1)
 
 	// Add a writer that counts how many bytes have been written
 	v.counter = datacounter.NewWriterCounter(v.w)
 	v.w = v.counter
-
-	return v, nil
 }
@@ -4,21 +4,31 @@ go 1.18
 
 require (
 	cloud.google.com/go/storage v1.28.0
+	filippo.io/age v1.0.0
 	github.com/Azure/azure-sdk-for-go v67.0.0+incompatible
 	github.com/Azure/azure-storage-blob-go v0.15.0
+	github.com/Azure/go-autorest/autorest v0.11.28
+	github.com/Azure/go-autorest/autorest/adal v0.9.21
 	github.com/aws/aws-sdk-go v1.44.136
 	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/dustin/go-humanize v1.0.0
+	github.com/fxamacker/cbor/v2 v2.5.0
+	github.com/hanwen/go-fuse/v2 v2.2.0
 	github.com/juju/ratelimit v1.0.2
+	github.com/klauspost/compress v1.15.12
 	github.com/klauspost/pgzip v1.2.5
+	github.com/klauspost/reedsolomon v1.11.8
 	github.com/kurin/blazer v0.5.3
 	github.com/miolini/datacounter v1.0.3
-	github.com/nightlyone/lockfile v1.0.0
 	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	github.com/pierrec/lz4/v4 v4.1.17
 	github.com/pkg/errors v0.9.1
 	github.com/spf13/cobra v1.6.1
+	github.com/zeebo/blake3 v0.2.3
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.2.0
 	golang.org/x/sync v0.1.0
+	golang.org/x/term v0.2.0
 	google.golang.org/api v0.103.0
 )
 
@@ -29,10 +39,9 @@ require (
 	cloud.google.com/go/iam v0.7.0 // indirect
 	github.com/Azure/azure-pipeline-go v0.2.3 // indirect
 	github.com/Azure/go-autorest v14.2.0+incompatible // indirect
-	github.com/Azure/go-autorest/autorest v0.11.28 // indirect
-	github.com/Azure/go-autorest/autorest/adal v0.9.21 // indirect
 	github.com/Azure/go-autorest/autorest/date v0.3.0 // indirect
 	github.com/Azure/go-autorest/autorest/to v0.4.0 // indirect
+	github.com/Azure/go-autorest/autorest/validation v0.3.1 // indirect
 	github.com/Azure/go-autorest/logger v0.2.1 // indirect
 	github.com/Azure/go-autorest/tracing v0.6.0 // indirect
 	github.com/dnaeon/go-vcr v1.2.0 // indirect
@@ -46,14 +55,14 @@ require (
 	github.com/googleapis/gax-go/v2 v2.7.0 // indirect
 	github.com/inconshreveable/mousetrap v1.0.1 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
-	github.com/klauspost/compress v1.15.12 // indirect
+	github.com/klauspost/cpuid/v2 v2.1.1 // indirect
 	github.com/mattn/go-ieproxy v0.0.9 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	go.opencensus.io v0.24.0 // indirect
 	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/oauth2 v0.2.0 // indirect
 	golang.org/x/sys v0.2.0 // indirect
-	golang.org/x/term v0.2.0 // indirect
 	golang.org/x/text v0.4.0 // indirect
 	golang.org/x/xerrors v0.0.0-20220907171357-04be3eba64a2 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
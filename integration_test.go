@@ -425,7 +425,7 @@ func restoreWrapper(dataset, bucket, target string) func(*testing.T) {
 		cmd.ResetReceiveJobInfo()
 
 		// Restore to snapshot @a (full)
-		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "-F", fmt.Sprintf("%s@a", dataset), bucket, target})
+		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "-F", "--yes", fmt.Sprintf("%s@a", dataset), bucket, target})
 		if err := cmd.RootCmd.ExecuteContext(ctx); err != nil {
 			t.Fatalf("error performing receive: %v", err)
 		}
@@ -433,7 +433,7 @@ func restoreWrapper(dataset, bucket, target string) func(*testing.T) {
 		cmd.ResetReceiveJobInfo()
 
 		// Restore to snapshot @b from @a (incremental)
-		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "-F", "-i", fmt.Sprintf("%s@a", dataset), fmt.Sprintf("%s@b", dataset), bucket, target})
+		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "-F", "--yes", "-i", fmt.Sprintf("%s@a", dataset), fmt.Sprintf("%s@b", dataset), bucket, target})
 		if err := cmd.RootCmd.ExecuteContext(ctx); err != nil {
 			t.Fatalf("error performing receive: %v", err)
 		}
@@ -441,7 +441,7 @@ func restoreWrapper(dataset, bucket, target string) func(*testing.T) {
 		cmd.ResetReceiveJobInfo()
 
 		// Restore to latest snapshot @c (auto)
-		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "--workingDirectory", scratchDir, "-F", "--auto", dataset, bucket, target})
+		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "--workingDirectory", scratchDir, "-F", "--yes", "--auto", dataset, bucket, target})
 		if err := cmd.RootCmd.ExecuteContext(ctx); err != nil {
 			t.Fatalf("error performing receive: %v", err)
 		}
@@ -451,7 +451,7 @@ func restoreWrapper(dataset, bucket, target string) func(*testing.T) {
 		cmd.ResetReceiveJobInfo()
 
 		// Restore to snapshot @c from origin tank/data@b (auto)
-		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "-F", "--auto", "-o", "origin=tank/data@b", dataset, bucket, target + "origin"})
+		cmd.RootCmd.SetArgs([]string{"receive", "--logLevel", logLevel, "--separator", "+", "-F", "--yes", "--auto", "-o", "origin=tank/data@b", dataset, bucket, target + "origin"})
 		if err := cmd.RootCmd.ExecuteContext(ctx); err != nil {
 			t.Fatalf("error performing receive: %v", err)
 		}
@@ -544,22 +544,22 @@ func TestEncryptionAndSign(t *testing.T) {
 		},
 		{
 			"Restore Failure - No Key Ring",
-			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "-F", fmt.Sprintf("%s@a", dataset), target, newDataset},
+			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "-F", "--yes", fmt.Sprintf("%s@a", dataset), target, newDataset},
 			true,
 		},
 		{
 			"Full Restore success - Encrypted",
-			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "--secretKeyRingPath", "private.pgp", "--encryptTo", user, "-F", fmt.Sprintf("%s@a", dataset), target, newDataset},
+			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "--secretKeyRingPath", "private.pgp", "--encryptTo", user, "-F", "--yes", fmt.Sprintf("%s@a", dataset), target, newDataset},
 			false,
 		},
 		{
 			"Incremental Restore success - Signed",
-			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "--publicKeyRingPath", "public.pgp", "--signFrom", user, "-F", "-i", fmt.Sprintf("%s@a", dataset), fmt.Sprintf("%s@b", dataset), target, newDataset},
+			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "--publicKeyRingPath", "public.pgp", "--signFrom", user, "-F", "--yes", "-i", fmt.Sprintf("%s@a", dataset), fmt.Sprintf("%s@b", dataset), target, newDataset},
 			false,
 		},
 		{
 			"Smart Restore success - Encrypted & Signed",
-			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "--publicKeyRingPath", "public.pgp", "--secretKeyRingPath", "private.pgp", "--encryptTo", user, "--signFrom", user, "-F", "--auto", dataset, target, newDataset},
+			[]string{"receive", "--logLevel", logLevel, "--workingDirectory", scratchDir, "--publicKeyRingPath", "public.pgp", "--secretKeyRingPath", "private.pgp", "--encryptTo", user, "--signFrom", user, "-F", "--yes", "--auto", dataset, target, newDataset},
 			false,
 		},
 	}
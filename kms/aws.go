@@ -0,0 +1,70 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kms
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+// awsKeyService wraps data keys with an AWS KMS key, given by its id, ARN, or alias (e.g. alias/backups).
+type awsKeyService struct {
+	client kmsiface.KMSAPI
+	keyID  string
+}
+
+func newAWSKeyService(keyID string) (*awsKeyService, error) {
+	// Keys given by ARN are used from their own region, otherwise the region is taken from the environment
+	awsconf := aws.NewConfig()
+	if parsed, err := arn.Parse(keyID); err == nil {
+		awsconf = awsconf.WithRegion(parsed.Region)
+	}
+
+	sess, err := session.NewSession(awsconf)
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsKeyService{client: awskms.New(sess), keyID: keyID}, nil
+}
+
+// Wrap encrypts the plaintext with the KMS key.
+func (a *awsKeyService) Wrap(ctx context.Context, plaintext []byte) ([]byte, error) {
+	out, err := a.client.EncryptWithContext(ctx, &awskms.EncryptInput{KeyId: aws.String(a.keyID), Plaintext: plaintext})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+// Unwrap decrypts the ciphertext with the KMS key.
+func (a *awsKeyService) Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	out, err := a.client.DecryptWithContext(ctx, &awskms.DecryptInput{KeyId: aws.String(a.keyID), CiphertextBlob: ciphertext})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,117 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/keyvault/v7.0/keyvault"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+const azureKeyVaultResource = "https://vault.azure.net"
+
+// azureKeyService wraps data keys with an RSA key in Azure Key Vault, given as <vault>.vault.azure.net/keys/<name>
+// with an optional /<version>. It authenticates as the service principal in AZURE_TENANT_ID, AZURE_CLIENT_ID, and
+// AZURE_CLIENT_SECRET when set, or with the managed identity of the host otherwise.
+type azureKeyService struct {
+	client  keyvault.BaseClient
+	vault   string
+	name    string
+	version string
+}
+
+func newAzureKeyService(key string) (*azureKeyService, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[1] != "keys" || parts[2] == "" {
+		return nil, fmt.Errorf("expected an Azure Key Vault key as <vault>.vault.azure.net/keys/<name>[/<version>], got %s", key)
+	}
+
+	var (
+		token *adal.ServicePrincipalToken
+		err   error
+	)
+	if secret := os.Getenv("AZURE_CLIENT_SECRET"); secret != "" {
+		oauthConfig, oerr := adal.NewOAuthConfig(azure.PublicCloud.ActiveDirectoryEndpoint, os.Getenv("AZURE_TENANT_ID"))
+		if oerr != nil {
+			return nil, oerr
+		}
+		token, err = adal.NewServicePrincipalToken(*oauthConfig, os.Getenv("AZURE_CLIENT_ID"), secret, azureKeyVaultResource)
+	} else {
+		token, err = adal.NewServicePrincipalTokenFromManagedIdentity(azureKeyVaultResource, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	a := &azureKeyService{client: keyvault.New(), vault: "https://" + parts[0], name: parts[2]}
+	if len(parts) == 4 {
+		a.version = parts[3]
+	}
+	a.client.Authorizer = autorest.NewBearerAuthorizer(token)
+
+	return a, nil
+}
+
+// Wrap encrypts the plaintext with the key. The version of the key used is kept in front of the ciphertext so it can
+// still be unwrapped after the key is rotated.
+func (a *azureKeyService) Wrap(ctx context.Context, plaintext []byte) ([]byte, error) {
+	value := base64.RawURLEncoding.EncodeToString(plaintext)
+	result, err := a.client.WrapKey(ctx, a.vault, a.name, a.version, keyvault.KeyOperationsParameters{
+		Algorithm: keyvault.RSAOAEP256,
+		Value:     &value,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Kid == nil || result.Result == nil {
+		return nil, fmt.Errorf("key vault did not return the wrapped key")
+	}
+
+	version := (*result.Kid)[strings.LastIndex(*result.Kid, "/")+1:]
+	return []byte(version + "." + *result.Result), nil
+}
+
+// Unwrap decrypts the ciphertext with the version of the key it was wrapped with.
+func (a *azureKeyService) Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	parts := strings.SplitN(string(ciphertext), ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("the wrapped key is not in the expected format")
+	}
+
+	result, err := a.client.UnwrapKey(ctx, a.vault, a.name, parts[0], keyvault.KeyOperationsParameters{
+		Algorithm: keyvault.RSAOAEP256,
+		Value:     &parts[1],
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Result == nil {
+		return nil, fmt.Errorf("key vault did not return the unwrapped key")
+	}
+	return base64.RawURLEncoding.DecodeString(*result.Result)
+}
@@ -0,0 +1,65 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+
+	"google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// gcpKeyService wraps data keys with a Cloud KMS key, given by its resource name
+// (projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>).
+type gcpKeyService struct {
+	keys *cloudkms.ProjectsLocationsKeyRingsCryptoKeysService
+	name string
+}
+
+func newGCPKeyService(ctx context.Context, name string) (*gcpKeyService, error) {
+	service, err := cloudkms.NewService(ctx, option.WithScopes(cloudkms.CloudkmsScope))
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcpKeyService{keys: service.Projects.Locations.KeyRings.CryptoKeys, name: name}, nil
+}
+
+// Wrap encrypts the plaintext with the Cloud KMS key.
+func (g *gcpKeyService) Wrap(ctx context.Context, plaintext []byte) ([]byte, error) {
+	request := &cloudkms.EncryptRequest{Plaintext: base64.StdEncoding.EncodeToString(plaintext)}
+	resp, err := g.keys.Encrypt(g.name, request).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+// Unwrap decrypts the ciphertext with the Cloud KMS key.
+func (g *gcpKeyService) Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	request := &cloudkms.DecryptRequest{Ciphertext: base64.StdEncoding.EncodeToString(ciphertext)}
+	resp, err := g.keys.Decrypt(g.name, request).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,82 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package kms wraps and unwraps the data keys backups are encrypted with using keys held by a cloud key management
+// service, so no key files are needed to restore them.
+package kms
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Key management service URI prefixes
+const (
+	AWSKMSPrefix        = "awskms"
+	GCPKMSPrefix        = "gcpkms"
+	AzureKeyVaultPrefix = "azurekeyvault"
+)
+
+// ErrInvalidKeyURI is returned when the key URI provided is not for a supported key management service.
+var ErrInvalidKeyURI = errors.New("unsupported key URI provided")
+
+// KeyService wraps and unwraps data keys with a key that never leaves the key management service.
+type KeyService interface {
+	Wrap(ctx context.Context, plaintext []byte) ([]byte, error)
+	Unwrap(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// CheckKeyURI returns an error if the key URI provided is not for a supported key management service.
+func CheckKeyURI(uri string) error {
+	_, _, err := splitKeyURI(uri)
+	return err
+}
+
+// GetKeyService returns the KeyService for the key URI provided.
+func GetKeyService(ctx context.Context, uri string) (KeyService, error) {
+	prefix, key, err := splitKeyURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch prefix {
+	case AWSKMSPrefix:
+		return newAWSKeyService(key)
+	case GCPKMSPrefix:
+		return newGCPKeyService(ctx, key)
+	default:
+		return newAzureKeyService(key)
+	}
+}
+
+func splitKeyURI(uri string) (prefix, key string, err error) {
+	parts := strings.SplitN(uri, "://", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", "", ErrInvalidKeyURI
+	}
+
+	switch parts[0] {
+	case AWSKMSPrefix, GCPKMSPrefix, AzureKeyVaultPrefix:
+		return parts[0], parts[1], nil
+	default:
+		return "", "", ErrInvalidKeyURI
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pgp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// GPGPath is the path to the gpg executable used to sign and decrypt with the keys held by gpg-agent.
+var GPGPath = "gpg"
+
+// AgentEncryptCommand returns the gpg command that encrypts to encryptTo and/or signs on behalf of signFrom what is
+// written to its stdin, using the keys gpg-agent holds so they never have to be exported to a keyring file.
+func AgentEncryptCommand(ctx context.Context, encryptTo, signFrom string) *exec.Cmd {
+	args := agentArgs("--compress-algo", "none", "--cipher-algo", "AES256", "--digest-algo", "SHA256", "--trust-model", "always")
+	if encryptTo != "" {
+		args = append(args, "--encrypt", "--recipient", encryptTo)
+	}
+	if signFrom != "" {
+		args = append(args, "--sign", "--local-user", signFrom)
+	}
+	args = append(args, "--output", "-")
+
+	return agentCommand(ctx, args)
+}
+
+// AgentDecryptCommand returns the gpg command that decrypts and verifies what is written to its stdin. The status
+// lines gpg writes to stderr should be passed to CheckAgentSignature once it exits.
+func AgentDecryptCommand(ctx context.Context) *exec.Cmd {
+	return agentCommand(ctx, agentArgs("--status-fd", "2", "--decrypt", "--output", "-"))
+}
+
+// AgentDetachSignCommand returns the gpg command that writes a detached signature on behalf of signFrom of what is
+// written to its stdin.
+func AgentDetachSignCommand(ctx context.Context, signFrom string) *exec.Cmd {
+	return agentCommand(ctx, agentArgs("--digest-algo", "SHA256", "--detach-sign", "--local-user", signFrom, "--output", "-"))
+}
+
+// AgentVerifyCommand returns the gpg command that verifies the detached signature at signaturePath against what is
+// written to its stdin. The status lines gpg writes to stderr should be passed to CheckAgentSignature once it exits.
+func AgentVerifyCommand(ctx context.Context, signaturePath string) *exec.Cmd {
+	return agentCommand(ctx, agentArgs("--status-fd", "2", "--verify", signaturePath, "-"))
+}
+
+// CheckAgentSignature returns an error unless the status lines written by gpg report a good signature from signFrom.
+func CheckAgentSignature(status []byte, signFrom string) error {
+	if signFrom == "" {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "[GNUPG:] GOODSIG ") && strings.Contains(line, "<"+signFrom+">") {
+			return nil
+		}
+	}
+	return fmt.Errorf("did not find a good signature from %s", signFrom)
+}
+
+// CheckAgentDecryption returns an error unless the status lines written by gpg while reading the start of a message
+// report it could decrypt it, when encrypted, and read the data it holds.
+func CheckAgentDecryption(status []byte, encrypted bool) error {
+	var decrypting, plaintext bool
+	scanner := bufio.NewScanner(bytes.NewReader(status))
+	for scanner.Scan() {
+		switch line := scanner.Text(); {
+		case strings.HasPrefix(line, "[GNUPG:] BEGIN_DECRYPTION"):
+			decrypting = true
+		case strings.HasPrefix(line, "[GNUPG:] PLAINTEXT "):
+			plaintext = true
+		}
+	}
+	if encrypted && !decrypting {
+		return fmt.Errorf("gpg could not decrypt the message: %s", strings.TrimSpace(string(status)))
+	}
+	if !plaintext {
+		return fmt.Errorf("gpg could not read the message: %s", strings.TrimSpace(string(status)))
+	}
+	return nil
+}
+
+// agentArgs prepends --batch when running non-interactively so gpg fails instead of waiting on a pinentry prompt
+// nobody will answer.
+func agentArgs(args ...string) []string {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return append([]string{"--batch"}, args...)
+	}
+	return args
+}
+
+// agentCommand sets GPG_TTY for interactive runs so gpg-agent can show pinentry on the terminal, as stdin is used for
+// the data.
+func agentCommand(ctx context.Context, args []string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, GPGPath, args...)
+	cmd.Env = os.Environ()
+	if os.Getenv("GPG_TTY") == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		if tty, err := os.Readlink("/proc/self/fd/0"); err == nil {
+			cmd.Env = append(cmd.Env, "GPG_TTY="+tty)
+		}
+	}
+	return cmd
+}
@@ -0,0 +1,218 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pgp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1" // nolint:gosec // SHA1 is mandated by the Web Key Directory specification
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+
+	"github.com/jdfalk/zfsbackup-go/log"
+)
+
+// zbase32Alphabet is the alphabet used to encode the hashed local part of an email for the Web Key Directory.
+const zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+
+// maxKeySize bounds how much is read from a key lookup, keys are far smaller than this.
+const maxKeySize = 1 << 20
+
+var fetchClient = &http.Client{Timeout: 30 * time.Second}
+
+// FetchPublicKey looks up the keys for email with the Web Key Directory of its domain, then on the keyserver
+// (hkps://, hkp://, https:// or http://) if one was provided and WKD had none. Only the keys with a user id for
+// email are returned, along with where they were found.
+func FetchPublicKey(ctx context.Context, email, keyserver string) (openpgp.EntityList, string, error) {
+	urls, err := wkdURLs(email)
+	if err != nil {
+		return nil, "", err
+	}
+	if keyserver != "" {
+		lookup, kerr := keyserverURL(keyserver, email)
+		if kerr != nil {
+			return nil, "", kerr
+		}
+		urls = append(urls, lookup)
+	}
+
+	for _, u := range urls {
+		keys, ferr := fetchKeys(ctx, u, email)
+		if ferr != nil {
+			log.AppLogger.Debugf("Could not fetch the key for %s from %s - %v", email, u, ferr)
+			continue
+		}
+		if len(keys) > 0 {
+			return keys, u, nil
+		}
+	}
+	return nil, "", fmt.Errorf("could not find a key for %s", email)
+}
+
+// AddPublicKeys makes the keys provided available as if they had been read from the public keyring.
+func AddPublicKeys(keys openpgp.EntityList) {
+	pubRing = append(pubRing, keys...)
+}
+
+// LoadPinnedKey reads the key previously pinned to the file at path with PinKey.
+func LoadPinnedKey(path string) (*openpgp.Entity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) != 1 {
+		return nil, fmt.Errorf("expected a single key in %s, found %d", path, len(keys))
+	}
+	return keys[0], nil
+}
+
+// PinKey writes the public part of the key to the file at path so later runs use it instead of fetching it again.
+func PinKey(path string, key *openpgp.Entity) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	w, err := armor.Encode(f, openpgp.PublicKeyType, nil)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = key.Serialize(w); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = w.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// wkdURLs returns the advanced and direct Web Key Directory URLs the key for email may be found at.
+func wkdURLs(email string) ([]string, error) {
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid email address %s", email)
+	}
+	local, domain := parts[0], strings.ToLower(parts[1])
+	// nolint:gosec // SHA1 is mandated by the Web Key Directory specification
+	hash := sha1.Sum([]byte(strings.ToLower(local)))
+	hu := zbase32(hash[:])
+	query := "?l=" + url.QueryEscape(local)
+
+	return []string{
+		fmt.Sprintf("https://openpgpkey.%s/.well-known/openpgpkey/%s/hu/%s%s", domain, domain, hu, query),
+		fmt.Sprintf("https://%s/.well-known/openpgpkey/hu/%s%s", domain, hu, query),
+	}, nil
+}
+
+// keyserverURL returns the HKP lookup URL for the keys of email on the keyserver.
+func keyserverURL(keyserver, email string) (string, error) {
+	u, err := url.Parse(keyserver)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "hkps":
+		u.Scheme = "https"
+	case "hkp":
+		u.Scheme = "http"
+		if u.Port() == "" {
+			u.Host += ":11371"
+		}
+	case "https", "http":
+	default:
+		return "", fmt.Errorf("unsupported keyserver %s, expected a hkps://, hkp://, https:// or http:// URL", keyserver)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/pks/lookup"
+	u.RawQuery = url.Values{"op": {"get"}, "options": {"mr"}, "search": {email}}.Encode()
+	return u.String(), nil
+}
+
+// fetchKeys downloads the armored or binary keys at u, returning those with a user id for email.
+func fetchKeys(ctx context.Context, u, email string) (openpgp.EntityList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, http.NoBody)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeySize))
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(body))
+	if err != nil {
+		if keys, err = openpgp.ReadKeyRing(bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+	}
+
+	matching := make(openpgp.EntityList, 0, len(keys))
+	for _, key := range keys {
+		if getKeyByEmail(openpgp.EntityList{key}, email) != nil {
+			matching = append(matching, key)
+		}
+	}
+	return matching, nil
+}
+
+// zbase32 encodes data with the human-oriented base-32 encoding, without padding.
+func zbase32(data []byte) string {
+	var (
+		out    strings.Builder
+		buffer uint
+		bits   uint
+	)
+	for _, b := range data {
+		buffer = buffer<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out.WriteByte(zbase32Alphabet[(buffer>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		out.WriteByte(zbase32Alphabet[(buffer<<(5-bits))&31])
+	}
+	return out.String()
+}
@@ -0,0 +1,117 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pgp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestZBase32(t *testing.T) {
+	testCases := []struct {
+		data     []byte
+		expected string
+	}{
+		{data: nil, expected: ""},
+		{data: []byte{0x00}, expected: "yy"},
+		{data: []byte{0xf0}, expected: "6y"},
+		{data: []byte{0xff, 0xff, 0xff, 0xff, 0xff}, expected: "99999999"},
+	}
+
+	for idx, testCase := range testCases {
+		if got := zbase32(testCase.data); got != testCase.expected {
+			t.Errorf("%d: Expected %x to be encoded as %s, got %s", idx, testCase.data, testCase.expected, got)
+		}
+	}
+}
+
+func TestWKDURLs(t *testing.T) {
+	// The example from the Web Key Directory specification
+	urls, err := wkdURLs("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatalf("Expected nil error, got %v", err)
+	}
+	expected := []string{
+		"https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+		"https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+	}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Errorf("Expected %v, got %v", expected, urls)
+	}
+
+	if urls, err = wkdURLs("a+b@example.org"); err != nil || len(urls) != 2 || !strings.HasSuffix(urls[1], "?l=a%2Bb") {
+		t.Errorf("Expected the local part to be escaped in the query, got %v (%v)", urls, err)
+	}
+
+	for _, email := range []string{"", "joe", "@example.org", "joe@", "joe@doe@example.org"} {
+		if _, err = wkdURLs(email); err == nil {
+			t.Errorf("Expected error for the email address %q, got nil", email)
+		}
+	}
+}
+
+func TestKeyserverURL(t *testing.T) {
+	testCases := []struct {
+		keyserver string
+		expected  string
+		valid     bool
+	}{
+		{
+			keyserver: "hkps://keys.openpgp.org",
+			expected:  "https://keys.openpgp.org/pks/lookup?op=get&options=mr&search=joe%40example.org",
+			valid:     true,
+		},
+		{
+			keyserver: "hkp://keyserver.example.com",
+			expected:  "http://keyserver.example.com:11371/pks/lookup?op=get&options=mr&search=joe%40example.org",
+			valid:     true,
+		},
+		{
+			keyserver: "hkp://keyserver.example.com:80",
+			expected:  "http://keyserver.example.com:80/pks/lookup?op=get&options=mr&search=joe%40example.org",
+			valid:     true,
+		},
+		{
+			keyserver: "https://keys.example.com/keyserver/",
+			expected:  "https://keys.example.com/keyserver/pks/lookup?op=get&options=mr&search=joe%40example.org",
+			valid:     true,
+		},
+		{keyserver: "ldap://keys.example.com"},
+		{keyserver: "keys.openpgp.org"},
+		{keyserver: "hkps://keys.example.com:port"},
+	}
+
+	for idx, testCase := range testCases {
+		u, err := keyserverURL(testCase.keyserver, "joe@example.org")
+		if !testCase.valid {
+			if err == nil {
+				t.Errorf("%d: Expected error for the keyserver %s, got nil", idx, testCase.keyserver)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: Expected nil error for the keyserver %s, got %v", idx, testCase.keyserver, err)
+		} else if u != testCase.expected {
+			t.Errorf("%d: Expected %s, got %s", idx, testCase.expected, u)
+		}
+	}
+}
@@ -21,11 +21,15 @@
 package pgp
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
 
 	"github.com/jdfalk/zfsbackup-go/log"
 )
@@ -105,3 +109,188 @@ func PrintPGPDebugInformation() {
 
 	log.AppLogger.Debugf("%s", strings.Join(debugStr, "\n"))
 }
+
+// CheckEncryptionKey returns an error explaining why data cannot be encrypted to the entity, such as the key or all
+// of its encryption subkeys having expired or been revoked.
+func CheckEncryptionKey(entity *openpgp.Entity, now time.Time) error {
+	return checkKey(entity, "encryption", func(sig *packet.Signature) bool { return sig.FlagEncryptCommunications }, now)
+}
+
+// CheckSigningKey returns an error explaining why data cannot be signed by the entity, such as the key or all of its
+// signing subkeys having expired or been revoked.
+func CheckSigningKey(entity *openpgp.Entity, now time.Time) error {
+	return checkKey(entity, "signing", func(sig *packet.Signature) bool { return sig.FlagSign }, now)
+}
+
+// SelectEncryptionKey returns a copy of the entity restricted to encrypting with the key, primary or subkey, matching
+// the fingerprint provided.
+func SelectEncryptionKey(entity *openpgp.Entity, fingerprint string, now time.Time) (*openpgp.Entity, error) {
+	return selectKey(entity, fingerprint, "encryption", func(sig *packet.Signature) bool { return sig.FlagEncryptCommunications }, now)
+}
+
+// SelectSigningKey returns a copy of the entity restricted to signing with the key, primary or subkey, matching the
+// fingerprint provided.
+func SelectSigningKey(entity *openpgp.Entity, fingerprint string, now time.Time) (*openpgp.Entity, error) {
+	return selectKey(entity, fingerprint, "signing", func(sig *packet.Signature) bool { return sig.FlagSign }, now)
+}
+
+func checkKey(entity *openpgp.Entity, usage string, hasUsage func(*packet.Signature) bool, now time.Time) error {
+	if len(entity.Revocations) > 0 {
+		return fmt.Errorf("the key %s has been revoked", entity.PrimaryKey.KeyIdString())
+	}
+	selfSig := primarySelfSignature(entity)
+	if selfSig != nil && selfSig.KeyExpired(now) {
+		return fmt.Errorf("the key %s expired on %s", entity.PrimaryKey.KeyIdString(), keyExpiry(entity.PrimaryKey, selfSig))
+	}
+
+	reasons := make([]string, 0, len(entity.Subkeys))
+	for _, subkey := range entity.Subkeys {
+		switch {
+		case subkey.Sig.SigType == packet.SigTypeSubkeyRevocation:
+			reasons = append(reasons, fmt.Sprintf("the subkey %s has been revoked", subkey.PublicKey.KeyIdString()))
+		case !subkey.Sig.FlagsValid || !hasUsage(subkey.Sig):
+		case subkey.Sig.KeyExpired(now):
+			reasons = append(reasons, fmt.Sprintf(
+				"the %s subkey %s expired on %s", usage, subkey.PublicKey.KeyIdString(), keyExpiry(subkey.PublicKey, subkey.Sig),
+			))
+		default:
+			return nil
+		}
+	}
+
+	// The primary key is used when no subkey can be, unless its flags rule it out
+	if selfSig == nil || !selfSig.FlagsValid || hasUsage(selfSig) {
+		return nil
+	}
+	reasons = append(reasons, "the primary key cannot be used for "+usage)
+	return fmt.Errorf("the key %s has no usable %s key: %s", entity.PrimaryKey.KeyIdString(), usage, strings.Join(reasons, ", "))
+}
+
+func selectKey(
+	entity *openpgp.Entity,
+	fingerprint, usage string,
+	hasUsage func(*packet.Signature) bool,
+	now time.Time,
+) (*openpgp.Entity, error) {
+	fingerprint = strings.ToUpper(strings.TrimPrefix(strings.ReplaceAll(fingerprint, " ", ""), "0x"))
+
+	// Drop every other key for the usage so openpgp can only pick the one selected
+	selected := *entity
+	selected.Subkeys = make([]openpgp.Subkey, 0, len(entity.Subkeys))
+	found := false
+	if fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint) == fingerprint {
+		if selfSig := primarySelfSignature(entity); selfSig != nil && selfSig.FlagsValid && !hasUsage(selfSig) {
+			return nil, fmt.Errorf("the primary key %s cannot be used for %s", fingerprint, usage)
+		}
+		found = true
+	}
+	for _, subkey := range entity.Subkeys {
+		if fmt.Sprintf("%X", subkey.PublicKey.Fingerprint) == fingerprint {
+			if !subkey.Sig.FlagsValid || !hasUsage(subkey.Sig) {
+				return nil, fmt.Errorf("the subkey %s cannot be used for %s", fingerprint, usage)
+			}
+			// openpgp would silently fall back to the primary key otherwise
+			if subkey.Sig.KeyExpired(now) {
+				return nil, fmt.Errorf("the subkey %s expired on %s", fingerprint, keyExpiry(subkey.PublicKey, subkey.Sig))
+			}
+			found = true
+		} else if subkey.Sig.FlagsValid && hasUsage(subkey.Sig) {
+			continue
+		}
+		selected.Subkeys = append(selected.Subkeys, subkey)
+	}
+	if !found {
+		return nil, fmt.Errorf("the key %s has no key with the fingerprint %s", entity.PrimaryKey.KeyIdString(), fingerprint)
+	}
+
+	return &selected, nil
+}
+
+// primarySelfSignature returns the self signature of the identity marked as primary, or of the first identity if none
+// are so marked, the same way the openpgp package picks it.
+func primarySelfSignature(entity *openpgp.Entity) *packet.Signature {
+	var selfSig *packet.Signature
+	for _, ident := range entity.Identities {
+		if selfSig == nil {
+			selfSig = ident.SelfSignature
+		}
+		if ident.SelfSignature.IsPrimaryId != nil && *ident.SelfSignature.IsPrimaryId {
+			return ident.SelfSignature
+		}
+	}
+	return selfSig
+}
+
+func keyExpiry(key *packet.PublicKey, sig *packet.Signature) string {
+	return key.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second).Format(time.RFC3339)
+}
+
+// CheckFIPSKey returns an error unless every key of the entity that could be used to encrypt, or to sign, uses a FIPS
+// approved algorithm: RSA of at least 2048 bits, or ECDSA (and ECDH for encryption) on a NIST P curve. Keys used to
+// encrypt must also prefer AES-256 and SHA-256 so openpgp does not negotiate weaker algorithms.
+func CheckFIPSKey(entity *openpgp.Entity, encrypt bool) error {
+	usage := "signing"
+	hasUsage := func(sig *packet.Signature) bool { return sig.FlagSign }
+	if encrypt {
+		usage = "encryption"
+		hasUsage = func(sig *packet.Signature) bool { return sig.FlagEncryptCommunications }
+	}
+
+	selfSig := primarySelfSignature(entity)
+	if selfSig == nil || !selfSig.FlagsValid || hasUsage(selfSig) {
+		if err := checkFIPSAlgorithm(entity.PrimaryKey); err != nil {
+			return err
+		}
+	}
+	for _, subkey := range entity.Subkeys {
+		if subkey.Sig.FlagsValid && hasUsage(subkey.Sig) {
+			if err := checkFIPSAlgorithm(subkey.PublicKey); err != nil {
+				return err
+			}
+		}
+	}
+
+	if encrypt && selfSig != nil {
+		if !containsAlgorithm(selfSig.PreferredSymmetric, uint8(packet.CipherAES256)) {
+			return fmt.Errorf("the key %s does not list AES-256 in its preferred ciphers", entity.PrimaryKey.KeyIdString())
+		}
+		// SHA-256 is the identifier 8, see RFC 4880 section 9.4
+		if !containsAlgorithm(selfSig.PreferredHash, 8) {
+			return fmt.Errorf("the key %s does not list SHA-256 in its preferred hashes", entity.PrimaryKey.KeyIdString())
+		}
+	}
+	log.AppLogger.Debugf("The %s key %s only uses FIPS approved algorithms.", usage, entity.PrimaryKey.KeyIdString())
+
+	return nil
+}
+
+func checkFIPSAlgorithm(key *packet.PublicKey) error {
+	switch key.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		bits, err := key.BitLength()
+		if err != nil {
+			return err
+		}
+		if bits < 2048 {
+			return fmt.Errorf("the key %s is a %d bit RSA key, at least 2048 bits are required", key.KeyIdString(), bits)
+		}
+	case packet.PubKeyAlgoECDSA, packet.PubKeyAlgoECDH:
+		// openpgp only reads ECDSA and ECDH keys on the NIST P-256, P-384, and P-521 curves, but do not rely on it
+		pub, ok := key.PublicKey.(*ecdsa.PublicKey)
+		if !ok || (pub.Curve != elliptic.P256() && pub.Curve != elliptic.P384() && pub.Curve != elliptic.P521()) {
+			return fmt.Errorf("the key %s does not use a NIST P-256, P-384, or P-521 curve", key.KeyIdString())
+		}
+	default:
+		return fmt.Errorf("the key %s uses an algorithm (%d) that is not FIPS approved", key.KeyIdString(), key.PubKeyAlgo)
+	}
+	return nil
+}
+
+func containsAlgorithm(preferences []uint8, algorithm uint8) bool {
+	for _, preference := range preferences {
+		if preference == algorithm {
+			return true
+		}
+	}
+	return false
+}
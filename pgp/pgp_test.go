@@ -0,0 +1,326 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package pgp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+var testKeyCreation = time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestEntity returns a small RSA key, with a signing primary key and an encryption subkey, created at
+// testKeyCreation. Extra encryption subkeys are taken from other generated keys, the binding signatures of an
+// entity built in memory are never verified.
+func newTestEntity(t *testing.T, extraSubkeys int) *openpgp.Entity {
+	t.Helper()
+	config := &packet.Config{RSABits: 1024, Time: func() time.Time { return testKeyCreation }}
+	entity, err := openpgp.NewEntity("Test", "", "test@example.com", config)
+	if err != nil {
+		t.Fatalf("could not generate a test key - %v", err)
+	}
+	for i := 0; i < extraSubkeys; i++ {
+		other, oerr := openpgp.NewEntity("Other", "", "other@example.com", config)
+		if oerr != nil {
+			t.Fatalf("could not generate a test key - %v", oerr)
+		}
+		entity.Subkeys = append(entity.Subkeys, other.Subkeys...)
+	}
+	return entity
+}
+
+func expire(sig *packet.Signature, lifetime time.Duration) {
+	secs := uint32(lifetime / time.Second)
+	sig.KeyLifetimeSecs = &secs
+}
+
+func fingerprint(key *packet.PublicKey) string {
+	return fmt.Sprintf("%X", key.Fingerprint)
+}
+
+func encryptionSubkeys(entity *openpgp.Entity) []string {
+	var keys []string
+	for _, subkey := range entity.Subkeys {
+		if subkey.Sig.FlagsValid && subkey.Sig.FlagEncryptCommunications {
+			keys = append(keys, subkey.PublicKey.KeyIdString())
+		}
+	}
+	return keys
+}
+
+func TestCheckKey(t *testing.T) {
+	now := testKeyCreation.Add(48 * time.Hour)
+
+	testCases := []struct {
+		name     string
+		subkeys  int
+		modify   func(e *openpgp.Entity)
+		encrypt  bool
+		expected string
+	}{
+		{name: "valid encryption key", encrypt: true},
+		{name: "valid signing key"},
+		{
+			name:     "revoked key",
+			modify:   func(e *openpgp.Entity) { e.Revocations = append(e.Revocations, &packet.Signature{}) },
+			encrypt:  true,
+			expected: "the key %[1]s has been revoked",
+		},
+		{
+			name:     "expired primary key",
+			modify:   func(e *openpgp.Entity) { expire(primarySelfSignature(e), time.Hour) },
+			expected: "the key %[1]s expired on 2024-01-01T01:00:00Z",
+		},
+		{
+			name:     "expired primary key with a valid encryption subkey",
+			modify:   func(e *openpgp.Entity) { expire(primarySelfSignature(e), time.Hour) },
+			encrypt:  true,
+			expected: "the key %[1]s expired on 2024-01-01T01:00:00Z",
+		},
+		{
+			name:     "only expired encryption subkeys",
+			subkeys:  1,
+			modify:   func(e *openpgp.Entity) { expire(e.Subkeys[0].Sig, time.Hour); expire(e.Subkeys[1].Sig, 24*time.Hour) },
+			encrypt:  true,
+			expected: "the encryption subkey %[2]s expired on 2024-01-01T01:00:00Z, the encryption subkey %[3]s expired on 2024-01-02T00:00:00Z",
+		},
+		{
+			name:    "one expired and one valid encryption subkey",
+			subkeys: 1,
+			modify:  func(e *openpgp.Entity) { expire(e.Subkeys[0].Sig, time.Hour); expire(e.Subkeys[1].Sig, 72*time.Hour) },
+			encrypt: true,
+		},
+		{
+			name:     "revoked encryption subkey",
+			modify:   func(e *openpgp.Entity) { e.Subkeys[0].Sig.SigType = packet.SigTypeSubkeyRevocation },
+			encrypt:  true,
+			expected: "the subkey %[2]s has been revoked, the primary key cannot be used for encryption",
+		},
+		{
+			name:    "encryption subkeys do not affect signing",
+			modify:  func(e *openpgp.Entity) { e.Subkeys[0].Sig.SigType = packet.SigTypeSubkeyRevocation },
+			encrypt: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		entity := newTestEntity(t, testCase.subkeys)
+		if testCase.modify != nil {
+			testCase.modify(entity)
+		}
+
+		var err error
+		if testCase.encrypt {
+			err = CheckEncryptionKey(entity, now)
+		} else {
+			err = CheckSigningKey(entity, now)
+		}
+		if testCase.expected == "" {
+			if err != nil {
+				t.Errorf("%s: Expected nil error, got %v", testCase.name, err)
+			}
+			continue
+		}
+
+		ids := []interface{}{entity.PrimaryKey.KeyIdString()}
+		for _, subkey := range entity.Subkeys {
+			ids = append(ids, subkey.PublicKey.KeyIdString())
+		}
+		expected := fmt.Sprintf(testCase.expected, ids...)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("%s: Expected an error containing %q, got %v", testCase.name, expected, err)
+		}
+	}
+}
+
+func TestSelectKey(t *testing.T) {
+	now := testKeyCreation.Add(48 * time.Hour)
+	entity := newTestEntity(t, 2)
+	expire(entity.Subkeys[2].Sig, time.Hour)
+	primary, first, second := entity.PrimaryKey, entity.Subkeys[0].PublicKey, entity.Subkeys[1].PublicKey
+
+	// Fingerprints are accepted in lower case, with spaces, and with a 0x prefix
+	spaced := strings.ToLower(fingerprint(second))
+	spaced = "0x" + spaced[:8] + " " + spaced[8:]
+	selected, err := SelectEncryptionKey(entity, spaced, now)
+	if err != nil {
+		t.Fatalf("Expected nil error selecting the second subkey, got %v", err)
+	}
+	if keys := encryptionSubkeys(selected); len(keys) != 1 || keys[0] != second.KeyIdString() {
+		t.Errorf("Expected only the selected subkey %s to be left to encrypt to, got %v", second.KeyIdString(), keys)
+	}
+	if len(entity.Subkeys) != 3 {
+		t.Errorf("Expected the entity selected from not to be modified, got %d subkeys", len(entity.Subkeys))
+	}
+
+	if selected, err = SelectEncryptionKey(entity, fingerprint(first), now); err != nil {
+		t.Fatalf("Expected nil error selecting the first subkey, got %v", err)
+	}
+	if keys := encryptionSubkeys(selected); len(keys) != 1 || keys[0] != first.KeyIdString() {
+		t.Errorf("Expected only the selected subkey %s to be left to encrypt to, got %v", first.KeyIdString(), keys)
+	}
+
+	if selected, err = SelectSigningKey(entity, fingerprint(primary), now); err != nil {
+		t.Fatalf("Expected nil error selecting the primary key for signing, got %v", err)
+	}
+	if selected.PrimaryKey != primary || len(selected.Subkeys) != 3 {
+		t.Errorf("Expected the primary key to be selected and the encryption subkeys kept, got %d subkeys", len(selected.Subkeys))
+	}
+
+	for name, testCase := range map[string]struct {
+		fingerprint string
+		encrypt     bool
+		expected    string
+	}{
+		"primary key for encryption": {fingerprint: fingerprint(primary), encrypt: true, expected: "cannot be used for encryption"},
+		"subkey for signing":         {fingerprint: fingerprint(first), expected: "cannot be used for signing"},
+		"expired subkey":             {fingerprint: fingerprint(entity.Subkeys[2].PublicKey), encrypt: true, expected: "expired on"},
+		"unknown fingerprint":        {fingerprint: strings.Repeat("AB", 20), encrypt: true, expected: "has no key with the fingerprint"},
+	} {
+		if testCase.encrypt {
+			_, err = SelectEncryptionKey(entity, testCase.fingerprint, now)
+		} else {
+			_, err = SelectSigningKey(entity, testCase.fingerprint, now)
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+			t.Errorf("%s: Expected an error containing %q, got %v", name, testCase.expected, err)
+		}
+	}
+}
+
+func TestCheckFIPSKey(t *testing.T) {
+	// NewEntity only records the preferences of the config provided
+	fipsEntity := func(bits int) *openpgp.Entity {
+		config := &packet.Config{RSABits: bits, DefaultHash: crypto.SHA256, DefaultCipher: packet.CipherAES256}
+		entity, err := openpgp.NewEntity("Test", "", "test@example.com", config)
+		if err != nil {
+			t.Fatalf("could not generate a test key - %v", err)
+		}
+		return entity
+	}
+	ecdsaKey := func(curve elliptic.Curve) *packet.PublicKey {
+		priv, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatalf("could not generate a test key - %v", err)
+		}
+		return packet.NewECDSAPublicKey(testKeyCreation, &priv.PublicKey)
+	}
+
+	testCases := []struct {
+		name     string
+		bits     int
+		modify   func(e *openpgp.Entity)
+		encrypt  bool
+		expected string
+	}{
+		{name: "RSA-2048 signing key", bits: 2048},
+		{name: "RSA-2048 encryption key", bits: 2048, encrypt: true},
+		{name: "RSA-1024 signing key", bits: 1024, expected: "is a 1024 bit RSA key"},
+		{name: "RSA-1024 encryption key", bits: 1024, encrypt: true, expected: "is a 1024 bit RSA key"},
+		{
+			name:   "ECDSA P-384 signing key",
+			bits:   1024,
+			modify: func(e *openpgp.Entity) { e.PrimaryKey = ecdsaKey(elliptic.P384()) },
+		},
+		{
+			name: "ECDSA P-224 signing key",
+			bits: 1024,
+			modify: func(e *openpgp.Entity) {
+				priv, err := ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+				if err != nil {
+					t.Fatalf("could not generate a test key - %v", err)
+				}
+				// openpgp cannot serialize a P-224 key, as it has no OID for it
+				e.PrimaryKey = &packet.PublicKey{PubKeyAlgo: packet.PubKeyAlgoECDSA, PublicKey: &priv.PublicKey}
+			},
+			expected: "does not use a NIST P-256, P-384, or P-521 curve",
+		},
+		{
+			name: "EdDSA signing key",
+			bits: 1024,
+			modify: func(e *openpgp.Entity) {
+				pub, _, _ := ed25519.GenerateKey(rand.Reader)
+				// EdDSA is algorithm 22, which openpgp does not define
+				e.PrimaryKey = &packet.PublicKey{PubKeyAlgo: packet.PublicKeyAlgorithm(22), PublicKey: pub}
+			},
+			expected: "uses an algorithm (22) that is not FIPS approved",
+		},
+		{
+			name: "Curve25519 encryption subkey",
+			bits: 2048,
+			modify: func(e *openpgp.Entity) {
+				pub, _, _ := ed25519.GenerateKey(rand.Reader)
+				e.Subkeys[0].PublicKey = &packet.PublicKey{PubKeyAlgo: packet.PubKeyAlgoECDH, PublicKey: pub}
+			},
+			encrypt:  true,
+			expected: "does not use a NIST P-256, P-384, or P-521 curve",
+		},
+		{
+			name: "key without the AES-256 preference",
+			bits: 2048,
+			modify: func(e *openpgp.Entity) {
+				primarySelfSignature(e).PreferredSymmetric = []uint8{uint8(packet.CipherAES128)}
+			},
+			encrypt:  true,
+			expected: "does not list AES-256 in its preferred ciphers",
+		},
+		{
+			name:     "key without the SHA-256 preference",
+			bits:     2048,
+			modify:   func(e *openpgp.Entity) { primarySelfSignature(e).PreferredHash = nil },
+			encrypt:  true,
+			expected: "does not list SHA-256 in its preferred hashes",
+		},
+		{
+			name:   "preferences are not needed to sign",
+			bits:   2048,
+			modify: func(e *openpgp.Entity) { primarySelfSignature(e).PreferredSymmetric = nil },
+		},
+	}
+
+	for _, testCase := range testCases {
+		entity := fipsEntity(testCase.bits)
+		if testCase.modify != nil {
+			testCase.modify(entity)
+		}
+
+		err := CheckFIPSKey(entity, testCase.encrypt)
+		if testCase.expected == "" {
+			if err != nil {
+				t.Errorf("%s: Expected nil error, got %v", testCase.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), testCase.expected) {
+			t.Errorf("%s: Expected an error containing %q, got %v", testCase.name, testCase.expected, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zfs
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// SSHPath is the path to the ssh binary used to run commands on a remote host
+var SSHPath = "ssh"
+
+// remote is the destination ([user@]host) and port the zfs and zpool commands are run on, if any
+var remote *remoteHost
+
+type remoteHost struct {
+	destination string
+	port        string
+}
+
+var shellSafe = regexp.MustCompile(`^[A-Za-z0-9_@%+=:,./-]+$`)
+
+// SetRemote will run every zfs and zpool command, apart from zfs send, on the host of the
+// ssh://[user@]host[:port] URI provided, over SSH. An empty URI runs the commands locally again.
+func SetRemote(uri string) error {
+	if uri == "" {
+		remote = nil
+		return nil
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "ssh" || u.Hostname() == "" {
+		return fmt.Errorf("expected a remote host in the format ssh://[user@]host[:port], got %s instead", uri)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return fmt.Errorf("the remote host %s should not have a path or query", uri)
+	}
+
+	r := &remoteHost{destination: u.Hostname(), port: u.Port()}
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return fmt.Errorf("passwords are not supported for the remote host, use an SSH key or agent instead")
+		}
+		r.destination = u.User.Username() + "@" + r.destination
+	}
+	remote = r
+	return nil
+}
+
+// command will return the command to run the binary with the args provided, wrapped in an ssh
+// invocation when a remote host was set.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if remote == nil {
+		return exec.CommandContext(ctx, name, args...)
+	}
+
+	// Never prompt for credentials, the stdin of the command may be a zfs stream
+	sshArgs := []string{"-o", "BatchMode=yes"}
+	if remote.port != "" {
+		sshArgs = append(sshArgs, "-p", remote.port)
+	}
+
+	// The remote shell will split the command line again, so quote every argument
+	quoted := make([]string, 0, len(args)+1)
+	for _, arg := range append([]string{name}, args...) {
+		quoted = append(quoted, shellQuote(arg))
+	}
+	sshArgs = append(sshArgs, remote.destination, strings.Join(quoted, " "))
+
+	return exec.CommandContext(ctx, SSHPath, sshArgs...)
+}
+
+func shellQuote(s string) string {
+	if shellSafe.MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -24,6 +24,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"strconv"
 	"strings"
@@ -33,11 +35,21 @@ import (
 	"github.com/jdfalk/zfsbackup-go/log"
 )
 
-// ZFSPath is the path to the zfs binary
 var (
+	// ZFSPath is the path to the zfs binary
 	ZFSPath = "zfs"
+	// ZPoolPath is the path to the zpool binary
+	ZPoolPath = "zpool"
+	// ZvolDeviceDir is the directory the block devices of zvols (and their visible snapshots) are found in
+	ZvolDeviceDir = "/dev/zvol"
 )
 
+// IsDatasetNotExist reports whether the error returned by a zfs command is the one zfs reports for a dataset that
+// does not exist.
+func IsDatasetNotExist(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "dataset does not exist")
+}
+
 // GetCreationDate will use the zfs command to get and parse the creation datetime
 // of the specified volume/snapshot
 func GetCreationDate(ctx context.Context, target string) (time.Time, error) {
@@ -55,7 +67,7 @@ func GetCreationDate(ctx context.Context, target string) (time.Time, error) {
 // GetSnapshotsAndBookmarks will retrieve all snapshots and bookmarks for the given target
 func GetSnapshotsAndBookmarks(ctx context.Context, target string) ([]files.SnapshotInfo, error) {
 	errB := new(bytes.Buffer)
-	cmd := exec.CommandContext(
+	cmd := command(
 		ctx, ZFSPath, "list", "-H", "-d", "1", "-p", "-t", "snapshot,bookmark", "-r", "-o", "name,creation,type", "-S", "creation", target,
 	)
 	log.AppLogger.Debugf("Getting ZFS Snapshots with command \"%s\"", strings.Join(cmd.Args, " "))
@@ -94,12 +106,223 @@ func GetSnapshotsAndBookmarks(ctx context.Context, target string) ([]files.Snaps
 	return snapshots, nil
 }
 
+// GetDatasets will retrieve the target along with every filesystem and volume beneath it, or every
+// filesystem and volume on the system if no target is given. Parents are always listed before their children.
+func GetDatasets(ctx context.Context, target string) ([]string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	zfsArgs := []string{"list", "-H", "-r", "-o", "name", "-t", "filesystem,volume"}
+	if target != "" {
+		zfsArgs = append(zfsArgs, target)
+	}
+	cmd := command(ctx, ZFSPath, zfsArgs...)
+	log.AppLogger.Debugf("Getting ZFS Datasets with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return strings.Fields(b.String()), nil
+}
+
+// CreateSnapshot will take a snapshot of the target with the given name, including all
+// descendant datasets if recursive is set.
+func CreateSnapshot(ctx context.Context, target, name string, recursive bool) error {
+	errB := new(bytes.Buffer)
+	zfsArgs := []string{"snapshot"}
+	if recursive {
+		zfsArgs = append(zfsArgs, "-r")
+	}
+	zfsArgs = append(zfsArgs, fmt.Sprintf("%s@%s", target, name))
+	cmd := command(ctx, ZFSPath, zfsArgs...)
+	log.AppLogger.Debugf("Creating ZFS Snapshot with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
+
+// DestroyDataset will destroy the target along with all of its snapshots and descendant datasets.
+func DestroyDataset(ctx context.Context, target string) error {
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, "destroy", "-r", target)
+	log.AppLogger.Debugf("Destroying ZFS Dataset with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
+
+// DestroySnapshot will destroy the snapshot (dataset@name) only, leaving the snapshots of the same name of any
+// descendant datasets alone.
+func DestroySnapshot(ctx context.Context, snapshot string) error {
+	return runDatasetCommand(ctx, "Destroying ZFS Snapshot", "destroy", snapshot)
+}
+
+// RenameDataset will rename the target, along with its snapshots and descendant datasets, to the new name.
+func RenameDataset(ctx context.Context, target, name string) error {
+	return runDatasetCommand(ctx, "Renaming ZFS Dataset", "rename", target, name)
+}
+
+// CloneSnapshot will create the target as a clone of the snapshot, with the properties (name=value) provided.
+func CloneSnapshot(ctx context.Context, snapshot, target string, properties ...string) error {
+	args := []string{"clone"}
+	for _, prop := range properties {
+		args = append(args, "-o", prop)
+	}
+	return runDatasetCommand(ctx, "Cloning ZFS Snapshot", append(args, snapshot, target)...)
+}
+
+// MountDataset will mount the target filesystem.
+func MountDataset(ctx context.Context, target string) error {
+	return runDatasetCommand(ctx, "Mounting ZFS Dataset", "mount", target)
+}
+
+// UnmountDataset will unmount the target filesystem.
+func UnmountDataset(ctx context.Context, target string) error {
+	return runDatasetCommand(ctx, "Unmounting ZFS Dataset", "unmount", target)
+}
+
+// LoadKey will load the encryption key of the target from its keylocation, prompting on the
+// terminal for it when the keylocation is prompt.
+func LoadKey(ctx context.Context, target string) error {
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, "load-key", target)
+	log.AppLogger.Debugf("Loading ZFS Key with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = io.MultiWriter(os.Stderr, errB)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
+
+func runDatasetCommand(ctx context.Context, action string, args ...string) error {
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, args...)
+	log.AppLogger.Debugf("%s with command \"%s\"", action, strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
+
+// AbortReceive will discard the partially received state left on the target by an interrupted resumable receive.
+func AbortReceive(ctx context.Context, target string) error {
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, "receive", "-A", target)
+	log.AppLogger.Debugf("Aborting partial ZFS receive with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
+
+// GetHolds will return the tags of the user holds placed on each of the given snapshots.
+func GetHolds(ctx context.Context, snapshots ...string) (map[string][]string, error) {
+	holds := make(map[string][]string)
+	if len(snapshots) == 0 {
+		return holds, nil
+	}
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, append([]string{"holds", "-H"}, snapshots...)...)
+	log.AppLogger.Debugf("Getting ZFS Holds with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		holds[fields[0]] = append(holds[fields[0]], fields[1])
+	}
+	return holds, nil
+}
+
+// HoldSnapshot will place a user hold with the given tag on the snapshot.
+func HoldSnapshot(ctx context.Context, tag, snapshot string) error {
+	return runHoldCommand(ctx, "hold", tag, snapshot)
+}
+
+// ReleaseSnapshot will release the user hold with the given tag from the snapshot.
+func ReleaseSnapshot(ctx context.Context, tag, snapshot string) error {
+	return runHoldCommand(ctx, "release", tag, snapshot)
+}
+
+func runHoldCommand(ctx context.Context, subcommand, tag, snapshot string) error {
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, subcommand, tag, snapshot)
+	log.AppLogger.Debugf("Running ZFS %s with command \"%s\"", subcommand, strings.Join(cmd.Args, " "))
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return nil
+}
+
+// Diff will return the changes between two snapshots of a filesystem as reported by "zfs diff -H", one change per
+// line. The filesystem must be mounted.
+func Diff(ctx context.Context, from, to string) ([]string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, "diff", "-H", from, to)
+	log.AppLogger.Debugf("Getting ZFS Diff with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	if b.Len() == 0 {
+		return nil, nil
+	}
+	return strings.Split(strings.TrimRight(b.String(), "\n"), "\n"), nil
+}
+
+// Version will return the version of the zfs userland utilities as reported by "zfs version", which is only available
+// from OpenZFS 0.8.
+func Version(ctx context.Context) (string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, "version")
+	log.AppLogger.Debugf("Getting ZFS Version with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return strings.SplitN(strings.TrimSpace(b.String()), "\n", 2)[0], nil
+}
+
+// GetPermissions will return the permissions delegated on the target and its parents as reported by "zfs allow".
+func GetPermissions(ctx context.Context, target string) (string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, "allow", target)
+	log.AppLogger.Debugf("Getting ZFS Permissions with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return b.String(), nil
+}
+
 // GetZFSProperty will return the raw value returned by the "zfs get" command for
 // the given property on the given target.
 func GetZFSProperty(ctx context.Context, prop, target string) (string, error) {
 	b := new(bytes.Buffer)
 	errB := new(bytes.Buffer)
-	cmd := exec.CommandContext(ctx, ZFSPath, "get", "-H", "-p", "-o", "value", prop, target)
+	cmd := command(ctx, ZFSPath, "get", "-H", "-p", "-o", "value", prop, target)
 	log.AppLogger.Debugf("Getting ZFS Property with command \"%s\"", strings.Join(cmd.Args, " "))
 	cmd.Stdout = b
 	cmd.Stderr = errB
@@ -110,6 +333,86 @@ func GetZFSProperty(ctx context.Context, prop, target string) (string, error) {
 	return strings.TrimSpace(b.String()), nil
 }
 
+// GetLocalProperties will return the properties set locally on the target, user properties included, keyed by name.
+func GetLocalProperties(ctx context.Context, target string) (map[string]string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZFSPath, "get", "-H", "-p", "-s", "local", "-o", "property,value", "all", target)
+	log.AppLogger.Debugf("Getting local ZFS Properties with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	err := cmd.Run()
+	if err != nil {
+		return nil, fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+
+	properties := make(map[string]string)
+	for _, line := range strings.Split(b.String(), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		properties[fields[0]] = fields[1]
+	}
+	return properties, nil
+}
+
+// SetZFSProperty will set the given property to the value provided on the target.
+func SetZFSProperty(ctx context.Context, prop, value, target string) error {
+	return runDatasetCommand(ctx, "Setting ZFS Property", "set", prop+"="+value, target)
+}
+
+// GetPoolFeature will return the state (disabled, enabled, or active) of the given feature
+// on the pool the target belongs to.
+func GetPoolFeature(ctx context.Context, feature, target string) (string, error) {
+	return GetPoolProperty(ctx, "feature@"+feature, target)
+}
+
+// GetPoolProperty will return the value of the given property of the pool the target belongs to.
+func GetPoolProperty(ctx context.Context, prop, target string) (string, error) {
+	b := new(bytes.Buffer)
+	errB := new(bytes.Buffer)
+	cmd := command(ctx, ZPoolPath, "get", "-H", "-p", "-o", "value", prop, PoolName(target))
+	log.AppLogger.Debugf("Getting ZFS Pool Property with command \"%s\"", strings.Join(cmd.Args, " "))
+	cmd.Stdout = b
+	cmd.Stderr = errB
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("%s (%v)", strings.TrimSpace(errB.String()), err)
+	}
+	return strings.TrimSpace(b.String()), nil
+}
+
+// PoolName will return the name of the pool the target belongs to.
+func PoolName(target string) string {
+	return strings.SplitN(target, "/", 2)[0]
+}
+
+// RequiredPoolFeatures will return the pool features needed to receive the stream described by
+// the given JobInfo.
+func RequiredPoolFeatures(j *files.JobInfo) []string {
+	var features []string
+
+	if j.LargeBlocks {
+		features = append(features, "large_blocks")
+	}
+
+	if j.EmbeddedData {
+		features = append(features, "embedded_data")
+	}
+
+	if j.CompressedStream() {
+		switch {
+		case strings.HasPrefix(j.StreamCompression, "zstd"):
+			features = append(features, "zstd_compress")
+		case j.StreamCompression == "lz4":
+			features = append(features, "lz4_compress")
+		}
+	}
+
+	return features
+}
+
 // GetZFSSendCommand will return the send command to use for the given JobInfo
 func GetZFSSendCommand(ctx context.Context, j *files.JobInfo) *exec.Cmd {
 	// Prepare the zfs send command
@@ -135,11 +438,21 @@ func GetZFSSendCommand(ctx context.Context, j *files.JobInfo) *exec.Cmd {
 		zfsArgs = append(zfsArgs, "-p")
 	}
 
-	if j.Compressor == files.ZfsCompressor {
+	if j.CompressedStream() {
 		log.AppLogger.Infof("Enabling the compression (-c) flag on the send.")
 		zfsArgs = append(zfsArgs, "-c")
 	}
 
+	if j.LargeBlocks {
+		log.AppLogger.Infof("Enabling the large block (-L) flag on the send.")
+		zfsArgs = append(zfsArgs, "-L")
+	}
+
+	if j.EmbeddedData {
+		log.AppLogger.Infof("Enabling the embedded data (-e) flag on the send.")
+		zfsArgs = append(zfsArgs, "-e")
+	}
+
 	if j.Raw {
 		log.AppLogger.Infof("Enabling the raw (-w) flag on the send.")
 		zfsArgs = append(zfsArgs, "-w")
@@ -166,6 +479,28 @@ func GetZFSSendCommand(ctx context.Context, j *files.JobInfo) *exec.Cmd {
 	return cmd
 }
 
+// EstimateSendSize will use a dry run of the send command for the given JobInfo to estimate
+// the number of bytes the zfs send stream will contain.
+func EstimateSendSize(ctx context.Context, j *files.JobInfo) (uint64, error) {
+	b := new(bytes.Buffer)
+	sendCmd := GetZFSSendCommand(ctx, j)
+	cmd := exec.CommandContext(ctx, ZFSPath, append([]string{"send", "-n", "-P"}, sendCmd.Args[2:]...)...)
+	log.AppLogger.Debugf("Estimating ZFS Send size with command \"%s\"", strings.Join(cmd.Args, " "))
+	// Older versions of zfs print the estimate to stderr
+	cmd.Stdout = b
+	cmd.Stderr = b
+	if err := cmd.Run(); err != nil {
+		return 0, fmt.Errorf("%s (%v)", strings.TrimSpace(b.String()), err)
+	}
+	for _, line := range strings.Split(b.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "size" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("could not find the estimated size in the output of %s", strings.Join(cmd.Args, " "))
+}
+
 // GetZFSReceiveCommand will return the recv command to use for the given JobInfo
 func GetZFSReceiveCommand(ctx context.Context, j *files.JobInfo) *exec.Cmd {
 	// Prepare the zfs send command
@@ -196,8 +531,13 @@ func GetZFSReceiveCommand(ctx context.Context, j *files.JobInfo) *exec.Cmd {
 		zfsArgs = append(zfsArgs, "-o", "origin="+j.Origin)
 	}
 
+	for _, prop := range j.ExcludeProperties {
+		log.AppLogger.Infof("Excluding the %s property (-x) on the receive.", prop)
+		zfsArgs = append(zfsArgs, "-x", prop)
+	}
+
 	zfsArgs = append(zfsArgs, GetLocalVolumeName(j))
-	cmd := exec.CommandContext(ctx, ZFSPath, zfsArgs...)
+	cmd := command(ctx, ZFSPath, zfsArgs...)
 
 	return cmd
 }
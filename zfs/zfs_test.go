@@ -0,0 +1,64 @@
+// Copyright © 2016 Prateek Malhotra (someone1@gmail.com)
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package zfs
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/jdfalk/zfsbackup-go/files"
+)
+
+func TestRequiredPoolFeatures(t *testing.T) {
+	testCases := []struct {
+		name     string
+		jobInfo  files.JobInfo
+		expected []string
+	}{
+		{name: "plain stream"},
+		{name: "large blocks", jobInfo: files.JobInfo{LargeBlocks: true}, expected: []string{"large_blocks"}},
+		{name: "embedded data", jobInfo: files.JobInfo{EmbeddedData: true}, expected: []string{"embedded_data"}},
+		{
+			name:     "large blocks and embedded data",
+			jobInfo:  files.JobInfo{LargeBlocks: true, EmbeddedData: true},
+			expected: []string{"large_blocks", "embedded_data"},
+		},
+		{name: "lz4", jobInfo: files.JobInfo{Compressed: true, StreamCompression: "lz4"}, expected: []string{"lz4_compress"}},
+		{name: "zstd", jobInfo: files.JobInfo{Compressed: true, StreamCompression: "zstd"}, expected: []string{"zstd_compress"}},
+		{name: "zstd level", jobInfo: files.JobInfo{Compressed: true, StreamCompression: "zstd-19"}, expected: []string{"zstd_compress"}},
+		{name: "zstd fast", jobInfo: files.JobInfo{Compressed: true, StreamCompression: "zstd-fast-10"}, expected: []string{"zstd_compress"}},
+		{
+			name:     "zfs compressor",
+			jobInfo:  files.JobInfo{Compressor: files.ZfsCompressor, StreamCompression: "lz4"},
+			expected: []string{"lz4_compress"},
+		},
+		{name: "gzip", jobInfo: files.JobInfo{Compressed: true, StreamCompression: "gzip-9"}},
+		{name: "no compression", jobInfo: files.JobInfo{Compressed: true, StreamCompression: "off"}},
+		{name: "compression not recorded", jobInfo: files.JobInfo{Compressed: true}},
+		{name: "stream not compressed", jobInfo: files.JobInfo{StreamCompression: "zstd"}},
+	}
+
+	for _, tc := range testCases {
+		if features := RequiredPoolFeatures(&tc.jobInfo); !reflect.DeepEqual(features, tc.expected) {
+			t.Errorf("%s: expected the features %v, got %v", tc.name, tc.expected, features)
+		}
+	}
+}